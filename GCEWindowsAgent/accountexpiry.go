@@ -0,0 +1,217 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+const (
+	// createdAccountsRegName is a REG_MULTI_SZ value under regKeyBase holding
+	// a createdAccountJSON for every user the accounts manager created.
+	createdAccountsRegName = "CreatedAccounts"
+
+	expiredKeep    = "keep"
+	expiredDisable = "disable"
+	expiredDelete  = "delete"
+)
+
+var (
+	// accountExpiryRecheck is how often accountExpiryLoop checks whether a
+	// key has expired.
+	accountExpiryRecheck = time.Minute
+
+	// readCreatedAccounts, writeCreatedAccounts, disableAccount and
+	// deleteAccount are replaced in tests.
+	readCreatedAccounts  = func() ([]string, error) { return readRegMultiString(regKeyBase, createdAccountsRegName) }
+	writeCreatedAccounts = func(entries []string) error { return writeRegMultiString(regKeyBase, createdAccountsRegName, entries) }
+	disableAccount       = setUserDisabled
+	deleteAccount        = deleteUser
+
+	expiryMu sync.Mutex
+	// nextAccountExpiry is the earliest expireOn of the keys last applied.
+	nextAccountExpiry time.Time
+)
+
+// createdAccountJSON is an account created by the accounts manager.
+type createdAccountJSON struct {
+	UserName string
+	Disabled bool `json:",omitempty"`
+}
+
+// expiredAccountPolicy returns [accountManager] expired_accounts, what is done
+// with created accounts whose keys expired or were removed from metadata:
+// keep (the default), disable or delete.
+func expiredAccountPolicy(config *ini.File) string {
+	policy := strings.ToLower(config.Section("accountManager").Key("expired_accounts").MustString(expiredKeep))
+	switch policy {
+	case expiredKeep, expiredDisable, expiredDelete:
+		return policy
+	}
+	logger.Errorf("Invalid expired_accounts %q, using %s", policy, expiredKeep)
+	return expiredKeep
+}
+
+// setNextAccountExpiry records the earliest expiry of keys.
+func setNextAccountExpiry(keys []windowsKeyJSON) {
+	var next time.Time
+	for _, k := range keys {
+		t, err := time.Parse(time.RFC3339, k.ExpireOn)
+		if err != nil {
+			continue
+		}
+		if next.IsZero() || t.Before(next) {
+			next = t
+		}
+	}
+	expiryMu.Lock()
+	nextAccountExpiry = next
+	expiryMu.Unlock()
+}
+
+// accountExpiryDue reports whether a key applied last has expired since.
+func accountExpiryDue(now time.Time) bool {
+	expiryMu.Lock()
+	defer expiryMu.Unlock()
+	return !nextAccountExpiry.IsZero() && !now.Before(nextAccountExpiry)
+}
+
+func readCreated() (map[string]createdAccountJSON, error) {
+	entries, err := readCreatedAccounts()
+	if err != nil && err != errRegNotExist {
+		return nil, err
+	}
+	created := map[string]createdAccountJSON{}
+	for _, e := range entries {
+		var a createdAccountJSON
+		if err := json.Unmarshal([]byte(e), &a); err != nil {
+			logger.Errorf("Invalid created account entry %q: %v", e, err)
+			continue
+		}
+		created[strings.ToLower(a.UserName)] = a
+	}
+	return created, nil
+}
+
+func writeCreated(created map[string]createdAccountJSON) error {
+	var entries []string
+	for _, a := range created {
+		data, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, string(data))
+	}
+	sort.Strings(entries)
+	return writeCreatedAccounts(entries)
+}
+
+// expiryAction is what expireAccounts does with a created account, op is
+// expiredDisable, expiredDelete or expiryEnable.
+type expiryAction struct {
+	key string
+	op  string
+}
+
+const expiryEnable = "enable"
+
+// expiryActions returns what policy does with created accounts that have no
+// key in keys and with disabled accounts whose keys are back, by user name.
+func expiryActions(created map[string]createdAccountJSON, keys []windowsKeyJSON, policy string) []expiryAction {
+	active := map[string]bool{}
+	for _, k := range keys {
+		active[strings.ToLower(k.UserName)] = true
+	}
+
+	var names []string
+	for name := range created {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var actions []expiryAction
+	for _, name := range names {
+		a := created[name]
+		switch {
+		case active[name]:
+			if a.Disabled {
+				actions = append(actions, expiryAction{name, expiryEnable})
+			}
+		case policy == expiredDisable && !a.Disabled:
+			actions = append(actions, expiryAction{name, expiredDisable})
+		case policy == expiredDelete:
+			actions = append(actions, expiryAction{name, expiredDelete})
+		}
+	}
+	return actions
+}
+
+// expireAccounts applies policy to created accounts that have no key in keys
+// and enables disabled accounts whose keys are back. Deleted accounts are no
+// longer tracked.
+func expireAccounts(created map[string]createdAccountJSON, keys []windowsKeyJSON, policy string) {
+	for _, act := range expiryActions(created, keys, policy) {
+		a := created[act.key]
+		switch act.op {
+		case expiryEnable:
+			logger.Infoln("Enabling user", a.UserName)
+			if err := disableAccount(a.UserName, false); err != nil {
+				logger.Errorf("Error enabling user %s: %v", a.UserName, err)
+				continue
+			}
+			a.Disabled = false
+			created[act.key] = a
+		case expiredDisable:
+			logger.Infof("Disabling user %s, its keys expired or were removed", a.UserName)
+			if err := disableAccount(a.UserName, true); err != nil {
+				logger.Errorf("Error disabling user %s: %v", a.UserName, err)
+				continue
+			}
+			a.Disabled = true
+			created[act.key] = a
+		case expiredDelete:
+			logger.Infof("Deleting user %s, its keys expired or were removed", a.UserName)
+			if err := deleteAccount(a.UserName); err != nil {
+				logger.Errorf("Error deleting user %s: %v", a.UserName, err)
+				continue
+			}
+			delete(created, act.key)
+		}
+	}
+}
+
+// accountExpiryLoop runs the accounts manager when a key expires, as that
+// changes no metadata, unless expired_accounts is keep.
+func accountExpiryLoop(ctx context.Context) {
+	periodicLoop(ctx, periodicTask{
+		name:     "account expiry",
+		interval: every(accountExpiryRecheck),
+		due: func(cfg *ini.File, now time.Time) bool {
+			return accountExpiryDue(now) && expiredAccountPolicy(cfg) != expiredKeep
+		},
+		run: func(ctx context.Context, cfg *ini.File) error {
+			return runScheduledManager(ctx, cfg, "accountManager", func(md, _ *metadataJSON, cfg *ini.File) manager {
+				return &accounts{newMetadata: md, oldMetadata: md, config: cfg}
+			})
+		},
+	})
+}
@@ -0,0 +1,219 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math/big"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+func TestExpiredAccountPolicy(t *testing.T) {
+	var tests = []struct {
+		data string
+		want string
+	}{
+		{"", expiredKeep},
+		{"[accountManager]\nexpired_accounts=disable", expiredDisable},
+		{"[accountManager]\nexpired_accounts=Delete", expiredDelete},
+		{"[accountManager]\nexpired_accounts=bogus", expiredKeep},
+	}
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := expiredAccountPolicy(cfg); got != tt.want {
+			t.Errorf("expiredAccountPolicy(%q) got: %q, want: %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestExpireAccounts(t *testing.T) {
+	oldDisable, oldDelete := disableAccount, deleteAccount
+	defer func() { disableAccount, deleteAccount = oldDisable, oldDelete }()
+
+	var tests = []struct {
+		policy      string
+		created     map[string]createdAccountJSON
+		want        map[string]createdAccountJSON
+		wantActions []string
+	}{
+		{
+			expiredKeep,
+			map[string]createdAccountJSON{"alice": {UserName: "Alice"}, "bob": {UserName: "bob"}},
+			map[string]createdAccountJSON{"alice": {UserName: "Alice"}, "bob": {UserName: "bob"}},
+			nil,
+		},
+		{
+			expiredDisable,
+			map[string]createdAccountJSON{"alice": {UserName: "Alice"}, "bob": {UserName: "bob"}, "carol": {UserName: "carol", Disabled: true}},
+			map[string]createdAccountJSON{"alice": {UserName: "Alice"}, "bob": {UserName: "bob", Disabled: true}, "carol": {UserName: "carol", Disabled: true}},
+			[]string{"disable bob"},
+		},
+		{
+			expiredDelete,
+			map[string]createdAccountJSON{"alice": {UserName: "Alice", Disabled: true}, "bob": {UserName: "bob"}},
+			map[string]createdAccountJSON{"alice": {UserName: "Alice"}},
+			[]string{"enable Alice", "delete bob"},
+		},
+	}
+
+	for _, tt := range tests {
+		var actions []string
+		disableAccount = func(name string, disabled bool) error {
+			if disabled {
+				actions = append(actions, "disable "+name)
+			} else {
+				actions = append(actions, "enable "+name)
+			}
+			return nil
+		}
+		deleteAccount = func(name string) error {
+			actions = append(actions, "delete "+name)
+			return nil
+		}
+		expireAccounts(tt.created, []windowsKeyJSON{{UserName: "alice"}}, tt.policy)
+		if !reflect.DeepEqual(tt.created, tt.want) {
+			t.Errorf("policy %s: accounts got: %v, want: %v", tt.policy, tt.created, tt.want)
+		}
+		if !reflect.DeepEqual(actions, tt.wantActions) {
+			t.Errorf("policy %s: actions got: %q, want: %q", tt.policy, actions, tt.wantActions)
+		}
+	}
+}
+
+func TestAccountExpiryDue(t *testing.T) {
+	defer setNextAccountExpiry(nil)
+
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	setNextAccountExpiry([]windowsKeyJSON{
+		{ExpireOn: "2018-06-03T00:00:00Z"},
+		{ExpireOn: "2018-06-02T00:00:00Z"},
+		{ExpireOn: "bad"},
+	})
+	if accountExpiryDue(now) {
+		t.Error("accountExpiryDue() before the earliest expiry got: true, want: false")
+	}
+	if !accountExpiryDue(now.Add(24 * time.Hour)) {
+		t.Error("accountExpiryDue() at the earliest expiry got: false, want: true")
+	}
+	setNextAccountExpiry(nil)
+	if accountExpiryDue(now.Add(24 * time.Hour)) {
+		t.Error("accountExpiryDue() without keys got: true, want: false")
+	}
+}
+
+func TestAccountsSetTracksCreated(t *testing.T) {
+	prv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	key := fmt.Sprintf(`{"userName":"gce-test-user-does-not-exist","modulus":%q,"exponent":%q,"expireOn":%q}`,
+		base64.StdEncoding.EncodeToString(prv.PublicKey.N.Bytes()),
+		base64.StdEncoding.EncodeToString(new(big.Int).SetInt64(int64(prv.PublicKey.E)).Bytes()),
+		time.Now().Add(time.Hour).Format(time.RFC3339))
+
+	oldOpen, oldRead, oldWrite, oldDelete := openSerial, readCreatedAccounts, writeCreatedAccounts, deleteAccount
+	defer func() {
+		openSerial, readCreatedAccounts, writeCreatedAccounts, deleteAccount = oldOpen, oldRead, oldWrite, oldDelete
+		setNextAccountExpiry(nil)
+	}()
+	openSerial = func(string) (io.WriteCloser, error) { return &fakeSerialPort{}, nil }
+	stored := []string{`{"UserName":"gone"}`}
+	readCreatedAccounts = func() ([]string, error) { return stored, nil }
+	writeCreatedAccounts = func(entries []string) error {
+		stored = entries
+		return nil
+	}
+	var deleted []string
+	deleteAccount = func(name string) error {
+		deleted = append(deleted, name)
+		return nil
+	}
+
+	cfg, err := ini.InsensitiveLoad([]byte("[accountManager]\nexpired_accounts=delete"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := &metadataJSON{Instance: instanceJSON{Attributes: attributesJSON{WindowsKeys: key}}}
+	if err := (&accounts{newMetadata: md, oldMetadata: &metadataJSON{}, config: cfg}).set(context.Background()); err != nil {
+		t.Fatalf("accounts.set(context.Background()) returned error: %v", err)
+	}
+	if want := []string{`{"UserName":"gce-test-user-does-not-exist"}`}; !reflect.DeepEqual(stored, want) {
+		t.Errorf("created accounts got: %q, want: %q", stored, want)
+	}
+	if want := []string{"gone"}; !reflect.DeepEqual(deleted, want) {
+		t.Errorf("deleted accounts got: %q, want: %q", deleted, want)
+	}
+}
+
+func TestAccountsSetMaxAccountsKeepsCreated(t *testing.T) {
+	prv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	var keys []string
+	for _, user := range []string{"gce-test-user-0", "gce-test-user-1"} {
+		keys = append(keys, fmt.Sprintf(`{"userName":%q,"modulus":%q,"exponent":%q,"expireOn":%q}`, user,
+			base64.StdEncoding.EncodeToString(prv.PublicKey.N.Bytes()),
+			base64.StdEncoding.EncodeToString(new(big.Int).SetInt64(int64(prv.PublicKey.E)).Bytes()),
+			time.Now().Add(time.Hour).Format(time.RFC3339)))
+	}
+
+	oldOpen, oldRead, oldWrite, oldDelete := openSerial, readCreatedAccounts, writeCreatedAccounts, deleteAccount
+	defer func() {
+		openSerial, readCreatedAccounts, writeCreatedAccounts, deleteAccount = oldOpen, oldRead, oldWrite, oldDelete
+		setNextAccountExpiry(nil)
+	}()
+	openSerial = func(string) (io.WriteCloser, error) { return &fakeSerialPort{}, nil }
+	// Both were created before max_accounts was lowered.
+	stored := []string{`{"UserName":"gce-test-user-0"}`, `{"UserName":"gce-test-user-1"}`}
+	readCreatedAccounts = func() ([]string, error) { return stored, nil }
+	writeCreatedAccounts = func(entries []string) error {
+		stored = entries
+		return nil
+	}
+	var deleted []string
+	deleteAccount = func(name string) error {
+		deleted = append(deleted, name)
+		return nil
+	}
+
+	cfg, err := ini.InsensitiveLoad([]byte("[accountManager]\nexpired_accounts=delete\nmax_accounts=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := &metadataJSON{Instance: instanceJSON{Attributes: attributesJSON{WindowsKeys: strings.Join(keys, "\n")}}}
+	if err := (&accounts{newMetadata: md, oldMetadata: &metadataJSON{}, config: cfg}).set(context.Background()); err != nil {
+		t.Fatalf("accounts.set(context.Background()) returned error: %v", err)
+	}
+	if len(deleted) != 0 {
+		t.Errorf("deleted accounts with valid keys over max_accounts: %q", deleted)
+	}
+	if len(stored) != 2 {
+		t.Errorf("created accounts got: %q, want both still tracked", stored)
+	}
+}
@@ -16,6 +16,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
@@ -23,9 +24,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/big"
+	"os"
 	"os/user"
 	"reflect"
-	"strconv"
 	"strings"
 	"time"
 
@@ -44,6 +45,8 @@ type windowsKeyJSON struct {
 	Exponent string
 	Modulus  string
 	UserName string
+	// Groups overrides the groups a created user is added to.
+	Groups []string `json:",omitempty"`
 }
 
 var badExpire []string
@@ -60,19 +63,66 @@ func (k windowsKeyJSON) expired() bool {
 	return t.Before(time.Now())
 }
 
+// passwordPolicy is the part of the local password policy a generated
+// password has to satisfy. Password history needs no check as every password
+// is random.
+type passwordPolicy struct {
+	MinLength int
+	// Complexity requires characters from 3 of the 4 character classes.
+	Complexity bool
+}
+
+const (
+	defaultPwdLength = 15
+	// maxPwdLength is the longest password NetUserAdd accepts.
+	maxPwdLength   = 127
+	maxPwdAttempts = 100
+)
+
+// getPasswordPolicy is replaced in tests.
+var getPasswordPolicy = localPasswordPolicy
+
+var (
+	pwdLower   = []byte("abcdefghijklmnopqrstuvwxyz")
+	pwdUpper   = []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	pwdNumbers = []byte("0123456789")
+	pwdSpecial = []byte(`~!@#$%^&*_-+=|\(){}[]:;<>,.?/`)
+)
+
+// satisfies reports whether pwd meets the policy.
+func (p passwordPolicy) satisfies(pwd string) bool {
+	if len(pwd) < p.MinLength {
+		return false
+	}
+	if !p.Complexity {
+		return true
+	}
+	var classes int
+	for _, chars := range [][]byte{pwdLower, pwdUpper, pwdNumbers, pwdSpecial} {
+		if bytes.ContainsAny(chars, pwd) {
+			classes++
+		}
+	}
+	return classes >= 3
+}
+
 // newPwd will generate a random password that meets Windows complexity
-// requirements: https://technet.microsoft.com/en-us/library/cc786468.
-// Characters that are difficult for users to type on a command line (quotes,
-// non english characters) are not used.
-func newPwd() (string, error) {
-	pwLgth := 15
-	lower := []byte("abcdefghijklmnopqrstuvwxyz")
-	upper := []byte("ABCDEFGHIJKLMNOPQRSTUVWXYZ")
-	numbers := []byte("0123456789")
-	special := []byte(`~!@#$%^&*_-+=|\(){}[]:;<>,.?/`)
-	chars := bytes.Join([][]byte{lower, upper, numbers, special}, nil)
-
-	for {
+// requirements: https://technet.microsoft.com/en-us/library/cc786468, and
+// the local password policy. Characters that are difficult for users to type
+// on a command line (quotes, non english characters) are not used.
+func newPwd(policy passwordPolicy) (string, error) {
+	pwLgth := defaultPwdLength
+	if policy.MinLength > pwLgth {
+		pwLgth = policy.MinLength
+	}
+	if pwLgth > maxPwdLength {
+		return "", fmt.Errorf("password policy minimum length %d is longer than the maximum of %d", policy.MinLength, maxPwdLength)
+	}
+	// Windows complexity requirements are always met, even if not enforced.
+	policy.Complexity = true
+	chars := bytes.Join([][]byte{pwdLower, pwdUpper, pwdNumbers, pwdSpecial}, nil)
+
+	for attempt := 0; attempt < maxPwdAttempts; attempt++ {
 		b := make([]byte, pwLgth)
 		for i := range b {
 			ci, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
@@ -82,45 +132,66 @@ func newPwd() (string, error) {
 			b[i] = chars[ci.Int64()]
 		}
 
-		var l, u, n, s int
-		if bytes.ContainsAny(lower, string(b)) {
-			l = 1
-		}
-		if bytes.ContainsAny(upper, string(b)) {
-			u = 1
-		}
-		if bytes.ContainsAny(numbers, string(b)) {
-			n = 1
-		}
-		if bytes.ContainsAny(special, string(b)) {
-			s = 1
-		}
-		// If the password does not meet Windows complexity requirements, try again.
-		// https://technet.microsoft.com/en-us/library/cc786468
-		if l+u+n+s >= 3 {
+		// If the password does not meet the policy, try again.
+		if policy.satisfies(string(b)) {
 			return string(b), nil
 		}
 	}
+	return "", fmt.Errorf("no password satisfying %+v generated in %d attempts", policy, maxPwdAttempts)
 }
 
-func (k windowsKeyJSON) createOrResetPwd() (*credsJSON, error) {
-	pwd, err := newPwd()
+// lookupDomainUser is replaced in tests.
+var lookupDomainUser = domainUserExists
+
+// createOrResetPwd resets the password of an existing user or creates the
+// user as a member of groups, created reports which. If skipDomainUser is set
+// no local user is created when a domain account with the same name exists.
+func (k windowsKeyJSON) createOrResetPwd(groups []string, admin, skipDomainUser bool) (creds *credsJSON, created bool, err error) {
+	policy, err := getPasswordPolicy()
+	if err != nil {
+		logger.Errorln("Error reading password policy, using defaults:", err)
+	}
+	pwd, err := newPwd(policy)
 	if err != nil {
-		return nil, fmt.Errorf("error creating password: %v", err)
+		return nil, false, fmt.Errorf("error creating password: %v", err)
 	}
 	if _, err := user.Lookup(k.UserName); err == nil {
 		logger.Infoln("Resetting password for user", k.UserName)
 		if err := resetPwd(k.UserName, pwd); err != nil {
-			return nil, fmt.Errorf("error running resetPwd: %v", err)
+			return nil, false, fmt.Errorf("error running resetPwd: %v", err)
+		}
+		// A user denied administrator rights after it was created must not
+		// get a password while it still is one.
+		if !admin {
+			if err := demoteAccount(k.UserName, groups); err != nil {
+				return nil, false, err
+			}
 		}
 	} else {
-		logger.Infoln("Creating user", k.UserName)
-		if err := createAdminUser(k.UserName, pwd); err != nil {
-			return nil, fmt.Errorf("error running createUser: %v", err)
+		if skipDomainUser {
+			exists, err := lookupDomainUser(k.UserName)
+			if err != nil {
+				return nil, false, fmt.Errorf("error looking up domain user: %v", err)
+			}
+			if exists {
+				logger.Infof("Domain account %s exists, not creating a local user", k.UserName)
+				return nil, false, fmt.Errorf("a domain account named %s exists, local user not created", k.UserName)
+			}
+		}
+		logger.Infof("Creating user %s in groups %s", k.UserName, strings.Join(groups, ", "))
+		if err := createUser(k.UserName, pwd, groups[0]); err != nil {
+			return nil, false, fmt.Errorf("error running createUser: %v", err)
+		}
+		created = true
+		for _, g := range groups[1:] {
+			if err := addToGroup(k.UserName, g); err != nil {
+				logger.Errorf("Error adding user %s to group %s: %v", k.UserName, g, err)
+			}
 		}
 	}
 
-	return createcredsJSON(k, pwd)
+	creds, err = createcredsJSON(k, pwd)
+	return creds, created, err
 }
 
 func createcredsJSON(k windowsKeyJSON, pwd string) (*credsJSON, error) {
@@ -152,6 +223,124 @@ func createcredsJSON(k windowsKeyJSON, pwd string) (*credsJSON, error) {
 	}, nil
 }
 
+const (
+	adminGroup           = "Administrators"
+	defaultNonAdminGroup = "Remote Desktop Users"
+)
+
+// splitAccountName splits a domain qualified account name, either
+// DOMAIN\user or user@domain, into lower cased domain and user parts.
+func splitAccountName(name string) (domain, user string) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	if i := strings.Index(name, `\`); i != -1 {
+		return name[:i], name[i+1:]
+	}
+	if i := strings.LastIndex(name, "@"); i != -1 {
+		return name[i+1:], name[:i]
+	}
+	return "", name
+}
+
+// matchAccountName reports whether a configured account name matches
+// username, case insensitively. A name qualified with the local machine
+// (".\user" or "HOSTNAME\user") matches the unqualified local username.
+func matchAccountName(entry, username, hostname string) bool {
+	eDomain, eUser := splitAccountName(entry)
+	uDomain, uUser := splitAccountName(username)
+	if eUser != uUser {
+		return false
+	}
+	if eDomain == uDomain {
+		return true
+	}
+	isLocal := func(d string) bool {
+		return d == "" || d == "." || d == strings.ToLower(hostname)
+	}
+	return isLocal(eDomain) && isLocal(uDomain)
+}
+
+func matchAccountList(list, username, hostname string) bool {
+	for _, entry := range strings.Split(list, ",") {
+		if strings.TrimSpace(entry) != "" && matchAccountName(entry, username, hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// isAdminGroup reports whether group names Administrators, by name or SID.
+func isAdminGroup(group string) bool {
+	g := strings.TrimPrefix(strings.ToLower(group), `builtin\`)
+	return g == strings.ToLower(adminGroup) || g == strings.ToLower(administratorsSID) || g == "*"+strings.ToLower(administratorsSID)
+}
+
+// accountAdmin reports whether username may be an administrator. Users
+// matching admin_denylist never are, if admin_allowlist is set only users
+// matching it are.
+func accountAdmin(config *ini.File, username, hostname string) bool {
+	sec := config.Section("accountManager")
+	if matchAccountList(sec.Key("admin_denylist").String(), username, hostname) {
+		return false
+	}
+	if allow := sec.Key("admin_allowlist").String(); allow != "" {
+		return matchAccountList(allow, username, hostname)
+	}
+	return true
+}
+
+// demoteAccount removes an existing user that may not be an administrator
+// from Administrators and adds it to groups, so it can still log in.
+func demoteAccount(username string, groups []string) error {
+	logger.Infof("Removing user %s from %s, it may not be an administrator", username, adminGroup)
+	if err := localUsers.removeFromGroup(username, adminGroup); err != nil {
+		return fmt.Errorf("error removing user %s from %s: %v", username, adminGroup, err)
+	}
+	for _, g := range groups {
+		if err := localUsers.addToGroup(username, g); err != nil {
+			return fmt.Errorf("error adding user %s to group %s: %v", username, g, err)
+		}
+	}
+	return nil
+}
+
+// accountGroups returns the local groups a newly created user is added to:
+// the groups of its key, [accountManager] groups, or Administrators, in that
+// order. Users that may not be administrators, see accountAdmin, are left out
+// of Administrators. The groups of a key are only used for users that may be
+// administrators, anyone who can add a key could otherwise pick privileged
+// groups. A user left without any group is added to default_group.
+func accountGroups(config *ini.File, key windowsKeyJSON, hostname string) []string {
+	sec := config.Section("accountManager")
+	admin := accountAdmin(config, key.UserName, hostname)
+
+	groups := sec.Key("groups").Strings(",")
+	if len(key.Groups) != 0 {
+		if admin {
+			groups = key.Groups
+		} else {
+			logger.Infof("Ignoring the groups in the key of %s, it may not be an administrator", key.UserName)
+		}
+	}
+	if len(groups) == 0 {
+		groups = []string{adminGroup}
+	}
+	var allowed []string
+	for _, g := range groups {
+		g = strings.TrimSpace(g)
+		if g == "" || containsString(g, allowed) {
+			continue
+		}
+		if !admin && isAdminGroup(g) {
+			continue
+		}
+		allowed = append(allowed, g)
+	}
+	if len(allowed) == 0 {
+		return []string{sec.Key("default_group").MustString(defaultNonAdminGroup)}
+	}
+	return allowed
+}
+
 type accounts struct {
 	newMetadata, oldMetadata *metadataJSON
 	config                   *ini.File
@@ -161,6 +350,14 @@ func (a *accounts) diff() bool {
 	return !reflect.DeepEqual(a.newMetadata.Instance.Attributes.WindowsKeys, a.oldMetadata.Instance.Attributes.WindowsKeys)
 }
 
+func (a *accounts) metadataPaths() []string {
+	return attributePaths
+}
+
+func (a *accounts) diffPaths() []string {
+	return []string{"instance/attributes/windows-keys"}
+}
+
 func (a *accounts) disabled() (disabled bool) {
 	defer func() {
 		if disabled != accountDisabled {
@@ -169,20 +366,19 @@ func (a *accounts) disabled() (disabled bool) {
 		}
 	}()
 
-	var err error
-	disabled, err = strconv.ParseBool(a.config.Section("accountManager").Key("disable").String())
-	if err == nil {
-		return disabled
-	}
-	disabled, err = strconv.ParseBool(a.newMetadata.Instance.Attributes.DisableAccountManager)
-	if err == nil {
-		return disabled
-	}
-	disabled, err = strconv.ParseBool(a.newMetadata.Project.Attributes.DisableAccountManager)
-	if err == nil {
-		return disabled
-	}
-	return accountDisabled
+	return !a.enablement().Enabled
+}
+
+var accountsEnable = enableRule{
+	section:   "accountManager",
+	key:       "disable",
+	attribute: "disable-account-manager",
+	value:     func(a attributesJSON) string { return a.DisableAccountManager },
+	inverted:  true,
+}
+
+func (a *accounts) enablement() enablement {
+	return isEnabled(a.config, a.newMetadata, accountsEnable, !accountDisabled)
 }
 
 type credsJSON struct {
@@ -194,12 +390,15 @@ type credsJSON struct {
 	Modulus           string `json:"modulus,omitempty"`
 }
 
-func printCreds(creds *credsJSON) error {
+// defaultCredsPort is the serial port clients read credential responses from.
+const defaultCredsPort = "COM4"
+
+func printCreds(port string, creds *credsJSON) error {
 	data, err := json.Marshal(creds)
 	if err != nil {
 		return err
 	}
-	return writeSerial("COM4", append(data, []byte("\n")...))
+	return writeSerial(port, append(data, []byte("\n")...))
 }
 
 var badReg []string
@@ -241,9 +440,69 @@ func compareAccounts(newKeys []windowsKeyJSON, oldStrKeys []string) []windowsKey
 	return toAdd
 }
 
+// normalizeAccountNames resolves keys whose user names differ only in case,
+// which Windows treats as the same account. With the default policy,
+// first_wins, keys spelled like the first key for a user are kept and the
+// rest are logged and dropped. lower lower cases all user names and none
+// leaves keys unchanged.
+func normalizeAccountNames(keys []windowsKeyJSON, policy string) []windowsKeyJSON {
+	switch policy {
+	case "none":
+		return keys
+	case "lower":
+		for i := range keys {
+			keys[i].UserName = strings.ToLower(keys[i].UserName)
+		}
+		return keys
+	case "", "first_wins":
+	default:
+		logger.Errorf("Invalid name_normalization %q, using first_wins", policy)
+	}
+
+	first := make(map[string]string)
+	var normalized []windowsKeyJSON
+	for _, key := range keys {
+		lower := strings.ToLower(key.UserName)
+		name, ok := first[lower]
+		if !ok {
+			first[lower] = key.UserName
+		} else if name != key.UserName {
+			logger.Errorf("User name %s collides with %s, ignoring key for %s", key.UserName, name, key.UserName)
+			continue
+		}
+		normalized = append(normalized, key)
+	}
+	return normalized
+}
+
+// limitAccounts keeps the keys of the first max user names, in metadata
+// order, and returns the user names that were skipped. A max of 0 or less is
+// no limit.
+func limitAccounts(keys []windowsKeyJSON, max int) ([]windowsKeyJSON, []string) {
+	if max <= 0 {
+		return keys, nil
+	}
+	var users, skipped []string
+	var limited []windowsKeyJSON
+	for _, key := range keys {
+		if !containsString(key.UserName, users) {
+			if len(users) >= max {
+				if !containsString(key.UserName, skipped) {
+					skipped = append(skipped, key.UserName)
+				}
+				continue
+			}
+			users = append(users, key.UserName)
+		}
+		limited = append(limited, key)
+	}
+	return limited, skipped
+}
+
 var badKeys []string
 
-func (a *accounts) set() error {
+// validKeys returns the valid, unexpired keys in metadata.
+func (a *accounts) validKeys() []windowsKeyJSON {
 	var newKeys []windowsKeyJSON
 	for _, s := range strings.Split(a.newMetadata.Instance.Attributes.WindowsKeys, "\n") {
 		var key windowsKeyJSON
@@ -258,7 +517,51 @@ func (a *accounts) set() error {
 			newKeys = append(newKeys, key)
 		}
 	}
+	return normalizeAccountNames(newKeys, a.config.Section("accountManager").Key("name_normalization").String())
+}
+
+// wantKeys returns the keys of up to max_accounts users from valid, the
+// accounts that are created or have their password reset.
+func (a *accounts) wantKeys(valid []windowsKeyJSON) []windowsKeyJSON {
+	maxAccounts := a.config.Section("accountManager").Key("max_accounts").MustInt(0)
+	keys, skipped := limitAccounts(valid, maxAccounts)
+	if len(skipped) > 0 {
+		logger.Errorf("More than max_accounts (%d) accounts in metadata, skipping %d: %s", maxAccounts, len(skipped), strings.Join(skipped, ", "))
+	}
+	return keys
+}
 
+// plan returns the accounts set would create or reset the password of, and
+// the created accounts it would enable, disable or delete.
+func (a *accounts) plan() ([]string, error) {
+	valid := a.validKeys()
+	regKeys, err := readRegMultiString(regKeyBase, regName)
+	if err != nil && err != errRegNotExist {
+		return nil, err
+	}
+	var changes []string
+	for _, key := range compareAccounts(a.wantKeys(valid), regKeys) {
+		changes = append(changes, fmt.Sprintf("create or reset the password of account %s", key.UserName))
+	}
+
+	created, err := readCreated()
+	if err != nil {
+		return nil, err
+	}
+	for _, act := range expiryActions(created, valid, expiredAccountPolicy(a.config)) {
+		user := created[act.key].UserName
+		if act.op == expiryEnable {
+			changes = append(changes, fmt.Sprintf("enable account %s, its keys are back", user))
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("%s account %s, its keys expired or were removed", act.op, user))
+	}
+	return changes, nil
+}
+
+func (a *accounts) set(ctx context.Context) error {
+	valid := a.validKeys()
+	newKeys := a.wantKeys(valid)
 	regKeys, err := readRegMultiString(regKeyBase, regName)
 	if err != nil && err != errRegNotExist {
 		return err
@@ -266,10 +569,29 @@ func (a *accounts) set() error {
 
 	toAdd := compareAccounts(newKeys, regKeys)
 
+	created, err := readCreated()
+	if err != nil {
+		return err
+	}
+	// Accounts over max_accounts are not created, but existing ones still
+	// have valid keys and are not expired.
+	expireAccounts(created, valid, expiredAccountPolicy(a.config))
+	setNextAccountExpiry(valid)
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.Error(err)
+	}
+	skipDomainUser := a.config.Section("accountManager").Key("skip_if_domain_user").MustBool(false)
+	credsPort := a.config.Section("accountManager").Key("reset_serial_port").MustString(defaultCredsPort)
 	for _, key := range toAdd {
-		creds, err := key.createOrResetPwd()
+		creds, isNew, err := key.createOrResetPwd(accountGroups(a.config, key, hostname), accountAdmin(a.config, key.UserName, hostname), skipDomainUser)
 		if err == nil {
-			printCreds(creds)
+			if isNew {
+				created[strings.ToLower(key.UserName)] = createdAccountJSON{UserName: key.UserName}
+				accountsCreated.inc("")
+			}
+			printCreds(credsPort, creds)
 			continue
 		}
 		logger.Error(err)
@@ -280,7 +602,7 @@ func (a *accounts) set() error {
 			UserName:      key.UserName,
 			ErrorMessage:  err.Error(),
 		}
-		printCreds(creds)
+		printCreds(credsPort, creds)
 	}
 
 	var jsonKeys []string
@@ -293,5 +615,13 @@ func (a *accounts) set() error {
 		}
 		jsonKeys = append(jsonKeys, string(jsn))
 	}
-	return writeRegMultiString(regKeyBase, regName, jsonKeys)
+	if err := writeCreated(created); err != nil {
+		return err
+	}
+	if err := writeRegMultiString(regKeyBase, regName, jsonKeys); err != nil {
+		return err
+	}
+	fp := windowsKeysFingerprint(a.newMetadata)
+	updateAppliedState(func(s *appliedStateJSON) { s.WindowsKeys = fp })
+	return nil
 }
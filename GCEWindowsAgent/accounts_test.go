@@ -15,13 +15,17 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"encoding/base64"
+	"io"
 	"log"
 	"math/big"
+	"os/user"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 	"unicode"
@@ -88,7 +92,7 @@ func TestAccountsDisabled(t *testing.T) {
 
 func TestNewPwd(t *testing.T) {
 	for i := 0; i < 100000; i++ {
-		pwd, err := newPwd()
+		pwd, err := newPwd(passwordPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -114,6 +118,59 @@ func TestNewPwd(t *testing.T) {
 	}
 }
 
+func TestNewPwdPolicy(t *testing.T) {
+	var tests = []struct {
+		policy  passwordPolicy
+		wantLen int
+		wantErr bool
+	}{
+		{passwordPolicy{MinLength: 8, Complexity: true}, 15, false},
+		{passwordPolicy{MinLength: 20, Complexity: true}, 20, false},
+		{passwordPolicy{MinLength: 20}, 20, false},
+		{passwordPolicy{MinLength: maxPwdLength}, maxPwdLength, false},
+		{passwordPolicy{MinLength: maxPwdLength + 1}, 0, true},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 1000; i++ {
+			pwd, err := newPwd(tt.policy)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newPwd(%+v) error got: %v, want error: %t", tt.policy, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				break
+			}
+			if len(pwd) != tt.wantLen {
+				t.Errorf("newPwd(%+v) length got: %d, want: %d", tt.policy, len(pwd), tt.wantLen)
+			}
+			if !tt.policy.satisfies(pwd) || !(passwordPolicy{Complexity: true}).satisfies(pwd) {
+				t.Errorf("newPwd(%+v) = %q does not satisfy the policy", tt.policy, pwd)
+			}
+		}
+	}
+}
+
+func TestPasswordPolicySatisfies(t *testing.T) {
+	var tests = []struct {
+		policy passwordPolicy
+		pwd    string
+		want   bool
+	}{
+		{passwordPolicy{}, "a", true},
+		{passwordPolicy{MinLength: 20}, "aaaaaaaaaaaaaaaaaaa", false},
+		{passwordPolicy{MinLength: 20}, "aaaaaaaaaaaaaaaaaaaa", true},
+		{passwordPolicy{Complexity: true}, "aaaaAAAA", false},
+		{passwordPolicy{Complexity: true}, "aaaaAAAA1", true},
+		{passwordPolicy{Complexity: true}, "aaaa1111!", true},
+	}
+
+	for _, tt := range tests {
+		if got := tt.policy.satisfies(tt.pwd); got != tt.want {
+			t.Errorf("%+v.satisfies(%q) got: %t, want: %t", tt.policy, tt.pwd, got, tt.want)
+		}
+	}
+}
+
 func TestCreatecredsJSON(t *testing.T) {
 	pwd := "password"
 	prv, err := rsa.GenerateKey(rand.Reader, 2048)
@@ -178,6 +235,36 @@ func TestCompareAccounts(t *testing.T) {
 	}
 }
 
+func TestNormalizeAccountNames(t *testing.T) {
+	keys := func() []windowsKeyJSON {
+		return []windowsKeyJSON{
+			{UserName: "Admin", Modulus: "1"},
+			{UserName: "admin", Modulus: "2"},
+			{UserName: "bob", Modulus: "3"},
+			{UserName: "Admin", Modulus: "4"},
+			{UserName: "ADMIN", Modulus: "5"},
+		}
+	}
+
+	var tests = []struct {
+		policy string
+		want   []windowsKeyJSON
+	}{
+		{"", []windowsKeyJSON{{UserName: "Admin", Modulus: "1"}, {UserName: "bob", Modulus: "3"}, {UserName: "Admin", Modulus: "4"}}},
+		{"first_wins", []windowsKeyJSON{{UserName: "Admin", Modulus: "1"}, {UserName: "bob", Modulus: "3"}, {UserName: "Admin", Modulus: "4"}}},
+		{"bogus", []windowsKeyJSON{{UserName: "Admin", Modulus: "1"}, {UserName: "bob", Modulus: "3"}, {UserName: "Admin", Modulus: "4"}}},
+		{"lower", []windowsKeyJSON{{UserName: "admin", Modulus: "1"}, {UserName: "admin", Modulus: "2"}, {UserName: "bob", Modulus: "3"}, {UserName: "admin", Modulus: "4"}, {UserName: "admin", Modulus: "5"}}},
+		{"none", keys()},
+	}
+
+	for _, tt := range tests {
+		got := normalizeAccountNames(keys(), tt.policy)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("normalizeAccountNames(%q) got: %+v, want: %+v", tt.policy, got, tt.want)
+		}
+	}
+}
+
 func TestAccountsLogStatus(t *testing.T) {
 	var buf bytes.Buffer
 	logger.Init("test", "")
@@ -205,3 +292,296 @@ func TestAccountsLogStatus(t *testing.T) {
 		t.Errorf("got: %q, want: %q", buf.String(), want)
 	}
 }
+
+func TestAccountGroups(t *testing.T) {
+	var tests = []struct {
+		name     string
+		data     []byte
+		username string
+		groups   []string
+		want     []string
+	}{
+		{"no lists", []byte(""), "alice", nil, []string{adminGroup}},
+		{"in allowlist", []byte("[accountManager]\nadmin_allowlist=alice,bob"), "alice", nil, []string{adminGroup}},
+		{"not in allowlist", []byte("[accountManager]\nadmin_allowlist=bob"), "alice", nil, []string{defaultNonAdminGroup}},
+		{"allowlist case insensitive", []byte("[accountManager]\nadmin_allowlist=ALICE"), "Alice", nil, []string{adminGroup}},
+		{"in denylist", []byte("[accountManager]\nadmin_denylist=alice"), "alice", nil, []string{defaultNonAdminGroup}},
+		{"not in denylist", []byte("[accountManager]\nadmin_denylist=bob"), "alice", nil, []string{adminGroup}},
+		{"deny wins over allow", []byte("[accountManager]\nadmin_allowlist=alice\nadmin_denylist=alice"), "alice", nil, []string{defaultNonAdminGroup}},
+		{"custom default group", []byte("[accountManager]\nadmin_denylist=alice\ndefault_group=Users"), "alice", nil, []string{"Users"}},
+		{"local machine qualified", []byte("[accountManager]\nadmin_allowlist=.\\alice"), "alice", nil, []string{adminGroup}},
+		{"hostname qualified", []byte("[accountManager]\nadmin_allowlist=MYHOST\\alice"), "alice", nil, []string{adminGroup}},
+		{"upn local machine", []byte("[accountManager]\nadmin_allowlist=alice@myhost"), "alice", nil, []string{adminGroup}},
+		{"other domain", []byte("[accountManager]\nadmin_allowlist=CORP\\alice"), "alice", nil, []string{defaultNonAdminGroup}},
+		{"domain qualified user", []byte("[accountManager]\nadmin_allowlist=corp\\alice"), "CORP\\alice", nil, []string{adminGroup}},
+		{"domain qualified user, upn entry", []byte("[accountManager]\nadmin_allowlist=alice@corp"), "CORP\\alice", nil, []string{adminGroup}},
+		{"configured groups", []byte("[accountManager]\ngroups=Remote Desktop Users, Operators"), "alice", nil, []string{"Remote Desktop Users", "Operators"}},
+		{"key groups override config", []byte("[accountManager]\ngroups=Operators"), "alice", []string{"Users"}, []string{"Users"}},
+		{"denylist removes administrators", []byte("[accountManager]\ngroups=Administrators,Operators\nadmin_denylist=alice"), "alice", nil, []string{"Operators"}},
+		{"denylist removes key administrators", []byte("[accountManager]\nadmin_denylist=alice"), "alice", []string{"administrators"}, []string{defaultNonAdminGroup}},
+		{"key groups ignored when not allowed", []byte("[accountManager]\nadmin_allowlist=bob\ngroups=Operators"), "alice", []string{"Backup Operators"}, []string{"Operators"}},
+		{"denylist removes qualified administrators", []byte("[accountManager]\ngroups=BUILTIN\\Administrators,*S-1-5-32-544,Operators\nadmin_denylist=alice"), "alice", nil, []string{"Operators"}},
+		{"duplicate groups", []byte(""), "alice", []string{"Users", "Users", " "}, []string{"Users"}},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.data)
+		if err != nil {
+			t.Errorf("test case %q: error parsing config: %v", tt.name, err)
+			continue
+		}
+		if got := accountGroups(cfg, windowsKeyJSON{UserName: tt.username, Groups: tt.groups}, "myhost"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("test case %q, accountGroups(%q) got: %q, want: %q", tt.name, tt.username, got, tt.want)
+		}
+	}
+}
+
+func TestCreateOrResetPwdSkipDomainUser(t *testing.T) {
+	prv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	k := windowsKeyJSON{
+		Exponent: base64.StdEncoding.EncodeToString(new(big.Int).SetInt64(int64(prv.PublicKey.E)).Bytes()),
+		Modulus:  base64.StdEncoding.EncodeToString(prv.PublicKey.N.Bytes()),
+		// A user that does not exist locally.
+		UserName: "gce-test-user-does-not-exist",
+	}
+
+	oldLookup := lookupDomainUser
+	defer func() { lookupDomainUser = oldLookup }()
+
+	var tests = []struct {
+		name           string
+		skipDomainUser bool
+		domainUser     bool
+		wantLookup     bool
+		wantErr        bool
+	}{
+		{"domain user exists", true, true, true, true},
+		{"domain user does not exist", true, false, true, false},
+		{"option not set", false, true, false, false},
+	}
+
+	for _, tt := range tests {
+		var looked bool
+		lookupDomainUser = func(string) (bool, error) {
+			looked = true
+			return tt.domainUser, nil
+		}
+		_, _, err := k.createOrResetPwd([]string{adminGroup}, true, tt.skipDomainUser)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("test case %q: createOrResetPwd() error: %v, want error: %t", tt.name, err, tt.wantErr)
+		}
+		if looked != tt.wantLookup {
+			t.Errorf("test case %q: domain lookup got: %t, want: %t", tt.name, looked, tt.wantLookup)
+		}
+	}
+}
+
+func TestCreateOrResetPwdGroups(t *testing.T) {
+	prv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	// The password of an existing user is reset.
+	cur, err := user.Current()
+	if err != nil {
+		t.Skipf("no current user: %v", err)
+	}
+	k := windowsKeyJSON{
+		Exponent: base64.StdEncoding.EncodeToString(new(big.Int).SetInt64(int64(prv.PublicKey.E)).Bytes()),
+		Modulus:  base64.StdEncoding.EncodeToString(prv.PublicKey.N.Bytes()),
+		UserName: cur.Username,
+	}
+
+	oldUsers := localUsers
+	defer func() { localUsers = oldUsers }()
+
+	var tests = []struct {
+		name   string
+		data   string
+		groups []string
+	}{
+		{"admin", "", []string{adminGroup, "Remote Desktop Users"}},
+		{"denylisted", "[accountManager]\nadmin_denylist=" + cur.Username, []string{"Remote Desktop Users"}},
+		{"not allowlisted", "[accountManager]\nadmin_allowlist=someone-else", []string{"Remote Desktop Users"}},
+	}
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		users := fakeLocalUsers{cur.Username: {adminGroup, "Remote Desktop Users"}}
+		localUsers = users
+		creds, created, err := k.createOrResetPwd(accountGroups(cfg, k, "myhost"), accountAdmin(cfg, k.UserName, "myhost"), false)
+		if err != nil {
+			t.Fatalf("test case %q: createOrResetPwd() returned error: %v", tt.name, err)
+		}
+		if created || creds == nil {
+			t.Errorf("test case %q: createOrResetPwd() created: %t, creds: %v, want a reset", tt.name, created, creds)
+		}
+		if got := users[cur.Username]; !reflect.DeepEqual(got, tt.groups) {
+			t.Errorf("test case %q: groups after reset got: %q, want: %q", tt.name, got, tt.groups)
+		}
+	}
+}
+
+func TestLimitAccounts(t *testing.T) {
+	keys := []windowsKeyJSON{
+		{UserName: "a", Modulus: "1"},
+		{UserName: "b"},
+		{UserName: "a", Modulus: "2"},
+		{UserName: "c"},
+		{UserName: "d"},
+		{UserName: "c"},
+	}
+
+	var tests = []struct {
+		max         int
+		wantUsers   []string
+		wantSkipped []string
+	}{
+		{0, []string{"a", "b", "a", "c", "d", "c"}, nil},
+		{2, []string{"a", "b", "a"}, []string{"c", "d"}},
+		{4, []string{"a", "b", "a", "c", "d", "c"}, nil},
+	}
+
+	for _, tt := range tests {
+		got, skipped := limitAccounts(keys, tt.max)
+		var users []string
+		for _, k := range got {
+			users = append(users, k.UserName)
+		}
+		if !reflect.DeepEqual(users, tt.wantUsers) {
+			t.Errorf("limitAccounts(%d) kept: %q, want: %q", tt.max, users, tt.wantUsers)
+		}
+		if !reflect.DeepEqual(skipped, tt.wantSkipped) {
+			t.Errorf("limitAccounts(%d) skipped: %q, want: %q", tt.max, skipped, tt.wantSkipped)
+		}
+	}
+}
+
+func TestAccountsSetMaxAccounts(t *testing.T) {
+	prv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	var keys []string
+	for i := 0; i < 5; i++ {
+		keys = append(keys, fmt.Sprintf(`{"userName":"gce-test-user-%d","modulus":%q,"exponent":%q,"expireOn":%q}`, i,
+			base64.StdEncoding.EncodeToString(prv.PublicKey.N.Bytes()),
+			base64.StdEncoding.EncodeToString(new(big.Int).SetInt64(int64(prv.PublicKey.E)).Bytes()),
+			time.Now().Add(time.Hour).Format(time.RFC3339)))
+	}
+
+	oldOpen := openSerial
+	defer func() { openSerial = oldOpen }()
+	port := &fakeSerialPort{}
+	openSerial = func(string) (io.WriteCloser, error) { return port, nil }
+
+	cfg, err := ini.InsensitiveLoad([]byte("[accountManager]\nmax_accounts=3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := &metadataJSON{Instance: instanceJSON{Attributes: attributesJSON{WindowsKeys: strings.Join(keys, "\n")}}}
+	if err := (&accounts{newMetadata: md, oldMetadata: &metadataJSON{}, config: cfg}).set(context.Background()); err != nil {
+		t.Fatalf("accounts.set(context.Background()) returned error: %v", err)
+	}
+
+	written := bytes.Join(port.writes, nil)
+	for i := 0; i < 5; i++ {
+		user := []byte(fmt.Sprintf(`"userName":"gce-test-user-%d"`, i))
+		if got, want := bytes.Contains(written, user), i < 3; got != want {
+			t.Errorf("gce-test-user-%d processed: %t, want: %t", i, got, want)
+		}
+	}
+}
+
+func TestAccountsSetCredsPort(t *testing.T) {
+	prv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	key := fmt.Sprintf(`{"userName":"gce-test-user-does-not-exist","modulus":%q,"exponent":%q,"expireOn":%q}`,
+		base64.StdEncoding.EncodeToString(prv.PublicKey.N.Bytes()),
+		base64.StdEncoding.EncodeToString(new(big.Int).SetInt64(int64(prv.PublicKey.E)).Bytes()),
+		time.Now().Add(time.Hour).Format(time.RFC3339))
+
+	oldOpen := openSerial
+	defer func() { openSerial = oldOpen }()
+
+	var tests = []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"default port", []byte(""), defaultCredsPort},
+		{"configured port", []byte("[accountManager]\nreset_serial_port=COM2"), "COM2"},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.data)
+		if err != nil {
+			t.Fatalf("test case %q: error parsing config: %v", tt.name, err)
+		}
+		var ports []string
+		port := &fakeSerialPort{}
+		openSerial = func(name string) (io.WriteCloser, error) {
+			ports = append(ports, name)
+			return port, nil
+		}
+
+		md := &metadataJSON{Instance: instanceJSON{Attributes: attributesJSON{WindowsKeys: key}}}
+		if err := (&accounts{newMetadata: md, oldMetadata: &metadataJSON{}, config: cfg}).set(context.Background()); err != nil {
+			t.Errorf("test case %q: accounts.set(context.Background()) returned error: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(ports, []string{tt.want}) {
+			t.Errorf("test case %q: credentials written to %q, want %q", tt.name, ports, tt.want)
+		}
+		if !bytes.Contains(bytes.Join(port.writes, nil), []byte(`"userName":"gce-test-user-does-not-exist"`)) {
+			t.Errorf("test case %q: credentials response not written, got %q", tt.name, port.writes)
+		}
+	}
+}
+
+func TestAccountsPlan(t *testing.T) {
+	prv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	key := func(user string, expire time.Duration) string {
+		return fmt.Sprintf(`{"userName":%q,"modulus":%q,"exponent":%q,"expireOn":%q}`, user,
+			base64.StdEncoding.EncodeToString(prv.PublicKey.N.Bytes()),
+			base64.StdEncoding.EncodeToString(new(big.Int).SetInt64(int64(prv.PublicKey.E)).Bytes()),
+			time.Now().Add(expire).Format(time.RFC3339))
+	}
+
+	oldRead := readCreatedAccounts
+	defer func() { readCreatedAccounts = oldRead }()
+	readCreatedAccounts = func() ([]string, error) {
+		return []string{`{"UserName":"expired-user"}`, `{"UserName":"new-user","Disabled":true}`}, nil
+	}
+
+	md := &metadataJSON{Instance: instanceJSON{Attributes: attributesJSON{WindowsKeys: strings.Join([]string{key("new-user", time.Hour), key("expired-user", -time.Hour)}, "\n")}}}
+	var tests = []struct {
+		policy string
+		want   []string
+	}{
+		{expiredKeep, []string{"create or reset the password of account new-user", "enable account new-user, its keys are back"}},
+		{expiredDelete, []string{"create or reset the password of account new-user", "delete account expired-user, its keys expired or were removed", "enable account new-user, its keys are back"}},
+	}
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte("[accountManager]\nexpired_accounts=" + tt.policy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := (&accounts{newMetadata: md, oldMetadata: &metadataJSON{}, config: cfg}).plan()
+		if err != nil {
+			t.Fatalf("accounts.plan() with policy %s returned error: %v", tt.policy, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("accounts.plan() with policy %s got: %q, want: %q", tt.policy, got, tt.want)
+		}
+	}
+}
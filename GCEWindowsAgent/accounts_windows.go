@@ -26,7 +26,11 @@ var (
 	netAPI32                    = windows.NewLazySystemDLL("netapi32.dll")
 	procNetUserAdd              = netAPI32.NewProc("NetUserAdd")
 	procNetUserSetInfo          = netAPI32.NewProc("NetUserSetInfo")
+	procNetUserGetInfo          = netAPI32.NewProc("NetUserGetInfo")
 	procNetLocalGroupAddMembers = netAPI32.NewProc("NetLocalGroupAddMembers")
+	procNetLocalGroupDelMembers = netAPI32.NewProc("NetLocalGroupDelMembers")
+	procNetUserDel              = netAPI32.NewProc("NetUserDel")
+	procNetUserModalsGet        = netAPI32.NewProc("NetUserModalsGet")
 )
 
 type (
@@ -51,6 +55,18 @@ type (
 	USER_INFO_1003 struct {
 		Usri1003_password LPWSTR
 	}
+
+	USER_INFO_1008 struct {
+		Usri1008_flags DWORD
+	}
+
+	USER_MODALS_INFO_0 struct {
+		Usrmod0_min_passwd_len    DWORD
+		Usrmod0_max_passwd_age    DWORD
+		Usrmod0_min_passwd_age    DWORD
+		Usrmod0_force_logoff      DWORD
+		Usrmod0_password_hist_len DWORD
+	}
 )
 
 const (
@@ -84,6 +100,9 @@ const (
 	UF_NO_AUTH_DATA_REQUIRED                  = 0x2000000
 	UF_PARTIAL_SECRETS_ACCOUNT                = 0x4000000
 	UF_USE_AES_KEYS                           = 0x8000000
+
+	ERROR_MEMBER_NOT_IN_ALIAS = 1377
+	ERROR_MEMBER_IN_ALIAS     = 1378
 )
 
 func resetPwd(username, pwd string) error {
@@ -128,13 +147,93 @@ func addToGroup(username, group string) error {
 		uintptr(1),
 	)
 
-	if ret != 0 {
+	if ret != 0 && ret != ERROR_MEMBER_IN_ALIAS {
 		return fmt.Errorf("nonzero return code from NetLocalGroupAddMembers: %d", ret)
 	}
 	return nil
 }
 
-func createAdminUser(username, pwd string) error {
+func removeFromGroup(username, group string) error {
+	gPtr, err := syscall.UTF16PtrFromString(group)
+	if err != nil {
+		return fmt.Errorf("error encoding group to UTF16: %v", err)
+	}
+
+	sid, _, _, err := syscall.LookupSID("", username)
+	if err != nil {
+		return err
+	}
+
+	sArray := []LOCALGROUP_MEMBERS_INFO_0{{sid}}
+	ret, _, _ := procNetLocalGroupDelMembers.Call(
+		uintptr(0),
+		uintptr(unsafe.Pointer(gPtr)),
+		uintptr(0),
+		uintptr(unsafe.Pointer(&sArray[0])),
+		uintptr(1),
+	)
+
+	if ret != 0 && ret != ERROR_MEMBER_NOT_IN_ALIAS {
+		return fmt.Errorf("nonzero return code from NetLocalGroupDelMembers: %d", ret)
+	}
+	return nil
+}
+
+func deleteUser(username string) error {
+	uPtr, err := syscall.UTF16PtrFromString(username)
+	if err != nil {
+		return fmt.Errorf("error encoding username to UTF16: %v", err)
+	}
+
+	ret, _, _ := procNetUserDel.Call(
+		uintptr(0),
+		uintptr(unsafe.Pointer(uPtr)),
+	)
+	if ret != 0 {
+		return fmt.Errorf("nonzero return code from NetUserDel: %d", ret)
+	}
+	return nil
+}
+
+// setUserDisabled sets or clears UF_ACCOUNTDISABLE on a local user, keeping
+// its other flags.
+func setUserDisabled(username string, disabled bool) error {
+	uPtr, err := syscall.UTF16PtrFromString(username)
+	if err != nil {
+		return fmt.Errorf("error encoding username to UTF16: %v", err)
+	}
+
+	var buf *USER_INFO_1
+	ret, _, _ := procNetUserGetInfo.Call(
+		uintptr(0),
+		uintptr(unsafe.Pointer(uPtr)),
+		uintptr(1),
+		uintptr(unsafe.Pointer(&buf)),
+	)
+	if ret != 0 {
+		return fmt.Errorf("nonzero return code from NetUserGetInfo: %d", ret)
+	}
+	flags := buf.Usri1_flags
+	windows.NetApiBufferFree((*byte)(unsafe.Pointer(buf)))
+
+	if disabled {
+		flags |= UF_ACCOUNTDISABLE
+	} else {
+		flags &^= UF_ACCOUNTDISABLE
+	}
+	ret, _, _ = procNetUserSetInfo.Call(
+		uintptr(0),
+		uintptr(unsafe.Pointer(uPtr)),
+		uintptr(1008),
+		uintptr(unsafe.Pointer(&USER_INFO_1008{flags})),
+		uintptr(0))
+	if ret != 0 {
+		return fmt.Errorf("nonzero return code from NetUserSetInfo: %d", ret)
+	}
+	return nil
+}
+
+func createUser(username, pwd, group string) error {
 	uPtr, err := syscall.UTF16PtrFromString(username)
 	if err != nil {
 		return fmt.Errorf("error encoding username to UTF16: %v", err)
@@ -159,5 +258,43 @@ func createAdminUser(username, pwd string) error {
 	if ret != 0 {
 		return fmt.Errorf("nonzero return code from NetUserAdd: %d", ret)
 	}
-	return addToGroup(username, "Administrators")
+	return addToGroup(username, group)
+}
+
+// domainUserExists reports whether the domain this machine is joined to has
+// an account named username. It returns false if the machine is not domain
+// joined.
+func domainUserExists(username string) (bool, error) {
+	var domain *uint16
+	var status uint32
+	if err := windows.NetGetJoinInformation(nil, &domain, &status); err != nil {
+		return false, err
+	}
+	defer windows.NetApiBufferFree((*byte)(unsafe.Pointer(domain)))
+	if status != windows.NetSetupDomainName {
+		return false, nil
+	}
+
+	_, _, _, err := syscall.LookupSID("", windows.UTF16PtrToString(domain)+`\`+username)
+	if err == windows.ERROR_NONE_MAPPED {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// localPasswordPolicy returns the effective local password policy. The
+// complexity setting is not exposed by NetUserModalsGet, generated passwords
+// always meet it.
+func localPasswordPolicy() (passwordPolicy, error) {
+	var buf *USER_MODALS_INFO_0
+	ret, _, _ := procNetUserModalsGet.Call(
+		uintptr(0),
+		uintptr(0),
+		uintptr(unsafe.Pointer(&buf)),
+	)
+	if ret != 0 {
+		return passwordPolicy{}, fmt.Errorf("nonzero return code from NetUserModalsGet: %d", ret)
+	}
+	defer windows.NetApiBufferFree((*byte)(unsafe.Pointer(buf)))
+	return passwordPolicy{MinLength: int(buf.Usrmod0_min_passwd_len), Complexity: true}, nil
 }
@@ -0,0 +1,365 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+const (
+	defaultKMSHost = "kms.windows.googlecloud.com"
+	kmsPort        = "1688"
+
+	// activationGuestAttribute is the guest attribute the activation state
+	// is reported to.
+	activationGuestAttribute = "windows-activation"
+
+	licenseLicensed     = "Licensed"
+	licenseNotification = "Notification"
+	// licenseNoKey is reported when no product key is installed.
+	licenseNoKey = "No product key"
+
+	// kmsClientChannel is the channel of KMS client setup keys.
+	kmsClientChannel = "VOLUME_KMSCLIENT"
+)
+
+// kmsClientKeys are the KMS client setup keys of the editions that can be
+// activated on GCE, by ProductName. See
+// https://technet.microsoft.com/en-us/library/jj612867.aspx.
+var kmsClientKeys = map[string]string{
+	"Windows Server 2008 R2 Datacenter": "74YFP-3QFB3-KQT8W-PMXWJ-7M648",
+	"Windows Server 2008 R2 Standard":   "YC6KT-GKW9T-YTKYR-T4X34-R7VHC",
+	"Windows Server 2008 R2 Enterprise": "489J6-VHDMP-X63PK-3K798-CPX3Y",
+	"Windows Server 2008 R2 Web":        "6TPJF-RBVHG-WBW2R-86QPH-6RTM4",
+	"Windows Server 2012 Standard":      "XC9B7-NBPP2-83J2H-RHMBY-92BT4",
+	"Windows Server 2012 Datacenter":    "48HP8-DN98B-MYWDG-T2DCC-8W83P",
+	"Windows Server 2012 R2 Standard":   "D2N9P-3P6X9-2R39C-7RTCD-MDVJX",
+	"Windows Server 2012 R2 Datacenter": "W3GGN-FT8W3-Y4M27-J84CP-Q3VJ9",
+	"Windows Server 2016 Standard":      "WC2BQ-8NRM3-FDDYY-2BFGV-KHKQY",
+	"Windows Server 2016 Datacenter":    "CB7KF-BWN84-R7R2Y-793K2-8XDDG",
+	"Windows Server 2019 Standard":      "N69G4-B89J2-4G8F4-WWYCC-J464C",
+	"Windows Server 2019 Datacenter":    "WMDGN-G9PQG-XVVXX-R3X43-63DFG",
+	"Windows Server 2022 Standard":      "VDYBN-27WPP-V4HQT-9VMD4-VMK7H",
+	"Windows Server 2022 Datacenter":    "WX4NM-KYWYW-QJJR4-XV3QB-6VM33",
+	"Windows Server Standard":           "DPCNP-XQFKJ-BJF7R-FRC8D-GF6G4",
+	"Windows Server Datacenter":         "6Y6KB-N82V8-D8CQV-23MJW-BWTG6",
+}
+
+// licenseStatus is the Windows license state from slmgr /dli. Remaining is
+// the grace period or activation validity left, zero if not reported.
+// Channel is the channel of the installed product key, such as
+// VOLUME_KMSCLIENT or RETAIL, empty if no key is installed.
+type licenseStatus struct {
+	Status    string
+	Remaining time.Duration
+	Channel   string
+}
+
+var (
+	remainingRe = regexp.MustCompile(`^(?:Time remaining|Volume activation expiration): (\d+) minute`)
+	channelRe   = regexp.MustCompile(`^Description: .*\b(\w+) channel`)
+)
+
+// parseLicenseStatus parses the output of slmgr /dli.
+func parseLicenseStatus(out []byte) (licenseStatus, error) {
+	var s licenseStatus
+	if bytes.Contains(bytes.ToLower(out), []byte("product key not found")) {
+		s.Status = licenseNoKey
+		return s, nil
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "License Status:") {
+			s.Status = strings.TrimSpace(strings.TrimPrefix(line, "License Status:"))
+		}
+		if m := remainingRe.FindStringSubmatch(line); m != nil {
+			min, _ := strconv.Atoi(m[1])
+			s.Remaining = time.Duration(min) * time.Minute
+		}
+		if m := channelRe.FindStringSubmatch(line); m != nil {
+			s.Channel = m[1]
+		}
+	}
+	if s.Status == "" {
+		return s, fmt.Errorf("no license status in slmgr output: %s", out)
+	}
+	return s, nil
+}
+
+// licensing is the interface to the Windows Software Licensing service.
+type licensing interface {
+	productName() (string, error)
+	status() (licenseStatus, error)
+	setKMSHost(host string) error
+	installKey(key string) error
+	activate() error
+}
+
+// slmgrLicensing runs slmgr.vbs, as activate_instance.ps1 did.
+type slmgrLicensing struct{}
+
+func slmgr(args ...string) ([]byte, error) {
+	script := filepath.Join(os.Getenv("WINDIR"), "System32", "slmgr.vbs")
+	return exec.Command("cscript.exe", append([]string{"//nologo", script}, args...)...).CombinedOutput()
+}
+
+func (slmgrLicensing) productName() (string, error) {
+	out, err := runPowershell(`(Get-ItemProperty 'HKLM:\Software\Microsoft\Windows NT\CurrentVersion').ProductName`)
+	if err != nil {
+		return "", fmt.Errorf("error reading product name: %v, output: %s", err, out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (slmgrLicensing) status() (licenseStatus, error) {
+	out, err := slmgr("/dli")
+	// slmgr fails when no product key is installed, which is a status.
+	if s, perr := parseLicenseStatus(out); perr == nil && s.Status == licenseNoKey {
+		return s, nil
+	}
+	if err != nil {
+		return licenseStatus{}, fmt.Errorf("error reading license status: %v, output: %s", err, out)
+	}
+	return parseLicenseStatus(out)
+}
+
+func (slmgrLicensing) setKMSHost(host string) error {
+	if out, err := slmgr("/skms", host); err != nil {
+		return fmt.Errorf("error setting KMS host: %v, output: %s", err, out)
+	}
+	return nil
+}
+
+func (slmgrLicensing) installKey(key string) error {
+	if out, err := slmgr("/ipk", key); err != nil {
+		return fmt.Errorf("error installing KMS client key: %v, output: %s", err, out)
+	}
+	return nil
+}
+
+func (slmgrLicensing) activate() error {
+	if out, err := slmgr("/ato"); err != nil {
+		return fmt.Errorf("error activating: %v, output: %s", err, out)
+	}
+	return nil
+}
+
+// activationStateJSON is reported to the windows-activation guest attribute.
+type activationStateJSON struct {
+	Status           string `json:"status"`
+	Product          string `json:"product,omitempty"`
+	Channel          string `json:"channel,omitempty"`
+	KMSHost          string `json:"kmsHost,omitempty"`
+	RemainingMinutes int    `json:"remainingMinutes,omitempty"`
+	Error            string `json:"error,omitempty"`
+	Time             string `json:"time"`
+}
+
+var (
+	activationDisabled = true
+	activationSchedule certSchedule
+	// activationBackoff is the wait before retrying a failed activation,
+	// doubled on each failure up to activationRecheck.
+	activationBackoff time.Duration
+
+	// activationRecheck is how often the license status is checked once
+	// activated, activationRetryWait the wait between attempts in a run.
+	activationRecheck   = 24 * time.Hour
+	activationRetryWait = 5 * time.Second
+
+	// licensingMgr and dialKMS are replaced in tests.
+	licensingMgr licensing = slmgrLicensing{}
+	dialKMS                = func(ctx context.Context, addr string) error {
+		c, err := (&net.Dialer{Timeout: 3 * time.Second}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return c.Close()
+	}
+)
+
+type activation struct {
+	newMetadata *metadataJSON
+	config      *ini.File
+}
+
+func (a *activation) diff() bool {
+	return activationSchedule.due(time.Now())
+}
+
+func (a *activation) metadataPaths() []string {
+	// Only configurable locally.
+	return []string{}
+}
+
+func (a *activation) disabled() (disabled bool) {
+	defer func() {
+		if disabled != activationDisabled {
+			activationDisabled = disabled
+			logStatus("activation", disabled)
+		}
+	}()
+
+	return !a.enablement().Enabled
+}
+
+// Activation is opt-in while images still run activate_instance.ps1.
+func (a *activation) enablement() enablement {
+	return isEnabled(a.config, a.newMetadata, enableRule{section: "activation", key: "enable"}, false)
+}
+
+func (a *activation) kmsHost() string {
+	return a.config.Section("activation").Key("kms_host").MustString(defaultKMSHost)
+}
+
+func (a *activation) report(s activationStateJSON) {
+	s.Time = time.Now().UTC().Format(time.RFC3339)
+	data, err := json.Marshal(s)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	writeGuestAttribute(a.config, activationGuestAttribute, string(data))
+}
+
+// logGrace logs the state of an unlicensed instance, an expired grace period
+// is an error as Windows then runs with reduced functionality.
+func logGrace(s licenseStatus) {
+	if s.Status == licenseNotification {
+		logger.Errorf("Windows activation grace period expired, license status: %s", s.Status)
+		return
+	}
+	logger.Infof("Windows is not activated, license status: %s, %s remaining", s.Status, s.Remaining)
+}
+
+func (a *activation) plan() ([]string, error) {
+	s, err := licensingMgr.status()
+	if err != nil {
+		return nil, err
+	}
+	if s.Status == licenseLicensed || (s.Channel != "" && s.Channel != kmsClientChannel) {
+		return nil, nil
+	}
+	return []string{fmt.Sprintf("activate Windows against %s", a.kmsHost())}, nil
+}
+
+// set activates Windows against the KMS host unless it is licensed or has a
+// product key of another channel, trying [activation] attempts times. A failed run is retried with exponential
+// backoff, a licensed instance is checked again daily.
+func (a *activation) set(ctx context.Context) error {
+	host := a.kmsHost()
+	s, err := licensingMgr.status()
+	if err != nil {
+		return a.failed(activationStateJSON{KMSHost: host}, err)
+	}
+	state := activationStateJSON{Status: s.Status, KMSHost: host, Channel: s.Channel, RemainingMinutes: int(s.Remaining / time.Minute)}
+	if s.Status == licenseLicensed {
+		a.succeeded(state)
+		return nil
+	}
+	logGrace(s)
+	// A retail, OEM or MAK key was installed on purpose, replacing it with
+	// the KMS client key would lose it.
+	if s.Channel != "" && s.Channel != kmsClientChannel {
+		logger.Infof("Windows has a %s product key, not activating against KMS.", s.Channel)
+		a.succeeded(state)
+		return nil
+	}
+
+	product, err := licensingMgr.productName()
+	if err != nil {
+		return a.failed(state, err)
+	}
+	state.Product = product
+	key, ok := kmsClientKeys[product]
+	if !ok {
+		logger.Infof("Activation of %s is not supported on GCE, skipping.", product)
+		state.Status = "unsupported"
+		a.succeeded(state)
+		return nil
+	}
+
+	addr := net.JoinHostPort(host, kmsPort)
+	if err := dialKMS(ctx, addr); err != nil {
+		return a.failed(state, fmt.Errorf("error contacting KMS host %s: %v", addr, err))
+	}
+	if err := licensingMgr.setKMSHost(addr); err != nil {
+		return a.failed(state, err)
+	}
+	if err := licensingMgr.installKey(key); err != nil {
+		return a.failed(state, err)
+	}
+	attempts := a.config.Section("activation").Key("attempts").MustInt(3)
+	for i := 1; ; i++ {
+		logger.Infof("Activating %s against %s, attempt %d of %d.", product, addr, i, attempts)
+		err = licensingMgr.activate()
+		if err == nil {
+			if s, err = licensingMgr.status(); err == nil && s.Status != licenseLicensed {
+				err = fmt.Errorf("license status is %s after activation", s.Status)
+			}
+		}
+		if err == nil {
+			break
+		}
+		logger.Errorf("Activation attempt %d failed: %v", i, err)
+		if i >= attempts {
+			return a.failed(state, err)
+		}
+		if !sleepCtx(ctx, time.Duration(i)*activationRetryWait) {
+			return a.failed(state, ctx.Err())
+		}
+	}
+	logger.Infof("Activated %s.", product)
+	state.Status, state.RemainingMinutes = s.Status, int(s.Remaining/time.Minute)
+	a.succeeded(state)
+	return nil
+}
+
+func (a *activation) succeeded(state activationStateJSON) {
+	activationBackoff = 0
+	activationSchedule.set(time.Now().Add(activationRecheck))
+	a.report(state)
+}
+
+// failed reports err and schedules a retry after the next backoff.
+func (a *activation) failed(state activationStateJSON, err error) error {
+	activationBackoff *= 2
+	if activationBackoff == 0 {
+		activationBackoff = 5 * time.Minute
+	}
+	if activationBackoff > activationRecheck {
+		activationBackoff = activationRecheck
+	}
+	activationSchedule.set(time.Now().Add(activationBackoff))
+	state.Error = err.Error()
+	a.report(state)
+	return err
+}
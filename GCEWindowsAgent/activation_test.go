@@ -0,0 +1,157 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+type fakeLicensing struct {
+	product    string
+	statuses   []licenseStatus
+	activateOK bool
+	calls      []string
+}
+
+func (f *fakeLicensing) productName() (string, error) {
+	return f.product, nil
+}
+
+func (f *fakeLicensing) status() (licenseStatus, error) {
+	s := f.statuses[0]
+	if len(f.statuses) > 1 {
+		f.statuses = f.statuses[1:]
+	}
+	return s, nil
+}
+
+func (f *fakeLicensing) setKMSHost(host string) error {
+	f.calls = append(f.calls, "skms "+host)
+	return nil
+}
+
+func (f *fakeLicensing) installKey(key string) error {
+	f.calls = append(f.calls, "ipk "+key)
+	return nil
+}
+
+func (f *fakeLicensing) activate() error {
+	f.calls = append(f.calls, "ato")
+	if !f.activateOK {
+		return errors.New("0xC004F074")
+	}
+	return nil
+}
+
+func TestParseLicenseStatus(t *testing.T) {
+	var tests = []struct {
+		out     string
+		want    licenseStatus
+		wantErr bool
+	}{
+		{"Name: Windows(R), ServerDatacenter edition\r\nLicense Status: Licensed\r\nVolume activation expiration: 259200 minute(s) (180 day(s))\r\n",
+			licenseStatus{"Licensed", 180 * 24 * time.Hour, ""}, false},
+		{"Description: Windows(R) Operating System, VOLUME_KMSCLIENT channel\r\nLicense Status: Initial grace period\r\nTime remaining: 43200 minute(s) (30 day(s))\r\n",
+			licenseStatus{"Initial grace period", 30 * 24 * time.Hour, "VOLUME_KMSCLIENT"}, false},
+		{"Description: Windows(R) Operating System, RETAIL channel\r\nLicense Status: Notification\r\nNotification Reason: 0xC004F009 (grace time expired).\r\n",
+			licenseStatus{"Notification", 0, "RETAIL"}, false},
+		{"Error: product key not found.\r\n", licenseStatus{licenseNoKey, 0, ""}, false},
+		{"Unexpected output\r\n", licenseStatus{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseLicenseStatus([]byte(tt.out))
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseLicenseStatus(%q) got: %+v, %v, want: %+v, error: %t", tt.out, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestActivationSet(t *testing.T) {
+	oldLicensing, oldDial, oldWait, oldPut := licensingMgr, dialKMS, activationRetryWait, putGuestAttribute
+	defer func() {
+		licensingMgr, dialKMS, activationRetryWait, putGuestAttribute = oldLicensing, oldDial, oldWait, oldPut
+		activationSchedule.set(time.Time{})
+		activationBackoff = 0
+	}()
+	activationRetryWait = 0
+
+	grace := licenseStatus{"Initial grace period", time.Hour, kmsClientChannel}
+	licensed := licenseStatus{"Licensed", 180 * 24 * time.Hour, kmsClientChannel}
+	noKey := licenseStatus{licenseNoKey, 0, ""}
+	retail := licenseStatus{"Initial grace period", time.Hour, "RETAIL"}
+	dc := "Windows Server 2016 Datacenter"
+	var tests = []struct {
+		name        string
+		product     string
+		statuses    []licenseStatus
+		activateOK  bool
+		dialErr     error
+		wantCalls   []string
+		wantStatus  string
+		wantErr     bool
+		wantBackoff time.Duration
+	}{
+		{"licensed", dc, []licenseStatus{licensed}, false, nil, nil, "Licensed", false, 0},
+		{"unsupported", "Windows 10 Pro", []licenseStatus{grace}, false, nil, nil, "unsupported", false, 0},
+		{"activated", dc, []licenseStatus{grace, licensed}, true, nil,
+			[]string{"skms kms.windows.googlecloud.com:1688", "ipk CB7KF-BWN84-R7R2Y-793K2-8XDDG", "ato"}, "Licensed", false, 0},
+		{"activation fails", dc, []licenseStatus{grace}, false, nil,
+			[]string{"skms kms.windows.googlecloud.com:1688", "ipk CB7KF-BWN84-R7R2Y-793K2-8XDDG", "ato", "ato", "ato"}, "Initial grace period", true, 5 * time.Minute},
+		{"no key", "Windows Server 2022 Datacenter", []licenseStatus{noKey, licensed}, true, nil,
+			[]string{"skms kms.windows.googlecloud.com:1688", "ipk WX4NM-KYWYW-QJJR4-XV3QB-6VM33", "ato"}, "Licensed", false, 0},
+		{"retail key", dc, []licenseStatus{retail}, false, nil, nil, "Initial grace period", false, 0},
+		{"kms unreachable", dc, []licenseStatus{grace}, false, errors.New("timeout"), nil, "Initial grace period", true, 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		activationBackoff = 0
+		lic := &fakeLicensing{product: tt.product, statuses: tt.statuses, activateOK: tt.activateOK}
+		licensingMgr = lic
+		dialKMS = func(ctx context.Context, addr string) error { return tt.dialErr }
+		var state activationStateJSON
+		putGuestAttribute = func(cfg *ini.File, key, value string) error {
+			if key == activationGuestAttribute {
+				if err := json.Unmarshal([]byte(value), &state); err != nil {
+					t.Error(err)
+				}
+			}
+			return nil
+		}
+
+		a := &activation{newMetadata: &metadataJSON{}, config: ini.Empty()}
+		if err := a.set(context.Background()); (err != nil) != tt.wantErr {
+			t.Errorf("test case %q: set() error: %v, want error: %t", tt.name, err, tt.wantErr)
+		}
+		if !reflect.DeepEqual(lic.calls, tt.wantCalls) {
+			t.Errorf("test case %q: calls got: %q, want: %q", tt.name, lic.calls, tt.wantCalls)
+		}
+		if state.Status != tt.wantStatus || (state.Error != "") != tt.wantErr {
+			t.Errorf("test case %q: reported state got: %+v, want status %q, error: %t", tt.name, state, tt.wantStatus, tt.wantErr)
+		}
+		if activationBackoff != tt.wantBackoff {
+			t.Errorf("test case %q: backoff got: %s, want: %s", tt.name, activationBackoff, tt.wantBackoff)
+		}
+		if a.diff() {
+			t.Errorf("test case %q: diff() after set got: true, want: false", tt.name)
+		}
+	}
+}
@@ -15,21 +15,45 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"reflect"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
 	"github.com/go-ini/ini"
 )
 
 var (
-	addressDisabled  = false
-	addressKey       = regKeyBase + `\ForwardedIps`
+	addressDisabled = false
+	addressKey      = regKeyBase + `\ForwardedIps`
+	// routeKey holds the on-link routes added for alias IP ranges by MAC.
+	routeKey         = regKeyBase + `\ForwardedRoutes`
 	oldWSFCAddresses string
 	oldWSFCEnable    bool
+
+	// pendingRmRegName stores forwarded IPs waiting out removal_grace_sec as
+	// "mac ip unixtime" entries.
+	pendingRmRegName = "PendingAddressRemovals"
+	// addressMu serializes set with the removal grace timer, addressGen is
+	// bumped on every set so stale timers do nothing.
+	addressMu  sync.Mutex
+	addressGen int
+
+	// rerunAddresses runs the address manager once a removal grace period
+	// ends. It goes through runScheduledManager, so it takes updateMu,
+	// reads the current metadata and config, and honours the live migration
+	// pause and dry run like an update. Replaced in tests.
+	rerunAddresses = func() {
+		r := registeredManager("addressManager")
+		if err := runScheduledManager(context.Background(), loadConfig(), r.section, r.build); err != nil {
+			logger.Errorf("Error running the address manager after the removal grace period: %v", err)
+		}
+	}
 )
 
 type addresses struct {
@@ -37,6 +61,13 @@ type addresses struct {
 	config                   *ini.File
 }
 
+// addressPlan collects the changes reconcile would make in a dry run.
+type addressPlan []string
+
+func (p *addressPlan) add(format string, v ...interface{}) {
+	*p = append(*p, fmt.Sprintf(format, v...))
+}
+
 func (a *addresses) parseWSFCAddresses() string {
 	wsfcAddresses := a.config.Section("wsfc").Key("addresses").String()
 	if len(wsfcAddresses) > 0 {
@@ -69,20 +100,22 @@ func (a *addresses) parseWSFCEnable() bool {
 }
 
 func (a *addresses) diff() bool {
+	if changed, ok := addressPause.diff(addressPause.migrating(a.newMetadata, a.config)); ok {
+		return changed
+	}
+
 	wsfcAddresses := a.parseWSFCAddresses()
 	wsfcEnable := a.parseWSFCEnable()
 
-	diff := !reflect.DeepEqual(a.newMetadata.Instance.NetworkInterfaces, a.oldMetadata.Instance.NetworkInterfaces) ||
+	return !reflect.DeepEqual(a.newMetadata.Instance.NetworkInterfaces, a.oldMetadata.Instance.NetworkInterfaces) ||
 		wsfcEnable != oldWSFCEnable || wsfcAddresses != oldWSFCAddresses
+}
 
-	oldWSFCAddresses = wsfcAddresses
-	oldWSFCEnable = wsfcEnable
-	return diff
+func (a *addresses) metadataPaths() []string {
+	return append([]string{"instance/network-interfaces", "instance/maintenance-event"}, attributePaths...)
 }
 
 func (a *addresses) disabled() (disabled bool) {
-	var err error
-
 	defer func() {
 		if disabled != addressDisabled {
 			addressDisabled = disabled
@@ -90,19 +123,19 @@ func (a *addresses) disabled() (disabled bool) {
 		}
 	}()
 
-	disabled, err = strconv.ParseBool(a.config.Section("addressManager").Key("disable").String())
-	if err == nil {
-		return disabled
-	}
-	disabled, err = strconv.ParseBool(a.newMetadata.Instance.Attributes.DisableAddressManager)
-	if err == nil {
-		return disabled
-	}
-	disabled, err = strconv.ParseBool(a.newMetadata.Project.Attributes.DisableAddressManager)
-	if err == nil {
-		return disabled
-	}
-	return addressDisabled
+	return !a.enablement().Enabled
+}
+
+var addressesEnable = enableRule{
+	section:   "addressManager",
+	key:       "disable",
+	attribute: "disable-address-manager",
+	value:     func(a attributesJSON) string { return a.DisableAddressManager },
+	inverted:  true,
+}
+
+func (a *addresses) enablement() enablement {
+	return isEnabled(a.config, a.newMetadata, addressesEnable, !addressDisabled)
 }
 
 func compareIPs(regFwdIPs, mdFwdIPs, cfgIPs []string) (toAdd []string, toRm []string) {
@@ -121,16 +154,201 @@ func compareIPs(regFwdIPs, mdFwdIPs, cfgIPs []string) (toAdd []string, toRm []st
 	return
 }
 
+// compareIPsByFamily runs compareIPs for IPv4 and IPv6 addresses separately.
+func compareIPsByFamily(regFwdIPs, mdFwdIPs, cfgIPs []string) (toAdd []string, toRm []string) {
+	for _, v6 := range []bool{false, true} {
+		add, rm := compareIPs(filterFamily(regFwdIPs, v6), filterFamily(mdFwdIPs, v6), filterFamily(cfgIPs, v6))
+		toAdd = append(toAdd, add...)
+		toRm = append(toRm, rm...)
+	}
+	return
+}
+
+// filterFamily returns the IPv6 addresses in ips if v6 is set, the IPv4
+// addresses otherwise.
+func filterFamily(ips []string, v6 bool) []string {
+	var filtered []string
+	for _, ip := range ips {
+		if parsed := net.ParseIP(ip); parsed != nil && (parsed.To4() == nil) == v6 {
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
+
+// wantIPs returns the addresses to add to an interface: its forwarded IPv4
+// and IPv6 addresses and alias IP ranges, in canonical form. IPv6 addresses
+// are left out if [addressManager] ipv6 is false.
+func (a *addresses) wantIPs(ni networkInterfacesJSON) []string {
+	ipv6 := a.config.Section("addressManager").Key("ipv6").MustBool(true)
+	var ips []string
+	for _, ip := range append(append(append([]string(nil), ni.ForwardedIps...), ni.ForwardedIpv6s...), a.aliasIPs(ni.IPAliases)...) {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			logger.Errorln("Invalid forwarded IP", ip)
+			continue
+		}
+		if parsed.To4() == nil && !ipv6 {
+			continue
+		}
+		if s := parsed.String(); !containsString(s, ips) {
+			ips = append(ips, s)
+		}
+	}
+	return ips
+}
+
+func readPendingRemovals() map[string]time.Time {
+	pending := make(map[string]time.Time)
+	entries, err := readRegMultiString(regKeyBase, pendingRmRegName)
+	if err != nil && err != errRegNotExist {
+		logger.Error(err)
+	}
+	for _, e := range entries {
+		fields := strings.Fields(e)
+		if len(fields) != 3 {
+			continue
+		}
+		sec, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		pending[fields[0]+" "+fields[1]] = time.Unix(sec, 0)
+	}
+	return pending
+}
+
+func writePendingRemovals(pending map[string]time.Time) error {
+	var entries []string
+	for k, t := range pending {
+		entries = append(entries, fmt.Sprintf("%s %d", k, t.Unix()))
+	}
+	return writeRegMultiString(regKeyBase, pendingRmRegName, entries)
+}
+
+// graceRemovals returns the IPs in toRm that have been missing from metadata
+// for at least grace. IPs still within the grace period are copied from
+// oldPending, or added with the current time, to newPending. IPs that are not
+// in toRm this cycle are dropped, restarting their grace period.
+func graceRemovals(mac string, toRm []string, oldPending, newPending map[string]time.Time, now time.Time, grace time.Duration) []string {
+	if grace <= 0 {
+		return toRm
+	}
+	var remove []string
+	for _, ip := range toRm {
+		k := mac + " " + ip
+		since, ok := oldPending[k]
+		if !ok {
+			since = now
+		}
+		if now.Sub(since) >= grace {
+			remove = append(remove, ip)
+			continue
+		}
+		newPending[k] = since
+	}
+	return remove
+}
+
 var badMAC []string
 
-func (a *addresses) set() error {
+func (a *addresses) set(ctx context.Context) (err error) {
+	if addressPause.skip(addressPause.migrating(a.newMetadata, a.config)) {
+		return nil
+	}
+	defer func() { addressPause.done(err) }()
+	addressMu.Lock()
+	defer addressMu.Unlock()
+	addressGen++
+	// Recorded here rather than in diff so a diff only audit does not hide
+	// WSFC changes from the next update.
+	oldWSFCAddresses = a.parseWSFCAddresses()
+	oldWSFCEnable = a.parseWSFCEnable()
+	return a.reconcile(nil)
+}
+
+// plan returns the address and route changes set would make.
+func (a *addresses) plan() ([]string, error) {
+	if addressPause.migrating(a.newMetadata, a.config) {
+		return []string{"pause until the live migration completes"}, nil
+	}
+	addressMu.Lock()
+	defer addressMu.Unlock()
+	var p addressPlan
+	err := a.reconcile(&p)
+	return p, err
+}
+
+// scheduleReconcile runs the address manager again after d unless set has
+// run since. The caller holds addressMu.
+func (a *addresses) scheduleReconcile(d time.Duration) {
+	gen := addressGen
+	time.AfterFunc(d, func() {
+		addressMu.Lock()
+		stale := gen != addressGen
+		addressMu.Unlock()
+		if !stale {
+			rerunAddresses()
+		}
+	})
+}
+
+// addressChange is the planned change to the forwarded IPs of one interface.
+type addressChange struct {
+	mac         string
+	index       uint32
+	toAdd, toRm []string
+	reg         []string
+}
+
+// movedIPs splits toRm for the interface with mac into the addresses that
+// metadata now assigns to another interface, by owner, and the rest.
+func movedIPs(mac string, toRm []string, owner map[string]string) (moved, rest []string) {
+	for _, ip := range toRm {
+		if m, ok := owner[ip]; ok && m != mac {
+			moved = append(moved, ip)
+		} else {
+			rest = append(rest, ip)
+		}
+	}
+	return
+}
+
+// reconcile programs the forwarded IPs of each metadata network interface on
+// the adapter with its MAC address. Addresses are removed from every adapter
+// before any are added, so an address moving between interfaces is never
+// on two at once. If plan is not nil the changes are added to it instead of
+// being made.
+func (a *addresses) reconcile(plan *addressPlan) error {
 	ifs, err := net.Interfaces()
 	if err != nil {
 		return err
 	}
 
+	grace := time.Duration(a.config.Section("addressManager").Key("removal_grace_sec").MustInt(0)) * time.Second
+	oldPending := readPendingRemovals()
+	newPending := make(map[string]time.Time)
+	now := time.Now()
+
 	a.applyWSFCFilter()
+	a.applyDuplicateFilter()
 
+	add, remove := addAddress, removeAddress
+	if a.config.Section("addressManager").Key("use_netsh").MustBool(false) {
+		add, remove = netshAddAddress, netshRemoveAddress
+	}
+
+	// owner maps each wanted address to the MAC of its interface.
+	owner := make(map[string]string)
+	for _, ni := range a.newMetadata.Instance.NetworkInterfaces {
+		if mac, err := net.ParseMAC(ni.Mac); err == nil {
+			for _, ip := range a.wantIPs(ni) {
+				owner[ip] = mac.String()
+			}
+		}
+	}
+
+	var changes []*addressChange
 	for _, ni := range a.newMetadata.Instance.NetworkInterfaces {
 		mac, err := net.ParseMAC(ni.Mac)
 		if err != nil {
@@ -150,41 +368,55 @@ func (a *addresses) set() error {
 			// check for those and clean them up.
 			oldName := strings.Replace(mac.String(), ":", "", -1)
 			regFwdIPs, err = readRegMultiString(addressKey, oldName)
-			if err == nil {
+			if err != nil {
+				regFwdIPs = nil
+			} else if plan == nil {
 				// Ignore error here as this is just cleanup.
 				deleteRegKey(addressKey, oldName)
-			} else {
-				regFwdIPs = nil
 			}
 		}
 
-		var iface net.Interface
-		for _, i := range ifs {
-			if i.HardwareAddr.String() == mac.String() {
-				iface = i
-			}
-		}
-
-		if reflect.DeepEqual(net.Interface{}, iface) {
+		iface, err := interfaceByMAC(ni.Mac, ifs)
+		if err != nil {
 			if !containsString(ni.Mac, badMAC) {
-				logger.Errorf("no interface with mac %s exists on system", mac)
+				logger.Error(err)
 				badMAC = append(badMAC, ni.Mac)
 			}
 			continue
 		}
 
-		addrs, err := iface.Addrs()
+		a.reconcileRoutes(mac.String(), uint32(iface.Index), ni, plan)
+
+		cfgIPs, err := listAddresses(uint32(iface.Index))
 		if err != nil {
 			logger.Error(err)
 			continue
 		}
 
-		var cfgIPs []string
-		for _, addr := range addrs {
-			cfgIPs = append(cfgIPs, strings.TrimSuffix(addr.String(), "/32"))
+		wantIPs := a.wantIPs(ni)
+		logger.Debugf("Interface %s: metadata IPs %q, configured IPs %q, registry IPs %q", mac, wantIPs, cfgIPs, regFwdIPs)
+		toAdd, allRm := compareIPsByFamily(regFwdIPs, wantIPs, cfgIPs)
+		// Addresses that moved to another interface are removed right away.
+		moved, toRm := movedIPs(mac.String(), allRm, owner)
+		toRm = append(moved, graceRemovals(mac.String(), toRm, oldPending, newPending, now, grace)...)
+		if plan != nil {
+			for _, ip := range toRm {
+				plan.add("remove forwarded IP %s from %s", ip, mac)
+			}
+			for _, ip := range toAdd {
+				plan.add("add forwarded IP %s to %s", ip, mac)
+			}
+			continue
+		}
+		var deferred []string
+		for _, ip := range allRm {
+			if !containsString(ip, toRm) {
+				deferred = append(deferred, ip)
+			}
+		}
+		if len(deferred) != 0 {
+			logger.Infof("Deferring removal of forwarded IPs %q from %s for up to %s", deferred, mac, grace)
 		}
-
-		toAdd, toRm := compareIPs(regFwdIPs, ni.ForwardedIps, cfgIPs)
 		if len(toAdd) != 0 || len(toRm) != 0 {
 			// Remove non configured IPs from registry list.
 			for _, ip := range toAdd {
@@ -195,7 +427,7 @@ func (a *addresses) set() error {
 					}
 				}
 			}
-			msg := fmt.Sprintf("Changing forwarded IPs for %s from %q to %q by", mac, regFwdIPs, ni.ForwardedIps)
+			msg := fmt.Sprintf("Changing forwarded IPs for %s from %q to %q by", mac, regFwdIPs, wantIPs)
 			if len(toAdd) != 0 {
 				msg += fmt.Sprintf(" adding %q", toAdd)
 			}
@@ -208,32 +440,254 @@ func (a *addresses) set() error {
 			logger.Info(msg, ".")
 		}
 
-		reg := ni.ForwardedIps
-		for _, ip := range toAdd {
-			if err := addAddress(net.ParseIP(ip), net.ParseIP("255.255.255.255"), uint32(iface.Index)); err != nil {
+		// Keep tracking deferred IPs so they are removed once the grace period
+		// expires.
+		changes = append(changes, &addressChange{
+			mac:   mac.String(),
+			index: uint32(iface.Index),
+			toAdd: toAdd,
+			toRm:  toRm,
+			reg:   append(wantIPs, deferred...),
+		})
+	}
+	if plan != nil {
+		return nil
+	}
+
+	for _, c := range changes {
+		for _, ip := range c.toRm {
+			if err := remove(net.ParseIP(ip), c.index); err != nil {
 				logger.Error(err)
-				for i, rIP := range reg {
+				c.reg = append(c.reg, ip)
+				continue
+			}
+			forwardedIPChanges.inc("remove")
+		}
+	}
+	// Gratuitous ARPs let upstream caches follow an address taken over from
+	// another instance without waiting for their entries to expire.
+	announce := a.config.Section("addressManager").Key("gratuitous_arp").MustBool(true)
+	for _, c := range changes {
+		for _, ip := range c.toAdd {
+			if err := add(net.ParseIP(ip), net.ParseIP("255.255.255.255"), c.index); err != nil {
+				logger.Error(err)
+				for i, rIP := range c.reg {
 					if rIP == ip {
-						reg = append(reg[:i], reg[i+1:]...)
+						c.reg = append(c.reg[:i], c.reg[i+1:]...)
 						break
 					}
 				}
+				continue
 			}
+			forwardedIPChanges.inc("add")
+			if announce {
+				if err := announceAddress(net.ParseIP(ip), c.index); err != nil {
+					logger.Errorf("Error announcing forwarded IP %s: %v", ip, err)
+				}
+			}
+		}
+		if err := writeRegMultiString(addressKey, c.mac, c.reg); err != nil {
+			logger.Error(err)
 		}
+	}
+	updateAppliedState(func(s *appliedStateJSON) {
+		if s.ForwardedIPs == nil {
+			s.ForwardedIPs = make(map[string][]string)
+		}
+		for _, c := range changes {
+			s.ForwardedIPs[c.mac] = c.reg
+		}
+	})
 
-		for _, ip := range toRm {
-			if err := removeAddress(net.ParseIP(ip), uint32(iface.Index)); err != nil {
+	if len(newPending) != 0 || len(oldPending) != 0 {
+		if err := writePendingRemovals(newPending); err != nil {
+			logger.Error(err)
+		}
+	}
+	var next time.Duration
+	for _, since := range newPending {
+		if d := since.Add(grace).Sub(now); next == 0 || d < next {
+			next = d
+		}
+	}
+	if next > 0 {
+		a.scheduleReconcile(next)
+	}
+	return nil
+}
+
+// maxAliasAddresses is the largest alias IP range that is added address by
+// address, maxAliasPrefixBits its host bits.
+const (
+	maxAliasAddresses  = 1 << maxAliasPrefixBits
+	maxAliasPrefixBits = 8
+)
+
+var badAlias []string
+
+// parseRange parses an IP range in CIDR notation, a single address is a range
+// of one.
+func parseRange(r string) (*net.IPNet, error) {
+	if !strings.Contains(r, "/") {
+		if strings.Contains(r, ":") {
+			r += "/128"
+		} else {
+			r += "/32"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(r)
+	return ipNet, err
+}
+
+// routeRanges returns the ranges in [addressManager] route_ranges, which are
+// added as on-link routes rather than address by address.
+func (a *addresses) routeRanges() []string {
+	var ranges []string
+	for _, r := range strings.Split(a.config.Section("addressManager").Key("route_ranges").String(), ",") {
+		if r = strings.TrimSpace(r); r == "" {
+			continue
+		}
+		ipNet, err := parseRange(r)
+		if err != nil {
+			if !containsString(r, badAlias) {
 				logger.Error(err)
-				reg = append(reg, ip)
+				badAlias = append(badAlias, r)
 			}
+			continue
+		}
+		ranges = append(ranges, ipNet.String())
+	}
+	return ranges
+}
+
+// wantRoutes returns the alias IP ranges of an interface listed in
+// route_ranges.
+func (a *addresses) wantRoutes(ni networkInterfacesJSON) []string {
+	if !a.config.Section("addressManager").Key("ip_aliases").MustBool(true) {
+		return nil
+	}
+	ipv6 := a.config.Section("addressManager").Key("ipv6").MustBool(true)
+	routeRanges := a.routeRanges()
+	var routes []string
+	for _, alias := range ni.IPAliases {
+		ipNet, err := parseRange(alias)
+		if err != nil || !containsString(ipNet.String(), routeRanges) {
+			continue
+		}
+		if ipNet.IP.To4() == nil && !ipv6 {
+			continue
+		}
+		if !containsString(ipNet.String(), routes) {
+			routes = append(routes, ipNet.String())
 		}
+	}
+	return routes
+}
+
+// reconcileRoutes adds the on-link routes wanted for an interface and removes
+// the ones it added before that are no longer wanted.
+func (a *addresses) reconcileRoutes(mac string, index uint32, ni networkInterfacesJSON, plan *addressPlan) {
+	want := a.wantRoutes(ni)
+	reg, err := readRegMultiString(routeKey, mac)
+	if err != nil && err != errRegNotExist {
+		logger.Error(err)
+		return
+	}
+	if len(want) == 0 && len(reg) == 0 {
+		return
+	}
 
-		if err := writeRegMultiString(addressKey, mac.String(), reg); err != nil {
+	var keep []string
+	for _, r := range reg {
+		if containsString(r, want) {
+			continue
+		}
+		_, ipNet, _ := net.ParseCIDR(r)
+		if ipNet == nil {
+			continue
+		}
+		if plan != nil {
+			plan.add("remove the route for %s from %s", r, mac)
+			continue
+		}
+		logger.Infof("Removing route for %s from %s.", r, mac)
+		if err := removeRoute(ipNet, index); err != nil {
 			logger.Error(err)
+			keep = append(keep, r)
 		}
 	}
+	for _, r := range want {
+		_, ipNet, _ := net.ParseCIDR(r)
+		if plan != nil {
+			if !containsString(r, reg) {
+				plan.add("add a route for %s to %s", r, mac)
+			}
+			continue
+		}
+		if !containsString(r, reg) {
+			logger.Infof("Adding route for %s to %s.", r, mac)
+		}
+		// Added every time so a route deleted outside the agent comes back.
+		if err := addRoute(ipNet, index); err != nil {
+			logger.Error(err)
+			continue
+		}
+		keep = append(keep, r)
+	}
+	if plan != nil {
+		return
+	}
+	if err := writeRegMultiString(routeKey, mac, keep); err != nil {
+		logger.Error(err)
+	}
+}
 
-	return nil
+// aliasIPs returns the addresses in the IPv4 and IPv6 alias IP ranges of an
+// interface, unless [addressManager] ip_aliases is false. Every address is
+// added like a forwarded IP, ranges larger than maxAliasAddresses are skipped.
+// Ranges in route_ranges are added as routes instead, see wantRoutes.
+func (a *addresses) aliasIPs(aliases []string) []string {
+	if !a.config.Section("addressManager").Key("ip_aliases").MustBool(true) {
+		return nil
+	}
+	routeRanges := a.routeRanges()
+	var ips []string
+	for _, alias := range aliases {
+		ipNet, err := parseRange(alias)
+		if err == nil {
+			if containsString(ipNet.String(), routeRanges) {
+				continue
+			}
+			if ones, bits := ipNet.Mask.Size(); bits-ones > maxAliasPrefixBits {
+				err = fmt.Errorf("alias IP range %s is larger than %d addresses", alias, maxAliasAddresses)
+			}
+		}
+		if err != nil {
+			if !containsString(alias, badAlias) {
+				logger.Error(err)
+				badAlias = append(badAlias, alias)
+			}
+			continue
+		}
+		for ip := ipNet.IP; ipNet.Contains(ip); ip = nextIP(ip) {
+			if s := ip.String(); !containsString(s, ips) {
+				ips = append(ips, s)
+			}
+		}
+	}
+	return ips
+}
+
+// nextIP returns the address after ip.
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		if next[i]++; next[i] != 0 {
+			break
+		}
+	}
+	return next
 }
 
 // Filter out forwarded ips based on WSFC (Windows Failover Cluster Settings).
@@ -248,32 +702,81 @@ func (a *addresses) applyWSFCFilter() {
 			continue
 		}
 
-		if net.ParseIP(wsfcAddr) == nil {
+		ip := net.ParseIP(wsfcAddr)
+		if ip == nil {
 			logger.Errorln("ip address for wsfc is not in valid form", wsfcAddr)
 			continue
 		}
 
-		wsfcAddrs = append(wsfcAddrs, wsfcAddr)
+		wsfcAddrs = append(wsfcAddrs, ip.String())
 	}
 
 	if len(wsfcAddrs) != 0 {
 		interfaces := a.newMetadata.Instance.NetworkInterfaces
 		for idx := range interfaces {
-			var filteredList []string
-			for _, ip := range interfaces[idx].ForwardedIps {
-				if !containsString(ip, wsfcAddrs) {
-					filteredList = append(filteredList, ip)
-				}
-			}
-
-			interfaces[idx].ForwardedIps = filteredList
+			interfaces[idx].ForwardedIps = filterWSFCAddrs(interfaces[idx].ForwardedIps, wsfcAddrs)
+			interfaces[idx].ForwardedIpv6s = filterWSFCAddrs(interfaces[idx].ForwardedIpv6s, wsfcAddrs)
 		}
 	} else {
 		wsfcEnable := a.parseWSFCEnable()
 		if wsfcEnable {
 			for idx := range a.newMetadata.Instance.NetworkInterfaces {
 				a.newMetadata.Instance.NetworkInterfaces[idx].ForwardedIps = nil
+				a.newMetadata.Instance.NetworkInterfaces[idx].ForwardedIpv6s = nil
+			}
+		}
+	}
+}
+
+// filterWSFCAddrs returns the ips not in wsfcAddrs, comparing IPv6 addresses
+// in canonical form.
+func filterWSFCAddrs(ips, wsfcAddrs []string) []string {
+	var filteredList []string
+	for _, ip := range ips {
+		canonical := ip
+		if parsed := net.ParseIP(ip); parsed != nil {
+			canonical = parsed.String()
+		}
+		if !containsString(canonical, wsfcAddrs) {
+			filteredList = append(filteredList, ip)
+		}
+	}
+	return filteredList
+}
+
+// Filter out forwarded ips that appear on more than one interface, applying
+// each only to the first interface listing it so the instance does not ARP for
+// the same address on two NICs. If duplicate_ip_priority is set to a MAC
+// address that interface is considered first.
+func (a *addresses) applyDuplicateFilter() {
+	interfaces := a.newMetadata.Instance.NetworkInterfaces
+	order := make([]int, 0, len(interfaces))
+	if priority, err := net.ParseMAC(a.config.Section("addressManager").Key("duplicate_ip_priority").String()); err == nil {
+		for idx, ni := range interfaces {
+			if mac, err := net.ParseMAC(ni.Mac); err == nil && mac.String() == priority.String() {
+				order = append(order, idx)
+			}
+		}
+	}
+	for idx := range interfaces {
+		if len(order) == 0 || order[0] != idx {
+			order = append(order, idx)
+		}
+	}
+
+	owner := make(map[string]string)
+	for _, idx := range order {
+		var filteredList []string
+		for _, ip := range interfaces[idx].ForwardedIps {
+			if mac, ok := owner[ip]; ok {
+				if mac != interfaces[idx].Mac {
+					logger.Errorf("Forwarded ip %s is assigned to both %s and %s, only applying it to %s", ip, mac, interfaces[idx].Mac, mac)
+				}
+				continue
 			}
+			owner[ip] = interfaces[idx].Mac
+			filteredList = append(filteredList, ip)
 		}
+		interfaces[idx].ForwardedIps = filteredList
 	}
 }
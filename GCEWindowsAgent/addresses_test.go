@@ -19,6 +19,7 @@ import (
 	"log"
 	"reflect"
 	"testing"
+	"time"
 
 	"bytes"
 
@@ -65,6 +66,198 @@ func TestCompareIPs(t *testing.T) {
 
 }
 
+func TestAliasIPs(t *testing.T) {
+	var tests = []struct {
+		name    string
+		data    string
+		aliases []string
+		want    []string
+	}{
+		{"none", "", nil, nil},
+		{"single address", "", []string{"10.1.0.5"}, []string{"10.1.0.5"}},
+		{"single address range", "", []string{"10.1.0.5/32"}, []string{"10.1.0.5"}},
+		{"range", "", []string{"10.1.0.4/30"}, []string{"10.1.0.4", "10.1.0.5", "10.1.0.6", "10.1.0.7"}},
+		{"unaligned range", "", []string{"10.1.0.5/31"}, []string{"10.1.0.4", "10.1.0.5"}},
+		{"overlapping ranges", "", []string{"10.1.0.4/31", "10.1.0.5"}, []string{"10.1.0.4", "10.1.0.5"}},
+		{"too large", "", []string{"10.1.0.0/23", "10.2.0.1"}, []string{"10.2.0.1"}},
+		{"invalid", "", []string{"10.1.0.300", "fd00::/64"}, nil},
+		{"IPv6 address", "", []string{"fd00::1"}, []string{"fd00::1"}},
+		{"IPv6 range", "", []string{"fd00::ff/127"}, []string{"fd00::fe", "fd00::ff"}},
+		{"disabled", "[addressManager]\nip_aliases=false", []string{"10.1.0.5"}, nil},
+		{"route range", "[addressManager]\nroute_ranges=10.1.0.4/30", []string{"10.1.0.4/30", "10.2.0.1"}, []string{"10.2.0.1"}},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := (&addresses{config: cfg}).aliasIPs(tt.aliases); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("test case %q: aliasIPs(%q) got: %q, want: %q", tt.name, tt.aliases, got, tt.want)
+		}
+	}
+
+	if got := (&addresses{config: ini.Empty()}).aliasIPs([]string{"10.1.0.0/24"}); len(got) != maxAliasAddresses {
+		t.Errorf("aliasIPs() of a /24 returned %d addresses, want %d", len(got), maxAliasAddresses)
+	}
+}
+
+func TestWantRoutes(t *testing.T) {
+	var tests = []struct {
+		name    string
+		data    string
+		aliases []string
+		want    []string
+	}{
+		{"none", "[addressManager]\nroute_ranges=10.1.0.0/16", nil, nil},
+		{"not configured", "", []string{"10.1.0.0/16"}, nil},
+		{"configured", "[addressManager]\nroute_ranges=10.1.0.0/16, fd00::/64", []string{"10.1.0.0/16", "10.2.0.1", "fd00::/64"}, []string{"10.1.0.0/16", "fd00::/64"}},
+		{"canonicalized", "[addressManager]\nroute_ranges=10.1.0.5/24", []string{"10.1.0.0/24"}, []string{"10.1.0.0/24"}},
+		{"no ipv6", "[addressManager]\nroute_ranges=fd00::/64\nipv6=false", []string{"fd00::/64"}, nil},
+		{"aliases disabled", "[addressManager]\nroute_ranges=10.1.0.0/16\nip_aliases=false", []string{"10.1.0.0/16"}, nil},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ni := networkInterfacesJSON{IPAliases: tt.aliases}
+		if got := (&addresses{config: cfg}).wantRoutes(ni); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("test case %q: wantRoutes(%q) got: %q, want: %q", tt.name, tt.aliases, got, tt.want)
+		}
+	}
+}
+
+func TestCompareIPsByFamily(t *testing.T) {
+	reg := []string{"1.2.3.4", "fd00::1"}
+	md := []string{"1.2.3.5", "fd00::1", "fd00::2"}
+	cfg := []string{"1.2.3.4", "fd00::1", "fe80::1"}
+	toAdd, toRm := compareIPsByFamily(reg, md, cfg)
+	if want := []string{"1.2.3.5", "fd00::2"}; !reflect.DeepEqual(toAdd, want) {
+		t.Errorf("toAdd got: %q, want: %q", toAdd, want)
+	}
+	if want := []string{"1.2.3.4"}; !reflect.DeepEqual(toRm, want) {
+		t.Errorf("toRm got: %q, want: %q", toRm, want)
+	}
+}
+
+func TestWantIPs(t *testing.T) {
+	ni := networkInterfacesJSON{
+		ForwardedIps:   []string{"1.2.3.4", "bogus"},
+		ForwardedIpv6s: []string{"FD00:0::1", "fd00::1"},
+		IPAliases:      []string{"10.1.0.4/31", "fd00::2"},
+	}
+	var tests = []struct {
+		data string
+		want []string
+	}{
+		{"", []string{"1.2.3.4", "fd00::1", "10.1.0.4", "10.1.0.5", "fd00::2"}},
+		{"[addressManager]\nipv6=false", []string{"1.2.3.4", "10.1.0.4", "10.1.0.5"}},
+	}
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := (&addresses{config: cfg}).wantIPs(ni); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("wantIPs() with config %q got: %q, want: %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestMovedIPs(t *testing.T) {
+	owner := map[string]string{"1.2.3.4": "aa", "1.2.3.5": "bb"}
+	var tests = []struct {
+		mac               string
+		toRm, moved, rest []string
+	}{
+		{"aa", []string{"1.2.3.5"}, []string{"1.2.3.5"}, nil},
+		{"aa", []string{"1.2.3.6"}, nil, []string{"1.2.3.6"}},
+		{"bb", []string{"1.2.3.4", "1.2.3.6"}, []string{"1.2.3.4"}, []string{"1.2.3.6"}},
+		{"bb", nil, nil, nil},
+	}
+	for _, tt := range tests {
+		moved, rest := movedIPs(tt.mac, tt.toRm, owner)
+		if !reflect.DeepEqual(moved, tt.moved) || !reflect.DeepEqual(rest, tt.rest) {
+			t.Errorf("movedIPs(%q, %q) = %q, %q, want %q, %q", tt.mac, tt.toRm, moved, rest, tt.moved, tt.rest)
+		}
+	}
+}
+
+func TestGraceRemovals(t *testing.T) {
+	mac := "00:00:00:00:00:01"
+	start := time.Now()
+	grace := 30 * time.Second
+
+	var tests = []struct {
+		name        string
+		offset      time.Duration
+		toRm        []string
+		wantRemove  []string
+		wantPending int
+	}{
+		{"ip disappears", 0, []string{"192.168.0.1"}, nil, 1},
+		{"ip reappears", 10 * time.Second, nil, nil, 0},
+		{"ip disappears again", 20 * time.Second, []string{"192.168.0.1"}, nil, 1},
+		// Only 25s since it disappeared again, the first absence is forgotten.
+		{"still within grace", 45 * time.Second, []string{"192.168.0.1"}, nil, 1},
+		{"grace expires", 50 * time.Second, []string{"192.168.0.1"}, []string{"192.168.0.1"}, 0},
+	}
+
+	pending := map[string]time.Time{}
+	for _, tt := range tests {
+		newPending := map[string]time.Time{}
+		got := graceRemovals(mac, tt.toRm, pending, newPending, start.Add(tt.offset), grace)
+		if !reflect.DeepEqual(got, tt.wantRemove) {
+			t.Errorf("test case %q: graceRemovals() got: %q, want: %q", tt.name, got, tt.wantRemove)
+		}
+		if len(newPending) != tt.wantPending {
+			t.Errorf("test case %q: pending got: %v, want %d entries", tt.name, newPending, tt.wantPending)
+		}
+		pending = newPending
+	}
+
+	// No grace period removes immediately.
+	if got := graceRemovals(mac, []string{"192.168.0.1"}, nil, map[string]time.Time{}, start, 0); !reflect.DeepEqual(got, []string{"192.168.0.1"}) {
+		t.Errorf("graceRemovals() with no grace got: %q", got)
+	}
+}
+
+func TestScheduleReconcile(t *testing.T) {
+	oldRerun := rerunAddresses
+	defer func() { rerunAddresses = oldRerun }()
+
+	var tests = []struct {
+		name    string
+		setRuns bool
+		want    bool
+	}{
+		{"grace period ends", false, true},
+		{"set ran since", true, false},
+	}
+	for _, tt := range tests {
+		ran := make(chan struct{}, 1)
+		rerunAddresses = func() { ran <- struct{}{} }
+		addressMu.Lock()
+		(&addresses{}).scheduleReconcile(10 * time.Millisecond)
+		if tt.setRuns {
+			addressGen++
+		}
+		addressMu.Unlock()
+
+		var got bool
+		select {
+		case <-ran:
+			got = true
+		case <-time.After(100 * time.Millisecond):
+		}
+		if got != tt.want {
+			t.Errorf("test case %q: address manager rerun got: %t, want: %t", tt.name, got, tt.want)
+		}
+	}
+}
+
 func TestAddressDisabled(t *testing.T) {
 	var tests = []struct {
 		name string
@@ -117,6 +310,7 @@ func TestAddressDiff(t *testing.T) {
 		{"disabled in instance metadata only", []byte(""), &metadataJSON{Instance: instanceJSON{Attributes: attributesJSON{EnableWSFC: "false"}}}, false},
 		{"enabled in instance metadata, disabled in project metadata", []byte(""), &metadataJSON{Instance: instanceJSON{Attributes: attributesJSON{EnableWSFC: "true"}}, Project: projectJSON{Attributes: attributesJSON{EnableWSFC: "false"}}}, true},
 		{"disabled in project metadata only", []byte(""), &metadataJSON{Project: projectJSON{Attributes: attributesJSON{EnableWSFC: "false"}}}, false},
+		{"alias IP range added", []byte(""), &metadataJSON{Instance: instanceJSON{NetworkInterfaces: []networkInterfacesJSON{{IPAliases: []string{"10.1.0.0/30"}}}}}, true},
 	}
 
 	oldMetadata := &metadataJSON{}
@@ -137,6 +331,52 @@ func TestAddressDiff(t *testing.T) {
 	}
 }
 
+func TestAddressDiffMigration(t *testing.T) {
+	defer func() { addressPause.paused = false }()
+	ni := []networkInterfacesJSON{{Mac: "00:00:00:00:00:01", ForwardedIps: []string{"192.168.0.1"}}}
+	niChanged := []networkInterfacesJSON{{Mac: "00:00:00:00:00:01", ForwardedIps: []string{"192.168.0.2"}}}
+
+	var tests = []struct {
+		name  string
+		cfg   []byte
+		event string
+		ifs   []networkInterfacesJSON
+		want  bool
+		// wantSkip is whether set skips, when it runs.
+		wantSkip bool
+	}{
+		{"initial", []byte(""), "NONE", ni, true, false},
+		{"no change", []byte(""), "NONE", ni, false, false},
+		{"migration starts", []byte(""), "MIGRATE_ON_HOST_MAINTENANCE", niChanged, true, true},
+		{"migrating", []byte(""), "MIGRATE_ON_HOST_MAINTENANCE", ni, false, false},
+		{"migration ends", []byte(""), "NONE", ni, true, false},
+		{"resumed", []byte(""), "NONE", ni, false, false},
+		{"pause disabled", []byte("[addressManager]\npause_during_migration=false"), "MIGRATE_ON_HOST_MAINTENANCE", niChanged, true, false},
+	}
+
+	oldMetadata := &metadataJSON{}
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.cfg)
+		if err != nil {
+			t.Fatalf("test case %q: error parsing config: %v", tt.name, err)
+		}
+		md := &metadataJSON{Instance: instanceJSON{MaintenanceEvent: tt.event, NetworkInterfaces: tt.ifs}}
+		got := (&addresses{oldMetadata: oldMetadata, newMetadata: md, config: cfg}).diff()
+		if got != tt.want {
+			t.Errorf("test case %q, addresses.diff() got: %t, want: %t", tt.name, got, tt.want)
+		}
+		if got {
+			// The pause part of set.
+			if skip := addressPause.skip(addressPause.migrating(md, cfg)); skip != tt.wantSkip {
+				t.Errorf("test case %q, set skipped: %t, want: %t", tt.name, skip, tt.wantSkip)
+			} else if !skip {
+				addressPause.done(nil)
+			}
+		}
+		oldMetadata = md
+	}
+}
+
 func TestWsfcFilter(t *testing.T) {
 	var tests = []struct {
 		metaData    []byte
@@ -150,6 +390,8 @@ func TestWsfcFilter(t *testing.T) {
 		{[]byte(`{"instance":{"attributes":{"wsfc-addrs":"192.168.0.1"}, "networkInterfaces":[{"forwardedIps":["192.168.0.0", "192.168.0.1"]}]}}`), []string{"192.168.0.0"}},
 		// filter with both wsfc-addrs and enable-wsfc flag
 		{[]byte(`{"instance":{"attributes":{"wsfc-addrs":"192.168.0.1", "enable-wsfc":"true"}, "networkInterfaces":[{"forwardedIps":["192.168.0.0", "192.168.0.1"]}]}}`), []string{"192.168.0.0"}},
+		// filter IPv6 forwarded IPs with wsfc-addrs in another form
+		{[]byte(`{"instance":{"attributes":{"wsfc-addrs":"fd00:0::1"}, "networkInterfaces":[{"forwardedIps":["192.168.0.0"], "forwardedIpv6s":["fd00::1", "fd00::2"]}]}}`), []string{"192.168.0.0", "fd00::2"}},
 		// filter with invalid wsfc-addrs
 		{[]byte(`{"instance":{"attributes":{"wsfc-addrs":"192.168.0"}, "networkInterfaces":[{"forwardedIps":["192.168.0.0", "192.168.0.1"]}]}}`), []string{"192.168.0.0", "192.168.0.1"}},
 	}
@@ -166,6 +408,7 @@ func TestWsfcFilter(t *testing.T) {
 		forwardedIps := []string{}
 		for _, ni := range testAddress.newMetadata.Instance.NetworkInterfaces {
 			forwardedIps = append(forwardedIps, ni.ForwardedIps...)
+			forwardedIps = append(forwardedIps, ni.ForwardedIpv6s...)
 		}
 
 		if !reflect.DeepEqual(forwardedIps, tt.expectedIps) {
@@ -174,6 +417,42 @@ func TestWsfcFilter(t *testing.T) {
 	}
 }
 
+func TestDuplicateFilter(t *testing.T) {
+	var tests = []struct {
+		name     string
+		cfg      string
+		metaData []byte
+		want     [][]string
+	}{
+		{"no duplicates", "", []byte(`{"instance":{"networkInterfaces":[{"mac":"00:00:00:00:00:01","forwardedIps":["192.168.0.0"]},{"mac":"00:00:00:00:00:02","forwardedIps":["192.168.0.1"]}]}}`), [][]string{{"192.168.0.0"}, {"192.168.0.1"}}},
+		{"duplicate goes to first", "", []byte(`{"instance":{"networkInterfaces":[{"mac":"00:00:00:00:00:01","forwardedIps":["192.168.0.0","192.168.0.1"]},{"mac":"00:00:00:00:00:02","forwardedIps":["192.168.0.1","192.168.0.2"]}]}}`), [][]string{{"192.168.0.0", "192.168.0.1"}, {"192.168.0.2"}}},
+		{"duplicate goes to priority", "[addressManager]\nduplicate_ip_priority=00-00-00-00-00-02", []byte(`{"instance":{"networkInterfaces":[{"mac":"00:00:00:00:00:01","forwardedIps":["192.168.0.0","192.168.0.1"]},{"mac":"00:00:00:00:00:02","forwardedIps":["192.168.0.1","192.168.0.2"]}]}}`), [][]string{{"192.168.0.0"}, {"192.168.0.1", "192.168.0.2"}}},
+		{"duplicate within one interface", "", []byte(`{"instance":{"networkInterfaces":[{"mac":"00:00:00:00:00:01","forwardedIps":["192.168.0.0","192.168.0.0"]}]}}`), [][]string{{"192.168.0.0"}}},
+	}
+
+	for _, tt := range tests {
+		var metadata metadataJSON
+		if err := json.Unmarshal(tt.metaData, &metadata); err != nil {
+			t.Fatalf("test case %q: invalid metadata: %v", tt.name, err)
+		}
+		cfg, err := ini.InsensitiveLoad([]byte(tt.cfg))
+		if err != nil {
+			t.Fatalf("test case %q: invalid config: %v", tt.name, err)
+		}
+
+		testAddress := addresses{&metadata, nil, cfg}
+		testAddress.applyDuplicateFilter()
+
+		var got [][]string
+		for _, ni := range testAddress.newMetadata.Instance.NetworkInterfaces {
+			got = append(got, ni.ForwardedIps)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("test case %q: duplicate filter got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
 func TestWsfcFlagTriggerAddressDiff(t *testing.T) {
 	var tests = []struct {
 		newMetadata, oldMetadata *metadataJSON
@@ -189,7 +468,7 @@ func TestWsfcFlagTriggerAddressDiff(t *testing.T) {
 		oldWSFCAddresses = tt.oldMetadata.Instance.Attributes.WSFCAddresses
 		testAddress := addresses{tt.newMetadata, tt.oldMetadata, ini.Empty()}
 		if !testAddress.diff() {
-			t.Errorf("old: %q new: %q doesn't tirgger diff.", tt.oldMetadata, tt.newMetadata)
+			t.Errorf("old: %+v new: %+v doesn't tirgger diff.", tt.oldMetadata, tt.newMetadata)
 		}
 	}
 }
@@ -34,13 +34,36 @@ var (
 	procInitializeUnicastIpAddressEntry = ipHlpAPI.NewProc("InitializeUnicastIpAddressEntry")
 	procGetUnicastIpAddressEntry        = ipHlpAPI.NewProc("GetUnicastIpAddressEntry")
 	procDeleteUnicastIpAddressEntry     = ipHlpAPI.NewProc("DeleteUnicastIpAddressEntry")
+	procGetUnicastIpAddressTable        = ipHlpAPI.NewProc("GetUnicastIpAddressTable")
+	procFreeMibTable                    = ipHlpAPI.NewProc("FreeMibTable")
+	procSendARP                         = ipHlpAPI.NewProc("SendARP")
+	procInitializeIpForwardEntry        = ipHlpAPI.NewProc("InitializeIpForwardEntry")
+	procCreateIpForwardEntry2           = ipHlpAPI.NewProc("CreateIpForwardEntry2")
+	procDeleteIpForwardEntry2           = ipHlpAPI.NewProc("DeleteIpForwardEntry2")
+
+	procNotifyAddrChange = ipHlpAPI.NewProc("NotifyAddrChange")
 )
 
 const (
-	AF_NET   = 2
-	AF_INET6 = 23
+	AF_UNSPEC = 0
+	AF_NET    = 2
+	AF_INET6  = 23
+
+	ERROR_BAD_NET_NAME          = 67
+	ERROR_NOT_FOUND             = 1168
+	ERROR_OBJECT_ALREADY_EXISTS = 5010
 )
 
+// ipHelperError is a nonzero return code from an IP Helper API function.
+type ipHelperError struct {
+	fn   string
+	code uintptr
+}
+
+func (e *ipHelperError) Error() string {
+	return fmt.Sprintf("nonzero return code from %s: %d (%s)", e.fn, e.code, syscall.Errno(e.code))
+}
+
 type in_addr struct {
 	S_un struct {
 		S_addr uint32
@@ -57,6 +80,36 @@ type SOCKADDR_INET struct {
 	si_family int16
 }
 
+type SOCKADDR_IN6 struct {
+	sin6_family   uint16
+	sin6_port     uint16
+	sin6_flowinfo uint32
+	sin6_addr     [16]byte
+	sin6_scope_id uint32
+}
+
+// MIB_UNICASTIPADDRESS_ROW6 is MIB_UNICASTIPADDRESS_ROW with the address
+// union laid out as its largest member, SOCKADDR_IN6.
+type MIB_UNICASTIPADDRESS_ROW6 struct {
+	Address            SOCKADDR_IN6
+	InterfaceLuid      uint64
+	InterfaceIndex     uint32
+	PrefixOrigin       uint32
+	SuffixOrigin       uint32
+	ValidLifetime      uint32
+	PreferredLifetime  uint32
+	OnLinkPrefixLength uint8
+	SkipAsSource       uint8
+	DadState           uint32
+	ScopeId            uint32
+	CreationTimeStamp  int64
+}
+
+type MIB_UNICASTIPADDRESS_TABLE6 struct {
+	NumEntries uint32
+	Table      [1]MIB_UNICASTIPADDRESS_ROW6
+}
+
 type NET_LUID struct {
 	Value uint64
 	Info  struct {
@@ -77,22 +130,160 @@ type MIB_UNICASTIPADDRESS_ROW struct {
 	SkipAsSource       bool
 }
 
+// MIB_IPFORWARD_ROW2 with SOCKADDR_INET laid out as SOCKADDR_IN6, see
+// MIB_UNICASTIPADDRESS_ROW6.
+type MIB_IPFORWARD_ROW2 struct {
+	InterfaceLuid        uint64
+	InterfaceIndex       uint32
+	DestinationPrefix    SOCKADDR_IN6
+	PrefixLength         uint8
+	NextHop              SOCKADDR_IN6
+	SitePrefixLength     uint8
+	ValidLifetime        uint32
+	PreferredLifetime    uint32
+	Metric               uint32
+	Protocol             uint32
+	Loopback             uint8
+	AutoconfigureAddress uint8
+	Publish              uint8
+	Immortal             uint8
+	Age                  uint32
+	Origin               uint32
+}
+
+// sockaddrInet returns ip as a SOCKADDR_INET. An IPv4 SOCKADDR_IN keeps its
+// address where SOCKADDR_IN6 has sin6_flowinfo.
+func sockaddrInet(ip net.IP) SOCKADDR_IN6 {
+	var sa SOCKADDR_IN6
+	if ip4 := ip.To4(); ip4 != nil {
+		sa.sin6_family = AF_NET
+		sa.sin6_flowinfo = binary.LittleEndian.Uint32(ip4)
+		return sa
+	}
+	sa.sin6_family = AF_INET6
+	copy(sa.sin6_addr[:], ip.To16())
+	return sa
+}
+
+// ipForwardRow returns the on-link route for ipNet on the interface with
+// index, the next hop is the unspecified address.
+func ipForwardRow(ipNet *net.IPNet, index uint32) *MIB_IPFORWARD_ROW2 {
+	row := new(MIB_IPFORWARD_ROW2)
+	// No return value.
+	procInitializeIpForwardEntry.Call(uintptr(unsafe.Pointer(row)))
+
+	ones, _ := ipNet.Mask.Size()
+	row.InterfaceIndex = index
+	row.DestinationPrefix = sockaddrInet(ipNet.IP)
+	row.PrefixLength = uint8(ones)
+	row.NextHop.sin6_family = row.DestinationPrefix.sin6_family
+	return row
+}
+
+func addRoute(ipNet *net.IPNet, index uint32) error {
+	if err := procCreateIpForwardEntry2.Find(); err != nil {
+		return fmt.Errorf("cannot add route for %s: %v", ipNet, err)
+	}
+	if ret, _, _ := procCreateIpForwardEntry2.Call(uintptr(unsafe.Pointer(ipForwardRow(ipNet, index)))); ret != 0 && ret != ERROR_OBJECT_ALREADY_EXISTS {
+		return &ipHelperError{"CreateIpForwardEntry2", ret}
+	}
+	return nil
+}
+
+func removeRoute(ipNet *net.IPNet, index uint32) error {
+	if err := procDeleteIpForwardEntry2.Find(); err != nil {
+		return fmt.Errorf("cannot remove route for %s: %v", ipNet, err)
+	}
+	if ret, _, _ := procDeleteIpForwardEntry2.Call(uintptr(unsafe.Pointer(ipForwardRow(ipNet, index)))); ret != 0 && ret != ERROR_NOT_FOUND {
+		return &ipHelperError{"DeleteIpForwardEntry2", ret}
+	}
+	return nil
+}
+
 func addAddress(ip, mask net.IP, index uint32) error {
 	// CreateUnicastIpAddressEntry only available Vista onwards.
 	if err := procCreateUnicastIpAddressEntry.Find(); err != nil {
+		if ip.To4() == nil {
+			return fmt.Errorf("cannot add IPv6 address %s: %v", ip, err)
+		}
 		return addIPAddress(ip, mask, index)
 	}
+	if ip.To4() == nil {
+		return createUnicastIpAddressEntry6(ip, index)
+	}
 	return createUnicastIpAddressEntry(ip, 32, index)
 }
 
 func removeAddress(ip net.IP, index uint32) error {
 	// DeleteUnicastIpAddressEntry only available Vista onwards.
 	if err := procDeleteUnicastIpAddressEntry.Find(); err != nil {
+		if ip.To4() == nil {
+			return fmt.Errorf("cannot remove IPv6 address %s: %v", ip, err)
+		}
 		return deleteIPAddress(ip)
 	}
+	if ip.To4() == nil {
+		return deleteUnicastIpAddressEntry6(ip, index)
+	}
 	return deleteUnicastIpAddressEntry(ip, index)
 }
 
+// announceAddress sends a gratuitous ARP request, with ip as both the sender
+// and target address, so neighbours update their caches right away. The IP
+// Helper API has no way to send an unsolicited neighbor advertisement, IPv6
+// addresses are not announced.
+func announceAddress(ip net.IP, index uint32) error {
+	if ip.To4() == nil {
+		return nil
+	}
+	addr := binary.LittleEndian.Uint32(ip.To4())
+	var mac [8]byte
+	macLen := uint32(len(mac))
+	// Nothing answers for our own address, so no reply is expected.
+	if ret, _, _ := procSendARP.Call(uintptr(addr), uintptr(addr), uintptr(unsafe.Pointer(&mac[0])), uintptr(unsafe.Pointer(&macLen))); ret != 0 && ret != ERROR_BAD_NET_NAME {
+		return &ipHelperError{"SendARP", ret}
+	}
+	return nil
+}
+
+func unicastIpAddressRow6(ip net.IP, index uint32) *MIB_UNICASTIPADDRESS_ROW6 {
+	ipRow := new(MIB_UNICASTIPADDRESS_ROW6)
+	// No return value.
+	procInitializeUnicastIpAddressEntry.Call(uintptr(unsafe.Pointer(ipRow)))
+
+	ipRow.InterfaceIndex = index
+	ipRow.Address.sin6_family = AF_INET6
+	copy(ipRow.Address.sin6_addr[:], ip.To16())
+	return ipRow
+}
+
+func createUnicastIpAddressEntry6(ip net.IP, index uint32) error {
+	ipRow := unicastIpAddressRow6(ip, index)
+	ipRow.OnLinkPrefixLength = 128
+	ipRow.SkipAsSource = 1
+
+	if ret, _, _ := procCreateUnicastIpAddressEntry.Call(uintptr(unsafe.Pointer(ipRow))); ret != 0 && ret != ERROR_OBJECT_ALREADY_EXISTS {
+		return &ipHelperError{"CreateUnicastIpAddressEntry", ret}
+	}
+	return nil
+}
+
+func deleteUnicastIpAddressEntry6(ip net.IP, index uint32) error {
+	ipRow := unicastIpAddressRow6(ip, index)
+	ret, _, _ := procGetUnicastIpAddressEntry.Call(uintptr(unsafe.Pointer(ipRow)))
+	if ret == ERROR_NOT_FOUND {
+		// Already gone.
+		return nil
+	}
+	if ret != 0 {
+		return &ipHelperError{"GetUnicastIpAddressEntry", ret}
+	}
+	if ret, _, _ := procDeleteUnicastIpAddressEntry.Call(uintptr(unsafe.Pointer(ipRow))); ret != 0 {
+		return &ipHelperError{"DeleteUnicastIpAddressEntry", ret}
+	}
+	return nil
+}
+
 func createUnicastIpAddressEntry(ip net.IP, prefix uint8, index uint32) error {
 	ipRow := new(MIB_UNICASTIPADDRESS_ROW)
 	// No return value.
@@ -106,8 +297,8 @@ func createUnicastIpAddressEntry(ip net.IP, prefix uint8, index uint32) error {
 	ipRow.Address.Ipv4.sin_family = AF_NET
 	ipRow.Address.Ipv4.sin_addr.S_un.S_addr = binary.LittleEndian.Uint32(ip.To4())
 
-	if ret, _, _ := procCreateUnicastIpAddressEntry.Call(uintptr(unsafe.Pointer(ipRow))); ret != 0 {
-		return fmt.Errorf("nonzero return code from CreateUnicastIpAddressEntry: %d", ret)
+	if ret, _, _ := procCreateUnicastIpAddressEntry.Call(uintptr(unsafe.Pointer(ipRow))); ret != 0 && ret != ERROR_OBJECT_ALREADY_EXISTS {
+		return &ipHelperError{"CreateUnicastIpAddressEntry", ret}
 	}
 	return nil
 }
@@ -122,18 +313,17 @@ func deleteUnicastIpAddressEntry(ip net.IP, index uint32) error {
 
 	ret, _, _ := procGetUnicastIpAddressEntry.Call(uintptr(unsafe.Pointer(ipRow)))
 
-	// ERROR_NOT_FOUND
-	if ret == 1168 {
+	if ret == ERROR_NOT_FOUND {
 		// This address was added by addIPAddress(), need to remove with deleteIPAddress()
 		return deleteIPAddress(ip)
 	}
 
 	if ret != 0 {
-		return fmt.Errorf("nonzero return code from GetUnicastIpAddressEntry: %d", ret)
+		return &ipHelperError{"GetUnicastIpAddressEntry", ret}
 	}
 
 	if ret, _, _ := procDeleteUnicastIpAddressEntry.Call(uintptr(unsafe.Pointer(ipRow))); ret != 0 {
-		return fmt.Errorf("nonzero return code from DeleteUnicastIpAddressEntry: %d", ret)
+		return &ipHelperError{"DeleteUnicastIpAddressEntry", ret}
 	}
 	return nil
 }
@@ -151,7 +341,7 @@ func addIPAddress(ip, mask net.IP, index uint32) error {
 		uintptr(unsafe.Pointer(&nteC)),
 		uintptr(unsafe.Pointer(&nteI)))
 	if ret != 0 {
-		return fmt.Errorf("nonzero return code from AddIPAddress: %d", ret)
+		return &ipHelperError{"AddIPAddress", ret}
 	}
 	return nil
 }
@@ -178,10 +368,46 @@ func deleteIPAddress(ip net.IP) error {
 			nteC := ipl.Context
 			ret, _, _ := procDeleteIPAddress.Call(uintptr(nteC))
 			if ret != 0 {
-				return fmt.Errorf("nonzero return code from DeleteIPAddress: %d", ret)
+				return &ipHelperError{"DeleteIPAddress", ret}
 			}
 			return nil
 		}
 	}
 	return fmt.Errorf("did not find address %s on system", ip)
 }
+
+// listAddresses returns the unicast IPv4 and IPv6 addresses of the interface
+// with index.
+func listAddresses(index uint32) ([]string, error) {
+	var table *MIB_UNICASTIPADDRESS_TABLE6
+	if ret, _, _ := procGetUnicastIpAddressTable.Call(uintptr(AF_UNSPEC), uintptr(unsafe.Pointer(&table))); ret != 0 {
+		return nil, &ipHelperError{"GetUnicastIpAddressTable", ret}
+	}
+	defer procFreeMibTable.Call(uintptr(unsafe.Pointer(table)))
+
+	n := int(table.NumEntries)
+	rows := (*[1 << 16]MIB_UNICASTIPADDRESS_ROW6)(unsafe.Pointer(&table.Table[0]))[:n:n]
+	var ips []string
+	for _, row := range rows {
+		if row.InterfaceIndex != index {
+			continue
+		}
+		raw := (*[unsafe.Sizeof(row.Address)]byte)(unsafe.Pointer(&row.Address))
+		switch row.Address.sin6_family {
+		case AF_NET:
+			// SOCKADDR_IN: family, port, then the address.
+			ips = append(ips, net.IP(append([]byte(nil), raw[4:8]...)).String())
+		case AF_INET6:
+			ips = append(ips, net.IP(append([]byte(nil), raw[8:24]...)).String())
+		}
+	}
+	return ips, nil
+}
+
+// waitAddrChange blocks until the IPv4 address table changes.
+func waitAddrChange() error {
+	if ret, _, _ := procNotifyAddrChange.Call(0, 0); ret != 0 {
+		return fmt.Errorf("nonzero return code from NotifyAddrChange: %s", syscall.Errno(ret))
+	}
+	return nil
+}
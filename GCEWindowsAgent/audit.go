@@ -0,0 +1,146 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// auditStatus is the result of the last diff only audit pass, Drift lists the
+// config sections of managers that would apply changes.
+type auditStatus struct {
+	Time  time.Time
+	Drift []string
+}
+
+var (
+	lastAudit   *auditStatus
+	lastAuditMu sync.Mutex
+
+	// appliedMetadata is the metadata of the last update cycle, only kept
+	// while auditing or the status endpoint is enabled.
+	appliedMetadata   *metadataJSON
+	appliedMetadataMu sync.Mutex
+
+	// auditRecheck is how often the config is checked while auditing is off.
+	auditRecheck = time.Minute
+)
+
+func auditInterval(cfg *ini.File) time.Duration {
+	return time.Duration(cfg.Section("core").Key("audit_interval_sec").MustInt(0)) * time.Second
+}
+
+func getAuditStatus() *auditStatus {
+	lastAuditMu.Lock()
+	defer lastAuditMu.Unlock()
+	return lastAudit
+}
+
+func setAppliedMetadata(md *metadataJSON) {
+	appliedMetadataMu.Lock()
+	defer appliedMetadataMu.Unlock()
+	cfg := loadConfig()
+	if addr, _ := statusAddress(cfg); auditInterval(cfg) > 0 || addr != "" {
+		appliedMetadata = md
+	} else {
+		appliedMetadata = nil
+	}
+}
+
+func getAppliedMetadata() *metadataJSON {
+	appliedMetadataMu.Lock()
+	defer appliedMetadataMu.Unlock()
+	return appliedMetadata
+}
+
+// auditManagers returns the sections of the enabled managers that would
+// apply changes, never running set. Managers that can plan their changes
+// are checked against the state of the system, so changes made outside of
+// the agent are found. The others can only diff the metadata.
+func auditManagers(mgrs []namedManager) []string {
+	var drift []string
+	for _, mgr := range mgrs {
+		if mgr.disabled() {
+			continue
+		}
+		p, ok := managerPlanner(mgr.manager)
+		if !ok {
+			if mgr.diff() {
+				drift = append(drift, mgr.section)
+			}
+			continue
+		}
+		changes, err := p.plan()
+		if err != nil {
+			logger.Errorf("Error auditing %s: %v", mgr.section, err)
+			continue
+		}
+		if len(changes) != 0 {
+			logger.Debugf("Audit of %s found changes: %q", mgr.section, changes)
+			drift = append(drift, mgr.section)
+		}
+	}
+	return drift
+}
+
+// audit checks the managers against the current metadata and the state of
+// the system and records which have drifted.
+func audit(ctx context.Context, cfg *ini.File) {
+	applied := getAppliedMetadata()
+	if applied == nil {
+		// Nothing applied yet, the next update cycle reconciles everything.
+		return
+	}
+
+	md, err := getMetadata(ctx, cfg)
+	if err != nil {
+		logger.Errorln("Error getting metadata for audit:", err)
+		return
+	}
+
+	updateMu.Lock()
+	drift := auditManagers(newManagers(md, applied, cfg))
+	updateMu.Unlock()
+
+	if len(drift) != 0 {
+		logger.Infof("Audit found drift in %q", drift)
+	}
+	lastAuditMu.Lock()
+	lastAudit = &auditStatus{Time: time.Now(), Drift: drift}
+	lastAuditMu.Unlock()
+}
+
+// auditLoop runs an audit every [core] audit_interval_sec until ctx is done.
+func auditLoop(ctx context.Context) {
+	for {
+		cfg := loadConfig()
+		interval := auditInterval(cfg)
+		if interval <= 0 {
+			if !sleepCtx(ctx, auditRecheck) {
+				return
+			}
+			continue
+		}
+		if !sleepCtx(ctx, interval) {
+			return
+		}
+		audit(ctx, loadConfig())
+	}
+}
@@ -0,0 +1,106 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+func TestAuditManagers(t *testing.T) {
+	mgrs := []namedManager{
+		{"a", &fakeManager{isDiff: true}},
+		{"b", &fakeManager{}},
+		{"c", &fakeManager{isDisabled: true, isDiff: true}},
+		{"d", &fakeManager{isDiff: true}},
+		// Planners are checked against the system, not the metadata.
+		{"e", &plannedManager{changes: []string{"add route"}}},
+		{"f", &plannedManager{fakeManager: fakeManager{isDiff: true}}},
+	}
+
+	got := auditManagers(mgrs)
+	if want := []string{"a", "d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("auditManagers() got: %q, want: %q", got, want)
+	}
+	for _, mgr := range mgrs {
+		var sets int
+		switch m := mgr.manager.(type) {
+		case *fakeManager:
+			sets = m.sets
+		case *plannedManager:
+			sets = m.sets
+		}
+		if sets != 0 {
+			t.Errorf("audit of %q called set() %d times", mgr.section, sets)
+		}
+	}
+}
+
+func TestAudit(t *testing.T) {
+	prv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	key := fmt.Sprintf(`{"userName":"new-user","modulus":%q,"exponent":%q,"expireOn":%q}`,
+		base64.StdEncoding.EncodeToString(prv.PublicKey.N.Bytes()),
+		base64.StdEncoding.EncodeToString(new(big.Int).SetInt64(int64(prv.PublicKey.E)).Bytes()),
+		time.Now().Add(time.Hour).Format(time.RFC3339))
+	md, err := json.Marshal(map[string]interface{}{"instance": map[string]interface{}{"attributes": map[string]string{"windows-keys": key}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(md)
+	}))
+	defer ts.Close()
+
+	oldServer := metadataServer
+	defer func() {
+		metadataServer = oldServer
+		appliedMetadata = nil
+		lastAudit = nil
+	}()
+	metadataServer = ts.URL
+
+	// Nothing is audited before the first update.
+	audit(context.Background(), ini.Empty())
+	if got := getAuditStatus(); got != nil {
+		t.Errorf("audit before any update got: %+v, want nil", got)
+	}
+
+	// The account isn't created yet, so it has drifted even though the
+	// metadata was applied.
+	appliedMetadata = &metadataJSON{Instance: instanceJSON{Attributes: attributesJSON{WindowsKeys: key}}}
+	audit(context.Background(), ini.Empty())
+	got := getAuditStatus()
+	if got == nil {
+		t.Fatal("audit status not recorded")
+	}
+	if want := []string{"accountManager"}; !reflect.DeepEqual(got.Drift, want) {
+		t.Errorf("audit drift got: %q, want: %q", got.Drift, want)
+	}
+}
@@ -0,0 +1,295 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// certJSON is a certificate in the LocalMachine\My store.
+type certJSON struct {
+	Thumbprint string
+	NotAfter   time.Time
+	// Raw is the base64 encoded DER certificate.
+	Raw string
+}
+
+// certStore is the interface to the LocalMachine\My certificate store.
+type certStore interface {
+	// list returns the certificates with friendlyName.
+	list(friendlyName string) ([]certJSON, error)
+	// create creates a self-signed server authentication certificate.
+	create(friendlyName string, dnsNames []string, notAfter time.Time) (certJSON, error)
+	// importPFX imports a base64 encoded PKCS #12 file without password.
+	importPFX(friendlyName, data string) (certJSON, error)
+	remove(thumbprint string) error
+}
+
+// psCertStore manages certificates with PowerShell.
+type psCertStore struct{}
+
+// psQuote returns s as a single quoted PowerShell string.
+func psQuote(s string) string {
+	return "'" + strings.Replace(s, "'", "''", -1) + "'"
+}
+
+// psCertObject is a PowerShell script block that turns a certificate into
+// the fields of certJSON.
+const psCertObject = `{ @{Thumbprint=$_.Thumbprint; NotAfter=$_.NotAfter.ToUniversalTime().ToString('o'); Raw=[Convert]::ToBase64String($_.RawData)} }`
+
+func parseCerts(out []byte) ([]certJSON, error) {
+	var certs []certJSON
+	if err := json.Unmarshal(out, &certs); err != nil {
+		return nil, fmt.Errorf("error parsing certificates %q: %v", out, err)
+	}
+	return certs, nil
+}
+
+func (psCertStore) list(friendlyName string) ([]certJSON, error) {
+	script := fmt.Sprintf(`ConvertTo-Json -Compress -InputObject @(Get-ChildItem Cert:\LocalMachine\My | Where-Object { $_.FriendlyName -eq %s } | ForEach-Object %s)`,
+		psQuote(friendlyName), psCertObject)
+	out, err := runPowershell(script)
+	if err != nil {
+		return nil, fmt.Errorf("error listing certificates: %v, output: %s", err, out)
+	}
+	return parseCerts(out)
+}
+
+func (psCertStore) create(friendlyName string, dnsNames []string, notAfter time.Time) (certJSON, error) {
+	var names []string
+	for _, n := range dnsNames {
+		names = append(names, psQuote(n))
+	}
+	script := fmt.Sprintf(`$c = New-SelfSignedCertificate -CertStoreLocation Cert:\LocalMachine\My -FriendlyName %s -DnsName %s -NotAfter ([DateTime]::Parse(%s).ToUniversalTime()) -KeyExportPolicy NonExportable -KeyUsage DigitalSignature,KeyEncipherment -TextExtension @('2.5.29.37={text}1.3.6.1.5.5.7.3.1'); ConvertTo-Json -Compress -InputObject @($c | ForEach-Object %s)`,
+		psQuote(friendlyName), strings.Join(names, ","), psQuote(notAfter.UTC().Format(time.RFC3339)), psCertObject)
+	out, err := runPowershell(script)
+	if err != nil {
+		return certJSON{}, fmt.Errorf("error creating certificate: %v, output: %s", err, out)
+	}
+	certs, err := parseCerts(out)
+	if err != nil {
+		return certJSON{}, err
+	}
+	if len(certs) != 1 {
+		return certJSON{}, fmt.Errorf("created %d certificates, want 1", len(certs))
+	}
+	return certs[0], nil
+}
+
+func (psCertStore) importPFX(friendlyName, data string) (certJSON, error) {
+	script := fmt.Sprintf(`$f = New-TemporaryFile
+try {
+  [IO.File]::WriteAllBytes($f.FullName, [Convert]::FromBase64String(%s))
+  $c = Import-PfxCertificate -FilePath $f.FullName -CertStoreLocation Cert:\LocalMachine\My
+} finally { Remove-Item $f.FullName }
+$c.FriendlyName = %s
+ConvertTo-Json -Compress -InputObject @($c | ForEach-Object %s)`, psQuote(data), psQuote(friendlyName), psCertObject)
+	out, err := runPowershell(script)
+	if err != nil {
+		return certJSON{}, fmt.Errorf("error importing certificate: %v, output: %s", err, out)
+	}
+	certs, err := parseCerts(out)
+	if err != nil {
+		return certJSON{}, err
+	}
+	if len(certs) != 1 {
+		return certJSON{}, fmt.Errorf("imported %d certificates, want 1", len(certs))
+	}
+	return certs[0], nil
+}
+
+func (psCertStore) remove(thumbprint string) error {
+	script := fmt.Sprintf(`Remove-Item -Path (Join-Path Cert:\LocalMachine\My %s) -DeleteKey`, psQuote(thumbprint))
+	if out, err := runPowershell(script); err != nil {
+		return fmt.Errorf("error removing certificate %s: %v, output: %s", thumbprint, err, out)
+	}
+	return nil
+}
+
+// certStoreMgr is replaced in tests.
+var certStoreMgr certStore = psCertStore{}
+
+// certDNSNames returns the names certificates for this machine are issued to.
+func certDNSNames(hostname string) []string {
+	names := []string{hostname}
+	if i := strings.Index(hostname, "."); i > 0 {
+		names = append(names, hostname[:i])
+	}
+	return names
+}
+
+// removeCertsExcept removes the certificates in certs other than keep and
+// logs errors.
+func removeCertsExcept(certs []certJSON, keep string) {
+	for _, c := range certs {
+		if strings.EqualFold(c.Thumbprint, keep) {
+			continue
+		}
+		if err := certStoreMgr.remove(c.Thumbprint); err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+const (
+	defaultCertValidityDays = 365
+	defaultCertRenewDays    = 30
+)
+
+// certRecheck is the longest time between checks of a bound certificate, so
+// a certificate changed by someone else is replaced.
+var certRecheck = 24 * time.Hour
+
+// certRetry is the wait before retrying a failed certificate check, doubled
+// on each failure up to certRecheck.
+var certRetry = 5 * time.Minute
+
+// certSchedule is when a managed certificate has to be checked next, zero
+// before the first check.
+type certSchedule struct {
+	mu      sync.Mutex
+	next    time.Time
+	backoff time.Duration
+}
+
+func (s *certSchedule) due(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !now.Before(s.next)
+}
+
+func (s *certSchedule) set(t time.Time) {
+	s.mu.Lock()
+	s.next, s.backoff = t, 0
+	s.mu.Unlock()
+}
+
+// failed schedules a retry of a failed check after the next backoff.
+func (s *certSchedule) failed(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backoff *= 2
+	if s.backoff == 0 {
+		s.backoff = certRetry
+	}
+	if s.backoff > certRecheck {
+		s.backoff = certRecheck
+	}
+	s.next = now.Add(s.backoff)
+}
+
+// certValidity returns validity_days and renew_before_days of sec.
+func certValidity(sec *ini.Section) (validity, renew time.Duration, err error) {
+	validityDays := sec.Key("validity_days").MustInt(defaultCertValidityDays)
+	renewDays := sec.Key("renew_before_days").MustInt(defaultCertRenewDays)
+	if renewDays >= validityDays {
+		return 0, 0, fmt.Errorf("renew_before_days (%d) must be less than validity_days (%d)", renewDays, validityDays)
+	}
+	return time.Duration(validityDays) * 24 * time.Hour, time.Duration(renewDays) * 24 * time.Hour, nil
+}
+
+// boundCert returns the certificate of certs that is bound unless it expires
+// within renew of now, nil if there is none.
+func boundCert(certs []certJSON, bound string, renew time.Duration, now time.Time) *certJSON {
+	for i, c := range certs {
+		if strings.EqualFold(c.Thumbprint, bound) && now.Before(c.NotAfter.Add(-renew)) {
+			return &certs[i]
+		}
+	}
+	return nil
+}
+
+// planCert returns the changes ensureCert would make.
+func planCert(friendlyName, bound string, renew time.Duration) ([]string, error) {
+	certs, err := certStoreMgr.list(friendlyName)
+	if err != nil {
+		return nil, err
+	}
+	var changes []string
+	var keep string
+	if cert := boundCert(certs, bound, renew, time.Now()); cert != nil {
+		keep = cert.Thumbprint
+	} else {
+		changes = append(changes, fmt.Sprintf("create and bind a new %s certificate", friendlyName))
+	}
+	for _, c := range certs {
+		if !strings.EqualFold(c.Thumbprint, keep) {
+			changes = append(changes, fmt.Sprintf("remove certificate %s (%s)", c.Thumbprint, friendlyName))
+		}
+	}
+	return changes, nil
+}
+
+// ensureCert returns the certificate with friendlyName that is bound, as
+// reported by bound, unless it expires within renew. Otherwise a new
+// certificate valid for validity is created and bound with bind.
+// Certificates with friendlyName that are no longer bound are removed and
+// sched is set to the next check.
+func ensureCert(friendlyName, bound string, validity, renew time.Duration, bind func(thumbprint string) error, sched *certSchedule) (certJSON, error) {
+	certs, err := certStoreMgr.list(friendlyName)
+	if err != nil {
+		return certJSON{}, err
+	}
+
+	now := time.Now()
+	cert := boundCert(certs, bound, renew, now)
+	if cert == nil {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return certJSON{}, err
+		}
+		c, err := certStoreMgr.create(friendlyName, certDNSNames(hostname), now.Add(validity))
+		if err != nil {
+			return certJSON{}, err
+		}
+		logger.Infof("Binding new certificate %s (%s), valid until %s", c.Thumbprint, friendlyName, c.NotAfter.Format(time.RFC3339))
+		if err := bind(c.Thumbprint); err != nil {
+			// Don't leave unused certificates behind.
+			removeCertsExcept([]certJSON{c}, "")
+			return certJSON{}, err
+		}
+		cert = &c
+	}
+	removeCertsExcept(certs, cert.Thumbprint)
+
+	next := now.Add(certRecheck)
+	if renewAt := cert.NotAfter.Add(-renew); renewAt.Before(next) {
+		next = renewAt
+	}
+	sched.set(next)
+	return *cert, nil
+}
+
+// certRotationLoop runs the manager of section when sched is due, as
+// certificate renewal and activation checks do not depend on metadata changes.
+func certRotationLoop(ctx context.Context, section string, sched *certSchedule) {
+	periodicLoop(ctx, periodicTask{
+		name:     section + " rotation",
+		interval: every(time.Minute),
+		due:      func(_ *ini.File, now time.Time) bool { return sched.due(now) },
+		run: func(ctx context.Context, cfg *ini.File) error {
+			return runScheduledManager(ctx, cfg, section, buildSection(section))
+		},
+	})
+}
@@ -0,0 +1,349 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+const (
+	// cloudLoggingBuffer is how many entries are queued for Cloud Logging.
+	// Entries logged while the queue is full are dropped.
+	cloudLoggingBuffer  = 1000
+	cloudLoggingRetries = 3
+)
+
+var (
+	// cloudLoggingURL, cloudLoggingRetryWait and cloudLoggingSetupMaxWait
+	// are replaced in tests.
+	cloudLoggingURL          = "https://logging.googleapis.com/v2/entries:write"
+	cloudLoggingRetryWait    = time.Second
+	cloudLoggingSetupMaxWait = 5 * time.Minute
+)
+
+// cloudLoggingTokenMargin is how long before it expires a cached token is
+// refreshed.
+const cloudLoggingTokenMargin = time.Minute
+
+// cloudLogger is a logger backend that writes to Cloud Logging in batches
+// with the default service account of the instance. Only run uses the log
+// name, resource and token.
+type cloudLogger struct {
+	config      *ini.File
+	logName     string
+	resource    cloudLoggingResource
+	batchSize   int
+	flush       time.Duration
+	entries     chan logger.Entry
+	flushReq    chan chan struct{}
+	done        chan struct{}
+	token       string
+	tokenExpiry time.Time
+}
+
+type cloudLoggingResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+}
+
+type cloudLoggingEntry struct {
+	Timestamp   time.Time              `json:"timestamp"`
+	Severity    string                 `json:"severity"`
+	JSONPayload map[string]interface{} `json:"jsonPayload"`
+}
+
+type cloudLoggingRequest struct {
+	LogName  string               `json:"logName"`
+	Resource cloudLoggingResource `json:"resource"`
+	Entries  []cloudLoggingEntry  `json:"entries"`
+}
+
+// Log queues e without blocking.
+func (c *cloudLogger) Log(e logger.Entry) {
+	select {
+	case c.entries <- e:
+	default:
+	}
+}
+
+// startCloudLogging adds a Cloud Logging backend to the logger if
+// [cloudLogging] enable is set. Entries are queued from the start while the
+// backend looks up the instance in the background. The backend stops,
+// flushing queued entries, when ctx is done. It returns nil if Cloud Logging
+// is off.
+func startCloudLogging(ctx context.Context, config *ini.File) *cloudLogger {
+	sec := config.Section("cloudLogging")
+	if !sec.Key("enable").MustBool(false) {
+		return nil
+	}
+	c := newCloudLogger(config)
+	logger.AddBackend(c)
+	go c.run(ctx)
+	return c
+}
+
+func newCloudLogger(config *ini.File) *cloudLogger {
+	sec := config.Section("cloudLogging")
+	return &cloudLogger{
+		config:    config,
+		batchSize: sec.Key("batch_size").MustInt(100),
+		flush:     time.Duration(sec.Key("flush_sec").MustInt(5)) * time.Second,
+		entries:   make(chan logger.Entry, cloudLoggingBuffer),
+		flushReq:  make(chan chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// setup sets the log name and resource from the project, instance and zone
+// in metadata.
+func (c *cloudLogger) setup(ctx context.Context) error {
+	var md []string
+	for _, p := range []string{"project/project-id", "instance/id", "instance/zone"} {
+		b, err := getMetadataPath(ctx, c.config, p)
+		if err != nil {
+			return err
+		}
+		md = append(md, string(b))
+	}
+	name := c.config.Section("cloudLogging").Key("log_name").MustString("GCEWindowsAgent")
+	c.logName = fmt.Sprintf("projects/%s/logs/%s", md[0], url.PathEscape(name))
+	c.resource = cloudLoggingResource{
+		Type: "gce_instance",
+		Labels: map[string]string{
+			"project_id":  md[0],
+			"instance_id": md[1],
+			"zone":        path.Base(md[2]),
+		},
+	}
+	return nil
+}
+
+// setupWithRetry runs setup until it succeeds, backing off up to
+// cloudLoggingSetupMaxWait, as the metadata server may not answer yet when
+// the agent starts. It returns false if ctx is done first.
+func (c *cloudLogger) setupWithRetry(ctx context.Context) bool {
+	wait := cloudLoggingRetryWait
+	for ctx.Err() == nil {
+		err := c.setup(ctx)
+		if err == nil {
+			return true
+		}
+		if wait == cloudLoggingRetryWait {
+			logger.Errorf("Error setting up Cloud Logging, retrying: %v", err)
+		}
+		timer := time.NewTimer(wait)
+		for waiting := true; waiting; {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return false
+			case flushed := <-c.flushReq:
+				// Nothing can be written yet.
+				close(flushed)
+			case <-timer.C:
+				waiting = false
+			}
+		}
+		if wait *= 2; wait > cloudLoggingSetupMaxWait {
+			wait = cloudLoggingSetupMaxWait
+		}
+	}
+	return false
+}
+
+// accessToken returns the service account token, cached until shortly
+// before it expires.
+func (c *cloudLogger) accessToken(ctx context.Context) (string, error) {
+	if c.token != "" && time.Now().Before(c.tokenExpiry.Add(-cloudLoggingTokenMargin)) {
+		return c.token, nil
+	}
+	token, expiry, err := serviceAccountTokenExpiry(ctx, c.config)
+	if err != nil {
+		return "", err
+	}
+	c.token, c.tokenExpiry = token, expiry
+	return token, nil
+}
+
+// wait waits for the backend to stop after its context is done.
+func (c *cloudLogger) wait() {
+	if c != nil {
+		<-c.done
+	}
+}
+
+// flushNow writes the queued entries now, waiting until they are written or ctx
+// is done.
+func (c *cloudLogger) flushNow(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	flushed := make(chan struct{})
+	select {
+	case c.flushReq <- flushed:
+	case <-c.done:
+		return
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+	}
+}
+
+func (c *cloudLogger) run(ctx context.Context) {
+	defer close(c.done)
+	if !c.setupWithRetry(ctx) {
+		// Stopping before setup succeeded, try once more to flush the
+		// queued entries.
+		fctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := c.setup(fctx)
+		cancel()
+		if err != nil {
+			logger.RemoveBackend(c)
+			return
+		}
+	}
+	ticker := time.NewTicker(c.flush)
+	defer ticker.Stop()
+	var batch []logger.Entry
+	for {
+		select {
+		case e := <-c.entries:
+			batch = append(batch, e)
+			if len(batch) >= c.batchSize {
+				batch = c.write(ctx, batch)
+			}
+		case <-ticker.C:
+			batch = c.write(ctx, batch)
+		case flushed := <-c.flushReq:
+			for len(c.entries) != 0 {
+				batch = append(batch, <-c.entries)
+			}
+			batch = c.write(ctx, batch)
+			close(flushed)
+		case <-ctx.Done():
+			logger.RemoveBackend(c)
+			for len(c.entries) != 0 {
+				batch = append(batch, <-c.entries)
+			}
+			fctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			c.write(fctx, batch)
+			cancel()
+			return
+		}
+	}
+}
+
+// write sends batch to Cloud Logging, retrying on failure. It returns the
+// entries to send with the next batch, those that failed up to the size of
+// the queue.
+func (c *cloudLogger) write(ctx context.Context, batch []logger.Entry) []logger.Entry {
+	if len(batch) == 0 {
+		return nil
+	}
+	var err error
+	for i := 0; i < cloudLoggingRetries; i++ {
+		if i > 0 && !sleepCtx(ctx, cloudLoggingRetryWait<<uint(i-1)) {
+			break
+		}
+		if err = c.post(ctx, batch); err == nil {
+			return nil
+		}
+	}
+	// Logging the error queues it too, so it shows up once the write
+	// succeeds.
+	logger.Errorf("Error writing %d entries to Cloud Logging: %v", len(batch), err)
+	if len(batch) > cloudLoggingBuffer {
+		batch = batch[len(batch)-cloudLoggingBuffer:]
+	}
+	return batch
+}
+
+func (c *cloudLogger) post(ctx context.Context, batch []logger.Entry) error {
+	req := cloudLoggingRequest{LogName: c.logName, Resource: c.resource}
+	for _, e := range batch {
+		payload := map[string]interface{}{"message": e.Message, "component": e.Component}
+		if e.Caller != "" {
+			payload["caller"] = e.Caller
+		}
+		for k, v := range e.Fields {
+			payload[k] = v
+		}
+		req.Entries = append(req.Entries, cloudLoggingEntry{
+			Timestamp:   e.Time,
+			Severity:    cloudLoggingSeverity(e.Severity),
+			JSONPayload: payload,
+		})
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		// Quote field values that can't be marshalled.
+		for _, e := range req.Entries {
+			for k, v := range e.JSONPayload {
+				e.JSONPayload[k] = fmt.Sprint(v)
+			}
+		}
+		if body, err = json.Marshal(req); err != nil {
+			return err
+		}
+	}
+
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequest("POST", cloudLoggingURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	r.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(r.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		// Revoked or rotated, get a new one on the retry.
+		c.token = ""
+	}
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s, %s", resp.Status, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// cloudLoggingSeverity maps a logger severity to a Cloud Logging one.
+func cloudLoggingSeverity(s string) string {
+	if s == "FATAL" {
+		return "CRITICAL"
+	}
+	return s
+}
@@ -0,0 +1,237 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// cloudLoggingTest has the requests the fake logging API got and how many
+// tokens were fetched.
+type cloudLoggingTest struct {
+	reqs   []cloudLoggingRequest
+	tokens int
+}
+
+// setupCloudLoggingTest fakes the metadata server, which fails the first
+// mdFail requests, and the logging API, which fails the first fail requests.
+func setupCloudLoggingTest(t *testing.T, mdFail, fail int) (*cloudLoggingTest, func()) {
+	var mu sync.Mutex
+	ct := &cloudLoggingTest{}
+	md := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if mdFail > 0 {
+			mdFail--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		switch r.URL.Path {
+		case "/project/project-id":
+			w.Write([]byte("my-project"))
+		case "/instance/id":
+			w.Write([]byte("1234"))
+		case "/instance/zone":
+			w.Write([]byte("projects/5678/zones/us-central1-a"))
+		case "/instance/service-accounts/default/token":
+			ct.tokens++
+			w.Write([]byte(`{"access_token":"token","expires_in":3599}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail > 0 {
+			fail--
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("Authorization = %q, want %q", got, "Bearer token")
+		}
+		var req cloudLoggingRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("error decoding request: %v", err)
+		}
+		ct.reqs = append(ct.reqs, req)
+		w.Write([]byte("{}"))
+	}))
+
+	oldMetadata, oldURL, oldWait, oldMax := metadataServer, cloudLoggingURL, cloudLoggingRetryWait, cloudLoggingSetupMaxWait
+	metadataServer, cloudLoggingURL, cloudLoggingRetryWait, cloudLoggingSetupMaxWait = md.URL, api.URL, time.Millisecond, 4*time.Millisecond
+	return ct, func() {
+		metadataServer, cloudLoggingURL, cloudLoggingRetryWait, cloudLoggingSetupMaxWait = oldMetadata, oldURL, oldWait, oldMax
+		md.Close()
+		api.Close()
+	}
+}
+
+func TestNewCloudLogger(t *testing.T) {
+	_, cleanup := setupCloudLoggingTest(t, 2, 0)
+	defer cleanup()
+
+	cfg, err := ini.InsensitiveLoad([]byte("[cloudLogging]\nenable=true\nlog_name=agent/log\nbatch_size=10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newCloudLogger(cfg)
+	if !c.setupWithRetry(context.Background()) {
+		t.Fatal("setupWithRetry() returned false")
+	}
+	if want := "projects/my-project/logs/agent%2Flog"; c.logName != want {
+		t.Errorf("logName = %q, want %q", c.logName, want)
+	}
+	want := cloudLoggingResource{"gce_instance", map[string]string{"project_id": "my-project", "instance_id": "1234", "zone": "us-central1-a"}}
+	if !reflect.DeepEqual(c.resource, want) {
+		t.Errorf("resource = %+v, want %+v", c.resource, want)
+	}
+	if c.batchSize != 10 || c.flush != 5*time.Second {
+		t.Errorf("batchSize, flush = %d, %s, want 10, 5s", c.batchSize, c.flush)
+	}
+}
+
+func TestCloudLoggerWrite(t *testing.T) {
+	var tests = []struct {
+		name     string
+		fail     int
+		wantReqs int
+		wantLeft int
+	}{
+		{"success", 0, 1, 0},
+		{"retried", cloudLoggingRetries - 1, 1, 0},
+		{"failed", cloudLoggingRetries, 0, 2},
+	}
+	for _, tt := range tests {
+		ct, cleanup := setupCloudLoggingTest(t, 0, tt.fail)
+		reqs := &ct.reqs
+		c := newCloudLogger(ini.Empty())
+		if err := c.setup(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		batch := []logger.Entry{
+			{Time: time.Now(), Severity: "INFO", Component: "GCEWindowsAgent", Message: "hello", Fields: map[string]interface{}{"ip": "10.0.0.1"}},
+			{Time: time.Now(), Severity: "FATAL", Component: "GCEWindowsAgent", Caller: "main.go:1", Message: "bye"},
+		}
+		left := c.write(context.Background(), batch)
+		cleanup()
+
+		if len(left) != tt.wantLeft {
+			t.Errorf("test case %q: write() left %d entries, want %d", tt.name, len(left), tt.wantLeft)
+		}
+		if len(*reqs) != tt.wantReqs {
+			t.Errorf("test case %q: got %d requests, want %d", tt.name, len(*reqs), tt.wantReqs)
+			continue
+		}
+		if tt.wantReqs == 0 {
+			continue
+		}
+		entries := (*reqs)[0].Entries
+		if len(entries) != 2 {
+			t.Fatalf("test case %q: got %d entries, want 2", tt.name, len(entries))
+		}
+		if got := entries[0].JSONPayload; got["message"] != "hello" || got["ip"] != "10.0.0.1" {
+			t.Errorf("test case %q: first payload = %v", tt.name, got)
+		}
+		if got := entries[1]; got.Severity != "CRITICAL" || got.JSONPayload["caller"] != "main.go:1" {
+			t.Errorf("test case %q: second entry = %+v", tt.name, got)
+		}
+	}
+}
+
+func TestCloudLoggerFlushOnStop(t *testing.T) {
+	ct, cleanup := setupCloudLoggingTest(t, 0, 0)
+	defer cleanup()
+	reqs := &ct.reqs
+
+	c := newCloudLogger(ini.Empty())
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Log(logger.Entry{Time: time.Now(), Severity: "INFO", Message: "queued"})
+	cancel()
+	c.run(ctx)
+	c.wait()
+
+	var got []string
+	for _, req := range *reqs {
+		for _, e := range req.Entries {
+			got = append(got, e.JSONPayload["message"].(string))
+		}
+	}
+	if strings.Join(got, ",") != "queued" {
+		t.Errorf("flushed messages = %q, want [queued]", got)
+	}
+}
+
+func TestCloudLoggerFlushNow(t *testing.T) {
+	ct, cleanup := setupCloudLoggingTest(t, 0, 0)
+	defer cleanup()
+	reqs := &ct.reqs
+
+	c := newCloudLogger(ini.Empty())
+	ctx, cancel := context.WithCancel(context.Background())
+	go c.run(ctx)
+	defer func() {
+		cancel()
+		c.wait()
+	}()
+	c.Log(logger.Entry{Time: time.Now(), Severity: "INFO", Message: "queued"})
+	fctx, fcancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer fcancel()
+	c.flushNow(fctx)
+
+	if len(*reqs) != 1 || len((*reqs)[0].Entries) != 1 {
+		t.Fatalf("flushNow() sent %v, want one entry", *reqs)
+	}
+	// A nil logger, Cloud Logging being off, is a no-op.
+	var off *cloudLogger
+	off.flushNow(fctx)
+}
+
+func TestCloudLoggerTokenCache(t *testing.T) {
+	ct, cleanup := setupCloudLoggingTest(t, 0, 0)
+	defer cleanup()
+
+	c := newCloudLogger(ini.Empty())
+	if err := c.setup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	batch := []logger.Entry{{Time: time.Now(), Severity: "INFO", Message: "hello"}}
+	for i := 0; i < 3; i++ {
+		if left := c.write(context.Background(), batch); len(left) != 0 {
+			t.Fatalf("write() left %d entries", len(left))
+		}
+	}
+	if ct.tokens != 1 {
+		t.Errorf("fetched %d tokens for 3 writes, want 1", ct.tokens)
+	}
+
+	c.tokenExpiry = time.Now()
+	c.write(context.Background(), batch)
+	if ct.tokens != 2 {
+		t.Errorf("fetched %d tokens after expiry, want 2", ct.tokens)
+	}
+}
@@ -0,0 +1,297 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// configSettings is an agent config as section -> key -> value, the common
+// form every overlay format is parsed into.
+type configSettings map[string]map[string]string
+
+var (
+	overlayMu sync.Mutex
+	// configOverlay is the config from the google-compute-agent-config
+	// metadata attribute, merged into every loaded config.
+	configOverlay configSettings
+)
+
+// setConfigOverlay parses the google-compute-agent-config attributes from md,
+// keys in the instance attribute override those in the project attribute. On
+// a parse error the previous overlay is kept.
+func setConfigOverlay(md *metadataJSON, cfg *ini.File) {
+	settings, err := metadataConfigSettings(md, cfg)
+	if err != nil {
+		logger.Errorln("Error parsing google-compute-agent-config metadata, keeping the previous config:", err)
+		return
+	}
+
+	overlayMu.Lock()
+	defer overlayMu.Unlock()
+	configOverlay = settings
+}
+
+// metadataConfigSettings parses the google-compute-agent-config attributes
+// from md, keys in the instance attribute override those in the project
+// attribute.
+func metadataConfigSettings(md *metadataJSON, cfg *ini.File) (configSettings, error) {
+	format := cfg.Section("metadata").Key("config_format").MustString("auto")
+	settings := configSettings{}
+	for _, data := range []string{md.Project.Attributes.AgentConfig, md.Instance.Attributes.AgentConfig} {
+		s, err := parseConfigOverlay(data, format)
+		if err != nil {
+			return nil, err
+		}
+		for section, keys := range s {
+			for key, value := range keys {
+				settings.set(section, key, value)
+			}
+		}
+	}
+	return settings, nil
+}
+
+// mergeConfigOverlay merges settings from the metadata overlay over cfg, so
+// fleet wide settings win over the local config file.
+func mergeConfigOverlay(cfg *ini.File) {
+	overlayMu.Lock()
+	defer overlayMu.Unlock()
+	configOverlay.merge(cfg)
+}
+
+// localOnlySections are only read from the local config: [metadata] decides
+// which metadata is trusted and [updates] which binaries the agent installs.
+var localOnlySections = []string{"metadata", "updates"}
+
+// merge sets the settings in cfg, except for the localOnlySections.
+func (c configSettings) merge(cfg *ini.File) {
+	for section, keys := range c {
+		if containsString(strings.ToLower(section), localOnlySections) {
+			continue
+		}
+		sec := cfg.Section(section)
+		for key, value := range keys {
+			if _, err := sec.NewKey(key, value); err != nil {
+				logger.Error(err)
+			}
+		}
+	}
+}
+
+// parseConfigOverlay parses data in format, one of ini, json, toml, yaml or
+// auto. An empty overlay is not an error.
+func parseConfigOverlay(data, format string) (configSettings, error) {
+	if strings.TrimSpace(data) == "" {
+		return nil, nil
+	}
+	switch format {
+	case "ini":
+		return parseINISettings(data)
+	case "json":
+		return parseJSONSettings(data)
+	case "toml":
+		return parseTOMLSettings(data)
+	case "yaml":
+		return parseYAMLSettings(data)
+	case "auto", "":
+		return parseAutoSettings(data)
+	default:
+		return nil, fmt.Errorf("invalid config_format %q", format)
+	}
+}
+
+// parseAutoSettings detects the format of data. TOML written for the agent
+// is mostly valid INI, so TOML is tried first and INI is the fallback.
+func parseAutoSettings(data string) (configSettings, error) {
+	if strings.HasPrefix(strings.TrimSpace(data), "{") {
+		return parseJSONSettings(data)
+	}
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line == "---" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasSuffix(line, ":") {
+			return parseYAMLSettings(data)
+		}
+		break
+	}
+	if settings, err := parseTOMLSettings(data); err == nil {
+		return settings, nil
+	}
+	return parseINISettings(data)
+}
+
+func (c configSettings) set(section, key, value string) {
+	if c[section] == nil {
+		c[section] = map[string]string{}
+	}
+	c[section][key] = value
+}
+
+func parseINISettings(data string) (configSettings, error) {
+	f, err := ini.Load([]byte(data))
+	if err != nil {
+		return nil, err
+	}
+	settings := configSettings{}
+	for _, sec := range f.Sections() {
+		for _, key := range sec.Keys() {
+			settings.set(sec.Name(), key.Name(), key.String())
+		}
+	}
+	return settings, nil
+}
+
+// parseJSONSettings parses an object of sections, each an object of
+// string, number or boolean values.
+func parseJSONSettings(data string) (configSettings, error) {
+	var raw map[string]map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return nil, err
+	}
+	settings := configSettings{}
+	for section, keys := range raw {
+		for key, value := range keys {
+			switch v := value.(type) {
+			case string:
+				settings.set(section, key, v)
+			case float64:
+				settings.set(section, key, strconv.FormatFloat(v, 'f', -1, 64))
+			case bool:
+				settings.set(section, key, strconv.FormatBool(v))
+			default:
+				return nil, fmt.Errorf("%s.%s: unsupported value %v", section, key, value)
+			}
+		}
+	}
+	return settings, nil
+}
+
+var (
+	tomlSection = regexp.MustCompile(`^\[\s*([A-Za-z0-9_-]+)\s*\]$`)
+	tomlKey     = regexp.MustCompile(`^([A-Za-z0-9_-]+)\s*=\s*(.*)$`)
+	yamlKey     = regexp.MustCompile(`^([A-Za-z0-9_-]+):(?:\s+(.*))?$`)
+	bareValue   = regexp.MustCompile(`^[A-Za-z0-9_.+-]+$`)
+)
+
+// parseTOMLSettings parses the TOML subset the agent config needs: [section]
+// tables of keys with string, integer, float or boolean values.
+func parseTOMLSettings(data string) (configSettings, error) {
+	settings := configSettings{}
+	var section string
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+		if m := tomlSection.FindStringSubmatch(line); m != nil {
+			section = m[1]
+			continue
+		}
+		m := tomlKey.FindStringSubmatch(line)
+		if m == nil {
+			return nil, fmt.Errorf("line %d: invalid TOML %q", i+1, line)
+		}
+		value, err := parseScalar(m[2])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		settings.set(section, m[1], value)
+	}
+	return settings, nil
+}
+
+// parseYAMLSettings parses the YAML subset the agent config needs: a mapping
+// of sections, each an indented mapping of scalar values.
+func parseYAMLSettings(data string) (configSettings, error) {
+	settings := configSettings{}
+	var section string
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(stripComment(line), " \t\r")
+		if strings.TrimSpace(line) == "" || line == "---" {
+			continue
+		}
+		indented := line[0] == ' '
+		m := yamlKey.FindStringSubmatch(strings.TrimSpace(line))
+		if m == nil || line[0] == '\t' {
+			return nil, fmt.Errorf("line %d: invalid YAML %q", i+1, line)
+		}
+		if !indented {
+			if m[2] != "" {
+				return nil, fmt.Errorf("line %d: %q is not a section", i+1, m[1])
+			}
+			section = m[1]
+			continue
+		}
+		if section == "" {
+			return nil, fmt.Errorf("line %d: key %q outside a section", i+1, m[1])
+		}
+		value := m[2]
+		// Unlike TOML, unquoted YAML values are plain strings.
+		if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "'") {
+			var err error
+			if value, err = parseScalar(value); err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+		}
+		settings.set(section, m[1], value)
+	}
+	return settings, nil
+}
+
+// parseScalar parses a quoted or bare scalar value.
+func parseScalar(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", fmt.Errorf("unterminated string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	case bareValue.MatchString(s):
+		return s, nil
+	default:
+		return "", fmt.Errorf("unsupported value %q", s)
+	}
+}
+
+// stripComment removes a # comment that is not inside a quoted string.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '"' && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,146 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+func TestParseConfigOverlay(t *testing.T) {
+	want := configSettings{
+		"accountManager": {"disable": "true"},
+		"timeSync":       {"ntp_servers": "time1.example.com,time2.example.com"},
+		"core":           {"audit_interval_sec": "300", "post_converge_script": `C:\verify me.ps1`},
+	}
+
+	var tests = []struct {
+		name, format, data string
+	}{
+		{"ini", "ini", `
+[accountManager]
+disable = true
+[timeSync]
+ntp_servers = time1.example.com,time2.example.com
+[core]
+audit_interval_sec = 300
+post_converge_script = C:\verify me.ps1
+`},
+		{"json", "json", `{
+  "accountManager": {"disable": true},
+  "timeSync": {"ntp_servers": "time1.example.com,time2.example.com"},
+  "core": {"audit_interval_sec": 300, "post_converge_script": "C:\\verify me.ps1"}
+}`},
+		{"toml", "toml", `
+# Managed by the fleet config.
+[accountManager]
+disable = true
+
+[timeSync]
+ntp_servers = "time1.example.com,time2.example.com" # comment
+
+[core]
+audit_interval_sec = 300
+post_converge_script = 'C:\verify me.ps1'
+`},
+		{"yaml", "yaml", `---
+# Managed by the fleet config.
+accountManager:
+  disable: true
+timeSync:
+  ntp_servers: time1.example.com,time2.example.com # comment
+core:
+  audit_interval_sec: 300
+  post_converge_script: "C:\\verify me.ps1"
+`},
+	}
+
+	for _, tt := range tests {
+		for _, format := range []string{tt.format, "auto"} {
+			got, err := parseConfigOverlay(tt.data, format)
+			if err != nil {
+				t.Errorf("test case %q: parseConfigOverlay(%s) returned error: %v", tt.name, format, err)
+				continue
+			}
+			delete(got, ini.DEFAULT_SECTION)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("test case %q: parseConfigOverlay(%s) got: %v, want: %v", tt.name, format, got, want)
+			}
+		}
+	}
+}
+
+func TestParseConfigOverlayErrors(t *testing.T) {
+	var tests = []struct {
+		name, format, data string
+	}{
+		{"bad format", "xml", "<core/>"},
+		{"bad json", "json", `{"core": "x"}`},
+		{"json array", "json", `{"core": {"a": [1]}}`},
+		{"bare toml string", "toml", "[core]\na = b c"},
+		{"toml array table", "toml", "[[core]]\na = 1"},
+		{"unterminated toml string", "toml", "[core]\na = 'b"},
+		{"yaml key outside section", "yaml", "  a: b"},
+		{"yaml section with value", "yaml", "core: b"},
+		{"yaml tab indent", "yaml", "core:\n\ta: b"},
+	}
+
+	for _, tt := range tests {
+		if got, err := parseConfigOverlay(tt.data, tt.format); err == nil {
+			t.Errorf("test case %q: parseConfigOverlay() got: %v, want error", tt.name, got)
+		}
+	}
+}
+
+func TestConfigOverlay(t *testing.T) {
+	defer func() { configOverlay = nil }()
+
+	md := &metadataJSON{}
+	md.Project.Attributes.AgentConfig = "[core]\naudit_interval_sec=300\nboot_settle_sec=30"
+	md.Instance.Attributes.AgentConfig = "core:\n  audit_interval_sec: 60\n  treat_missing_as: remove\nmetadata:\n  expected_project: other\nupdates:\n  bucket: gs://other"
+	setConfigOverlay(md, ini.Empty())
+
+	// A parse error keeps the previous overlay.
+	bad := &metadataJSON{}
+	bad.Instance.Attributes.AgentConfig = "{"
+	setConfigOverlay(bad, ini.Empty())
+
+	cfg, err := ini.InsensitiveLoad([]byte("[core]\ntreat_missing_as=ignore\nconsole_logging=false\n[metadata]\nexpected_project=mine"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mergeConfigOverlay(cfg)
+
+	var tests = []struct {
+		section, key, want string
+	}{
+		// Instance keys override project keys.
+		{"core", "audit_interval_sec", "60"},
+		{"core", "boot_settle_sec", "30"},
+		// Metadata overrides the config file.
+		{"core", "treat_missing_as", "remove"},
+		{"core", "console_logging", "false"},
+		// Except for the [metadata] section.
+		{"metadata", "expected_project", "mine"},
+		{"updates", "bucket", ""},
+	}
+	for _, tt := range tests {
+		if got := cfg.Section(tt.section).Key(tt.key).String(); got != tt.want {
+			t.Errorf("[%s] %s got: %q, want: %q", tt.section, tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+)
+
+var (
+	configWatchInterval = 5 * time.Second
+
+	// configModTime is replaced in tests.
+	configModTime = func() (time.Time, error) {
+		// The drop-in directory is included so removing a drop-in file is
+		// noticed.
+		return latestModTime(append([]string{configPath, configPath + ".d"}, configDropIns(configPath)...))
+	}
+)
+
+// latestModTime returns the latest modification time of files, those that do
+// not exist are skipped.
+func latestModTime(files []string) (time.Time, error) {
+	var latest time.Time
+	for _, f := range files {
+		fi, err := os.Stat(f)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// watchConfig calls onChange whenever the config file or a drop-in file is
+// modified, created or removed, until ctx is done.
+func watchConfig(ctx context.Context, onChange func()) {
+	last, err := configModTime()
+	if err != nil && !os.IsNotExist(err) {
+		logger.Errorln("Error watching config file:", err)
+	}
+	for sleepCtx(ctx, configWatchInterval) {
+		mod, err := configModTime()
+		if err != nil && !os.IsNotExist(err) {
+			logger.Errorln("Error watching config file:", err)
+			continue
+		}
+		if mod.Equal(last) {
+			continue
+		}
+		last = mod
+		logger.Info("Config file changed, reapplying configuration.")
+		onChange()
+	}
+}
+
+// reapplyConfig runs every manager against the current metadata, as on
+// startup, so config changes take effect without waiting for a metadata
+// change.
+func reapplyConfig(ctx context.Context) {
+	cfg := loadConfig()
+	md, err := getMetadata(ctx, cfg)
+	if err != nil {
+		logger.Errorln("Error getting metadata:", err)
+		return
+	}
+	if err := verifyMetadata(md, cfg); err != nil {
+		logger.Errorln("Not applying metadata:", err)
+		return
+	}
+	setConfigOverlay(md, cfg)
+	runUpdate(ctx, md, &metadataJSON{}, nil)
+}
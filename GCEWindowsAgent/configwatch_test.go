@@ -0,0 +1,67 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatchConfig(t *testing.T) {
+	oldInterval, oldModTime := configWatchInterval, configModTime
+	defer func() { configWatchInterval, configModTime = oldInterval, oldModTime }()
+	configWatchInterval = time.Millisecond
+
+	t1 := time.Unix(1, 0)
+	t2 := time.Unix(2, 0)
+	type stat struct {
+		mod time.Time
+		err error
+	}
+	stats := []stat{
+		{t1, nil},
+		// Unchanged.
+		{t1, nil},
+		// Modified.
+		{t2, nil},
+		// Errors are ignored.
+		{time.Time{}, errors.New("access denied")},
+		{t2, nil},
+		// Removed.
+		{time.Time{}, os.ErrNotExist},
+		// Created again.
+		{t1, nil},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	configModTime = func() (time.Time, error) {
+		if len(stats) == 0 {
+			cancel()
+			return t1, nil
+		}
+		s := stats[0]
+		stats = stats[1:]
+		return s.mod, s.err
+	}
+
+	var changes int
+	watchConfig(ctx, func() { changes++ })
+	if changes != 3 {
+		t.Errorf("watchConfig() called onChange %d times, want 3", changes)
+	}
+}
@@ -0,0 +1,248 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// controlPipeName is the local control channel of the agent, an
+// administrators only named pipe. It is replaced in tests.
+var controlPipeName = `\\.\pipe\GCEWindowsAgent`
+
+// controlRequest is a command sent over the control pipe. Each connection
+// carries one request and one controlResponse, as JSON.
+type controlRequest struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args,omitempty"`
+}
+
+type controlResponse struct {
+	Error  string          `json:"error,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+}
+
+type controlStatusJSON struct {
+	Version           string                       `json:"version"`
+	LastMetadataFetch *time.Time                   `json:"lastMetadataFetch,omitempty"`
+	Managers          map[string]string            `json:"managers"`
+	ManagerConfig     []managerConfigJSON          `json:"managerConfig"`
+	Config            map[string]map[string]string `json:"config"`
+	Overrides         map[string]bool              `json:"overrides,omitempty"`
+}
+
+var controlCommands = map[string]func(args []string) (interface{}, error){
+	"status":  controlStatus,
+	"enable":  func(args []string) (interface{}, error) { return controlOverride(args, true) },
+	"disable": func(args []string) (interface{}, error) { return controlOverride(args, false) },
+}
+
+var (
+	overridesMu sync.Mutex
+	// overrides enables or disables managers by section until the agent
+	// restarts, regardless of their config.
+	overrides = make(map[string]bool)
+)
+
+// managerOverride returns the runtime override for section, if any.
+func managerOverride(section string) (enabled, ok bool) {
+	overridesMu.Lock()
+	defer overridesMu.Unlock()
+	enabled, ok = overrides[section]
+	return enabled, ok
+}
+
+func managerOverrides() map[string]bool {
+	overridesMu.Lock()
+	defer overridesMu.Unlock()
+	o := make(map[string]bool, len(overrides))
+	for k, v := range overrides {
+		o[k] = v
+	}
+	return o
+}
+
+// managerSection returns the manager section name refers to, matched
+// without case and allowing the Manager suffix and a plural to be left out,
+// so "accounts" is accountManager.
+func managerSection(name string) (string, error) {
+	for _, mgr := range newManagers(&metadataJSON{}, &metadataJSON{}, loadConfig()) {
+		short := strings.TrimSuffix(mgr.section, "Manager")
+		for _, s := range []string{mgr.section, short, short + "s", short + "es"} {
+			if strings.EqualFold(s, name) {
+				return mgr.section, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unknown manager %q", name)
+}
+
+// controlOverride enables or disables the named managers until the agent
+// restarts. Enabled managers are applied right away, disabled managers
+// release what they hold beyond set(), such as the wsfc listener.
+func controlOverride(args []string, enabled bool) (interface{}, error) {
+	if len(args) == 0 {
+		return nil, errors.New("no manager given")
+	}
+	var sections []string
+	for _, a := range args {
+		section, err := managerSection(a)
+		if err != nil {
+			return nil, err
+		}
+		sections = append(sections, section)
+	}
+	overridesMu.Lock()
+	for _, section := range sections {
+		overrides[section] = enabled
+	}
+	overridesMu.Unlock()
+	state := map[bool]string{true: "enabled", false: "disabled"}[enabled]
+	logger.Infof("Managers %q %s until the agent restarts", sections, state)
+	if enabled {
+		go controlReapply()
+	} else {
+		go controlTeardown(sections)
+	}
+	return managerOverrides(), nil
+}
+
+// controlReapply and controlTeardown are replaced in tests.
+var (
+	controlReapply  = func() { reapplyConfig(context.Background()) }
+	controlTeardown = func(sections []string) { teardownManagers(loadConfig(), sections) }
+)
+
+// controlPipeEnabled reports whether the control pipe is served, per
+// [core] control_pipe, on by default.
+func controlPipeEnabled(cfg *ini.File) bool {
+	return cfg.Section("core").Key("control_pipe").MustBool(true)
+}
+
+func controlStatus(args []string) (interface{}, error) {
+	cfg := loadConfig()
+	md := getAppliedMetadata()
+	if md == nil {
+		md = &metadataJSON{}
+	}
+	s := controlStatusJSON{
+		Version:   version,
+		Managers:  captureAgentState().ManagerStates,
+		Config:    make(map[string]map[string]string),
+		Overrides: managerOverrides(),
+	}
+	if t := lastMetadataFetch(); !t.IsZero() {
+		s.LastMetadataFetch = &t
+	}
+	for _, mgr := range newManagers(md, md, cfg) {
+		s.ManagerConfig = append(s.ManagerConfig, managerConfigJSON{mgr.section, managerEnablement(mgr.manager)})
+	}
+	for _, sec := range cfg.Sections() {
+		if keys := sec.KeysHash(); len(keys) != 0 {
+			s.Config[sec.Name()] = keys
+		}
+	}
+	return s, nil
+}
+
+// serveControlPipe answers control requests until ctx is done.
+func serveControlPipe(ctx context.Context) {
+	l, err := listenPipe(controlPipeName)
+	if err != nil {
+		logger.Errorf("Error listening on %s: %v", controlPipeName, err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Errorf("Error accepting control connection: %v", err)
+			}
+			return
+		}
+		// A client that never sends a request only holds its own
+		// connection, as pipes have no deadlines.
+		go handleControlConn(c)
+	}
+}
+
+func handleControlConn(c net.Conn) {
+	defer c.Close()
+	var req controlRequest
+	var resp controlResponse
+	if err := json.NewDecoder(c).Decode(&req); err != nil {
+		resp.Error = fmt.Sprintf("invalid request: %v", err)
+	} else if cmd, ok := controlCommands[req.Command]; !ok {
+		resp.Error = fmt.Sprintf("unknown command %q", req.Command)
+	} else if result, err := cmd(req.Args); err != nil {
+		resp.Error = err.Error()
+	} else if resp.Result, err = json.Marshal(result); err != nil {
+		resp.Error = err.Error()
+	}
+	if err := json.NewEncoder(c).Encode(resp); err != nil {
+		logger.Errorf("Error writing control response: %v", err)
+	}
+}
+
+// sendControlCommand sends a command to the running agent and returns its
+// result.
+func sendControlCommand(command string, args ...string) (json.RawMessage, error) {
+	c, err := dialPipe(controlPipeName)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to the agent, is it running? %v", err)
+	}
+	defer c.Close()
+	if err := json.NewEncoder(c).Encode(controlRequest{command, args}); err != nil {
+		return nil, err
+	}
+	var resp controlResponse
+	if err := json.NewDecoder(c).Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Result, nil
+}
+
+// runControlCommand runs a command line control command such as
+// "GCEWindowsAgent status", printing the result.
+func runControlCommand(command string, args []string) error {
+	result, err := sendControlCommand(command, args...)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, result, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(out.String())
+	return nil
+}
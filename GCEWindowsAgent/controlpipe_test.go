@@ -0,0 +1,184 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startControlPipe serves the control pipe on a temporary socket.
+func startControlPipe(t *testing.T) func() {
+	tmp, err := ioutil.TempDir("", "controlpipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldName := controlPipeName
+	controlPipeName = filepath.Join(tmp, "agent.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		serveControlPipe(ctx)
+		close(done)
+	}()
+	for i := 0; ; i++ {
+		c, err := dialPipe(controlPipeName)
+		if err == nil {
+			c.Close()
+			break
+		}
+		if i == 50 {
+			t.Fatalf("control pipe not listening: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return func() {
+		cancel()
+		<-done
+		controlPipeName = oldName
+		os.RemoveAll(tmp)
+	}
+}
+
+func TestControlPipeStatus(t *testing.T) {
+	defer startControlPipe(t)()
+	recordMetadataFetch()
+
+	result, err := sendControlCommand("status")
+	if err != nil {
+		t.Fatalf("sendControlCommand(status) error: %v", err)
+	}
+	var got controlStatusJSON
+	if err := json.Unmarshal(result, &got); err != nil {
+		t.Fatalf("error parsing status %s: %v", result, err)
+	}
+	if got.Version != version {
+		t.Errorf("status version got: %q, want: %q", got.Version, version)
+	}
+	if got.LastMetadataFetch == nil || time.Since(*got.LastMetadataFetch) > time.Minute {
+		t.Errorf("status lastMetadataFetch got: %v, want about now", got.LastMetadataFetch)
+	}
+	if len(got.ManagerConfig) != len(newManagers(&metadataJSON{}, &metadataJSON{}, loadConfig())) {
+		t.Errorf("status managerConfig got %d managers, want all of them", len(got.ManagerConfig))
+	}
+}
+
+func TestControlPipeErrors(t *testing.T) {
+	defer startControlPipe(t)()
+
+	if _, err := sendControlCommand("reboot"); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("sendControlCommand(reboot) error got: %v, want unknown command", err)
+	}
+
+	c, err := dialPipe(controlPipeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("not json\n"))
+	var resp controlResponse
+	if err := json.NewDecoder(c).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(resp.Error, "invalid request") {
+		t.Errorf("response to invalid request got: %+v", resp)
+	}
+}
+
+func TestManagerSection(t *testing.T) {
+	var tests = []struct {
+		name, want string
+		wantErr    bool
+	}{
+		{"accountManager", "accountManager", false},
+		{"accounts", "accountManager", false},
+		{"account", "accountManager", false},
+		{"addresses", "addressManager", false},
+		{"WSFC", "wsfc", false},
+		{"printers", "printers", false},
+		{"bogus", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := managerSection(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("managerSection(%q) error = %v, wantErr %t", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("managerSection(%q) got: %q, want: %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestControlPipeOverride(t *testing.T) {
+	defer startControlPipe(t)()
+	oldReapply := controlReapply
+	reapplied := make(chan struct{}, 1)
+	controlReapply = func() { reapplied <- struct{}{} }
+	oldTeardown := controlTeardown
+	tornDown := make(chan []string, 1)
+	controlTeardown = func(sections []string) { tornDown <- sections }
+	defer func() {
+		controlReapply = oldReapply
+		controlTeardown = oldTeardown
+		overrides = make(map[string]bool)
+	}()
+
+	accounts := namedManager{"accountManager", &fakeManager{}}
+	wsfc := namedManager{"wsfc", &fakeManager{isDisabled: true}}
+	if _, err := sendControlCommand("disable", "accounts"); err != nil {
+		t.Fatalf("disable accounts error: %v", err)
+	}
+	if !accounts.disabled() {
+		t.Error("accounts not disabled by the override")
+	}
+	select {
+	case got := <-tornDown:
+		if !reflect.DeepEqual(got, []string{"accountManager"}) {
+			t.Errorf("disable tore down %q, want [accountManager]", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("disable did not tear down the managers")
+	}
+	if _, err := sendControlCommand("enable", "wsfc"); err != nil {
+		t.Fatalf("enable wsfc error: %v", err)
+	}
+	if wsfc.disabled() {
+		t.Error("wsfc not enabled by the override")
+	}
+	select {
+	case <-reapplied:
+	case <-time.After(5 * time.Second):
+		t.Error("enable did not reapply the managers")
+	}
+
+	if _, err := sendControlCommand("disable"); err == nil {
+		t.Error("disable without a manager did not fail")
+	}
+	if _, err := sendControlCommand("disable", "bogus"); err == nil {
+		t.Error("disable of an unknown manager did not fail")
+	}
+	if got, want := managerOverrides(), map[string]bool{"accountManager": false, "wsfc": true}; !reflect.DeepEqual(got, want) {
+		t.Errorf("overrides got: %v, want: %v", got, want)
+	}
+}
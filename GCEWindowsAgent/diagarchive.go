@@ -0,0 +1,266 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// diagnosticsArchivePrefix names the archives the agent writes to
+// diagnosticsDir.
+const diagnosticsArchivePrefix = "agent-diagnostics-"
+
+var (
+	diagnosticsDir = filepath.Join(os.Getenv("ProgramData"), "Google", "Compute Engine", "diagnostics")
+	minidumpDir    = filepath.Join(os.Getenv("SystemRoot"), "Minidump")
+	unattendFiles  = []string{
+		filepath.Join(os.Getenv("SystemRoot"), "Panther", "unattend.xml"),
+		filepath.Join(os.Getenv("SystemRoot"), "Panther", "Unattend", "unattend.xml"),
+		filepath.Join(os.Getenv("SystemRoot"), "System32", "Sysprep", "unattend.xml"),
+	}
+
+	// runDiagCommand is replaced in tests.
+	runDiagCommand = func(name string, args ...string) ([]byte, error) {
+		return exec.Command(name, args...).CombinedOutput()
+	}
+)
+
+// diagCollector gathers one category of diagnostics, written since the given
+// time, into a directory. Each category is toggled by the [diagnostics] key
+// of the same name, which defaults to def.
+type diagCollector struct {
+	name    string
+	collect func(dir string, since time.Time) error
+	def     bool
+}
+
+// The unattend files hold credentials in forms redaction may miss, they are
+// only collected when asked for.
+var diagCollectors = []diagCollector{
+	{"event_logs", collectEventLogs, true},
+	{"minidumps", collectMinidumps, true},
+	{"drivers", collectDrivers, true},
+	{"unattend", collectUnattend, false},
+}
+
+// collectEventLogs exports the System and Application event logs.
+func collectEventLogs(dir string, since time.Time) error {
+	query := fmt.Sprintf("/q:*[System[TimeCreated[timediff(@SystemTime) <= %d]]]", time.Since(since)/time.Millisecond)
+	for _, name := range []string{"System", "Application"} {
+		if out, err := runDiagCommand("wevtutil.exe", "epl", name, filepath.Join(dir, name+".evtx"), query, "/ow:true"); err != nil {
+			return fmt.Errorf("error exporting %s event log: %v, output: %s", name, err, out)
+		}
+	}
+	return nil
+}
+
+// collectMinidumps copies the kernel minidumps. Full memory dumps are too
+// large to collect.
+func collectMinidumps(dir string, since time.Time) error {
+	files, err := ioutil.ReadDir(minidumpDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.EqualFold(filepath.Ext(f.Name()), ".dmp") || f.ModTime().Before(since) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Join(dir, "Minidump"), 0755); err != nil {
+			return err
+		}
+		if err := copyFile(filepath.Join(minidumpDir, f.Name()), filepath.Join(dir, "Minidump", f.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collectDrivers lists the installed drivers and their versions.
+func collectDrivers(dir string, since time.Time) error {
+	out, err := runDiagCommand("driverquery.exe", "/v", "/fo", "csv")
+	if err != nil {
+		return fmt.Errorf("error listing drivers: %v, output: %s", err, out)
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "drivers.csv"), out, 0644)
+}
+
+// collectUnattend copies the unattend files used to set up Windows, named
+// after their directory.
+func collectUnattend(dir string, since time.Time) error {
+	for _, f := range unattendFiles {
+		if _, err := os.Stat(f); os.IsNotExist(err) {
+			continue
+		}
+		dst := filepath.Join(dir, filepath.Base(filepath.Dir(f))+"-"+filepath.Base(f))
+		if err := copyFile(f, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// enabledDiagCollectors returns the collectors enabled in config.
+func enabledDiagCollectors(config *ini.File) []diagCollector {
+	var collectors []diagCollector
+	for _, c := range diagCollectors {
+		if config.Section("diagnostics").Key(c.name).MustBool(c.def) {
+			collectors = append(collectors, c)
+		}
+	}
+	return collectors
+}
+
+// buildDiagnosticsArchive runs the enabled collectors over the last
+// [diagnostics] hours and writes the result as a zip archive to
+// diagnosticsDir, keeping the newest [diagnostics] keep_archives. Failed
+// collectors are recorded in errors.txt in the archive. Sensitive values are
+// redacted unless [diagnostics] redact is false, see redactDir. It returns the
+// archive path, "" if every collector is disabled.
+func buildDiagnosticsArchive(config *ini.File, now time.Time) (string, error) {
+	collectors := enabledDiagCollectors(config)
+	if len(collectors) == 0 {
+		return "", nil
+	}
+	since := now.Add(-time.Duration(config.Section("diagnostics").Key("hours").MustInt(24)) * time.Hour)
+
+	tmp, err := ioutil.TempDir("", "diagnostics")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	var errs []string
+	for _, c := range collectors {
+		dir := filepath.Join(tmp, c.name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return "", err
+		}
+		if err := c.collect(dir, since); err != nil {
+			logger.Errorf("Error collecting %s diagnostics: %v", c.name, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", c.name, err))
+		}
+	}
+	if len(errs) != 0 {
+		if err := ioutil.WriteFile(filepath.Join(tmp, "errors.txt"), []byte(strings.Join(errs, "\r\n")), 0644); err != nil {
+			return "", err
+		}
+	}
+
+	if config.Section("diagnostics").Key("redact").MustBool(true) {
+		if err := redactDir(tmp); err != nil {
+			return "", fmt.Errorf("error redacting diagnostics: %v", err)
+		}
+	}
+
+	if err := os.MkdirAll(diagnosticsDir, 0755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(diagnosticsDir, diagnosticsArchivePrefix+now.UTC().Format("20060102T150405Z")+".zip")
+	if err := zipDir(tmp, path); err != nil {
+		os.Remove(path)
+		return "", err
+	}
+	pruneDiagnosticsArchives(config.Section("diagnostics").Key("keep_archives").MustInt(5))
+	return path, nil
+}
+
+// zipDir writes the files under dir to a zip archive at path.
+func zipDir(dir, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	zw := zip.NewWriter(f)
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		w, err := zw.Create(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		in, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		_, err = io.Copy(w, in)
+		return err
+	})
+	if err != nil {
+		zw.Close()
+		f.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// pruneDiagnosticsArchives removes all but the newest keep archives. Names
+// sort by creation time.
+func pruneDiagnosticsArchives(keep int) {
+	if keep < 1 {
+		keep = 1
+	}
+	paths, err := filepath.Glob(filepath.Join(diagnosticsDir, diagnosticsArchivePrefix+"*.zip"))
+	if err != nil || len(paths) <= keep {
+		return
+	}
+	sort.Strings(paths)
+	for _, p := range paths[:len(paths)-keep] {
+		if err := os.Remove(p); err != nil {
+			logger.Error(err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+// setupDiagnosticsTest points the collectors at a temporary directory and
+// fakes the commands they run.
+func setupDiagnosticsTest(t *testing.T) (string, func()) {
+	tmp, err := ioutil.TempDir("", "diagarchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDir, oldMinidump, oldUnattend, oldRun := diagnosticsDir, minidumpDir, unattendFiles, runDiagCommand
+	diagnosticsDir, minidumpDir = filepath.Join(tmp, "out"), filepath.Join(tmp, "Minidump")
+	unattendFiles = []string{filepath.Join(tmp, "Panther", "unattend.xml")}
+	runDiagCommand = func(name string, args ...string) ([]byte, error) {
+		switch name {
+		case "wevtutil.exe":
+			if args[0] == "qe" {
+				return []byte("Event[0]:\r\n  Description: logon with password=hunter2"), nil
+			}
+			return nil, ioutil.WriteFile(args[2], []byte("evtx\x00"), 0644)
+		case "driverquery.exe":
+			return []byte("driver,version"), nil
+		}
+		return nil, errors.New("unknown command")
+	}
+	return tmp, func() {
+		diagnosticsDir, minidumpDir, unattendFiles, runDiagCommand = oldDir, oldMinidump, oldUnattend, oldRun
+		os.RemoveAll(tmp)
+	}
+}
+
+func archiveNames(t *testing.T, path string) []string {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestBuildDiagnosticsArchive(t *testing.T) {
+	_, cleanup := setupDiagnosticsTest(t)
+	defer cleanup()
+
+	now := time.Now()
+	if err := os.MkdirAll(minidumpDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, age := range map[string]time.Duration{"new.dmp": time.Hour, "old.dmp": 48 * time.Hour, "notes.txt": time.Hour} {
+		p := filepath.Join(minidumpDir, name)
+		if err := ioutil.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"default", "", []string{"drivers/drivers.csv", "event_logs/Application.txt", "event_logs/System.txt", "minidumps/Minidump/new.dmp"}},
+		{"not redacted", "[diagnostics]\nredact=false", []string{"drivers/drivers.csv", "event_logs/Application.evtx", "event_logs/System.evtx", "minidumps/Minidump/new.dmp"}},
+		{"drivers only", "[diagnostics]\nevent_logs=false\nminidumps=false", []string{"drivers/drivers.csv"}},
+		{"none", "[diagnostics]\nevent_logs=false\nminidumps=false\ndrivers=false", nil},
+	}
+	for i, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		path, err := buildDiagnosticsArchive(cfg, now.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatalf("test case %q: buildDiagnosticsArchive() error: %v", tt.name, err)
+		}
+		if tt.want == nil {
+			if path != "" {
+				t.Errorf("test case %q: buildDiagnosticsArchive() path got: %q, want none", tt.name, path)
+			}
+			continue
+		}
+		if got := archiveNames(t, path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("test case %q: archive files got: %q, want: %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBuildDiagnosticsArchiveErrors(t *testing.T) {
+	_, cleanup := setupDiagnosticsTest(t)
+	defer cleanup()
+	runDiagCommand = func(name string, args ...string) ([]byte, error) {
+		return []byte("access denied"), errors.New("exit status 5")
+	}
+
+	path, err := buildDiagnosticsArchive(ini.Empty(), time.Now())
+	if err != nil {
+		t.Fatalf("buildDiagnosticsArchive() error: %v", err)
+	}
+	if got, want := archiveNames(t, path), []string{"errors.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("archive files got: %q, want: %q", got, want)
+	}
+}
+
+func TestPruneDiagnosticsArchives(t *testing.T) {
+	_, cleanup := setupDiagnosticsTest(t)
+	defer cleanup()
+
+	cfg, err := ini.InsensitiveLoad([]byte("[diagnostics]\nkeep_archives=2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	var paths []string
+	for i := 0; i < 4; i++ {
+		path, err := buildDiagnosticsArchive(cfg, now.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	got, err := filepath.Glob(filepath.Join(diagnosticsDir, "*.zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(got)
+	if want := paths[2:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("archives kept got: %q, want: %q", got, want)
+	}
+}
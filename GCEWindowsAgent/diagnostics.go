@@ -15,10 +15,10 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"os/exec"
 	"reflect"
-	"strconv"
 	"time"
 
 	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
@@ -58,6 +58,14 @@ func (a *diagnostics) diff() bool {
 	return !reflect.DeepEqual(a.newMetadata.Instance.Attributes.Diagnostics, a.oldMetadata.Instance.Attributes.Diagnostics)
 }
 
+func (a *diagnostics) metadataPaths() []string {
+	return attributePaths
+}
+
+func (a *diagnostics) diffPaths() []string {
+	return []string{"instance/attributes/diagnostics"}
+}
+
 func (a *diagnostics) disabled() (disabled bool) {
 	defer func() {
 		if disabled != diagnosticsDisabled {
@@ -66,27 +74,43 @@ func (a *diagnostics) disabled() (disabled bool) {
 		}
 	}()
 
-	// Diagnostics are opt-in and disabled by default.
-	var err error
-	var enabled bool
-	enabled, err = strconv.ParseBool(a.config.Section("diagnostics").Key("enable").String())
-	if err == nil {
-		return !enabled
+	return !a.enablement().Enabled
+}
+
+var diagnosticsEnable = enableRule{
+	section:   "diagnostics",
+	key:       "enable",
+	attribute: "enable-diagnostics",
+	value:     func(a attributesJSON) string { return a.EnableDiagnostics },
+}
+
+// Diagnostics are opt-in and disabled by default.
+func (a *diagnostics) enablement() enablement {
+	return isEnabled(a.config, a.newMetadata, diagnosticsEnable, !diagnosticsDisabled)
+}
+
+var diagnosticsEntries []string
+
+// plan returns the diagnostics collection set would start.
+func (a *diagnostics) plan() ([]string, error) {
+	var entry diagnosticsEntryJSON
+	strEntry := a.newMetadata.Instance.Attributes.Diagnostics
+	if containsString(strEntry, diagnosticsEntries) {
+		return nil, nil
 	}
-	enabled, err = strconv.ParseBool(a.newMetadata.Instance.Attributes.EnableDiagnostics)
-	if err == nil {
-		return !enabled
+	if err := json.Unmarshal([]byte(strEntry), &entry); err != nil {
+		return nil, err
+	}
+	if entry.SignedUrl == "" || entry.expired() {
+		return nil, nil
 	}
-	enabled, err = strconv.ParseBool(a.newMetadata.Project.Attributes.EnableDiagnostics)
-	if err == nil {
-		return !enabled
+	if entry.TraceFlag {
+		return []string{"collect and upload diagnostics with tracing"}, nil
 	}
-	return diagnosticsDisabled
+	return []string{"collect and upload diagnostics"}, nil
 }
 
-var diagnosticsEntries []string
-
-func (a *diagnostics) set() error {
+func (a *diagnostics) set(ctx context.Context) error {
 	var entry diagnosticsEntryJSON
 	strEntry := a.newMetadata.Instance.Attributes.Diagnostics
 	if containsString(strEntry, diagnosticsEntries) {
@@ -117,6 +141,13 @@ func (a *diagnostics) set() error {
 		if err != nil {
 			logger.Infof("Error collecting logs: %v", err)
 		}
+
+		path, err := buildDiagnosticsArchive(a.config, time.Now())
+		if err != nil {
+			logger.Errorf("Error collecting additional diagnostics: %v", err)
+		} else if path != "" {
+			logger.Infof("Saved event logs, minidumps and driver versions to %s", path)
+		}
 	}()
 
 	return nil
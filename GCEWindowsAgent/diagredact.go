@@ -0,0 +1,169 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+)
+
+const redacted = "REDACTED"
+
+// redactPatterns match sensitive values. The first submatch, if any, is kept
+// and the rest of the match is replaced.
+var redactPatterns = []*regexp.Regexp{
+	// Passwords in unattend.xml, which may be plain text or base64, with or
+	// without a Value element.
+	regexp.MustCompile(`(?is)(<\w*Password>\s*<Value>)[^<]*`),
+	regexp.MustCompile(`(?i)(<\w*Password>\s*)[^<\s][^<]*`),
+	// key=value, key: value and JSON pairs, such as the encryptedPassword
+	// in windows-keys and credentials passed on the serial port.
+	regexp.MustCompile(`(?i)((?:password|passwd|pwd|secret|token|api[_-]?key)\w*"?\s*[=:]\s*"?)[^\s"',;&<]+`),
+	regexp.MustCompile(`(?i)(bearer\s+)[\w.~+/=-]+`),
+	// Google API keys.
+	regexp.MustCompile(`()AIza[\w-]{35}`),
+}
+
+// redact replaces the sensitive values in b.
+func redact(b []byte) []byte {
+	for _, re := range redactPatterns {
+		b = re.ReplaceAll(b, []byte("${1}"+redacted))
+	}
+	return b
+}
+
+// isBinary reports whether b looks like binary data, which is not redacted.
+func isBinary(b []byte) bool {
+	if len(b) > 512 {
+		b = b[:512]
+	}
+	return bytes.IndexByte(b, 0) != -1
+}
+
+// utf16Order returns the byte order of b if it is UTF-16 text, as written by
+// PowerShell and most Windows tools: it starts with a byte order mark, or
+// every other byte of its start is zero.
+func utf16Order(b []byte) (binary.ByteOrder, bool) {
+	switch {
+	case bytes.HasPrefix(b, []byte{0xff, 0xfe}):
+		return binary.LittleEndian, true
+	case bytes.HasPrefix(b, []byte{0xfe, 0xff}):
+		return binary.BigEndian, true
+	}
+	if len(b) < 2 || len(b)%2 != 0 {
+		return nil, false
+	}
+	head := b
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	for i := 0; i < len(head); i += 2 {
+		if head[i] == 0 || head[i+1] != 0 {
+			return nil, false
+		}
+	}
+	return binary.LittleEndian, true
+}
+
+// redactUTF16 redacts UTF-16 text in the given byte order, keeping the
+// encoding and byte order mark.
+func redactUTF16(b []byte, order binary.ByteOrder) []byte {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = order.Uint16(b[2*i:])
+	}
+	r := []rune(string(redact([]byte(string(utf16.Decode(u))))))
+	u = utf16.Encode(r)
+	out := make([]byte, 2*len(u))
+	for i, c := range u {
+		order.PutUint16(out[2*i:], c)
+	}
+	return out
+}
+
+// redactFile redacts the text file at p in place.
+func redactFile(p string, info os.FileInfo) error {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	var r []byte
+	if order, ok := utf16Order(b); ok {
+		r = redactUTF16(b, order)
+	} else if isBinary(b) {
+		return nil
+	} else {
+		r = redact(b)
+	}
+	if !bytes.Equal(r, b) {
+		return ioutil.WriteFile(p, r, info.Mode())
+	}
+	return nil
+}
+
+// redactEventLog replaces the exported event log at p with its events as
+// text, redacted. Event log files are checksummed, they can't be redacted in
+// place.
+func redactEventLog(p string, info os.FileInfo) error {
+	out, err := runDiagCommand("wevtutil.exe", "qe", p, "/lf:true", "/f:text")
+	if err != nil {
+		return fmt.Errorf("error reading event log %s: %v, output: %s", p, err, out)
+	}
+	txt := strings.TrimSuffix(p, filepath.Ext(p)) + ".txt"
+	if err := ioutil.WriteFile(txt, out, info.Mode()); err != nil {
+		return err
+	}
+	if err := redactFile(txt, info); err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// redactDir redacts the files under dir in place. Text files are redacted in
+// UTF-8 or UTF-16, event logs are converted to redacted text. Other binary
+// files, such as minidumps, are left untouched.
+func redactDir(dir string) error {
+	var evtx []string
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if strings.EqualFold(filepath.Ext(p), ".evtx") {
+			evtx = append(evtx, p)
+			return nil
+		}
+		return redactFile(p, info)
+	})
+	if err != nil {
+		return err
+	}
+	for _, p := range evtx {
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if err := redactEventLog(p, info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
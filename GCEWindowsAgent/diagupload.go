@@ -0,0 +1,172 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+var (
+	// diagnosticsRecheck is how often the schedule is checked, so schedule
+	// changes apply without a restart.
+	diagnosticsRecheck = time.Minute
+
+	// gcsUploadURL is replaced in tests.
+	gcsUploadURL = "https://storage.googleapis.com/upload/storage/v1"
+)
+
+// diagnosticsSchedule returns the [diagnostics] schedule, such as 6h, zero
+// if periodic collection is off.
+func diagnosticsSchedule(config *ini.File) time.Duration {
+	s := config.Section("diagnostics").Key("schedule").String()
+	if s == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		logger.Errorf("Invalid diagnostics schedule %q", s)
+		return 0
+	}
+	return d
+}
+
+// parseGCSBucket splits "gs://bucket/prefix" or "bucket" into the bucket and
+// object prefix.
+func parseGCSBucket(s string) (bucket, prefix string, err error) {
+	s = strings.TrimPrefix(s, "gs://")
+	parts := strings.SplitN(s, "/", 2)
+	if parts[0] == "" {
+		return "", "", fmt.Errorf("invalid bucket %q", s)
+	}
+	if len(parts) == 2 {
+		prefix = strings.Trim(parts[1], "/")
+	}
+	return parts[0], prefix, nil
+}
+
+// serviceAccountToken returns an access token for the default service
+// account of the instance.
+func serviceAccountToken(ctx context.Context, config *ini.File) (string, error) {
+	token, _, err := serviceAccountTokenExpiry(ctx, config)
+	return token, err
+}
+
+// serviceAccountTokenExpiry returns an access token for the default service
+// account of the instance and when it expires.
+func serviceAccountTokenExpiry(ctx context.Context, config *ini.File) (string, time.Time, error) {
+	data, err := getMetadataPath(ctx, config, "instance/service-accounts/default/token")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(data, &token); err != nil {
+		return "", time.Time{}, fmt.Errorf("error parsing service account token: %v", err)
+	}
+	return token.AccessToken, time.Now().Add(time.Duration(token.ExpiresIn) * time.Second), nil
+}
+
+// uploadToGCS uploads the file at src to bucket as object.
+func uploadToGCS(ctx context.Context, config *ini.File, bucket, object, src string) error {
+	token, err := serviceAccountToken(ctx, config)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	u := fmt.Sprintf("%s/b/%s/o?uploadType=media&name=%s", gcsUploadURL, url.PathEscape(bucket), url.QueryEscape(object))
+	req, err := http.NewRequest("POST", u, f)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/zip")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("error uploading to gs://%s/%s: %s, %s", bucket, object, resp.Status, body)
+	}
+	return nil
+}
+
+// runScheduledDiagnostics builds a diagnostics archive and uploads it to the
+// [diagnostics] bucket, if set, under the prefix and hostname.
+func runScheduledDiagnostics(ctx context.Context, config *ini.File, now time.Time) error {
+	src, err := buildDiagnosticsArchive(config, now)
+	if err != nil || src == "" {
+		return err
+	}
+	logger.Infof("Saved scheduled diagnostics to %s", src)
+
+	b := config.Section("diagnostics").Key("bucket").String()
+	if b == "" {
+		return nil
+	}
+	bucket, prefix, err := parseGCSBucket(b)
+	if err != nil {
+		return err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	object := path.Join(prefix, hostname, filepath.Base(src))
+	if err := uploadToGCS(ctx, config, bucket, object, src); err != nil {
+		return err
+	}
+	logger.Infof("Uploaded scheduled diagnostics to gs://%s/%s", bucket, object)
+	return nil
+}
+
+// diagnosticsScheduleLoop collects diagnostics every [diagnostics] schedule,
+// unless diagnostics are disabled in the config file.
+func diagnosticsScheduleLoop(ctx context.Context) {
+	last := time.Now()
+	periodicLoop(ctx, periodicTask{
+		name:     "scheduled diagnostics",
+		interval: every(diagnosticsRecheck),
+		due: func(cfg *ini.File, now time.Time) bool {
+			d := diagnosticsSchedule(cfg)
+			return d != 0 && cfg.Section("diagnostics").Key("enable").MustBool(true) && now.Sub(last) >= d
+		},
+		run: func(ctx context.Context, cfg *ini.File) error {
+			last = time.Now()
+			return runScheduledDiagnostics(ctx, cfg, last)
+		},
+	})
+}
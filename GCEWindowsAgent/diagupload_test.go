@@ -0,0 +1,119 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+func TestDiagnosticsSchedule(t *testing.T) {
+	var tests = []struct {
+		name string
+		data []byte
+		want time.Duration
+	}{
+		{"unset", []byte(""), 0},
+		{"hours", []byte("[diagnostics]\nschedule=6h"), 6 * time.Hour},
+		{"minutes", []byte("[diagnostics]\nschedule=90m"), 90 * time.Minute},
+		{"invalid", []byte("[diagnostics]\nschedule=daily"), 0},
+		{"negative", []byte("[diagnostics]\nschedule=-1h"), 0},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.data)
+		if err != nil {
+			t.Fatalf("test case %q: error parsing config: %v", tt.name, err)
+		}
+		if got := diagnosticsSchedule(cfg); got != tt.want {
+			t.Errorf("test case %q: diagnosticsSchedule() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseGCSBucket(t *testing.T) {
+	var tests = []struct {
+		in, bucket, prefix string
+		wantErr            bool
+	}{
+		{"bucket", "bucket", "", false},
+		{"gs://bucket", "bucket", "", false},
+		{"gs://bucket/", "bucket", "", false},
+		{"gs://bucket/some/prefix/", "bucket", "some/prefix", false},
+		{"gs://", "", "", true},
+		{"", "", "", true},
+	}
+
+	for _, tt := range tests {
+		bucket, prefix, err := parseGCSBucket(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseGCSBucket(%q) error = %v, wantErr %t", tt.in, err, tt.wantErr)
+			continue
+		}
+		if bucket != tt.bucket || prefix != tt.prefix {
+			t.Errorf("parseGCSBucket(%q) = %q, %q, want %q, %q", tt.in, bucket, prefix, tt.bucket, tt.prefix)
+		}
+	}
+}
+
+func TestRunScheduledDiagnostics(t *testing.T) {
+	_, cleanup := setupDiagnosticsTest(t)
+	defer cleanup()
+
+	md := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"token","expires_in":3600,"token_type":"Bearer"}`))
+	}))
+	defer md.Close()
+	var gotAuth, gotName string
+	var gotBody []byte
+	gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotAuth = r.Header.Get("Authorization")
+		gotName = r.URL.Query().Get("name")
+		gotBody, _ = ioutil.ReadAll(r.Body)
+		w.Write([]byte("{}"))
+	}))
+	defer gcs.Close()
+
+	oldMetadata, oldUpload := metadataServer, gcsUploadURL
+	metadataServer, gcsUploadURL = md.URL, gcs.URL
+	defer func() { metadataServer, gcsUploadURL = oldMetadata, oldUpload }()
+
+	cfg, err := ini.InsensitiveLoad([]byte("[diagnostics]\nbucket=gs://bucket/diag"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runScheduledDiagnostics(context.Background(), cfg, time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)); err != nil {
+		t.Fatalf("runScheduledDiagnostics() returned error: %v", err)
+	}
+
+	hostname, _ := os.Hostname()
+	if want := "diag/" + hostname + "/agent-diagnostics-20180102T030405Z.zip"; gotName != want {
+		t.Errorf("uploaded object = %q, want %q", gotName, want)
+	}
+	if gotAuth != "Bearer token" {
+		t.Errorf("Authorization = %q, want %q", gotAuth, "Bearer token")
+	}
+	if !strings.HasPrefix(string(gotBody), "PK") {
+		t.Errorf("uploaded body is not a zip archive")
+	}
+}
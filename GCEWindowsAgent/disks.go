@@ -0,0 +1,480 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// disksRegName is a REG_MULTI_SZ under regKeyBase listing the disks the agent
+// initialized, see diskRecord.
+const disksRegName = "DisksInitialized"
+
+var disksDisabled = true
+
+const (
+	// diskPartitionRaw is the PartitionStyle of a disk without a partition
+	// table.
+	diskPartitionRaw = 0
+	// diskExtendMinBytes is the free space after a volume it is extended
+	// into, smaller gaps are left by partition alignment.
+	diskExtendMinBytes = 16 << 20
+)
+
+// localDisk is a disk as seen by Windows. On Compute Engine the serial number
+// of a persistent disk is its device name.
+type localDisk struct {
+	Number       int
+	SerialNumber string
+	// UniqueID identifies the disk itself, the serial number is its device
+	// name, which another disk can be attached with.
+	UniqueID       string
+	PartitionStyle int
+	IsOffline      bool
+	IsReadOnly     bool
+	IsBoot         bool
+	IsSystem       bool
+}
+
+// diskPolicyJSON is how to initialize a blank disk. DeviceName "*" applies to
+// the disks without a policy of their own.
+type diskPolicyJSON struct {
+	DeviceName     string
+	PartitionStyle string
+	FileSystem     string
+	DriveLetter    string
+	MountPath      string
+	Label          string
+}
+
+// diskVolume is a partition with a drive letter, SizeMax is the size it can
+// be extended to.
+type diskVolume struct {
+	DriveLetter   string
+	Size, SizeMax uint64
+}
+
+// diskSystem is the interface to the Storage module.
+type diskSystem interface {
+	list() ([]localDisk, error)
+	online(d localDisk, writable bool) error
+	initialize(d localDisk, p diskPolicyJSON) error
+	volumes() ([]diskVolume, error)
+	extend(v diskVolume) error
+}
+
+// psDiskSystem manages disks with the Storage PowerShell module.
+type psDiskSystem struct{}
+
+func (psDiskSystem) list() ([]localDisk, error) {
+	out, err := runPowershell(`ConvertTo-Json -Compress -InputObject @(Get-Disk | ForEach-Object { @{Number=$_.Number; SerialNumber=$_.SerialNumber; UniqueId=$_.UniqueId; PartitionStyle=[int]$_.PartitionStyle; IsOffline=$_.IsOffline; IsReadOnly=$_.IsReadOnly; IsBoot=$_.IsBoot; IsSystem=$_.IsSystem} })`)
+	if err != nil {
+		return nil, fmt.Errorf("error listing disks: %v, output: %s", err, out)
+	}
+	var disks []localDisk
+	if err := json.Unmarshal(out, &disks); err != nil {
+		return nil, fmt.Errorf("error parsing disks: %v, output: %s", err, out)
+	}
+	for i := range disks {
+		disks[i].SerialNumber = strings.TrimSpace(disks[i].SerialNumber)
+		disks[i].UniqueID = strings.TrimSpace(disks[i].UniqueID)
+	}
+	return disks, nil
+}
+
+func (psDiskSystem) online(d localDisk, writable bool) error {
+	script := fmt.Sprintf(`Set-Disk -Number %d -IsOffline $false`, d.Number)
+	if writable && d.IsReadOnly {
+		script += fmt.Sprintf(`; Set-Disk -Number %d -IsReadOnly $false`, d.Number)
+	}
+	if out, err := runPowershell(script); err != nil {
+		return fmt.Errorf("error bringing disk %d online: %v, output: %s", d.Number, err, out)
+	}
+	return nil
+}
+
+func (psDiskSystem) initialize(d localDisk, p diskPolicyJSON) error {
+	script := fmt.Sprintf("Initialize-Disk -Number %d -PartitionStyle %s -ErrorAction Stop\n", d.Number, p.PartitionStyle)
+	if p.DriveLetter != "" {
+		script += fmt.Sprintf("$p = New-Partition -DiskNumber %d -UseMaximumSize -DriveLetter %s -ErrorAction Stop\n", d.Number, p.DriveLetter)
+	} else if p.MountPath == "" {
+		script += fmt.Sprintf("$p = New-Partition -DiskNumber %d -UseMaximumSize -AssignDriveLetter -ErrorAction Stop\n", d.Number)
+	} else {
+		script += fmt.Sprintf("$p = New-Partition -DiskNumber %d -UseMaximumSize -ErrorAction Stop\n", d.Number)
+	}
+	script += fmt.Sprintf("$p | Format-Volume -FileSystem %s -NewFileSystemLabel %s -Confirm:$false -ErrorAction Stop | Out-Null\n", p.FileSystem, psQuote(p.Label))
+	if p.MountPath != "" {
+		script += fmt.Sprintf("New-Item -ItemType Directory -Force -Path %[1]s | Out-Null\n$p | Add-PartitionAccessPath -AccessPath %[1]s -ErrorAction Stop", psQuote(p.MountPath))
+	}
+	if out, err := runPowershell(script); err != nil {
+		return fmt.Errorf("error initializing disk %d: %v, output: %s", d.Number, err, out)
+	}
+	return nil
+}
+
+func (psDiskSystem) volumes() ([]diskVolume, error) {
+	// Disks grown online keep their old size until storage is rescanned.
+	out, err := runPowershell(`Update-HostStorageCache
+ConvertTo-Json -Compress -InputObject @(Get-Partition | Where-Object { [string]$_.DriveLetter -match '^[A-Z]$' } | ForEach-Object { @{DriveLetter=[string]$_.DriveLetter; Size=$_.Size; SizeMax=($_ | Get-PartitionSupportedSize).SizeMax} })`)
+	if err != nil {
+		return nil, fmt.Errorf("error listing volumes: %v, output: %s", err, out)
+	}
+	var vols []diskVolume
+	if err := json.Unmarshal(out, &vols); err != nil {
+		return nil, fmt.Errorf("error parsing volumes: %v, output: %s", err, out)
+	}
+	return vols, nil
+}
+
+func (psDiskSystem) extend(v diskVolume) error {
+	if out, err := runPowershell(fmt.Sprintf(`Resize-Partition -DriveLetter %s -Size %d`, v.DriveLetter, v.SizeMax)); err != nil {
+		return fmt.Errorf("error extending %s: %v, output: %s", v.DriveLetter, err, out)
+	}
+	return nil
+}
+
+var (
+	diskMgr diskSystem = psDiskSystem{}
+	// readDisksInitialized and writeDisksInitialized are replaced in tests.
+	readDisksInitialized = func() ([]string, error) {
+		return readRegMultiString(regKeyBase, disksRegName)
+	}
+	writeDisksInitialized = func(records []string) error {
+		return writeRegMultiString(regKeyBase, disksRegName, records)
+	}
+)
+
+// parseDiskPolicies parses a JSON list of disk policies, filling in the
+// defaults and skipping invalid and duplicate ones.
+func parseDiskPolicies(data string) map[string]diskPolicyJSON {
+	if data == "" {
+		return nil
+	}
+
+	var ps []diskPolicyJSON
+	if err := json.Unmarshal([]byte(data), &ps); err != nil {
+		logger.Errorln("Error parsing disk policies:", err)
+		return nil
+	}
+
+	policies := make(map[string]diskPolicyJSON)
+	for _, p := range ps {
+		if p.DeviceName == "" {
+			logger.Errorf("Disk policy %+v has no DeviceName, ignoring", p)
+			continue
+		}
+		if _, ok := policies[p.DeviceName]; ok {
+			logger.Errorf("Duplicate disk policy for %s, ignoring %+v", p.DeviceName, p)
+			continue
+		}
+		p.PartitionStyle = strings.ToUpper(p.PartitionStyle)
+		if p.PartitionStyle == "" {
+			p.PartitionStyle = "GPT"
+		}
+		if p.PartitionStyle != "GPT" && p.PartitionStyle != "MBR" {
+			logger.Errorf("Disk policy for %s has invalid PartitionStyle %q, want GPT or MBR, ignoring", p.DeviceName, p.PartitionStyle)
+			continue
+		}
+		if p.FileSystem == "" {
+			p.FileSystem = "NTFS"
+		}
+		if !containsString(strings.ToUpper(p.FileSystem), []string{"NTFS", "REFS", "EXFAT", "FAT32"}) {
+			logger.Errorf("Disk policy for %s has invalid FileSystem %q, want NTFS, ReFS, exFAT or FAT32, ignoring", p.DeviceName, p.FileSystem)
+			continue
+		}
+		if p.DriveLetter != "" {
+			drive, err := normalizeDrive(p.DriveLetter)
+			if err != nil || drive == "A:" || drive == "B:" || drive == "C:" {
+				logger.Errorf("Disk policy for %s has invalid DriveLetter %q, ignoring", p.DeviceName, p.DriveLetter)
+				continue
+			}
+			p.DriveLetter = drive[:1]
+		}
+		policies[p.DeviceName] = p
+	}
+	return policies
+}
+
+// disks brings hot-attached disks online and initializes blank disks that
+// have a policy. Disks it initialized are recorded in the registry, and only
+// disks without a partition table are initialized, so an existing volume is
+// never formatted.
+type disks struct {
+	newMetadata, oldMetadata *metadataJSON
+	config                   *ini.File
+}
+
+func (d *disks) diff() bool {
+	return !reflect.DeepEqual(d.newMetadata.Instance.Disks, d.oldMetadata.Instance.Disks) ||
+		d.newMetadata.Instance.Attributes.DiskPolicy != d.oldMetadata.Instance.Attributes.DiskPolicy ||
+		d.newMetadata.Project.Attributes.DiskPolicy != d.oldMetadata.Project.Attributes.DiskPolicy
+}
+
+func (d *disks) metadataPaths() []string {
+	// The instance ID keys the record of initialized disks.
+	return append([]string{"instance/disks", "instance/id"}, attributePaths...)
+}
+
+func (d *disks) disabled() (disabled bool) {
+	defer func() {
+		if disabled != disksDisabled {
+			disksDisabled = disabled
+			logStatus("disks", disabled)
+		}
+	}()
+
+	return !d.enablement().Enabled
+}
+
+// Disks are only brought online and initialized when [disks] enable is set,
+// no metadata attribute turns it on.
+func (d *disks) enablement() enablement {
+	return isEnabled(d.config, d.newMetadata, enableRule{section: "disks", key: "enable"}, false)
+}
+
+// policies returns the disk policies from the config file, or instance and
+// then project metadata.
+func (d *disks) policies() map[string]diskPolicyJSON {
+	data := d.config.Section("disks").Key("policy").String()
+	if data == "" {
+		data = d.newMetadata.Instance.Attributes.DiskPolicy
+	}
+	if data == "" {
+		data = d.newMetadata.Project.Attributes.DiskPolicy
+	}
+	return parseDiskPolicies(data)
+}
+
+// diskAction is what the manager does to an attached disk.
+type diskAction struct {
+	disk       localDisk
+	online     bool
+	writable   bool
+	initialize bool
+	policy     diskPolicyJSON
+}
+
+func (a diskAction) String() string {
+	var s []string
+	if a.online {
+		s = append(s, fmt.Sprintf("bring disk %s (%d) online", a.disk.SerialNumber, a.disk.Number))
+	}
+	if a.initialize {
+		s = append(s, fmt.Sprintf("initialize disk %s (%d) as %s %s", a.disk.SerialNumber, a.disk.Number, a.policy.PartitionStyle, a.policy.FileSystem))
+	}
+	return strings.Join(s, " and ")
+}
+
+// diskRecord returns the record of d being initialized on the instance with
+// id. An instance created from an image of this one has another ID, so its
+// disks are not taken as initialized.
+func diskRecord(id uint64, d localDisk) string {
+	disk := d.UniqueID
+	if disk == "" {
+		disk = d.SerialNumber
+	}
+	return fmt.Sprintf("%d/%s", id, disk)
+}
+
+// actions returns what to do to the attached disks. Disks not attached in
+// metadata, such as the boot disk, are left alone.
+func (d *disks) actions() ([]diskAction, error) {
+	local, err := diskMgr.list()
+	if err != nil {
+		return nil, err
+	}
+	initialized, err := readDisksInitialized()
+	if err != nil && err != errRegNotExist {
+		// Without the record, no disk can safely be initialized.
+		return nil, fmt.Errorf("error reading initialized disks: %v", err)
+	}
+	policies := d.policies()
+
+	var actions []diskAction
+	for _, md := range d.newMetadata.Instance.Disks {
+		if md.Type != "PERSISTENT" && md.Type != "SCRATCH" {
+			continue
+		}
+		for _, ld := range local {
+			if ld.SerialNumber != md.DeviceName || ld.IsBoot || ld.IsSystem {
+				continue
+			}
+			a := diskAction{disk: ld, online: ld.IsOffline, writable: md.Mode == "READ_WRITE"}
+			if a.writable && ld.IsReadOnly {
+				a.online = true
+			}
+			p, ok := policies[md.DeviceName]
+			if !ok {
+				p, ok = policies["*"]
+			}
+			switch {
+			case !ok || !a.writable || ld.PartitionStyle != diskPartitionRaw:
+			case containsString(diskRecord(d.newMetadata.Instance.ID, ld), initialized):
+				logger.Errorf("Disk %s was initialized before and is blank now, not initializing it again.", ld.SerialNumber)
+			default:
+				a.initialize, a.policy = true, p
+			}
+			if a.online || a.initialize {
+				actions = append(actions, a)
+			}
+		}
+	}
+	return actions, nil
+}
+
+func (d *disks) plan() ([]string, error) {
+	actions, err := d.actions()
+	if err != nil {
+		return nil, err
+	}
+	var changes []string
+	for _, a := range actions {
+		changes = append(changes, a.String())
+	}
+	return changes, nil
+}
+
+// set brings the disks online and initializes them. The disk is recorded
+// before it is initialized, so an interrupted initialization is never
+// retried over the volume it may have created.
+func (d *disks) set(ctx context.Context) error {
+	actions, err := d.actions()
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, a := range actions {
+		logger.Infof("Disks: %s.", a)
+		if a.online {
+			if err := diskMgr.online(a.disk, a.writable); err != nil {
+				logger.Error(err)
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+		}
+		if !a.initialize {
+			continue
+		}
+		initialized, _ := readDisksInitialized()
+		if err := writeDisksInitialized(append(initialized, diskRecord(d.newMetadata.Instance.ID, a.disk))); err != nil {
+			err = fmt.Errorf("error recording disk %s, not initializing it: %v", a.disk.SerialNumber, err)
+			logger.Error(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if err := diskMgr.initialize(a.disk, a.policy); err != nil {
+			logger.Error(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// extendDrives returns the drive letters in [disks] extend_drives, "*" allows
+// every drive.
+func extendDrives(cfg *ini.File) []string {
+	var drives []string
+	for _, d := range cfg.Section("disks").Key("extend_drives").Strings(",") {
+		if d == "*" {
+			return []string{"*"}
+		}
+		drive, err := normalizeDrive(d)
+		if err != nil {
+			logger.Errorf("Invalid drive %q in disks.extend_drives, ignoring", d)
+			continue
+		}
+		drives = append(drives, drive[:1])
+	}
+	return drives
+}
+
+// extendVolumes extends the allowed volumes into the free space after them,
+// as Windows doesn't when their disk is resized.
+func extendVolumes(cfg *ini.File) error {
+	drives := extendDrives(cfg)
+	if len(drives) == 0 {
+		return nil
+	}
+	vols, err := diskMgr.volumes()
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, v := range vols {
+		if !containsString("*", drives) && !containsString(v.DriveLetter, drives) {
+			continue
+		}
+		if v.SizeMax < v.Size+diskExtendMinBytes {
+			continue
+		}
+		if dryRun(cfg) {
+			logger.Infof("Dry run: would extend %s: from %d to %d bytes.", v.DriveLetter, v.Size, v.SizeMax)
+			continue
+		}
+		logger.Infof("Extending %s: from %d to %d bytes.", v.DriveLetter, v.Size, v.SizeMax)
+		if err := diskMgr.extend(v); err != nil {
+			logger.Error(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Bounds of [disks] extend_interval_sec, every check lists the volumes.
+const (
+	defaultExtendInterval = 5 * time.Minute
+	minExtendInterval     = 30 * time.Second
+)
+
+// extendInterval returns [disks] extend_interval_sec, the default if it is not
+// positive and at least minExtendInterval.
+func extendInterval(cfg *ini.File) time.Duration {
+	sec := cfg.Section("disks").Key("extend_interval_sec").MustInt(int(defaultExtendInterval / time.Second))
+	if sec < 1 {
+		return defaultExtendInterval
+	}
+	if d := time.Duration(sec) * time.Second; d > minExtendInterval {
+		return d
+	}
+	return minExtendInterval
+}
+
+// diskExtendLoop extends volumes every [disks] extend_interval_sec, as a disk
+// resize changes no metadata. It holds updateMu so it never runs alongside
+// the disks manager.
+func diskExtendLoop(ctx context.Context) {
+	periodicLoop(ctx, periodicTask{
+		name:      "volume extension",
+		interval:  extendInterval,
+		exclusive: true,
+		run:       func(_ context.Context, cfg *ini.File) error { return extendVolumes(cfg) },
+	})
+}
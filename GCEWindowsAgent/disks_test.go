@@ -0,0 +1,220 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+type fakeDiskSystem struct {
+	disks       []localDisk
+	vols        []diskVolume
+	ran         []string
+	initialized []diskPolicyJSON
+}
+
+func (f *fakeDiskSystem) list() ([]localDisk, error) {
+	return f.disks, nil
+}
+
+func (f *fakeDiskSystem) online(d localDisk, writable bool) error {
+	if writable {
+		f.ran = append(f.ran, "online "+d.SerialNumber+" writable")
+	} else {
+		f.ran = append(f.ran, "online "+d.SerialNumber)
+	}
+	return nil
+}
+
+func (f *fakeDiskSystem) initialize(d localDisk, p diskPolicyJSON) error {
+	f.ran = append(f.ran, "initialize "+d.SerialNumber)
+	f.initialized = append(f.initialized, p)
+	return nil
+}
+
+func (f *fakeDiskSystem) volumes() ([]diskVolume, error) {
+	return f.vols, nil
+}
+
+func (f *fakeDiskSystem) extend(v diskVolume) error {
+	f.ran = append(f.ran, "extend "+v.DriveLetter)
+	return nil
+}
+
+func TestParseDiskPolicies(t *testing.T) {
+	var tests = []struct {
+		name string
+		data string
+		want map[string]diskPolicyJSON
+	}{
+		{"empty", "", nil},
+		{"invalid JSON", "[", nil},
+		{"defaults", `[{"DeviceName":"data"}]`, map[string]diskPolicyJSON{"data": {DeviceName: "data", PartitionStyle: "GPT", FileSystem: "NTFS"}}},
+		{"all fields", `[{"DeviceName":"*","PartitionStyle":"mbr","FileSystem":"ReFS","DriveLetter":"e:","Label":"logs"}]`,
+			map[string]diskPolicyJSON{"*": {DeviceName: "*", PartitionStyle: "MBR", FileSystem: "ReFS", DriveLetter: "E", Label: "logs"}}},
+		{"invalid skipped", `[{"DeviceName":"a","PartitionStyle":"APM"},{"DeviceName":"b","FileSystem":"ext4"},{"DeviceName":"c","DriveLetter":"C"},{"DriveLetter":"F"}]`, map[string]diskPolicyJSON{}},
+		{"duplicate skipped", `[{"DeviceName":"data","MountPath":"D:\\data"},{"DeviceName":"data","DriveLetter":"F"}]`,
+			map[string]diskPolicyJSON{"data": {DeviceName: "data", PartitionStyle: "GPT", FileSystem: "NTFS", MountPath: `D:\data`}}},
+	}
+
+	for _, tt := range tests {
+		if got := parseDiskPolicies(tt.data); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("test case %q: parseDiskPolicies got: %+v, want: %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDisksMetadataPaths(t *testing.T) {
+	// diskRecord keys on the instance ID, a subtree fetch has to include it.
+	paths := (&disks{}).metadataPaths()
+	for _, want := range []string{"instance/disks", "instance/id"} {
+		if !containsString(want, paths) {
+			t.Errorf("metadataPaths() got: %q, missing %q", paths, want)
+		}
+	}
+}
+
+func TestDisksSet(t *testing.T) {
+	oldMgr, oldRead, oldWrite := diskMgr, readDisksInitialized, writeDisksInitialized
+	defer func() {
+		diskMgr, readDisksInitialized, writeDisksInitialized = oldMgr, oldRead, oldWrite
+	}()
+
+	local := []localDisk{
+		{Number: 0, SerialNumber: "boot", PartitionStyle: 2, IsBoot: true, IsSystem: true},
+		{Number: 1, SerialNumber: "blank", UniqueID: "disk-1", IsOffline: true, IsReadOnly: true},
+		{Number: 2, SerialNumber: "existing", PartitionStyle: 2, IsOffline: true},
+		{Number: 3, SerialNumber: "shared", IsOffline: true, IsReadOnly: true},
+		{Number: 4, SerialNumber: "unknown", IsOffline: true},
+	}
+	attached := []diskJSON{
+		{DeviceName: "boot", Mode: "READ_WRITE", Type: "PERSISTENT"},
+		{DeviceName: "blank", Index: 1, Mode: "READ_WRITE", Type: "PERSISTENT"},
+		{DeviceName: "existing", Index: 2, Mode: "READ_WRITE", Type: "PERSISTENT"},
+		{DeviceName: "shared", Index: 3, Mode: "READ_ONLY", Type: "PERSISTENT"},
+	}
+	var tests = []struct {
+		name            string
+		policy          string
+		initialized     []string
+		wantRan         []string
+		wantInitialized []string
+	}{
+		{"no policy", "", nil, []string{"online blank writable", "online existing writable", "online shared"}, nil},
+		{"policy", `[{"DeviceName":"*"}]`, nil,
+			[]string{"online blank writable", "initialize blank", "online existing writable", "online shared"}, []string{"7/disk-1"}},
+		{"initialized before", `[{"DeviceName":"blank","DriveLetter":"E"}]`, []string{"7/disk-1"},
+			[]string{"online blank writable", "online existing writable", "online shared"}, []string{"7/disk-1"}},
+		{"initialized on another instance", `[{"DeviceName":"*"}]`, []string{"6/disk-1"},
+			[]string{"online blank writable", "initialize blank", "online existing writable", "online shared"}, []string{"6/disk-1", "7/disk-1"}},
+		{"other disk with the device name", `[{"DeviceName":"*"}]`, []string{"7/disk-0"},
+			[]string{"online blank writable", "initialize blank", "online existing writable", "online shared"}, []string{"7/disk-0", "7/disk-1"}},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte("[disks]\nenable=true"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fake := &fakeDiskSystem{disks: local}
+		diskMgr = fake
+		initialized := tt.initialized
+		readDisksInitialized = func() ([]string, error) { return initialized, nil }
+		writeDisksInitialized = func(records []string) error {
+			initialized = records
+			return nil
+		}
+		md := &metadataJSON{Instance: instanceJSON{ID: 7, Disks: attached, Attributes: attributesJSON{DiskPolicy: tt.policy}}}
+		d := &disks{newMetadata: md, oldMetadata: &metadataJSON{}, config: cfg}
+		if !d.diff() {
+			t.Errorf("test case %q: no diff for attached disks", tt.name)
+		}
+		if err := d.set(context.Background()); err != nil {
+			t.Errorf("test case %q: set error: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(fake.ran, tt.wantRan) {
+			t.Errorf("test case %q: ran got: %q, want: %q", tt.name, fake.ran, tt.wantRan)
+		}
+		if !reflect.DeepEqual(initialized, tt.wantInitialized) {
+			t.Errorf("test case %q: initialized got: %q, want: %q", tt.name, initialized, tt.wantInitialized)
+		}
+	}
+}
+
+func TestExtendVolumes(t *testing.T) {
+	oldMgr := diskMgr
+	defer func() { diskMgr = oldMgr }()
+
+	vols := []diskVolume{
+		{"C", 50 << 30, 50 << 30},
+		{"D", 100 << 30, 200 << 30},
+		{"E", 10 << 30, 10<<30 + 1<<20},
+		{"F", 10 << 30, 20 << 30},
+	}
+	var tests = []struct {
+		name    string
+		data    string
+		wantRan []string
+	}{
+		{"not configured", "", nil},
+		{"allowlist", "[disks]\nextend_drives = d:, E, C", []string{"extend D"}},
+		{"invalid drive", "[disks]\nextend_drives = data, F", []string{"extend F"}},
+		{"all drives", "[disks]\nextend_drives = *", []string{"extend D", "extend F"}},
+		{"dry run", "[core]\ndry_run = true\n[disks]\nextend_drives = *", nil},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fake := &fakeDiskSystem{vols: vols}
+		diskMgr = fake
+		if err := extendVolumes(cfg); err != nil {
+			t.Errorf("test case %q: extendVolumes error: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(fake.ran, tt.wantRan) {
+			t.Errorf("test case %q: ran got: %q, want: %q", tt.name, fake.ran, tt.wantRan)
+		}
+	}
+}
+
+func TestExtendInterval(t *testing.T) {
+	var tests = []struct {
+		data string
+		want time.Duration
+	}{
+		{"", 5 * time.Minute},
+		{"[disks]\nextend_interval_sec = 600", 10 * time.Minute},
+		{"[disks]\nextend_interval_sec = 0", 5 * time.Minute},
+		{"[disks]\nextend_interval_sec = -5", 5 * time.Minute},
+		{"[disks]\nextend_interval_sec = 1", 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := extendInterval(cfg); got != tt.want {
+			t.Errorf("extendInterval(%q) got: %s, want: %s", tt.data, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,423 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// dnsRegName is a REG_MULTI_SZ value under regKeyBase holding the resolver
+// settings last applied by the agent, so they can be reverted when removed.
+const dnsRegName = "DNSConfig"
+
+// dnsClient reads and writes the resolver settings of the system.
+type dnsClient interface {
+	// servers returns the DNS servers of the adapter with index.
+	servers(index int) ([]string, error)
+	// setServers sets the DNS servers of the adapter with index, an empty
+	// list resets them to the ones from DHCP.
+	setServers(index int, servers []string) error
+	searchList() ([]string, error)
+	setSearchList(domains []string) error
+}
+
+type psDNSClient struct{}
+
+func (psDNSClient) servers(index int) ([]string, error) {
+	out, err := runPowershell(fmt.Sprintf(`ConvertTo-Json -Compress -InputObject @(Get-DnsClientServerAddress -InterfaceIndex %d | ForEach-Object { $_.ServerAddresses })`, index))
+	if err != nil {
+		return nil, fmt.Errorf("error getting DNS servers of interface %d: %v, output: %s", index, err, out)
+	}
+	return parseDNSList(out)
+}
+
+func (psDNSClient) setServers(index int, servers []string) error {
+	script := fmt.Sprintf(`Set-DnsClientServerAddress -InterfaceIndex %d -ResetServerAddresses`, index)
+	if len(servers) != 0 {
+		script = fmt.Sprintf(`Set-DnsClientServerAddress -InterfaceIndex %d -ServerAddresses %s`, index, psList(servers))
+	}
+	if out, err := runPowershell(script); err != nil {
+		return fmt.Errorf("error setting DNS servers of interface %d: %v, output: %s", index, err, out)
+	}
+	return nil
+}
+
+func (psDNSClient) searchList() ([]string, error) {
+	out, err := runPowershell(`ConvertTo-Json -Compress -InputObject @((Get-DnsClientGlobalSetting).SuffixSearchList)`)
+	if err != nil {
+		return nil, fmt.Errorf("error getting DNS search list: %v, output: %s", err, out)
+	}
+	return parseDNSList(out)
+}
+
+func (psDNSClient) setSearchList(domains []string) error {
+	list := "@()"
+	if len(domains) != 0 {
+		list = psList(domains)
+	}
+	if out, err := runPowershell(`Set-DnsClientGlobalSetting -SuffixSearchList ` + list); err != nil {
+		return fmt.Errorf("error setting DNS search list: %v, output: %s", err, out)
+	}
+	return nil
+}
+
+// psList formats items as a PowerShell array argument.
+func psList(items []string) string {
+	var quoted []string
+	for _, i := range items {
+		quoted = append(quoted, psQuote(i))
+	}
+	return strings.Join(quoted, ",")
+}
+
+func parseDNSList(out []byte) ([]string, error) {
+	var list []string
+	if err := json.Unmarshal(out, &list); err != nil {
+		return nil, fmt.Errorf("error parsing DNS settings %q: %v", out, err)
+	}
+	return list, nil
+}
+
+// dnsConfigJSON is the resolver configuration for the adapter with Mac.
+type dnsConfigJSON struct {
+	Mac        string
+	Servers    []string
+	SearchList []string
+}
+
+var (
+	dnsDisabled = false
+
+	// dnsClientMgr, dnsInterfaces, readDNSState and writeDNSState are
+	// replaced in tests.
+	dnsClientMgr  dnsClient = psDNSClient{}
+	dnsInterfaces           = net.Interfaces
+	readDNSState            = func() ([]string, error) { return readRegMultiString(regKeyBase, dnsRegName) }
+	writeDNSState           = func(s []string) error { return writeRegMultiString(regKeyBase, dnsRegName, s) }
+)
+
+type dns struct {
+	newMetadata, oldMetadata *metadataJSON
+	config                   *ini.File
+}
+
+// splitDNSList splits a comma or space separated list, dropping duplicates.
+func splitDNSList(s string) []string {
+	var list []string
+	for _, f := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !containsString(f, list) {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+// setting returns the value of key from the config file, or attr from
+// instance and then project metadata.
+func (d *dns) setting(key string, attr func(attributesJSON) string) string {
+	if v := d.config.Section("dns").Key(key).String(); v != "" {
+		return v
+	}
+	if v := attr(d.newMetadata.Instance.Attributes); v != "" {
+		return v
+	}
+	return attr(d.newMetadata.Project.Attributes)
+}
+
+// managedDomain returns the domain when the domain join manager joins a
+// Managed Microsoft AD domain, which the search list includes. Managed
+// Microsoft AD forwards the domain to authorized networks with Cloud DNS, so
+// the servers stay unchanged.
+func (d *dns) managedDomain() string {
+	j := &domainJoin{newMetadata: d.newMetadata, config: d.config}
+	if !j.enablement().Enabled {
+		return ""
+	}
+	p, ok := j.params()
+	if !ok || p.ManagedDomain == "" {
+		return ""
+	}
+	return p.Domain
+}
+
+// want returns the resolver configuration for the primary network interface,
+// or the adapter selected by [dns] interface_mac. Invalid server addresses
+// are skipped. The search list has the configured domains followed by the
+// managed domain being joined, if any.
+func (d *dns) want() dnsConfigJSON {
+	var c dnsConfigJSON
+	var primary string
+	if nis := d.newMetadata.Instance.NetworkInterfaces; len(nis) != 0 {
+		primary = nis[0].Mac
+	}
+	sec := d.config.Section("dns")
+	if mac, err := selectedMAC(sec, primary); err == nil {
+		c.Mac = mac
+	} else if sec.Key("interface_mac").String() != "" {
+		logger.Error(err)
+	}
+	for _, s := range splitDNSList(d.setting("servers", func(a attributesJSON) string { return a.DNSServers })) {
+		if net.ParseIP(s) == nil {
+			logger.Errorf("Ignoring invalid DNS server %q", s)
+			continue
+		}
+		c.Servers = append(c.Servers, s)
+	}
+	c.SearchList = splitDNSList(d.setting("search_domains", func(a attributesJSON) string { return a.DNSSearchDomains }))
+	if domain := d.managedDomain(); domain != "" && !containsString(domain, c.SearchList) {
+		c.SearchList = append(c.SearchList, domain)
+	}
+	return c
+}
+
+// splitDNSFamilies splits servers into IPv4 and IPv6 addresses.
+func splitDNSFamilies(servers []string) (v4, v6 []string) {
+	for _, s := range servers {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() == nil {
+			v6 = append(v6, s)
+		} else {
+			v4 = append(v4, s)
+		}
+	}
+	return v4, v6
+}
+
+// sameDNSServers reports whether the servers of an adapter, cur, are the
+// servers in want. Windows lists the servers of both address families
+// together and setting those of one leaves the other alone, so the IPv6
+// servers are only compared if want has any.
+func sameDNSServers(cur, want []string) bool {
+	curV4, curV6 := splitDNSFamilies(cur)
+	wantV4, wantV6 := splitDNSFamilies(want)
+	if strings.Join(curV4, ",") != strings.Join(wantV4, ",") {
+		return false
+	}
+	return len(wantV6) == 0 || strings.Join(curV6, ",") == strings.Join(wantV6, ",")
+}
+
+// loadDNSState returns the configuration last applied by the agent.
+func loadDNSState() dnsConfigJSON {
+	var state dnsConfigJSON
+	data, err := readDNSState()
+	if err != nil && err != errRegNotExist {
+		logger.Error(err)
+	}
+	if err == nil && len(data) != 0 {
+		if err := json.Unmarshal([]byte(data[0]), &state); err != nil {
+			logger.Error(err)
+		}
+	}
+	return state
+}
+
+func (d *dns) diff() bool {
+	if changed, ok := dnsPause.diff(dnsPause.migrating(d.newMetadata, d.config)); ok {
+		return changed
+	}
+	want := d.want()
+	if !reflect.DeepEqual(want, loadDNSState()) {
+		return true
+	}
+	// Reapply settings changed outside the agent.
+	if len(want.Servers) != 0 {
+		ifs, err := dnsInterfaces()
+		if err != nil {
+			logger.Error(err)
+			return false
+		}
+		if iface, err := interfaceByMAC(want.Mac, ifs); err == nil {
+			if cur, err := dnsClientMgr.servers(iface.Index); err == nil && !sameDNSServers(cur, want.Servers) {
+				logger.Debugf("DNS servers on interface %d are %q, want %q", iface.Index, cur, want.Servers)
+				return true
+			}
+		}
+	}
+	if len(want.SearchList) != 0 {
+		if cur, err := dnsClientMgr.searchList(); err == nil && !reflect.DeepEqual(cur, want.SearchList) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *dns) metadataPaths() []string {
+	return append([]string{"instance/network-interfaces", "instance/maintenance-event"}, attributePaths...)
+}
+
+func (d *dns) disabled() (disabled bool) {
+	defer func() {
+		if disabled != dnsDisabled {
+			dnsDisabled = disabled
+			logStatus("DNS", disabled)
+		}
+	}()
+
+	return !d.enablement().Enabled
+}
+
+var dnsEnable = enableRule{
+	section:   "dns",
+	key:       "disable",
+	attribute: "disable-dns-manager",
+	value:     func(a attributesJSON) string { return a.DisableDNSManager },
+	inverted:  true,
+}
+
+func (d *dns) enablement() enablement {
+	return isEnabled(d.config, d.newMetadata, dnsEnable, !dnsDisabled)
+}
+
+// plan returns the DNS changes set would make.
+func (d *dns) plan() ([]string, error) {
+	if dnsPause.migrating(d.newMetadata, d.config) {
+		return []string{"pause until the live migration completes"}, nil
+	}
+	want, state := d.want(), loadDNSState()
+	ifs, err := dnsInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	var changes []string
+	if len(state.Servers) != 0 && (len(want.Servers) == 0 || state.Mac != want.Mac) {
+		if _, err := interfaceByMAC(state.Mac, ifs); err == nil {
+			changes = append(changes, fmt.Sprintf("reset the DNS servers of %s", state.Mac))
+		}
+	}
+	if len(want.Servers) != 0 {
+		iface, err := interfaceByMAC(want.Mac, ifs)
+		if err != nil {
+			return nil, err
+		}
+		cur, err := dnsClientMgr.servers(iface.Index)
+		if err != nil {
+			return nil, err
+		}
+		if !sameDNSServers(cur, want.Servers) {
+			changes = append(changes, fmt.Sprintf("change the DNS servers of %s from %q to %q", want.Mac, cur, want.Servers))
+		}
+	}
+	switch {
+	case len(want.SearchList) != 0:
+		cur, err := dnsClientMgr.searchList()
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(cur, want.SearchList) {
+			changes = append(changes, fmt.Sprintf("change the DNS search list from %q to %q", cur, want.SearchList))
+		}
+	case len(state.SearchList) != 0:
+		changes = append(changes, "reset the DNS search list")
+	}
+	return changes, nil
+}
+
+// set applies the configured DNS servers to the adapter of want and the
+// search domains globally, changing only settings that differ. Settings the
+// agent applied before but that are no longer configured are reset.
+func (d *dns) set(ctx context.Context) (err error) {
+	if dnsPause.skip(dnsPause.migrating(d.newMetadata, d.config)) {
+		return nil
+	}
+	defer func() { dnsPause.done(err) }()
+	want, state := d.want(), loadDNSState()
+	ifs, err := dnsInterfaces()
+	if err != nil {
+		return err
+	}
+
+	// applied is what the agent manages after this run, written even on
+	// error so a failed reset is retried.
+	applied := state
+	var firstErr error
+	record := func(err error) {
+		logger.Error(err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if len(state.Servers) != 0 && (len(want.Servers) == 0 || state.Mac != want.Mac) {
+		if iface, err := interfaceByMAC(state.Mac, ifs); err == nil {
+			logger.Infof("Resetting DNS servers of %s.", state.Mac)
+			if err := dnsClientMgr.setServers(iface.Index, nil); err != nil {
+				record(err)
+			} else {
+				applied.Servers = nil
+			}
+		} else {
+			// The adapter is gone, nothing to reset.
+			applied.Servers = nil
+		}
+	}
+	applied.Mac = want.Mac
+
+	if len(want.Servers) != 0 {
+		iface, err := interfaceByMAC(want.Mac, ifs)
+		if err != nil {
+			record(err)
+		} else if cur, err := dnsClientMgr.servers(iface.Index); err != nil {
+			record(err)
+		} else if !sameDNSServers(cur, want.Servers) {
+			logger.Infof("Changing DNS servers of %s from %q to %q.", want.Mac, cur, want.Servers)
+			if err := dnsClientMgr.setServers(iface.Index, want.Servers); err != nil {
+				record(err)
+			} else {
+				applied.Servers = want.Servers
+			}
+		} else {
+			applied.Servers = want.Servers
+		}
+	}
+
+	switch {
+	case len(want.SearchList) != 0:
+		if cur, err := dnsClientMgr.searchList(); err != nil {
+			record(err)
+		} else if !reflect.DeepEqual(cur, want.SearchList) {
+			logger.Infof("Changing DNS search list from %q to %q.", cur, want.SearchList)
+			if err := dnsClientMgr.setSearchList(want.SearchList); err != nil {
+				record(err)
+			} else {
+				applied.SearchList = want.SearchList
+			}
+		} else {
+			applied.SearchList = want.SearchList
+		}
+	case len(state.SearchList) != 0:
+		logger.Info("Resetting DNS search list.")
+		if err := dnsClientMgr.setSearchList(nil); err != nil {
+			record(err)
+		} else {
+			applied.SearchList = nil
+		}
+	}
+
+	data, err := json.Marshal(applied)
+	if err != nil {
+		return err
+	}
+	if err := writeDNSState([]string{string(data)}); err != nil {
+		return err
+	}
+	return firstErr
+}
@@ -0,0 +1,215 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+type fakeDNSClient struct {
+	ifServers map[int][]string
+	search    []string
+	calls     []string
+}
+
+func (f *fakeDNSClient) servers(index int) ([]string, error) {
+	return f.ifServers[index], nil
+}
+
+func (f *fakeDNSClient) setServers(index int, servers []string) error {
+	f.calls = append(f.calls, "setServers")
+	f.ifServers[index] = servers
+	return nil
+}
+
+func (f *fakeDNSClient) searchList() ([]string, error) {
+	return f.search, nil
+}
+
+func (f *fakeDNSClient) setSearchList(domains []string) error {
+	f.calls = append(f.calls, "setSearchList")
+	f.search = domains
+	return nil
+}
+
+func TestSplitDNSList(t *testing.T) {
+	var tests = []struct {
+		in   string
+		want []string
+	}{
+		{"", nil},
+		{"8.8.8.8", []string{"8.8.8.8"}},
+		{"8.8.8.8, 8.8.4.4 8.8.8.8", []string{"8.8.8.8", "8.8.4.4"}},
+		{"corp.example.com,,example.com", []string{"corp.example.com", "example.com"}},
+	}
+	for _, tt := range tests {
+		if got := splitDNSList(tt.in); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitDNSList(%q) got: %q, want: %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSameDNSServers(t *testing.T) {
+	var tests = []struct {
+		name      string
+		cur, want []string
+		same      bool
+	}{
+		{"same", []string{"10.0.0.2", "8.8.8.8"}, []string{"10.0.0.2", "8.8.8.8"}, true},
+		{"ipv6 servers ignored", []string{"10.0.0.2", "fec0:0:0:ffff::1"}, []string{"10.0.0.2"}, true},
+		{"ipv4 differs", []string{"10.0.0.3", "fec0:0:0:ffff::1"}, []string{"10.0.0.2"}, false},
+		{"order differs", []string{"8.8.8.8", "10.0.0.2"}, []string{"10.0.0.2", "8.8.8.8"}, false},
+		{"ipv6 wanted", []string{"10.0.0.2", "fec0:0:0:ffff::1"}, []string{"10.0.0.2", "2001:4860:4860::8888"}, false},
+		{"ipv6 same", []string{"10.0.0.2", "2001:4860:4860::8888"}, []string{"10.0.0.2", "2001:4860:4860::8888"}, true},
+	}
+	for _, tt := range tests {
+		if got := sameDNSServers(tt.cur, tt.want); got != tt.same {
+			t.Errorf("test case %q: sameDNSServers(%q, %q) got: %t, want: %t", tt.name, tt.cur, tt.want, got, tt.same)
+		}
+	}
+}
+
+func TestDNSWant(t *testing.T) {
+	cfg := ini.Empty()
+	md := &metadataJSON{
+		Instance: instanceJSON{
+			NetworkInterfaces: []networkInterfacesJSON{{Mac: "00:00:00:00:00:01"}},
+			Attributes:        attributesJSON{DNSServers: "10.0.0.2, bad"},
+		},
+		Project: projectJSON{Attributes: attributesJSON{DNSServers: "10.0.0.3", DNSSearchDomains: "example.com"}},
+	}
+	want := dnsConfigJSON{Mac: "00:00:00:00:00:01", Servers: []string{"10.0.0.2"}, SearchList: []string{"example.com"}}
+	if got := (&dns{newMetadata: md, config: cfg}).want(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want() got: %+v, want: %+v", got, want)
+	}
+
+	cfg.Section("dns").Key("search_domains").SetValue("corp.example.com")
+	want.SearchList = []string{"corp.example.com"}
+	if got := (&dns{newMetadata: md, config: cfg}).want(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want() with config got: %+v, want: %+v", got, want)
+	}
+
+	md.Instance.Attributes.DomainJoin = `{"ManagedDomain":"projects/p/locations/global/domains/ad.example.com"}`
+	if got := (&dns{newMetadata: md, config: cfg}).want(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want() with domain join disabled got: %+v, want: %+v", got, want)
+	}
+	md.Instance.Attributes.EnableDomainJoin = "true"
+	want.SearchList = []string{"corp.example.com", "ad.example.com"}
+	if got := (&dns{newMetadata: md, config: cfg}).want(); !reflect.DeepEqual(got, want) {
+		t.Errorf("want() with a managed domain got: %+v, want: %+v", got, want)
+	}
+}
+
+func TestDNSSetInterfaceMAC(t *testing.T) {
+	oldClient, oldIfs, oldRead, oldWrite := dnsClientMgr, dnsInterfaces, readDNSState, writeDNSState
+	defer func() {
+		dnsClientMgr, dnsInterfaces, readDNSState, writeDNSState = oldClient, oldIfs, oldRead, oldWrite
+	}()
+
+	mac1, _ := net.ParseMAC("00:00:00:00:00:01")
+	mac2, _ := net.ParseMAC("00:00:00:00:00:02")
+	dnsInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{{Index: 3, HardwareAddr: mac1}, {Index: 4, HardwareAddr: mac2}}, nil
+	}
+
+	var tests = []struct {
+		name        string
+		data        string
+		wantServers map[int][]string
+		wantErr     bool
+	}{
+		{"primary", "", map[int][]string{3: {"10.0.0.2"}}, false},
+		{"matched", "[dns]\ninterface_mac=00-00-00-00-00-02", map[int][]string{4: {"10.0.0.2"}}, false},
+		{"unmatched", "[dns]\ninterface_mac=00:00:00:00:00:09", map[int][]string{}, true},
+	}
+	md := &metadataJSON{Instance: instanceJSON{
+		NetworkInterfaces: []networkInterfacesJSON{{Mac: mac1.String()}, {Mac: mac2.String()}},
+		Attributes:        attributesJSON{DNSServers: "10.0.0.2"},
+	}}
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var state []string
+		readDNSState = func() ([]string, error) { return state, nil }
+		writeDNSState = func(s []string) error { state = s; return nil }
+		client := &fakeDNSClient{ifServers: map[int][]string{}}
+		dnsClientMgr = client
+		if err := (&dns{newMetadata: md, config: cfg}).set(context.Background()); (err != nil) != tt.wantErr {
+			t.Errorf("%s: set() error: %v, want error: %t", tt.name, err, tt.wantErr)
+		}
+		if !reflect.DeepEqual(client.ifServers, tt.wantServers) {
+			t.Errorf("%s: servers got: %v, want: %v", tt.name, client.ifServers, tt.wantServers)
+		}
+	}
+}
+
+func TestDNSSet(t *testing.T) {
+	oldClient, oldIfs, oldRead, oldWrite := dnsClientMgr, dnsInterfaces, readDNSState, writeDNSState
+	defer func() {
+		dnsClientMgr, dnsInterfaces, readDNSState, writeDNSState = oldClient, oldIfs, oldRead, oldWrite
+	}()
+
+	mac, _ := net.ParseMAC("00:00:00:00:00:01")
+	dnsInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{{Index: 3, HardwareAddr: mac}}, nil
+	}
+	var state []string
+	readDNSState = func() ([]string, error) { return state, nil }
+	writeDNSState = func(s []string) error { state = s; return nil }
+
+	var tests = []struct {
+		name      string
+		servers   string
+		search    string
+		wantCalls []string
+		want      dnsConfigJSON
+	}{
+		{"apply", "10.0.0.2", "example.com", []string{"setServers", "setSearchList"}, dnsConfigJSON{Mac: mac.String(), Servers: []string{"10.0.0.2"}, SearchList: []string{"example.com"}}},
+		{"unchanged", "10.0.0.2", "example.com", nil, dnsConfigJSON{Mac: mac.String(), Servers: []string{"10.0.0.2"}, SearchList: []string{"example.com"}}},
+		{"servers only", "10.0.0.2", "", []string{"setSearchList"}, dnsConfigJSON{Mac: mac.String(), Servers: []string{"10.0.0.2"}}},
+		{"reset", "", "", []string{"setServers"}, dnsConfigJSON{Mac: mac.String()}},
+		{"nothing to reset", "", "", nil, dnsConfigJSON{Mac: mac.String()}},
+	}
+	client := &fakeDNSClient{ifServers: map[int][]string{3: {"169.254.169.254"}}}
+	dnsClientMgr = client
+	for _, tt := range tests {
+		client.calls = nil
+		md := &metadataJSON{Instance: instanceJSON{
+			NetworkInterfaces: []networkInterfacesJSON{{Mac: mac.String()}},
+			Attributes:        attributesJSON{DNSServers: tt.servers, DNSSearchDomains: tt.search},
+		}}
+		if err := (&dns{newMetadata: md, config: ini.Empty()}).set(context.Background()); err != nil {
+			t.Fatalf("%s: set() error: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(client.calls, tt.wantCalls) {
+			t.Errorf("%s: calls got: %q, want: %q", tt.name, client.calls, tt.wantCalls)
+		}
+		var got dnsConfigJSON
+		if err := json.Unmarshal([]byte(state[0]), &got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: state got: %+v, want: %+v", tt.name, got, tt.want)
+		}
+	}
+}
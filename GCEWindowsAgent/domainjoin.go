@@ -0,0 +1,310 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// domainJoinRegName is a REG_MULTI_SZ under regKeyBase holding the domain
+// joined, the join state and the boot time the join was made in.
+const domainJoinRegName = "DomainJoinState"
+
+// Domain join states.
+const (
+	domainJoinRebootPending = "rebootPending"
+	domainJoinJoined        = "joined"
+)
+
+var domainJoinDisabled = true
+
+// domainJoinJSON is how to join the domain. The password of User is read
+// from the Secret Manager secret version PasswordSecret, such as
+// projects/p/secrets/s/versions/latest, or else the instance attribute
+// PasswordAttribute. For a Managed Microsoft AD domain, ManagedDomain is its
+// resource name or domain name and the other settings default from it.
+type domainJoinJSON struct {
+	ManagedDomain     string
+	Domain            string
+	OU                string
+	User              string
+	PasswordSecret    string
+	PasswordAttribute string
+}
+
+// domainJoiner is the interface to the domain membership of the machine.
+type domainJoiner interface {
+	current() (domain string, partOfDomain bool, err error)
+	join(p domainJoinJSON, password string) error
+}
+
+// psDomainJoiner joins the domain with Add-Computer. The password is passed
+// in the environment so it isn't on a command line.
+type psDomainJoiner struct{}
+
+func (psDomainJoiner) current() (string, bool, error) {
+	out, err := runPowershell(`Get-CimInstance Win32_ComputerSystem | ForEach-Object { @{Domain=$_.Domain; PartOfDomain=$_.PartOfDomain} } | ConvertTo-Json -Compress`)
+	if err != nil {
+		return "", false, fmt.Errorf("error reading domain membership: %v, output: %s", err, out)
+	}
+	var cs struct {
+		Domain       string
+		PartOfDomain bool
+	}
+	if err := json.Unmarshal(out, &cs); err != nil {
+		return "", false, fmt.Errorf("error parsing domain membership: %v, output: %s", err, out)
+	}
+	return cs.Domain, cs.PartOfDomain, nil
+}
+
+func (psDomainJoiner) join(p domainJoinJSON, password string) error {
+	script := fmt.Sprintf(`$c = New-Object PSCredential(%s, (ConvertTo-SecureString $env:GCE_DOMAIN_JOIN_PASSWORD -AsPlainText -Force))
+$a = @{DomainName=%s; Credential=$c; Options='JoinWithNewName,AccountCreate'; Force=$true; ErrorAction='Stop'}
+`, psQuote(p.User), psQuote(p.Domain))
+	if p.OU != "" {
+		script += fmt.Sprintf("$a.OUPath = %s\n", psQuote(p.OU))
+	}
+	script += "Add-Computer @a -WarningAction SilentlyContinue"
+	c := exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script)
+	c.Env = append(os.Environ(), "GCE_DOMAIN_JOIN_PASSWORD="+password)
+	if out, err := c.CombinedOutput(); err != nil {
+		return fmt.Errorf("error joining domain %s: %v, output: %s", p.Domain, err, out)
+	}
+	return nil
+}
+
+var (
+	domainJoinMgr domainJoiner = psDomainJoiner{}
+	// secretManagerURL, readDomainJoinState and writeDomainJoinState are
+	// replaced in tests.
+	secretManagerURL    = "https://secretmanager.googleapis.com/v1"
+	readDomainJoinState = func() ([]string, error) {
+		return readRegMultiString(regKeyBase, domainJoinRegName)
+	}
+	writeDomainJoinState = func(state []string) error {
+		return writeRegMultiString(regKeyBase, domainJoinRegName, state)
+	}
+)
+
+// accessSecret returns the payload of the Secret Manager secret version name,
+// accessed as the service account of the instance.
+func accessSecret(ctx context.Context, config *ini.File, name string) (string, error) {
+	token, err := serviceAccountToken(ctx, config)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("GET", secretManagerURL+"/"+name+":access", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("error accessing secret %s: %s, %s", name, resp.Status, body)
+	}
+	var sv struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &sv); err != nil {
+		return "", fmt.Errorf("error parsing secret %s: %v", name, err)
+	}
+	data, err := base64.StdEncoding.DecodeString(sv.Payload.Data)
+	if err != nil {
+		return "", fmt.Errorf("error decoding secret %s: %v", name, err)
+	}
+	return string(data), nil
+}
+
+// domainJoin joins the machine to an Active Directory domain once. The join
+// is recorded in the registry with the boot it was made in, so it isn't
+// repeated while the reboot that completes it is pending.
+type domainJoin struct {
+	newMetadata, oldMetadata *metadataJSON
+	config                   *ini.File
+}
+
+// params returns the join parameters from the config file, or instance and
+// then project metadata.
+func (j *domainJoin) params() (domainJoinJSON, bool) {
+	data := j.config.Section("domainJoin").Key("settings").String()
+	if data == "" {
+		data = j.newMetadata.Instance.Attributes.DomainJoin
+	}
+	if data == "" {
+		data = j.newMetadata.Project.Attributes.DomainJoin
+	}
+	if data == "" {
+		return domainJoinJSON{}, false
+	}
+	var p domainJoinJSON
+	if err := json.Unmarshal([]byte(data), &p); err != nil {
+		logger.Errorln("Error parsing domain join settings:", err)
+		return domainJoinJSON{}, false
+	}
+	if p.ManagedDomain != "" {
+		// The managed domain is named after its domain name.
+		p.Domain = p.ManagedDomain[strings.LastIndex(p.ManagedDomain, "/")+1:]
+		return p, true
+	}
+	if p.Domain == "" || p.User == "" || (p.PasswordSecret == "" && p.PasswordAttribute == "") {
+		logger.Error("Domain join settings need a ManagedDomain, or a Domain, User and PasswordSecret or PasswordAttribute.")
+		return domainJoinJSON{}, false
+	}
+	return p, true
+}
+
+// pending reports whether the join of domain is still to be made or
+// confirmed, it isn't while the reboot completing a join is pending.
+func (j *domainJoin) pending(domain string) bool {
+	state, err := readDomainJoinState()
+	if err != nil && err != errRegNotExist {
+		logger.Errorln("Error reading domain join state:", err)
+		return false
+	}
+	if len(state) != 3 || !strings.EqualFold(state[0], domain) {
+		return true
+	}
+	if state[1] == domainJoinJoined {
+		return false
+	}
+	t, err := time.Parse(time.RFC3339, state[2])
+	return err != nil || absDuration(bootTime().Sub(t)) > time.Minute
+}
+
+func (j *domainJoin) diff() bool {
+	p, ok := j.params()
+	return ok && j.pending(p.Domain)
+}
+
+func (j *domainJoin) metadataPaths() []string {
+	// The project ID names managed domains.
+	return append([]string{"project/project-id"}, attributePaths...)
+}
+
+func (j *domainJoin) disabled() (disabled bool) {
+	defer func() {
+		if disabled != domainJoinDisabled {
+			domainJoinDisabled = disabled
+			logStatus("domain join", disabled)
+		}
+	}()
+
+	return !j.enablement().Enabled
+}
+
+var domainJoinEnable = enableRule{
+	section:   "domainJoin",
+	key:       "enable",
+	attribute: "enable-domain-join",
+	value:     func(a attributesJSON) string { return a.EnableDomainJoin },
+}
+
+// Domain join is opt-in.
+func (j *domainJoin) enablement() enablement {
+	return isEnabled(j.config, j.newMetadata, domainJoinEnable, false)
+}
+
+// password returns the password of the join user.
+func (j *domainJoin) password(ctx context.Context, p domainJoinJSON) (string, error) {
+	if p.PasswordSecret != "" {
+		return accessSecret(ctx, j.config, p.PasswordSecret)
+	}
+	data, err := getMetadataPath(ctx, j.config, "instance/attributes/"+p.PasswordAttribute)
+	if err != nil {
+		return "", fmt.Errorf("error reading domain join password from %s: %v", p.PasswordAttribute, err)
+	}
+	return string(data), nil
+}
+
+func (j *domainJoin) plan() ([]string, error) {
+	p, _ := j.params()
+	if p.ManagedDomain != "" {
+		return []string{fmt.Sprintf("join managed domain %s", p.ManagedDomain)}, nil
+	}
+	return []string{fmt.Sprintf("join domain %s as %s", p.Domain, p.User)}, nil
+}
+
+// set joins the domain and reports the result to the domain join guest
+// attribute.
+func (j *domainJoin) set(ctx context.Context) error {
+	p, ok := j.params()
+	if !ok {
+		return nil
+	}
+	state, err := j.join(ctx, p)
+	reportDomainJoin(j.config, p, state, err)
+	return err
+}
+
+// join joins the domain unless the machine is a member already, and requests
+// the reboot completing the join. A machine in another domain is left alone.
+// It returns the join state.
+func (j *domainJoin) join(ctx context.Context, p domainJoinJSON) (string, error) {
+	domain, member, err := domainJoinMgr.current()
+	if err != nil {
+		return "", err
+	}
+	if member {
+		if !strings.EqualFold(domain, p.Domain) {
+			return "", fmt.Errorf("machine is a member of domain %s, not joining %s", domain, p.Domain)
+		}
+		logger.Infof("Machine is a member of domain %s.", domain)
+		return domainJoinJoined, writeDomainJoinState([]string{p.Domain, domainJoinJoined, bootTime().Format(time.RFC3339)})
+	}
+
+	if p.ManagedDomain != "" {
+		if p, err = resolveManagedDomain(ctx, j.config, j.newMetadata.Project.ProjectID, p); err != nil {
+			return "", err
+		}
+		if err := checkManagedDomainDNS(p.Domain); err != nil {
+			return "", err
+		}
+	}
+	password, err := j.password(ctx, p)
+	if err != nil {
+		return "", err
+	}
+	logger.Infof("Joining domain %s as %s.", p.Domain, p.User)
+	if err := domainJoinMgr.join(p, password); err != nil {
+		return "", err
+	}
+	if err := writeDomainJoinState([]string{p.Domain, domainJoinRebootPending, bootTime().Format(time.RFC3339)}); err != nil {
+		logger.Errorln("Error recording domain join:", err)
+	}
+	requestReboot(j.config, "domainJoin")
+	return domainJoinRebootPending, nil
+}
@@ -0,0 +1,133 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+type fakeDomainJoiner struct {
+	domain   string
+	member   bool
+	user     string
+	password string
+	joined   bool
+}
+
+func (f *fakeDomainJoiner) current() (string, bool, error) {
+	return f.domain, f.member, nil
+}
+
+func (f *fakeDomainJoiner) join(p domainJoinJSON, password string) error {
+	f.joined, f.password, f.user = true, password, p.User
+	return nil
+}
+
+func TestDomainJoinSet(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/instance/service-accounts/default/token":
+			w.Write([]byte(`{"access_token":"token","expires_in":3600,"token_type":"Bearer"}`))
+		case "/projects/p/secrets/join/versions/latest:access":
+			if r.Header.Get("Authorization") != "Bearer token" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			// "secret" base64 encoded.
+			w.Write([]byte(`{"name":"projects/p/secrets/join/versions/1","payload":{"data":"c2VjcmV0"}}`))
+		case "/instance/attributes/join-password":
+			w.Write([]byte("attribute secret"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	oldMgr, oldServer, oldSecrets := domainJoinMgr, metadataServer, secretManagerURL
+	oldRead, oldWrite, oldPut := readDomainJoinState, writeDomainJoinState, putGuestAttribute
+	defer func() {
+		domainJoinMgr, metadataServer, secretManagerURL = oldMgr, oldServer, oldSecrets
+		readDomainJoinState, writeDomainJoinState, putGuestAttribute = oldRead, oldWrite, oldPut
+		pendingReboot = pendingRebootJSON{}
+	}()
+	metadataServer, secretManagerURL = srv.URL, srv.URL
+	putGuestAttribute = func(*ini.File, string, string) error { return nil }
+
+	secretJoin := `{"Domain":"corp.example.com","User":"CORP\\joiner","PasswordSecret":"projects/p/secrets/join/versions/latest"}`
+	attributeJoin := `{"Domain":"corp.example.com","OU":"OU=Servers,DC=corp,DC=example,DC=com","User":"CORP\\joiner","PasswordAttribute":"join-password"}`
+	boot := bootTime().Format(time.RFC3339)
+	var tests = []struct {
+		name         string
+		settings     string
+		state        []string
+		fake         fakeDomainJoiner
+		wantDiff     bool
+		wantPassword string
+		wantState    string
+		wantErr      bool
+	}{
+		{"no settings", "", nil, fakeDomainJoiner{}, false, "", "", false},
+		{"invalid settings", `{"Domain":"corp.example.com"}`, nil, fakeDomainJoiner{}, false, "", "", false},
+		{"secret manager", secretJoin, nil, fakeDomainJoiner{domain: "WORKGROUP"}, true, "secret", domainJoinRebootPending, false},
+		{"metadata attribute", attributeJoin, nil, fakeDomainJoiner{domain: "WORKGROUP"}, true, "attribute secret", domainJoinRebootPending, false},
+		{"reboot pending", secretJoin, []string{"corp.example.com", domainJoinRebootPending, boot}, fakeDomainJoiner{domain: "WORKGROUP"}, false, "", "", false},
+		{"rebooted", secretJoin, []string{"corp.example.com", domainJoinRebootPending, "2020-01-01T00:00:00Z"}, fakeDomainJoiner{domain: "corp.example.com", member: true}, true, "", domainJoinJoined, false},
+		{"joined", secretJoin, []string{"CORP.EXAMPLE.COM", domainJoinJoined, boot}, fakeDomainJoiner{domain: "corp.example.com", member: true}, false, "", "", false},
+		{"other domain", secretJoin, nil, fakeDomainJoiner{domain: "other.example.com", member: true}, true, "", "", true},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte("[domainJoin]\nenable=true"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fake := tt.fake
+		domainJoinMgr = &fake
+		readDomainJoinState = func() ([]string, error) { return tt.state, nil }
+		var gotState []string
+		writeDomainJoinState = func(state []string) error {
+			gotState = state
+			return nil
+		}
+		md := &metadataJSON{Instance: instanceJSON{Attributes: attributesJSON{DomainJoin: tt.settings}}}
+		j := &domainJoin{newMetadata: md, oldMetadata: md, config: cfg}
+		if got := j.diff(); got != tt.wantDiff {
+			t.Errorf("test case %q: diff got: %t, want: %t", tt.name, got, tt.wantDiff)
+		}
+		if !tt.wantDiff {
+			continue
+		}
+		if err := j.set(context.Background()); (err != nil) != tt.wantErr {
+			t.Errorf("test case %q: set error: %v, want error: %t", tt.name, err, tt.wantErr)
+		}
+		if fake.joined != (tt.wantPassword != "") || fake.password != tt.wantPassword {
+			t.Errorf("test case %q: joined: %t with password %q, want password %q", tt.name, fake.joined, fake.password, tt.wantPassword)
+		}
+		var want []string
+		if tt.wantState != "" {
+			want = []string{"corp.example.com", tt.wantState, boot}
+		}
+		if !reflect.DeepEqual(gotState, want) {
+			t.Errorf("test case %q: state got: %q, want: %q", tt.name, gotState, want)
+		}
+	}
+}
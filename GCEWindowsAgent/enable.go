@@ -0,0 +1,83 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/go-ini/ini"
+)
+
+// Sources of a manager's enabled state.
+const (
+	sourceConfig           = "config"
+	sourceInstanceMetadata = "instance metadata"
+	sourceProjectMetadata  = "project metadata"
+	sourceDefault          = "default"
+)
+
+// enablement is whether a manager is enabled and where that was decided.
+type enablement struct {
+	Enabled bool   `json:"enabled"`
+	Source  string `json:"source"`
+	// Setting is the config key, as section.key, or the metadata attribute
+	// that decided. It is empty for the default.
+	Setting string `json:"setting,omitempty"`
+}
+
+// enabler is implemented by managers that can be enabled or disabled from
+// config or metadata.
+type enabler interface {
+	enablement() enablement
+}
+
+// enableRule is where a manager is enabled. When inverted the settings
+// disable the manager instead.
+type enableRule struct {
+	section, key string
+	// attribute is the metadata attribute read by value, empty if the
+	// manager is only configurable locally.
+	attribute string
+	value     func(attributesJSON) string
+	inverted  bool
+}
+
+// isEnabled decides if a manager is enabled from the config key, then the
+// instance attribute, then the project attribute. The first one holding a
+// valid bool decides, def is used if none does.
+func isEnabled(cfg *ini.File, md *metadataJSON, r enableRule, def bool) enablement {
+	if b, err := cfg.Section(r.section).Key(r.key).Bool(); err == nil {
+		return enablement{b != r.inverted, sourceConfig, r.section + "." + r.key}
+	}
+	if r.attribute != "" {
+		if b, err := strconv.ParseBool(r.value(md.Instance.Attributes)); err == nil {
+			return enablement{b != r.inverted, sourceInstanceMetadata, r.attribute}
+		}
+		if b, err := strconv.ParseBool(r.value(md.Project.Attributes)); err == nil {
+			return enablement{b != r.inverted, sourceProjectMetadata, r.attribute}
+		}
+	}
+	return enablement{Enabled: def, Source: sourceDefault}
+}
+
+// managerEnablement returns the enablement of mgr for status reports. It
+// doesn't call disabled(), which records and logs the state, so every
+// manager implements enabler.
+func managerEnablement(mgr manager) enablement {
+	if e, ok := mgr.(enabler); ok {
+		return e.enablement()
+	}
+	return enablement{Enabled: true, Source: sourceDefault}
+}
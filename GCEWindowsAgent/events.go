@@ -0,0 +1,131 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// Manager states reported in transition events.
+const (
+	stateDisabled  = "disabled"
+	stateSucceeded = "succeeded"
+	stateFailed    = "failed"
+)
+
+// The pending reboot is reported as transitions of the rebootEvent manager
+// between these states, with the sections that need the reboot.
+const (
+	rebootEvent        = "reboot"
+	stateRebootPending = "pending"
+	stateNoReboot      = "none"
+)
+
+type transitionEventJSON struct {
+	Manager   string   `json:"manager"`
+	OldState  string   `json:"oldState"`
+	NewState  string   `json:"newState"`
+	Reasons   []string `json:"reasons,omitempty"`
+	Timestamp string   `json:"timestamp"`
+}
+
+// queuedEvent is a transition event waiting to be sent to url.
+type queuedEvent struct {
+	url   string
+	event transitionEventJSON
+}
+
+var (
+	managerStates   = map[string]string{}
+	managerStatesMu sync.Mutex
+	eventTimeout    = 5 * time.Second
+
+	// transitionEvents queues events for eventWorker, so a slow webhook
+	// never holds up the managers, which record their state under
+	// updateMu.
+	transitionEvents = make(chan queuedEvent, 32)
+
+	// sendEvent is replaced in tests.
+	sendEvent = postEvent
+)
+
+// recordState records the current state of a manager and, if it changed
+// from a previously recorded state, emits a transition event.
+func recordState(cfg *ini.File, mgr, state string) {
+	managerStatesMu.Lock()
+	old := managerStates[mgr]
+	managerStates[mgr] = state
+	managerStatesMu.Unlock()
+
+	if old == "" || old == state {
+		return
+	}
+	emitEvent(cfg, transitionEventJSON{Manager: mgr, OldState: old, NewState: state})
+}
+
+// emitEvent queues e for the [events] webhook, if set. Delivery is best
+// effort, the event is dropped when the queue is full.
+func emitEvent(cfg *ini.File, e transitionEventJSON) {
+	webhook := cfg.Section("events").Key("webhook").String()
+	if webhook == "" {
+		return
+	}
+	e.Timestamp = time.Now().UTC().Format(time.RFC3339)
+	select {
+	case transitionEvents <- queuedEvent{webhook, e}:
+	default:
+		logger.Errorf("Dropping %s transition event, too many events are queued.", e.Manager)
+	}
+}
+
+// eventWorker sends the queued transition events until ctx is done.
+func eventWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case q := <-transitionEvents:
+			if err := sendEvent(q.url, q.event); err != nil {
+				logger.Errorf("Error sending %s transition event: %v", q.event.Manager, err)
+			}
+		}
+	}
+}
+
+func postEvent(url string, e transitionEventJSON) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: eventTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+// queuedEvents returns and removes the queued transition events.
+func queuedEvents() []transitionEventJSON {
+	var events []transitionEventJSON
+	for {
+		select {
+		case q := <-transitionEvents:
+			events = append(events, q.event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestRecordStateTransitions(t *testing.T) {
+	queuedEvents()
+	managerStates = map[string]string{}
+
+	cfg, err := ini.InsensitiveLoad([]byte("[Events]\nwebhook=http://localhost/hook"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	failing := &fakeManager{isDiff: true, err: errors.New("fail")}
+	mgrs := []namedManager{{"accountManager", failing}}
+	// First observation and steady state emit nothing.
+	runManagers(context.Background(), cfg, mgrs)
+	runManagers(context.Background(), cfg, mgrs)
+	if got := queuedEvents(); len(got) != 0 {
+		t.Fatalf("got events %+v before any transition", got)
+	}
+
+	failing.err = nil
+	runManagers(context.Background(), cfg, mgrs)
+	runManagers(context.Background(), cfg, mgrs)
+	failing.isDisabled = true
+	runManagers(context.Background(), cfg, mgrs)
+
+	var transitions [][2]string
+	for _, e := range queuedEvents() {
+		if e.Manager != "accountManager" || e.Timestamp == "" {
+			t.Errorf("unexpected event: %+v", e)
+		}
+		transitions = append(transitions, [2]string{e.OldState, e.NewState})
+	}
+	want := [][2]string{{stateFailed, stateSucceeded}, {stateSucceeded, stateDisabled}}
+	if !reflect.DeepEqual(transitions, want) {
+		t.Errorf("transitions got: %q, want: %q", transitions, want)
+	}
+}
+
+func TestPostEvent(t *testing.T) {
+	var got transitionEventJSON
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	e := transitionEventJSON{Manager: "wsfc", OldState: stateFailed, NewState: stateSucceeded, Timestamp: "now"}
+	if err := postEvent(ts.URL, e); err != nil {
+		t.Fatalf("postEvent() returned error: %v", err)
+	}
+	if !reflect.DeepEqual(got, e) {
+		t.Errorf("webhook received: %+v, want: %+v", got, e)
+	}
+}
+
+func TestEventWorker(t *testing.T) {
+	oldSendEvent := sendEvent
+	defer func() { sendEvent = oldSendEvent }()
+	queuedEvents()
+
+	sent := make(chan transitionEventJSON)
+	sendEvent = func(url string, e transitionEventJSON) error {
+		if url != "http://localhost/hook" {
+			t.Errorf("event sent to %q, want http://localhost/hook", url)
+		}
+		sent <- e
+		return errors.New("unreachable")
+	}
+	cfg, err := ini.InsensitiveLoad([]byte("[events]\nwebhook=http://localhost/hook"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Events queue without a worker, up to the size of the queue.
+	for i := 0; i < cap(transitionEvents)+1; i++ {
+		emitEvent(cfg, transitionEventJSON{Manager: "wsfc", OldState: stateFailed, NewState: stateSucceeded})
+	}
+	if got := len(transitionEvents); got != cap(transitionEvents) {
+		t.Errorf("queued events got: %d, want: %d", got, cap(transitionEvents))
+	}
+	queuedEvents()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		eventWorker(ctx)
+		close(done)
+	}()
+	emitEvent(cfg, transitionEventJSON{Manager: rebootEvent, OldState: stateNoReboot, NewState: stateRebootPending, Reasons: []string{"pagefile"}})
+	select {
+	case e := <-sent:
+		if e.Manager != rebootEvent || !reflect.DeepEqual(e.Reasons, []string{"pagefile"}) || e.Timestamp == "" {
+			t.Errorf("sent event got: %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued event was not sent")
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("eventWorker() did not return once ctx was done")
+	}
+}
@@ -0,0 +1,155 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// metadataFingerprint is a hash of each top level metadata key, e.g.
+// "instance/networkinterfaces", and of each attribute, e.g.
+// "instance/attributes/windowskeys". It is used in place of a full copy of the
+// previous metadata when [metadata] diff_mode is hash.
+type metadataFingerprint map[string][sha256.Size]byte
+
+func hashDiffMode(config *ini.File) bool {
+	return strings.EqualFold(config.Section("metadata").Key("diff_mode").String(), "hash")
+}
+
+// fingerprintKey normalizes a metadata path or JSON field name so that
+// "instance/network-interfaces" and "Instance/NetworkInterfaces" match.
+func fingerprintKey(s string) string {
+	return strings.ToLower(strings.Replace(s, "-", "", -1))
+}
+
+func fingerprintMetadata(md *metadataJSON) metadataFingerprint {
+	fp := make(metadataFingerprint)
+	b, err := json.Marshal(md)
+	if err != nil {
+		logger.Error(err)
+		return fp
+	}
+	var tree map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(b, &tree); err != nil {
+		logger.Error(err)
+		return fp
+	}
+	for top, keys := range tree {
+		for key, value := range keys {
+			var attrs map[string]json.RawMessage
+			if fingerprintKey(key) != "attributes" || json.Unmarshal(value, &attrs) != nil {
+				fp[fingerprintKey(top+"/"+key)] = sha256.Sum256(value)
+				continue
+			}
+			for name, v := range attrs {
+				fp[fingerprintKey(top+"/"+key+"/"+name)] = sha256.Sum256(v)
+			}
+		}
+	}
+	return fp
+}
+
+// changedKeys returns the keys whose hash differs between old and new,
+// including keys present in only one of them.
+func changedKeys(old, new metadataFingerprint) []string {
+	var changed []string
+	for k, v := range new {
+		if ov, ok := old[k]; !ok || ov != v {
+			changed = append(changed, k)
+		}
+	}
+	for k := range old {
+		if _, ok := new[k]; !ok {
+			changed = append(changed, k)
+		}
+	}
+	return changed
+}
+
+// pathsChanged reports whether any of the metadata paths overlap a changed
+// key. A nil path list means the manager reads the whole tree.
+func pathsChanged(paths, changed []string) bool {
+	if paths == nil {
+		return len(changed) != 0
+	}
+	for _, p := range paths {
+		p = fingerprintKey(p)
+		for _, c := range changed {
+			if p == c || strings.HasPrefix(p, c+"/") || strings.HasPrefix(c, p+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fingerprintDiff reports a manager as changed when one of its metadata paths
+// changed, on top of any local state its own diff detects.
+type fingerprintDiff struct {
+	manager
+	changed []string
+}
+
+func (f fingerprintDiff) diff() bool {
+	if t, ok := f.manager.(targetedDiffer); ok {
+		// Its diff would compare the new metadata with itself.
+		return pathsChanged(t.diffPaths(), f.changed)
+	}
+	// The wrapped diff is always called as some managers track state in it.
+	diff := f.manager.diff()
+	return pathsChanged(f.manager.metadataPaths(), f.changed) || diff
+}
+
+// targetedDiffer is implemented by managers whose changes only come from the
+// metadata paths diffPaths returns, such as
+// "instance/attributes/windows-keys". Their diff is only called when one of
+// those paths changed, instead of on every update.
+type targetedDiffer interface {
+	diffPaths() []string
+}
+
+// targetedDiff skips the diff of a targetedDiffer when none of its paths is
+// in changed.
+type targetedDiff struct {
+	manager
+	changed []string
+}
+
+func (t targetedDiff) diff() bool {
+	if !pathsChanged(t.manager.(targetedDiffer).diffPaths(), t.changed) {
+		return false
+	}
+	return t.manager.diff()
+}
+
+// targetManagers wraps the targetedDiffers in mgrs to skip their diff unless
+// their paths changed between oldMetadata and newMetadata.
+func targetManagers(mgrs []namedManager, newMetadata, oldMetadata *metadataJSON) {
+	var changed []string
+	for i := range mgrs {
+		if _, ok := mgrs[i].manager.(targetedDiffer); !ok {
+			continue
+		}
+		if changed == nil {
+			changed = append([]string{}, changedKeys(fingerprintMetadata(oldMetadata), fingerprintMetadata(newMetadata))...)
+		}
+		mgrs[i].manager = targetedDiff{mgrs[i].manager, changed}
+	}
+}
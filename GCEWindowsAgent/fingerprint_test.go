@@ -0,0 +1,166 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+func TestChangedKeys(t *testing.T) {
+	var old, new metadataJSON
+	new.Instance.Attributes.WindowsKeys = "key"
+	new.Instance.NetworkInterfaces = []networkInterfacesJSON{{Mac: "00:00:00:00:00:01"}}
+
+	got := changedKeys(fingerprintMetadata(&old), fingerprintMetadata(&new))
+	sort.Strings(got)
+	want := []string{"instance/attributes/windowskeys", "instance/networkinterfaces"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("changedKeys() got: %q, want: %q", got, want)
+	}
+
+	if got := changedKeys(fingerprintMetadata(&new), fingerprintMetadata(&new)); len(got) != 0 {
+		t.Errorf("changedKeys() of identical metadata got: %q, want none", got)
+	}
+	if got := changedKeys(nil, fingerprintMetadata(&old)); len(got) == 0 {
+		t.Error("changedKeys() with no previous fingerprint returned no changes")
+	}
+}
+
+func TestPathsChanged(t *testing.T) {
+	var tests = []struct {
+		paths, changed []string
+		want           bool
+	}{
+		{attributePaths, []string{"instance/attributes"}, true},
+		{attributePaths, []string{"instance/networkinterfaces"}, false},
+		{[]string{"instance/network-interfaces"}, []string{"instance/networkinterfaces"}, true},
+		{[]string{"instance/attributes/windows-keys"}, []string{"instance/attributes"}, true},
+		{nil, []string{"project/projectid"}, true},
+		{nil, []string{}, false},
+	}
+
+	for _, tt := range tests {
+		if got := pathsChanged(tt.paths, tt.changed); got != tt.want {
+			t.Errorf("pathsChanged(%q, %q) got: %t, want: %t", tt.paths, tt.changed, got, tt.want)
+		}
+	}
+}
+
+// TestDiffModes compares the changes detected by a manager diffing the full
+// previous metadata with those detected in hash mode.
+func TestDiffModes(t *testing.T) {
+	base := `{"instance":{"attributes":{"printer-ports":"[]","windows-keys":"a"}},"project":{"attributes":{}}}`
+	var tests = []struct {
+		name               string
+		next               string
+		wantFull, wantHash bool
+	}{
+		{"no change", base, false, false},
+		{"watched attribute changed", `{"instance":{"attributes":{"printer-ports":"[{}]","windows-keys":"a"}},"project":{"attributes":{}}}`, true, true},
+		{"watched attribute removed", `{"instance":{"attributes":{"windows-keys":"a"}},"project":{"attributes":{}}}`, true, true},
+		{"other attribute changed", `{"instance":{"attributes":{"printer-ports":"[]","windows-keys":"b"}},"project":{"attributes":{}}}`, false, false},
+		{"unrelated key changed", `{"instance":{"id":1,"attributes":{"printer-ports":"[]","windows-keys":"a"}},"project":{"attributes":{}}}`, false, false},
+	}
+
+	for _, tt := range tests {
+		var old, next metadataJSON
+		if err := json.Unmarshal([]byte(base), &old); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(tt.next), &next); err != nil {
+			t.Fatal(err)
+		}
+
+		full := &printers{newMetadata: &next, oldMetadata: &old, config: ini.Empty()}
+		if got := full.diff(); got != tt.wantFull {
+			t.Errorf("test case %q: full diff got: %t, want: %t", tt.name, got, tt.wantFull)
+		}
+
+		changed := changedKeys(fingerprintMetadata(&old), fingerprintMetadata(&next))
+		hash := fingerprintDiff{&printers{newMetadata: &next, oldMetadata: &next, config: ini.Empty()}, changed}
+		if got := hash.diff(); got != tt.wantHash {
+			t.Errorf("test case %q: hash diff got: %t, want: %t", tt.name, got, tt.wantHash)
+		}
+	}
+}
+
+func TestHashDiffMode(t *testing.T) {
+	var tests = []struct {
+		data []byte
+		want bool
+	}{
+		{[]byte(""), false},
+		{[]byte("[Metadata]\ndiff_mode=full"), false},
+		{[]byte("[Metadata]\ndiff_mode=hash"), true},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := hashDiffMode(cfg); got != tt.want {
+			t.Errorf("hashDiffMode(%q) got: %t, want: %t", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestTargetManagers(t *testing.T) {
+	base := `{"instance":{"attributes":{"printer-ports":"[]","windows-keys":"a"}},"project":{"attributes":{}}}`
+	var tests = []struct {
+		name string
+		next string
+		want bool
+	}{
+		{"no change", base, false},
+		{"watched attribute changed", `{"instance":{"attributes":{"printer-ports":"[{}]","windows-keys":"a"}},"project":{"attributes":{}}}`, true},
+		{"other attribute changed", `{"instance":{"attributes":{"printer-ports":"[]","windows-keys":"b"}},"project":{"attributes":{}}}`, false},
+	}
+
+	for _, tt := range tests {
+		var old, next metadataJSON
+		if err := json.Unmarshal([]byte(base), &old); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(tt.next), &next); err != nil {
+			t.Fatal(err)
+		}
+
+		var calls int
+		mgrs := []namedManager{{"printers", &countingDiff{&printers{newMetadata: &next, oldMetadata: &old, config: ini.Empty()}, &calls}}}
+		targetManagers(mgrs, &next, &old)
+		if got := mgrs[0].diff(); got != tt.want {
+			t.Errorf("test case %q: diff got: %t, want: %t", tt.name, got, tt.want)
+		}
+		if tt.want != (calls == 1) {
+			t.Errorf("test case %q: wrapped diff called %d times", tt.name, calls)
+		}
+	}
+}
+
+// countingDiff counts the calls to the diff of a targetedDiffer.
+type countingDiff struct {
+	*printers
+	calls *int
+}
+
+func (c *countingDiff) diff() bool {
+	*c.calls++
+	return c.printers.diff()
+}
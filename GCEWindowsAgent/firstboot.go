@@ -0,0 +1,82 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// firstBootRegName is a REG_DWORD under regKeyBase that is set once the first
+// update cycle on the instance succeeded.
+const firstBootRegName = "FirstBootComplete"
+
+var (
+	// readFirstBootMarker and writeFirstBootMarker are replaced in tests.
+	readFirstBootMarker = func() (uint32, error) {
+		return readRegDword(regKeyBase, firstBootRegName)
+	}
+	writeFirstBootMarker = func() error {
+		return writeRegDword(regKeyBase, firstBootRegName, 1)
+	}
+)
+
+// firstBoot reports whether the first-boot marker is not set yet. If the
+// marker can't be read it is assumed set, so run once managers never run
+// twice.
+func firstBoot() bool {
+	v, err := readFirstBootMarker()
+	if err == errRegNotExist {
+		return true
+	}
+	if err != nil {
+		logger.Errorln("Error reading first boot marker:", err)
+		return false
+	}
+	return v == 0
+}
+
+// firstBootOnly reports whether the manager in section only runs on first
+// boot, per [<section>] first_boot_only.
+func firstBootOnly(cfg *ini.File, section string) bool {
+	return cfg.Section(section).Key("first_boot_only").MustBool(false)
+}
+
+// filterManagers drops the managers that run from their own metadata watch
+// and, when first is false, those that only run on first boot.
+func filterManagers(cfg *ini.File, all []namedManager, first bool) []namedManager {
+	var mgrs []namedManager
+	for _, mgr := range all {
+		if containsString(mgr.section, independentSections) {
+			continue
+		}
+		if !first && firstBootOnly(cfg, mgr.section) {
+			continue
+		}
+		mgrs = append(mgrs, mgr)
+	}
+	return mgrs
+}
+
+// markFirstBootDone sets the first-boot marker once a first boot cycle had no
+// failures, so failed run once managers are retried.
+func markFirstBootDone(first bool, failed int) {
+	if !first || failed > 0 {
+		return
+	}
+	if err := writeFirstBootMarker(); err != nil {
+		logger.Errorln("Error writing first boot marker:", err)
+	}
+}
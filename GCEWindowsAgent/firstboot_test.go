@@ -0,0 +1,112 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+func TestFirstBoot(t *testing.T) {
+	oldRead := readFirstBootMarker
+	defer func() { readFirstBootMarker = oldRead }()
+
+	var tests = []struct {
+		name  string
+		value uint32
+		err   error
+		want  bool
+	}{
+		{"not set", 0, errRegNotExist, true},
+		{"zero", 0, nil, true},
+		{"set", 1, nil, false},
+		{"read error", 0, errors.New("access denied"), false},
+	}
+
+	for _, tt := range tests {
+		readFirstBootMarker = func() (uint32, error) { return tt.value, tt.err }
+		if got := firstBoot(); got != tt.want {
+			t.Errorf("test case %q: firstBoot() got: %t, want: %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFirstBootOnlyManager(t *testing.T) {
+	oldRead, oldWrite := readFirstBootMarker, writeFirstBootMarker
+	defer func() { readFirstBootMarker, writeFirstBootMarker = oldRead, oldWrite }()
+	var marker uint32
+	readFirstBootMarker = func() (uint32, error) {
+		if marker == 0 {
+			return 0, errRegNotExist
+		}
+		return marker, nil
+	}
+	writeFirstBootMarker = func() error {
+		marker = 1
+		return nil
+	}
+
+	cfg, err := ini.InsensitiveLoad([]byte("[domainJoin]\nfirst_boot_only=true"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	once := &fakeManager{isDiff: true}
+	always := &fakeManager{isDiff: true}
+	all := []namedManager{{"domainJoin", once}, {"accountManager", always}}
+
+	for i := 0; i < 3; i++ {
+		first := firstBoot()
+		_, failed := runManagers(context.Background(), cfg, filterManagers(cfg, all, first))
+		markFirstBootDone(first, failed)
+	}
+	if once.sets != 1 {
+		t.Errorf("first_boot_only manager ran %d times, want 1", once.sets)
+	}
+	if always.sets != 3 {
+		t.Errorf("manager ran %d times, want 3", always.sets)
+	}
+	neededPaths = nil
+}
+
+func TestFirstBootRetriedOnFailure(t *testing.T) {
+	oldWrite := writeFirstBootMarker
+	defer func() { writeFirstBootMarker = oldWrite }()
+	var writes int
+	writeFirstBootMarker = func() error {
+		writes++
+		return nil
+	}
+
+	var tests = []struct {
+		first  bool
+		failed int
+		want   int
+	}{
+		{true, 0, 1},
+		{true, 1, 0},
+		{false, 0, 0},
+	}
+
+	for _, tt := range tests {
+		writes = 0
+		markFirstBootDone(tt.first, tt.failed)
+		if writes != tt.want {
+			t.Errorf("markFirstBootDone(%t, %d) wrote the marker %d times, want %d", tt.first, tt.failed, writes, tt.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// guestAttributesPath is the guest attribute namespace the agent reports to,
+// so operators can query agent health from the Compute API.
+const guestAttributesPath = "instance/guest-attributes/guest-agent/"
+
+// managerStatusJSON is the last run of a manager, reported to the guest
+// attribute named after its config section.
+type managerStatusJSON struct {
+	Status  string `json:"status"`
+	Version string `json:"version"`
+	Error   string `json:"error,omitempty"`
+	Time    string `json:"time"`
+}
+
+var (
+	// putGuestAttribute is replaced in tests.
+	putGuestAttribute = putAgentGuestAttribute
+
+	guestAttributesFailing   bool
+	guestAttributesFailingMu sync.Mutex
+)
+
+func putAgentGuestAttribute(cfg *ini.File, key, value string) error {
+	return putMetadata(context.Background(), cfg, guestAttributesPath+key, value)
+}
+
+// guestAttributesEnabled reports [core] guest_attributes, true by default.
+// It uses Key.Bool as MustBool writes the default back into cfg, which is
+// shared by the managers running in parallel.
+func guestAttributesEnabled(cfg *ini.File) bool {
+	enabled, err := cfg.Section("core").Key("guest_attributes").Bool()
+	return enabled || err != nil
+}
+
+// writeGuestAttribute writes value to the agent guest attribute key, unless
+// [core] guest_attributes is false. Guest attributes may not be enabled for
+// the instance, so an error is only logged once until a write succeeds.
+func writeGuestAttribute(cfg *ini.File, key, value string) {
+	if !guestAttributesEnabled(cfg) {
+		return
+	}
+	err := putGuestAttribute(cfg, key, value)
+
+	guestAttributesFailingMu.Lock()
+	defer guestAttributesFailingMu.Unlock()
+	if err != nil && !guestAttributesFailing {
+		logger.Errorf("Error writing guest attribute %s: %v", key, err)
+	}
+	guestAttributesFailing = err != nil
+}
+
+// reportManagerStatus writes the result of a manager run to its guest
+// attribute.
+func reportManagerStatus(cfg *ini.File, section string, err error) {
+	s := managerStatusJSON{
+		Status:  stateSucceeded,
+		Version: version,
+		Time:    time.Now().UTC().Format(time.RFC3339),
+	}
+	if err != nil {
+		s.Status, s.Error = stateFailed, err.Error()
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	writeGuestAttribute(cfg, section, string(data))
+}
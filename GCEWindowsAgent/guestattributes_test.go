@@ -0,0 +1,106 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+func TestReportManagerStatus(t *testing.T) {
+	oldPut := putGuestAttribute
+	defer func() { putGuestAttribute = oldPut }()
+	// Managers run in parallel.
+	var mu sync.Mutex
+	writes := map[string]managerStatusJSON{}
+	putGuestAttribute = func(cfg *ini.File, key, value string) error {
+		var s managerStatusJSON
+		if err := json.Unmarshal([]byte(value), &s); err != nil {
+			t.Errorf("error parsing status %q: %v", value, err)
+		}
+		mu.Lock()
+		writes[key] = s
+		mu.Unlock()
+		return nil
+	}
+
+	mgrs := []namedManager{
+		{"accountManager", &fakeManager{isDiff: true}},
+		{"addressManager", &fakeManager{isDiff: true, err: errors.New("bad address")}},
+		{"diagnostics", &fakeManager{isDiff: false}},
+		{"wsfc", &fakeManager{isDisabled: true, isDiff: true}},
+	}
+	runManagers(context.Background(), ini.Empty(), mgrs)
+	neededPaths = nil
+
+	want := map[string]managerStatusJSON{
+		"accountManager": {Status: stateSucceeded, Version: version},
+		"addressManager": {Status: stateFailed, Version: version, Error: "bad address"},
+	}
+	if len(writes) != len(want) {
+		t.Errorf("status written for %v, want %v", writes, want)
+	}
+	for key, w := range want {
+		got := writes[key]
+		if got.Time == "" {
+			t.Errorf("%s status has no time", key)
+		}
+		got.Time = ""
+		if got != w {
+			t.Errorf("%s status got: %+v, want: %+v", key, got, w)
+		}
+	}
+
+	// Reporting can be turned off.
+	writes = map[string]managerStatusJSON{}
+	cfg, err := ini.InsensitiveLoad([]byte("[core]\nguest_attributes=false"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	runManagers(context.Background(), cfg, mgrs)
+	neededPaths = nil
+	if len(writes) != 0 {
+		t.Errorf("status written with guest_attributes=false: %v", writes)
+	}
+}
+
+func TestWriteGuestAttributeLogsOnce(t *testing.T) {
+	oldPut := putGuestAttribute
+	defer func() {
+		putGuestAttribute = oldPut
+		guestAttributesFailing = false
+	}()
+
+	var tests = []struct {
+		err         error
+		wantFailing bool
+	}{
+		{errors.New("guest attributes disabled"), true},
+		{errors.New("guest attributes disabled"), true},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		putGuestAttribute = func(*ini.File, string, string) error { return tt.err }
+		writeGuestAttribute(ini.Empty(), "key", "value")
+		if guestAttributesFailing != tt.wantFailing {
+			t.Errorf("after write returning %v failing got: %t, want: %t", tt.err, guestAttributesFailing, tt.wantFailing)
+		}
+	}
+}
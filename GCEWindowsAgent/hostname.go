@@ -0,0 +1,229 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// hostnameGuestAttribute is the guest attribute the computer name state is
+// reported to.
+const hostnameGuestAttribute = "computer-name"
+
+// computerName is the DNS host name and primary DNS suffix of the machine,
+// active and as they will be after the next reboot.
+type computerName struct {
+	Hostname, Domain               string
+	PendingHostname, PendingDomain string
+	PartOfDomain                   bool
+}
+
+// computerNamer is the interface to the computer name.
+type computerNamer interface {
+	current() (computerName, error)
+	rename(hostname string) error
+	setDNSSuffix(suffix string) error
+}
+
+// psComputerNamer reads the names from the Tcpip parameters, where the NV
+// values are the names after the next reboot.
+type psComputerNamer struct{}
+
+func (psComputerNamer) current() (computerName, error) {
+	out, err := runPowershell(`$p = Get-ItemProperty 'HKLM:\SYSTEM\CurrentControlSet\Services\Tcpip\Parameters'
+@{Hostname=$p.Hostname; Domain=$p.Domain; PendingHostname=$p.'NV Hostname'; PendingDomain=$p.'NV Domain'; PartOfDomain=(Get-CimInstance Win32_ComputerSystem).PartOfDomain} | ConvertTo-Json -Compress`)
+	if err != nil {
+		return computerName{}, fmt.Errorf("error reading computer name: %v, output: %s", err, out)
+	}
+	var n computerName
+	if err := json.Unmarshal(out, &n); err != nil {
+		return computerName{}, fmt.Errorf("error parsing computer name: %v, output: %s", err, out)
+	}
+	return n, nil
+}
+
+func (psComputerNamer) rename(hostname string) error {
+	if out, err := runPowershell(fmt.Sprintf(`Rename-Computer -NewName %s -Force -WarningAction SilentlyContinue`, psQuote(hostname))); err != nil {
+		return fmt.Errorf("error renaming computer: %v, output: %s", err, out)
+	}
+	return nil
+}
+
+func (psComputerNamer) setDNSSuffix(suffix string) error {
+	script := fmt.Sprintf(`Set-ItemProperty 'HKLM:\SYSTEM\CurrentControlSet\Services\Tcpip\Parameters' -Name 'NV Domain' -Value %s`, psQuote(suffix))
+	if out, err := runPowershell(script); err != nil {
+		return fmt.Errorf("error setting primary DNS suffix: %v, output: %s", err, out)
+	}
+	return nil
+}
+
+// hostnameStateJSON is reported to the hostname guest attribute.
+type hostnameStateJSON struct {
+	Current       string `json:"current"`
+	Desired       string `json:"desired"`
+	PendingRename bool   `json:"pendingRename"`
+	Time          string `json:"time"`
+}
+
+var (
+	hostnameDisabled = true
+
+	// hostnameRetry is set while the last set failed, so diff retries it
+	// without a metadata change.
+	hostnameMu    sync.Mutex
+	hostnameRetry bool
+
+	// computerNameMgr is replaced in tests.
+	computerNameMgr computerNamer = psComputerNamer{}
+)
+
+// splitHostname splits a metadata hostname such as
+// instance-1.us-central1-a.c.project.internal into the host name and DNS
+// suffix.
+func splitHostname(fqdn string) (string, string) {
+	fqdn = strings.TrimSuffix(fqdn, ".")
+	if i := strings.Index(fqdn, "."); i != -1 {
+		return fqdn[:i], fqdn[i+1:]
+	}
+	return fqdn, ""
+}
+
+type hostname struct {
+	newMetadata, oldMetadata *metadataJSON
+	config                   *ini.File
+}
+
+func (h *hostname) diff() bool {
+	hostnameMu.Lock()
+	defer hostnameMu.Unlock()
+	return hostnameRetry || h.newMetadata.Instance.Hostname != h.oldMetadata.Instance.Hostname
+}
+
+func (h *hostname) metadataPaths() []string {
+	return []string{"instance/hostname"}
+}
+
+func (h *hostname) disabled() (disabled bool) {
+	defer func() {
+		if disabled != hostnameDisabled {
+			hostnameDisabled = disabled
+			logStatus("hostname", disabled)
+		}
+	}()
+
+	return !h.enablement().Enabled
+}
+
+// The host name is left alone unless [hostname] enable is set.
+func (h *hostname) enablement() enablement {
+	return isEnabled(h.config, h.newMetadata, enableRule{section: "hostname", key: "enable"}, false)
+}
+
+// changes returns the host name and DNS suffix to set, empty if they already
+// are, or will be after a reboot. The DNS suffix of a domain member is its
+// domain and is left alone.
+func (h *hostname) changes(cur computerName) (name, suffix string) {
+	wantName, wantSuffix := splitHostname(h.newMetadata.Instance.Hostname)
+	if wantName != "" && !strings.EqualFold(cur.PendingHostname, wantName) {
+		name = wantName
+	}
+	if !cur.PartOfDomain && h.config.Section("hostname").Key("set_dns_suffix").MustBool(true) && !strings.EqualFold(cur.PendingDomain, wantSuffix) {
+		suffix = wantSuffix
+	}
+	return name, suffix
+}
+
+func (h *hostname) plan() ([]string, error) {
+	cur, err := computerNameMgr.current()
+	if err != nil {
+		return nil, err
+	}
+	var changes []string
+	name, suffix := h.changes(cur)
+	if name != "" && h.config.Section("hostname").Key("auto_rename").MustBool(false) && !cur.PartOfDomain {
+		changes = append(changes, fmt.Sprintf("rename the computer from %s to %s", cur.PendingHostname, name))
+	}
+	if suffix != "" {
+		changes = append(changes, fmt.Sprintf("set the primary DNS suffix to %s", suffix))
+	}
+	return changes, nil
+}
+
+// set renames the computer to the metadata hostname when [hostname]
+// auto_rename is set, and sets the primary DNS suffix unless [hostname]
+// set_dns_suffix is false. Both take effect after a reboot, which is
+// requested. Domain joined computers are never renamed, that needs domain
+// credentials. A failed set is retried on the next update.
+func (h *hostname) set(ctx context.Context) (err error) {
+	defer func() {
+		hostnameMu.Lock()
+		hostnameRetry = err != nil
+		hostnameMu.Unlock()
+	}()
+	if h.newMetadata.Instance.Hostname == "" {
+		return nil
+	}
+	cur, err := computerNameMgr.current()
+	if err != nil {
+		return err
+	}
+	name, suffix := h.changes(cur)
+	if name != "" {
+		switch {
+		case !h.config.Section("hostname").Key("auto_rename").MustBool(false):
+			logger.Infof("Computer name %s differs from metadata hostname %s, set [hostname] auto_rename to rename it.", cur.PendingHostname, name)
+		case cur.PartOfDomain:
+			logger.Infof("Computer name %s differs from metadata hostname %s, not renaming a domain joined computer.", cur.PendingHostname, name)
+		default:
+			logger.Infof("Renaming computer from %s to %s.", cur.PendingHostname, name)
+			if err := computerNameMgr.rename(name); err != nil {
+				return err
+			}
+			cur.PendingHostname = name
+		}
+	}
+	if suffix != "" {
+		logger.Infof("Setting primary DNS suffix to %s.", suffix)
+		if err := computerNameMgr.setDNSSuffix(suffix); err != nil {
+			return err
+		}
+		cur.PendingDomain = suffix
+	}
+
+	pending := !strings.EqualFold(cur.Hostname, cur.PendingHostname) || !strings.EqualFold(cur.Domain, cur.PendingDomain)
+	if pending {
+		requestReboot(h.config, "hostname")
+	}
+	wantName, _ := splitHostname(h.newMetadata.Instance.Hostname)
+	data, err := json.Marshal(hostnameStateJSON{
+		Current:       cur.Hostname,
+		Desired:       wantName,
+		PendingRename: pending,
+		Time:          time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	writeGuestAttribute(h.config, hostnameGuestAttribute, string(data))
+	return nil
+}
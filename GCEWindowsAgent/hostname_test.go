@@ -0,0 +1,148 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+type fakeComputerNamer struct {
+	name      computerName
+	calls     []string
+	renameErr error
+}
+
+func (f *fakeComputerNamer) current() (computerName, error) {
+	return f.name, nil
+}
+
+func (f *fakeComputerNamer) rename(hostname string) error {
+	f.calls = append(f.calls, "rename "+hostname)
+	return f.renameErr
+}
+
+func (f *fakeComputerNamer) setDNSSuffix(suffix string) error {
+	f.calls = append(f.calls, "suffix "+suffix)
+	return nil
+}
+
+func TestSplitHostname(t *testing.T) {
+	var tests = []struct {
+		fqdn, name, suffix string
+	}{
+		{"instance-1.us-central1-a.c.project.internal", "instance-1", "us-central1-a.c.project.internal"},
+		{"instance-1.c.project.internal.", "instance-1", "c.project.internal"},
+		{"instance-1", "instance-1", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		if name, suffix := splitHostname(tt.fqdn); name != tt.name || suffix != tt.suffix {
+			t.Errorf("splitHostname(%q) got: %q, %q, want: %q, %q", tt.fqdn, name, suffix, tt.name, tt.suffix)
+		}
+	}
+}
+
+func TestHostnameSet(t *testing.T) {
+	oldNamer, oldPut := computerNameMgr, putGuestAttribute
+	defer func() { computerNameMgr, putGuestAttribute = oldNamer, oldPut }()
+
+	fqdn := "new.c.project.internal"
+	synced := computerName{"old", "c.project.internal", "old", "c.project.internal", false}
+	var tests = []struct {
+		name      string
+		data      string
+		cur       computerName
+		wantCalls []string
+		want      hostnameStateJSON
+	}{
+		{"no auto rename", "", synced, nil, hostnameStateJSON{"old", "new", false, ""}},
+		{"auto rename", "[hostname]\nauto_rename=true", synced, []string{"rename new"}, hostnameStateJSON{"old", "new", true, ""}},
+		{"domain joined", "[hostname]\nauto_rename=true", computerName{"old", "c.project.internal", "old", "c.project.internal", true}, nil, hostnameStateJSON{"old", "new", false, ""}},
+		{"rename pending", "[hostname]\nauto_rename=true", computerName{"old", "c.project.internal", "NEW", "c.project.internal", false}, nil, hostnameStateJSON{"old", "new", true, ""}},
+		{"dns suffix", "", computerName{"new", "example.com", "new", "example.com", false}, []string{"suffix c.project.internal"}, hostnameStateJSON{"new", "new", true, ""}},
+		{"domain member dns suffix", "", computerName{"new", "corp.example.com", "new", "corp.example.com", true}, nil, hostnameStateJSON{"new", "new", false, ""}},
+		{"no dns suffix", "[hostname]\nset_dns_suffix=false", computerName{"new", "example.com", "new", "example.com", false}, nil, hostnameStateJSON{"new", "new", false, ""}},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		namer := &fakeComputerNamer{name: tt.cur}
+		computerNameMgr = namer
+		var got hostnameStateJSON
+		putGuestAttribute = func(cfg *ini.File, key, value string) error {
+			if key == hostnameGuestAttribute {
+				if err := json.Unmarshal([]byte(value), &got); err != nil {
+					t.Error(err)
+				}
+			}
+			return nil
+		}
+
+		md := &metadataJSON{Instance: instanceJSON{Hostname: fqdn}}
+		if err := (&hostname{newMetadata: md, oldMetadata: &metadataJSON{}, config: cfg}).set(context.Background()); err != nil {
+			t.Errorf("test case %q: set() error: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(namer.calls, tt.wantCalls) {
+			t.Errorf("test case %q: calls got: %q, want: %q", tt.name, namer.calls, tt.wantCalls)
+		}
+		got.Time = ""
+		if got != tt.want {
+			t.Errorf("test case %q: reported state got: %+v, want: %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHostnameDiffRetry(t *testing.T) {
+	oldNamer, oldPut := computerNameMgr, putGuestAttribute
+	defer func() {
+		computerNameMgr, putGuestAttribute = oldNamer, oldPut
+		hostnameRetry = false
+	}()
+	putGuestAttribute = func(*ini.File, string, string) error { return nil }
+
+	cfg, err := ini.InsensitiveLoad([]byte("[hostname]\nauto_rename=true"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := &metadataJSON{Instance: instanceJSON{Hostname: "new.c.project.internal"}}
+	h := &hostname{newMetadata: md, oldMetadata: md, config: cfg}
+
+	var tests = []struct {
+		name      string
+		renameErr error
+		want      bool
+	}{
+		{"rename fails", errors.New("access denied"), true},
+		{"rename succeeds", nil, false},
+	}
+	for _, tt := range tests {
+		computerNameMgr = &fakeComputerNamer{name: computerName{"old", "c.project.internal", "old", "c.project.internal", false}, renameErr: tt.renameErr}
+		if err := h.set(context.Background()); (err != nil) != (tt.renameErr != nil) {
+			t.Errorf("test case %q: set() error: %v", tt.name, err)
+		}
+		if got := h.diff(); got != tt.want {
+			t.Errorf("test case %q: diff() got: %t, want: %t", tt.name, got, tt.want)
+		}
+	}
+}
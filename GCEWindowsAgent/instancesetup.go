@@ -0,0 +1,249 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// instanceSetupRegName is a REG_MULTI_SZ under regKeyBase listing the instance
+// setup actions that completed, after the instanceSetupIDPrefix value of the
+// instance they completed on.
+const (
+	instanceSetupRegName  = "InstanceSetupDone"
+	instanceSetupIDPrefix = "instance-id="
+)
+
+var instanceSetupDisabled = true
+
+// instanceSetupSystem is the interface to the one-time system changes of
+// instance setup.
+type instanceSetupSystem interface {
+	enableRDP() error
+	extendBootPartition() error
+	disableAdministrator() error
+}
+
+// psInstanceSetup makes the changes with PowerShell, as instance_setup.ps1
+// did.
+type psInstanceSetup struct{}
+
+func (psInstanceSetup) enableRDP() error {
+	script := `Set-ItemProperty -Path 'HKLM:\SYSTEM\CurrentControlSet\Control\Terminal Server' -Name fDenyTSConnections -Value 0 -Force
+Enable-NetFirewallRule -DisplayGroup 'Remote Desktop'
+Restart-Service UmRdpService,TermService -Force`
+	if out, err := runPowershell(script); err != nil {
+		return fmt.Errorf("error enabling Remote Desktop: %v, output: %s", err, out)
+	}
+	return nil
+}
+
+func (psInstanceSetup) extendBootPartition() error {
+	script := `$d = $env:SystemDrive.TrimEnd(':')
+$max = (Get-PartitionSupportedSize -DriveLetter $d).SizeMax
+if ((Get-Partition -DriveLetter $d).Size -lt $max) { Resize-Partition -DriveLetter $d -Size $max }`
+	if out, err := runPowershell(script); err != nil {
+		return fmt.Errorf("error extending the boot partition: %v, output: %s", err, out)
+	}
+	return nil
+}
+
+func (psInstanceSetup) disableAdministrator() error {
+	// The built-in Administrator is the local account with RID 500,
+	// whatever it was renamed to.
+	script := `Get-LocalUser | Where-Object { $_.SID.Value -like 'S-1-5-21-*-500' } | Disable-LocalUser`
+	if out, err := runPowershell(script); err != nil {
+		return fmt.Errorf("error disabling the built-in Administrator: %v, output: %s", err, out)
+	}
+	return nil
+}
+
+var (
+	instanceSetupMgr instanceSetupSystem = psInstanceSetup{}
+	// readInstanceSetupDone and writeInstanceSetupDone are replaced in
+	// tests.
+	readInstanceSetupDone = func() ([]string, error) {
+		return readRegMultiString(regKeyBase, instanceSetupRegName)
+	}
+	writeInstanceSetupDone = func(done []string) error {
+		return writeRegMultiString(regKeyBase, instanceSetupRegName, done)
+	}
+)
+
+// setupAction is a one-time instance setup change.
+type setupAction struct {
+	name, desc string
+	enabled    func(sec *ini.Section) bool
+	run        func(ctx context.Context, s *instanceSetup) error
+}
+
+// boolKey returns whether the [instanceSetup] key is true, def if unset.
+func boolKey(key string, def bool) func(sec *ini.Section) bool {
+	return func(sec *ini.Section) bool { return sec.Key(key).MustBool(def) }
+}
+
+// setupActions are the instance setup actions in the order they run.
+var setupActions = []setupAction{
+	{"rdp", "enable Remote Desktop and its firewall rule", boolKey("rdp", true), func(ctx context.Context, s *instanceSetup) error {
+		return instanceSetupMgr.enableRDP()
+	}},
+	{"winrm", "enable the WinRM HTTPS listener", boolKey("winrm", true), func(ctx context.Context, s *instanceSetup) error {
+		return (&winrm{newMetadata: s.newMetadata, oldMetadata: s.oldMetadata, config: s.config}).set(ctx)
+	}},
+	{"pagefile", "set the page files", func(sec *ini.Section) bool { return sec.Key("pagefile").String() != "" }, func(ctx context.Context, s *instanceSetup) error {
+		return s.setPagefiles()
+	}},
+	{"extendBootPartition", "extend the boot partition", boolKey("extend_boot_partition", true), func(ctx context.Context, s *instanceSetup) error {
+		return instanceSetupMgr.extendBootPartition()
+	}},
+	{"disableAdministrator", "disable the built-in Administrator", boolKey("disable_administrator", false), func(ctx context.Context, s *instanceSetup) error {
+		return instanceSetupMgr.disableAdministrator()
+	}},
+}
+
+// instanceSetup performs the one-time setup of a new instance, recording
+// each completed action in the registry so it never runs again.
+type instanceSetup struct {
+	newMetadata, oldMetadata *metadataJSON
+	config                   *ini.File
+}
+
+// instanceID returns the instanceSetupIDPrefix value of this instance, empty
+// if its ID is unknown.
+func (s *instanceSetup) instanceID() string {
+	if s.newMetadata.Instance.ID == 0 {
+		return ""
+	}
+	return instanceSetupIDPrefix + strconv.FormatUint(s.newMetadata.Instance.ID, 10)
+}
+
+// done returns the actions completed on this instance. Actions recorded on
+// another instance, such as the one an image was captured from, still have
+// to run here.
+func (s *instanceSetup) done() ([]string, error) {
+	done, err := readInstanceSetupDone()
+	if err != nil && err != errRegNotExist {
+		return nil, err
+	}
+	if len(done) == 0 || done[0] != s.instanceID() {
+		return nil, nil
+	}
+	return done[1:], nil
+}
+
+// pending returns the enabled actions that haven't completed yet. If the
+// completed actions or the instance ID can't be read none are pending, so no
+// action runs twice.
+func (s *instanceSetup) pending() []setupAction {
+	if s.instanceID() == "" {
+		return nil
+	}
+	done, err := s.done()
+	if err != nil {
+		logger.Errorln("Error reading completed instance setup actions:", err)
+		return nil
+	}
+	sec := s.config.Section("instanceSetup")
+	var actions []setupAction
+	for _, a := range setupActions {
+		if a.enabled(sec) && !containsString(a.name, done) {
+			actions = append(actions, a)
+		}
+	}
+	return actions
+}
+
+func (s *instanceSetup) diff() bool {
+	return len(s.pending()) != 0
+}
+
+func (s *instanceSetup) metadataPaths() []string {
+	// Only configurable locally, the instance ID tells whether the actions
+	// completed on this instance.
+	return []string{"instance/id"}
+}
+
+func (s *instanceSetup) disabled() (disabled bool) {
+	defer func() {
+		if disabled != instanceSetupDisabled {
+			instanceSetupDisabled = disabled
+			logStatus("instance setup", disabled)
+		}
+	}()
+
+	return !s.enablement().Enabled
+}
+
+// Instance setup is opt-in with [instanceSetup] enable, images built with it
+// enable it in their config file. There is no metadata attribute for it, the
+// google-compute-agent-config overlay can still set the key.
+func (s *instanceSetup) enablement() enablement {
+	return isEnabled(s.config, s.newMetadata, enableRule{section: "instanceSetup", key: "enable"}, false)
+}
+
+// setPagefiles sets the page files in [instanceSetup] pagefile, in the
+// format of [pagefile] files. The change takes effect after a reboot.
+func (s *instanceSetup) setPagefiles() error {
+	pfs := parsePagefiles(s.config.Section("instanceSetup").Key("pagefile").String())
+	if len(pfs) == 0 {
+		return fmt.Errorf("no valid page files in instanceSetup.pagefile")
+	}
+	for _, pf := range pfs {
+		logger.Infof("Setting page file on %s to initial size %d MB, maximum size %d MB", pf.Drive, pf.Initial, pf.Max)
+		if err := pagefileMgr.set(pf); err != nil {
+			return err
+		}
+	}
+	requestReboot(s.config, "instanceSetup")
+	return nil
+}
+
+func (s *instanceSetup) plan() ([]string, error) {
+	var changes []string
+	for _, a := range s.pending() {
+		changes = append(changes, a.desc)
+	}
+	return changes, nil
+}
+
+// set runs the pending actions in order. A failed action is retried on the
+// next update, the others still run.
+func (s *instanceSetup) set(ctx context.Context) error {
+	actions := s.pending()
+	done, _ := s.done()
+	done = append([]string{s.instanceID()}, done...)
+	var firstErr error
+	for _, a := range actions {
+		logger.Infof("Instance setup: running %s.", a.name)
+		if err := a.run(ctx, s); err != nil {
+			err = fmt.Errorf("error running instance setup action %s: %v", a.name, err)
+			logger.Error(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		done = append(done, a.name)
+		if err := writeInstanceSetupDone(done); err != nil {
+			logger.Errorln("Error recording completed instance setup actions:", err)
+		}
+	}
+	return firstErr
+}
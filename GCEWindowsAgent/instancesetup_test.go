@@ -0,0 +1,156 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+type fakeInstanceSetup struct {
+	ran     []string
+	failRDP bool
+}
+
+func (f *fakeInstanceSetup) enableRDP() error {
+	if f.failRDP {
+		return errors.New("rdp error")
+	}
+	f.ran = append(f.ran, "rdp")
+	return nil
+}
+
+func (f *fakeInstanceSetup) extendBootPartition() error {
+	f.ran = append(f.ran, "extendBootPartition")
+	return nil
+}
+
+func (f *fakeInstanceSetup) disableAdministrator() error {
+	f.ran = append(f.ran, "disableAdministrator")
+	return nil
+}
+
+func TestInstanceSetupSet(t *testing.T) {
+	oldSystem, oldPagefiles, oldStore, oldListener := instanceSetupMgr, pagefileMgr, certStoreMgr, winrmListenerMgr
+	oldRead, oldWrite := readInstanceSetupDone, writeInstanceSetupDone
+	defer func() {
+		instanceSetupMgr, pagefileMgr, certStoreMgr, winrmListenerMgr = oldSystem, oldPagefiles, oldStore, oldListener
+		readInstanceSetupDone, writeInstanceSetupDone = oldRead, oldWrite
+		winrmCertSchedule.set(time.Time{})
+	}()
+
+	// ids prefixes actions with the ID of the instance they completed on.
+	ids := func(id string, actions ...string) []string {
+		return append([]string{instanceSetupIDPrefix + id}, actions...)
+	}
+	var tests = []struct {
+		name          string
+		data          string
+		done          []string
+		failRDP       bool
+		wantRan       []string
+		wantDone      []string
+		wantPagefiles []pagefileJSON
+		wantErr       bool
+	}{
+		{"defaults", "", nil, false, []string{"rdp", "extendBootPartition"}, ids("1", "rdp", "winrm", "extendBootPartition"), nil, false},
+		{"all done", "", ids("1", "rdp", "winrm", "extendBootPartition"), false, nil, ids("1", "rdp", "winrm", "extendBootPartition"), nil, false},
+		{"done on image", "", ids("2", "rdp", "winrm", "extendBootPartition"), false, []string{"rdp", "extendBootPartition"}, ids("1", "rdp", "winrm", "extendBootPartition"), nil, false},
+		{"all actions", "[instanceSetup]\nwinrm=false\npagefile=[{\"Drive\":\"c\",\"Initial\":1024,\"Max\":4096}]\ndisable_administrator=true", ids("1", "rdp"), false,
+			[]string{"extendBootPartition", "disableAdministrator"}, ids("1", "rdp", "pagefile", "extendBootPartition", "disableAdministrator"), []pagefileJSON{{"C:", 1024, 4096}}, false},
+		{"failure retried", "[instanceSetup]\nwinrm=false", nil, true, []string{"extendBootPartition"}, ids("1", "extendBootPartition"), nil, true},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		system := &fakeInstanceSetup{failRDP: tt.failRDP}
+		pagefiles := &fakePagefileManager{}
+		instanceSetupMgr, pagefileMgr = system, pagefiles
+		certStoreMgr, winrmListenerMgr = &fakeCertStore{}, &fakeWinRMListener{}
+		done := tt.done
+		readInstanceSetupDone = func() ([]string, error) { return done, nil }
+		writeInstanceSetupDone = func(d []string) error {
+			done = append([]string(nil), d...)
+			return nil
+		}
+
+		s := &instanceSetup{newMetadata: &metadataJSON{Instance: instanceJSON{ID: 1}}, oldMetadata: &metadataJSON{}, config: cfg}
+		if err := s.set(context.Background()); (err != nil) != tt.wantErr {
+			t.Errorf("test case %q: set() error: %v, want error: %t", tt.name, err, tt.wantErr)
+		}
+		if !reflect.DeepEqual(system.ran, tt.wantRan) {
+			t.Errorf("test case %q: actions run got: %q, want: %q", tt.name, system.ran, tt.wantRan)
+		}
+		if !reflect.DeepEqual(done, tt.wantDone) {
+			t.Errorf("test case %q: actions recorded got: %q, want: %q", tt.name, done, tt.wantDone)
+		}
+		if !reflect.DeepEqual(pagefiles.applied, tt.wantPagefiles) {
+			t.Errorf("test case %q: page files set got: %+v, want: %+v", tt.name, pagefiles.applied, tt.wantPagefiles)
+		}
+		if got, want := s.diff(), tt.failRDP; got != want {
+			t.Errorf("test case %q: diff() after set got: %t, want: %t", tt.name, got, want)
+		}
+	}
+}
+
+func TestInstanceSetupSubtreeFetch(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("etag", "1")
+		if r.URL.Path == "/instance/id/" {
+			w.Write([]byte("1234"))
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer ts.Close()
+
+	oldServer, oldPaths, oldRead := metadataServer, neededPaths, readInstanceSetupDone
+	defer func() {
+		metadataServer, neededPaths, readInstanceSetupDone = oldServer, oldPaths, oldRead
+		etag = defaultEtag
+		pathEtags = map[string]string{}
+		pathContent = map[string]json.RawMessage{}
+	}()
+	metadataServer = ts.URL
+	readInstanceSetupDone = func() ([]string, error) { return nil, nil }
+
+	cfg, err := ini.InsensitiveLoad([]byte("[metadata]\nsubtree_fetch=true\n[instanceSetup]\nenable=true"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &instanceSetup{config: cfg}
+	neededPaths = s.metadataPaths()
+	s.newMetadata, err = watchMetadata(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("watchMetadata() returned error: %v", err)
+	}
+	if got, want := s.instanceID(), instanceSetupIDPrefix+"1234"; got != want {
+		t.Errorf("instanceID() got: %q, want: %q", got, want)
+	}
+	if !s.diff() {
+		t.Error("diff() with subtree fetch got: false, want: true")
+	}
+}
@@ -0,0 +1,53 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/go-ini/ini"
+)
+
+// interfaceByMAC returns the interface in ifs whose hardware address matches
+// mac. Interface names and indices can change across reboots, the MAC address
+// is the only stable way to match a metadata network interface to an adapter.
+func interfaceByMAC(mac string, ifs []net.Interface) (net.Interface, error) {
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return net.Interface{}, err
+	}
+	for _, iface := range ifs {
+		if iface.HardwareAddr.String() == hwAddr.String() {
+			return iface, nil
+		}
+	}
+	return net.Interface{}, fmt.Errorf("no interface with mac %s exists on system", hwAddr)
+}
+
+// selectedMAC returns the MAC address in the interface_mac key of sec, which
+// selects the adapter a manager changes, or def when the key is unset. It is
+// returned in the form interfaceByMAC matches.
+func selectedMAC(sec *ini.Section, def string) (string, error) {
+	mac := sec.Key("interface_mac").String()
+	if mac == "" {
+		mac = def
+	}
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", fmt.Errorf("invalid interface_mac %q in [%s]: %v", mac, sec.Name(), err)
+	}
+	return hwAddr.String(), nil
+}
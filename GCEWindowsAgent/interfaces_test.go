@@ -0,0 +1,82 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+func TestInterfaceByMAC(t *testing.T) {
+	mac1, _ := net.ParseMAC("42:01:0a:80:00:02")
+	mac2, _ := net.ParseMAC("42:01:0a:80:00:03")
+	ifs := []net.Interface{
+		{Index: 4, Name: "Ethernet", HardwareAddr: mac1},
+		{Index: 7, Name: "Ethernet 2", HardwareAddr: mac2},
+	}
+
+	var tests = []struct {
+		mac       string
+		wantIndex int
+		wantErr   bool
+	}{
+		{"42:01:0a:80:00:02", 4, false},
+		{"42:01:0A:80:00:03", 7, false},
+		{"42-01-0a-80-00-03", 7, false},
+		{"42:01:0a:80:00:04", 0, true},
+		{"not a mac", 0, true},
+	}
+
+	for _, tt := range tests {
+		iface, err := interfaceByMAC(tt.mac, ifs)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("interfaceByMAC(%q) returned error %v, want error: %t", tt.mac, err, tt.wantErr)
+			continue
+		}
+		if iface.Index != tt.wantIndex {
+			t.Errorf("interfaceByMAC(%q) returned interface index %d, want %d", tt.mac, iface.Index, tt.wantIndex)
+		}
+	}
+}
+
+func TestSelectedMAC(t *testing.T) {
+	var tests = []struct {
+		data    string
+		def     string
+		want    string
+		wantErr bool
+	}{
+		{"", "42:01:0a:80:00:02", "42:01:0a:80:00:02", false},
+		{"[dns]\ninterface_mac=42-01-0A-80-00-03", "42:01:0a:80:00:02", "42:01:0a:80:00:03", false},
+		{"[dns]\ninterface_mac=bad", "42:01:0a:80:00:02", "", true},
+		{"", "", "", true},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := selectedMAC(cfg.Section("dns"), tt.def)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("selectedMAC(%q, %q) returned error %v, want error: %t", tt.data, tt.def, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("selectedMAC(%q, %q) got: %q, want: %q", tt.data, tt.def, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// guestInventoryPath is the guest attribute namespace of the OS inventory,
+// in the format of the OS Config agent.
+const guestInventoryPath = "instance/guest-attributes/guestInventory/"
+
+var (
+	// inventoryRecheck is how often the config is checked while inventory
+	// reporting is off.
+	inventoryRecheck = time.Minute
+
+	invSource inventorySource = psInventory{}
+	// putInventoryAttribute is replaced in tests.
+	putInventoryAttribute = func(cfg *ini.File, key, value string) error {
+		return putMetadata(context.Background(), cfg, guestInventoryPath+key, value)
+	}
+)
+
+// osInventory describes the operating system.
+type osInventory struct {
+	LongName      string
+	Version       string
+	KernelVersion string
+	KernelRelease string
+	Architecture  string
+}
+
+// qfePackage is an installed hotfix.
+type qfePackage struct {
+	Caption, Description, HotFixID, InstalledOn string
+}
+
+// googetPackage is an installed googet package.
+type googetPackage struct {
+	Name, Arch, Version string
+}
+
+// installedPackagesJSON is the InstalledPackages inventory attribute.
+type installedPackagesJSON struct {
+	GooGet []googetPackage `json:"googet,omitempty"`
+	QFE    []qfePackage    `json:"qfe,omitempty"`
+}
+
+// inventorySource collects the inventory.
+type inventorySource interface {
+	osInfo() (osInventory, error)
+	hotfixes() ([]qfePackage, error)
+	googetPackages() ([]googetPackage, error)
+}
+
+// psInventory collects the inventory with PowerShell and googet.
+type psInventory struct{}
+
+func (psInventory) osInfo() (osInventory, error) {
+	out, err := runPowershell(`$os = Get-CimInstance Win32_OperatingSystem
+$ubr = (Get-ItemProperty 'HKLM:\SOFTWARE\Microsoft\Windows NT\CurrentVersion').UBR
+@{LongName=$os.Caption; Version=$os.Version; KernelVersion=$os.BuildNumber; KernelRelease="$($os.Version).$ubr"; Architecture=$env:PROCESSOR_ARCHITECTURE} | ConvertTo-Json -Compress`)
+	if err != nil {
+		return osInventory{}, fmt.Errorf("error reading OS version: %v, output: %s", err, out)
+	}
+	var i osInventory
+	if err := json.Unmarshal(out, &i); err != nil {
+		return osInventory{}, fmt.Errorf("error parsing OS version: %v, output: %s", err, out)
+	}
+	i.Architecture = inventoryArch(i.Architecture)
+	return i, nil
+}
+
+func (psInventory) hotfixes() ([]qfePackage, error) {
+	out, err := runPowershell(`ConvertTo-Json -Compress -InputObject @(Get-CimInstance Win32_QuickFixEngineering | ForEach-Object { @{Caption=[string]$_.Caption; Description=[string]$_.Description; HotFixID=[string]$_.HotFixID; InstalledOn=[string]$_.InstalledOn} })`)
+	if err != nil {
+		return nil, fmt.Errorf("error listing hotfixes: %v, output: %s", err, out)
+	}
+	var qfes []qfePackage
+	if err := json.Unmarshal(out, &qfes); err != nil {
+		return nil, fmt.Errorf("error parsing hotfixes: %v, output: %s", err, out)
+	}
+	return qfes, nil
+}
+
+func (psInventory) googetPackages() ([]googetPackage, error) {
+	root := os.Getenv("GooGetRoot")
+	if root == "" {
+		root = `C:\ProgramData\GooGet`
+	}
+	out, err := exec.Command(filepath.Join(root, "googet.exe"), "installed").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("error listing googet packages: %v, output: %s", err, out)
+	}
+	return parseGoogetInstalled(out), nil
+}
+
+// inventoryArch returns PROCESSOR_ARCHITECTURE as the OS Config agent names
+// architectures.
+func inventoryArch(arch string) string {
+	switch strings.ToUpper(arch) {
+	case "AMD64":
+		return "x86_64"
+	case "X86":
+		return "x86_32"
+	case "ARM64":
+		return "arm64"
+	default:
+		return arch
+	}
+}
+
+// parseGoogetInstalled parses the output of googet installed, a header line
+// followed by a "name.arch version" line per package.
+func parseGoogetInstalled(out []byte) []googetPackage {
+	var pkgs []googetPackage
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		i := strings.LastIndex(fields[0], ".")
+		if i <= 0 {
+			continue
+		}
+		pkgs = append(pkgs, googetPackage{Name: fields[0][:i], Arch: fields[0][i+1:], Version: fields[1]})
+	}
+	return pkgs
+}
+
+// inventoryEnabled reports whether [inventory] enable is set.
+func inventoryEnabled(cfg *ini.File) bool {
+	return cfg.Section("inventory").Key("enable").MustBool(false)
+}
+
+// inventoryInterval returns how often the inventory is reported.
+func inventoryInterval(cfg *ini.File) time.Duration {
+	return time.Duration(cfg.Section("inventory").Key("interval_sec").MustInt(3600)) * time.Second
+}
+
+// encodePackages returns pkgs as gzipped and base64 encoded JSON, keeping
+// the attribute within the guest attribute size limit.
+func encodePackages(pkgs installedPackagesJSON) (string, error) {
+	var buf bytes.Buffer
+	b64 := base64.NewEncoder(base64.StdEncoding, &buf)
+	zw := gzip.NewWriter(b64)
+	if err := json.NewEncoder(zw).Encode(pkgs); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+	if err := b64.Close(); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// reportInventory collects the inventory and writes it to the guestInventory
+// guest attributes. Parts that can't be collected are left out.
+func reportInventory(cfg *ini.File) error {
+	if !cfg.Section("core").Key("guest_attributes").MustBool(true) {
+		return nil
+	}
+	attrs := map[string]string{
+		"ShortName":    "windows",
+		"AgentVersion": version,
+		"LastUpdated":  time.Now().UTC().Format(time.RFC3339),
+	}
+	if h, err := os.Hostname(); err == nil {
+		attrs["Hostname"] = h
+	}
+	if i, err := invSource.osInfo(); err != nil {
+		logger.Error(err)
+	} else {
+		attrs["LongName"], attrs["Version"], attrs["Architecture"] = i.LongName, i.Version, i.Architecture
+		attrs["KernelVersion"], attrs["KernelRelease"] = i.KernelVersion, i.KernelRelease
+	}
+
+	var pkgs installedPackagesJSON
+	var err error
+	if pkgs.QFE, err = invSource.hotfixes(); err != nil {
+		logger.Error(err)
+	}
+	if pkgs.GooGet, err = invSource.googetPackages(); err != nil {
+		logger.Error(err)
+	}
+	if attrs["InstalledPackages"], err = encodePackages(pkgs); err != nil {
+		return err
+	}
+
+	var keys []string
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := putInventoryAttribute(cfg, k, attrs[k]); err != nil {
+			return fmt.Errorf("error writing inventory attribute %s: %v", k, err)
+		}
+	}
+	return nil
+}
+
+// inventoryLoop reports the inventory at start and then every [inventory]
+// interval_sec until ctx is done.
+func inventoryLoop(ctx context.Context) {
+	periodicLoop(ctx, periodicTask{
+		name: "inventory report",
+		interval: func(cfg *ini.File) time.Duration {
+			if !inventoryEnabled(cfg) {
+				return inventoryRecheck
+			}
+			return inventoryInterval(cfg)
+		},
+		atStart: true,
+		due:     func(cfg *ini.File, _ time.Time) bool { return inventoryEnabled(cfg) },
+		run:     func(_ context.Context, cfg *ini.File) error { return reportInventory(cfg) },
+	})
+}
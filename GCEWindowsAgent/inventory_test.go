@@ -0,0 +1,112 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+type fakeInventory struct {
+	hotfixErr bool
+}
+
+func (fakeInventory) osInfo() (osInventory, error) {
+	return osInventory{"Microsoft Windows Server 2019 Datacenter", "10.0.17763", "17763", "10.0.17763.1757", "x86_64"}, nil
+}
+
+func (f fakeInventory) hotfixes() ([]qfePackage, error) {
+	if f.hotfixErr {
+		return nil, errors.New("hotfix error")
+	}
+	return []qfePackage{{"http://support.microsoft.com/?kbid=4598230", "Security Update", "KB4598230", "1/12/2021 12:00:00 AM"}}, nil
+}
+
+func (fakeInventory) googetPackages() ([]googetPackage, error) {
+	return []googetPackage{{"googet", "x86_64", "2.17.0@1"}}, nil
+}
+
+func TestParseGoogetInstalled(t *testing.T) {
+	out := []byte("Installed packages:\n  googet.x86_64 2.17.0@1\n  google-compute-engine-windows.x86_64 4.6.0@1\n\nbogus\n")
+	want := []googetPackage{{"googet", "x86_64", "2.17.0@1"}, {"google-compute-engine-windows", "x86_64", "4.6.0@1"}}
+	if got := parseGoogetInstalled(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseGoogetInstalled got: %+v, want: %+v", got, want)
+	}
+}
+
+func decodePackages(t *testing.T, s string) installedPackagesJSON {
+	zr, err := gzip.NewReader(base64.NewDecoder(base64.StdEncoding, strings.NewReader(s)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pkgs installedPackagesJSON
+	if err := json.NewDecoder(zr).Decode(&pkgs); err != nil {
+		t.Fatal(err)
+	}
+	return pkgs
+}
+
+func TestReportInventory(t *testing.T) {
+	oldSource, oldPut := invSource, putInventoryAttribute
+	defer func() { invSource, putInventoryAttribute = oldSource, oldPut }()
+
+	var tests = []struct {
+		name      string
+		data      string
+		hotfixErr bool
+		wantKeys  int
+		wantQFE   int
+	}{
+		{"all", "", false, 10, 1},
+		{"hotfix error", "", true, 10, 0},
+		{"guest attributes disabled", "[core]\nguest_attributes=false", false, 0, 0},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		invSource = fakeInventory{tt.hotfixErr}
+		got := map[string]string{}
+		putInventoryAttribute = func(cfg *ini.File, key, value string) error {
+			got[key] = value
+			return nil
+		}
+		if err := reportInventory(cfg); err != nil {
+			t.Errorf("test case %q: reportInventory error: %v", tt.name, err)
+		}
+		if len(got) != tt.wantKeys {
+			t.Errorf("test case %q: wrote %d attributes, want %d: %q", tt.name, len(got), tt.wantKeys, got)
+		}
+		if tt.wantKeys == 0 {
+			continue
+		}
+		if got["KernelRelease"] != "10.0.17763.1757" || got["ShortName"] != "windows" {
+			t.Errorf("test case %q: unexpected OS attributes: %q", tt.name, got)
+		}
+		pkgs := decodePackages(t, got["InstalledPackages"])
+		if len(pkgs.QFE) != tt.wantQFE || len(pkgs.GooGet) != 1 {
+			t.Errorf("test case %q: InstalledPackages got: %+v", tt.name, pkgs)
+		}
+	}
+}
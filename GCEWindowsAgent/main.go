@@ -17,15 +17,19 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"net"
-	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
 	"github.com/go-ini/ini"
+	"github.com/kardianos/service"
 	"github.com/tarm/serial"
 )
 
@@ -36,17 +40,52 @@ const (
 	regKeyBase = `SOFTWARE\Google\ComputeEngine`
 )
 
+const defaultSerialMaxWrite = 4096
+
+var (
+	// serialMaxWrite is the largest single write to a serial port, larger
+	// messages are split into chunks written serialChunkDelay apart so the
+	// console is not overrun. It is stored by runUpdate and loaded by the
+	// loggers writing to the port.
+	serialMaxWrite   int64 = defaultSerialMaxWrite
+	serialChunkDelay       = 10 * time.Millisecond
+
+	// openSerial is replaced in tests.
+	openSerial = func(port string) (io.WriteCloser, error) {
+		return serial.OpenPort(&serial.Config{Name: port, Baud: 115200})
+	}
+)
+
+// serialLogPort returns the [core] serial_port the agent logs to, "none" to
+// turn off serial logging.
+func serialLogPort(cfg *ini.File) string {
+	return cfg.Section("core").Key("serial_port").MustString("COM1")
+}
+
+// writeSerial writes msg to port, doing nothing if port is "none".
 func writeSerial(port string, msg []byte) error {
-	c := &serial.Config{Name: port, Baud: 115200}
-	s, err := serial.OpenPort(c)
+	if strings.EqualFold(port, "none") {
+		return nil
+	}
+	s, err := openSerial(port)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
 
-	_, err = s.Write(msg)
-	if err != nil {
-		return err
+	limit := int(atomic.LoadInt64(&serialMaxWrite))
+	for len(msg) > 0 {
+		n := len(msg)
+		if limit > 0 && n > limit {
+			n = limit
+		}
+		if _, err := s.Write(msg[:n]); err != nil {
+			return err
+		}
+		msg = msg[n:]
+		if len(msg) > 0 {
+			time.Sleep(serialChunkDelay)
+		}
 	}
 	return nil
 }
@@ -54,9 +93,31 @@ func writeSerial(port string, msg []byte) error {
 type manager interface {
 	diff() bool
 	disabled() bool
-	set() error
+	set(ctx context.Context) error
+	// metadataPaths returns the metadata subtrees the manager reads.
+	metadataPaths() []string
+}
+
+// namedManager is a manager along with its config file section.
+type namedManager struct {
+	section string
+	manager
+}
+
+// disabled reports whether the manager is disabled, by its own config or
+// by a runtime override from the control pipe.
+func (m namedManager) disabled() bool {
+	// The manager's own check always runs as it logs its status.
+	d := m.manager.disabled()
+	if enabled, ok := managerOverride(m.section); ok {
+		return !enabled
+	}
+	return d
 }
 
+// logFatal is replaced in tests.
+var logFatal = logger.Fatal
+
 func logStatus(name string, disabled bool) {
 	var status string
 	switch disabled {
@@ -68,15 +129,78 @@ func logStatus(name string, disabled bool) {
 	logger.Infof("GCE %s manager status: %s", name, status)
 }
 
+// configDropIns returns the *.cfg files in the drop-in directory of file,
+// file.d, in lexical order.
+func configDropIns(file string) []string {
+	// Glob only fails on a bad pattern.
+	files, _ := filepath.Glob(filepath.Join(file+".d", "*.cfg"))
+	return files
+}
+
+// parseConfig parses file and then its drop-in files, keys set by later files
+// override earlier ones. A missing file is only an error if there are no
+// drop-in files either.
 func parseConfig(file string) (*ini.File, error) {
+	var sources []interface{}
 	d, err := ioutil.ReadFile(file)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return nil, err
 	}
-	return ini.InsensitiveLoad(d)
+	if err == nil {
+		sources = append(sources, d)
+	}
+	for _, f := range configDropIns(file) {
+		d, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, d)
+	}
+	if len(sources) == 0 {
+		return nil, err
+	}
+	return ini.InsensitiveLoad(sources[0], sources[1:]...)
+}
+
+// regConfigName is a REG_MULTI_SZ value under regKeyBase holding config
+// settings as "section.key=value" entries.
+const regConfigName = "Config"
+
+// readRegConfig is replaced in tests.
+var readRegConfig = func() ([]string, error) {
+	return readRegMultiString(regKeyBase, regConfigName)
 }
 
-func runUpdate(newMetadata, oldMetadata *metadataJSON) {
+// mergeRegistryConfig adds settings from the registry to cfg. Settings in the
+// config file take precedence, registry settings only fill in keys the file
+// does not set.
+func mergeRegistryConfig(cfg *ini.File) {
+	entries, err := readRegConfig()
+	if err != nil && err != errRegNotExist {
+		logger.Errorln("Error reading config from registry:", err)
+		return
+	}
+	for _, e := range entries {
+		kv := strings.SplitN(e, "=", 2)
+		sk := strings.SplitN(kv[0], ".", 2)
+		if len(kv) != 2 || len(sk) != 2 || strings.TrimSpace(sk[0]) == "" || strings.TrimSpace(sk[1]) == "" {
+			logger.Errorf("Invalid registry config entry %q, want section.key=value", e)
+			continue
+		}
+		sec := cfg.Section(strings.TrimSpace(sk[0]))
+		key := strings.TrimSpace(sk[1])
+		if sec.HasKey(key) {
+			continue
+		}
+		if _, err := sec.NewKey(key, strings.TrimSpace(kv[1])); err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+// loadConfig parses the local config file and merges in registry and
+// metadata settings, on error an empty config is used so callers always fall back to defaults.
+func loadConfig() *ini.File {
 	cfg, err := parseConfig(configPath)
 	if err != nil && !os.IsNotExist(err) {
 		logger.Error(err)
@@ -84,79 +208,556 @@ func runUpdate(newMetadata, oldMetadata *metadataJSON) {
 	if cfg == nil {
 		cfg, _ = ini.InsensitiveLoad([]byte{})
 	}
+	mergeRegistryConfig(cfg)
+	mergeConfigOverlay(cfg)
+	return cfg
+}
 
-	var wg sync.WaitGroup
-	addressMgr := &addresses{
-		oldMetadata: oldMetadata,
-		newMetadata: newMetadata,
-		config:      cfg,
+// newManagers returns all managers, in the order they are run. Plugins run
+// after the managers of the agent.
+func newManagers(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) []namedManager {
+	return append(builtinManagers(newMetadata, oldMetadata, cfg), pluginManagers(newMetadata, oldMetadata, cfg)...)
+}
+
+// builtinManagers returns the managers of the agent, in registration order.
+func builtinManagers(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) []namedManager {
+	var mgrs []namedManager
+	for _, r := range managerRegistry {
+		mgrs = append(mgrs, namedManager{r.section, r.build(newMetadata, oldMetadata, cfg)})
+	}
+	return mgrs
+}
+
+func init() {
+	registerManager("addressManager", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &addresses{oldMetadata: oldMetadata, newMetadata: newMetadata, config: cfg}
+	})
+	registerManager("accountManager", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &accounts{oldMetadata: oldMetadata, newMetadata: newMetadata, config: cfg}
+	})
+	// The cluster health check answers for the addresses being added.
+	registerManager("wsfc", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return newWsfcManager(newMetadata, cfg)
+	}, "addressManager")
+	registerManager("diagnostics", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &diagnostics{oldMetadata: oldMetadata, newMetadata: newMetadata, config: cfg}
+	})
+	registerManager("printers", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &printers{oldMetadata: oldMetadata, newMetadata: newMetadata, config: cfg}
+	})
+	registerManager("timeSync", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &timeSync{newMetadata: newMetadata, config: cfg}
+	})
+	registerManager("disks", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &disks{newMetadata: newMetadata, oldMetadata: oldMetadata, config: cfg}
+	})
+	// Page files can be on disks brought online by the disks manager.
+	registerManager("pagefile", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &pagefiles{oldMetadata: oldMetadata, newMetadata: newMetadata, config: cfg}
+	}, "disks")
+	registerManager("perfTune", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &perfTune{config: cfg}
+	})
+	registerManager("osLogin", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &osLogin{newMetadata: newMetadata, oldMetadata: oldMetadata, config: cfg}
+	})
+	registerManager("sshKeys", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &sshKeys{newMetadata: newMetadata, oldMetadata: oldMetadata, config: cfg}
+	})
+	registerManager("rdpCert", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &rdpCert{newMetadata: newMetadata, oldMetadata: oldMetadata, config: cfg}
+	})
+	registerManager("winrm", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &winrm{newMetadata: newMetadata, oldMetadata: oldMetadata, config: cfg}
+	})
+	registerManager("mtu", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &mtu{newMetadata: newMetadata, oldMetadata: oldMetadata, config: cfg}
+	})
+	registerManager("dns", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &dns{newMetadata: newMetadata, oldMetadata: oldMetadata, config: cfg}
+	})
+	registerManager("instanceSetup", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &instanceSetup{newMetadata: newMetadata, oldMetadata: oldMetadata, config: cfg}
+	})
+	registerManager("activation", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &activation{newMetadata: newMetadata, config: cfg}
+	})
+	registerManager("hostname", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &hostname{newMetadata: newMetadata, oldMetadata: oldMetadata, config: cfg}
+	})
+	// The domain is joined with the new computer name and must resolve.
+	registerManager("domainJoin", func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		return &domainJoin{newMetadata: newMetadata, oldMetadata: oldMetadata, config: cfg}
+	}, "hostname", "dns")
+}
+
+// updateMu serializes update cycles and audit passes.
+var updateMu sync.Mutex
+
+// runUpdate runs all managers against newMetadata. When changed is non-nil the
+// managers are diffed in hash mode: oldMetadata is the same as newMetadata and
+// changed lists the top level metadata keys that changed. It reports whether
+// newMetadata was applied, a dry run leaves it to the next update.
+func runUpdate(ctx context.Context, newMetadata, oldMetadata *metadataJSON, changed []string) bool {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	cfg := loadConfig()
+	maxWrite, err := cfg.Section("core").Key("serial_max_write").Int64()
+	if err != nil {
+		maxWrite = defaultSerialMaxWrite
+	}
+	atomic.StoreInt64(&serialMaxWrite, maxWrite)
+
+	first := firstBoot()
+	mgrs := filterManagers(cfg, newManagers(newMetadata, oldMetadata, cfg), first)
+	if changed != nil {
+		for i := range mgrs {
+			mgrs[i].manager = fingerprintDiff{mgrs[i].manager, changed}
+		}
+	} else {
+		targetManagers(mgrs, newMetadata, oldMetadata)
+	}
+	if changed != nil {
+		logger.Debugf("Changed metadata keys: %q", changed)
+	}
+	root := newTracer(cfg).startSpan("runUpdate", nil)
+	if root != nil {
+		for i := range mgrs {
+			mgrs[i].manager = tracedManager{mgrs[i].manager, mgrs[i].section, root}
+		}
 	}
-	acctMgr := &accounts{
-		oldMetadata: oldMetadata,
-		newMetadata: newMetadata,
-		config:      cfg,
+	ran, failed := runManagers(ctx, cfg, mgrs)
+	if dryRun(cfg) {
+		root.finish(nil)
+		return false
 	}
-	diagMgr := &diagnostics{
-		oldMetadata: oldMetadata,
-		newMetadata: newMetadata,
-		config:      cfg,
+	if ran > 0 && failed == 0 {
+		runPostConvergeScript(ctx, cfg)
 	}
-	wsfcMgr := newWsfcManager(newMetadata, cfg)
+	markFirstBootDone(first, failed)
+	root.finish(nil)
+	setAppliedMetadata(newMetadata)
+	return true
+}
 
-	for _, mgr := range []manager{addressMgr, acctMgr, wsfcMgr, diagMgr} {
+// runManagers runs all managers in parallel and returns how many applied
+// changes and how many of those failed. A manager whose set() fails and has
+// failure_is_fatal set in its config section stops the agent so the service
+// recovery actions can restart it.
+func runManagers(ctx context.Context, cfg *ini.File, mgrs []namedManager) (ran, failed int) {
+	var mu sync.Mutex
+	var fullTree bool
+	paths := append(append(append([]string(nil), attributePaths...), verifyPaths(cfg)...), terminationPaths(cfg)...)
+	for _, p := range maintenancePaths(cfg) {
+		if !containsString(p, paths) {
+			paths = append(paths, p)
+		}
+	}
+	// done waits for the managers of a section, for the managers ordered
+	// after them.
+	done := make(map[string]*sync.WaitGroup)
+	for _, mgr := range mgrs {
+		if done[mgr.section] == nil {
+			done[mgr.section] = &sync.WaitGroup{}
+		}
+		done[mgr.section].Add(1)
+	}
+	settings := make(map[string]runSettings)
+	for _, mgr := range mgrs {
+		settings[mgr.section] = managerRunSettings(cfg, mgr.section)
+	}
+	var wg sync.WaitGroup
+	for _, mgr := range mgrs {
 		wg.Add(1)
-		go func(mgr manager) {
+		go func(mgr namedManager) {
 			defer wg.Done()
-			if mgr.disabled() || !mgr.diff() {
+			defer done[mgr.section].Done()
+			for _, s := range managerAfter(mgr.section) {
+				if d, ok := done[s]; ok {
+					d.Wait()
+				}
+			}
+			if mgr.disabled() {
+				logger.Debugf("Skipping disabled %s manager", mgr.section)
+				recordState(cfg, mgr.section, stateDisabled)
+				return
+			}
+			mu.Lock()
+			if mgr.metadataPaths() == nil {
+				fullTree = true
+			}
+			for _, p := range mgr.metadataPaths() {
+				if !containsString(p, paths) {
+					paths = append(paths, p)
+				}
+			}
+			mu.Unlock()
+			if !mgr.diff() {
+				logger.Debugf("No changes for %s manager", mgr.section)
 				return
 			}
-			if err := mgr.set(); err != nil {
-				logger.Error(err)
+			logger.Debugf("Applying changes for %s manager", mgr.section)
+			err := runSet(ctx, cfg, mgr, settings[mgr.section])
+			mu.Lock()
+			ran++
+			if err != nil {
+				failed++
 			}
+			mu.Unlock()
 		}(mgr)
 	}
 	wg.Wait()
+	if fullTree {
+		paths = nil
+	}
+	neededPaths = paths
+	return ran, failed
+}
+
+// teardowner is implemented by managers that hold resources beyond set(),
+// such as listeners, to release them when the agent stops or the manager is
+// disabled through the control pipe.
+type teardowner interface {
+	teardown(ctx context.Context) error
+}
+
+// teardownTimeout bounds teardownManagers, on top of the wsfc drain period.
+var teardownTimeout = 10 * time.Second
+
+// teardownManagers tears down the managers of sections that implement
+// teardowner, every one if sections is nil.
+func teardownManagers(cfg *ini.File, sections []string) {
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), teardownTimeout+wsfcDrainPeriod(cfg))
+	defer cancel()
+	for _, mgr := range newManagers(&metadataJSON{}, &metadataJSON{}, cfg) {
+		t, ok := mgr.manager.(teardowner)
+		if !ok || (sections != nil && !containsString(mgr.section, sections)) {
+			continue
+		}
+		if err := t.teardown(ctx); err != nil {
+			logger.Errorf("Error tearing down %s manager: %v", mgr.section, err)
+		}
+	}
+}
+
+// dryRunFlag is set by noservice --dry-run.
+var dryRunFlag bool
+
+// dryRun reports whether managers should only log the changes they would
+// make, set by --dry-run or [core] dry_run.
+func dryRun(cfg *ini.File) bool {
+	return cfg.Section("core").Key("dry_run").MustBool(dryRunFlag)
+}
+
+// planner is implemented by managers that can describe the changes set()
+// would make, for dry runs.
+type planner interface {
+	plan() ([]string, error)
+}
+
+// managerPlanner returns the planner of mgr, looking through the wrappers
+// added by runUpdate.
+func managerPlanner(mgr manager) (planner, bool) {
+	switch m := mgr.(type) {
+	case fingerprintDiff:
+		return managerPlanner(m.manager)
+	case tracedManager:
+		return managerPlanner(m.manager)
+	}
+	p, ok := mgr.(planner)
+	return p, ok
+}
+
+// logPlan logs the changes mgr would make in place of running set(). Every
+// manager of the agent and every plugin can plan.
+func logPlan(mgr namedManager) error {
+	p, ok := managerPlanner(mgr.manager)
+	if !ok {
+		logger.Infof("Dry run: %s would apply changes.", mgr.section)
+		return nil
+	}
+	changes, err := p.plan()
+	if err != nil {
+		return fmt.Errorf("error planning %s changes: %v", mgr.section, err)
+	}
+	if len(changes) == 0 {
+		logger.Infof("Dry run: %s would make no changes.", mgr.section)
+	}
+	for _, c := range changes {
+		logger.Infof("Dry run: %s would %s.", mgr.section, c)
+	}
+	return nil
+}
+
+// managerTimeout returns how long a manager's set() may run, its section's
+// timeout_sec or [core] manager_timeout_sec. 0 or less means no timeout.
+func managerTimeout(cfg *ini.File, section string) time.Duration {
+	sec := cfg.Section("core").Key("manager_timeout_sec").MustInt(600)
+	sec = cfg.Section(section).Key("timeout_sec").MustInt(sec)
+	return time.Duration(sec) * time.Second
+}
+
+// runSettings are the config values runSet uses. runManagers reads them
+// before the managers run in parallel, as reading an unset key with a default
+// writes the default into the shared config.
+type runSettings struct {
+	dryRun         bool
+	reportStatus   bool
+	failureIsFatal bool
+	timeout        time.Duration
+}
+
+func managerRunSettings(cfg *ini.File, section string) runSettings {
+	return runSettings{
+		dryRun:         dryRun(cfg),
+		reportStatus:   guestAttributesEnabled(cfg),
+		failureIsFatal: cfg.Section(section).Key("failure_is_fatal").MustBool(false),
+		timeout:        managerTimeout(cfg, section),
+	}
+}
+
+var (
+	// runningSets are the sections whose set() has not returned yet, which
+	// outlives runSet when set() runs past its timeout.
+	runningSets   = make(map[string]bool)
+	runningSetsMu sync.Mutex
+)
+
+// markRunning records whether the set() of section is running, it returns
+// false if it already was.
+func markRunning(section string, running bool) bool {
+	runningSetsMu.Lock()
+	defer runningSetsMu.Unlock()
+	if running && runningSets[section] {
+		return false
+	}
+	if running {
+		runningSets[section] = true
+	} else {
+		delete(runningSets, section)
+	}
+	return true
+}
+
+// runSet applies a manager and records its state. In a dry run it only logs
+// the changes the manager would make. A failure stops the agent if
+// failure_is_fatal is set in the manager's config section. A manager that
+// runs past its timeout fails and has its context cancelled, so a hung
+// command doesn't block the other managers. Until that set() returns the
+// manager is skipped, so it never runs twice at once or after updateMu is
+// released to another update.
+func runSet(ctx context.Context, cfg *ini.File, mgr namedManager, s runSettings) error {
+	if s.dryRun {
+		err := logPlan(mgr)
+		if err != nil {
+			logger.Error(err)
+		}
+		return err
+	}
+	if !markRunning(mgr.section, true) {
+		err := fmt.Errorf("%s is still running from an earlier update, skipping it", mgr.section)
+		logger.Error(err)
+		return err
+	}
+	var cancel context.CancelFunc
+	if s.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	errc := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		err := mgr.set(ctx)
+		markRunning(mgr.section, false)
+		errc <- err
+	}()
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		err = fmt.Errorf("%s did not finish within %s, skipping it", mgr.section, s.timeout)
+	}
+	managerRunSeconds.observe(mgr.section, time.Since(start).Seconds())
+	if s.reportStatus {
+		reportManagerStatus(cfg, mgr.section, err)
+	}
+	if err == nil {
+		recordState(cfg, mgr.section, stateSucceeded)
+		return nil
+	}
+	recordState(cfg, mgr.section, stateFailed)
+	managerFailures.inc(mgr.section)
+	if s.failureIsFatal {
+		logFatal(fmt.Sprintf("%s failed and failure_is_fatal is set: %v", mgr.section, err))
+		return err
+	}
+	logger.Error(err)
+	return err
+}
+
+// settleSleep is replaced in tests.
+var settleSleep = sleepCtx
+
+// bootSettler delays the first update cycle by [core] boot_settle_sec so
+// managers do not run while Windows is still starting services.
+type bootSettler struct {
+	done bool
+}
+
+// wait sleeps before the first update only, it returns false if ctx is done
+// first.
+func (b *bootSettler) wait(ctx context.Context, cfg *ini.File) bool {
+	if b.done {
+		return true
+	}
+	b.done = true
+	d := time.Duration(cfg.Section("core").Key("boot_settle_sec").MustInt(0)) * time.Second
+	if d <= 0 {
+		return true
+	}
+	logger.Infof("Waiting %s for the system to settle before the first update.", d)
+	return settleSleep(ctx, d)
 }
 
 func run(ctx context.Context) {
+	cl := startCloudLogging(ctx, loadConfig())
 	logger.Infof("GCE Agent Started (version %s)", version)
+	if err := restoreAgentState(); err != nil {
+		logger.Errorln("Error restoring agent state:", err)
+	}
+	if err := loadAppliedState(); err != nil {
+		logger.Errorln("Error loading applied state:", err)
+	}
+	go eventWorker(ctx)
+	restorePendingReboot(loadConfig())
+	go auditLoop(ctx)
+	go maintenanceHookWorker(ctx)
+	go osLoginLoop(ctx)
+	go accountExpiryLoop(ctx)
+	go certRotationLoop(ctx, "rdpCert", &rdpCertSchedule)
+	go certRotationLoop(ctx, "winrm", &winrmCertSchedule)
+	go certRotationLoop(ctx, "activation", &activationSchedule)
+	go diagnosticsScheduleLoop(ctx)
+	go updateLoop(ctx)
+	go snapshotLoop(ctx)
+	go diskExtendLoop(ctx)
+	go peerMonitorLoop(ctx)
+	go inventoryLoop(ctx)
+	if cfg := loadConfig(); scriptsEnabled(cfg) {
+		go runStartupScripts(ctx, cfg)
+	}
+	// Reports the restored pending reboot, or clears one reported before the
+	// system rebooted.
+	reportPendingReboot(loadConfig(), getPendingReboot())
+	if addr, err := statusAddress(loadConfig()); err != nil {
+		logger.Error(err)
+	} else if addr != "" {
+		go serveStatus(ctx, addr)
+	}
+	if controlPipeEnabled(loadConfig()) {
+		go serveControlPipe(ctx)
+	}
+	if addr, err := metricsAddress(loadConfig()); err != nil {
+		logger.Error(err)
+	} else if addr != "" {
+		go serveMetrics(ctx, addr)
+	}
+
+	var sections []string
+	for _, mgr := range newManagers(&metadataJSON{}, &metadataJSON{}, loadConfig()) {
+		sections = append(sections, mgr.section)
+	}
+	independentSections = parseIndependentWatch(loadConfig(), sections)
+	if path := metadataFile(loadConfig()); path != "" && len(independentSections) != 0 {
+		logger.Infof("Ignoring independent_watch, metadata is read from %s.", path)
+		independentSections = nil
+	}
+	for _, section := range independentSections {
+		logger.Infof("Running %s from its own metadata watch.", section)
+		go independentWatch(ctx, section, buildSection(section))
+	}
+
+	go watchConfig(ctx, func() { reapplyConfig(ctx) })
+
+	backoff := newFetchBackoff(minFetchBackoff, maxFetchBackoff, defaultFetchJitter)
+	if loadConfig().Section("metadata").Key("watch_network_changes").MustBool(false) {
+		go watchNetworkChanges(ctx, backoff)
+	}
 
 	go func() {
 		var oldMetadata metadataJSON
-		webError := 0
+		var oldFingerprint metadataFingerprint
+		var settler bootSettler
+		var failures watchFailures
+		reconciled, healthy := false, false
 		for {
-			newMetadata, err := watchMetadata(ctx)
+			cfg := loadConfig()
+			backoff.configure(cfg)
+			start := time.Now()
+			newMetadata, err := watchMetadata(ctx, cfg)
+			metadataWatchSeconds.observe("", time.Since(start).Seconds())
 			if err != nil {
-				// Only log the second web error to avoid transient errors and
-				// not to spam the log on network failures.
-				if webError == 1 {
-					if urlErr, ok := err.(*url.Error); ok {
-						if _, ok := urlErr.Err.(*net.DNSError); ok {
-							logger.Error("DNS error when requesting metadata, check DNS settings and ensure metadata.internal.google is setup in your hosts file.")
-						}
-						if _, ok := urlErr.Err.(*net.OpError); ok {
-							logger.Error("Network error when requesting metadata, make sure your instance has an active network and can reach the metadata server.")
-						}
-					}
-					logger.Error(err)
+				metadataWatchErrors.inc("")
+				failures.failed(cfg, err)
+				if !backoff.wait(ctx) {
+					return
 				}
-				webError++
-				time.Sleep(5 * time.Second)
 				continue
 			}
+			backoff.reset()
+			failures.succeeded()
 			select {
 			case <-ctx.Done():
 				return
 			default:
 			}
-			runUpdate(newMetadata, &oldMetadata)
-			oldMetadata = *newMetadata
-			webError = 0
+			if err := verifyMetadata(newMetadata, cfg); err != nil {
+				logger.Errorln("Not applying metadata:", err)
+				continue
+			}
+			setConfigOverlay(newMetadata, cfg)
+			handleTerminationNotice(ctx, cfg, newMetadata, cl)
+			handleMaintenanceEvent(ctx, cfg, newMetadata)
+			if !settler.wait(ctx, cfg) {
+				return
+			}
+			if !reconciled {
+				oldFingerprint = reconcileAppliedState(cfg, newMetadata, &oldMetadata)
+				reconciled = true
+			}
+			if hashDiffMode(cfg) {
+				fp := fingerprintMetadata(newMetadata)
+				// Always non-nil so runUpdate diffs in hash mode.
+				changed := append([]string{}, changedKeys(oldFingerprint, fp)...)
+				if runUpdate(ctx, newMetadata, newMetadata, changed) {
+					oldMetadata, oldFingerprint = metadataJSON{}, fp
+				}
+			} else if runUpdate(ctx, newMetadata, &oldMetadata, nil) {
+				oldMetadata, oldFingerprint = *newMetadata, nil
+			}
+			if !healthy {
+				markAgentHealthy()
+				healthy = true
+			}
 		}
 	}()
 
 	<-ctx.Done()
+	teardownManagers(loadConfig(), nil)
+	if cfg := loadConfig(); scriptsEnabled(cfg) && isSystemShutdown() {
+		if err := runScripts(context.Background(), cfg, "shutdown"); err != nil {
+			logger.Errorf("Error running shutdown scripts: %v", err)
+		}
+	}
+	if err := saveAgentState(); err != nil {
+		logger.Errorln("Error saving agent state:", err)
+	}
 	logger.Info("GCE Agent Stopped")
+	cl.wait()
 }
 
 func containsString(s string, ss []string) bool {
@@ -168,9 +769,56 @@ func containsString(s string, ss []string) bool {
 	return false
 }
 
+// missingIsRemove reports whether managers should treat metadata keys that
+// are absent as an empty desired state, per [core] treat_missing_as. The
+// default, ignore, leaves previously applied state untouched so partial
+// metadata never wipes configuration.
+func missingIsRemove(cfg *ini.File) bool {
+	switch policy := cfg.Section("core").Key("treat_missing_as").String(); policy {
+	case "", "ignore":
+		return false
+	case "remove":
+		return true
+	default:
+		logger.Errorf("Invalid treat_missing_as %q, using ignore", policy)
+		return false
+	}
+}
+
+// consoleLogging reports whether log output should also be written to
+// stdout. This is only ever done when running interactively, never under the
+// service manager.
+func consoleLogging(cfg *ini.File, interactive bool) bool {
+	if !interactive {
+		return false
+	}
+	return cfg.Section("core").Key("console_logging").MustBool(true)
+}
+
 func main() {
 	ctx := context.Background()
 	logger.Init("GCEWindowsAgent", "COM1")
+	cfg := loadConfig()
+	logger.SetSerialPort(serialLogPort(cfg))
+	if err := logger.SetFormat(cfg.Section("core").Key("log_format").String()); err != nil {
+		logger.Error(err)
+	}
+	if err := logger.SetLevel(cfg.Section("core").Key("log_level").String()); err != nil {
+		logger.Error(err)
+	}
+	logger.SetRepeatWindow(time.Duration(cfg.Section("core").Key("log_repeat_window_sec").MustInt(60)) * time.Second)
+	if path := cfg.Section("core").Key("log_file").String(); path != "" {
+		maxSize := int64(cfg.Section("core").Key("log_file_max_mb").MustInt(10)) << 20
+		fb, err := logger.NewFileBackend(path, maxSize, cfg.Section("core").Key("log_file_max_files").MustInt(3))
+		if err != nil {
+			logger.Errorf("Error opening log file: %v", err)
+		} else {
+			logger.AddBackend(fb)
+		}
+	}
+	if consoleLogging(cfg, service.Interactive()) {
+		logger.Log.SetOutput(io.MultiWriter(logger.Log.Writer(), os.Stdout))
+	}
 
 	var action string
 	if len(os.Args) < 2 {
@@ -178,7 +826,32 @@ func main() {
 	} else {
 		action = os.Args[1]
 	}
+	if _, ok := controlCommands[action]; ok {
+		if err := runControlCommand(action, os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if action == "run-scripts" {
+		if err := runScriptsCommand(ctx, os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if action == "validate-config" {
+		if !validateConfig(ctx, os.Stdout) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
 	if action == "noservice" {
+		if containsString("--debug", os.Args[2:]) {
+			logger.SetLevel("debug")
+		}
+		dryRunFlag = containsString("--dry-run", os.Args[2:])
+		metadataFileFlag = flagValue(os.Args[2:], "--metadata-file")
 		run(ctx)
 		os.Exit(0)
 	}
@@ -14,7 +14,30 @@
 
 package main
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+func TestMain(m *testing.M) {
+	// Managers report their status to guest attributes, keep tests from
+	// talking to a real metadata server. Tests that need one start their own,
+	// tests that check the writes replace putGuestAttribute.
+	metadataServer = "http://127.0.0.1:0/computeMetadata/v1"
+	putGuestAttribute = func(*ini.File, string, string) error { return nil }
+	os.Exit(m.Run())
+}
 
 func TestContainsString(t *testing.T) {
 	table := []struct {
@@ -31,3 +54,446 @@ func TestContainsString(t *testing.T) {
 		}
 	}
 }
+
+type fakeManager struct {
+	isDisabled, isDiff bool
+	err                error
+	paths              []string
+	sets               int
+}
+
+func (f *fakeManager) diff() bool     { return f.isDiff }
+func (f *fakeManager) disabled() bool { return f.isDisabled }
+
+func (f *fakeManager) set(ctx context.Context) error {
+	f.sets++
+	return f.err
+}
+
+func (f *fakeManager) metadataPaths() []string { return f.paths }
+
+func TestRunManagersFailureIsFatal(t *testing.T) {
+	var mu sync.Mutex
+	var fatal []string
+	oldLogFatal := logFatal
+	defer func() { logFatal = oldLogFatal }()
+	logFatal = func(v ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		fatal = append(fatal, v[0].(string))
+	}
+
+	cfg, err := ini.InsensitiveLoad([]byte("[accountManager]\nfailure_is_fatal=true"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name      string
+		section   string
+		mgr       *fakeManager
+		wantFatal bool
+	}{
+		{"marked manager fails", "accountManager", &fakeManager{isDiff: true, err: errors.New("fail")}, true},
+		{"unmarked manager fails", "addressManager", &fakeManager{isDiff: true, err: errors.New("fail")}, false},
+		{"marked manager succeeds", "accountManager", &fakeManager{isDiff: true}, false},
+		{"marked manager disabled", "accountManager", &fakeManager{isDisabled: true, isDiff: true, err: errors.New("fail")}, false},
+	}
+
+	for _, tt := range tests {
+		fatal = nil
+		runManagers(context.Background(), cfg, []namedManager{{tt.section, tt.mgr}})
+		if got := len(fatal) != 0; got != tt.wantFatal {
+			t.Errorf("test case %q: fatal got: %t, want: %t", tt.name, got, tt.wantFatal)
+		}
+	}
+}
+
+// hangingManager blocks in set() until released, like a hung command.
+type hangingManager struct {
+	fakeManager
+	release chan struct{}
+}
+
+func (h *hangingManager) set(ctx context.Context) error {
+	<-h.release
+	return nil
+}
+
+func TestManagerTimeout(t *testing.T) {
+	var tests = []struct {
+		data []byte
+		want time.Duration
+	}{
+		{[]byte(""), 10 * time.Minute},
+		{[]byte("[core]\nmanager_timeout_sec=60"), time.Minute},
+		{[]byte("[core]\nmanager_timeout_sec=60\n[addressManager]\ntimeout_sec=5"), 5 * time.Second},
+		{[]byte("[accountManager]\ntimeout_sec=5"), 10 * time.Minute},
+		{[]byte("[addressManager]\ntimeout_sec=0"), 0},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := managerTimeout(cfg, "addressManager"); got != tt.want {
+			t.Errorf("managerTimeout(%q) got: %s, want: %s", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestRunManagersTimeout(t *testing.T) {
+	cfg, err := ini.InsensitiveLoad([]byte("[hung]\ntimeout_sec=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hung := &hangingManager{fakeManager{isDiff: true}, make(chan struct{})}
+	defer close(hung.release)
+	other := &fakeManager{isDiff: true}
+
+	done := make(chan struct{})
+	var ran, failed int
+	go func() {
+		ran, failed = runManagers(context.Background(), cfg, []namedManager{{"hung", hung}, {"other", other}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("runManagers() blocked on a hung manager")
+	}
+	if ran != 2 || failed != 1 {
+		t.Errorf("runManagers() got ran %d, failed %d, want 2, 1", ran, failed)
+	}
+	if other.sets != 1 {
+		t.Errorf("other manager set %d times, want 1", other.sets)
+	}
+
+	// The hung set() is still running, so the next update skips it.
+	ran, failed = runManagers(context.Background(), cfg, []namedManager{{"hung", hung}})
+	if ran != 1 || failed != 1 {
+		t.Errorf("runManagers() with a running set got ran %d, failed %d, want 1, 1", ran, failed)
+	}
+}
+
+// plannedManager is a fakeManager that can describe its changes.
+type plannedManager struct {
+	fakeManager
+	changes []string
+	plans   int
+}
+
+func (p *plannedManager) plan() ([]string, error) {
+	p.plans++
+	return p.changes, nil
+}
+
+func TestRunManagersDryRun(t *testing.T) {
+	var tests = []struct {
+		name string
+		data []byte
+		flag bool
+		want bool
+	}{
+		{"off", []byte(""), false, false},
+		{"config", []byte("[core]\ndry_run=true"), false, true},
+		{"flag", []byte(""), true, true},
+		{"config overrides flag", []byte("[core]\ndry_run=false"), true, false},
+	}
+
+	oldFlag := dryRunFlag
+	defer func() { dryRunFlag = oldFlag }()
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dryRunFlag = tt.flag
+		planned := &plannedManager{fakeManager: fakeManager{isDiff: true}, changes: []string{"add forwarded IP 1.2.3.4 to 42:01:0a:00:00:02"}}
+		unplanned := &fakeManager{isDiff: true}
+		mgrs := []namedManager{{"planned", fingerprintDiff{planned, nil}}, {"unplanned", unplanned}}
+		runManagers(context.Background(), cfg, mgrs)
+		if got := planned.sets == 0 && unplanned.sets == 0; got != tt.want {
+			t.Errorf("test case %q: set skipped got: %t, want: %t", tt.name, got, tt.want)
+		}
+		if got := planned.plans == 1; got != tt.want {
+			t.Errorf("test case %q: plan called got: %t, want: %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRunManagersNeededPaths(t *testing.T) {
+	var tests = []struct {
+		name string
+		mgrs []namedManager
+		want []string
+	}{
+		{"attributes only", []namedManager{{"a", &fakeManager{paths: attributePaths}}}, attributePaths},
+		{"extra path", []namedManager{
+			{"a", &fakeManager{paths: attributePaths}},
+			{"b", &fakeManager{paths: []string{"instance/network-interfaces"}}},
+		}, append(append([]string(nil), attributePaths...), "instance/network-interfaces")},
+		{"disabled manager is ignored", []namedManager{
+			{"a", &fakeManager{paths: attributePaths}},
+			{"b", &fakeManager{isDisabled: true, paths: []string{"instance/network-interfaces"}}},
+		}, attributePaths},
+		{"full tree", []namedManager{
+			{"a", &fakeManager{paths: attributePaths}},
+			{"b", &fakeManager{}},
+		}, nil},
+	}
+
+	for _, tt := range tests {
+		runManagers(context.Background(), ini.Empty(), tt.mgrs)
+		if !reflect.DeepEqual(neededPaths, tt.want) {
+			t.Errorf("test case %q: neededPaths got: %q, want: %q", tt.name, neededPaths, tt.want)
+		}
+	}
+	neededPaths = nil
+}
+
+func TestConsoleLogging(t *testing.T) {
+	var tests = []struct {
+		name        string
+		data        []byte
+		interactive bool
+		want        bool
+	}{
+		{"interactive", []byte(""), true, true},
+		{"service", []byte(""), false, false},
+		{"interactive, disabled in cfg", []byte("[Core]\nconsole_logging=false"), true, false},
+		{"service, enabled in cfg", []byte("[Core]\nconsole_logging=true"), false, false},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.data)
+		if err != nil {
+			t.Errorf("test case %q: error parsing config: %v", tt.name, err)
+			continue
+		}
+		if got := consoleLogging(cfg, tt.interactive); got != tt.want {
+			t.Errorf("test case %q, consoleLogging() got: %t, want: %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSerialLogPort(t *testing.T) {
+	var tests = []struct {
+		data []byte
+		want string
+	}{
+		{[]byte(""), "COM1"},
+		{[]byte("[Core]\nserial_port=COM2"), "COM2"},
+		{[]byte("[core]\nserial_port=none"), "none"},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.data)
+		if err != nil {
+			t.Fatalf("error parsing config %q: %v", tt.data, err)
+		}
+		if got := serialLogPort(cfg); got != tt.want {
+			t.Errorf("serialLogPort(%q) got: %q, want: %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+type fakeSerialPort struct {
+	writes [][]byte
+	closed bool
+}
+
+func (f *fakeSerialPort) Write(b []byte) (int, error) {
+	f.writes = append(f.writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (f *fakeSerialPort) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestWriteSerialChunks(t *testing.T) {
+	oldOpen, oldMax, oldDelay := openSerial, serialMaxWrite, serialChunkDelay
+	defer func() { openSerial, serialMaxWrite, serialChunkDelay = oldOpen, oldMax, oldDelay }()
+	serialChunkDelay = 0
+
+	var tests = []struct {
+		msgLen, max, wantWrites int
+	}{
+		{10, 100, 1},
+		{100, 100, 1},
+		{101, 100, 2},
+		{1000, 100, 10},
+		{1000, 0, 1},
+	}
+
+	for _, tt := range tests {
+		port := &fakeSerialPort{}
+		openSerial = func(string) (io.WriteCloser, error) { return port, nil }
+		serialMaxWrite = int64(tt.max)
+
+		msg := bytes.Repeat([]byte("a"), tt.msgLen)
+		if err := writeSerial("COM1", msg); err != nil {
+			t.Fatalf("writeSerial() returned error: %v", err)
+		}
+		if len(port.writes) != tt.wantWrites {
+			t.Errorf("writeSerial() of %d bytes with max %d: got %d writes, want %d", tt.msgLen, tt.max, len(port.writes), tt.wantWrites)
+		}
+		if got := bytes.Join(port.writes, nil); !bytes.Equal(got, msg) {
+			t.Errorf("writeSerial() wrote %q, want %q", got, msg)
+		}
+		if !port.closed {
+			t.Error("writeSerial() did not close the port")
+		}
+	}
+}
+
+func TestWriteSerialNone(t *testing.T) {
+	oldOpen := openSerial
+	defer func() { openSerial = oldOpen }()
+	openSerial = func(string) (io.WriteCloser, error) {
+		t.Fatal("writeSerial() opened a port for none")
+		return nil, nil
+	}
+
+	if err := writeSerial("none", []byte("msg")); err != nil {
+		t.Errorf("writeSerial() returned error: %v", err)
+	}
+}
+
+func TestMergeRegistryConfig(t *testing.T) {
+	oldRead := readRegConfig
+	defer func() { readRegConfig = oldRead }()
+	readRegConfig = func() ([]string, error) {
+		return []string{
+			"accountManager.disable=true",
+			"addressManager.disable = true",
+			"Core.treat_missing_as=remove",
+			"bad entry",
+			".nosection=1",
+		}, nil
+	}
+
+	cfg, err := ini.InsensitiveLoad([]byte("[addressManager]\ndisable=false\n[core]\nconsole_logging=false"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mergeRegistryConfig(cfg)
+
+	var tests = []struct {
+		section, key, want string
+	}{
+		// Only in the registry.
+		{"accountManager", "disable", "true"},
+		{"core", "treat_missing_as", "remove"},
+		// The config file takes precedence.
+		{"addressManager", "disable", "false"},
+		// Only in the config file.
+		{"core", "console_logging", "false"},
+		{"", "nosection", ""},
+	}
+
+	for _, tt := range tests {
+		if got := cfg.Section(tt.section).Key(tt.key).String(); got != tt.want {
+			t.Errorf("[%s] %s got: %q, want: %q", tt.section, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestBootSettler(t *testing.T) {
+	oldSleep := settleSleep
+	defer func() { settleSleep = oldSleep }()
+
+	var tests = []struct {
+		name string
+		data []byte
+		want []time.Duration
+	}{
+		{"not set", []byte(""), nil},
+		{"set", []byte("[Core]\nboot_settle_sec=30"), []time.Duration{30 * time.Second}},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var slept []time.Duration
+		settleSleep = func(ctx context.Context, d time.Duration) bool {
+			slept = append(slept, d)
+			return true
+		}
+
+		var b bootSettler
+		for i := 0; i < 3; i++ {
+			if !b.wait(context.Background(), cfg) {
+				t.Errorf("test case %q: wait() returned false", tt.name)
+			}
+		}
+		// Only the first cycle is delayed.
+		if !reflect.DeepEqual(slept, tt.want) {
+			t.Errorf("test case %q: slept got: %v, want: %v", tt.name, slept, tt.want)
+		}
+	}
+}
+
+func TestParseConfigDropIns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "instance_configs.cfg")
+
+	// Without the file or drop-ins the error is returned.
+	if _, err := parseConfig(file); !os.IsNotExist(err) {
+		t.Errorf("parseConfig() with no config got error: %v, want not exist", err)
+	}
+
+	if err := os.Mkdir(file+".d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"instance_configs.cfg":          "[accountManager]\ndisable=true\n[core]\naudit_interval_sec=60",
+		"instance_configs.cfg.d/20.cfg": "[accountManager]\ndisable=false\n[addressManager]\ndisable=true",
+		"instance_configs.cfg.d/10.cfg": "[addressManager]\ndisable=false\n[Core]\naudit_interval_sec=30",
+		// Only *.cfg files are read.
+		"instance_configs.cfg.d/30.cfg.bak": "[accountManager]\ndisable=bak",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg, err := parseConfig(file)
+	if err != nil {
+		t.Fatalf("parseConfig() returned error: %v", err)
+	}
+	var tests = []struct {
+		section, key, want string
+	}{
+		{"accountManager", "disable", "false"},
+		{"addressManager", "disable", "true"},
+		{"core", "audit_interval_sec", "30"},
+	}
+	for _, tt := range tests {
+		if got := cfg.Section(tt.section).Key(tt.key).String(); got != tt.want {
+			t.Errorf("[%s] %s got: %q, want: %q", tt.section, tt.key, got, tt.want)
+		}
+	}
+
+	// Drop-ins are used without the base file.
+	if err := os.Remove(file); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = parseConfig(file)
+	if err != nil {
+		t.Fatalf("parseConfig() without the base file returned error: %v", err)
+	}
+	if got := cfg.Section("accountManager").Key("disable").String(); got != "false" {
+		t.Errorf("[accountManager] disable without the base file got: %q, want: %q", got, "false")
+	}
+}
@@ -0,0 +1,216 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// Event log IDs of maintenance event transitions, so workloads can subscribe
+// to them.
+const (
+	eventMigrationStarted   = 100
+	eventMigrationCompleted = 101
+	eventTerminationNotice  = 102
+)
+
+var (
+	// lastMaintenanceEvent is the maintenance-event value of the last
+	// metadata update.
+	lastMaintenanceEvent = "NONE"
+	// maintenanceHooks queues hook runs for maintenanceHookWorker, which
+	// runs them one at a time in the order of the transitions.
+	maintenanceHooks = make(chan maintenanceHookRun, 16)
+)
+
+// maintenanceHookRun is one queued run of [maintenance] hook.
+type maintenanceHookRun struct {
+	hook, event, phase string
+	timeout            time.Duration
+}
+
+// migrationPause pauses a network manager while the instance is live
+// migrated, as network state is unstable, and has it reconcile everything
+// once the migration completes. diff only reads it, set records it, so a
+// dry run or an audit does not change it.
+type migrationPause struct {
+	// section holds pause_during_migration, which defaults to true.
+	section string
+	name    string
+
+	mu     sync.Mutex
+	paused bool
+}
+
+var (
+	addressPause = &migrationPause{section: "addressManager", name: "address"}
+	mtuPause     = &migrationPause{section: "mtu", name: "MTU"}
+	dnsPause     = &migrationPause{section: "dns", name: "DNS"}
+)
+
+// migrating reports whether the manager is to pause for a live migration.
+func (p *migrationPause) migrating(md *metadataJSON, cfg *ini.File) bool {
+	return md.Instance.migrating() && cfg.Section(p.section).Key("pause_during_migration").MustBool(true)
+}
+
+// diff returns the diff of a manager while migrating, a change until set
+// records the pause, or once the migration completes, a change until set
+// reconciles. ok is false when the pause does not decide the diff.
+func (p *migrationPause) diff(migrating bool) (changed, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case migrating:
+		return !p.paused, true
+	case p.paused:
+		return true, true
+	}
+	return false, false
+}
+
+// skip is called at the start of set, it records the pause and reports
+// whether set must not change anything.
+func (p *migrationPause) skip(migrating bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if migrating && !p.paused {
+		logger.Infof("Live migration in progress, pausing %s manager.", p.name)
+		p.paused = true
+	}
+	return migrating
+}
+
+// done is called at the end of set, a successful set after the migration
+// ends the pause.
+func (p *migrationPause) done(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil && p.paused {
+		logger.Infof("Live migration complete, resumed %s manager.", p.name)
+		p.paused = false
+	}
+}
+
+// maintenanceEnabled reports whether [maintenance] enable is set.
+func maintenanceEnabled(cfg *ini.File) bool {
+	return cfg.Section("maintenance").Key("enable").MustBool(false)
+}
+
+// maintenancePaths returns the metadata path of the maintenance event, so it
+// is watched when no manager uses it.
+func maintenancePaths(cfg *ini.File) []string {
+	if !maintenanceEnabled(cfg) {
+		return nil
+	}
+	return []string{"instance/maintenance-event"}
+}
+
+// maintenanceTransition returns the event ID and phase of a change of the
+// maintenance-event value from old to new, ok is false if there is nothing
+// to report.
+func maintenanceTransition(old, new string) (id uint32, phase string, ok bool) {
+	if old == new {
+		return 0, "", false
+	}
+	switch new {
+	case "MIGRATE_ON_HOST_MAINTENANCE":
+		return eventMigrationStarted, "start", true
+	case "TERMINATE_ON_HOST_MAINTENANCE":
+		return eventTerminationNotice, "terminate", true
+	case "NONE":
+		if old == "MIGRATE_ON_HOST_MAINTENANCE" {
+			return eventMigrationCompleted, "complete", true
+		}
+	}
+	return 0, "", false
+}
+
+// handleMaintenanceEvent logs maintenance-event transitions to the event log
+// with their own event IDs and runs [maintenance] hook for them.
+func handleMaintenanceEvent(ctx context.Context, cfg *ini.File, md *metadataJSON) {
+	event := md.Instance.MaintenanceEvent
+	if !maintenanceEnabled(cfg) || event == "" {
+		// Not fetched, such as in subtree mode without the path.
+		return
+	}
+	old := lastMaintenanceEvent
+	lastMaintenanceEvent = event
+	id, phase, ok := maintenanceTransition(old, event)
+	if !ok {
+		return
+	}
+	switch id {
+	case eventMigrationStarted:
+		logger.InfoEventf(id, "Live migration started.")
+	case eventMigrationCompleted:
+		logger.InfoEventf(id, "Live migration completed.")
+	case eventTerminationNotice:
+		logger.InfoEventf(id, "Instance is stopping for host maintenance.")
+	}
+
+	hook := cfg.Section("maintenance").Key("hook").String()
+	if hook == "" {
+		return
+	}
+	if dryRun(cfg) {
+		logger.Infof("Dry run: would run maintenance hook %s for %s.", hook, phase)
+		return
+	}
+	timeout := time.Duration(cfg.Section("maintenance").Key("hook_timeout_sec").MustInt(60)) * time.Second
+	select {
+	case maintenanceHooks <- maintenanceHookRun{hook, event, phase, timeout}:
+	default:
+		logger.Errorf("Not running maintenance hook %s for %s, too many runs are queued.", hook, phase)
+	}
+}
+
+// maintenanceHookWorker runs the queued maintenance hooks until ctx is done,
+// so a slow hook never blocks the metadata watcher.
+func maintenanceHookWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case r := <-maintenanceHooks:
+			if err := runMaintenanceHook(ctx, r.hook, r.event, r.phase, r.timeout); err != nil {
+				logger.Error(err)
+			}
+		}
+	}
+}
+
+// runMaintenanceHook runs hook with the maintenance event and phase in the
+// GCE_MAINTENANCE_EVENT and GCE_MAINTENANCE_PHASE environment variables.
+func runMaintenanceHook(ctx context.Context, hook, event, phase string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	logger.Infof("Running maintenance hook %s for %s.", hook, phase)
+	c := scriptCommand(ctx, hook)
+	c.Env = append(os.Environ(), "GCE_MAINTENANCE_EVENT="+event, "GCE_MAINTENANCE_PHASE="+phase)
+	if err := runScriptCmd(c, "maintenance hook"); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("maintenance hook %s did not finish within %s", hook, timeout)
+		}
+		return fmt.Errorf("error running maintenance hook %s: %v", hook, err)
+	}
+	return nil
+}
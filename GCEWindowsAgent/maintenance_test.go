@@ -0,0 +1,136 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+func TestMaintenanceTransition(t *testing.T) {
+	var tests = []struct {
+		old, new  string
+		wantID    uint32
+		wantPhase string
+		wantOK    bool
+	}{
+		{"NONE", "NONE", 0, "", false},
+		{"NONE", "MIGRATE_ON_HOST_MAINTENANCE", eventMigrationStarted, "start", true},
+		{"MIGRATE_ON_HOST_MAINTENANCE", "MIGRATE_ON_HOST_MAINTENANCE", 0, "", false},
+		{"MIGRATE_ON_HOST_MAINTENANCE", "NONE", eventMigrationCompleted, "complete", true},
+		{"NONE", "TERMINATE_ON_HOST_MAINTENANCE", eventTerminationNotice, "terminate", true},
+		{"TERMINATE_ON_HOST_MAINTENANCE", "NONE", 0, "", false},
+	}
+
+	for _, tt := range tests {
+		id, phase, ok := maintenanceTransition(tt.old, tt.new)
+		if id != tt.wantID || phase != tt.wantPhase || ok != tt.wantOK {
+			t.Errorf("maintenanceTransition(%q, %q) = %d, %q, %t, want %d, %q, %t", tt.old, tt.new, id, phase, ok, tt.wantID, tt.wantPhase, tt.wantOK)
+		}
+	}
+}
+
+func TestHandleMaintenanceEvent(t *testing.T) {
+	oldRun := runScriptCmd
+	defer func() {
+		runScriptCmd = oldRun
+		lastMaintenanceEvent = "NONE"
+	}()
+	ran := make(chan []string, 10)
+	runScriptCmd = func(c *exec.Cmd, name string) error {
+		var env []string
+		for _, e := range c.Env {
+			if strings.HasPrefix(e, "GCE_MAINTENANCE_") {
+				env = append(env, e)
+			}
+		}
+		ran <- env
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go maintenanceHookWorker(ctx)
+
+	cfg, err := ini.InsensitiveLoad([]byte("[maintenance]\nenable=true\nhook=C:\\pause.cmd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrate := &metadataJSON{Instance: instanceJSON{MaintenanceEvent: "MIGRATE_ON_HOST_MAINTENANCE"}}
+	none := &metadataJSON{Instance: instanceJSON{MaintenanceEvent: "NONE"}}
+	var tests = []struct {
+		name    string
+		cfg     *ini.File
+		md      *metadataJSON
+		wantEnv []string
+	}{
+		{"disabled", ini.Empty(), migrate, nil},
+		{"no event", cfg, none, nil},
+		{"migration started", cfg, migrate, []string{"GCE_MAINTENANCE_EVENT=MIGRATE_ON_HOST_MAINTENANCE", "GCE_MAINTENANCE_PHASE=start"}},
+		{"same event", cfg, migrate, nil},
+		{"not fetched", cfg, &metadataJSON{}, nil},
+		{"migration completed", cfg, none, []string{"GCE_MAINTENANCE_EVENT=NONE", "GCE_MAINTENANCE_PHASE=complete"}},
+	}
+
+	for _, tt := range tests {
+		handleMaintenanceEvent(ctx, tt.cfg, tt.md)
+		var got []string
+		select {
+		case got = <-ran:
+		case <-time.After(100 * time.Millisecond):
+		}
+		if !reflect.DeepEqual(got, tt.wantEnv) {
+			t.Errorf("test case %q: hook env got: %q, want: %q", tt.name, got, tt.wantEnv)
+		}
+	}
+}
+
+func TestMigrationPause(t *testing.T) {
+	p := &migrationPause{section: "mtu", name: "MTU"}
+	var tests = []struct {
+		name      string
+		migrating bool
+		setErr    error
+		wantDiff  bool
+		wantOK    bool
+	}{
+		{"not migrating", false, nil, false, false},
+		{"migration starts", true, nil, true, true},
+		{"pause recorded", true, nil, false, true},
+		{"migration ends", false, errors.New("failed"), true, true},
+		{"failed set retried", false, nil, true, true},
+		{"resumed", false, nil, false, false},
+	}
+
+	for _, tt := range tests {
+		changed, ok := p.diff(tt.migrating)
+		if changed != tt.wantDiff || ok != tt.wantOK {
+			t.Errorf("test case %q: diff got: %t, %t, want: %t, %t", tt.name, changed, ok, tt.wantDiff, tt.wantOK)
+		}
+		if changed {
+			if skip := p.skip(tt.migrating); skip != tt.migrating {
+				t.Errorf("test case %q: skip got: %t, want: %t", tt.name, skip, tt.migrating)
+			} else if !skip {
+				p.done(tt.setErr)
+			}
+		}
+	}
+}
@@ -0,0 +1,157 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// domainJoinGuestAttribute is the guest attribute the domain join status is
+// reported to.
+const domainJoinGuestAttribute = "domain-join"
+
+// managedADJoinSecretLabel is the label of a Managed Microsoft AD domain
+// naming the secret, in the project of the instance, holding the password of
+// the join account.
+const managedADJoinSecretLabel = "join-secret"
+
+var (
+	// managedIdentitiesURL and lookupSRV are replaced in tests.
+	managedIdentitiesURL = "https://managedidentities.googleapis.com/v1"
+	lookupSRV            = net.LookupSRV
+)
+
+// managedDomainJSON is the part of a Managed Microsoft AD domain resource
+// used to join it.
+type managedDomainJSON struct {
+	Name   string            `json:"name"`
+	Fqdn   string            `json:"fqdn"`
+	Admin  string            `json:"admin"`
+	State  string            `json:"state"`
+	Labels map[string]string `json:"labels"`
+}
+
+// domainJoinStatusJSON is reported to the domain join guest attribute.
+type domainJoinStatusJSON struct {
+	Domain        string `json:"domain"`
+	ManagedDomain string `json:"managedDomain,omitempty"`
+	State         string `json:"state"`
+	Error         string `json:"error,omitempty"`
+	Time          string `json:"time"`
+}
+
+// reportDomainJoin writes the state of the join of p, or err, to the domain
+// join guest attribute.
+func reportDomainJoin(cfg *ini.File, p domainJoinJSON, state string, err error) {
+	s := domainJoinStatusJSON{
+		Domain:        p.Domain,
+		ManagedDomain: p.ManagedDomain,
+		State:         state,
+		Time:          time.Now().UTC().Format(time.RFC3339),
+	}
+	if err != nil {
+		s.State, s.Error = stateFailed, err.Error()
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	writeGuestAttribute(cfg, domainJoinGuestAttribute, string(data))
+}
+
+// managedDomainName returns the resource name of the managed domain d, which
+// is a resource name or the domain name in project.
+func managedDomainName(d, project string) string {
+	if strings.HasPrefix(d, "projects/") {
+		return d
+	}
+	return fmt.Sprintf("projects/%s/locations/global/domains/%s", project, d)
+}
+
+// getManagedDomain fetches the Managed Microsoft AD domain name as the
+// service account of the instance.
+func getManagedDomain(ctx context.Context, config *ini.File, name string) (*managedDomainJSON, error) {
+	token, err := serviceAccountToken(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", managedIdentitiesURL+"/"+name, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error getting managed domain %s: %s, %s", name, resp.Status, body)
+	}
+	var d managedDomainJSON
+	if err := json.Unmarshal(body, &d); err != nil {
+		return nil, fmt.Errorf("error parsing managed domain %s: %v", name, err)
+	}
+	return &d, nil
+}
+
+// resolveManagedDomain fills in the domain, join user and password secret of
+// p from its managed domain. Settings in p take precedence.
+func resolveManagedDomain(ctx context.Context, config *ini.File, project string, p domainJoinJSON) (domainJoinJSON, error) {
+	name := managedDomainName(p.ManagedDomain, project)
+	d, err := getManagedDomain(ctx, config, name)
+	if err != nil {
+		return p, err
+	}
+	if d.State != "READY" {
+		return p, fmt.Errorf("managed domain %s is %s, not READY", name, d.State)
+	}
+	p.Domain = d.Fqdn
+	if p.User == "" {
+		p.User = d.Admin + "@" + d.Fqdn
+	}
+	if p.PasswordSecret == "" && p.PasswordAttribute == "" {
+		secret := d.Labels[managedADJoinSecretLabel]
+		if secret == "" {
+			return p, fmt.Errorf("managed domain %s has no %s label and no password is set", name, managedADJoinSecretLabel)
+		}
+		p.PasswordSecret = fmt.Sprintf("projects/%s/secrets/%s/versions/latest", project, secret)
+	}
+	return p, nil
+}
+
+// checkManagedDomainDNS checks the domain controllers of domain resolve. The
+// dns manager, which runs first, adds the domain to the search list.
+func checkManagedDomainDNS(domain string) error {
+	if _, _, err := lookupSRV("ldap", "tcp", "dc._msdcs."+domain); err != nil {
+		return fmt.Errorf("domain controllers of %s don't resolve, is the network of the instance authorized for the domain: %v", domain, err)
+	}
+	return nil
+}
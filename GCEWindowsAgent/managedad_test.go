@@ -0,0 +1,133 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+func TestManagedDomainName(t *testing.T) {
+	var tests = []struct {
+		d, want string
+	}{
+		{"corp.example.com", "projects/p/locations/global/domains/corp.example.com"},
+		{"projects/other/locations/global/domains/corp.example.com", "projects/other/locations/global/domains/corp.example.com"},
+	}
+
+	for _, tt := range tests {
+		if got := managedDomainName(tt.d, "p"); got != tt.want {
+			t.Errorf("managedDomainName(%q) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestManagedDomainJoin(t *testing.T) {
+	domainState := "READY"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/instance/service-accounts/default/token":
+			w.Write([]byte(`{"access_token":"token","expires_in":3600,"token_type":"Bearer"}`))
+		case "/projects/p/locations/global/domains/corp.example.com":
+			json.NewEncoder(w).Encode(managedDomainJSON{
+				Name:   "projects/p/locations/global/domains/corp.example.com",
+				Fqdn:   "corp.example.com",
+				Admin:  "setupadmin",
+				State:  domainState,
+				Labels: map[string]string{"join-secret": "ad-join"},
+			})
+		case "/projects/p/secrets/ad-join/versions/latest:access":
+			w.Write([]byte(`{"payload":{"data":"c2VjcmV0"}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	oldMgr, oldServer, oldSecrets, oldAPI := domainJoinMgr, metadataServer, secretManagerURL, managedIdentitiesURL
+	oldRead, oldWrite, oldPut, oldLookup := readDomainJoinState, writeDomainJoinState, putGuestAttribute, lookupSRV
+	defer func() {
+		domainJoinMgr, metadataServer, secretManagerURL, managedIdentitiesURL = oldMgr, oldServer, oldSecrets, oldAPI
+		readDomainJoinState, writeDomainJoinState, putGuestAttribute, lookupSRV = oldRead, oldWrite, oldPut, oldLookup
+		pendingReboot = pendingRebootJSON{}
+	}()
+	metadataServer, secretManagerURL, managedIdentitiesURL = srv.URL, srv.URL, srv.URL
+	readDomainJoinState = func() ([]string, error) { return nil, errRegNotExist }
+	writeDomainJoinState = func([]string) error { return nil }
+
+	var tests = []struct {
+		name       string
+		state      string
+		resolves   bool
+		wantJoined bool
+		wantStatus string
+	}{
+		{"joined", "READY", true, true, domainJoinRebootPending},
+		{"not ready", "CREATING", true, false, stateFailed},
+		{"not resolvable", "READY", false, false, stateFailed},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte("[domainJoin]\nenable=true"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		domainState = tt.state
+		fake := &fakeDomainJoiner{domain: "WORKGROUP"}
+		domainJoinMgr = fake
+		lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+			if !tt.resolves || name != "dc._msdcs.corp.example.com" {
+				return "", nil, errors.New("no such host")
+			}
+			return "", []*net.SRV{{Target: "dc1.corp.example.com.", Port: 389}}, nil
+		}
+		var status domainJoinStatusJSON
+		putGuestAttribute = func(cfg *ini.File, key, value string) error {
+			if key == domainJoinGuestAttribute {
+				return json.Unmarshal([]byte(value), &status)
+			}
+			return nil
+		}
+
+		md := &metadataJSON{
+			Instance: instanceJSON{Attributes: attributesJSON{DomainJoin: `{"ManagedDomain":"corp.example.com"}`}},
+			Project:  projectJSON{ProjectID: "p"},
+		}
+		j := &domainJoin{newMetadata: md, oldMetadata: md, config: cfg}
+		if !j.diff() {
+			t.Errorf("test case %q: no diff", tt.name)
+		}
+		err = j.set(context.Background())
+		if (err == nil) != tt.wantJoined || fake.joined != tt.wantJoined {
+			t.Errorf("test case %q: set error: %v, joined: %t, want joined: %t", tt.name, err, fake.joined, tt.wantJoined)
+		}
+		if status.State != tt.wantStatus || status.Domain != "corp.example.com" {
+			t.Errorf("test case %q: status got: %+v, want state %s", tt.name, status, tt.wantStatus)
+		}
+		if !tt.wantJoined {
+			continue
+		}
+		if fake.user != "setupadmin@corp.example.com" || fake.password != "secret" {
+			t.Errorf("test case %q: joined as %q with password %q, want setupadmin@corp.example.com with secret", tt.name, fake.user, fake.password)
+		}
+	}
+}
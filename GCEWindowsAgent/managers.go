@@ -0,0 +1,69 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"fmt"
+)
+
+// managerRegistration is a manager of the agent: the config section naming
+// it, how to build it for an update and the sections of the managers it runs
+// after.
+type managerRegistration struct {
+	section string
+	build   managerBuilder
+	after   []string
+}
+
+// managerRegistry holds the managers of the agent in registration order.
+var managerRegistry []managerRegistration
+
+// registerManager adds a manager to every update. Managers run in parallel,
+// except that it runs once the managers of the sections in after are done,
+// when they run in the same update. Those must be registered before it, so
+// the order has no cycles.
+//
+// It is called from init, before the logger is set up, so a bad registration
+// panics, which fails every test run rather than going unnoticed.
+func registerManager(section string, build managerBuilder, after ...string) {
+	for _, s := range after {
+		if registeredManager(s) == nil {
+			panic(fmt.Sprintf("manager %s is ordered after unregistered manager %s", section, s))
+		}
+	}
+	if registeredManager(section) != nil {
+		panic(fmt.Sprintf("manager %s is registered twice", section))
+	}
+	managerRegistry = append(managerRegistry, managerRegistration{section, build, after})
+}
+
+// registeredManager returns the registration of section, nil if there is
+// none.
+func registeredManager(section string) *managerRegistration {
+	for i := range managerRegistry {
+		if managerRegistry[i].section == section {
+			return &managerRegistry[i]
+		}
+	}
+	return nil
+}
+
+// managerAfter returns the sections of the managers section runs after.
+func managerAfter(section string) []string {
+	if r := registeredManager(section); r != nil {
+		return r.after
+	}
+	return nil
+}
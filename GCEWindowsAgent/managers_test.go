@@ -0,0 +1,143 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+func TestManagerRegistry(t *testing.T) {
+	var sections []string
+	for _, r := range managerRegistry {
+		if containsString(r.section, sections) {
+			t.Errorf("manager %s registered twice", r.section)
+		}
+		for _, s := range r.after {
+			if !containsString(s, sections) {
+				t.Errorf("manager %s is ordered after %s, which isn't registered before it", r.section, s)
+			}
+		}
+		sections = append(sections, r.section)
+	}
+	cfg, _ := ini.InsensitiveLoad([]byte{})
+	md := &metadataJSON{}
+	for _, mgr := range builtinManagers(md, md, cfg) {
+		if _, ok := mgr.manager.(enabler); !ok {
+			t.Errorf("manager %s doesn't report its enablement", mgr.section)
+		}
+		if _, ok := mgr.manager.(planner); !ok {
+			t.Errorf("manager %s can't plan its changes for a dry run", mgr.section)
+		}
+	}
+	if got := managerAfter("wsfc"); !reflect.DeepEqual(got, []string{"addressManager"}) {
+		t.Errorf("wsfc runs after %q, want addressManager", got)
+	}
+}
+
+func TestRegisterManager(t *testing.T) {
+	oldRegistry := managerRegistry
+	defer func() { managerRegistry = oldRegistry }()
+	managerRegistry = nil
+
+	build := func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager { return &fakeManager{} }
+	var tests = []struct {
+		section string
+		after   []string
+		panics  bool
+	}{
+		{"first", nil, false},
+		{"second", []string{"first"}, false},
+		{"first", nil, true},
+		{"third", []string{"first", "later"}, true},
+		{"later", nil, false},
+	}
+
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if r := recover(); (r != nil) != tt.panics {
+					t.Errorf("registering %s after %q: panic got: %v, want: %t", tt.section, tt.after, r, tt.panics)
+				}
+			}()
+			registerManager(tt.section, build, tt.after...)
+		}()
+	}
+
+	var sections []string
+	for _, r := range managerRegistry {
+		sections = append(sections, r.section)
+	}
+	if want := []string{"first", "second", "later"}; !reflect.DeepEqual(sections, want) {
+		t.Errorf("registered managers got: %q, want: %q", sections, want)
+	}
+	if got := managerAfter("second"); !reflect.DeepEqual(got, []string{"first"}) {
+		t.Errorf("second runs after %q, want first", got)
+	}
+}
+
+// orderedManager records when its set runs.
+type orderedManager struct {
+	fakeManager
+	name  string
+	delay time.Duration
+	mu    *sync.Mutex
+	order *[]string
+}
+
+func (o *orderedManager) set(ctx context.Context) error {
+	time.Sleep(o.delay)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	*o.order = append(*o.order, o.name)
+	return nil
+}
+
+func TestRunManagersOrder(t *testing.T) {
+	oldRegistry := managerRegistry
+	defer func() { managerRegistry = oldRegistry }()
+	managerRegistry = nil
+	build := func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager { return &fakeManager{} }
+	registerManager("first", build)
+	registerManager("second", build, "first")
+
+	var mu sync.Mutex
+	var order []string
+	mgr := func(name string, delay time.Duration, disabled bool) namedManager {
+		return namedManager{name, &orderedManager{fakeManager{isDiff: true, isDisabled: disabled}, name, delay, &mu, &order}}
+	}
+	var tests = []struct {
+		name string
+		mgrs []namedManager
+		want []string
+	}{
+		{"ordered", []namedManager{mgr("second", 0, false), mgr("first", 50*time.Millisecond, false)}, []string{"first", "second"}},
+		{"dependency disabled", []namedManager{mgr("second", 0, false), mgr("first", 0, true)}, []string{"second"}},
+		{"dependency not run", []namedManager{mgr("second", 0, false)}, []string{"second"}},
+	}
+
+	for _, tt := range tests {
+		order = nil
+		runManagers(context.Background(), ini.Empty(), tt.mgrs)
+		if !reflect.DeepEqual(order, tt.want) {
+			t.Errorf("test case %q: set order got: %q, want: %q", tt.name, order, tt.want)
+		}
+	}
+}
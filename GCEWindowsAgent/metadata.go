@@ -15,20 +15,44 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
 )
 
-const metadataServer = "http://metadata.google.internal/computeMetadata/v1"
-const metadataHang = "/?recursive=true&alt=json&wait_for_change=true&timeout_sec=60&last_etag="
+const metadataRecursive = "/?recursive=true&alt=json"
+const metadataHang = "&wait_for_change=true&timeout_sec=%d&last_etag="
+const defaultHangTimeout = 60 * time.Second
+const defaultPollInterval = 10 * time.Second
 const defaultEtag = "NONE"
 
 var (
-	defaultTimeout = 70 * time.Second
-	etag           = defaultEtag
+	metadataServer = "http://metadata.google.internal/computeMetadata/v1"
+	// clientTimeout is added to the hanging GET timeout for the client
+	// timeout.
+	clientTimeout = 10 * time.Second
+	etag          = defaultEtag
+
+	// attributePaths are needed by every manager to evaluate disabled().
+	attributePaths = []string{"instance/attributes", "project/attributes"}
+	// neededPaths are the metadata subtrees used by the enabled managers
+	// during the last update, nil means the full tree is needed.
+	neededPaths []string
+	pathEtags   = map[string]string{}
+	pathContent = map[string]json.RawMessage{}
 )
 
 type metadataJSON struct {
@@ -37,17 +61,47 @@ type metadataJSON struct {
 }
 
 type instanceJSON struct {
+	ID                uint64
+	Hostname          string
 	Attributes        attributesJSON
+	MaintenanceEvent  string
+	Preempted         string
 	NetworkInterfaces []networkInterfacesJSON
+	Disks             []diskJSON
+}
+
+// migrating reports whether the instance is being live migrated.
+func (i instanceJSON) migrating() bool {
+	return i.MaintenanceEvent == "MIGRATE_ON_HOST_MAINTENANCE"
+}
+
+// terminating reports whether the instance got a termination notice, it is
+// preempted or stops for host maintenance.
+func (i instanceJSON) terminating() bool {
+	return i.Preempted == "TRUE" || i.MaintenanceEvent == "TERMINATE_ON_HOST_MAINTENANCE"
 }
 
 type networkInterfacesJSON struct {
-	ForwardedIps []string
-	Mac          string
+	ForwardedIps   []string
+	ForwardedIpv6s []string
+	IPAliases      []string
+	Mac            string
+	Mtu            int
+}
+
+// diskJSON is an attached disk. Type is PERSISTENT or SCRATCH, Mode is
+// READ_WRITE or READ_ONLY.
+type diskJSON struct {
+	DeviceName string
+	Index      int
+	Mode       string
+	Type       string
 }
 
 type projectJSON struct {
-	Attributes attributesJSON
+	ProjectID        string
+	NumericProjectID uint64
+	Attributes       attributesJSON
 }
 
 type attributesJSON struct {
@@ -59,6 +113,56 @@ type attributesJSON struct {
 	EnableWSFC            string `json:"enable-wsfc"`
 	WSFCAddresses         string `json:"wsfc-addrs"`
 	WSFCAgentPort         string `json:"wsfc-agent-port"`
+	PrinterPorts          string `json:"printer-ports"`
+	EnableTimeSync        string `json:"enable-time-sync"`
+	NTPServers            string `json:"ntp-servers"`
+	PageFiles             string `json:"page-files"`
+	AgentConfig           string `json:"google-compute-agent-config"`
+	EnableOSLogin         string `json:"enable-oslogin"`
+	EnableOSLogin2FA      string `json:"enable-oslogin-2fa"`
+	SSHKeys               string `json:"ssh-keys"`
+	WindowsSSHKeys        string `json:"windows-ssh-keys"`
+	BlockProjectSSHKeys   string `json:"block-project-ssh-keys"`
+	EnableWindowsSSH      string `json:"enable-windows-ssh"`
+	EnableWinRMHTTPS      string `json:"enable-winrm-https"`
+	WinRMCertificate      string `json:"winrm-certificate"`
+	DisableMTUManager     string `json:"disable-mtu-manager"`
+	DNSServers            string `json:"dns-servers"`
+	DNSSearchDomains      string `json:"dns-search-domains"`
+	DisableDNSManager     string `json:"disable-dns-manager"`
+	DiskPolicy            string `json:"disk-policy"`
+	DomainJoin            string `json:"domain-join"`
+	EnableDomainJoin      string `json:"enable-domain-join"`
+}
+
+// verifyPaths returns the metadata paths needed by verifyMetadata.
+func verifyPaths(config *ini.File) []string {
+	var paths []string
+	if config.Section("metadata").Key("expected_project").String() != "" {
+		paths = append(paths, "project/project-id", "project/numeric-project-id")
+	}
+	if config.Section("metadata").Key("expected_instance").String() != "" {
+		paths = append(paths, "instance/id")
+	}
+	return paths
+}
+
+// verifyMetadata checks that metadata belongs to the project and instance
+// set in [metadata] expected_project (project ID or number) and
+// expected_instance (instance ID). Either check is skipped when unset.
+func verifyMetadata(md *metadataJSON, config *ini.File) error {
+	sec := config.Section("metadata")
+	if project := sec.Key("expected_project").String(); project != "" {
+		if project != md.Project.ProjectID && project != strconv.FormatUint(md.Project.NumericProjectID, 10) {
+			return fmt.Errorf("metadata is for project %q (%d), expected project %q", md.Project.ProjectID, md.Project.NumericProjectID, project)
+		}
+	}
+	if instance := sec.Key("expected_instance").String(); instance != "" {
+		if instance != strconv.FormatUint(md.Instance.ID, 10) {
+			return fmt.Errorf("metadata is for instance %d, expected instance %q", md.Instance.ID, instance)
+		}
+	}
+	return nil
 }
 
 func updateEtag(resp *http.Response) bool {
@@ -70,19 +174,294 @@ func updateEtag(resp *http.Response) bool {
 	return etag == oldEtag
 }
 
-func watchMetadata(ctx context.Context) (*metadataJSON, error) {
-	client := &http.Client{
-		Timeout: defaultTimeout,
+type metadataClientConfig struct {
+	serverIP        string
+	maxIdleConns    int
+	idleConnTimeout time.Duration
+	hangTimeout     time.Duration
+	acceptGzip      bool
+}
+
+// parseMetadataClientConfig reads the [metadata] client keys. The config is
+// shared by the managers of an update, which all fetch the client, so the
+// keys are looked up with GetKey: Key and the MustX methods add the missing
+// key to the config.
+func parseMetadataClientConfig(config *ini.File) metadataClientConfig {
+	key := func(name string) *ini.Key {
+		if sec, err := config.GetSection("metadata"); err == nil {
+			if k, err := sec.GetKey(name); err == nil {
+				return k
+			}
+		}
+		return nil
+	}
+	intKey := func(name string, def int) int {
+		if k := key(name); k != nil {
+			if n, err := k.Int(); err == nil {
+				return n
+			}
+		}
+		return def
+	}
+	acceptGzip := true
+	if k := key("accept_gzip"); k != nil {
+		if b, err := k.Bool(); err == nil {
+			acceptGzip = b
+		}
+	}
+	var serverIP string
+	if k := key("server_ip"); k != nil {
+		serverIP = k.String()
+	}
+	return metadataClientConfig{
+		serverIP:        serverIP,
+		maxIdleConns:    intKey("max_idle_conns", 2),
+		idleConnTimeout: time.Duration(intKey("idle_conn_timeout_sec", 90)) * time.Second,
+		hangTimeout:     time.Duration(intKey("hang_timeout_sec", int(defaultHangTimeout/time.Second))) * time.Second,
+		acceptGzip:      acceptGzip,
+	}
+}
+
+var (
+	// metadataClientMu guards metadataClient and metadataClientCfg, the
+	// client is shared by the watcher and every manager.
+	metadataClientMu  sync.Mutex
+	metadataClient    *http.Client
+	metadataClientCfg metadataClientConfig
+)
+
+// getMetadataClient returns the shared metadata client so connections are
+// kept alive across watches, the client is only rebuilt when its config
+// changes.
+func getMetadataClient(config *ini.File) *http.Client {
+	cfg := parseMetadataClientConfig(config)
+	metadataClientMu.Lock()
+	defer metadataClientMu.Unlock()
+	if metadataClient == nil || cfg != metadataClientCfg {
+		if metadataClient != nil {
+			// Requests in flight finish on the old client, its idle
+			// connections would otherwise stay open until they time out.
+			metadataClient.CloseIdleConnections()
+		}
+		metadataClient = newMetadataClient(cfg)
+		metadataClientCfg = cfg
+	}
+	return metadataClient
+}
+
+// newMetadataClient returns the http.Client used to talk to the metadata
+// server. If serverIP is set all connections are dialed to that address
+// instead of resolving the metadata server name, the request URL is left
+// untouched so the Host header (and TLS server name) stay correct.
+func newMetadataClient(cfg metadataClientConfig) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	dial := dialer.DialContext
+	if cfg.serverIP != "" {
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			return dialer.DialContext(ctx, network, net.JoinHostPort(cfg.serverIP, port))
+		}
 	}
 
-	req, err := http.NewRequest("GET", metadataServer+metadataHang+etag, nil)
+	// The client timeout bounds hanging GETs, which only send their
+	// headers once metadata changes or the hang timeout expires.
+	return &http.Client{
+		Timeout: hangTimeout(cfg) + clientTimeout,
+		Transport: &metadataTransport{
+			Transport: &http.Transport{
+				DialContext:           dial,
+				MaxIdleConns:          cfg.maxIdleConns,
+				MaxIdleConnsPerHost:   cfg.maxIdleConns,
+				IdleConnTimeout:       cfg.idleConnTimeout,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ExpectContinueTimeout: time.Second,
+				// Compression is handled by metadataTransport so the
+				// bytes received can be counted.
+				DisableCompression: true,
+			},
+			acceptGzip: cfg.acceptGzip,
+		},
+	}
+}
+
+// metadataTransport requests gzip compressed responses when acceptGzip is
+// set and decompresses them, as http.Transport would, counting the bytes
+// received and decoded in the metadata metrics.
+type metadataTransport struct {
+	*http.Transport
+	acceptGzip bool
+}
+
+func (t *metadataTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.acceptGzip && req.Header.Get("Accept-Encoding") == "" {
+		// RoundTrip must not modify the caller's request.
+		req = req.Clone(req.Context())
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	resp, err := t.Transport.RoundTrip(req)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Metadata-Flavor", "Google")
-	req = req.WithContext(ctx)
+
+	encoding := "identity"
+	if t.acceptGzip && strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		encoding = "gzip"
+	}
+	body := &countingReadCloser{ReadCloser: resp.Body, counter: metadataReceivedBytes, label: encoding}
+	if encoding != "gzip" {
+		resp.Body = &countingReadCloser{ReadCloser: body, counter: metadataDecodedBytes, label: encoding}
+		return resp, nil
+	}
+	resp.Body = &countingReadCloser{ReadCloser: &gzipReadCloser{body: body}, counter: metadataDecodedBytes, label: encoding}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return resp, nil
+}
+
+// countingReadCloser adds the bytes read from ReadCloser to counter.
+type countingReadCloser struct {
+	io.ReadCloser
+	counter *counterVec
+	label   string
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	if n > 0 {
+		c.counter.add(c.label, float64(n))
+	}
+	return n, err
+}
+
+// gzipReadCloser decompresses body, the gzip reader is created on the first
+// Read so a response that is closed unread does not block on its header.
+type gzipReadCloser struct {
+	body io.ReadCloser
+	zr   *gzip.Reader
+	err  error
+}
+
+func (g *gzipReadCloser) Read(p []byte) (int, error) {
+	if g.zr == nil && g.err == nil {
+		g.zr, g.err = gzip.NewReader(g.body)
+	}
+	if g.err != nil {
+		return 0, g.err
+	}
+	return g.zr.Read(p)
+}
+
+func (g *gzipReadCloser) Close() error {
+	return g.body.Close()
+}
+
+// closeBody drains and closes the body of resp so its connection goes back
+// to the idle pool instead of being closed.
+func closeBody(resp *http.Response) {
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// pollInterval returns the interval between metadata requests when the
+// [metadata] mode is "poll", or 0 when using hanging GET requests
+// ("longpoll", the default). An interval that isn't positive would poll in
+// a busy loop or switch to longpoll, the default is used instead.
+func pollInterval(config *ini.File) time.Duration {
+	sec := config.Section("metadata")
+	switch mode := sec.Key("mode").MustString("longpoll"); mode {
+	case "poll":
+		n := sec.Key("poll_interval_sec").MustInt(int(defaultPollInterval / time.Second))
+		if n <= 0 {
+			logger.Errorf("Invalid poll_interval_sec %d, using %d", n, int(defaultPollInterval/time.Second))
+			return defaultPollInterval
+		}
+		return time.Duration(n) * time.Second
+	case "longpoll":
+	default:
+		logger.Errorf("Unknown metadata mode %q, using longpoll", mode)
+	}
+	return 0
+}
+
+// hangTimeout returns how long the metadata server holds a hanging GET, per
+// [metadata] hang_timeout_sec.
+func hangTimeout(cfg metadataClientConfig) time.Duration {
+	if cfg.hangTimeout <= 0 {
+		return defaultHangTimeout
+	}
+	return cfg.hangTimeout
+}
+
+// metadataURL returns the recursive metadata URL for path, waiting for a
+// change from lastEtag unless polling. The hanging GET timeout is that of the
+// current metadata client.
+func metadataURL(path, lastEtag string, poll time.Duration) string {
+	url := metadataServer + path + metadataRecursive
+	if poll == 0 {
+		metadataClientMu.Lock()
+		hang := hangTimeout(metadataClientCfg)
+		metadataClientMu.Unlock()
+		url += fmt.Sprintf(metadataHang, int(hang/time.Second)) + lastEtag
+	}
+	return url
+}
+
+// sleepCtx sleeps for d, it returns false if ctx is done first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+var (
+	lastFetchMu sync.Mutex
+	lastFetch   time.Time
+)
+
+// recordMetadataFetch notes a response from the metadata watcher.
+func recordMetadataFetch() {
+	lastFetchMu.Lock()
+	defer lastFetchMu.Unlock()
+	lastFetch = time.Now()
+}
+
+// lastMetadataFetch returns when the metadata watcher last got a response,
+// zero if it never did.
+func lastMetadataFetch() time.Time {
+	lastFetchMu.Lock()
+	defer lastFetchMu.Unlock()
+	return lastFetch
+}
+
+func watchMetadata(ctx context.Context, config *ini.File) (*metadataJSON, error) {
+	if path := metadataFile(config); path != "" {
+		return watchMetadataFile(ctx, path)
+	}
+	client := getMetadataClient(config)
+	poll := pollInterval(config)
+	if config.Section("metadata").Key("subtree_fetch").MustBool(false) && len(neededPaths) != 0 {
+		return watchMetadataPaths(ctx, client, neededPaths, poll, pathEtags, pathContent)
+	}
 
 	for {
+		req, err := http.NewRequest("GET", metadataURL("", etag, poll), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Metadata-Flavor", "Google")
+		req = req.WithContext(ctx)
+
 		resp, err := client.Do(req)
 		// Don't return error on a canceled context.
 		if err != nil && ctx.Err() != nil {
@@ -91,18 +470,248 @@ func watchMetadata(ctx context.Context) (*metadataJSON, error) {
 		if err != nil {
 			return nil, err
 		}
+		recordMetadataFetch()
 
 		// Only return metadata on updated etag.
-		if !updateEtag(resp) {
+		if updateEtag(resp) {
+			logger.Debugf("Metadata unchanged, etag %s", etag)
+			closeBody(resp)
+			if poll != 0 && !sleepCtx(ctx, poll) {
+				return nil, nil
+			}
 			continue
 		}
 
-		md, err := ioutil.ReadAll(resp.Body)
+		logger.Debugf("Metadata changed, etag %s", etag)
+		metadata, err := decodeMetadata(resp.Body)
+		closeBody(resp)
+		return metadata, err
+	}
+}
+
+// maxPooledMetadataBuffer is the largest buffer kept in metadataBuffers, so
+// one unusually large document isn't held on to.
+const maxPooledMetadataBuffer = 4 << 20
+
+// metadataBuffers hold the metadata responses being decoded. They are reused
+// as the full metadata document is decoded on every change, a json.Decoder
+// grows a new buffer of the document size each time.
+var metadataBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// decodeMetadata decodes the metadata document read from r.
+func decodeMetadata(r io.Reader) (*metadataJSON, error) {
+	buf := metadataBuffers.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledMetadataBuffer {
+			buf.Reset()
+			metadataBuffers.Put(buf)
+		}
+	}()
+
+	var metadata metadataJSON
+	if _, err := buf.ReadFrom(r); err != nil {
+		return &metadata, err
+	}
+	return &metadata, json.Unmarshal(buf.Bytes(), &metadata)
+}
+
+// getMetadata fetches the current metadata without waiting for a change or
+// updating the etag used by watchMetadata.
+func getMetadata(ctx context.Context, config *ini.File) (*metadataJSON, error) {
+	if path := metadataFile(config); path != "" {
+		return readMetadataFile(path)
+	}
+	req, err := http.NewRequest("GET", metadataServer+metadataRecursive, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+	resp, err := getMetadataClient(config).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata server returned %s", resp.Status)
+	}
+	return decodeMetadata(resp.Body)
+}
+
+// getMetadataPath fetches a single, non recursive, metadata path such as an
+// OS Login endpoint.
+func getMetadataPath(ctx context.Context, config *ini.File, path string) ([]byte, error) {
+	if file := metadataFile(config); file != "" {
+		return readMetadataFilePath(file, path)
+	}
+	req, err := http.NewRequest("GET", metadataServer+"/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+	resp, err := getMetadataClient(config).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer closeBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metadata server returned %s for %s", resp.Status, path)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// putMetadata writes value to the writable metadata path, such as a guest
+// attribute. With a metadata file the write is only logged.
+func putMetadata(ctx context.Context, config *ini.File, path, value string) error {
+	if file := metadataFile(config); file != "" {
+		logger.Debugf("Metadata file %s is used, not writing %s: %s", file, path, value)
+		return nil
+	}
+	req, err := http.NewRequest("PUT", metadataServer+"/"+path, strings.NewReader(value))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Metadata-Flavor", "Google")
+	resp, err := getMetadataClient(config).Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer closeBody(resp)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("metadata server returned %s for PUT %s", resp.Status, path)
+	}
+	return nil
+}
+
+type pathResult struct {
+	path, etag string
+	body       []byte
+	err        error
+}
+
+// watchMetadataPaths watches only the given metadata subtrees and assembles
+// them into a partial metadataJSON. It returns once any subtree changes,
+// after every subtree has been fetched at least once. The etag and content of
+// each subtree are kept in etags and content between calls.
+func watchMetadataPaths(ctx context.Context, client *http.Client, paths []string, poll time.Duration, etags map[string]string, content map[string]json.RawMessage) (*metadataJSON, error) {
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan pathResult, len(paths))
+	for _, p := range paths {
+		lastEtag, ok := etags[p]
+		if !ok {
+			lastEtag = defaultEtag
+		}
+		go func(p, lastEtag string) {
+			body, newEtag, err := watchMetadataPath(wctx, client, p, lastEtag, poll)
+			results <- pathResult{p, newEtag, body, err}
+		}(p, lastEtag)
+	}
+
+	for range paths {
+		r := <-results
+		// Don't return error on a canceled context.
+		if r.err != nil && ctx.Err() != nil {
+			return nil, nil
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		etags[r.path] = r.etag
+		content[r.path] = r.body
+
+		var missing bool
+		for _, p := range paths {
+			if _, ok := content[p]; !ok {
+				missing = true
+			}
+		}
+		if !missing {
+			break
+		}
+	}
+
+	return assembleMetadata(paths, content)
+}
+
+// watchMetadataPath waits for the metadata subtree at path to change from
+// lastEtag and returns its content and new etag.
+func watchMetadataPath(ctx context.Context, client *http.Client, path, lastEtag string, poll time.Duration) ([]byte, string, error) {
+	for {
+		req, err := http.NewRequest("GET", metadataURL("/"+path, lastEtag, poll), nil)
+		if err != nil {
+			return nil, "", err
+		}
+		req.Header.Add("Metadata-Flavor", "Google")
+		req = req.WithContext(ctx)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		recordMetadataFetch()
+		body, err := ioutil.ReadAll(resp.Body)
 		resp.Body.Close()
 		if err != nil {
-			return nil, err
+			return nil, "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, "", fmt.Errorf("error fetching metadata path %q: %s", path, resp.Status)
+		}
+
+		newEtag := resp.Header.Get("etag")
+		if newEtag == "" {
+			newEtag = defaultEtag
+		}
+		if newEtag != lastEtag {
+			return body, newEtag, nil
+		}
+		if poll != 0 && !sleepCtx(ctx, poll) {
+			return nil, "", ctx.Err()
+		}
+	}
+}
+
+// assembleMetadata builds a metadataJSON from the content of metadata
+// subtrees keyed by path, e.g. "instance/network-interfaces".
+func assembleMetadata(paths []string, content map[string]json.RawMessage) (*metadataJSON, error) {
+	tree := map[string]interface{}{}
+	for _, p := range paths {
+		node := tree
+		elems := strings.Split(strings.Trim(p, "/"), "/")
+		for i, elem := range elems {
+			elem = jsonKey(elem)
+			if i == len(elems)-1 {
+				node[elem] = content[p]
+				break
+			}
+			child, ok := node[elem].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				node[elem] = child
+			}
+			node = child
+		}
+	}
+
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	var metadata metadataJSON
+	return &metadata, json.Unmarshal(data, &metadata)
+}
+
+// jsonKey converts a metadata path element to its key in the recursive JSON
+// output, e.g. "network-interfaces" to "networkInterfaces".
+func jsonKey(elem string) string {
+	parts := strings.Split(elem, "-")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
 		}
-		var metadata metadataJSON
-		return &metadata, json.Unmarshal(md, &metadata)
 	}
+	return strings.Join(parts, "")
 }
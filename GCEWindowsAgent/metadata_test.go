@@ -0,0 +1,567 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+func TestNewMetadataClientServerIP(t *testing.T) {
+	var gotHost string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotHost = r.Host
+	}))
+	defer ts.Close()
+
+	ip, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// metadata.google.internal does not resolve here, the request can only
+	// succeed if the client dials the configured IP directly.
+	host := "metadata.google.internal:" + port
+	resp, err := newMetadataClient(metadataClientConfig{serverIP: ip}).Get("http://" + host + "/computeMetadata/v1/")
+	if err != nil {
+		t.Fatalf("error requesting metadata with fixed server IP: %v", err)
+	}
+	resp.Body.Close()
+
+	if gotHost != host {
+		t.Errorf("request Host header got: %q, want: %q", gotHost, host)
+	}
+}
+
+func TestGetMetadataClientReuse(t *testing.T) {
+	metadataClient = nil
+	cfg := ini.Empty()
+
+	c1 := getMetadataClient(cfg)
+	c2 := getMetadataClient(cfg)
+	if c1 != c2 {
+		t.Error("getMetadataClient() returned a new client for an unchanged config")
+	}
+
+	cfg.Section("metadata").Key("max_idle_conns").SetValue("5")
+	c3 := getMetadataClient(cfg)
+	if c3 == c1 {
+		t.Error("getMetadataClient() did not rebuild the client after a config change")
+	}
+	if got := c3.Transport.(*metadataTransport).MaxIdleConns; got != 5 {
+		t.Errorf("MaxIdleConns got: %d, want: 5", got)
+	}
+	if c4 := getMetadataClient(cfg); c4 != c3 {
+		t.Error("getMetadataClient() returned a new client for an unchanged config")
+	}
+}
+
+func TestPollInterval(t *testing.T) {
+	var tests = []struct {
+		data string
+		want time.Duration
+	}{
+		{"", 0},
+		{"[metadata]\nmode=longpoll", 0},
+		{"[metadata]\nmode=bad", 0},
+		{"[metadata]\nmode=poll", defaultPollInterval},
+		{"[metadata]\nmode=poll\npoll_interval_sec=30", 30 * time.Second},
+		{"[metadata]\nmode=poll\npoll_interval_sec=0", defaultPollInterval},
+		{"[metadata]\nmode=poll\npoll_interval_sec=-5", defaultPollInterval},
+	}
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := pollInterval(cfg); got != tt.want {
+			t.Errorf("pollInterval(%q) got: %v, want: %v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestParseMetadataClientConfig(t *testing.T) {
+	var tests = []struct {
+		data string
+		want metadataClientConfig
+	}{
+		{"", metadataClientConfig{maxIdleConns: 2, idleConnTimeout: 90 * time.Second, hangTimeout: defaultHangTimeout, acceptGzip: true}},
+		{"[metadata]\nserver_ip=169.254.169.254\nmax_idle_conns=5\nidle_conn_timeout_sec=10\nhang_timeout_sec=30\naccept_gzip=false",
+			metadataClientConfig{serverIP: "169.254.169.254", maxIdleConns: 5, idleConnTimeout: 10 * time.Second, hangTimeout: 30 * time.Second}},
+		{"[metadata]\nmax_idle_conns=bad\naccept_gzip=bad", metadataClientConfig{maxIdleConns: 2, idleConnTimeout: 90 * time.Second, hangTimeout: defaultHangTimeout, acceptGzip: true}},
+	}
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := len(cfg.Section("metadata").Keys())
+		if got := parseMetadataClientConfig(cfg); got != tt.want {
+			t.Errorf("parseMetadataClientConfig(%q) got: %+v, want: %+v", tt.data, got, tt.want)
+		}
+		if got := len(cfg.Section("metadata").Keys()); got != keys {
+			t.Errorf("parseMetadataClientConfig(%q) wrote defaults to the config, keys got: %d, want: %d", tt.data, got, keys)
+		}
+	}
+}
+
+func TestWatchMetadataReusesConnection(t *testing.T) {
+	oldServer := metadataServer
+	defer func() {
+		metadataServer = oldServer
+		etag = defaultEtag
+		metadataClient = nil
+	}()
+
+	var mu sync.Mutex
+	var requests, conns int
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		// Every other response is unchanged, which watchMetadata discards.
+		w.Header().Set("etag", strconv.Itoa((n+1)/2))
+		w.Write([]byte(`{"instance":{"attributes":{"windows-keys":"keys"}}}`))
+	}))
+	ts.Config.ConnState = func(c net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			mu.Lock()
+			conns++
+			mu.Unlock()
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+	metadataServer = ts.URL
+	etag = defaultEtag
+	metadataClient = nil
+
+	cfg := ini.Empty()
+	for i := 0; i < 5; i++ {
+		if _, err := watchMetadata(context.Background(), cfg); err != nil {
+			t.Fatalf("watchMetadata() returned error: %v", err)
+		}
+		if _, err := getMetadataPath(context.Background(), cfg, "missing"); err == nil {
+			t.Fatal("getMetadataPath() of a missing path returned no error")
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests < 10 {
+		t.Fatalf("got %d requests, want at least 10", requests)
+	}
+	if conns != 1 {
+		t.Errorf("%d requests used %d connections, want 1", requests, conns)
+	}
+}
+
+func TestMetadataGzip(t *testing.T) {
+	oldServer := metadataServer
+	defer func() {
+		metadataServer = oldServer
+		metadataClient = nil
+	}()
+
+	data := largeMetadata(t)
+	var gotEncoding string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotEncoding = r.Header.Get("Accept-Encoding")
+		if gotEncoding != "gzip" {
+			w.Write(data)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		zw.Write(data)
+		zw.Close()
+	}))
+	defer ts.Close()
+	metadataServer = ts.URL
+
+	var tests = []struct {
+		data         []byte
+		wantEncoding string
+		wantLabel    string
+	}{
+		{[]byte(""), "gzip", "gzip"},
+		{[]byte("[metadata]\naccept_gzip=false"), "", "identity"},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		received, decoded := metadataReceivedBytes.values[tt.wantLabel], metadataDecodedBytes.values[tt.wantLabel]
+		md, err := getMetadata(context.Background(), cfg)
+		if err != nil {
+			t.Fatalf("config %q: getMetadata() returned error: %v", tt.data, err)
+		}
+		if gotEncoding != tt.wantEncoding {
+			t.Errorf("config %q: Accept-Encoding got: %q, want: %q", tt.data, gotEncoding, tt.wantEncoding)
+		}
+		if md.Instance.Attributes.SSHKeys == "" {
+			t.Errorf("config %q: getMetadata() did not decode the response", tt.data)
+		}
+
+		received = metadataReceivedBytes.values[tt.wantLabel] - received
+		decoded = metadataDecodedBytes.values[tt.wantLabel] - decoded
+		if decoded != float64(len(data)) {
+			t.Errorf("config %q: decoded bytes got: %v, want: %d", tt.data, decoded, len(data))
+		}
+		if tt.wantLabel == "gzip" && received >= decoded {
+			t.Errorf("config %q: received %v bytes for %v decoded, want fewer", tt.data, received, decoded)
+		}
+		if tt.wantLabel == "identity" && received != decoded {
+			t.Errorf("config %q: received bytes got: %v, want: %v", tt.data, received, decoded)
+		}
+	}
+}
+
+func TestWatchMetadataSubtrees(t *testing.T) {
+	var mu sync.Mutex
+	var requested []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("etag", "1")
+		switch r.URL.Path {
+		case "/instance/attributes/":
+			w.Write([]byte(`{"windows-keys":"key"}`))
+		case "/project/attributes/":
+			w.Write([]byte(`{"enable-wsfc":"true"}`))
+		case "/instance/network-interfaces/":
+			w.Write([]byte(`[{"mac":"42:01:0a:80:00:02","forwardedIps":["1.2.3.4"]}]`))
+		case "/instance/maintenance-event/":
+			w.Write([]byte(`"NONE"`))
+		default:
+			w.Write([]byte(`{"instance":{"attributes":{"windows-keys":"full"}}}`))
+		}
+	}))
+	defer ts.Close()
+
+	oldServer, oldPaths := metadataServer, neededPaths
+	defer func() {
+		metadataServer, neededPaths = oldServer, oldPaths
+		etag = defaultEtag
+		pathEtags = map[string]string{}
+		pathContent = map[string]json.RawMessage{}
+	}()
+	metadataServer = ts.URL
+
+	cfg, err := ini.InsensitiveLoad([]byte("[metadata]\nsubtree_fetch=true"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	neededPaths = (&addresses{}).metadataPaths()
+	md, err := watchMetadata(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("watchMetadata() returned error: %v", err)
+	}
+
+	sort.Strings(requested)
+	want := []string{"/instance/attributes/", "/instance/maintenance-event/", "/instance/network-interfaces/", "/project/attributes/"}
+	if !reflect.DeepEqual(requested, want) {
+		t.Errorf("requested paths got: %q, want: %q", requested, want)
+	}
+	wantMD := &metadataJSON{
+		Instance: instanceJSON{
+			Attributes:        attributesJSON{WindowsKeys: "key"},
+			MaintenanceEvent:  "NONE",
+			NetworkInterfaces: []networkInterfacesJSON{{Mac: "42:01:0a:80:00:02", ForwardedIps: []string{"1.2.3.4"}}},
+		},
+		Project: projectJSON{Attributes: attributesJSON{EnableWSFC: "true"}},
+	}
+	if !reflect.DeepEqual(md, wantMD) {
+		t.Errorf("watchMetadata() got: %+v, want: %+v", md, wantMD)
+	}
+
+	// Without any declared paths the full tree is fetched.
+	requested = nil
+	neededPaths = nil
+	md, err = watchMetadata(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("watchMetadata() returned error: %v", err)
+	}
+	for _, p := range requested {
+		if p != "/" {
+			t.Errorf("requested path got: %q, want: %q", p, "/")
+		}
+	}
+	if md.Instance.Attributes.WindowsKeys != "full" {
+		t.Errorf("watchMetadata() did not return the full tree: %+v", md)
+	}
+}
+
+func TestJSONKey(t *testing.T) {
+	var tests = []struct {
+		elem, want string
+	}{
+		{"instance", "instance"},
+		{"network-interfaces", "networkInterfaces"},
+		{"service-accounts", "serviceAccounts"},
+	}
+	for _, tt := range tests {
+		if got := jsonKey(tt.elem); got != tt.want {
+			t.Errorf("jsonKey(%q) got: %q, want: %q", tt.elem, got, tt.want)
+		}
+	}
+}
+
+func TestWatchMetadataModes(t *testing.T) {
+	var tests = []struct {
+		name     string
+		data     []byte
+		wantWait bool
+	}{
+		{"longpoll by default", []byte(""), true},
+		{"longpoll", []byte("[metadata]\nmode=longpoll"), true},
+		{"poll", []byte("[metadata]\nmode=poll\npoll_interval_sec=1"), false},
+	}
+
+	oldServer := metadataServer
+	defer func() {
+		metadataServer = oldServer
+		etag = defaultEtag
+	}()
+
+	for _, tt := range tests {
+		var queries []url.Values
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			queries = append(queries, r.URL.Query())
+			// The content changes on the third request.
+			if len(queries) < 3 {
+				w.Header().Set("etag", "1")
+				w.Write([]byte(`{"instance":{"attributes":{"windows-keys":"old"}}}`))
+				return
+			}
+			w.Header().Set("etag", "2")
+			w.Write([]byte(`{"instance":{"attributes":{"windows-keys":"new"}}}`))
+		}))
+		metadataServer = ts.URL
+		etag = defaultEtag
+
+		cfg, err := ini.InsensitiveLoad(tt.data)
+		if err != nil {
+			t.Fatalf("test case %q: error parsing config: %v", tt.name, err)
+		}
+		if _, err := watchMetadata(context.Background(), cfg); err != nil {
+			t.Fatalf("test case %q: watchMetadata() returned error: %v", tt.name, err)
+		}
+		md, err := watchMetadata(context.Background(), cfg)
+		if err != nil {
+			t.Fatalf("test case %q: watchMetadata() returned error: %v", tt.name, err)
+		}
+		ts.Close()
+
+		if md.Instance.Attributes.WindowsKeys != "new" {
+			t.Errorf("test case %q: watchMetadata() got: %+v, want updated metadata", tt.name, md)
+		}
+		if len(queries) != 3 {
+			t.Errorf("test case %q: got %d requests, want 3", tt.name, len(queries))
+		}
+		for _, q := range queries {
+			if got := q.Get("wait_for_change") == "true"; got != tt.wantWait {
+				t.Errorf("test case %q: wait_for_change got: %t, want: %t", tt.name, got, tt.wantWait)
+			}
+		}
+		if tt.wantWait && queries[len(queries)-1].Get("last_etag") != "1" {
+			t.Errorf("test case %q: last_etag got: %q, want: %q", tt.name, queries[len(queries)-1].Get("last_etag"), "1")
+		}
+	}
+}
+
+func TestVerifyMetadata(t *testing.T) {
+	md := &metadataJSON{
+		Instance: instanceJSON{ID: 1234567890123456789},
+		Project:  projectJSON{ProjectID: "my-project", NumericProjectID: 123456},
+	}
+
+	var tests = []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"off by default", []byte(""), false},
+		{"project ID matches", []byte("[metadata]\nexpected_project=my-project"), false},
+		{"project number matches", []byte("[metadata]\nexpected_project=123456"), false},
+		{"project mismatch", []byte("[metadata]\nexpected_project=other-project"), true},
+		{"instance matches", []byte("[metadata]\nexpected_instance=1234567890123456789"), false},
+		{"instance mismatch", []byte("[metadata]\nexpected_instance=1234567890123456788"), true},
+		{"project matches, instance mismatch", []byte("[metadata]\nexpected_project=my-project\nexpected_instance=1"), true},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.data)
+		if err != nil {
+			t.Errorf("test case %q: error parsing config: %v", tt.name, err)
+			continue
+		}
+		if err := verifyMetadata(md, cfg); (err != nil) != tt.wantErr {
+			t.Errorf("test case %q: verifyMetadata() error: %v, want error: %t", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestVerifyMetadataParsesIDs(t *testing.T) {
+	var md metadataJSON
+	data := []byte(`{"instance":{"id":1234567890123456789},"project":{"projectId":"my-project","numericProjectId":123456}}`)
+	if err := json.Unmarshal(data, &md); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ini.InsensitiveLoad([]byte("[metadata]\nexpected_project=my-project\nexpected_instance=1234567890123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyMetadata(&md, cfg); err != nil {
+		t.Errorf("verifyMetadata() returned error: %v", err)
+	}
+}
+
+func TestMetadataURLHangTimeout(t *testing.T) {
+	oldCfg := metadataClientCfg
+	defer func() { metadataClientCfg = oldCfg }()
+
+	var tests = []struct {
+		hang time.Duration
+		poll time.Duration
+		want string
+	}{
+		{0, 0, metadataServer + "/instance" + metadataRecursive + "&wait_for_change=true&timeout_sec=60&last_etag=abc"},
+		{300 * time.Second, 0, metadataServer + "/instance" + metadataRecursive + "&wait_for_change=true&timeout_sec=300&last_etag=abc"},
+		{300 * time.Second, time.Second, metadataServer + "/instance" + metadataRecursive},
+	}
+
+	for _, tt := range tests {
+		metadataClientCfg = metadataClientConfig{hangTimeout: tt.hang}
+		if got := metadataURL("/instance", "abc", tt.poll); got != tt.want {
+			t.Errorf("metadataURL() with hang timeout %v, poll %v got: %q, want: %q", tt.hang, tt.poll, got, tt.want)
+		}
+	}
+	if got, want := newMetadataClient(metadataClientConfig{hangTimeout: 300 * time.Second}).Timeout, 310*time.Second; got != want {
+		t.Errorf("client timeout got: %v, want: %v", got, want)
+	}
+}
+
+// largeMetadata returns a metadata document with many SSH keys and network
+// interfaces.
+func largeMetadata(tb testing.TB) []byte {
+	var md metadataJSON
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, fmt.Sprintf("user%d:ssh-rsa %s user%d@example.com", i, strings.Repeat("A", 372), i))
+	}
+	md.Instance.Attributes.SSHKeys = strings.Join(keys, "\n")
+	md.Project.Attributes.SSHKeys = md.Instance.Attributes.SSHKeys
+	for i := 0; i < 8; i++ {
+		md.Instance.NetworkInterfaces = append(md.Instance.NetworkInterfaces, networkInterfacesJSON{
+			Mac:          fmt.Sprintf("42:01:0a:00:00:%02x", i),
+			ForwardedIps: []string{fmt.Sprintf("10.1.%d.1", i), fmt.Sprintf("10.1.%d.2", i)},
+			IPAliases:    []string{fmt.Sprintf("10.2.%d.0/24", i)},
+		})
+	}
+	data, err := json.Marshal(md)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return data
+}
+
+func TestDecodeMetadata(t *testing.T) {
+	data := largeMetadata(t)
+	var want metadataJSON
+	if err := json.Unmarshal(data, &want); err != nil {
+		t.Fatal(err)
+	}
+	// Decode twice so the second run uses a pooled buffer.
+	for i := 0; i < 2; i++ {
+		got, err := decodeMetadata(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("decodeMetadata() returned error: %v", err)
+		}
+		if !reflect.DeepEqual(*got, want) {
+			t.Error("decodeMetadata() did not match json.Unmarshal")
+		}
+	}
+	if _, err := decodeMetadata(strings.NewReader(`{"instance":`)); err == nil {
+		t.Error("decodeMetadata() of a truncated document returned no error")
+	}
+}
+
+func BenchmarkDecodeMetadata(b *testing.B) {
+	data := largeMetadata(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := decodeMetadata(bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkStreamMetadata decodes with a json.Decoder, for comparison.
+func BenchmarkStreamMetadata(b *testing.B) {
+	data := largeMetadata(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		var md metadataJSON
+		if err := json.NewDecoder(bytes.NewReader(data)).Decode(&md); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadAllUnmarshalMetadata reads each document into a new buffer,
+// as watchMetadata used to, for comparison.
+func BenchmarkReadAllUnmarshalMetadata(b *testing.B) {
+	data := largeMetadata(b)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		body, err := ioutil.ReadAll(bytes.NewReader(data))
+		if err != nil {
+			b.Fatal(err)
+		}
+		var md metadataJSON
+		if err := json.Unmarshal(body, &md); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
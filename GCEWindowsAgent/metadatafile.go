@@ -0,0 +1,137 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+var (
+	// metadataFileFlag is set by noservice --metadata-file.
+	metadataFileFlag string
+	// metadataFileInterval is how often the metadata file is checked for
+	// changes.
+	metadataFileInterval = 2 * time.Second
+	// lastMetadataFile is the content of the metadata file last returned by
+	// watchMetadataFile.
+	lastMetadataFile []byte
+)
+
+// metadataFile returns the local JSON file metadata is read from instead of
+// the metadata server, set by --metadata-file or [metadata] file. It lets
+// managers be run end to end outside of GCE, such as in CI. Single paths are
+// read from the file too, writes such as guest attributes are only logged.
+func metadataFile(cfg *ini.File) string {
+	if path := cfg.Section("metadata").Key("file").String(); path != "" {
+		return path
+	}
+	return metadataFileFlag
+}
+
+// kebabToCamel returns the JSON key of a metadata path element, such as
+// networkInterfaces for network-interfaces.
+func kebabToCamel(s string) string {
+	parts := strings.Split(s, "-")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// readMetadataFilePath returns the value of a single metadata path, such as
+// instance/attributes/key, from the file at path. Strings are returned as is
+// like the metadata server does, anything else as JSON.
+func readMetadataFilePath(file, path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	for _, p := range strings.Split(strings.Trim(path, "/"), "/") {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("metadata path %s not found in %s", path, file)
+		}
+		if v, ok = m[p]; !ok {
+			if v, ok = m[kebabToCamel(p)]; !ok {
+				return nil, fmt.Errorf("metadata path %s not found in %s", path, file)
+			}
+		}
+	}
+	if s, ok := v.(string); ok {
+		return []byte(s), nil
+	}
+	return json.Marshal(v)
+}
+
+// readMetadataFile returns the metadata in the file at path, in the format of
+// the recursive metadata server response.
+func readMetadataFile(path string) (*metadataJSON, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var metadata metadataJSON
+	return &metadata, json.Unmarshal(data, &metadata)
+}
+
+// watchMetadataFile returns the metadata in the file at path once its content
+// differs from the last call, like a hanging GET to the metadata server.
+func watchMetadataFile(ctx context.Context, path string) (*metadataJSON, error) {
+	for {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		recordMetadataFetch()
+		if !bytes.Equal(data, lastMetadataFile) {
+			lastMetadataFile = data
+			logger.Debugf("Metadata file %s changed", path)
+			var metadata metadataJSON
+			return &metadata, json.Unmarshal(data, &metadata)
+		}
+		if !sleepCtx(ctx, metadataFileInterval) {
+			return nil, nil
+		}
+	}
+}
+
+// flagValue returns the value of the flag name in args, given as
+// "name=value" or "name value".
+func flagValue(args []string, name string) string {
+	for i, a := range args {
+		if a == name && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(a, name+"=") {
+			return strings.TrimPrefix(a, name+"=")
+		}
+	}
+	return ""
+}
@@ -0,0 +1,168 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+func TestMetadataFile(t *testing.T) {
+	defer func() { metadataFileFlag = "" }()
+
+	var tests = []struct {
+		flag string
+		data []byte
+		want string
+	}{
+		{"", []byte(""), ""},
+		{"flag.json", []byte(""), "flag.json"},
+		{"", []byte("[metadata]\nfile=config.json"), "config.json"},
+		{"flag.json", []byte("[metadata]\nfile=config.json"), "config.json"},
+	}
+
+	for _, tt := range tests {
+		metadataFileFlag = tt.flag
+		cfg, err := ini.InsensitiveLoad(tt.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := metadataFile(cfg); got != tt.want {
+			t.Errorf("metadataFile() with flag %q and config %q got: %q, want: %q", tt.flag, tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestReadMetadataFilePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadatafile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "metadata.json")
+	data := `{"instance":{"id":1,"attributes":{"ssh-keys":"key"},"networkInterfaces":[{"mac":"m"}]}}`
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		path    string
+		want    string
+		wantErr bool
+	}{
+		{"instance/attributes/ssh-keys", "key", false},
+		{"/instance/id", "1", false},
+		{"instance/network-interfaces", `[{"mac":"m"}]`, false},
+		{"instance/attributes/missing", "", true},
+		{"instance/id/missing", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := readMetadataFilePath(file, tt.path)
+		if (err != nil) != tt.wantErr || string(got) != tt.want {
+			t.Errorf("readMetadataFilePath(%q) got: %q, %v, want: %q, error: %t", tt.path, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestFlagValue(t *testing.T) {
+	var tests = []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"--debug"}, ""},
+		{[]string{"--metadata-file=md.json"}, "md.json"},
+		{[]string{"--debug", "--metadata-file", "md.json"}, "md.json"},
+		{[]string{"--metadata-file"}, ""},
+	}
+
+	for _, tt := range tests {
+		if got := flagValue(tt.args, "--metadata-file"); got != tt.want {
+			t.Errorf("flagValue(%q) got: %q, want: %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestWatchMetadataFile(t *testing.T) {
+	oldInterval := metadataFileInterval
+	defer func() {
+		metadataFileInterval = oldInterval
+		lastMetadataFile = nil
+	}()
+	metadataFileInterval = 10 * time.Millisecond
+	lastMetadataFile = nil
+
+	dir, err := ioutil.TempDir("", "metadatafile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metadata.json")
+	if err := ioutil.WriteFile(path, []byte(`{"instance":{"attributes":{"windows-keys":"old"}}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := ini.Empty()
+	cfg.Section("metadata").Key("file").SetValue(path)
+
+	md, err := watchMetadata(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("watchMetadata() returned error: %v", err)
+	}
+	if md.Instance.Attributes.WindowsKeys != "old" {
+		t.Errorf("watchMetadata() got: %+v, want the file content", md)
+	}
+
+	// Unchanged, the watch waits until ctx is done.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	md, err = watchMetadata(ctx, cfg)
+	cancel()
+	if md != nil || err != nil {
+		t.Errorf("watchMetadata() of an unchanged file got: %+v, %v, want: nil, nil", md, err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		// Replaced rather than rewritten so the watch never sees a
+		// partial file.
+		ioutil.WriteFile(path+".tmp", []byte(`{"instance":{"attributes":{"windows-keys":"new"}}}`), 0600)
+		os.Rename(path+".tmp", path)
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	md, err = watchMetadata(ctx, cfg)
+	if err != nil {
+		t.Fatalf("watchMetadata() returned error: %v", err)
+	}
+	if md == nil || md.Instance.Attributes.WindowsKeys != "new" {
+		t.Errorf("watchMetadata() got: %+v, want the new file content", md)
+	}
+
+	if got, err := getMetadata(context.Background(), cfg); err != nil || got.Instance.Attributes.WindowsKeys != "new" {
+		t.Errorf("getMetadata() got: %+v, %v, want the file content", got, err)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := watchMetadata(context.Background(), cfg); err == nil {
+		t.Error("watchMetadata() of a missing file returned no error")
+	}
+}
@@ -0,0 +1,250 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// metric is a counter or histogram written in the Prometheus text format.
+type metric interface {
+	write(w io.Writer)
+}
+
+// counterVec is a counter by the value of one label, label is empty for a
+// counter without labels.
+type counterVec struct {
+	name, help, label string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (c *counterVec) inc(labelValue string) {
+	c.add(labelValue, 1)
+}
+
+func (c *counterVec) add(labelValue string, v float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]float64)
+	}
+	c.values[labelValue] += v
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, lv := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, labels(c.label, lv, ""), formatFloat(c.values[lv]))
+	}
+}
+
+// histogramVec is a histogram by the value of one label, like counterVec.
+type histogramVec struct {
+	name, help, label string
+	buckets           []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogramVec) observe(labelValue string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.series == nil {
+		h.series = make(map[string]*histogramSeries)
+	}
+	s, ok := h.series[labelValue]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[labelValue] = s
+	}
+	for i, b := range h.buckets {
+		if v <= b {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var lvs []string
+	for lv := range h.series {
+		lvs = append(lvs, lv)
+	}
+	sort.Strings(lvs)
+	for _, lv := range lvs {
+		s := h.series[lv]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels(h.label, lv, formatFloat(b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labels(h.label, lv, "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, labels(h.label, lv, ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labels(h.label, lv, ""), s.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// labels formats the label set of a sample, le is the histogram bucket.
+func labels(label, value, le string) string {
+	var l []string
+	if label != "" {
+		l = append(l, fmt.Sprintf("%s=%q", label, value))
+	}
+	if le != "" {
+		l = append(l, fmt.Sprintf("le=%q", le))
+	}
+	if len(l) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(l, ",") + "}"
+}
+
+var durationBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 120, 300, 600}
+
+var (
+	metadataWatchSeconds = &histogramVec{
+		name:    "gce_agent_metadata_watch_seconds",
+		help:    "Time taken by metadata watch requests, including long polls.",
+		buckets: durationBuckets,
+	}
+	metadataWatchErrors = &counterVec{
+		name: "gce_agent_metadata_watch_errors_total",
+		help: "Failed metadata watch requests.",
+	}
+	metadataReceivedBytes = &counterVec{
+		name:  "gce_agent_metadata_received_bytes_total",
+		help:  "Metadata response bytes received, by content encoding.",
+		label: "encoding",
+	}
+	metadataDecodedBytes = &counterVec{
+		name:  "gce_agent_metadata_decoded_bytes_total",
+		help:  "Metadata response bytes after decompression, by content encoding.",
+		label: "encoding",
+	}
+	managerRunSeconds = &histogramVec{
+		name:    "gce_agent_manager_run_seconds",
+		help:    "Time taken to apply changes, by manager.",
+		label:   "manager",
+		buckets: durationBuckets,
+	}
+	managerFailures = &counterVec{
+		name:  "gce_agent_manager_failures_total",
+		help:  "Failed runs, by manager.",
+		label: "manager",
+	}
+	forwardedIPChanges = &counterVec{
+		name:  "gce_agent_forwarded_ips_programmed_total",
+		help:  "Forwarded IPs added or removed.",
+		label: "op",
+	}
+	accountsCreated = &counterVec{
+		name: "gce_agent_accounts_created_total",
+		help: "Local accounts created.",
+	}
+	wsfcProbes = &counterVec{
+		name:  "gce_agent_wsfc_probes_total",
+		help:  "WSFC health checks answered, by reply.",
+		label: "reply",
+	}
+	snapshotFailures = &counterVec{
+		name:  "gce_agent_snapshot_failures_total",
+		help:  "Failed snapshot freeze and thaw requests, by operation.",
+		label: "op",
+	}
+
+	allMetrics = []metric{metadataWatchSeconds, metadataWatchErrors, metadataReceivedBytes, metadataDecodedBytes, managerRunSeconds, managerFailures, forwardedIPChanges, accountsCreated, wsfcProbes, snapshotFailures}
+)
+
+// metricsAddress returns [core] metrics_address. It must be a loopback
+// address, the metrics aren't authenticated.
+func metricsAddress(cfg *ini.File) (string, error) {
+	return loopbackAddress(cfg, "metrics_address")
+}
+
+// loopbackAddress returns the address in the [core] key, an error unless it
+// is a loopback address.
+func loopbackAddress(cfg *ini.File, key string) (string, error) {
+	addr := cfg.Section("core").Key(key).String()
+	if addr == "" {
+		return "", nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s %q: %v", key, addr, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("invalid %s %q, it must be a loopback address", key, addr)
+	}
+	return addr, nil
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range allMetrics {
+		m.write(w)
+	}
+}
+
+// serveMetrics runs the metrics endpoint until ctx is done.
+func serveMetrics(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	logger.Infof("Serving agent metrics on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Errorln("Error serving agent metrics:", err)
+	}
+}
@@ -0,0 +1,108 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+func TestMetricsAddress(t *testing.T) {
+	var tests = []struct {
+		data    string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"[core]\nmetrics_address=localhost:9100", "localhost:9100", false},
+		{"[core]\nmetrics_address=127.0.0.1:9100", "127.0.0.1:9100", false},
+		{"[core]\nmetrics_address=[::1]:9100", "[::1]:9100", false},
+		{"[core]\nmetrics_address=:9100", "", true},
+		{"[core]\nmetrics_address=10.0.0.2:9100", "", true},
+		{"[core]\nmetrics_address=localhost", "", true},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := metricsAddress(cfg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("metricsAddress(%q) error: %v, want error: %t", tt.data, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("metricsAddress(%q) got: %q, want: %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestMetricsWrite(t *testing.T) {
+	c := &counterVec{name: "test_total", help: "Test counter.", label: "op"}
+	c.inc("add")
+	c.inc("add")
+	c.inc("remove")
+	h := &histogramVec{name: "test_seconds", help: "Test histogram.", buckets: []float64{0.5, 1}}
+	h.observe("", 0.25)
+	h.observe("", 2)
+
+	var tests = []struct {
+		name string
+		m    metric
+		want string
+	}{
+		{"counter", c, `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{op="add"} 2
+test_total{op="remove"} 1
+`},
+		{"histogram", h, `# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.5"} 1
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="+Inf"} 2
+test_seconds_sum 2.25
+test_seconds_count 2
+`},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		tt.m.write(&buf)
+		if got := buf.String(); got != tt.want {
+			t.Errorf("test case %q: write() got:\n%s\nwant:\n%s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestHandleMetrics(t *testing.T) {
+	managerFailures.inc("testManager")
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(w.Result().Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"# TYPE gce_agent_metadata_watch_seconds histogram", `gce_agent_manager_failures_total{manager="testManager"} `} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("handleMetrics() output missing %q, got:\n%s", want, body)
+		}
+	}
+}
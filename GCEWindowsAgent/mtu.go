@@ -0,0 +1,217 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+const (
+	// minMTU and maxMTU bound the MTUs of VPC networks.
+	minMTU = 1300
+	maxMTU = 8896
+)
+
+var (
+	mtuDisabled = false
+
+	// mtuInterfaces is replaced in tests.
+	mtuInterfaces = net.Interfaces
+)
+
+type mtu struct {
+	newMetadata, oldMetadata *metadataJSON
+	config                   *ini.File
+}
+
+// wantMTUs returns the MTU of each metadata network interface by MAC address.
+// Interfaces without a valid MTU are left alone.
+func wantMTUs(nis []networkInterfacesJSON) map[string]int {
+	want := make(map[string]int)
+	for _, ni := range nis {
+		mac, err := net.ParseMAC(ni.Mac)
+		if err != nil || ni.Mtu == 0 {
+			continue
+		}
+		if ni.Mtu < minMTU || ni.Mtu > maxMTU {
+			logger.Errorf("Ignoring MTU %d for %s, want %d to %d", ni.Mtu, mac, minMTU, maxMTU)
+			continue
+		}
+		want[mac.String()] = ni.Mtu
+	}
+	return want
+}
+
+// selectMTUs limits want to the adapter selected by [mtu] interface_mac, all
+// of want when it is unset. It is an error if no adapter in ifs has that
+// address, so no other adapter is changed.
+func (m *mtu) selectMTUs(want map[string]int, ifs []net.Interface) (map[string]int, error) {
+	sec := m.config.Section("mtu")
+	if sec.Key("interface_mac").String() == "" {
+		return want, nil
+	}
+	mac, err := selectedMAC(sec, "")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := interfaceByMAC(mac, ifs); err != nil {
+		return nil, err
+	}
+	selected := make(map[string]int)
+	if v, ok := want[mac]; ok {
+		selected[mac] = v
+	}
+	return selected, nil
+}
+
+// mtuChanges returns the MTU to set by interface index for the adapters in
+// ifs whose MTU differs from want.
+func mtuChanges(want map[string]int, ifs []net.Interface) map[int]int {
+	changes := make(map[int]int)
+	for mac, m := range want {
+		iface, err := interfaceByMAC(mac, ifs)
+		if err != nil {
+			continue
+		}
+		if iface.MTU != m {
+			changes[iface.Index] = m
+		}
+	}
+	return changes
+}
+
+func (m *mtu) diff() bool {
+	if changed, ok := mtuPause.diff(mtuPause.migrating(m.newMetadata, m.config)); ok {
+		return changed
+	}
+	want := wantMTUs(m.newMetadata.Instance.NetworkInterfaces)
+	old := wantMTUs(m.oldMetadata.Instance.NetworkInterfaces)
+	if len(want) != len(old) {
+		return true
+	}
+	for mac, v := range want {
+		if old[mac] != v {
+			return true
+		}
+	}
+	// Reapply MTUs changed outside the agent.
+	ifs, err := mtuInterfaces()
+	if err != nil {
+		logger.Error(err)
+		return false
+	}
+	want, err = m.selectMTUs(want, ifs)
+	if err != nil {
+		logger.Error(err)
+		return false
+	}
+	changes := mtuChanges(want, ifs)
+	if len(changes) != 0 {
+		logger.Debugf("MTU changed outside the agent on %d interfaces", len(changes))
+	}
+	return len(changes) != 0
+}
+
+func (m *mtu) metadataPaths() []string {
+	return append([]string{"instance/network-interfaces", "instance/maintenance-event"}, attributePaths...)
+}
+
+func (m *mtu) disabled() (disabled bool) {
+	defer func() {
+		if disabled != mtuDisabled {
+			mtuDisabled = disabled
+			logStatus("MTU", disabled)
+		}
+	}()
+
+	return !m.enablement().Enabled
+}
+
+var mtuEnable = enableRule{
+	section:   "mtu",
+	key:       "disable",
+	attribute: "disable-mtu-manager",
+	value:     func(a attributesJSON) string { return a.DisableMTUManager },
+	inverted:  true,
+}
+
+func (m *mtu) enablement() enablement {
+	return isEnabled(m.config, m.newMetadata, mtuEnable, !mtuDisabled)
+}
+
+// netshMTUArgs returns the netsh arguments to set the persistent MTU of the
+// IPv4 or IPv6 subinterface with index.
+func netshMTUArgs(family string, index, mtu int) []string {
+	return []string{"interface", family, "set", "subinterface", strconv.Itoa(index), "mtu=" + strconv.Itoa(mtu), "store=persistent"}
+}
+
+// plan returns the MTU changes set would make.
+func (m *mtu) plan() ([]string, error) {
+	if mtuPause.migrating(m.newMetadata, m.config) {
+		return []string{"pause until the live migration completes"}, nil
+	}
+	ifs, err := mtuInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	want, err := m.selectMTUs(wantMTUs(m.newMetadata.Instance.NetworkInterfaces), ifs)
+	if err != nil {
+		return nil, err
+	}
+	var changes []string
+	for index, v := range mtuChanges(want, ifs) {
+		changes = append(changes, fmt.Sprintf("set the MTU of interface %d to %d", index, v))
+	}
+	sort.Strings(changes)
+	return changes, nil
+}
+
+// set applies the metadata MTU of each network interface to its adapter, for
+// both IPv4 and IPv6.
+func (m *mtu) set(ctx context.Context) (err error) {
+	if mtuPause.skip(mtuPause.migrating(m.newMetadata, m.config)) {
+		return nil
+	}
+	defer func() { mtuPause.done(err) }()
+	ifs, err := mtuInterfaces()
+	if err != nil {
+		return err
+	}
+	want, err := m.selectMTUs(wantMTUs(m.newMetadata.Instance.NetworkInterfaces), ifs)
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for index, v := range mtuChanges(want, ifs) {
+		logger.Infof("Setting MTU of interface %d to %d.", index, v)
+		for _, f := range []string{"ipv4", "ipv6"} {
+			if out, err := runNetsh(netshMTUArgs(f, index, v)...); err != nil {
+				err = fmt.Errorf("error setting %s MTU of interface %d to %d: %v, output: %s", f, index, v, err, out)
+				logger.Error(err)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	return firstErr
+}
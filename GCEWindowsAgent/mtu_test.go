@@ -0,0 +1,127 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+func TestWantMTUs(t *testing.T) {
+	nis := []networkInterfacesJSON{
+		{Mac: "00:00:00:00:00:01", Mtu: 8896},
+		{Mac: "00:00:00:00:00:02"},
+		{Mac: "00:00:00:00:00:03", Mtu: 9000},
+		{Mac: "00:00:00:00:00:04", Mtu: 1000},
+		{Mac: "bad", Mtu: 1460},
+	}
+	want := map[string]int{"00:00:00:00:00:01": 8896}
+	if got := wantMTUs(nis); !reflect.DeepEqual(got, want) {
+		t.Errorf("wantMTUs() got: %v, want: %v", got, want)
+	}
+}
+
+func TestMTUSet(t *testing.T) {
+	oldRun, oldIfs := runNetsh, mtuInterfaces
+	defer func() { runNetsh, mtuInterfaces = oldRun, oldIfs }()
+
+	mac1, _ := net.ParseMAC("00:00:00:00:00:01")
+	mac2, _ := net.ParseMAC("00:00:00:00:00:02")
+	mtuInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{
+			{Index: 3, MTU: 1460, HardwareAddr: mac1},
+			{Index: 4, MTU: 8896, HardwareAddr: mac2},
+		}, nil
+	}
+	var got []string
+	runNetsh = func(args ...string) ([]byte, error) {
+		got = append(got, strings.Join(args, " "))
+		return nil, nil
+	}
+
+	md := &metadataJSON{Instance: instanceJSON{NetworkInterfaces: []networkInterfacesJSON{
+		{Mac: mac1.String(), Mtu: 8896},
+		{Mac: mac2.String(), Mtu: 8896},
+	}}}
+	m := &mtu{newMetadata: md, oldMetadata: md, config: ini.Empty()}
+	if !m.diff() {
+		t.Error("diff() got: false, want: true for MTU drift")
+	}
+	if err := m.set(context.Background()); err != nil {
+		t.Fatalf("set() error: %v", err)
+	}
+	want := []string{
+		"interface ipv4 set subinterface 3 mtu=8896 store=persistent",
+		"interface ipv6 set subinterface 3 mtu=8896 store=persistent",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("netsh calls got: %q, want: %q", got, want)
+	}
+}
+
+func TestMTUSetInterfaceMAC(t *testing.T) {
+	oldRun, oldIfs := runNetsh, mtuInterfaces
+	defer func() { runNetsh, mtuInterfaces = oldRun, oldIfs }()
+
+	mac1, _ := net.ParseMAC("00:00:00:00:00:01")
+	mac2, _ := net.ParseMAC("00:00:00:00:00:02")
+	mtuInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{
+			{Index: 3, MTU: 1460, HardwareAddr: mac1},
+			{Index: 4, MTU: 1460, HardwareAddr: mac2},
+		}, nil
+	}
+	md := &metadataJSON{Instance: instanceJSON{NetworkInterfaces: []networkInterfacesJSON{
+		{Mac: mac1.String(), Mtu: 8896},
+		{Mac: mac2.String(), Mtu: 8896},
+	}}}
+
+	var tests = []struct {
+		name    string
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{"all", "", []string{"3", "3", "4", "4"}, false},
+		{"matched", "[mtu]\ninterface_mac=00-00-00-00-00-02", []string{"4", "4"}, false},
+		{"unmatched", "[mtu]\ninterface_mac=00:00:00:00:00:09", nil, true},
+		{"invalid", "[mtu]\ninterface_mac=bad", nil, true},
+	}
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		runNetsh = func(args ...string) ([]byte, error) {
+			got = append(got, args[4])
+			return nil, nil
+		}
+		m := &mtu{newMetadata: md, oldMetadata: md, config: cfg}
+		if err := m.set(context.Background()); (err != nil) != tt.wantErr {
+			t.Errorf("test case %q: set() error: %v, want error: %t", tt.name, err, tt.wantErr)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("test case %q: interfaces set got: %q, want: %q", tt.name, got, tt.want)
+		}
+	}
+}
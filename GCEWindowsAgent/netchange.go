@@ -0,0 +1,214 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+const (
+	minFetchBackoff    = 5 * time.Second
+	maxFetchBackoff    = time.Minute
+	defaultFetchJitter = 0.2
+)
+
+// jitterRand is replaced in tests.
+var jitterRand = rand.Float64
+
+// fetchBackoff is the delay after a failed metadata request, doubling from
+// min up to max on every failure. Each delay is shortened by a random part of
+// up to jitter of it, so instances don't retry in lockstep.
+type fetchBackoff struct {
+	mu       sync.Mutex
+	min, max time.Duration
+	jitter   float64
+	cur      time.Duration
+	// wake ends a pending wait early.
+	wake chan struct{}
+}
+
+func newFetchBackoff(min, max time.Duration, jitter float64) *fetchBackoff {
+	return &fetchBackoff{min: min, max: max, jitter: jitter, cur: min, wake: make(chan struct{}, 1)}
+}
+
+// backoffSeconds returns the duration in seconds of key in sec, def if it is
+// unset or not positive, which would retry in a busy loop.
+func backoffSeconds(sec *ini.Section, key string, def time.Duration) time.Duration {
+	n := sec.Key(key).MustInt(int(def / time.Second))
+	if n < 1 {
+		logger.Errorf("Invalid %s %d, using %d", key, n, int(def/time.Second))
+		return def
+	}
+	return time.Duration(n) * time.Second
+}
+
+// configure sets the backoff from [metadata] retry_interval_sec,
+// max_backoff_sec and backoff_jitter. The intervals are at least a second.
+func (b *fetchBackoff) configure(cfg *ini.File) {
+	sec := cfg.Section("metadata")
+	min := backoffSeconds(sec, "retry_interval_sec", minFetchBackoff)
+	max := backoffSeconds(sec, "max_backoff_sec", maxFetchBackoff)
+	jitter := sec.Key("backoff_jitter").MustFloat64(defaultFetchJitter)
+	if max < min {
+		max = min
+	}
+	if jitter < 0 || jitter > 1 {
+		logger.Errorf("Invalid backoff_jitter %v, using %v", jitter, defaultFetchJitter)
+		jitter = defaultFetchJitter
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.min, b.max, b.jitter = min, max, jitter
+	if b.cur < min {
+		b.cur = min
+	}
+	if b.cur > max {
+		b.cur = max
+	}
+}
+
+// wait sleeps for the current delay and doubles it for the next failure. It
+// returns early when kicked and returns false if ctx is done.
+func (b *fetchBackoff) wait(ctx context.Context) bool {
+	b.mu.Lock()
+	d := b.cur - time.Duration(float64(b.cur)*b.jitter*jitterRand())
+	if b.cur *= 2; b.cur > b.max {
+		b.cur = b.max
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-b.wake:
+		return true
+	case <-time.After(d):
+		return true
+	}
+}
+
+// reset returns the delay to min after a successful request.
+func (b *fetchBackoff) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cur = b.min
+	// Drop a kick that arrived while nothing was waiting.
+	select {
+	case <-b.wake:
+	default:
+	}
+}
+
+// kick resets the delay and ends a pending wait, so the next request is made
+// right away.
+func (b *fetchBackoff) kick() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cur = b.min
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+}
+
+// watchFailures counts consecutive failed metadata watches, so that a
+// prolonged outage is logged louder than a transient error.
+type watchFailures struct {
+	count int
+	since time.Time
+}
+
+// watchErrorSeverity returns how the count-th consecutive failure is logged:
+// the first at debug level as most are transient, the following ones as
+// warnings and, from the threshold-th on, every threshold failures as errors.
+// It returns "" for failures not logged.
+func watchErrorSeverity(count, threshold int) string {
+	switch {
+	case count <= 1:
+		return "debug"
+	case count < threshold:
+		return "warning"
+	case (count-threshold)%threshold == 0:
+		return "error"
+	default:
+		return ""
+	}
+}
+
+// failed logs err as the next consecutive failure. [metadata]
+// error_after_failures is the number of failures logged as errors.
+func (w *watchFailures) failed(cfg *ini.File, err error) {
+	w.count++
+	if w.count == 1 {
+		w.since = time.Now()
+	}
+	threshold := cfg.Section("metadata").Key("error_after_failures").MustInt(3)
+	if threshold < 2 {
+		threshold = 2
+	}
+	switch watchErrorSeverity(w.count, threshold) {
+	case "debug":
+		logger.Debugf("Error watching metadata: %v", err)
+	case "warning":
+		logger.Warnf("Error watching metadata (%d consecutive failures): %v", w.count, err)
+	case "error":
+		if urlErr, ok := err.(*url.Error); ok {
+			if _, ok := urlErr.Err.(*net.DNSError); ok {
+				logger.Error("DNS error when requesting metadata, check DNS settings and ensure metadata.internal.google is setup in your hosts file.")
+			}
+			if _, ok := urlErr.Err.(*net.OpError); ok {
+				logger.Error("Network error when requesting metadata, make sure your instance has an active network and can reach the metadata server.")
+			}
+		}
+		logger.Errorf("Metadata unreachable for %s, %d consecutive failures: %v", time.Since(w.since).Round(time.Second), w.count, err)
+	}
+}
+
+// succeeded resets the count, logging the recovery from failures that were
+// logged as warnings or errors.
+func (w *watchFailures) succeeded() {
+	if w.count > 1 {
+		logger.Infof("Metadata reachable again after %d consecutive failures over %s.", w.count, time.Since(w.since).Round(time.Second))
+	}
+	w.count = 0
+}
+
+// netChangeWait is replaced in tests.
+var netChangeWait = waitAddrChange
+
+// watchNetworkChanges kicks b whenever the local IP address table changes,
+// so metadata is fetched as soon as the network is back instead of after the
+// backoff. It is enabled by [metadata] watch_network_changes.
+func watchNetworkChanges(ctx context.Context, b *fetchBackoff) {
+	for {
+		if err := netChangeWait(); err != nil {
+			logger.Errorln("Error watching for network changes:", err)
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		b.kick()
+	}
+}
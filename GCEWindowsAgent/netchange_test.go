@@ -0,0 +1,180 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+func TestFetchBackoff(t *testing.T) {
+	b := newFetchBackoff(time.Millisecond, 4*time.Millisecond, 0)
+	for _, want := range []time.Duration{2, 4, 4} {
+		b.wait(context.Background())
+		if b.cur != want*time.Millisecond {
+			t.Errorf("backoff after wait got: %v, want: %v", b.cur, want*time.Millisecond)
+		}
+	}
+	b.reset()
+	if b.cur != time.Millisecond {
+		t.Errorf("backoff after reset got: %v, want: %v", b.cur, time.Millisecond)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if b.wait(ctx) {
+		t.Error("wait() with a done context returned true")
+	}
+}
+
+func TestFetchBackoffConfigure(t *testing.T) {
+	oldRand := jitterRand
+	defer func() { jitterRand = oldRand }()
+	jitterRand = func() float64 { return 1 }
+
+	var tests = []struct {
+		name     string
+		data     []byte
+		min, max time.Duration
+		jitter   float64
+	}{
+		{"defaults", []byte(""), minFetchBackoff, maxFetchBackoff, defaultFetchJitter},
+		{"configured", []byte("[metadata]\nretry_interval_sec=10\nmax_backoff_sec=300\nbackoff_jitter=0.5"), 10 * time.Second, 300 * time.Second, 0.5},
+		{"max below min", []byte("[metadata]\nretry_interval_sec=10\nmax_backoff_sec=1"), 10 * time.Second, 10 * time.Second, defaultFetchJitter},
+		{"zero retry interval", []byte("[metadata]\nretry_interval_sec=0"), minFetchBackoff, maxFetchBackoff, defaultFetchJitter},
+		{"negative intervals", []byte("[metadata]\nretry_interval_sec=-5\nmax_backoff_sec=-1"), minFetchBackoff, maxFetchBackoff, defaultFetchJitter},
+		{"invalid jitter", []byte("[metadata]\nbackoff_jitter=2"), minFetchBackoff, maxFetchBackoff, defaultFetchJitter},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := newFetchBackoff(time.Millisecond, time.Millisecond, 0)
+		b.configure(cfg)
+		if b.min != tt.min || b.max != tt.max || b.jitter != tt.jitter || b.cur != tt.min {
+			t.Errorf("test case %q: got min %v, max %v, jitter %v, cur %v, want %v, %v, %v, %v", tt.name, b.min, b.max, b.jitter, b.cur, tt.min, tt.max, tt.jitter, tt.min)
+		}
+	}
+
+	// With full jitter the wait can be cut to nothing.
+	b := newFetchBackoff(time.Hour, time.Hour, 1)
+	done := make(chan bool)
+	go func() { done <- b.wait(context.Background()) }()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("jitter did not shorten the wait")
+	}
+}
+
+func TestFetchBackoffKick(t *testing.T) {
+	b := newFetchBackoff(time.Hour, time.Hour, 0)
+	done := make(chan bool)
+	go func() { done <- b.wait(context.Background()) }()
+
+	// A kick ends the pending wait and resets the delay.
+	b.kick()
+	select {
+	case ok := <-done:
+		if !ok {
+			t.Error("wait() ended by a kick returned false")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("kick() did not end the pending wait")
+	}
+	if b.cur != time.Hour {
+		t.Errorf("backoff after kick got: %v, want: %v", b.cur, time.Hour)
+	}
+
+	// A success drops a kick made while nothing was waiting.
+	b.kick()
+	b.reset()
+	select {
+	case <-b.wake:
+		t.Error("reset() did not drop the pending kick")
+	default:
+	}
+}
+
+func TestWatchNetworkChanges(t *testing.T) {
+	oldWait := netChangeWait
+	defer func() { netChangeWait = oldWait }()
+
+	b := newFetchBackoff(time.Millisecond, time.Hour, 0)
+	b.cur = time.Hour
+	var changes int
+	netChangeWait = func() error {
+		if changes == 1 {
+			return errors.New("stop")
+		}
+		changes++
+		return nil
+	}
+
+	watchNetworkChanges(context.Background(), b)
+	if b.cur != time.Millisecond {
+		t.Errorf("backoff after network change got: %v, want: %v", b.cur, time.Millisecond)
+	}
+	select {
+	case <-b.wake:
+	default:
+		t.Error("network change did not kick the backoff")
+	}
+}
+
+func TestWatchErrorSeverity(t *testing.T) {
+	var tests = []struct {
+		count, threshold int
+		want             string
+	}{
+		{1, 3, "debug"},
+		{2, 3, "warning"},
+		{3, 3, "error"},
+		{4, 3, ""},
+		{5, 3, ""},
+		{6, 3, "error"},
+		{9, 3, "error"},
+		{2, 2, "error"},
+		{3, 2, ""},
+		{4, 2, "error"},
+	}
+
+	for _, tt := range tests {
+		if got := watchErrorSeverity(tt.count, tt.threshold); got != tt.want {
+			t.Errorf("watchErrorSeverity(%d, %d) = %q, want %q", tt.count, tt.threshold, got, tt.want)
+		}
+	}
+}
+
+func TestWatchFailures(t *testing.T) {
+	var w watchFailures
+	cfg := ini.Empty()
+	for i := 0; i < 4; i++ {
+		w.failed(cfg, errors.New("unreachable"))
+	}
+	if w.count != 4 || w.since.IsZero() {
+		t.Errorf("after 4 failures got count %d since %v", w.count, w.since)
+	}
+	w.succeeded()
+	if w.count != 0 {
+		t.Errorf("count after success got: %d, want: 0", w.count)
+	}
+}
@@ -0,0 +1,60 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+)
+
+// runNetsh is replaced in tests.
+var runNetsh = func(args ...string) ([]byte, error) {
+	return exec.Command("netsh.exe", args...).CombinedOutput()
+}
+
+// netshAddressArgs returns the netsh arguments to add or delete ip on the
+// interface with index. Added addresses are not used as source addresses, as
+// with the IP Helper API.
+func netshAddressArgs(op string, ip, mask net.IP, index uint32) []string {
+	if ip.To4() == nil {
+		args := []string{"interface", "ipv6", op, "address", fmt.Sprintf("interface=%d", index), "address=" + ip.String()}
+		if op == "add" {
+			args = append(args, "skipassource=true")
+		}
+		return args
+	}
+	args := []string{"interface", "ipv4", op, "address", fmt.Sprintf("name=%d", index), "address=" + ip.String()}
+	if op == "add" {
+		args = append(args, "mask="+mask.String(), "skipassource=true")
+	}
+	return args
+}
+
+// netshAddAddress and netshRemoveAddress replace addAddress and
+// removeAddress when [addressManager] use_netsh is set.
+func netshAddAddress(ip, mask net.IP, index uint32) error {
+	if out, err := runNetsh(netshAddressArgs("add", ip, mask, index)...); err != nil {
+		return fmt.Errorf("error adding address %s with netsh: %v, output: %s", ip, err, out)
+	}
+	return nil
+}
+
+func netshRemoveAddress(ip net.IP, index uint32) error {
+	if out, err := runNetsh(netshAddressArgs("delete", ip, nil, index)...); err != nil {
+		return fmt.Errorf("error removing address %s with netsh: %v, output: %s", ip, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNetshAddressArgs(t *testing.T) {
+	mask := net.ParseIP("255.255.255.255")
+	var tests = []struct {
+		op   string
+		ip   string
+		want string
+	}{
+		{"add", "10.1.0.5", "interface ipv4 add address name=4 address=10.1.0.5 mask=255.255.255.255 skipassource=true"},
+		{"delete", "10.1.0.5", "interface ipv4 delete address name=4 address=10.1.0.5"},
+		{"add", "fd00::1", "interface ipv6 add address interface=4 address=fd00::1 skipassource=true"},
+		{"delete", "fd00::1", "interface ipv6 delete address interface=4 address=fd00::1"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(netshAddressArgs(tt.op, net.ParseIP(tt.ip), mask, 4), " "); got != tt.want {
+			t.Errorf("netshAddressArgs(%q, %q) got: %q, want: %q", tt.op, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestNetshAddAddress(t *testing.T) {
+	oldRun := runNetsh
+	defer func() { runNetsh = oldRun }()
+
+	var got [][]string
+	runNetsh = func(args ...string) ([]byte, error) {
+		got = append(got, args)
+		return []byte("The object already exists."), errors.New("exit status 1")
+	}
+	if err := netshAddAddress(net.ParseIP("10.1.0.5"), net.ParseIP("255.255.255.255"), 4); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("netshAddAddress() error got: %v, want netsh output", err)
+	}
+	if err := netshRemoveAddress(net.ParseIP("10.1.0.5"), 4); err == nil {
+		t.Error("netshRemoveAddress() returned no error")
+	}
+	want := [][]string{
+		netshAddressArgs("add", net.ParseIP("10.1.0.5"), net.ParseIP("255.255.255.255"), 4),
+		netshAddressArgs("delete", net.ParseIP("10.1.0.5"), nil, 4),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("netsh calls got: %q, want: %q", got, want)
+	}
+}
@@ -0,0 +1,486 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os/user"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+const (
+	// osLoginRegName is a REG_MULTI_SZ value under regKeyBase holding the
+	// local users provisioned from OS Login, so only those are ever
+	// deprovisioned.
+	osLoginRegName = "OSLoginUsers"
+
+	defaultOSLoginRefresh = 5 * time.Minute
+	osLoginPageSize       = 1000
+)
+
+var (
+	osLoginDisabled = true
+
+	osLoginMu       sync.Mutex
+	lastOSLoginSync time.Time
+	// osLoginActive is set while the last set provisioned users, so
+	// osLoginLoop only fetches metadata while OS Login is in use.
+	osLoginActive bool
+
+	// osLoginRecheck is how often osLoginLoop checks if a refresh is due.
+	osLoginRecheck = time.Minute
+
+	// osLoginAPI and localUsers are replaced in tests.
+	osLoginAPI osLoginService   = metadataOSLogin{}
+	localUsers localUserManager = systemLocalUsers{}
+
+	// readOSLoginState and writeOSLoginState are replaced in tests.
+	readOSLoginState = func() ([]string, error) {
+		return readRegMultiString(regKeyBase, osLoginRegName)
+	}
+	writeOSLoginState = func(s []string) error {
+		return writeRegMultiString(regKeyBase, osLoginRegName, s)
+	}
+)
+
+// osLoginUserJSON is a local user provisioned from an OS Login profile.
+type osLoginUserJSON struct {
+	Username string
+	// Email is the Google account of the profile.
+	Email string
+	Admin bool
+}
+
+// osLoginService is the OS Login API, as proxied by the metadata server.
+type osLoginService interface {
+	// users lists the login profiles allowed on the instance.
+	users(ctx context.Context, cfg *ini.File) ([]osLoginUserJSON, error)
+	// admin reports whether email has the adminLogin policy.
+	admin(ctx context.Context, cfg *ini.File, email string) (bool, error)
+}
+
+// localUserManager provisions local Windows users.
+type localUserManager interface {
+	exists(username string) bool
+	create(username, group string) error
+	remove(username string) error
+	addToGroup(username, group string) error
+	removeFromGroup(username, group string) error
+}
+
+type metadataOSLogin struct{}
+
+type osLoginUsersJSON struct {
+	LoginProfiles []struct {
+		Name          string
+		PosixAccounts []struct {
+			Username string
+			Primary  bool
+		}
+	}
+	NextPageToken string
+}
+
+func (metadataOSLogin) users(ctx context.Context, cfg *ini.File) ([]osLoginUserJSON, error) {
+	var users []osLoginUserJSON
+	var token string
+	for {
+		path := fmt.Sprintf("oslogin/users?pagesize=%d", osLoginPageSize)
+		if token != "" {
+			path += "&pagetoken=" + url.QueryEscape(token)
+		}
+		data, err := getMetadataPath(ctx, cfg, path)
+		if err != nil {
+			return nil, err
+		}
+		var resp osLoginUsersJSON
+		if err := json.Unmarshal(data, &resp); err != nil {
+			return nil, fmt.Errorf("error parsing OS Login users: %v", err)
+		}
+		for _, p := range resp.LoginProfiles {
+			for _, a := range p.PosixAccounts {
+				if a.Primary && a.Username != "" {
+					users = append(users, osLoginUserJSON{Username: a.Username, Email: p.Name})
+				}
+			}
+		}
+		if resp.NextPageToken == "" || resp.NextPageToken == "0" {
+			return users, nil
+		}
+		token = resp.NextPageToken
+	}
+}
+
+func (metadataOSLogin) admin(ctx context.Context, cfg *ini.File, email string) (bool, error) {
+	data, err := getMetadataPath(ctx, cfg, "oslogin/authorize?policy=adminLogin&email="+url.QueryEscape(email))
+	if err != nil {
+		return false, err
+	}
+	var resp struct{ Success bool }
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return false, fmt.Errorf("error parsing OS Login authorization: %v", err)
+	}
+	return resp.Success, nil
+}
+
+type systemLocalUsers struct{}
+
+func (systemLocalUsers) exists(username string) bool {
+	_, err := user.Lookup(username)
+	return err == nil
+}
+
+// create adds a user with a random password, users set their own with a
+// password reset.
+func (systemLocalUsers) create(username, group string) error {
+	policy, err := getPasswordPolicy()
+	if err != nil {
+		logger.Errorln("Error reading password policy, using defaults:", err)
+	}
+	pwd, err := newPwd(policy)
+	if err != nil {
+		return fmt.Errorf("error creating password: %v", err)
+	}
+	return createUser(username, pwd, group)
+}
+
+func (systemLocalUsers) remove(username string) error { return deleteUser(username) }
+
+func (systemLocalUsers) addToGroup(username, group string) error {
+	return addToGroup(username, group)
+}
+
+func (systemLocalUsers) removeFromGroup(username, group string) error {
+	return removeFromGroup(username, group)
+}
+
+type osLogin struct {
+	newMetadata, oldMetadata *metadataJSON
+	config                   *ini.File
+}
+
+func osLoginRefresh(cfg *ini.File) time.Duration {
+	return time.Duration(cfg.Section("osLogin").Key("refresh_interval_sec").MustInt(int(defaultOSLoginRefresh/time.Second))) * time.Second
+}
+
+// refreshDue reports whether the users were last synced longer than
+// [osLogin] refresh_interval_sec ago. IAM changes are not visible in
+// metadata, so users are synced periodically.
+func (o *osLogin) refreshDue() bool {
+	osLoginMu.Lock()
+	defer osLoginMu.Unlock()
+	return time.Since(lastOSLoginSync) >= osLoginRefresh(o.config)
+}
+
+func (o *osLogin) diff() bool {
+	// Only reached when disabled if provisioned users remain.
+	if !o.enablement().Enabled {
+		return true
+	}
+	return o.newMetadata.Instance.Attributes.EnableOSLogin != o.oldMetadata.Instance.Attributes.EnableOSLogin ||
+		o.newMetadata.Project.Attributes.EnableOSLogin != o.oldMetadata.Project.Attributes.EnableOSLogin ||
+		o.newMetadata.Instance.Attributes.EnableOSLogin2FA != o.oldMetadata.Instance.Attributes.EnableOSLogin2FA ||
+		o.newMetadata.Project.Attributes.EnableOSLogin2FA != o.oldMetadata.Project.Attributes.EnableOSLogin2FA ||
+		o.refreshDue()
+}
+
+func (o *osLogin) metadataPaths() []string {
+	return attributePaths
+}
+
+func (o *osLogin) disabled() (disabled bool) {
+	defer func() {
+		if disabled != osLoginDisabled {
+			osLoginDisabled = disabled
+			logStatus("OS Login", disabled)
+		}
+	}()
+
+	return !o.enablement().Enabled && !o.hasManagedUsers()
+}
+
+// hasManagedUsers reports whether users provisioned from OS Login remain, to
+// remove once it is disabled.
+func (o *osLogin) hasManagedUsers() bool {
+	managed, err := o.readState()
+	if err != nil {
+		logger.Error(err)
+		return false
+	}
+	return len(managed) != 0
+}
+
+var osLoginEnable = enableRule{
+	section:   "osLogin",
+	key:       "enable",
+	attribute: "enable-oslogin",
+	value:     func(a attributesJSON) string { return a.EnableOSLogin },
+}
+
+// OS Login is opt-in and disabled by default.
+func (o *osLogin) enablement() enablement {
+	return isEnabled(o.config, o.newMetadata, osLoginEnable, !osLoginDisabled)
+}
+
+// twoFactor reports whether OS Login 2-step verification is required, the
+// instance attribute takes precedence.
+func (o *osLogin) twoFactor() bool {
+	if b, err := strconv.ParseBool(o.newMetadata.Instance.Attributes.EnableOSLogin2FA); err == nil {
+		return b
+	}
+	b, _ := strconv.ParseBool(o.newMetadata.Project.Attributes.EnableOSLogin2FA)
+	return b
+}
+
+// wantUsers returns the users of the OS Login profiles allowed on the
+// instance, with their adminLogin policy.
+func (o *osLogin) wantUsers(ctx context.Context) ([]osLoginUserJSON, error) {
+	users, err := osLoginAPI.users(ctx, o.config)
+	if err != nil {
+		return nil, fmt.Errorf("error listing OS Login users: %v", err)
+	}
+	var want []osLoginUserJSON
+	for _, u := range users {
+		admin, err := osLoginAPI.admin(ctx, o.config, u.Email)
+		if err != nil {
+			return nil, fmt.Errorf("error checking OS Login admin policy for %s: %v", u.Email, err)
+		}
+		u.Admin = admin
+		want = append(want, u)
+	}
+	return want, nil
+}
+
+// plan returns the users set would create, change and remove. The profiles
+// are listed from the OS Login API.
+func (o *osLogin) plan() ([]string, error) {
+	enabled := o.enablement().Enabled
+	if enabled && o.twoFactor() {
+		return nil, nil
+	}
+	var want []osLoginUserJSON
+	if enabled {
+		var err error
+		if want, err = o.wantUsers(context.Background()); err != nil {
+			return nil, err
+		}
+	}
+	managed, err := o.readState()
+	if err != nil {
+		return nil, err
+	}
+	group := o.config.Section("osLogin").Key("default_group").MustString(defaultNonAdminGroup)
+	return planOSLoginUsers(want, managed, group), nil
+}
+
+// set provisions a local user for every OS Login profile, in the
+// Administrators group for profiles with the adminLogin policy, and removes
+// users it provisioned whose profile is gone, or all of them once OS Login is
+// disabled. Existing local users it did not create are never changed.
+// Windows password logins can't enforce 2-step verification, so when it is
+// required users are left as they are.
+func (o *osLogin) set(ctx context.Context) error {
+	enabled := o.enablement().Enabled
+	if enabled && o.twoFactor() {
+		logger.Error("OS Login 2-step verification is required and can't be enforced for Windows logins, not changing OS Login users.")
+		osLoginMu.Lock()
+		lastOSLoginSync, osLoginActive = time.Now(), false
+		osLoginMu.Unlock()
+		return nil
+	}
+	var want []osLoginUserJSON
+	if !enabled {
+		logger.Info("OS Login is disabled, removing the users it provisioned.")
+	} else {
+		var err error
+		if want, err = o.wantUsers(ctx); err != nil {
+			return err
+		}
+	}
+
+	managed, err := o.readState()
+	if err != nil {
+		return err
+	}
+	group := o.config.Section("osLogin").Key("default_group").MustString(defaultNonAdminGroup)
+	managed, errs := reconcileOSLoginUsers(want, managed, group)
+	for _, err := range errs {
+		logger.Error(err)
+	}
+
+	osLoginMu.Lock()
+	lastOSLoginSync, osLoginActive = time.Now(), enabled
+	osLoginMu.Unlock()
+	if err := o.writeState(managed); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d OS Login users failed to provision", len(errs))
+	}
+	return nil
+}
+
+// planOSLoginUsers returns the changes reconcileOSLoginUsers would make.
+func planOSLoginUsers(want []osLoginUserJSON, managed map[string]osLoginUserJSON, group string) []string {
+	var changes []string
+	wanted := map[string]bool{}
+	for _, u := range want {
+		wanted[u.Username] = true
+		old, ok := managed[u.Username]
+		switch {
+		case !ok && !localUsers.exists(u.Username):
+			g := group
+			if u.Admin {
+				g = adminGroup
+			}
+			changes = append(changes, fmt.Sprintf("create OS Login user %s in group %s", u.Username, g))
+		case ok && u.Admin && !old.Admin:
+			changes = append(changes, fmt.Sprintf("add OS Login user %s to %s", u.Username, adminGroup))
+		case ok && !u.Admin && old.Admin:
+			changes = append(changes, fmt.Sprintf("remove OS Login user %s from %s", u.Username, adminGroup))
+		}
+	}
+	var removed []string
+	for name := range managed {
+		if !wanted[name] {
+			removed = append(removed, name)
+		}
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		changes = append(changes, fmt.Sprintf("remove OS Login user %s", name))
+	}
+	return changes
+}
+
+// reconcileOSLoginUsers provisions want and deprovisions the managed users
+// not in it. It returns the users now managed.
+func reconcileOSLoginUsers(want []osLoginUserJSON, managed map[string]osLoginUserJSON, group string) (map[string]osLoginUserJSON, []error) {
+	var errs []error
+	wanted := map[string]bool{}
+	for _, u := range want {
+		wanted[u.Username] = true
+		old, ok := managed[u.Username]
+		if !ok {
+			if localUsers.exists(u.Username) {
+				logger.Infof("Local user %s exists and was not created by OS Login, not changing it", u.Username)
+				continue
+			}
+			g := group
+			if u.Admin {
+				g = adminGroup
+			}
+			logger.Infof("Creating OS Login user %s in group %s", u.Username, g)
+			if err := localUsers.create(u.Username, g); err != nil {
+				errs = append(errs, fmt.Errorf("error creating OS Login user %s: %v", u.Username, err))
+				continue
+			}
+			managed[u.Username] = u
+			continue
+		}
+
+		var err error
+		switch {
+		case u.Admin && !old.Admin:
+			logger.Infof("Adding OS Login user %s to %s", u.Username, adminGroup)
+			err = localUsers.addToGroup(u.Username, adminGroup)
+		case !u.Admin && old.Admin:
+			logger.Infof("Removing OS Login user %s from %s", u.Username, adminGroup)
+			err = localUsers.removeFromGroup(u.Username, adminGroup)
+			if err == nil {
+				// Keep the user able to log in.
+				err = localUsers.addToGroup(u.Username, group)
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error updating OS Login user %s: %v", u.Username, err))
+			continue
+		}
+		managed[u.Username] = u
+	}
+
+	for name := range managed {
+		if wanted[name] {
+			continue
+		}
+		logger.Infof("Removing OS Login user %s", name)
+		if err := localUsers.remove(name); err != nil {
+			errs = append(errs, fmt.Errorf("error removing OS Login user %s: %v", name, err))
+			continue
+		}
+		delete(managed, name)
+	}
+	return managed, errs
+}
+
+func (o *osLogin) readState() (map[string]osLoginUserJSON, error) {
+	entries, err := readOSLoginState()
+	if err != nil && err != errRegNotExist {
+		return nil, err
+	}
+	managed := map[string]osLoginUserJSON{}
+	for _, e := range entries {
+		var u osLoginUserJSON
+		if err := json.Unmarshal([]byte(e), &u); err != nil {
+			logger.Errorf("Invalid OS Login user entry %q: %v", e, err)
+			continue
+		}
+		managed[u.Username] = u
+	}
+	return managed, nil
+}
+
+func (o *osLogin) writeState(managed map[string]osLoginUserJSON) error {
+	var entries []string
+	for _, u := range managed {
+		data, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, string(data))
+	}
+	sort.Strings(entries)
+	return writeOSLoginState(entries)
+}
+
+// osLoginLoop syncs OS Login users every [osLogin] refresh_interval_sec while
+// OS Login is in use, independent of metadata changes. Enabling OS Login is
+// left to the update cycle.
+func osLoginLoop(ctx context.Context) {
+	periodicLoop(ctx, periodicTask{
+		name:     "OS Login refresh",
+		interval: every(osLoginRecheck),
+		due: func(cfg *ini.File, _ time.Time) bool {
+			osLoginMu.Lock()
+			active := osLoginActive
+			osLoginMu.Unlock()
+			return active && (&osLogin{config: cfg}).refreshDue()
+		},
+		run: func(ctx context.Context, cfg *ini.File) error {
+			return runScheduledManager(ctx, cfg, "osLogin", func(md, _ *metadataJSON, cfg *ini.File) manager {
+				return &osLogin{newMetadata: md, oldMetadata: md, config: cfg}
+			})
+		},
+	})
+}
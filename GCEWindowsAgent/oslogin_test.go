@@ -0,0 +1,285 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+type fakeOSLogin struct {
+	profiles []osLoginUserJSON
+	admins   map[string]bool
+}
+
+func (f *fakeOSLogin) users(context.Context, *ini.File) ([]osLoginUserJSON, error) {
+	return f.profiles, nil
+}
+
+func (f *fakeOSLogin) admin(_ context.Context, _ *ini.File, email string) (bool, error) {
+	return f.admins[email], nil
+}
+
+// fakeLocalUsers maps each user to its groups.
+type fakeLocalUsers map[string][]string
+
+func (f fakeLocalUsers) exists(username string) bool {
+	_, ok := f[username]
+	return ok
+}
+
+func (f fakeLocalUsers) create(username, group string) error {
+	f[username] = []string{group}
+	return nil
+}
+
+func (f fakeLocalUsers) remove(username string) error {
+	delete(f, username)
+	return nil
+}
+
+func (f fakeLocalUsers) addToGroup(username, group string) error {
+	if !containsString(group, f[username]) {
+		f[username] = append(f[username], group)
+	}
+	return nil
+}
+
+func (f fakeLocalUsers) removeFromGroup(username, group string) error {
+	var groups []string
+	for _, g := range f[username] {
+		if g != group {
+			groups = append(groups, g)
+		}
+	}
+	f[username] = groups
+	return nil
+}
+
+func TestOSLoginSet(t *testing.T) {
+	oldAPI, oldUsers, oldRead, oldWrite := osLoginAPI, localUsers, readOSLoginState, writeOSLoginState
+	defer func() {
+		osLoginAPI, localUsers, readOSLoginState, writeOSLoginState = oldAPI, oldUsers, oldRead, oldWrite
+	}()
+	var state []string
+	readOSLoginState = func() ([]string, error) { return state, nil }
+	writeOSLoginState = func(s []string) error {
+		state = s
+		return nil
+	}
+	// carol is a local user not created by OS Login.
+	users := fakeLocalUsers{"carol": {"Users"}}
+	localUsers = users
+	api := &fakeOSLogin{}
+	osLoginAPI = api
+
+	alice := osLoginUserJSON{Username: "alice", Email: "alice@example.com"}
+	bob := osLoginUserJSON{Username: "bob", Email: "bob@example.com"}
+	carol := osLoginUserJSON{Username: "carol", Email: "carol@example.com"}
+
+	var tests = []struct {
+		name      string
+		profiles  []osLoginUserJSON
+		admins    map[string]bool
+		twoFactor string
+		disabled  bool
+		want      fakeLocalUsers
+	}{
+		{
+			"provision",
+			[]osLoginUserJSON{alice, bob, carol},
+			map[string]bool{"alice@example.com": true, "carol@example.com": true},
+			"",
+			false,
+			fakeLocalUsers{"alice": {adminGroup}, "bob": {defaultNonAdminGroup}, "carol": {"Users"}},
+		},
+		{
+			"admin revoked and user removed from IAM",
+			[]osLoginUserJSON{alice},
+			nil,
+			"",
+			false,
+			fakeLocalUsers{"alice": {defaultNonAdminGroup}, "carol": {"Users"}},
+		},
+		{
+			"admin granted and user added",
+			[]osLoginUserJSON{alice, bob},
+			map[string]bool{"alice@example.com": true},
+			"false",
+			false,
+			fakeLocalUsers{"alice": {defaultNonAdminGroup, adminGroup}, "bob": {defaultNonAdminGroup}, "carol": {"Users"}},
+		},
+		{
+			"2-step verification required leaves users",
+			[]osLoginUserJSON{alice},
+			nil,
+			"true",
+			false,
+			fakeLocalUsers{"alice": {defaultNonAdminGroup, adminGroup}, "bob": {defaultNonAdminGroup}, "carol": {"Users"}},
+		},
+		{
+			"OS Login disabled",
+			[]osLoginUserJSON{alice, bob},
+			nil,
+			"",
+			true,
+			fakeLocalUsers{"carol": {"Users"}},
+		},
+	}
+
+	for _, tt := range tests {
+		api.profiles, api.admins = tt.profiles, tt.admins
+		md := &metadataJSON{}
+		md.Project.Attributes.EnableOSLogin = strconv.FormatBool(!tt.disabled)
+		md.Instance.Attributes.EnableOSLogin2FA = tt.twoFactor
+		o := &osLogin{newMetadata: md, oldMetadata: md, config: ini.Empty()}
+		if got := o.disabled(); got {
+			t.Errorf("test case %q: disabled() with provisioned users got: true, want: false", tt.name)
+		}
+		if err := o.set(context.Background()); err != nil {
+			t.Errorf("test case %q: osLogin.set(context.Background()) returned error: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(users, tt.want) {
+			t.Errorf("test case %q: local users got: %v, want: %v", tt.name, users, tt.want)
+		}
+		if o.refreshDue() {
+			t.Errorf("test case %q: refresh due right after a sync", tt.name)
+		}
+	}
+	// carol was never managed.
+	if len(state) != 0 {
+		t.Errorf("managed users after deprovisioning: %q", state)
+	}
+}
+
+func TestPlanOSLoginUsers(t *testing.T) {
+	oldUsers := localUsers
+	defer func() { localUsers = oldUsers }()
+	localUsers = fakeLocalUsers{"local": {"Users"}}
+
+	want := []osLoginUserJSON{
+		{Username: "new", Admin: true},
+		{Username: "local"},
+		{Username: "promoted", Admin: true},
+		{Username: "demoted"},
+		{Username: "same"},
+	}
+	managed := map[string]osLoginUserJSON{
+		"promoted": {Username: "promoted"},
+		"demoted":  {Username: "demoted", Admin: true},
+		"same":     {Username: "same"},
+		"gone":     {Username: "gone"},
+	}
+	got := planOSLoginUsers(want, managed, "Users")
+	wantPlan := []string{
+		"create OS Login user new in group " + adminGroup,
+		"add OS Login user promoted to " + adminGroup,
+		"remove OS Login user demoted from " + adminGroup,
+		"remove OS Login user gone",
+	}
+	if !reflect.DeepEqual(got, wantPlan) {
+		t.Errorf("planOSLoginUsers() got: %q, want: %q", got, wantPlan)
+	}
+	if len(managed) != 4 {
+		t.Errorf("planOSLoginUsers() changed the managed users: %v", managed)
+	}
+}
+
+func TestOSLoginEnablement(t *testing.T) {
+	var tests = []struct {
+		instance, project string
+		cfg               []byte
+		want              bool
+	}{
+		{"", "", []byte(""), false},
+		{"", "true", []byte(""), true},
+		{"false", "true", []byte(""), false},
+		{"true", "", []byte("[osLogin]\nenable=false"), false},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		md := &metadataJSON{}
+		md.Instance.Attributes.EnableOSLogin = tt.instance
+		md.Project.Attributes.EnableOSLogin = tt.project
+		osLoginDisabled = true
+		if got := (&osLogin{newMetadata: md, config: cfg}).disabled(); got == tt.want {
+			t.Errorf("instance %q, project %q, config %q: disabled() got: %t, want: %t", tt.instance, tt.project, tt.cfg, got, !tt.want)
+		}
+	}
+	osLoginDisabled = true
+}
+
+func TestMetadataOSLogin(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		q := r.URL.Query()
+		switch r.URL.Path {
+		case "/oslogin/users":
+			if q.Get("pagetoken") == "" {
+				fmt.Fprint(w, `{"loginProfiles":[{"name":"alice@example.com","posixAccounts":[{"username":"alice_old"},{"username":"alice","primary":true}]}],"nextPageToken":"next"}`)
+				return
+			}
+			fmt.Fprint(w, `{"loginProfiles":[{"name":"bob@example.com","posixAccounts":[{"username":"bob","primary":true}]}],"nextPageToken":"0"}`)
+		case "/oslogin/authorize":
+			fmt.Fprintf(w, `{"success":%t}`, q.Get("policy") == "adminLogin" && q.Get("email") == "alice@example.com")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	oldServer := metadataServer
+	defer func() { metadataServer = oldServer }()
+	metadataServer = ts.URL
+
+	users, err := metadataOSLogin{}.users(context.Background(), ini.Empty())
+	if err != nil {
+		t.Fatalf("users() returned error: %v", err)
+	}
+	want := []osLoginUserJSON{
+		{Username: "alice", Email: "alice@example.com"},
+		{Username: "bob", Email: "bob@example.com"},
+	}
+	if !reflect.DeepEqual(users, want) {
+		t.Errorf("users() got: %+v, want: %+v", users, want)
+	}
+
+	var admins []string
+	for _, u := range users {
+		admin, err := metadataOSLogin{}.admin(context.Background(), ini.Empty(), u.Email)
+		if err != nil {
+			t.Fatalf("admin(%q) returned error: %v", u.Email, err)
+		}
+		if admin {
+			admins = append(admins, u.Email)
+		}
+	}
+	if !reflect.DeepEqual(admins, []string{"alice@example.com"}) {
+		t.Errorf("admins got: %q, want: %q", admins, []string{"alice@example.com"})
+	}
+}
@@ -0,0 +1,334 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+var pagefileDisabled = true
+
+// pagefileJSON is the page file configuration of a single volume. Sizes are
+// in megabytes, 0 for both lets Windows size the page file.
+type pagefileJSON struct {
+	Drive   string
+	Initial uint32
+	Max     uint32
+}
+
+// normalizeDrive returns drive as an upper case drive letter and colon, e.g.
+// "d", "d:" and `D:\` all return "D:".
+func normalizeDrive(drive string) (string, error) {
+	d := strings.ToUpper(strings.TrimRight(drive, `:\`))
+	if len(d) != 1 || d[0] < 'A' || d[0] > 'Z' {
+		return "", fmt.Errorf("invalid page file drive %q", drive)
+	}
+	return d + ":", nil
+}
+
+// pagefileManager is the interface to the Win32_PageFileSetting WMI class.
+type pagefileManager interface {
+	list() ([]pagefileJSON, error)
+	set(pagefileJSON) error
+	remove(drive string) error
+}
+
+// wmiPagefileManager manages page files through WMI with PowerShell.
+type wmiPagefileManager struct{}
+
+func pagefileName(drive string) string {
+	return drive + `\pagefile.sys`
+}
+
+func runPowershell(script string) ([]byte, error) {
+	return exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", script).CombinedOutput()
+}
+
+func (wmiPagefileManager) list() ([]pagefileJSON, error) {
+	out, err := runPowershell(`Get-CimInstance Win32_PageFileSetting | ForEach-Object { '{0},{1},{2}' -f $_.Name,$_.InitialSize,$_.MaximumSize }`)
+	if err != nil {
+		return nil, fmt.Errorf("error listing page files: %v, output: %s", err, out)
+	}
+	return parsePagefileList(out)
+}
+
+func parsePagefileList(out []byte) ([]pagefileJSON, error) {
+	var pfs []pagefileJSON
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		if len(fields) != 3 || len(fields[0]) < 2 {
+			return nil, fmt.Errorf("unexpected page file setting %q", line)
+		}
+		drive, err := normalizeDrive(fields[0][:2])
+		if err != nil {
+			return nil, err
+		}
+		initial, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		max, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		pfs = append(pfs, pagefileJSON{Drive: drive, Initial: uint32(initial), Max: uint32(max)})
+	}
+	return pfs, scanner.Err()
+}
+
+func (wmiPagefileManager) set(pf pagefileJSON) error {
+	// Page file settings are ignored while Windows manages the page file.
+	script := fmt.Sprintf(`Get-CimInstance Win32_ComputerSystem | Set-CimInstance -Property @{AutomaticManagedPagefile=$false}; `+
+		`$n='%s'; $p=@{InitialSize=[uint32]%d; MaximumSize=[uint32]%d}; `+
+		`$s=Get-CimInstance Win32_PageFileSetting | Where-Object Name -eq $n; `+
+		`if ($s) { $s | Set-CimInstance -Property $p } else { $p.Name=$n; New-CimInstance -ClassName Win32_PageFileSetting -Property $p | Out-Null }`,
+		pagefileName(pf.Drive), pf.Initial, pf.Max)
+	if out, err := runPowershell(script); err != nil {
+		return fmt.Errorf("error setting page file on %s: %v, output: %s", pf.Drive, err, out)
+	}
+	return nil
+}
+
+func (wmiPagefileManager) remove(drive string) error {
+	script := fmt.Sprintf(`Get-CimInstance Win32_PageFileSetting | Where-Object Name -eq '%s' | Remove-CimInstance`, pagefileName(drive))
+	if out, err := runPowershell(script); err != nil {
+		return fmt.Errorf("error removing page file from %s: %v, output: %s", drive, err, out)
+	}
+	return nil
+}
+
+var (
+	pagefileMgr pagefileManager = wmiPagefileManager{}
+	// driveExists is replaced in tests.
+	driveExists = func(drive string) bool {
+		_, err := os.Stat(drive + `\`)
+		return err == nil
+	}
+)
+
+type pagefiles struct {
+	newMetadata, oldMetadata *metadataJSON
+	config                   *ini.File
+}
+
+func (p *pagefiles) diff() bool {
+	return !reflect.DeepEqual(p.newMetadata.Instance.Attributes.PageFiles, p.oldMetadata.Instance.Attributes.PageFiles) ||
+		!reflect.DeepEqual(p.newMetadata.Project.Attributes.PageFiles, p.oldMetadata.Project.Attributes.PageFiles)
+}
+
+func (p *pagefiles) metadataPaths() []string {
+	return attributePaths
+}
+
+func (p *pagefiles) diffPaths() []string {
+	return []string{"instance/attributes/page-files", "project/attributes/page-files"}
+}
+
+func (p *pagefiles) disabled() (disabled bool) {
+	defer func() {
+		if disabled != pagefileDisabled {
+			pagefileDisabled = disabled
+			logStatus("pagefile", disabled)
+		}
+	}()
+
+	return !p.enablement().Enabled
+}
+
+// [pagefile] manage turns page file management on, it is off by default.
+func (p *pagefiles) enablement() enablement {
+	return isEnabled(p.config, p.newMetadata, enableRule{section: "pagefile", key: "manage"}, false)
+}
+
+// desiredPagefiles returns the page files from the config file, or instance
+// and then project metadata.
+func (p *pagefiles) desiredPagefiles() []pagefileJSON {
+	data := p.config.Section("pagefile").Key("files").String()
+	if data == "" {
+		data = p.newMetadata.Instance.Attributes.PageFiles
+	}
+	if data == "" {
+		data = p.newMetadata.Project.Attributes.PageFiles
+	}
+	return parsePagefiles(data)
+}
+
+// parsePagefiles parses a JSON list of page files, skipping invalid and
+// duplicate drives.
+func parsePagefiles(data string) []pagefileJSON {
+	if data == "" {
+		return nil
+	}
+
+	var pfs []pagefileJSON
+	if err := json.Unmarshal([]byte(data), &pfs); err != nil {
+		logger.Errorln("Error parsing page files:", err)
+		return nil
+	}
+
+	var drives []string
+	var desired []pagefileJSON
+	for _, pf := range pfs {
+		drive, err := normalizeDrive(pf.Drive)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		if pf.Max < pf.Initial {
+			logger.Errorf("Page file on %s has maximum size %d smaller than initial size %d, ignoring", drive, pf.Max, pf.Initial)
+			continue
+		}
+		if containsString(drive, drives) {
+			logger.Errorf("Duplicate page file drive %s in configuration, ignoring %+v", drive, pf)
+			continue
+		}
+		pf.Drive = drive
+		drives = append(drives, drive)
+		desired = append(desired, pf)
+	}
+	return desired
+}
+
+// plan returns the page files set would set and remove.
+func (p *pagefiles) plan() ([]string, error) {
+	desired := p.desiredPagefiles()
+	if len(desired) == 0 {
+		return nil, nil
+	}
+	current, err := pagefileMgr.list()
+	if err != nil {
+		return nil, err
+	}
+
+	var changes, drives []string
+	for _, pf := range desired {
+		if !driveExists(pf.Drive) {
+			continue
+		}
+		drives = append(drives, pf.Drive)
+		var found bool
+		for _, c := range current {
+			if c == pf {
+				found = true
+				break
+			}
+		}
+		if !found {
+			changes = append(changes, fmt.Sprintf("set the page file on %s to initial size %d MB, maximum size %d MB", pf.Drive, pf.Initial, pf.Max))
+		}
+	}
+	for _, c := range current {
+		// Never leave the system without a page file.
+		if len(drives) != 0 && !containsString(c.Drive, drives) {
+			changes = append(changes, fmt.Sprintf("remove the page file from %s", c.Drive))
+		}
+	}
+	if len(changes) != 0 {
+		changes = append(changes, "request a reboot")
+	}
+	return changes, nil
+}
+
+func (p *pagefiles) set(ctx context.Context) error {
+	desired := p.desiredPagefiles()
+	if len(desired) == 0 {
+		// Never remove every page file because of missing configuration.
+		logger.Info("No page files configured, leaving page files unchanged.")
+		return nil
+	}
+
+	current, err := pagefileMgr.list()
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	fail := func(err error) {
+		logger.Error(err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	var changed bool
+	// drives are the desired page file drives that exist, in place are
+	// those that have their desired page file.
+	var drives, inPlace []string
+	for _, pf := range desired {
+		if !driveExists(pf.Drive) {
+			fail(fmt.Errorf("drive %s for page file does not exist, skipping", pf.Drive))
+			continue
+		}
+		drives = append(drives, pf.Drive)
+		var found bool
+		for _, c := range current {
+			if c == pf {
+				found = true
+				break
+			}
+		}
+		if found {
+			inPlace = append(inPlace, pf.Drive)
+			continue
+		}
+		logger.Infof("Setting page file on %s to initial size %d MB, maximum size %d MB", pf.Drive, pf.Initial, pf.Max)
+		if err := pagefileMgr.set(pf); err != nil {
+			fail(err)
+			continue
+		}
+		inPlace = append(inPlace, pf.Drive)
+		changed = true
+	}
+
+	for _, c := range current {
+		if containsString(c.Drive, drives) {
+			continue
+		}
+		if len(inPlace) == 0 {
+			// Never leave the system without a page file.
+			fail(fmt.Errorf("no configured page file could be set, keeping the page file on %s", c.Drive))
+			continue
+		}
+		logger.Infof("Removing page file from %s", c.Drive)
+		if err := pagefileMgr.remove(c.Drive); err != nil {
+			fail(err)
+			continue
+		}
+		changed = true
+	}
+
+	if changed {
+		logger.Info("Page file changes take effect after the next reboot.")
+		requestReboot(p.config, "pagefile")
+	}
+	return firstErr
+}
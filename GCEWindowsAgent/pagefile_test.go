@@ -0,0 +1,209 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+type fakePagefileManager struct {
+	current []pagefileJSON
+	applied []pagefileJSON
+	removed []string
+	setErr  error
+}
+
+func (f *fakePagefileManager) list() ([]pagefileJSON, error) {
+	return f.current, nil
+}
+
+func (f *fakePagefileManager) set(pf pagefileJSON) error {
+	if f.setErr != nil {
+		return f.setErr
+	}
+	f.applied = append(f.applied, pf)
+	return nil
+}
+
+func (f *fakePagefileManager) remove(drive string) error {
+	f.removed = append(f.removed, drive)
+	return nil
+}
+
+func TestNormalizeDrive(t *testing.T) {
+	var tests = []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{"d", "D:", false},
+		{"D:", "D:", false},
+		{`d:\`, "D:", false},
+		{"", "", true},
+		{"DD:", "", true},
+		{"1:", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := normalizeDrive(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("normalizeDrive(%q) = %q, %v, want %q, error %t", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParsePagefileList(t *testing.T) {
+	got, err := parsePagefileList([]byte("C:\\pagefile.sys,0,0\r\nd:\\pagefile.sys,1024,4096\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("parsePagefileList() returned error: %v", err)
+	}
+	want := []pagefileJSON{{"C:", 0, 0}, {"D:", 1024, 4096}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsePagefileList() got: %+v, want: %+v", got, want)
+	}
+
+	if _, err := parsePagefileList([]byte("C:\\pagefile.sys,0")); err == nil {
+		t.Error("parsePagefileList() with malformed line returned nil error")
+	}
+}
+
+func TestPagefileDisabled(t *testing.T) {
+	var tests = []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"not explicitly enabled", []byte(""), true},
+		{"enabled in cfg", []byte("[Pagefile]\nmanage=true"), false},
+		{"disabled in cfg", []byte("[Pagefile]\nmanage=false"), true},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.data)
+		if err != nil {
+			t.Errorf("test case %q: error parsing config: %v", tt.name, err)
+			continue
+		}
+		got := (&pagefiles{newMetadata: &metadataJSON{}, config: cfg}).disabled()
+		if got != tt.want {
+			t.Errorf("test case %q, pagefiles.disabled() got: %t, want: %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPagefilesSet(t *testing.T) {
+	oldMgr, oldExists, oldPut := pagefileMgr, driveExists, putGuestAttribute
+	defer func() {
+		pagefileMgr, driveExists, putGuestAttribute = oldMgr, oldExists, oldPut
+		pendingReboot = pendingRebootJSON{}
+	}()
+	putGuestAttribute = func(*ini.File, string, string) error { return nil }
+	driveExists = func(drive string) bool { return drive != "E:" }
+
+	var tests = []struct {
+		name        string
+		files       string
+		current     []pagefileJSON
+		setErr      error
+		wantSet     []pagefileJSON
+		wantRemoved []string
+		wantErr     bool
+	}{
+		{
+			"add data drive and remove system drive",
+			`[{"drive":"D","initial":1024,"max":4096}]`,
+			[]pagefileJSON{{"C:", 0, 0}},
+			nil,
+			[]pagefileJSON{{"D:", 1024, 4096}},
+			[]string{"C:"},
+			false,
+		},
+		{
+			"multiple drives, one unchanged",
+			`[{"drive":"C:","initial":0,"max":0},{"drive":"d:","initial":2048,"max":2048}]`,
+			[]pagefileJSON{{"C:", 0, 0}, {"D:", 1024, 4096}},
+			nil,
+			[]pagefileJSON{{"D:", 2048, 2048}},
+			nil,
+			false,
+		},
+		{
+			"missing drive is skipped",
+			`[{"drive":"C","initial":0,"max":0},{"drive":"E","initial":1024,"max":1024}]`,
+			[]pagefileJSON{{"C:", 0, 0}},
+			nil,
+			nil,
+			nil,
+			true,
+		},
+		{
+			"every drive missing keeps the current page file",
+			`[{"drive":"E","initial":1024,"max":1024}]`,
+			[]pagefileJSON{{"C:", 0, 0}},
+			nil,
+			nil,
+			nil,
+			true,
+		},
+		{
+			"failed set keeps the current page file",
+			`[{"drive":"D","initial":1024,"max":1024}]`,
+			[]pagefileJSON{{"C:", 0, 0}},
+			errors.New("set failed"),
+			nil,
+			nil,
+			true,
+		},
+		{
+			"invalid and duplicate entries are ignored",
+			`[{"drive":"D","initial":1024,"max":1024},{"drive":"d:","initial":1,"max":1},{"drive":"F","initial":2048,"max":1024}]`,
+			nil,
+			nil,
+			[]pagefileJSON{{"D:", 1024, 1024}},
+			nil,
+			false,
+		},
+		{
+			"nothing configured leaves page files alone",
+			"",
+			[]pagefileJSON{{"C:", 0, 0}},
+			nil,
+			nil,
+			nil,
+			false,
+		},
+	}
+
+	for _, tt := range tests {
+		fake := &fakePagefileManager{current: tt.current, setErr: tt.setErr}
+		pagefileMgr = fake
+		md := &metadataJSON{}
+		md.Instance.Attributes.PageFiles = tt.files
+		p := &pagefiles{newMetadata: md, oldMetadata: &metadataJSON{}, config: ini.Empty()}
+		if err := p.set(context.Background()); (err != nil) != tt.wantErr {
+			t.Errorf("test case %q: set() returned error: %v, want error: %t", tt.name, err, tt.wantErr)
+		}
+		if !reflect.DeepEqual(fake.applied, tt.wantSet) {
+			t.Errorf("test case %q: set page files got: %+v, want: %+v", tt.name, fake.applied, tt.wantSet)
+		}
+		if !reflect.DeepEqual(fake.removed, tt.wantRemoved) {
+			t.Errorf("test case %q: removed page files got: %q, want: %q", tt.name, fake.removed, tt.wantRemoved)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+const (
+	perfTuneRegName = "PerfTune"
+
+	tcpipParams    = `SYSTEM\CurrentControlSet\Services\Tcpip\Parameters`
+	afdParams      = `SYSTEM\CurrentControlSet\Services\AFD\Parameters`
+	diskParams     = `SYSTEM\CurrentControlSet\Services\Disk`
+	priorityParams = `SYSTEM\CurrentControlSet\Control\PriorityControl`
+)
+
+// regTweak is a REG_DWORD value under HKEY_LOCAL_MACHINE.
+type regTweak struct {
+	Key   string
+	Name  string
+	Value uint32
+}
+
+// perfProfile is a vetted bundle of registry tweaks. Bump Version whenever
+// Tweaks change so instances running the profile are reconciled.
+type perfProfile struct {
+	Version        int
+	RebootRequired bool
+	Tweaks         []regTweak
+}
+
+var perfProfiles = map[string]perfProfile{
+	"high-throughput": {
+		Version:        1,
+		RebootRequired: true,
+		Tweaks: []regTweak{
+			{tcpipParams, "MaxUserPort", 65534},
+			{tcpipParams, "TcpTimedWaitDelay", 30},
+			{tcpipParams, "Tcp1323Opts", 1},
+			{diskParams, "TimeOutValue", 60},
+		},
+	},
+	"low-latency": {
+		Version:        1,
+		RebootRequired: true,
+		Tweaks: []regTweak{
+			{tcpipParams, "TcpTimedWaitDelay", 30},
+			{afdParams, "FastSendDatagramThreshold", 1500},
+			{priorityParams, "Win32PrioritySeparation", 38},
+		},
+	},
+}
+
+// dwordRegistry reads and writes REG_DWORD values.
+type dwordRegistry interface {
+	get(key, name string) (uint32, error)
+	set(key, name string, value uint32) error
+	remove(key, name string) error
+}
+
+type systemDwordRegistry struct{}
+
+func (systemDwordRegistry) get(key, name string) (uint32, error) {
+	return readRegDword(key, name)
+}
+
+func (systemDwordRegistry) set(key, name string, value uint32) error {
+	return writeRegDword(key, name, value)
+}
+
+func (systemDwordRegistry) remove(key, name string) error {
+	return deleteRegKey(key, name)
+}
+
+// regOriginalJSON is a value replaced by a profile, Existed is false if the
+// profile created it.
+type regOriginalJSON struct {
+	Key     string
+	Name    string
+	Value   uint32
+	Existed bool
+}
+
+// perfTuneStateJSON is the applied profile and the values it replaced, so the
+// profile can be reverted.
+type perfTuneStateJSON struct {
+	Profile   string
+	Version   int
+	Originals []regOriginalJSON
+}
+
+func (s *perfTuneStateJSON) original(key, name string) bool {
+	for _, o := range s.Originals {
+		if strings.EqualFold(o.Key, key) && strings.EqualFold(o.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	perfTuneReg   dwordRegistry = systemDwordRegistry{}
+	perfTuneState *perfTuneStateJSON
+
+	// readPerfTuneState and writePerfTuneState are replaced in tests.
+	readPerfTuneState = func() ([]string, error) {
+		return readRegMultiString(regKeyBase, perfTuneRegName)
+	}
+	writePerfTuneState = func(s []string) error {
+		return writeRegMultiString(regKeyBase, perfTuneRegName, s)
+	}
+)
+
+// loadPerfTuneState returns the applied profile state, reading it from the
+// registry on first use so a profile applied by a previous run can still be
+// reverted.
+func loadPerfTuneState() *perfTuneStateJSON {
+	if perfTuneState != nil {
+		return perfTuneState
+	}
+	perfTuneState = &perfTuneStateJSON{}
+	data, err := readPerfTuneState()
+	if err != nil && err != errRegNotExist {
+		logger.Error(err)
+	}
+	if err == nil && len(data) != 0 {
+		if err := json.Unmarshal([]byte(data[0]), perfTuneState); err != nil {
+			logger.Error(err)
+		}
+	}
+	return perfTuneState
+}
+
+type perfTune struct {
+	config *ini.File
+}
+
+// profile returns the configured profile name, "" for none.
+func (p *perfTune) profile() string {
+	profile := strings.ToLower(p.config.Section("perfTune").Key("profile").String())
+	if profile == "none" {
+		return ""
+	}
+	return profile
+}
+
+func (p *perfTune) diff() bool {
+	state := loadPerfTuneState()
+	name := p.profile()
+	profile, ok := perfProfiles[name]
+	if name != state.Profile || profile.Version != state.Version {
+		return true
+	}
+	if !ok {
+		return false
+	}
+	// Reconcile values changed outside the agent.
+	for _, t := range profile.Tweaks {
+		if v, err := perfTuneReg.get(t.Key, t.Name); err != nil || v != t.Value {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *perfTune) metadataPaths() []string {
+	// Only configurable locally.
+	return []string{}
+}
+
+func (p *perfTune) disabled() bool {
+	// Always enabled so a removed profile is reverted.
+	return false
+}
+
+func (p *perfTune) enablement() enablement {
+	return enablement{Enabled: true, Source: sourceDefault}
+}
+
+// revert restores the values replaced by the applied profile.
+func revertPerfTune(state *perfTuneStateJSON) error {
+	var firstErr error
+	var remaining []regOriginalJSON
+	for _, o := range state.Originals {
+		var err error
+		if o.Existed {
+			err = perfTuneReg.set(o.Key, o.Name, o.Value)
+		} else {
+			err = perfTuneReg.remove(o.Key, o.Name)
+			if err == errRegNotExist {
+				err = nil
+			}
+		}
+		if err != nil {
+			logger.Errorf("Error reverting %s\\%s: %v", o.Key, o.Name, err)
+			remaining = append(remaining, o)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	state.Originals = remaining
+	return firstErr
+}
+
+// plan returns the profile set would revert and the values it would set.
+func (p *perfTune) plan() ([]string, error) {
+	state := loadPerfTuneState()
+	name := p.profile()
+	profile, ok := perfProfiles[name]
+	if name != "" && !ok {
+		return nil, fmt.Errorf("unknown performance profile %q", name)
+	}
+
+	var changes []string
+	var reboot bool
+	if state.Profile != "" && (state.Profile != name || state.Version != profile.Version) {
+		changes = append(changes, fmt.Sprintf("revert performance profile %s version %d", state.Profile, state.Version))
+		old, known := perfProfiles[state.Profile]
+		reboot = !known || old.RebootRequired
+	}
+	for _, t := range profile.Tweaks {
+		if v, err := perfTuneReg.get(t.Key, t.Name); err == nil && v == t.Value {
+			continue
+		}
+		changes = append(changes, fmt.Sprintf("set %s\\%s to %d for performance profile %s", t.Key, t.Name, t.Value, name))
+		reboot = reboot || profile.RebootRequired
+	}
+	if reboot {
+		changes = append(changes, "request a reboot")
+	}
+	return changes, nil
+}
+
+func (p *perfTune) set(ctx context.Context) error {
+	state := loadPerfTuneState()
+	name := p.profile()
+	profile, ok := perfProfiles[name]
+	if name != "" && !ok {
+		return fmt.Errorf("unknown performance profile %q", name)
+	}
+
+	var reboot, changed bool
+	if state.Profile != "" && (state.Profile != name || state.Version != profile.Version) {
+		logger.Infof("Reverting performance profile %s version %d", state.Profile, state.Version)
+		if err := revertPerfTune(state); err != nil {
+			// Keep the old profile recorded so the revert is retried.
+			p.saveState(state)
+			return err
+		}
+		old, known := perfProfiles[state.Profile]
+		reboot = !known || old.RebootRequired
+		state.Profile, state.Version, changed = "", 0, true
+	}
+
+	var firstErr error
+	if name != "" {
+		if state.Profile == "" {
+			logger.Infof("Applying performance profile %s version %d", name, profile.Version)
+		}
+		state.Profile, state.Version = name, profile.Version
+		for _, t := range profile.Tweaks {
+			v, err := perfTuneReg.get(t.Key, t.Name)
+			if err == nil && v == t.Value {
+				continue
+			}
+			if !state.original(t.Key, t.Name) {
+				state.Originals = append(state.Originals, regOriginalJSON{Key: t.Key, Name: t.Name, Value: v, Existed: err == nil})
+			}
+			if err := perfTuneReg.set(t.Key, t.Name, t.Value); err != nil {
+				logger.Errorf("Error setting %s\\%s: %v", t.Key, t.Name, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+			changed = true
+			reboot = reboot || profile.RebootRequired
+		}
+	}
+
+	if changed {
+		p.saveState(state)
+	}
+	if reboot {
+		logger.Info("Performance tuning changes take effect after the next reboot.")
+		requestReboot(p.config, "perfTune")
+	}
+	return firstErr
+}
+
+func (p *perfTune) saveState(state *perfTuneStateJSON) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	if err := writePerfTuneState([]string{string(data)}); err != nil {
+		logger.Error(err)
+	}
+}
@@ -0,0 +1,165 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+type fakeDwordRegistry map[string]uint32
+
+func (f fakeDwordRegistry) get(key, name string) (uint32, error) {
+	v, ok := f[key+`\`+name]
+	if !ok {
+		return 0, errRegNotExist
+	}
+	return v, nil
+}
+
+func (f fakeDwordRegistry) set(key, name string, value uint32) error {
+	f[key+`\`+name] = value
+	return nil
+}
+
+func (f fakeDwordRegistry) remove(key, name string) error {
+	if _, ok := f[key+`\`+name]; !ok {
+		return errRegNotExist
+	}
+	delete(f, key+`\`+name)
+	return nil
+}
+
+func TestPerfProfiles(t *testing.T) {
+	for name, profile := range perfProfiles {
+		if name != strings.ToLower(name) || name == "none" {
+			t.Errorf("profile %q: names must be lower case and not none", name)
+		}
+		if profile.Version < 1 {
+			t.Errorf("profile %q: version %d, want at least 1", name, profile.Version)
+		}
+		if len(profile.Tweaks) == 0 {
+			t.Errorf("profile %q has no tweaks", name)
+		}
+		seen := map[string]bool{}
+		for _, tweak := range profile.Tweaks {
+			k := strings.ToLower(tweak.Key + `\` + tweak.Name)
+			if seen[k] {
+				t.Errorf("profile %q sets %s twice", name, k)
+			}
+			seen[k] = true
+		}
+	}
+}
+
+func TestPerfTuneReconcile(t *testing.T) {
+	oldReg, oldState, oldRead, oldWrite, oldPut := perfTuneReg, perfTuneState, readPerfTuneState, writePerfTuneState, putGuestAttribute
+	defer func() {
+		perfTuneReg, perfTuneState, readPerfTuneState, writePerfTuneState, putGuestAttribute = oldReg, oldState, oldRead, oldWrite, oldPut
+		pendingReboot = pendingRebootJSON{}
+	}()
+	putGuestAttribute = func(*ini.File, string, string) error { return nil }
+
+	var saved []string
+	readPerfTuneState = func() ([]string, error) { return saved, nil }
+	writePerfTuneState = func(s []string) error {
+		saved = s
+		return nil
+	}
+	perfTuneState = nil
+
+	initial := fakeDwordRegistry{
+		tcpipParams + `\MaxUserPort`:       5000,
+		tcpipParams + `\TcpTimedWaitDelay`: 240,
+	}
+	reg := fakeDwordRegistry{}
+	for k, v := range initial {
+		reg[k] = v
+	}
+	perfTuneReg = reg
+
+	profileValues := func(name string) fakeDwordRegistry {
+		want := fakeDwordRegistry{}
+		for k, v := range initial {
+			want[k] = v
+		}
+		for _, tweak := range perfProfiles[name].Tweaks {
+			want[tweak.Key+`\`+tweak.Name] = tweak.Value
+		}
+		return want
+	}
+
+	var tests = []struct {
+		name    string
+		profile string
+		drift   map[string]uint32
+		restart bool
+		want    fakeDwordRegistry
+	}{
+		{"no profile", "", nil, false, initial},
+		{"apply profile", "high-throughput", nil, false, profileValues("high-throughput")},
+		{"drift is reconciled", "high-throughput", map[string]uint32{tcpipParams + `\MaxUserPort`: 1}, false, profileValues("high-throughput")},
+		{"profile change reverts the old profile", "low-latency", nil, false, profileValues("low-latency")},
+		{"profile removed after restart", "none", nil, true, initial},
+	}
+
+	for _, tt := range tests {
+		if tt.restart {
+			perfTuneState = nil
+		}
+		for k, v := range tt.drift {
+			reg[k] = v
+		}
+		cfg := ini.Empty()
+		cfg.Section("perfTune").Key("profile").SetValue(tt.profile)
+		p := &perfTune{config: cfg}
+
+		if !p.diff() && (tt.drift != nil || !reflect.DeepEqual(reg, tt.want)) {
+			t.Errorf("test case %q: diff() got false, want true", tt.name)
+		}
+		if plan, err := p.plan(); err != nil || (len(plan) != 0) != !reflect.DeepEqual(reg, tt.want) {
+			t.Errorf("test case %q: plan() got: %q, %v", tt.name, plan, err)
+		}
+		if err := p.set(context.Background()); err != nil {
+			t.Errorf("test case %q: set() returned error: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(reg, tt.want) {
+			t.Errorf("test case %q: registry got: %v, want: %v", tt.name, reg, tt.want)
+		}
+		if p.diff() {
+			t.Errorf("test case %q: diff() after set() got true", tt.name)
+		}
+		if plan, err := p.plan(); err != nil || len(plan) != 0 {
+			t.Errorf("test case %q: plan() after set() got: %q, %v, want no changes", tt.name, plan, err)
+		}
+	}
+}
+
+func TestPerfTuneUnknownProfile(t *testing.T) {
+	oldReg, oldState := perfTuneReg, perfTuneState
+	defer func() { perfTuneReg, perfTuneState = oldReg, oldState }()
+	perfTuneReg = fakeDwordRegistry{}
+	perfTuneState = &perfTuneStateJSON{}
+
+	cfg := ini.Empty()
+	cfg.Section("perfTune").Key("profile").SetValue("turbo")
+	if err := (&perfTune{config: cfg}).set(context.Background()); err == nil {
+		t.Error("set() with unknown profile returned nil error")
+	}
+}
@@ -0,0 +1,113 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// periodicTask is work the agent does on a schedule rather than on a metadata
+// change, such as expiring keys or renewing certificates.
+type periodicTask struct {
+	name string
+	// interval returns how long to wait before the next check.
+	interval func(cfg *ini.File) time.Duration
+	// atStart makes the first check without waiting.
+	atStart bool
+	// exclusive holds updateMu while run is called so it never overlaps an
+	// update cycle.
+	exclusive bool
+	// due reports whether run is called on this check, nil means always.
+	due func(cfg *ini.File, now time.Time) bool
+	run func(ctx context.Context, cfg *ini.File) error
+}
+
+// periodicLoop runs t until ctx is done, reloading the config on every check.
+func periodicLoop(ctx context.Context, t periodicTask) {
+	var wait time.Duration
+	if !t.atStart {
+		wait = t.interval(loadConfig())
+	}
+	for sleepCtx(ctx, wait) {
+		cfg := loadConfig()
+		wait = t.interval(cfg)
+		if t.due != nil && !t.due(cfg, time.Now()) {
+			continue
+		}
+		if t.exclusive {
+			updateMu.Lock()
+		}
+		err := t.run(ctx, cfg)
+		if t.exclusive {
+			updateMu.Unlock()
+		}
+		if err != nil && ctx.Err() == nil {
+			logger.Errorf("Error running %s: %v", t.name, err)
+		}
+	}
+}
+
+// every returns a periodicTask interval that is always d.
+func every(d time.Duration) func(*ini.File) time.Duration {
+	return func(*ini.File) time.Duration { return d }
+}
+
+// runScheduledManager runs set of the manager built for section against the
+// current metadata, for changes that come from time rather than metadata. A
+// failed set is logged by runSet, only metadata errors are returned.
+func runScheduledManager(ctx context.Context, cfg *ini.File, section string, build managerBuilder) error {
+	md, err := getMetadata(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	if err := verifyMetadata(md, cfg); err != nil {
+		return err
+	}
+	mgr := namedManager{section, build(md, md, cfg)}
+	// disabled records the state of the manager, like in an update.
+	updateMu.Lock()
+	defer updateMu.Unlock()
+	if mgr.disabled() {
+		return nil
+	}
+	convergeManager(ctx, cfg, mgr, true)
+	return nil
+}
+
+// convergeManager runs one manager outside runUpdate the way runUpdate does:
+// traced, honouring dry run, and followed by the post convergence script when
+// it applied changes without error. force skips the diff, for managers run on
+// a schedule. The caller holds updateMu.
+func convergeManager(ctx context.Context, cfg *ini.File, mgr namedManager, force bool) error {
+	root := newTracer(cfg).startSpan(mgr.section, nil)
+	if root != nil {
+		mgr.manager = tracedManager{mgr.manager, mgr.section, root}
+	}
+	if !force && !mgr.diff() {
+		root.finish(nil)
+		return nil
+	}
+	settings := managerRunSettings(cfg, mgr.section)
+	err := runSet(ctx, cfg, mgr, settings)
+	if err == nil && !settings.dryRun {
+		runPostConvergeScript(ctx, cfg)
+	}
+	root.finish(err)
+	return err
+}
@@ -0,0 +1,79 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+func TestPeriodicLoop(t *testing.T) {
+	var tests = []struct {
+		desc     string
+		interval time.Duration
+		atStart  bool
+		due      bool
+		err      error
+		min, max int32
+	}{
+		{"runs every interval", 10 * time.Millisecond, false, true, nil, 2, 100},
+		{"keeps running after an error", 10 * time.Millisecond, false, true, errors.New("failed"), 2, 100},
+		{"not due", 10 * time.Millisecond, false, false, nil, 0, 0},
+		{"at start", time.Hour, true, true, nil, 1, 1},
+		{"waits first", time.Hour, false, true, nil, 0, 0},
+	}
+	for _, tt := range tests {
+		var runs int32
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		periodicLoop(ctx, periodicTask{
+			name:     tt.desc,
+			interval: every(tt.interval),
+			atStart:  tt.atStart,
+			due:      func(*ini.File, time.Time) bool { return tt.due },
+			run: func(context.Context, *ini.File) error {
+				atomic.AddInt32(&runs, 1)
+				return tt.err
+			},
+		})
+		cancel()
+		if got := atomic.LoadInt32(&runs); got < tt.min || got > tt.max {
+			t.Errorf("%s: ran %d times, want %d to %d", tt.desc, got, tt.min, tt.max)
+		}
+	}
+}
+
+func TestPeriodicLoopExclusive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	periodicLoop(ctx, periodicTask{
+		name:      "exclusive",
+		interval:  every(time.Hour),
+		atStart:   true,
+		exclusive: true,
+		run: func(context.Context, *ini.File) error {
+			if updateMu.TryLock() {
+				updateMu.Unlock()
+				t.Error("updateMu not held while running an exclusive task")
+			}
+			cancel()
+			return nil
+		},
+	})
+}
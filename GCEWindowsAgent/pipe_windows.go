@@ -0,0 +1,174 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// controlPipeSDDL grants access to administrators and SYSTEM only.
+const controlPipeSDDL = "D:P(A;;GA;;;BA)(A;;GA;;;SY)"
+
+var errPipeClosed = errors.New("pipe listener closed")
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeConn is a connected pipe instance using synchronous I/O, so reads and
+// writes must not overlap. Deadlines are not supported.
+type pipeConn struct {
+	*os.File
+	addr   pipeAddr
+	server bool
+}
+
+func (c *pipeConn) LocalAddr() net.Addr                { return c.addr }
+func (c *pipeConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// Close closes the connection. The server side waits for the client to read
+// what was written before disconnecting.
+func (c *pipeConn) Close() error {
+	if c.server {
+		h := windows.Handle(c.Fd())
+		windows.FlushFileBuffers(h)
+		windows.DisconnectNamedPipe(h)
+	}
+	return c.File.Close()
+}
+
+type pipeListener struct {
+	name   string
+	sa     *windows.SecurityAttributes
+	mu     sync.Mutex
+	next   windows.Handle
+	closed bool
+}
+
+// listenPipe listens on the local named pipe name, such as
+// \\.\pipe\GCEWindowsAgent, accessible to administrators only.
+func listenPipe(name string) (net.Listener, error) {
+	sd, err := windows.SecurityDescriptorFromString(controlPipeSDDL)
+	if err != nil {
+		return nil, err
+	}
+	l := &pipeListener{
+		name: name,
+		sa: &windows.SecurityAttributes{
+			Length:             uint32(unsafe.Sizeof(windows.SecurityAttributes{})),
+			SecurityDescriptor: sd,
+		},
+	}
+	// Create the first instance right away so no other process can take
+	// the name.
+	if l.next, err = l.create(true); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *pipeListener) create(first bool) (windows.Handle, error) {
+	name, err := windows.UTF16PtrFromString(l.name)
+	if err != nil {
+		return windows.InvalidHandle, err
+	}
+	flags := uint32(windows.PIPE_ACCESS_DUPLEX)
+	if first {
+		flags |= windows.FILE_FLAG_FIRST_PIPE_INSTANCE
+	}
+	mode := uint32(windows.PIPE_TYPE_BYTE | windows.PIPE_READMODE_BYTE | windows.PIPE_WAIT | windows.PIPE_REJECT_REMOTE_CLIENTS)
+	return windows.CreateNamedPipe(name, flags, mode, windows.PIPE_UNLIMITED_INSTANCES, 4096, 4096, 0, l.sa)
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, errPipeClosed
+	}
+	h := l.next
+	l.next = windows.InvalidHandle
+	l.mu.Unlock()
+
+	if h == windows.InvalidHandle {
+		var err error
+		if h, err = l.create(false); err != nil {
+			return nil, err
+		}
+	}
+	err := windows.ConnectNamedPipe(h, nil)
+	l.mu.Lock()
+	closed := l.closed
+	l.mu.Unlock()
+	if closed {
+		windows.CloseHandle(h)
+		return nil, errPipeClosed
+	}
+	if err != nil && err != windows.ERROR_PIPE_CONNECTED {
+		windows.CloseHandle(h)
+		return nil, err
+	}
+	return &pipeConn{File: os.NewFile(uintptr(h), l.name), addr: pipeAddr(l.name), server: true}, nil
+}
+
+// Close stops the listener. An Accept blocked waiting for a client is woken
+// by connecting to the pipe.
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	next := l.next
+	l.next = windows.InvalidHandle
+	l.mu.Unlock()
+
+	if next != windows.InvalidHandle {
+		return windows.CloseHandle(next)
+	}
+	if f, err := os.OpenFile(l.name, os.O_RDWR, 0); err == nil {
+		f.Close()
+	}
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr(l.name) }
+
+// dialPipe connects to the local named pipe name, retrying for a short
+// while if every instance is busy.
+func dialPipe(name string) (net.Conn, error) {
+	for i := 0; ; i++ {
+		f, err := os.OpenFile(name, os.O_RDWR, 0)
+		if err == nil {
+			return &pipeConn{File: f, addr: pipeAddr(name)}, nil
+		}
+		if pe, ok := err.(*os.PathError); !ok || pe.Err != windows.ERROR_PIPE_BUSY || i == 20 {
+			return nil, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,262 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// pluginProtocolVersion is the version of the plugin request format.
+const pluginProtocolVersion = 1
+
+// pluginManifestJSON registers a plugin manager, read from a .json file in
+// [plugins] dir. Name is the config section of the plugin. MetadataPaths are
+// the metadata subtrees the plugin uses, none for the full tree.
+type pluginManifestJSON struct {
+	Name          string
+	Command       string
+	Args          []string
+	MetadataPaths []string
+}
+
+// pluginRequestJSON is written to the stdin of the plugin. Op is diff or
+// set, Config holds every section of the agent config.
+type pluginRequestJSON struct {
+	Version     int                          `json:"version"`
+	Op          string                       `json:"op"`
+	NewMetadata *metadataJSON                `json:"newMetadata"`
+	OldMetadata *metadataJSON                `json:"oldMetadata"`
+	Config      map[string]map[string]string `json:"config"`
+}
+
+// pluginResponseJSON is read from the stdout of the plugin. Changed answers
+// diff and Changes optionally describes them for dry runs. Error is set when
+// set failed.
+type pluginResponseJSON struct {
+	Changed bool     `json:"changed"`
+	Changes []string `json:"changes,omitempty"`
+	Error   string   `json:"error"`
+}
+
+var (
+	// pluginDiffTimeout bounds a plugin diff, which runs on every update and
+	// should only compare state.
+	pluginDiffTimeout = 30 * time.Second
+	// pluginWaitDelay is how long a killed plugin gets to close its output,
+	// so a child process holding the pipes open cannot hang the agent.
+	pluginWaitDelay = 5 * time.Second
+)
+
+// runPlugin runs the plugin command with req on stdin and returns its
+// stdout, logging its stderr. It is replaced in tests.
+var runPlugin = func(ctx context.Context, m pluginManifestJSON, req []byte) ([]byte, error) {
+	c := exec.CommandContext(ctx, m.Command, m.Args...)
+	c.WaitDelay = pluginWaitDelay
+	c.Stdin = bytes.NewReader(req)
+	var stdout, stderr bytes.Buffer
+	c.Stdout, c.Stderr = &stdout, &stderr
+	err := c.Run()
+	in := bufio.NewScanner(&stderr)
+	for in.Scan() {
+		logger.Infof("%s: %s", m.Name, in.Text())
+	}
+	return stdout.Bytes(), err
+}
+
+// builtinSection reports whether name is a config section of the agent.
+func builtinSection(name string) bool {
+	if _, ok := schemaSection(name); ok {
+		return true
+	}
+	for _, mgr := range builtinManagers(&metadataJSON{}, &metadataJSON{}, ini.Empty()) {
+		if strings.EqualFold(mgr.section, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadPlugins returns the plugins registered in [plugins] dir, sorted by
+// file name. Invalid manifests are logged and skipped.
+func loadPlugins(cfg *ini.File) []pluginManifestJSON {
+	dir := cfg.Section("plugins").Key("dir").String()
+	if dir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		logger.Errorln("Error listing plugins:", err)
+		return nil
+	}
+	sort.Strings(files)
+	var plugins []pluginManifestJSON
+	var names []string
+	for _, f := range files {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			logger.Errorf("Error reading plugin %s: %v", f, err)
+			continue
+		}
+		var m pluginManifestJSON
+		if err := json.Unmarshal(data, &m); err != nil {
+			logger.Errorf("Error parsing plugin %s: %v", f, err)
+			continue
+		}
+		name := strings.ToLower(m.Name)
+		switch {
+		case m.Name == "" || m.Command == "":
+			logger.Errorf("Plugin %s needs a Name and Command, skipping it", f)
+		case !filepath.IsAbs(m.Command):
+			logger.Errorf("Plugin %s command %q is not an absolute path, skipping it", f, m.Command)
+		case builtinSection(m.Name):
+			logger.Errorf("Plugin %s name %s is used by the agent, skipping it", f, m.Name)
+		case containsString(name, names):
+			logger.Errorf("Duplicate plugin name %s in %s, skipping it", m.Name, f)
+		default:
+			names = append(names, name)
+			plugins = append(plugins, m)
+		}
+	}
+	return plugins
+}
+
+// isPluginSection reports whether section is the config section of a
+// registered plugin, whose keys the plugin validates.
+func isPluginSection(cfg *ini.File, section string) bool {
+	for _, m := range loadPlugins(cfg) {
+		if strings.EqualFold(m.Name, section) {
+			return true
+		}
+	}
+	return false
+}
+
+// pluginManagers returns a manager for every registered plugin.
+func pluginManagers(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) []namedManager {
+	var mgrs []namedManager
+	for _, m := range loadPlugins(cfg) {
+		mgrs = append(mgrs, namedManager{m.Name, &plugin{manifest: m, newMetadata: newMetadata, oldMetadata: oldMetadata, config: cfg}})
+	}
+	return mgrs
+}
+
+// plugin is a manager run as a separate process, which is killed when its
+// timeout_sec passes, 0 means no timeout. A diff is killed after
+// pluginDiffTimeout. Its failures are those of any manager.
+type plugin struct {
+	manifest                 pluginManifestJSON
+	newMetadata, oldMetadata *metadataJSON
+	config                   *ini.File
+}
+
+// call runs the plugin for op and returns its response.
+func (p *plugin) call(ctx context.Context, op string) (*pluginResponseJSON, error) {
+	cfg := make(map[string]map[string]string)
+	for _, sec := range p.config.Sections() {
+		if strings.EqualFold(sec.Name(), ini.DEFAULT_SECTION) {
+			continue
+		}
+		cfg[sec.Name()] = sec.KeysHash()
+	}
+	req, err := json.Marshal(pluginRequestJSON{
+		Version:     pluginProtocolVersion,
+		Op:          op,
+		NewMetadata: p.newMetadata,
+		OldMetadata: p.oldMetadata,
+		Config:      cfg,
+	})
+	if err != nil {
+		return nil, err
+	}
+	out, err := runPlugin(ctx, p.manifest, req)
+	if err != nil {
+		return nil, fmt.Errorf("error running plugin %s %s: %v", p.manifest.Name, op, err)
+	}
+	var resp pluginResponseJSON
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, fmt.Errorf("error parsing plugin %s %s response %q: %v", p.manifest.Name, op, out, err)
+	}
+	return &resp, nil
+}
+
+// diff asks the plugin whether it has changes, a failing plugin has none.
+func (p *plugin) diff() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginDiffTimeout)
+	defer cancel()
+	resp, err := p.call(ctx, "diff")
+	if err != nil {
+		logger.Error(err)
+		return false
+	}
+	return resp.Changed
+}
+
+// plan returns the changes the plugin describes in its diff response.
+func (p *plugin) plan() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginDiffTimeout)
+	defer cancel()
+	resp, err := p.call(ctx, "diff")
+	if err != nil {
+		return nil, err
+	}
+	if resp.Changed && len(resp.Changes) == 0 {
+		return []string{"apply changes"}, nil
+	}
+	return resp.Changes, nil
+}
+
+func (p *plugin) metadataPaths() []string {
+	if len(p.manifest.MetadataPaths) == 0 {
+		return nil
+	}
+	return append(append([]string(nil), attributePaths...), p.manifest.MetadataPaths...)
+}
+
+func (p *plugin) disabled() bool {
+	return !p.enablement().Enabled
+}
+
+var pluginEnable = enableRule{key: "disable", inverted: true}
+
+// Plugins are enabled once registered, [<name>] disable turns one off.
+func (p *plugin) enablement() enablement {
+	r := pluginEnable
+	r.section = p.manifest.Name
+	return isEnabled(p.config, p.newMetadata, r, true)
+}
+
+func (p *plugin) set(ctx context.Context) error {
+	resp, err := p.call(ctx, "set")
+	if err != nil {
+		return err
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("plugin %s: %s", p.manifest.Name, resp.Error)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+func TestLoadPlugins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plugins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cmd, err := filepath.Abs("plugin.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests := map[string]string{
+		"a.json":   `{"Name":"backup","Command":` + jsonString(cmd) + `,"Args":["-v"]}`,
+		"b.json":   `{"Name":"Backup","Command":` + jsonString(cmd) + `}`,
+		"c.json":   `{"Name":"wsfc","Command":` + jsonString(cmd) + `}`,
+		"d.json":   `{"Name":"relative","Command":"plugin.exe"}`,
+		"e.json":   `{"Name":"nocommand"}`,
+		"f.json":   `{`,
+		"g.json":   `{"Name":"monitor","Command":` + jsonString(cmd) + `,"MetadataPaths":["instance/tags"]}`,
+		"notes.md": `not a plugin`,
+	}
+	for name, data := range manifests {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg, err := ini.InsensitiveLoad([]byte("[plugins]\ndir=" + dir + "\n[backup]\nbucket=b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []pluginManifestJSON{
+		{Name: "backup", Command: cmd, Args: []string{"-v"}},
+		{Name: "monitor", Command: cmd, MetadataPaths: []string{"instance/tags"}},
+	}
+	if got := loadPlugins(cfg); !reflect.DeepEqual(got, want) {
+		t.Errorf("loadPlugins got: %+v, want: %+v", got, want)
+	}
+	if got := loadPlugins(ini.Empty()); got != nil {
+		t.Errorf("loadPlugins without a plugin dir got: %+v, want: nil", got)
+	}
+	if problems := checkConfig(cfg); len(problems) != 0 {
+		t.Errorf("checkConfig reported the plugin section: %q", problems)
+	}
+}
+
+func jsonString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
+
+func TestPluginManager(t *testing.T) {
+	oldRun := runPlugin
+	defer func() { runPlugin = oldRun }()
+
+	cfg, err := ini.InsensitiveLoad([]byte("[backup]\nbucket=b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := &metadataJSON{Instance: instanceJSON{ID: 1}}
+	var tests = []struct {
+		name     string
+		out      string
+		err      error
+		wantDiff bool
+		wantErr  bool
+	}{
+		{"changes", `{"changed":true}`, nil, true, false},
+		{"no changes", `{"changed":false}`, nil, false, false},
+		{"set error", `{"changed":true,"error":"bucket not found"}`, nil, true, true},
+		{"invalid response", `changed`, nil, false, true},
+		{"plugin failed", ``, errors.New("exit status 1"), false, true},
+	}
+
+	for _, tt := range tests {
+		var reqs []pluginRequestJSON
+		runPlugin = func(ctx context.Context, m pluginManifestJSON, data []byte) ([]byte, error) {
+			var req pluginRequestJSON
+			if err := json.Unmarshal(data, &req); err != nil {
+				t.Fatal(err)
+			}
+			reqs = append(reqs, req)
+			if deadline, ok := ctx.Deadline(); req.Op == "diff" && (!ok || time.Until(deadline) > pluginDiffTimeout) {
+				t.Errorf("test case %q: diff deadline got: %v, %t, want within %s", tt.name, deadline, ok, pluginDiffTimeout)
+			}
+			return []byte(tt.out), tt.err
+		}
+		p := &plugin{manifest: pluginManifestJSON{Name: "backup"}, newMetadata: md, oldMetadata: &metadataJSON{}, config: cfg}
+		if got := p.diff(); got != tt.wantDiff {
+			t.Errorf("test case %q: diff got: %t, want: %t", tt.name, got, tt.wantDiff)
+		}
+		if err := p.set(context.Background()); (err != nil) != tt.wantErr {
+			t.Errorf("test case %q: set error: %v, want error: %t", tt.name, err, tt.wantErr)
+		}
+		if len(reqs) != 2 || reqs[0].Op != "diff" || reqs[1].Op != "set" {
+			t.Fatalf("test case %q: requests got: %+v, want diff and set", tt.name, reqs)
+		}
+		if reqs[1].Version != pluginProtocolVersion || reqs[1].NewMetadata.Instance.ID != 1 || reqs[1].Config["backup"]["bucket"] != "b" {
+			t.Errorf("test case %q: unexpected set request: %+v", tt.name, reqs[1])
+		}
+	}
+}
+
+func TestPluginPlan(t *testing.T) {
+	oldRun := runPlugin
+	defer func() { runPlugin = oldRun }()
+
+	var tests = []struct {
+		name    string
+		out     string
+		want    []string
+		wantErr bool
+	}{
+		{"described changes", `{"changed":true,"changes":["upload a backup"]}`, []string{"upload a backup"}, false},
+		{"undescribed changes", `{"changed":true}`, []string{"apply changes"}, false},
+		{"no changes", `{"changed":false}`, nil, false},
+		{"invalid response", `changed`, nil, true},
+	}
+	for _, tt := range tests {
+		runPlugin = func(ctx context.Context, m pluginManifestJSON, data []byte) ([]byte, error) {
+			return []byte(tt.out), nil
+		}
+		p := &plugin{manifest: pluginManifestJSON{Name: "backup"}, newMetadata: &metadataJSON{}, oldMetadata: &metadataJSON{}, config: ini.Empty()}
+		got, err := p.plan()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("test case %q: plan() error: %v, want error: %t", tt.name, err, tt.wantErr)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("test case %q: plan() got: %q, want: %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// verifyStatus is the result of the last post convergence script run.
+type verifyStatus struct {
+	Script   string
+	Time     time.Time
+	ExitCode int
+	Verified bool
+	Error    string `json:",omitempty"`
+}
+
+var (
+	lastVerify   *verifyStatus
+	lastVerifyMu sync.Mutex
+)
+
+func getVerifyStatus() *verifyStatus {
+	lastVerifyMu.Lock()
+	defer lastVerifyMu.Unlock()
+	return lastVerify
+}
+
+// runPostConvergeScript runs [core] post_converge_script, if set, and
+// records its exit code as the verified status of the instance. Failures are
+// only logged.
+func runPostConvergeScript(ctx context.Context, cfg *ini.File) {
+	sec := cfg.Section("core")
+	script := sec.Key("post_converge_script").String()
+	if script == "" {
+		return
+	}
+	timeout := time.Duration(sec.Key("post_converge_timeout_sec").MustInt(60)) * time.Second
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	status := &verifyStatus{Script: script, Time: time.Now(), ExitCode: -1}
+	logger.Infof("Running post convergence script %s", script)
+	out, err := exec.CommandContext(ctx, script).CombinedOutput()
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		status.Error = "timed out after " + timeout.String()
+	case err == nil:
+		status.ExitCode = 0
+		status.Verified = true
+	default:
+		if ee, ok := err.(*exec.ExitError); ok {
+			status.ExitCode = ee.ExitCode()
+		}
+		status.Error = err.Error()
+	}
+
+	if status.Verified {
+		logger.Infof("Post convergence script %s passed: %s", script, out)
+	} else {
+		logger.Errorf("Post convergence script %s failed: %s, output: %s", script, status.Error, out)
+	}
+
+	lastVerifyMu.Lock()
+	lastVerify = status
+	lastVerifyMu.Unlock()
+}
@@ -0,0 +1,76 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+func TestRunPostConvergeScript(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test uses a shell script")
+	}
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tests = []struct {
+		name         string
+		script       string
+		timeout      string
+		wantExit     int
+		wantVerified bool
+	}{
+		{"pass", "#!/bin/sh\nexit 0\n", "10", 0, true},
+		{"fail", "#!/bin/sh\nexit 3\n", "10", 3, false},
+		{"timeout", "#!/bin/sh\nsleep 5\n", "1", -1, false},
+	}
+
+	for i, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if err := ioutil.WriteFile(path, []byte(tt.script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		cfg := ini.Empty()
+		cfg.Section("core").Key("post_converge_script").SetValue(path)
+		cfg.Section("core").Key("post_converge_timeout_sec").SetValue(tt.timeout)
+
+		runPostConvergeScript(context.Background(), cfg)
+		got := getVerifyStatus()
+		if got == nil || got.Script != path {
+			t.Fatalf("test case %d %q: verify status not recorded: %+v", i, tt.name, got)
+		}
+		if got.ExitCode != tt.wantExit || got.Verified != tt.wantVerified {
+			t.Errorf("test case %q: got exit code %d verified %t, want %d %t", tt.name, got.ExitCode, got.Verified, tt.wantExit, tt.wantVerified)
+		}
+	}
+
+	// A missing script is logged but does not crash the agent.
+	cfg := ini.Empty()
+	cfg.Section("core").Key("post_converge_script").SetValue(filepath.Join(dir, "missing"))
+	runPostConvergeScript(context.Background(), cfg)
+	if got := getVerifyStatus(); got.Verified {
+		t.Errorf("missing script recorded as verified: %+v", got)
+	}
+}
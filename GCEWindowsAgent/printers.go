@@ -0,0 +1,331 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+var (
+	printersDisabled = true
+	printersRegName  = "PrinterPorts"
+)
+
+type printerPortJSON struct {
+	Name     string
+	Host     string
+	Protocol string
+	Queue    string `json:",omitempty"`
+}
+
+// tcpPort returns the well known TCP port for the protocol of the printer port.
+func (p printerPortJSON) tcpPort() string {
+	if strings.EqualFold(p.Protocol, "lpr") {
+		return "515"
+	}
+	return "9100"
+}
+
+func (p printerPortJSON) validate() error {
+	if p.Name == "" || p.Host == "" {
+		return fmt.Errorf("printer port %+v is missing a name or host", p)
+	}
+	for _, s := range []string{p.Name, p.Host, p.Queue} {
+		if strings.IndexFunc(s, unicode.IsControl) != -1 {
+			return fmt.Errorf("printer port %q has control characters", p.Name)
+		}
+	}
+	switch strings.ToLower(p.Protocol) {
+	case "", "raw", "lpr":
+		return nil
+	}
+	return fmt.Errorf("printer port %q has unsupported protocol %q", p.Name, p.Protocol)
+}
+
+// printManager is the interface to the local print subsystem.
+type printManager interface {
+	addPort(printerPortJSON) error
+	removePort(name string) error
+}
+
+// powershellPrintManager manages printer ports with the PrintManagement
+// PowerShell module.
+type powershellPrintManager struct{}
+
+// addPortScript returns the PowerShell script adding p. The values come from
+// metadata, PowerShell joins the arguments after -Command into the script so
+// each one is quoted.
+func addPortScript(p printerPortJSON) string {
+	if strings.EqualFold(p.Protocol, "lpr") {
+		return fmt.Sprintf("Add-PrinterPort -Name %s -LprHostAddress %s -LprQueueName %s", psQuote(p.Name), psQuote(p.Host), psQuote(p.Queue))
+	}
+	return fmt.Sprintf("Add-PrinterPort -Name %s -PrinterHostAddress %s", psQuote(p.Name), psQuote(p.Host))
+}
+
+func (powershellPrintManager) addPort(p printerPortJSON) error {
+	if out, err := runPowershell(addPortScript(p)); err != nil {
+		return fmt.Errorf("error adding printer port %q: %v, output: %s", p.Name, err, out)
+	}
+	return nil
+}
+
+func (powershellPrintManager) removePort(name string) error {
+	if out, err := runPowershell("Remove-PrinterPort -Name " + psQuote(name)); err != nil {
+		return fmt.Errorf("error removing printer port %q: %v, output: %s", name, err, out)
+	}
+	return nil
+}
+
+var (
+	printMgr printManager = powershellPrintManager{}
+	// readManagedPorts is replaced in tests.
+	readManagedPorts = func() ([]string, error) {
+		return readRegMultiString(regKeyBase, printersRegName)
+	}
+	// printHostReachable is replaced in tests.
+	printHostReachable = func(addr string) bool {
+		conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+)
+
+type printers struct {
+	newMetadata, oldMetadata *metadataJSON
+	config                   *ini.File
+}
+
+func (p *printers) diff() bool {
+	return !reflect.DeepEqual(p.newMetadata.Instance.Attributes.PrinterPorts, p.oldMetadata.Instance.Attributes.PrinterPorts) ||
+		!reflect.DeepEqual(p.newMetadata.Project.Attributes.PrinterPorts, p.oldMetadata.Project.Attributes.PrinterPorts)
+}
+
+func (p *printers) metadataPaths() []string {
+	return attributePaths
+}
+
+func (p *printers) diffPaths() []string {
+	return []string{"instance/attributes/printer-ports", "project/attributes/printer-ports"}
+}
+
+func (p *printers) disabled() (disabled bool) {
+	defer func() {
+		if disabled != printersDisabled {
+			printersDisabled = disabled
+			logStatus("printers", disabled)
+		}
+	}()
+
+	return !p.enablement().Enabled
+}
+
+// Printer ports are managed once [printers] manage is set.
+func (p *printers) enablement() enablement {
+	return isEnabled(p.config, p.newMetadata, enableRule{section: "printers", key: "manage"}, false)
+}
+
+// portsData returns the printer ports JSON from the config file, or instance
+// and then project metadata.
+func (p *printers) portsData() string {
+	data := p.config.Section("printers").Key("ports").String()
+	if data == "" {
+		data = p.newMetadata.Instance.Attributes.PrinterPorts
+	}
+	if data == "" {
+		data = p.newMetadata.Project.Attributes.PrinterPorts
+	}
+	return data
+}
+
+// desiredPorts returns the configured printer ports, skipping invalid and
+// duplicate entries.
+func (p *printers) desiredPorts() []printerPortJSON {
+	data := p.portsData()
+	if data == "" {
+		return nil
+	}
+
+	var ports []printerPortJSON
+	if err := json.Unmarshal([]byte(data), &ports); err != nil {
+		logger.Errorln("Error parsing printer ports:", err)
+		return nil
+	}
+
+	var names []string
+	var desired []printerPortJSON
+	for _, port := range ports {
+		if err := port.validate(); err != nil {
+			logger.Error(err)
+			continue
+		}
+		// Port names are case insensitive on Windows, the first definition wins.
+		if containsString(strings.ToLower(port.Name), names) {
+			logger.Errorf("Duplicate printer port %q in configuration, ignoring %+v", port.Name, port)
+			continue
+		}
+		names = append(names, strings.ToLower(port.Name))
+		desired = append(desired, port)
+	}
+	return desired
+}
+
+// comparePrinterPorts returns the ports to add and the names of managed
+// ports to remove. A port whose definition changed is removed and re-added.
+func comparePrinterPorts(desired, managed []printerPortJSON) (toAdd []printerPortJSON, toRm []string) {
+	for _, d := range desired {
+		var found bool
+		for _, m := range managed {
+			if reflect.DeepEqual(d, m) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			toAdd = append(toAdd, d)
+		}
+	}
+
+	for _, m := range managed {
+		var found bool
+		for _, d := range desired {
+			if reflect.DeepEqual(d, m) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			toRm = append(toRm, m.Name)
+		}
+	}
+	return toAdd, toRm
+}
+
+// managedPorts returns the printer ports the agent added.
+func managedPorts() ([]printerPortJSON, error) {
+	regPorts, err := readManagedPorts()
+	if err != nil && err != errRegNotExist {
+		return nil, err
+	}
+
+	var managed []printerPortJSON
+	for _, s := range regPorts {
+		var port printerPortJSON
+		if err := json.Unmarshal([]byte(s), &port); err != nil {
+			logger.Error(err)
+			continue
+		}
+		managed = append(managed, port)
+	}
+	return managed, nil
+}
+
+// plan returns the printer ports set would remove and add.
+func (p *printers) plan() ([]string, error) {
+	if p.portsData() == "" && !missingIsRemove(p.config) {
+		return nil, nil
+	}
+	managed, err := managedPorts()
+	if err != nil {
+		return nil, err
+	}
+	toAdd, toRm := comparePrinterPorts(p.desiredPorts(), managed)
+	var changes []string
+	for _, name := range toRm {
+		changes = append(changes, fmt.Sprintf("remove printer port %q", name))
+	}
+	for _, port := range toAdd {
+		changes = append(changes, fmt.Sprintf("add printer port %q for host %s", port.Name, port.Host))
+	}
+	return changes, nil
+}
+
+func (p *printers) set(ctx context.Context) error {
+	if p.portsData() == "" && !missingIsRemove(p.config) {
+		// Setting printer-ports to [] removes all managed ports.
+		logger.Info("No printer ports configured, leaving printer ports unchanged.")
+		return nil
+	}
+
+	managed, err := managedPorts()
+	if err != nil {
+		return err
+	}
+
+	toAdd, toRm := comparePrinterPorts(p.desiredPorts(), managed)
+
+	// Every port is tried, the first failure is returned once the ports
+	// that were applied are recorded.
+	var firstErr error
+	var failedRm []string
+	for _, name := range toRm {
+		logger.Infof("Removing printer port %q", name)
+		if err := printMgr.removePort(name); err != nil {
+			logger.Error(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			failedRm = append(failedRm, name)
+		}
+	}
+
+	var applied []printerPortJSON
+	for _, m := range managed {
+		if !containsString(m.Name, toRm) || containsString(m.Name, failedRm) {
+			applied = append(applied, m)
+		}
+	}
+
+	for _, port := range toAdd {
+		if !printHostReachable(net.JoinHostPort(port.Host, port.tcpPort())) {
+			logger.Errorf("Print host %s for printer port %q is not reachable, adding port anyway", port.Host, port.Name)
+		}
+		logger.Infof("Adding printer port %q for host %s", port.Name, port.Host)
+		if err := printMgr.addPort(port); err != nil {
+			logger.Error(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		applied = append(applied, port)
+	}
+
+	var jsonPorts []string
+	for _, port := range applied {
+		jsn, err := json.Marshal(port)
+		if err != nil {
+			logger.Error(err)
+			continue
+		}
+		jsonPorts = append(jsonPorts, string(jsn))
+	}
+	if err := writeRegMultiString(regKeyBase, printersRegName, jsonPorts); err != nil {
+		return err
+	}
+	return firstErr
+}
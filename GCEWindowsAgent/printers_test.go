@@ -0,0 +1,235 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+type fakePrintManager struct {
+	added   []string
+	removed []string
+	// fail holds the names of the ports whose change fails.
+	fail []string
+}
+
+func (f *fakePrintManager) addPort(p printerPortJSON) error {
+	if containsString(p.Name, f.fail) {
+		return fmt.Errorf("error adding %s", p.Name)
+	}
+	f.added = append(f.added, p.Name)
+	return nil
+}
+
+func (f *fakePrintManager) removePort(name string) error {
+	if containsString(name, f.fail) {
+		return fmt.Errorf("error removing %s", name)
+	}
+	f.removed = append(f.removed, name)
+	return nil
+}
+
+func TestPrintersDisabled(t *testing.T) {
+	var tests = []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"not explicitly enabled", []byte(""), true},
+		{"enabled in cfg", []byte("[Printers]\nmanage=true"), false},
+		{"disabled in cfg", []byte("[Printers]\nmanage=false"), true},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.data)
+		if err != nil {
+			t.Errorf("test case %q: error parsing config: %v", tt.name, err)
+			continue
+		}
+		got := (&printers{newMetadata: &metadataJSON{}, config: cfg}).disabled()
+		if got != tt.want {
+			t.Errorf("test case %q, printers.disabled() got: %t, want: %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPrintersDesiredPorts(t *testing.T) {
+	md := &metadataJSON{Instance: instanceJSON{Attributes: attributesJSON{PrinterPorts: `[
+		{"Name":"IP_10.0.0.5","Host":"10.0.0.5","Protocol":"raw"},
+		{"Name":"ip_10.0.0.5","Host":"10.0.0.6","Protocol":"raw"},
+		{"Name":"lpr1","Host":"printhost","Protocol":"lpr","Queue":"q"},
+		{"Name":"bad","Host":"printhost","Protocol":"ipp"},
+		{"Name":"","Host":"printhost"},
+		{"Name":"ctl\nport","Host":"printhost"},
+		{"Name":"ctlqueue","Host":"printhost","Protocol":"lpr","Queue":"q\u0000"}
+	]`}}}
+
+	got := (&printers{newMetadata: md, config: ini.Empty()}).desiredPorts()
+	want := []printerPortJSON{
+		{Name: "IP_10.0.0.5", Host: "10.0.0.5", Protocol: "raw"},
+		{Name: "lpr1", Host: "printhost", Protocol: "lpr", Queue: "q"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("desiredPorts() got: %+v, want: %+v", got, want)
+	}
+}
+
+func TestAddPortScript(t *testing.T) {
+	var tests = []struct {
+		port printerPortJSON
+		want string
+	}{
+		{printerPortJSON{Name: "IP_10.0.0.5", Host: "10.0.0.5"}, "Add-PrinterPort -Name 'IP_10.0.0.5' -PrinterHostAddress '10.0.0.5'"},
+		{printerPortJSON{Name: "front desk", Host: "printhost", Protocol: "LPR", Queue: "q"},
+			"Add-PrinterPort -Name 'front desk' -LprHostAddress 'printhost' -LprQueueName 'q'"},
+		{printerPortJSON{Name: "p'; Stop-Computer; '", Host: "h"},
+			"Add-PrinterPort -Name 'p''; Stop-Computer; ''' -PrinterHostAddress 'h'"},
+	}
+	for _, tt := range tests {
+		if got := addPortScript(tt.port); got != tt.want {
+			t.Errorf("addPortScript(%+v) got: %q, want: %q", tt.port, got, tt.want)
+		}
+	}
+}
+
+func TestComparePrinterPorts(t *testing.T) {
+	a := printerPortJSON{Name: "a", Host: "10.0.0.1"}
+	b := printerPortJSON{Name: "b", Host: "10.0.0.2"}
+	bMoved := printerPortJSON{Name: "b", Host: "10.0.0.3"}
+
+	var tests = []struct {
+		desired, managed []printerPortJSON
+		wantAdd          []printerPortJSON
+		wantRm           []string
+	}{
+		{[]printerPortJSON{a}, nil, []printerPortJSON{a}, nil},
+		{[]printerPortJSON{a}, []printerPortJSON{a}, nil, nil},
+		{nil, []printerPortJSON{a, b}, nil, []string{"a", "b"}},
+		{[]printerPortJSON{a, bMoved}, []printerPortJSON{a, b}, []printerPortJSON{bMoved}, []string{"b"}},
+	}
+
+	for _, tt := range tests {
+		toAdd, toRm := comparePrinterPorts(tt.desired, tt.managed)
+		if !reflect.DeepEqual(toAdd, tt.wantAdd) {
+			t.Errorf("comparePrinterPorts(%v, %v) toAdd got: %v, want: %v", tt.desired, tt.managed, toAdd, tt.wantAdd)
+		}
+		if !reflect.DeepEqual(toRm, tt.wantRm) {
+			t.Errorf("comparePrinterPorts(%v, %v) toRm got: %v, want: %v", tt.desired, tt.managed, toRm, tt.wantRm)
+		}
+	}
+}
+
+func TestPrintersSetUnreachableHost(t *testing.T) {
+	fake := &fakePrintManager{}
+	oldMgr, oldReachable := printMgr, printHostReachable
+	defer func() { printMgr, printHostReachable = oldMgr, oldReachable }()
+	printMgr = fake
+	printHostReachable = func(string) bool { return false }
+
+	md := &metadataJSON{Instance: instanceJSON{Attributes: attributesJSON{PrinterPorts: `[{"Name":"p1","Host":"10.0.0.5"}]`}}}
+	if err := (&printers{newMetadata: md, config: ini.Empty()}).set(context.Background()); err != nil {
+		t.Fatalf("printers.set(context.Background()) returned error: %v", err)
+	}
+	if want := []string{"p1"}; !reflect.DeepEqual(fake.added, want) {
+		t.Errorf("ports added got: %v, want: %v", fake.added, want)
+	}
+}
+
+func TestPrintersSetErrors(t *testing.T) {
+	oldMgr, oldRead, oldReachable := printMgr, readManagedPorts, printHostReachable
+	defer func() { printMgr, readManagedPorts, printHostReachable = oldMgr, oldRead, oldReachable }()
+	readManagedPorts = func() ([]string, error) {
+		return []string{`{"Name":"old1","Host":"10.0.0.5","Protocol":""}`, `{"Name":"old2","Host":"10.0.0.5","Protocol":""}`}, nil
+	}
+	printHostReachable = func(string) bool { return true }
+
+	var tests = []struct {
+		name        string
+		fail        []string
+		wantErr     string
+		wantAdded   []string
+		wantRemoved []string
+	}{
+		{"no errors", nil, "", []string{"new1", "new2"}, []string{"old1", "old2"}},
+		{"remove fails", []string{"old1"}, "error removing old1", []string{"new1", "new2"}, []string{"old2"}},
+		{"add fails", []string{"new1", "new2"}, "error adding new1", nil, []string{"old1", "old2"}},
+		{"first of both", []string{"old2", "new1"}, "error removing old2", []string{"new2"}, []string{"old1"}},
+	}
+
+	md := &metadataJSON{Instance: instanceJSON{Attributes: attributesJSON{PrinterPorts: `[{"Name":"new1","Host":"10.0.0.6"},{"Name":"new2","Host":"10.0.0.6"}]`}}}
+	for _, tt := range tests {
+		fake := &fakePrintManager{fail: tt.fail}
+		printMgr = fake
+		err := (&printers{newMetadata: md, config: ini.Empty()}).set(context.Background())
+		if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+			t.Errorf("test case %q: printers.set(context.Background()) error got: %v, want: %q", tt.name, err, tt.wantErr)
+		}
+		if !reflect.DeepEqual(fake.added, tt.wantAdded) {
+			t.Errorf("test case %q: ports added got: %v, want: %v", tt.name, fake.added, tt.wantAdded)
+		}
+		if !reflect.DeepEqual(fake.removed, tt.wantRemoved) {
+			t.Errorf("test case %q: ports removed got: %v, want: %v", tt.name, fake.removed, tt.wantRemoved)
+		}
+	}
+}
+
+func TestPrintersSetMissingPorts(t *testing.T) {
+	oldMgr, oldRead := printMgr, readManagedPorts
+	defer func() { printMgr, readManagedPorts = oldMgr, oldRead }()
+	readManagedPorts = func() ([]string, error) {
+		return []string{`{"Name":"p1","Host":"10.0.0.5","Protocol":""}`}, nil
+	}
+
+	var tests = []struct {
+		name        string
+		cfg         []byte
+		ports       string
+		wantRemoved []string
+	}{
+		{"default ignores missing key", []byte(""), "", nil},
+		{"ignore missing key", []byte("[Core]\ntreat_missing_as=ignore"), "", nil},
+		{"invalid policy ignores missing key", []byte("[Core]\ntreat_missing_as=wipe"), "", nil},
+		{"remove on missing key", []byte("[Core]\ntreat_missing_as=remove"), "", []string{"p1"}},
+		{"explicit empty list removes", []byte(""), "[]", []string{"p1"}},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.cfg)
+		if err != nil {
+			t.Fatalf("test case %q: error parsing config: %v", tt.name, err)
+		}
+		fake := &fakePrintManager{}
+		printMgr = fake
+		md := &metadataJSON{Instance: instanceJSON{Attributes: attributesJSON{PrinterPorts: tt.ports}}}
+		plan, err := (&printers{newMetadata: md, config: cfg}).plan()
+		if err != nil {
+			t.Errorf("test case %q: printers.plan() returned error: %v", tt.name, err)
+		}
+		if len(plan) != len(tt.wantRemoved) {
+			t.Errorf("test case %q: plan got: %q, want %d removals", tt.name, plan, len(tt.wantRemoved))
+		}
+		if err := (&printers{newMetadata: md, config: cfg}).set(context.Background()); err != nil {
+			t.Errorf("test case %q: printers.set(context.Background()) returned error: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(fake.removed, tt.wantRemoved) {
+			t.Errorf("test case %q: ports removed got: %v, want: %v", tt.name, fake.removed, tt.wantRemoved)
+		}
+	}
+}
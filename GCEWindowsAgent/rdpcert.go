@@ -0,0 +1,163 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+const (
+	rdpCertFriendlyName = "Google Compute Engine RDP"
+	// rdpCertAttribute is the guest attribute the bound certificate is
+	// published to.
+	rdpCertAttribute = "rdp-certificate"
+)
+
+var (
+	rdpCertDisabled = true
+	rdpCertSchedule certSchedule
+)
+
+// rdpListener is the interface to the TLS certificate binding of the
+// RDP-Tcp listener.
+type rdpListener interface {
+	thumbprint() (string, error)
+	bind(thumbprint string) error
+}
+
+// wmiRDPListener binds certificates through the Win32_TSGeneralSetting WMI
+// class with PowerShell.
+type wmiRDPListener struct{}
+
+const psRDPSetting = `Get-CimInstance -Namespace root\cimv2\TerminalServices -ClassName Win32_TSGeneralSetting -Filter "TerminalName='RDP-Tcp'"`
+
+func (wmiRDPListener) thumbprint() (string, error) {
+	out, err := runPowershell(fmt.Sprintf(`(%s).SSLCertificateSHA1Hash`, psRDPSetting))
+	if err != nil {
+		return "", fmt.Errorf("error reading RDP certificate: %v, output: %s", err, out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// bind gives Remote Desktop Services, which runs as NETWORK SERVICE, read
+// access to the private key and binds the certificate to RDP-Tcp.
+func (wmiRDPListener) bind(thumbprint string) error {
+	script := fmt.Sprintf(`$c = Get-Item (Join-Path Cert:\LocalMachine\My %[1]s)
+$k = [System.Security.Cryptography.X509Certificates.RSACertificateExtensions]::GetRSAPrivateKey($c)
+icacls.exe (Join-Path "$env:ProgramData\Microsoft\Crypto\Keys" $k.Key.UniqueName) /grant '*S-1-5-20:R' | Out-Null
+if ($LASTEXITCODE -ne 0) { throw "icacls exited with $LASTEXITCODE" }
+Set-CimInstance -InputObject (%[2]s) -Property @{SSLCertificateSHA1Hash=%[1]s}`, psQuote(thumbprint), psRDPSetting)
+	if out, err := runPowershell(script); err != nil {
+		return fmt.Errorf("error binding RDP certificate %s: %v, output: %s", thumbprint, err, out)
+	}
+	return nil
+}
+
+// rdpListenerMgr is replaced in tests.
+var rdpListenerMgr rdpListener = wmiRDPListener{}
+
+// rdpCertJSON is the certificate published to the rdp-certificate guest
+// attribute, so clients can verify the RDP endpoint.
+type rdpCertJSON struct {
+	Thumbprint  string `json:"thumbprint"`
+	NotAfter    string `json:"notAfter"`
+	Certificate string `json:"certificate"`
+}
+
+type rdpCert struct {
+	newMetadata, oldMetadata *metadataJSON
+	config                   *ini.File
+}
+
+// diff reports whether the certificate is due to be checked, the certificate
+// does not depend on metadata.
+func (r *rdpCert) diff() bool {
+	return rdpCertSchedule.due(time.Now())
+}
+
+func (r *rdpCert) metadataPaths() []string {
+	return attributePaths
+}
+
+func (r *rdpCert) disabled() (disabled bool) {
+	defer func() {
+		if disabled != rdpCertDisabled {
+			rdpCertDisabled = disabled
+			logStatus("RDP certificate", disabled)
+		}
+	}()
+
+	return !r.enablement().Enabled
+}
+
+// The RDP certificate is rotated when [rdpCert] enable is true, there is no
+// attribute for it as the default certificate works.
+func (r *rdpCert) enablement() enablement {
+	return isEnabled(r.config, r.newMetadata, enableRule{section: "rdpCert", key: "enable"}, false)
+}
+
+// set binds a certificate created by the agent to RDP-Tcp, creating a new one
+// when none is bound or the bound one expires within [rdpCert]
+// renew_before_days, and publishes it. Certificates from earlier rotations
+// are removed. A failure is retried after a backoff.
+// plan returns the certificate changes set would make.
+func (r *rdpCert) plan() ([]string, error) {
+	_, renew, err := certValidity(r.config.Section("rdpCert"))
+	if err != nil {
+		return nil, err
+	}
+	bound, err := rdpListenerMgr.thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	return planCert(rdpCertFriendlyName, bound, renew)
+}
+
+func (r *rdpCert) set(ctx context.Context) (err error) {
+	defer func() {
+		if err != nil {
+			rdpCertSchedule.failed(time.Now())
+		}
+	}()
+	validity, renew, err := certValidity(r.config.Section("rdpCert"))
+	if err != nil {
+		return err
+	}
+	bound, err := rdpListenerMgr.thumbprint()
+	if err != nil {
+		return err
+	}
+	cert, err := ensureCert(rdpCertFriendlyName, bound, validity, renew, rdpListenerMgr.bind, &rdpCertSchedule)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(rdpCertJSON{
+		Thumbprint:  cert.Thumbprint,
+		NotAfter:    cert.NotAfter.UTC().Format(time.RFC3339),
+		Certificate: cert.Raw,
+	})
+	if err != nil {
+		return err
+	}
+	writeGuestAttribute(r.config, rdpCertAttribute, string(data))
+	return nil
+}
@@ -0,0 +1,188 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+type fakeCertStore struct {
+	certs   []certJSON
+	created []string
+	removed []string
+}
+
+func (f *fakeCertStore) list(friendlyName string) ([]certJSON, error) {
+	return f.certs, nil
+}
+
+func (f *fakeCertStore) create(friendlyName string, dnsNames []string, notAfter time.Time) (certJSON, error) {
+	c := certJSON{Thumbprint: fmt.Sprintf("NEW%d", len(f.created)), NotAfter: notAfter, Raw: "cmF3"}
+	f.created = append(f.created, strings.Join(dnsNames, ","))
+	f.certs = append(f.certs, c)
+	return c, nil
+}
+
+func (f *fakeCertStore) importPFX(friendlyName, data string) (certJSON, error) {
+	c := certJSON{Thumbprint: "IMPORTED", NotAfter: time.Now().Add(365 * 24 * time.Hour), Raw: data}
+	f.certs = append(f.certs, c)
+	return c, nil
+}
+
+func (f *fakeCertStore) remove(thumbprint string) error {
+	f.removed = append(f.removed, thumbprint)
+	return nil
+}
+
+type fakeRDPListener struct {
+	bound string
+}
+
+func (f *fakeRDPListener) thumbprint() (string, error) {
+	return f.bound, nil
+}
+
+func (f *fakeRDPListener) bind(thumbprint string) error {
+	f.bound = thumbprint
+	return nil
+}
+
+func TestParseCerts(t *testing.T) {
+	got, err := parseCerts([]byte(`[{"Thumbprint":"ABC","NotAfter":"2019-06-01T00:00:00.0000000Z","Raw":"cmF3"}]`))
+	if err != nil {
+		t.Fatalf("parseCerts() returned error: %v", err)
+	}
+	want := []certJSON{{Thumbprint: "ABC", NotAfter: time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC), Raw: "cmF3"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseCerts() got: %+v, want: %+v", got, want)
+	}
+	if _, err := parseCerts([]byte("not json")); err == nil {
+		t.Error("parseCerts() with invalid output returned no error")
+	}
+}
+
+func TestPSQuote(t *testing.T) {
+	if got, want := psQuote("it's"), "'it''s'"; got != want {
+		t.Errorf("psQuote() got: %s, want: %s", got, want)
+	}
+}
+
+func TestRDPCertSet(t *testing.T) {
+	oldStore, oldListener, oldPut := certStoreMgr, rdpListenerMgr, putGuestAttribute
+	defer func() {
+		certStoreMgr, rdpListenerMgr, putGuestAttribute = oldStore, oldListener, oldPut
+		rdpCertSchedule.set(time.Time{})
+	}()
+
+	now := time.Now()
+	var tests = []struct {
+		name        string
+		certs       []certJSON
+		bound       string
+		wantCreated bool
+		wantRemoved []string
+	}{
+		{"no certificate", nil, "DEFAULT", true, nil},
+		{"valid bound certificate", []certJSON{{Thumbprint: "OLD", NotAfter: now.Add(100 * 24 * time.Hour)}}, "old", false, nil},
+		{"expiring certificate", []certJSON{{Thumbprint: "OLD", NotAfter: now.Add(10 * 24 * time.Hour)}}, "OLD", true, []string{"OLD"}},
+		{"not bound", []certJSON{{Thumbprint: "OLD", NotAfter: now.Add(100 * 24 * time.Hour)}}, "OTHER", true, []string{"OLD"}},
+	}
+
+	cfg := ini.Empty()
+	for _, tt := range tests {
+		store := &fakeCertStore{certs: tt.certs}
+		listener := &fakeRDPListener{bound: tt.bound}
+		certStoreMgr, rdpListenerMgr = store, listener
+		var published string
+		putGuestAttribute = func(_ *ini.File, key, value string) error {
+			if key == rdpCertAttribute {
+				published = value
+			}
+			return nil
+		}
+
+		plan, err := (&rdpCert{config: cfg}).plan()
+		if err != nil {
+			t.Fatalf("test case %q: plan() returned error: %v", tt.name, err)
+		}
+		want := len(tt.wantRemoved)
+		if tt.wantCreated {
+			want++
+		}
+		if len(plan) != want {
+			t.Errorf("test case %q: plan got: %q, want %d changes", tt.name, plan, want)
+		}
+		if err := (&rdpCert{config: cfg}).set(context.Background()); err != nil {
+			t.Fatalf("test case %q: set() returned error: %v", tt.name, err)
+		}
+		if got := len(store.created) == 1; got != tt.wantCreated {
+			t.Errorf("test case %q: certificate created: %t, want: %t", tt.name, got, tt.wantCreated)
+		}
+		if tt.wantCreated && listener.bound != "NEW0" {
+			t.Errorf("test case %q: bound certificate got: %q, want: NEW0", tt.name, listener.bound)
+		}
+		if !reflect.DeepEqual(store.removed, tt.wantRemoved) {
+			t.Errorf("test case %q: removed got: %q, want: %q", tt.name, store.removed, tt.wantRemoved)
+		}
+		if !strings.Contains(published, `"thumbprint":"`) {
+			t.Errorf("test case %q: published certificate got: %q", tt.name, published)
+		}
+		if rdpCertSchedule.due(now) || !rdpCertSchedule.due(now.Add(certRecheck+time.Minute)) {
+			t.Errorf("test case %q: next check not set to the recheck interval", tt.name)
+		}
+	}
+}
+
+func TestRDPCertSetInvalidConfig(t *testing.T) {
+	defer rdpCertSchedule.set(time.Time{})
+	cfg, err := ini.InsensitiveLoad([]byte("[rdpCert]\nvalidity_days=10\nrenew_before_days=10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&rdpCert{config: cfg}).set(context.Background()); err == nil {
+		t.Error("set() with renew_before_days not shorter than validity_days returned no error")
+	}
+	if rdpCertSchedule.due(time.Now()) {
+		t.Error("failed set() did not back off")
+	}
+}
+
+func TestCertScheduleFailed(t *testing.T) {
+	var s certSchedule
+	now := time.Now()
+	for _, want := range []time.Duration{certRetry, 2 * certRetry, 4 * certRetry} {
+		s.failed(now)
+		if s.due(now.Add(want-time.Second)) || !s.due(now.Add(want)) {
+			t.Errorf("retry after %v not scheduled, next check: %v", want, s.next.Sub(now))
+		}
+	}
+	s.backoff = certRecheck
+	s.failed(now)
+	if got := s.next.Sub(now); got != certRecheck {
+		t.Errorf("backoff got: %v, want at most: %v", got, certRecheck)
+	}
+	s.set(now)
+	s.failed(now)
+	if got := s.next.Sub(now); got != certRetry {
+		t.Errorf("backoff after a successful check got: %v, want: %v", got, certRetry)
+	}
+}
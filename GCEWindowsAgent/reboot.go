@@ -0,0 +1,115 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// pendingRebootAttribute is the guest attribute pending reboots are reported
+// to, so orchestration can coordinate reboots across the fleet.
+const pendingRebootAttribute = "pending-reboot"
+
+// pendingRebootJSON is the pending reboot status, Reasons are the config
+// sections of the managers whose changes need a reboot.
+type pendingRebootJSON struct {
+	Pending bool       `json:"pending"`
+	Reasons []string   `json:"reasons"`
+	Since   *time.Time `json:"since,omitempty"`
+}
+
+var (
+	// pendingReboot is persisted in the applied state, so restarting the
+	// agent without a reboot does not hide it.
+	pendingReboot   pendingRebootJSON
+	pendingRebootMu sync.Mutex
+)
+
+func getPendingReboot() pendingRebootJSON {
+	pendingRebootMu.Lock()
+	defer pendingRebootMu.Unlock()
+	s := pendingReboot
+	s.Reasons = append([]string(nil), pendingReboot.Reasons...)
+	return s
+}
+
+// requestReboot records that changes made for reason need a reboot to take
+// effect and reports the new status when it changed.
+func requestReboot(cfg *ini.File, reason string) {
+	pendingRebootMu.Lock()
+	if containsString(reason, pendingReboot.Reasons) {
+		pendingRebootMu.Unlock()
+		return
+	}
+	wasPending := pendingReboot.Pending
+	if !wasPending {
+		now := time.Now().UTC()
+		pendingReboot.Pending, pendingReboot.Since = true, &now
+	}
+	pendingReboot.Reasons = append(pendingReboot.Reasons, reason)
+	pendingRebootMu.Unlock()
+
+	s := getPendingReboot()
+	updateAppliedState(func(a *appliedStateJSON) {
+		a.PendingReboot, a.PendingRebootBoot = &s, bootTime().Format(time.RFC3339)
+	})
+	reportPendingReboot(cfg, s)
+	if !wasPending {
+		emitEvent(cfg, transitionEventJSON{Manager: rebootEvent, OldState: stateNoReboot, NewState: stateRebootPending, Reasons: s.Reasons})
+	}
+}
+
+// restorePendingReboot restores the pending reboot of a previous run from the
+// applied state, unless the system rebooted since it was requested.
+func restorePendingReboot(cfg *ini.File) {
+	appliedStateMu.Lock()
+	s, boot := appliedState.PendingReboot, appliedState.PendingRebootBoot
+	appliedStateMu.Unlock()
+	if s == nil {
+		return
+	}
+
+	t, err := time.Parse(time.RFC3339, boot)
+	if err != nil || absDuration(bootTime().Sub(t)) > time.Minute {
+		updateAppliedState(func(a *appliedStateJSON) {
+			a.PendingReboot, a.PendingRebootBoot = nil, ""
+		})
+		if s.Pending {
+			emitEvent(cfg, transitionEventJSON{Manager: rebootEvent, OldState: stateRebootPending, NewState: stateNoReboot, Reasons: s.Reasons})
+		}
+		return
+	}
+	pendingRebootMu.Lock()
+	defer pendingRebootMu.Unlock()
+	pendingReboot = *s
+}
+
+// reportPendingReboot writes s to the pending reboot guest attribute.
+func reportPendingReboot(cfg *ini.File, s pendingRebootJSON) {
+	if s.Reasons == nil {
+		s.Reasons = []string{}
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	writeGuestAttribute(cfg, pendingRebootAttribute, string(data))
+}
@@ -0,0 +1,149 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+func TestRequestReboot(t *testing.T) {
+	oldPut, oldWrite := putGuestAttribute, writeAppliedState
+	defer func() {
+		putGuestAttribute, writeAppliedState = oldPut, oldWrite
+		pendingReboot = pendingRebootJSON{}
+		appliedState = appliedStateJSON{}
+	}()
+	writeAppliedState = func([]string) error { return nil }
+	var writes []pendingRebootJSON
+	putGuestAttribute = func(cfg *ini.File, path, value string) error {
+		if path != pendingRebootAttribute {
+			t.Errorf("pending reboot written to %q, want %q", path, pendingRebootAttribute)
+		}
+		var s pendingRebootJSON
+		if err := json.Unmarshal([]byte(value), &s); err != nil {
+			t.Errorf("error parsing pending reboot %q: %v", value, err)
+		}
+		writes = append(writes, s)
+		return nil
+	}
+
+	cfg, err := ini.InsensitiveLoad([]byte("[events]\nwebhook=http://localhost/hook"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queuedEvents()
+	// Startup clears a status reported before the reboot.
+	reportPendingReboot(cfg, getPendingReboot())
+	requestReboot(cfg, "pagefile")
+	requestReboot(cfg, "pagefile")
+	requestReboot(cfg, "perfTune")
+
+	wantReasons := [][]string{{}, {"pagefile"}, {"pagefile", "perfTune"}}
+	if len(writes) != len(wantReasons) {
+		t.Fatalf("pending reboot written %d times, want %d: %+v", len(writes), len(wantReasons), writes)
+	}
+	for i, w := range writes {
+		if !reflect.DeepEqual(w.Reasons, wantReasons[i]) {
+			t.Errorf("write %d reasons got: %q, want: %q", i, w.Reasons, wantReasons[i])
+		}
+		if pending := i > 0; w.Pending != pending || (w.Since != nil) != pending {
+			t.Errorf("write %d got: %+v, want pending: %t", i, w, pending)
+		}
+	}
+	if !writes[1].Since.Equal(*writes[2].Since) {
+		t.Errorf("since changed from %v to %v on a new reason", writes[1].Since, writes[2].Since)
+	}
+	if got := appliedState.PendingReboot; got == nil || !reflect.DeepEqual(got.Reasons, wantReasons[2]) {
+		t.Errorf("persisted pending reboot got: %+v, want reasons: %q", got, wantReasons[2])
+	}
+	// Only the change to pending is an event, not the reasons added later.
+	events := queuedEvents()
+	if len(events) != 1 || events[0].Manager != rebootEvent || events[0].OldState != stateNoReboot || events[0].NewState != stateRebootPending ||
+		!reflect.DeepEqual(events[0].Reasons, []string{"pagefile"}) {
+		t.Errorf("pending reboot events got: %+v, want one to pending for pagefile", events)
+	}
+}
+
+func TestRestorePendingReboot(t *testing.T) {
+	oldWrite := writeAppliedState
+	defer func() {
+		writeAppliedState = oldWrite
+		pendingReboot = pendingRebootJSON{}
+		appliedState = appliedStateJSON{}
+	}()
+	writeAppliedState = func([]string) error { return nil }
+
+	cfg, err := ini.InsensitiveLoad([]byte("[events]\nwebhook=http://localhost/hook"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queuedEvents()
+	since := time.Now().UTC().Add(-time.Hour)
+	s := &pendingRebootJSON{Pending: true, Reasons: []string{"pagefile"}, Since: &since}
+	var tests = []struct {
+		name string
+		boot string
+		want bool
+	}{
+		{"same boot", bootTime().Format(time.RFC3339), true},
+		{"rebooted", bootTime().Add(-time.Hour).Format(time.RFC3339), false},
+		{"bad boot time", "bad", false},
+	}
+	for _, tt := range tests {
+		pendingReboot = pendingRebootJSON{}
+		appliedState = appliedStateJSON{PendingReboot: s, PendingRebootBoot: tt.boot}
+		restorePendingReboot(cfg)
+
+		if got := getPendingReboot(); got.Pending != tt.want {
+			t.Errorf("test case %q: restored pending reboot got: %+v, want pending: %t", tt.name, got, tt.want)
+		}
+		if kept := appliedState.PendingReboot != nil; kept != tt.want {
+			t.Errorf("test case %q: persisted pending reboot kept: %t, want: %t", tt.name, kept, tt.want)
+		}
+		// Clearing the pending reboot of the previous boot is a transition.
+		events := queuedEvents()
+		if cleared := len(events) == 1 && events[0].OldState == stateRebootPending && events[0].NewState == stateNoReboot; cleared == tt.want || len(events) > 1 {
+			t.Errorf("test case %q: events got: %+v, want a cleared reboot: %t", tt.name, events, !tt.want)
+		}
+	}
+}
+
+func TestPutMetadata(t *testing.T) {
+	var method, path, flavor, body string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path, flavor = r.Method, r.URL.Path, r.Header.Get("Metadata-Flavor")
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+	}))
+	defer ts.Close()
+	oldServer := metadataServer
+	defer func() { metadataServer = oldServer }()
+	metadataServer = ts.URL
+
+	if err := putAgentGuestAttribute(ini.Empty(), pendingRebootAttribute, `{"pending":true}`); err != nil {
+		t.Fatalf("putAgentGuestAttribute() returned error: %v", err)
+	}
+	if method != "PUT" || path != "/"+guestAttributesPath+pendingRebootAttribute || flavor != "Google" || body != `{"pending":true}` {
+		t.Errorf("got %s %s (Metadata-Flavor: %q) %q", method, path, flavor, body)
+	}
+}
@@ -0,0 +1,356 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// scriptsBootRegName is a REG_MULTI_SZ under regKeyBase holding the boot time
+// startup scripts last ran for.
+const scriptsBootRegName = "StartupScriptsBoot"
+
+var (
+	// scriptTypes are the suffixes of the script attributes, in the order
+	// the scripts run.
+	scriptTypes = []string{"ps1", "cmd", "bat", "url"}
+
+	powerShellArgs = []string{"-NoProfile", "-NoLogo", "-ExecutionPolicy", "Unrestricted", "-File"}
+
+	// gcsURLs match the Cloud Storage URLs a url script can be given as,
+	// capturing the bucket and object.
+	gcsURLs = []*regexp.Regexp{
+		regexp.MustCompile(`^gs://([a-z0-9][-_.a-z0-9]*)/(.+)$`),
+		regexp.MustCompile(`^https?://([a-z0-9][-_.a-z0-9]*)\.storage\.googleapis\.com/(.+)$`),
+		regexp.MustCompile(`^https?://storage\.cloud\.google\.com/([a-z0-9][-_.a-z0-9]*)/(.+)$`),
+		regexp.MustCompile(`^https?://(?:commondata)?storage\.googleapis\.com/([a-z0-9][-_.a-z0-9]*)/(.+)$`),
+	}
+
+	// runScriptCmd, readScriptsBoot and writeScriptsBoot are replaced in
+	// tests.
+	runScriptCmd    = runCmd
+	readScriptsBoot = func() ([]string, error) {
+		return readRegMultiString(regKeyBase, scriptsBootRegName)
+	}
+	writeScriptsBoot = func(boot string) error {
+		return writeRegMultiString(regKeyBase, scriptsBootRegName, []string{boot})
+	}
+)
+
+// metadataScript is a script from the metadata attribute name.
+type metadataScript struct {
+	name, script string
+}
+
+// scriptPrefix returns the attribute prefix of the scripts for event,
+// specialize, startup or shutdown.
+func scriptPrefix(event string) (string, error) {
+	switch event {
+	case "specialize":
+		return "sysprep-specialize-script-", nil
+	case "startup", "shutdown":
+		return "windows-" + event + "-script-", nil
+	default:
+		return "", fmt.Errorf("invalid script event %q, want specialize, startup or shutdown", event)
+	}
+}
+
+// parseScripts returns the scripts in attrs with prefix, in run order.
+func parseScripts(prefix string, attrs map[string]string) []metadataScript {
+	var scripts []metadataScript
+	for _, t := range scriptTypes {
+		name := prefix + t
+		if s := attrs[name]; strings.TrimSpace(s) != "" {
+			scripts = append(scripts, metadataScript{name, s})
+		}
+	}
+	return scripts
+}
+
+// getAttributes fetches the instance or project attributes, retrying while
+// the network comes up.
+func getAttributes(ctx context.Context, config *ini.File, level string) (map[string]string, error) {
+	var data []byte
+	var err error
+	for i := 1; i <= 5; i++ {
+		if data, err = getMetadataPath(ctx, config, level+"/attributes/?recursive=true"); err == nil {
+			break
+		}
+		logger.Errorf("Error fetching %s attributes, retrying: %v", level, err)
+		if !sleepCtx(ctx, time.Duration(3*i)*time.Second) {
+			return nil, ctx.Err()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	var attrs map[string]string
+	return attrs, json.Unmarshal(data, &attrs)
+}
+
+// getScripts returns the scripts for event. Instance scripts replace all
+// project scripts.
+func getScripts(ctx context.Context, config *ini.File, event string) ([]metadataScript, error) {
+	prefix, err := scriptPrefix(event)
+	if err != nil {
+		return nil, err
+	}
+	for _, level := range []string{"instance", "project"} {
+		attrs, err := getAttributes(ctx, config, level)
+		if err != nil {
+			return nil, err
+		}
+		if scripts := parseScripts(prefix, attrs); len(scripts) != 0 {
+			return scripts, nil
+		}
+	}
+	return nil, nil
+}
+
+// gcsObject returns the bucket and object of a Cloud Storage URL.
+func gcsObject(u string) (bucket, object string, ok bool) {
+	for _, re := range gcsURLs {
+		if m := re.FindStringSubmatch(u); m != nil {
+			return m[1], m[2], true
+		}
+	}
+	return "", "", false
+}
+
+func downloadURL(ctx context.Context, u string, w io.Writer) error {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", u, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// downloadScript writes the script at u to dst. Cloud Storage objects are
+// downloaded with the service account of the instance, falling back to an
+// unauthenticated download for public objects.
+func downloadScript(ctx context.Context, config *ini.File, u, dst string) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if bucket, object, ok := gcsObject(u); ok {
+		err := downloadFromGCS(ctx, config, bucket, object, f)
+		if err == nil {
+			return nil
+		}
+		logger.Infof("Error downloading %s with the service account, trying without: %v", u, err)
+		if err := f.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		u = fmt.Sprintf("https://storage.googleapis.com/%s/%s", bucket, object)
+	}
+	return downloadURL(ctx, u, f)
+}
+
+// scriptCommand returns the command running the script file.
+func scriptCommand(ctx context.Context, file string) *exec.Cmd {
+	if strings.HasSuffix(file, ".ps1") {
+		return exec.CommandContext(ctx, "powershell.exe", append(powerShellArgs, file)...)
+	}
+	return exec.CommandContext(ctx, file)
+}
+
+// run writes the script, or downloads it for a url script, to a temporary
+// directory and runs it.
+func (s metadataScript) run(ctx context.Context, config *ini.File) error {
+	dir, err := ioutil.TempDir("", "metadata-scripts")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	ext := s.name[strings.LastIndex(s.name, "-")+1:]
+	if ext != "url" {
+		file := filepath.Join(dir, s.name+"."+ext)
+		if err := ioutil.WriteFile(file, []byte(s.script), 0600); err != nil {
+			return err
+		}
+		return runScriptCmd(scriptCommand(ctx, file), s.name)
+	}
+
+	u := strings.TrimSpace(s.script)
+	ext = strings.ToLower(u[strings.LastIndex(u, ".")+1:])
+	if ext != "ps1" && ext != "cmd" && ext != "bat" {
+		return fmt.Errorf("unknown script type of %s, want a .ps1, .cmd or .bat file", u)
+	}
+	file := filepath.Join(dir, s.name+"."+ext)
+	if err := downloadScript(ctx, config, u, file); err != nil {
+		return fmt.Errorf("error downloading %s: %v", u, err)
+	}
+	return runScriptCmd(scriptCommand(ctx, file), s.name)
+}
+
+// runCmd runs c, logging its output line by line prefixed with name.
+func runCmd(c *exec.Cmd, name string) error {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer pr.Close()
+	c.Stdout, c.Stderr = pw, pw
+	if err := c.Start(); err != nil {
+		pw.Close()
+		return err
+	}
+	pw.Close()
+
+	in := bufio.NewScanner(pr)
+	for in.Scan() {
+		logger.Infof("%s: %s", name, in.Text())
+	}
+	return c.Wait()
+}
+
+// scriptTimeout returns how long the scripts for event may run, zero for no
+// limit. Shutdown scripts are always limited as they delay the service stop.
+func scriptTimeout(config *ini.File, event string) time.Duration {
+	sec := config.Section("scripts")
+	if event == "shutdown" {
+		return time.Duration(sec.Key("shutdown_timeout_sec").MustInt(60)) * time.Second
+	}
+	return time.Duration(sec.Key("timeout_sec").MustInt(0)) * time.Second
+}
+
+// runScripts runs the scripts for event in order, logging the exit code of
+// each. It returns an error if the scripts could not be fetched.
+func runScripts(ctx context.Context, config *ini.File, event string) error {
+	if d := scriptTimeout(config, event); d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	scripts, err := getScripts(ctx, config, event)
+	if err != nil {
+		return err
+	}
+	if len(scripts) == 0 {
+		logger.Infof("No %s scripts to run.", event)
+		return nil
+	}
+	for _, s := range scripts {
+		if dryRun(config) {
+			logger.Infof("Dry run: would run %s.", s.name)
+			continue
+		}
+		logger.Infof("Running %s.", s.name)
+		err := s.run(ctx, config)
+		switch e := err.(type) {
+		case nil:
+			logger.Infof("%s exit status 0", s.name)
+		case *exec.ExitError:
+			logger.Infof("%s %v", s.name, e)
+		default:
+			logger.Errorf("Error running %s: %v", s.name, err)
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			logger.Errorf("%s scripts did not finish within %s, skipping the rest", event, scriptTimeout(config, event))
+			break
+		}
+	}
+	logger.Infof("Finished running %s scripts.", event)
+	return nil
+}
+
+// scriptsEnabled reports whether the agent runs startup and shutdown scripts,
+// per [scripts] enable, instead of the GCEMetadataScripts scheduled tasks.
+// Shutdown scripts run when Windows shuts down, not when only the service
+// stops.
+func scriptsEnabled(config *ini.File) bool {
+	return config.Section("scripts").Key("enable").MustBool(false)
+}
+
+// runStartupScripts runs the startup scripts once per boot, so a service
+// restart doesn't run them again.
+func runStartupScripts(ctx context.Context, config *ini.File) {
+	boot := bootTime()
+	if last, err := readScriptsBoot(); err == nil && len(last) != 0 {
+		if t, err := time.Parse(time.RFC3339, last[0]); err == nil && absDuration(boot.Sub(t)) <= time.Minute {
+			logger.Debugf("Startup scripts already ran since boot at %s", t)
+			return
+		}
+	}
+	if err := writeScriptsBoot(boot.Format(time.RFC3339)); err != nil {
+		logger.Errorln("Error recording startup scripts run:", err)
+	}
+	if err := runScripts(ctx, config, "startup"); err != nil {
+		logger.Errorf("Error running startup scripts: %v", err)
+	}
+}
+
+// shutdownScriptsTimeout returns how long shutdown scripts may delay the
+// service stop.
+func shutdownScriptsTimeout(config *ini.File) time.Duration {
+	if !scriptsEnabled(config) {
+		return 0
+	}
+	return scriptTimeout(config, "shutdown")
+}
+
+// bootTime returns when the system booted, to the minute.
+func bootTime() time.Time {
+	return time.Now().Add(-systemUptime()).Truncate(time.Minute)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// runScriptsCommand runs the scripts for event from the command line, such
+// as during sysprep specialize.
+func runScriptsCommand(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: run-scripts specialize|startup|shutdown")
+	}
+	if _, err := scriptPrefix(args[0]); err != nil {
+		return err
+	}
+	return runScripts(ctx, loadConfig(), args[0])
+}
@@ -0,0 +1,168 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+func TestParseScripts(t *testing.T) {
+	attrs := map[string]string{
+		"windows-startup-script-url":    "gs://bucket/script.ps1",
+		"windows-startup-script-ps1":    "Write-Host hi",
+		"windows-startup-script-cmd":    " ",
+		"windows-shutdown-script-bat":   "echo bye",
+		"sysprep-specialize-script-cmd": "echo special",
+	}
+	var tests = []struct {
+		event string
+		want  []metadataScript
+	}{
+		{"startup", []metadataScript{{"windows-startup-script-ps1", "Write-Host hi"}, {"windows-startup-script-url", "gs://bucket/script.ps1"}}},
+		{"shutdown", []metadataScript{{"windows-shutdown-script-bat", "echo bye"}}},
+		{"specialize", []metadataScript{{"sysprep-specialize-script-cmd", "echo special"}}},
+	}
+
+	for _, tt := range tests {
+		prefix, err := scriptPrefix(tt.event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := parseScripts(prefix, attrs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseScripts(%q) got: %v, want: %v", prefix, got, tt.want)
+		}
+	}
+	if _, err := scriptPrefix("reboot"); err == nil {
+		t.Error("scriptPrefix(reboot) want error")
+	}
+}
+
+func TestGcsObject(t *testing.T) {
+	var tests = []struct {
+		url            string
+		bucket, object string
+		ok             bool
+	}{
+		{"gs://bucket/dir/script.ps1", "bucket", "dir/script.ps1", true},
+		{"https://bucket.storage.googleapis.com/script.ps1", "bucket", "script.ps1", true},
+		{"http://storage.cloud.google.com/bucket/script.ps1", "bucket", "script.ps1", true},
+		{"https://storage.googleapis.com/bucket/script.ps1", "bucket", "script.ps1", true},
+		{"https://commondatastorage.googleapis.com/bucket/script.ps1", "bucket", "script.ps1", true},
+		{"gs://bucket", "", "", false},
+		{"https://example.com/script.ps1", "", "", false},
+	}
+
+	for _, tt := range tests {
+		bucket, object, ok := gcsObject(tt.url)
+		if bucket != tt.bucket || object != tt.object || ok != tt.ok {
+			t.Errorf("gcsObject(%q) got: %q, %q, %t, want: %q, %q, %t", tt.url, bucket, object, ok, tt.bucket, tt.object, tt.ok)
+		}
+	}
+}
+
+// setupScriptsTest serves instance and project attributes from the metadata
+// server and records the scripts run, by name, with their contents.
+func setupScriptsTest(t *testing.T, instance, project map[string]string) (map[string]string, func()) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/instance/attributes/", func(w http.ResponseWriter, r *http.Request) { json.NewEncoder(w).Encode(instance) })
+	mux.HandleFunc("/project/attributes/", func(w http.ResponseWriter, r *http.Request) { json.NewEncoder(w).Encode(project) })
+	mux.HandleFunc("/script.cmd", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("echo downloaded")) })
+	ts := httptest.NewServer(mux)
+
+	ran := make(map[string]string)
+	oldServer, oldRun := metadataServer, runScriptCmd
+	metadataServer = ts.URL
+	runScriptCmd = func(c *exec.Cmd, name string) error {
+		file := c.Args[len(c.Args)-1]
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Errorf("error reading %s: %v", file, err)
+		}
+		ran[name] = filepath.Ext(file) + " " + string(data)
+		return nil
+	}
+	return ran, func() {
+		metadataServer, runScriptCmd = oldServer, oldRun
+		ts.Close()
+	}
+}
+
+func TestRunScripts(t *testing.T) {
+	var tests = []struct {
+		name              string
+		instance, project map[string]string
+		want              map[string]string
+	}{
+		{"instance", map[string]string{"windows-startup-script-ps1": "Write-Host hi"}, map[string]string{"windows-startup-script-cmd": "echo project"},
+			map[string]string{"windows-startup-script-ps1": ".ps1 Write-Host hi"}},
+		{"project", map[string]string{"other": "value"}, map[string]string{"windows-startup-script-cmd": "echo project"},
+			map[string]string{"windows-startup-script-cmd": ".cmd echo project"}},
+		{"url", map[string]string{"windows-startup-script-url": "URL/script.cmd"}, nil,
+			map[string]string{"windows-startup-script-url": ".cmd echo downloaded"}},
+		{"none", nil, nil, map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		ran, cleanup := setupScriptsTest(t, tt.instance, tt.project)
+		if u, ok := tt.instance["windows-startup-script-url"]; ok {
+			tt.instance["windows-startup-script-url"] = metadataServer + u[len("URL"):]
+		}
+		if err := runScripts(context.Background(), ini.Empty(), "startup"); err != nil {
+			t.Errorf("test case %q: runScripts() error: %v", tt.name, err)
+		}
+		cleanup()
+		if !reflect.DeepEqual(ran, tt.want) {
+			t.Errorf("test case %q: scripts run got: %q, want: %q", tt.name, ran, tt.want)
+		}
+	}
+}
+
+func TestRunStartupScriptsOncePerBoot(t *testing.T) {
+	ran, cleanup := setupScriptsTest(t, map[string]string{"windows-startup-script-cmd": "echo hi"}, nil)
+	defer cleanup()
+	oldRead, oldWrite := readScriptsBoot, writeScriptsBoot
+	defer func() { readScriptsBoot, writeScriptsBoot = oldRead, oldWrite }()
+	var boot []string
+	readScriptsBoot = func() ([]string, error) { return boot, nil }
+	writeScriptsBoot = func(b string) error {
+		boot = []string{b}
+		return nil
+	}
+
+	runStartupScripts(context.Background(), ini.Empty())
+	if len(ran) != 1 || len(boot) != 1 {
+		t.Fatalf("first run: scripts run %q, boot recorded %q", ran, boot)
+	}
+	delete(ran, "windows-startup-script-cmd")
+	runStartupScripts(context.Background(), ini.Empty())
+	if len(ran) != 0 {
+		t.Errorf("startup scripts ran again in the same boot: %q", ran)
+	}
+	boot = []string{"2018-01-01T00:00:00Z"}
+	runStartupScripts(context.Background(), ini.Empty())
+	if len(ran) != 1 {
+		t.Errorf("startup scripts did not run after a reboot")
+	}
+}
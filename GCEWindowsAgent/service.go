@@ -19,11 +19,24 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"time"
 
 	"github.com/kardianos/service"
 )
 
+// systemShutdown is set when the service stops because Windows shuts down,
+// shutdown scripts only run then.
+var systemShutdown int32
+
+func setSystemShutdown() {
+	atomic.StoreInt32(&systemShutdown, 1)
+}
+
+func isSystemShutdown() bool {
+	return atomic.LoadInt32(&systemShutdown) == 1
+}
+
 type program struct {
 	run     func(context.Context)
 	ctx     context.Context
@@ -68,13 +81,16 @@ func register(ctx context.Context, name, displayName, desc string, run func(cont
 
 	ctx, cancel := context.WithCancel(ctx)
 	done := make(chan struct{})
+	cfg := loadConfig()
 
 	prg := &program{
-		run:     run,
-		ctx:     ctx,
-		cancel:  cancel,
-		done:    done,
-		timeout: 15 * time.Second,
+		run:    run,
+		ctx:    ctx,
+		cancel: cancel,
+		done:   done,
+		// Leave time for the wsfc agent to drain and shutdown scripts to
+		// run on stop.
+		timeout: 15*time.Second + wsfcDrainPeriod(cfg) + shutdownScriptsTimeout(cfg),
 	}
 	svc, err := service.New(prg, svcConfig)
 	if err != nil {
@@ -83,7 +99,10 @@ func register(ctx context.Context, name, displayName, desc string, run func(cont
 
 	switch action {
 	case "run":
-		return svc.Run()
+		if service.Interactive() {
+			return svc.Run()
+		}
+		return runService(name, prg)
 	case "install":
 		if err := svc.Install(); err != nil {
 			return fmt.Errorf("failed to install service %s: %s", name, err)
@@ -0,0 +1,87 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"time"
+	"unsafe"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// windowsService runs a program as a Windows service. Unlike the service
+// package it accepts preshutdown, which Windows sends before shutdown and
+// waits for up to the preshutdown timeout, so shutdown scripts have time to
+// run.
+type windowsService struct {
+	p *program
+}
+
+func (w windowsService) Execute(args []string, r <-chan svc.ChangeRequest, s chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptPreShutdown
+	s <- svc.Status{State: svc.StartPending}
+	w.p.Start(nil)
+	s <- svc.Status{State: svc.Running, Accepts: accepted}
+	for c := range r {
+		switch c.Cmd {
+		case svc.Interrogate:
+			s <- c.CurrentStatus
+		case svc.Stop, svc.Shutdown, svc.PreShutdown:
+			if c.Cmd != svc.Stop {
+				setSystemShutdown()
+			}
+			s <- svc.Status{State: svc.StopPending, WaitHint: uint32(w.p.timeout / time.Millisecond)}
+			if err := w.p.Stop(nil); err != nil {
+				logger.Error(err)
+				return false, 1
+			}
+			return false, 0
+		}
+	}
+	return false, 0
+}
+
+// servicePreshutdownInfo is SERVICE_PRESHUTDOWN_INFO.
+type servicePreshutdownInfo struct {
+	timeout uint32
+}
+
+// setPreshutdownTimeout sets how long Windows waits for the service to stop
+// on preshutdown.
+func setPreshutdownTimeout(name string, d time.Duration) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	info := servicePreshutdownInfo{uint32(d / time.Millisecond)}
+	return windows.ChangeServiceConfig2(s.Handle, windows.SERVICE_CONFIG_PRESHUTDOWN_INFO, (*byte)(unsafe.Pointer(&info)))
+}
+
+// runService runs p as the Windows service name until it is stopped.
+func runService(name string, p *program) error {
+	if err := setPreshutdownTimeout(name, p.timeout); err != nil {
+		logger.Errorf("Error setting the preshutdown timeout: %v", err)
+	}
+	return svc.Run(name, windowsService{p})
+}
@@ -0,0 +1,358 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// defaultSnapshotChannel is the virtio-serial port persistent disk snapshots
+// send guest flush requests on.
+const defaultSnapshotChannel = `\\.\Global\com.google.snapshot.0`
+
+// snapshotRequest is a guest flush request, one JSON object per line. Op is
+// freeze or thaw, Volumes are the drives in the snapshot, all fixed volumes if
+// empty.
+type snapshotRequest struct {
+	ID      int64    `json:"id"`
+	Op      string   `json:"op"`
+	Volumes []string `json:"volumes,omitempty"`
+}
+
+// snapshotReply answers the request with ID.
+type snapshotReply struct {
+	ID    int64  `json:"id"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// snapshotFreezer brings applications to a consistent state on disk before a
+// snapshot and releases them after it.
+type snapshotFreezer interface {
+	freeze(ctx context.Context, requester string, volumes []string) error
+	thaw() error
+}
+
+// vssThawTimeout is how long the VSS requester has to finish the snapshot set
+// after thaw.
+var vssThawTimeout = 30 * time.Second
+
+// vssFreezer runs requester, a VSS requester using the Google snapshot
+// provider, with the volumes to snapshot as arguments, all fixed volumes if
+// none. The requester prints "frozen" once the writers are frozen and holds
+// the snapshot set open, which keeps them frozen, until its standard input is
+// closed on thaw. Creating and deleting a shadow copy with the system
+// provider would release the writers before the disk snapshot is taken.
+type vssFreezer struct {
+	cmd    *exec.Cmd
+	stdin  io.Closer
+	exited chan error
+}
+
+// newVSSRequester is replaced in tests.
+var newVSSRequester = exec.Command
+
+func (f *vssFreezer) freeze(ctx context.Context, requester string, volumes []string) error {
+	if requester == "" {
+		return errors.New("no [snapshots] vss_requester set")
+	}
+	var args []string
+	for _, v := range volumes {
+		d, err := normalizeDrive(v)
+		if err != nil {
+			return err
+		}
+		args = append(args, d+`\`)
+	}
+	cmd := newVSSRequester(requester, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting VSS requester %s: %v", requester, err)
+	}
+	frozen := make(chan struct{})
+	exited := make(chan error, 1)
+	go func() {
+		in := bufio.NewScanner(stdout)
+		signaled := false
+		for in.Scan() {
+			if !signaled && strings.TrimSpace(in.Text()) == "frozen" {
+				signaled = true
+				close(frozen)
+				continue
+			}
+			logger.Debugf("VSS requester: %s", in.Text())
+		}
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case <-frozen:
+		f.cmd, f.stdin, f.exited = cmd, stdin, exited
+		return nil
+	case err := <-exited:
+		return fmt.Errorf("VSS requester exited before freezing: %v, output: %s", err, stderr.String())
+	case <-ctx.Done():
+		cmd.Process.Kill()
+		<-exited
+		return fmt.Errorf("VSS requester did not freeze: %v", ctx.Err())
+	}
+}
+
+func (f *vssFreezer) thaw() error {
+	if f.cmd == nil {
+		return nil
+	}
+	cmd, exited := f.cmd, f.exited
+	f.cmd, f.exited = nil, nil
+	f.stdin.Close()
+	select {
+	case err := <-exited:
+		if err != nil {
+			return fmt.Errorf("VSS requester failed, the snapshot may not be consistent: %v", err)
+		}
+		return nil
+	case <-time.After(vssThawTimeout):
+		cmd.Process.Kill()
+		<-exited
+		return fmt.Errorf("VSS requester did not finish within %s of thawing", vssThawTimeout)
+	}
+}
+
+var (
+	// snapshotRecheck is how often the snapshot settings are checked and a
+	// closed channel reopened.
+	snapshotRecheck = time.Minute
+
+	// snapshotFreezerMgr and openSnapshotChannel are replaced in tests.
+	snapshotFreezerMgr  snapshotFreezer = &vssFreezer{}
+	openSnapshotChannel                 = func(name string) (io.ReadWriteCloser, error) {
+		return os.OpenFile(name, os.O_RDWR, 0)
+	}
+)
+
+// snapshotHandler answers the requests on one channel. A freeze not followed
+// by a thaw within the freeze timeout is thawed, so a lost thaw request
+// doesn't leave applications frozen.
+type snapshotHandler struct {
+	config *ini.File
+
+	mu        sync.Mutex
+	frozen    bool
+	autoThaw  *time.Timer
+	thawError error
+}
+
+// snapshotScript returns the path of the pre or post snapshot script from
+// [snapshots] <hook>_script, or else the snapshot-<hook>-script instance and
+// then project attribute. It is empty if there is none.
+func snapshotScript(ctx context.Context, config *ini.File, hook string) string {
+	if script := config.Section("snapshots").Key(hook + "_script").String(); script != "" {
+		return script
+	}
+	for _, level := range []string{"instance", "project"} {
+		data, err := getMetadataPath(ctx, config, level+"/attributes/snapshot-"+hook+"-script")
+		if err != nil {
+			continue
+		}
+		if script := strings.TrimSpace(string(data)); script != "" {
+			return script
+		}
+	}
+	return ""
+}
+
+// runSnapshotScript runs the pre or post snapshot script, if any, for at most
+// [snapshots] script_timeout_sec.
+func runSnapshotScript(ctx context.Context, config *ini.File, hook string) error {
+	timeout := time.Duration(config.Section("snapshots").Key("script_timeout_sec").MustInt(30)) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	script := snapshotScript(ctx, config, hook)
+	if script == "" {
+		return nil
+	}
+	logger.Infof("Running snapshot %s script %s.", hook, script)
+	if err := runScriptCmd(scriptCommand(ctx, script), "snapshot "+hook+" script"); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("snapshot %s script %s did not finish within %s", hook, script, timeout)
+		}
+		return fmt.Errorf("error running snapshot %s script %s: %v", hook, script, err)
+	}
+	return nil
+}
+
+func (h *snapshotHandler) freeze(ctx context.Context, volumes []string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.frozen {
+		return errors.New("already frozen")
+	}
+	sec := h.config.Section("snapshots")
+	timeout := time.Duration(sec.Key("freeze_timeout_sec").MustInt(60)) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	if err := runSnapshotScript(ctx, h.config, "pre"); err != nil {
+		return err
+	}
+	if sec.Key("vss").MustBool(true) {
+		if err := snapshotFreezerMgr.freeze(ctx, sec.Key("vss_requester").String(), volumes); err != nil {
+			if err := runSnapshotScript(context.Background(), h.config, "post"); err != nil {
+				logger.Error(err)
+			}
+			return err
+		}
+	}
+	h.frozen, h.thawError = true, nil
+	h.autoThaw = time.AfterFunc(timeout, func() {
+		logger.Errorf("No thaw request within %s of freezing for a snapshot, thawing", timeout)
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		h.thawError = fmt.Errorf("thawed after the freeze timeout of %s", timeout)
+		h.thawLocked()
+	})
+	return nil
+}
+
+// thawLocked releases a freeze, h.mu must be held.
+func (h *snapshotHandler) thawLocked() error {
+	if !h.frozen {
+		return nil
+	}
+	h.frozen = false
+	h.autoThaw.Stop()
+	var firstErr error
+	if h.config.Section("snapshots").Key("vss").MustBool(true) {
+		firstErr = snapshotFreezerMgr.thaw()
+	}
+	if err := runSnapshotScript(context.Background(), h.config, "post"); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+// thaw releases the freeze. It fails if the freeze timed out, as the snapshot
+// may not be consistent.
+func (h *snapshotHandler) thaw() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := h.thawError; err != nil {
+		h.thawError = nil
+		return err
+	}
+	return h.thawLocked()
+}
+
+func (h *snapshotHandler) handle(ctx context.Context, req snapshotRequest) snapshotReply {
+	var err error
+	switch req.Op {
+	case "freeze":
+		logger.Infof("Freezing for snapshot request %d.", req.ID)
+		err = h.freeze(ctx, req.Volumes)
+	case "thaw":
+		logger.Infof("Thawing for snapshot request %d.", req.ID)
+		err = h.thaw()
+	default:
+		err = fmt.Errorf("unknown operation %q", req.Op)
+	}
+	if err != nil {
+		logger.Errorf("Error handling snapshot request %d: %v", req.ID, err)
+		snapshotFailures.inc(req.Op)
+		return snapshotReply{ID: req.ID, Error: err.Error()}
+	}
+	return snapshotReply{ID: req.ID, OK: true}
+}
+
+// serveSnapshots answers the requests read from rw until it is closed. Any
+// freeze still held is thawed when it returns.
+func serveSnapshots(ctx context.Context, config *ini.File, rw io.ReadWriter) error {
+	h := &snapshotHandler{config: config}
+	defer func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if err := h.thawLocked(); err != nil {
+			logger.Error(err)
+		}
+	}()
+	in := bufio.NewScanner(rw)
+	enc := json.NewEncoder(rw)
+	for in.Scan() {
+		var req snapshotRequest
+		var reply snapshotReply
+		if err := json.Unmarshal(in.Bytes(), &req); err != nil {
+			reply.Error = fmt.Sprintf("invalid request: %v", err)
+		} else {
+			reply = h.handle(ctx, req)
+		}
+		if err := enc.Encode(reply); err != nil {
+			return err
+		}
+	}
+	return in.Err()
+}
+
+// snapshotLoop serves guest flush requests on [snapshots] channel while
+// [snapshots] enable is set.
+func snapshotLoop(ctx context.Context) {
+	periodicLoop(ctx, periodicTask{
+		name:     "snapshot requests",
+		interval: every(snapshotRecheck),
+		due: func(cfg *ini.File, _ time.Time) bool {
+			return cfg.Section("snapshots").Key("enable").MustBool(false)
+		},
+		run: func(ctx context.Context, cfg *ini.File) error {
+			name := cfg.Section("snapshots").Key("channel").MustString(defaultSnapshotChannel)
+			ch, err := openSnapshotChannel(name)
+			if err != nil {
+				return fmt.Errorf("error opening snapshot channel %s: %v", name, err)
+			}
+			defer ch.Close()
+			logger.Infof("Serving snapshot requests on %s", name)
+			done := make(chan struct{})
+			defer close(done)
+			go func() {
+				select {
+				case <-ctx.Done():
+					ch.Close()
+				case <-done:
+				}
+			}()
+			return serveSnapshots(ctx, cfg, ch)
+		},
+	})
+}
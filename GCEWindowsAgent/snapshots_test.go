@@ -0,0 +1,250 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+type fakeFreezer struct {
+	mu        sync.Mutex
+	calls     []string
+	freezeErr error
+}
+
+func (f *fakeFreezer) freeze(ctx context.Context, requester string, volumes []string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "freeze "+strings.Join(volumes, ","))
+	return f.freezeErr
+}
+
+func (f *fakeFreezer) thaw() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, "thaw")
+	return nil
+}
+
+func (f *fakeFreezer) called() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// TestVSSRequesterHelper is run as the VSS requester by TestVSSFreezer. It
+// acts as GCE_TEST_VSS_REQUESTER says: freeze holds the freeze until its
+// input is closed, fail exits without freezing and hang never freezes.
+func TestVSSRequesterHelper(t *testing.T) {
+	switch os.Getenv("GCE_TEST_VSS_REQUESTER") {
+	case "freeze":
+		fmt.Println("frozen")
+		ioutil.ReadAll(os.Stdin)
+		os.Exit(0)
+	case "fail":
+		fmt.Fprintln(os.Stderr, "VSS_E_UNEXPECTED_PROVIDER_ERROR")
+		os.Exit(1)
+	case "hang":
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+}
+
+func TestVSSFreezer(t *testing.T) {
+	oldNew := newVSSRequester
+	defer func() { newVSSRequester = oldNew }()
+
+	var tests = []struct {
+		mode, requester string
+		wantFreezeErr   bool
+	}{
+		{"freeze", "requester.exe", false},
+		{"fail", "requester.exe", true},
+		{"hang", "requester.exe", true},
+		{"freeze", "", true},
+	}
+	for _, tt := range tests {
+		var gotArgs []string
+		newVSSRequester = func(name string, args ...string) *exec.Cmd {
+			gotArgs = args
+			cmd := exec.Command(os.Args[0], "-test.run=TestVSSRequesterHelper")
+			cmd.Env = append(os.Environ(), "GCE_TEST_VSS_REQUESTER="+tt.mode)
+			return cmd
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		f := &vssFreezer{}
+		err := f.freeze(ctx, tt.requester, []string{"c", "D:"})
+		cancel()
+		if (err != nil) != tt.wantFreezeErr {
+			t.Errorf("test case %q %q: freeze() error: %v, want error: %t", tt.mode, tt.requester, err, tt.wantFreezeErr)
+		}
+		if err == nil && !reflect.DeepEqual(gotArgs, []string{`C:\`, `D:\`}) {
+			t.Errorf("test case %q: requester args got: %q", tt.mode, gotArgs)
+		}
+		if err := f.thaw(); err != nil {
+			t.Errorf("test case %q %q: thaw() error: %v", tt.mode, tt.requester, err)
+		}
+	}
+}
+
+// setupSnapshotMetadata serves the snapshot script attributes in attrs,
+// keyed by metadata path.
+func setupSnapshotMetadata(attrs map[string]string) func() {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, ok := attrs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(v))
+	}))
+	oldServer := metadataServer
+	metadataServer = ts.URL
+	return func() {
+		metadataServer = oldServer
+		ts.Close()
+	}
+}
+
+func TestServeSnapshots(t *testing.T) {
+	oldFreezer := snapshotFreezerMgr
+	defer func() { snapshotFreezerMgr = oldFreezer }()
+	defer setupSnapshotMetadata(nil)()
+
+	var tests = []struct {
+		name      string
+		data      string
+		requests  string
+		freezeErr error
+		want      string
+		wantCalls []string
+	}{
+		{"freeze and thaw", "", `{"id":1,"op":"freeze","volumes":["C:"]}` + "\n" + `{"id":2,"op":"thaw"}` + "\n", nil,
+			`{"id":1,"ok":true}` + "\n" + `{"id":2,"ok":true}` + "\n", []string{"freeze C:", "thaw"}},
+		{"already frozen", "", `{"id":1,"op":"freeze"}` + "\n" + `{"id":2,"op":"freeze"}` + "\n", nil,
+			`{"id":1,"ok":true}` + "\n" + `{"id":2,"ok":false,"error":"already frozen"}` + "\n", []string{"freeze ", "thaw"}},
+		{"freeze error", "", `{"id":1,"op":"freeze"}` + "\n", errors.New("vss error"),
+			`{"id":1,"ok":false,"error":"vss error"}` + "\n", []string{"freeze "}},
+		{"vss disabled", "[snapshots]\nvss=false", `{"id":1,"op":"freeze"}` + "\n" + `{"id":2,"op":"thaw"}` + "\n", nil,
+			`{"id":1,"ok":true}` + "\n" + `{"id":2,"ok":true}` + "\n", nil},
+		{"thaw without freeze", "", `{"id":1,"op":"thaw"}` + "\n", nil, `{"id":1,"ok":true}` + "\n", nil},
+		{"unknown op", "", `{"id":1,"op":"flush"}` + "\n", nil, `{"id":1,"ok":false,"error":"unknown operation \"flush\""}` + "\n", nil},
+		{"invalid request", "", "freeze\n", nil, `{"id":0,"ok":false,"error":"invalid request: invalid character 'r' in literal false (expecting 'a')"}` + "\n", nil},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		freezer := &fakeFreezer{freezeErr: tt.freezeErr}
+		snapshotFreezerMgr = freezer
+		var out bytes.Buffer
+		rw := struct {
+			io.Reader
+			io.Writer
+		}{strings.NewReader(tt.requests), &out}
+		if err := serveSnapshots(context.Background(), cfg, rw); err != nil {
+			t.Errorf("test case %q: serveSnapshots() error: %v", tt.name, err)
+		}
+		if out.String() != tt.want {
+			t.Errorf("test case %q: replies got: %q, want: %q", tt.name, out.String(), tt.want)
+		}
+		if !reflect.DeepEqual(freezer.calls, tt.wantCalls) {
+			t.Errorf("test case %q: freezer calls got: %q, want: %q", tt.name, freezer.calls, tt.wantCalls)
+		}
+	}
+}
+
+func TestSnapshotAutoThaw(t *testing.T) {
+	oldFreezer := snapshotFreezerMgr
+	defer func() { snapshotFreezerMgr = oldFreezer }()
+	defer setupSnapshotMetadata(nil)()
+	freezer := &fakeFreezer{}
+	snapshotFreezerMgr = freezer
+
+	cfg, err := ini.InsensitiveLoad([]byte("[snapshots]\nfreeze_timeout_sec=1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &snapshotHandler{config: cfg}
+	if r := h.handle(context.Background(), snapshotRequest{ID: 1, Op: "freeze"}); !r.OK {
+		t.Fatalf("freeze failed: %s", r.Error)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if got, want := freezer.called(), []string{"freeze ", "thaw"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("freezer calls got: %q, want: %q", got, want)
+	}
+	if r := h.handle(context.Background(), snapshotRequest{ID: 2, Op: "thaw"}); r.OK {
+		t.Error("thaw after the freeze timeout succeeded, want error")
+	}
+}
+
+func TestRunSnapshotScript(t *testing.T) {
+	oldRun := runScriptCmd
+	defer func() { runScriptCmd = oldRun }()
+	var ran []string
+	runScriptCmd = func(c *exec.Cmd, name string) error {
+		ran = append(ran, name+": "+c.Args[len(c.Args)-1])
+		return nil
+	}
+
+	var tests = []struct {
+		name  string
+		data  string
+		attrs map[string]string
+		want  []string
+	}{
+		{"none", "", nil, nil},
+		{"config", "[snapshots]\npre_script=C:\\pre.ps1", map[string]string{"/instance/attributes/snapshot-pre-script": `C:\md.cmd`},
+			[]string{`snapshot pre script: C:\pre.ps1`}},
+		{"instance", "", map[string]string{"/instance/attributes/snapshot-pre-script": `C:\instance.cmd`, "/project/attributes/snapshot-pre-script": `C:\project.cmd`},
+			[]string{`snapshot pre script: C:\instance.cmd`}},
+		{"project", "", map[string]string{"/project/attributes/snapshot-pre-script": `C:\project.cmd`},
+			[]string{`snapshot pre script: C:\project.cmd`}},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleanup := setupSnapshotMetadata(tt.attrs)
+		ran = nil
+		if err := runSnapshotScript(context.Background(), cfg, "pre"); err != nil {
+			t.Errorf("test case %q: runSnapshotScript() error: %v", tt.name, err)
+		}
+		cleanup()
+		if !reflect.DeepEqual(ran, tt.want) {
+			t.Errorf("test case %q: scripts run got: %q, want: %q", tt.name, ran, tt.want)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+const (
+	// sshKeysRegName is a REG_MULTI_SZ value under regKeyBase holding the
+	// users whose authorized_keys file the agent wrote.
+	sshKeysRegName = "SSHKeyUsers"
+	// administratorsSID is the well known SID of the Administrators group.
+	administratorsSID = "S-1-5-32-544"
+
+	// sshKeysBegin and sshKeysEnd mark the keys the agent manages in a key
+	// file, keys outside of them are left alone.
+	sshKeysBegin = "# Added by the Google Compute Engine agent, changes below are replaced."
+	sshKeysEnd   = "# End of keys added by the Google Compute Engine agent."
+)
+
+var (
+	sshKeysDisabled = true
+
+	// sshDir is the OpenSSH config directory holding
+	// administrators_authorized_keys.
+	sshDir = filepath.Join(os.Getenv("ProgramData"), "ssh")
+
+	// sshUserInfo, setKeyFileACL, readSSHKeyUsers and writeSSHKeyUsers are
+	// replaced in tests.
+	sshUserInfo      = lookupSSHUser
+	setKeyFileACL    = icaclsKeyFile
+	readSSHKeyUsers  = func() ([]string, error) { return readRegMultiString(regKeyBase, sshKeysRegName) }
+	writeSSHKeyUsers = func(users []string) error { return writeRegMultiString(regKeyBase, sshKeysRegName, users) }
+)
+
+// lookupSSHUser returns the profile directory of a local user and whether it
+// is an administrator.
+func lookupSSHUser(username string) (string, bool, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return "", false, err
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return "", false, err
+	}
+	return u.HomeDir, containsString(administratorsSID, gids), nil
+}
+
+// icaclsKeyFile limits access to path to SYSTEM, Administrators and owner, if
+// set, as OpenSSH refuses key files others can write.
+func icaclsKeyFile(path, owner string) error {
+	args := []string{path, "/inheritance:r", "/grant", "*S-1-5-18:F", "/grant", "*" + administratorsSID + ":F"}
+	if owner != "" {
+		args = append(args, "/grant", owner+":F")
+	}
+	if out, err := exec.Command("icacls.exe", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("error setting ACL on %s: %v, output: %s", path, err, out)
+	}
+	return nil
+}
+
+type sshKeys struct {
+	newMetadata, oldMetadata *metadataJSON
+	config                   *ini.File
+}
+
+func (s *sshKeys) diff() bool {
+	n, o := s.newMetadata, s.oldMetadata
+	return n.Instance.Attributes.SSHKeys != o.Instance.Attributes.SSHKeys ||
+		n.Instance.Attributes.WindowsSSHKeys != o.Instance.Attributes.WindowsSSHKeys ||
+		n.Instance.Attributes.BlockProjectSSHKeys != o.Instance.Attributes.BlockProjectSSHKeys ||
+		n.Project.Attributes.SSHKeys != o.Project.Attributes.SSHKeys ||
+		n.Project.Attributes.WindowsSSHKeys != o.Project.Attributes.WindowsSSHKeys
+}
+
+func (s *sshKeys) metadataPaths() []string {
+	return attributePaths
+}
+
+func (s *sshKeys) diffPaths() []string {
+	return []string{
+		"instance/attributes/ssh-keys", "instance/attributes/windows-ssh-keys", "instance/attributes/block-project-ssh-keys",
+		"project/attributes/ssh-keys", "project/attributes/windows-ssh-keys",
+	}
+}
+
+func (s *sshKeys) disabled() (disabled bool) {
+	defer func() {
+		if disabled != sshKeysDisabled {
+			sshKeysDisabled = disabled
+			logStatus("SSH keys", disabled)
+		}
+	}()
+
+	return !s.enablement().Enabled
+}
+
+var sshKeysEnable = enableRule{
+	section:   "sshKeys",
+	key:       "enable",
+	attribute: "enable-windows-ssh",
+	value:     func(a attributesJSON) string { return a.EnableWindowsSSH },
+}
+
+// SSH key management is opt-in and disabled by default.
+func (s *sshKeys) enablement() enablement {
+	return isEnabled(s.config, s.newMetadata, sshKeysEnable, !sshKeysDisabled)
+}
+
+// googleSSHKeyJSON is the JSON trailer of keys added by gcloud, which
+// expire.
+type googleSSHKeyJSON struct {
+	UserName string
+	ExpireOn string
+}
+
+// parseSSHKeys parses "user:key" lines, as in the ssh-keys attribute, into
+// keys by user. Expired keys and invalid lines are skipped.
+func parseSSHKeys(data string, now time.Time) map[string][]string {
+	keys := map[string][]string{}
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 || i == len(line)-1 {
+			logger.Errorf("Invalid SSH key entry %q, want user:key", line)
+			continue
+		}
+		name, key := line[:i], strings.TrimSpace(line[i+1:])
+		if j := strings.Index(key, "google-ssh "); j != -1 {
+			var g googleSSHKeyJSON
+			if err := json.Unmarshal([]byte(key[j+len("google-ssh "):]), &g); err == nil && g.ExpireOn != "" {
+				t, err := time.Parse(time.RFC3339, g.ExpireOn)
+				if err != nil || t.Before(now) {
+					continue
+				}
+			}
+		}
+		if !containsString(key, keys[name]) {
+			keys[name] = append(keys[name], key)
+		}
+	}
+	return keys
+}
+
+// wantKeys returns the keys by user from the instance and, unless blocked,
+// project attributes.
+func (s *sshKeys) wantKeys(now time.Time) map[string][]string {
+	inst, proj := s.newMetadata.Instance.Attributes, s.newMetadata.Project.Attributes
+	data := []string{inst.SSHKeys, inst.WindowsSSHKeys}
+	if block, _ := strconv.ParseBool(inst.BlockProjectSSHKeys); !block {
+		data = append(data, proj.SSHKeys, proj.WindowsSSHKeys)
+	}
+	return parseSSHKeys(strings.Join(data, "\n"), now)
+}
+
+// sshKeyNames returns the users with keys in want and the users whose key
+// files the agent wrote before, sorted.
+func sshKeyNames(want map[string][]string) ([]string, error) {
+	oldUsers, err := readSSHKeyUsers()
+	if err != nil && err != errRegNotExist {
+		return nil, err
+	}
+	var names []string
+	for name := range want {
+		names = append(names, name)
+	}
+	for _, name := range oldUsers {
+		if _, ok := want[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// plan returns the key files set would change.
+func (s *sshKeys) plan() ([]string, error) {
+	want := s.wantKeys(time.Now())
+	names, err := sshKeyNames(want)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes, adminKeys []string
+	for _, name := range names {
+		home, admin, err := sshUserInfo(name)
+		if err != nil {
+			continue
+		}
+		if admin {
+			adminKeys = append(adminKeys, want[name]...)
+			continue
+		}
+		changed, err := keyFileChanged(filepath.Join(home, ".ssh", "authorized_keys"), want[name])
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			changes = append(changes, fmt.Sprintf("update the SSH keys of %s", name))
+		}
+	}
+	changed, err := keyFileChanged(filepath.Join(sshDir, "administrators_authorized_keys"), adminKeys)
+	if err != nil {
+		return nil, err
+	}
+	if changed {
+		changes = append(changes, "update the SSH keys of administrators")
+	}
+	return changes, nil
+}
+
+// set writes the keys of administrators to administrators_authorized_keys,
+// which OpenSSH uses for every member of Administrators, and the keys of
+// other users to their own .ssh\authorized_keys. The agent's keys are removed
+// from the key files of users that no longer have keys.
+func (s *sshKeys) set(ctx context.Context) error {
+	want := s.wantKeys(time.Now())
+	names, err := sshKeyNames(want)
+	if err != nil {
+		return err
+	}
+
+	var adminKeys, users []string
+	var firstErr error
+	for _, name := range names {
+		home, admin, err := sshUserInfo(name)
+		if err != nil {
+			logger.Errorf("Not writing SSH keys for %s: %v", name, err)
+			continue
+		}
+		if admin {
+			adminKeys = append(adminKeys, want[name]...)
+			continue
+		}
+		if err := writeKeyFile(filepath.Join(home, ".ssh", "authorized_keys"), want[name], name); err != nil {
+			logger.Error(err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if len(want[name]) > 0 {
+			users = append(users, name)
+		}
+	}
+
+	if err := writeKeyFile(filepath.Join(sshDir, "administrators_authorized_keys"), adminKeys, ""); err != nil {
+		return err
+	}
+	if err := writeSSHKeyUsers(users); err != nil {
+		return err
+	}
+	return firstErr
+}
+
+// managedKeyFile returns the key file content with the agent's keys in
+// existing replaced by keys. Lines outside of the agent's block, such as keys
+// added by hand, are kept.
+func managedKeyFile(existing string, keys []string) string {
+	var lines []string
+	var inBlock bool
+	for _, line := range strings.Split(strings.Replace(existing, "\r\n", "\n", -1), "\n") {
+		switch {
+		case line == sshKeysBegin:
+			inBlock = true
+		case line == sshKeysEnd:
+			inBlock = false
+		case !inBlock:
+			lines = append(lines, line)
+		}
+	}
+	for len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(keys) > 0 {
+		lines = append(append(append(lines, sshKeysBegin), keys...), sshKeysEnd)
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// writeKeyFile replaces the agent's keys in the key file at path with keys.
+// The new file is written to a temporary file that is made readable only by
+// owner and the system before the keys are written, then renamed over path.
+// keyFileChanged reports whether writeKeyFile would change the file at path.
+func keyFileChanged(path string, keys []string) (bool, error) {
+	existing, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	return managedKeyFile(string(existing), keys) != string(existing), nil
+}
+
+func writeKeyFile(path string, keys []string, owner string) error {
+	existing, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	data := managedKeyFile(string(existing), keys)
+	if data == string(existing) {
+		return nil
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	f.Close()
+	defer os.Remove(tmp)
+	if err := setKeyFileACL(tmp, owner); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(tmp, []byte(data), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
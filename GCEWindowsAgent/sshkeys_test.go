@@ -0,0 +1,187 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSSHKeys(t *testing.T) {
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	var tests = []struct {
+		name string
+		data string
+		want map[string][]string
+	}{
+		{"empty", "", map[string][]string{}},
+		{"one key", "alice:ssh-rsa AAAA alice", map[string][]string{"alice": {"ssh-rsa AAAA alice"}}},
+		{"duplicate key", "alice:ssh-rsa AAAA\nalice:ssh-rsa AAAA", map[string][]string{"alice": {"ssh-rsa AAAA"}}},
+		{"invalid lines", "alice\n:ssh-rsa AAAA\nbob:\n# comment", map[string][]string{}},
+		{"invalid expiry", `alice:ecdsa AAAA google-ssh {"userName":"a@b.com","expireOn":"2018-06-02T00:00:00+0000"}`, map[string][]string{}},
+		{"expired", `alice:ecdsa AAAA google-ssh {"userName":"a@b.com","expireOn":"2018-05-01T00:00:00Z"}`, map[string][]string{}},
+		{"not expired", `alice:ecdsa AAAA google-ssh {"userName":"a@b.com","expireOn":"2018-06-02T00:00:00Z"}`,
+			map[string][]string{"alice": {`ecdsa AAAA google-ssh {"userName":"a@b.com","expireOn":"2018-06-02T00:00:00Z"}`}}},
+	}
+	for _, tt := range tests {
+		if got := parseSSHKeys(tt.data, now); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("test case %q: parseSSHKeys() got: %v, want: %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSSHKeysSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDir, oldInfo, oldACL, oldRead, oldWrite := sshDir, sshUserInfo, setKeyFileACL, readSSHKeyUsers, writeSSHKeyUsers
+	defer func() {
+		sshDir, sshUserInfo, setKeyFileACL, readSSHKeyUsers, writeSSHKeyUsers = oldDir, oldInfo, oldACL, oldRead, oldWrite
+	}()
+
+	sshDir = filepath.Join(dir, "ssh")
+	admins := map[string]bool{"admin": true}
+	sshUserInfo = func(name string) (string, bool, error) {
+		if name == "nobody" {
+			return "", false, fmt.Errorf("unknown user %s", name)
+		}
+		return filepath.Join(dir, name), admins[name], nil
+	}
+	var acls []string
+	setKeyFileACL = func(path, owner string) error {
+		acls = append(acls, owner)
+		return nil
+	}
+	stored := []string{"gone"}
+	readSSHKeyUsers = func() ([]string, error) { return stored, nil }
+	writeSSHKeyUsers = func(users []string) error {
+		stored = users
+		return nil
+	}
+	if err := writeKeyFile(filepath.Join(dir, "gone", ".ssh", "authorized_keys"), []string{"ssh-rsa OLD"}, "gone"); err != nil {
+		t.Fatal(err)
+	}
+	// Keys added by hand are kept.
+	if err := os.MkdirAll(filepath.Join(dir, "alice", ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "alice", ".ssh", "authorized_keys"), []byte("ssh-rsa MANUAL\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	md := &metadataJSON{
+		Instance: instanceJSON{Attributes: attributesJSON{
+			SSHKeys:        "admin:ssh-rsa ADMIN\nnobody:ssh-rsa NOBODY",
+			WindowsSSHKeys: "alice:ssh-rsa ALICE",
+		}},
+		Project: projectJSON{Attributes: attributesJSON{SSHKeys: "bob:ssh-rsa BOB"}},
+	}
+	s := &sshKeys{newMetadata: md, oldMetadata: &metadataJSON{}}
+	if err := s.set(context.Background()); err != nil {
+		t.Fatalf("set() returned error: %v", err)
+	}
+
+	block := func(key string) string {
+		return sshKeysBegin + "\r\n" + key + "\r\n" + sshKeysEnd + "\r\n"
+	}
+	files := map[string]string{
+		filepath.Join(dir, "ssh", "administrators_authorized_keys"): block("ssh-rsa ADMIN"),
+		filepath.Join(dir, "alice", ".ssh", "authorized_keys"):      "ssh-rsa MANUAL\r\n" + block("ssh-rsa ALICE"),
+		filepath.Join(dir, "bob", ".ssh", "authorized_keys"):        block("ssh-rsa BOB"),
+		filepath.Join(dir, "gone", ".ssh", "authorized_keys"):       "",
+	}
+	for path, want := range files {
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("error reading %s: %v", path, err)
+			continue
+		}
+		if string(got) != want {
+			t.Errorf("%s got: %q, want: %q", path, got, want)
+		}
+	}
+	if want := []string{"alice", "bob"}; !reflect.DeepEqual(stored, want) {
+		t.Errorf("managed users got: %q, want: %q", stored, want)
+	}
+	if want := []string{"gone", "alice", "bob", "gone", ""}; !reflect.DeepEqual(acls, want) {
+		t.Errorf("ACL owners got: %q, want: %q", acls, want)
+	}
+
+	// Blocking project keys empties the key file of bob.
+	md.Instance.Attributes.BlockProjectSSHKeys = "true"
+	if err := s.set(context.Background()); err != nil {
+		t.Fatalf("set() returned error: %v", err)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(dir, "bob", ".ssh", "authorized_keys")); len(got) != 0 {
+		t.Errorf("bob's key file got: %q, want empty", got)
+	}
+	if want := []string{"alice"}; !reflect.DeepEqual(stored, want) {
+		t.Errorf("managed users got: %q, want: %q", stored, want)
+	}
+}
+
+func TestSSHKeysDiff(t *testing.T) {
+	var tests = []struct {
+		name string
+		old  attributesJSON
+		new  attributesJSON
+		want bool
+	}{
+		{"unchanged", attributesJSON{SSHKeys: "a:k"}, attributesJSON{SSHKeys: "a:k"}, false},
+		{"ssh-keys", attributesJSON{SSHKeys: "a:k"}, attributesJSON{SSHKeys: "a:j"}, true},
+		{"windows-ssh-keys", attributesJSON{}, attributesJSON{WindowsSSHKeys: "a:k"}, true},
+		{"block project keys", attributesJSON{}, attributesJSON{BlockProjectSSHKeys: "true"}, true},
+	}
+	for _, tt := range tests {
+		s := &sshKeys{
+			newMetadata: &metadataJSON{Instance: instanceJSON{Attributes: tt.new}},
+			oldMetadata: &metadataJSON{Instance: instanceJSON{Attributes: tt.old}},
+		}
+		if got := s.diff(); got != tt.want {
+			t.Errorf("test case %q: diff() got: %t, want: %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestManagedKeyFile(t *testing.T) {
+	block := sshKeysBegin + "\r\nssh-rsa NEW\r\n" + sshKeysEnd + "\r\n"
+	var tests = []struct {
+		name     string
+		existing string
+		keys     []string
+		want     string
+	}{
+		{"new file", "", []string{"ssh-rsa NEW"}, block},
+		{"no keys", "", nil, ""},
+		{"manual keys kept", "ssh-rsa MANUAL\n", []string{"ssh-rsa NEW"}, "ssh-rsa MANUAL\r\n" + block},
+		{"block replaced", "ssh-rsa MANUAL\r\n" + sshKeysBegin + "\r\nssh-rsa OLD\r\n" + sshKeysEnd + "\r\nssh-rsa AFTER\r\n", []string{"ssh-rsa NEW"}, "ssh-rsa MANUAL\r\nssh-rsa AFTER\r\n" + block},
+		{"block removed", "ssh-rsa MANUAL\r\n" + sshKeysBegin + "\r\nssh-rsa OLD\r\n" + sshKeysEnd + "\r\n", nil, "ssh-rsa MANUAL\r\n"},
+	}
+
+	for _, tt := range tests {
+		if got := managedKeyFile(tt.existing, tt.keys); got != tt.want {
+			t.Errorf("test case %q: managedKeyFile() got: %q, want: %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+const (
+	stateRegName = "AgentState"
+	// appliedStateRegName is a REG_MULTI_SZ value under regKeyBase holding
+	// the appliedStateJSON. Unlike AgentState it is written as changes are
+	// applied, so it survives a crash.
+	appliedStateRegName = "AppliedState"
+)
+
+// agentStateJSON is the in-memory state that survives agent restarts and
+// upgrades. Everything else, like metadata etags and the lists used to avoid
+// logging the same bad entry twice, is ephemeral and rebuilt on startup.
+type agentStateJSON struct {
+	// Version is the agent version that saved the state.
+	Version string
+	// ManagerStates is the last state of each manager, so a restart does not
+	// hide or emit a spurious transition event.
+	ManagerStates map[string]string
+	// DiagnosticsEntries are the diagnostics requests that were already
+	// handled and must not run again.
+	DiagnosticsEntries []string
+}
+
+func captureAgentState() agentStateJSON {
+	managerStatesMu.Lock()
+	defer managerStatesMu.Unlock()
+
+	states := make(map[string]string, len(managerStates))
+	for k, v := range managerStates {
+		states[k] = v
+	}
+	return agentStateJSON{
+		Version:            version,
+		ManagerStates:      states,
+		DiagnosticsEntries: append([]string(nil), diagnosticsEntries...),
+	}
+}
+
+func (s agentStateJSON) restore() {
+	managerStatesMu.Lock()
+	defer managerStatesMu.Unlock()
+
+	for k, v := range s.ManagerStates {
+		managerStates[k] = v
+	}
+	for _, e := range s.DiagnosticsEntries {
+		if !containsString(e, diagnosticsEntries) {
+			diagnosticsEntries = append(diagnosticsEntries, e)
+		}
+	}
+}
+
+// saveAgentState persists the durable agent state to the registry.
+func saveAgentState() error {
+	data, err := json.Marshal(captureAgentState())
+	if err != nil {
+		return err
+	}
+	return writeRegMultiString(regKeyBase, stateRegName, []string{string(data)})
+}
+
+// restoreAgentState loads the agent state saved by a previous run, if any.
+func restoreAgentState() error {
+	data, err := readRegMultiString(regKeyBase, stateRegName)
+	if err == errRegNotExist || (err == nil && len(data) == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var s agentStateJSON
+	if err := json.Unmarshal([]byte(data[0]), &s); err != nil {
+		return err
+	}
+	s.restore()
+	return nil
+}
+
+// appliedStateJSON is what the agent last applied to the system. Without it
+// a restarted agent diffs against empty metadata and applies everything
+// again, and has no record of interfaces that left metadata meanwhile.
+type appliedStateJSON struct {
+	// ForwardedIPs are the forwarded IPs programmed on each interface, by
+	// MAC address.
+	ForwardedIPs map[string][]string `json:",omitempty"`
+	// WindowsKeys is the hex fingerprint of the windows-keys attribute the
+	// accounts were last issued for.
+	WindowsKeys string `json:",omitempty"`
+	// PendingReboot is the reboot the applied changes still need and
+	// PendingRebootBoot the boot time, in RFC 3339, it was requested in. It
+	// is dropped once the system has rebooted.
+	PendingReboot     *pendingRebootJSON `json:",omitempty"`
+	PendingRebootBoot string             `json:",omitempty"`
+}
+
+var (
+	appliedStateMu sync.Mutex
+	appliedState   appliedStateJSON
+
+	// readAppliedState, writeAppliedState, appliedInterfaces and
+	// removeStaleAddress are replaced in tests.
+	readAppliedState = func() ([]string, error) {
+		return readRegMultiString(regKeyBase, appliedStateRegName)
+	}
+	writeAppliedState = func(s []string) error {
+		return writeRegMultiString(regKeyBase, appliedStateRegName, s)
+	}
+	appliedInterfaces  = net.Interfaces
+	removeStaleAddress = removeAddress
+)
+
+// updateAppliedState applies f to the applied state and persists it.
+func updateAppliedState(f func(*appliedStateJSON)) {
+	appliedStateMu.Lock()
+	defer appliedStateMu.Unlock()
+
+	f(&appliedState)
+	data, err := json.Marshal(appliedState)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	if err := writeAppliedState([]string{string(data)}); err != nil {
+		logger.Errorln("Error saving applied state:", err)
+	}
+}
+
+// loadAppliedState loads the state applied by a previous run, if any.
+func loadAppliedState() error {
+	data, err := readAppliedState()
+	if err == errRegNotExist || (err == nil && len(data) == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var s appliedStateJSON
+	if err := json.Unmarshal([]byte(data[0]), &s); err != nil {
+		return err
+	}
+	appliedStateMu.Lock()
+	defer appliedStateMu.Unlock()
+	appliedState = s
+	return nil
+}
+
+var windowsKeysKey = fingerprintKey("instance/attributes/windows-keys")
+
+// windowsKeysFingerprint returns the fingerprint of the instance windows-keys
+// attribute of md, empty if it is not set.
+func windowsKeysFingerprint(md *metadataJSON) string {
+	h, ok := fingerprintMetadata(md)[windowsKeysKey]
+	if !ok {
+		return ""
+	}
+	return hex.EncodeToString(h[:])
+}
+
+// reconcileAppliedState compares the state applied by a previous run with md
+// before the first update. Forwarded IPs programmed on interfaces that are no
+// longer in metadata are removed, the address manager only looks at the
+// interfaces metadata lists. If the accounts were already issued for the
+// current windows-keys, old is seeded with it and the returned fingerprint
+// holds it, so the accounts manager does not run again in either diff mode.
+func reconcileAppliedState(cfg *ini.File, md, old *metadataJSON) metadataFingerprint {
+	appliedStateMu.Lock()
+	applied := appliedState
+	appliedStateMu.Unlock()
+
+	var fp metadataFingerprint
+	if applied.WindowsKeys != "" && applied.WindowsKeys == windowsKeysFingerprint(md) {
+		logger.Debugf("Accounts already issued for the current windows-keys.")
+		old.Instance.Attributes.WindowsKeys = md.Instance.Attributes.WindowsKeys
+		fp = metadataFingerprint{windowsKeysKey: fingerprintMetadata(md)[windowsKeysKey]}
+	}
+
+	if dryRun(cfg) || !(&addresses{newMetadata: md, config: cfg}).enablement().Enabled {
+		return fp
+	}
+	known := make(map[string]bool)
+	for _, ni := range md.Instance.NetworkInterfaces {
+		if mac, err := net.ParseMAC(ni.Mac); err == nil {
+			known[mac.String()] = true
+		}
+	}
+	var stale []string
+	for mac := range applied.ForwardedIPs {
+		if !known[mac] {
+			stale = append(stale, mac)
+		}
+	}
+	if len(stale) == 0 {
+		return fp
+	}
+	ifs, err := appliedInterfaces()
+	if err != nil {
+		logger.Error(err)
+		return fp
+	}
+	for _, mac := range stale {
+		ips := applied.ForwardedIPs[mac]
+		if iface, err := interfaceByMAC(mac, ifs); err == nil && len(ips) != 0 {
+			logger.Infof("Removing forwarded IPs %q from %s, it is no longer in metadata.", ips, mac)
+			for _, ip := range ips {
+				if err := removeStaleAddress(net.ParseIP(ip), uint32(iface.Index)); err != nil {
+					logger.Error(err)
+					continue
+				}
+				forwardedIPChanges.inc("remove")
+			}
+		}
+		if err := deleteRegKey(addressKey, mac); err != nil && err != errRegNotExist {
+			logger.Error(err)
+		}
+	}
+	updateAppliedState(func(s *appliedStateJSON) {
+		for _, mac := range stale {
+			delete(s.ForwardedIPs, mac)
+		}
+	})
+	return fp
+}
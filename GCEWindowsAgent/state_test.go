@@ -0,0 +1,163 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+func TestAgentStateRoundTrip(t *testing.T) {
+	defer func() {
+		managerStates = map[string]string{}
+		diagnosticsEntries = nil
+	}()
+
+	managerStates = map[string]string{"accountManager": stateFailed, "wsfc": stateSucceeded}
+	diagnosticsEntries = []string{`{"signedUrl":"url"}`}
+	want := captureAgentState()
+
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a restart.
+	managerStates = map[string]string{}
+	diagnosticsEntries = nil
+
+	var got agentStateJSON
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	got.restore()
+
+	if !reflect.DeepEqual(captureAgentState(), want) {
+		t.Errorf("restored state got: %+v, want: %+v", captureAgentState(), want)
+	}
+}
+
+func TestAgentStateRestoreMerges(t *testing.T) {
+	defer func() {
+		managerStates = map[string]string{}
+		diagnosticsEntries = nil
+	}()
+
+	managerStates = map[string]string{"wsfc": stateSucceeded}
+	diagnosticsEntries = []string{"a"}
+	agentStateJSON{
+		ManagerStates:      map[string]string{"accountManager": stateFailed},
+		DiagnosticsEntries: []string{"a", "b"},
+	}.restore()
+
+	wantStates := map[string]string{"wsfc": stateSucceeded, "accountManager": stateFailed}
+	if !reflect.DeepEqual(managerStates, wantStates) {
+		t.Errorf("managerStates got: %v, want: %v", managerStates, wantStates)
+	}
+	if want := []string{"a", "b"}; !reflect.DeepEqual(diagnosticsEntries, want) {
+		t.Errorf("diagnosticsEntries got: %q, want: %q", diagnosticsEntries, want)
+	}
+}
+
+func TestAppliedStateRoundTrip(t *testing.T) {
+	oldRead, oldWrite := readAppliedState, writeAppliedState
+	defer func() {
+		readAppliedState, writeAppliedState = oldRead, oldWrite
+		appliedState = appliedStateJSON{}
+	}()
+
+	var saved []string
+	writeAppliedState = func(s []string) error { saved = s; return nil }
+	readAppliedState = func() ([]string, error) { return saved, nil }
+
+	appliedState = appliedStateJSON{}
+	updateAppliedState(func(s *appliedStateJSON) {
+		s.ForwardedIPs = map[string][]string{"42:01:0a:00:00:02": {"1.2.3.4"}}
+		s.WindowsKeys = "abc"
+	})
+	want := appliedState
+
+	// Simulate a restart.
+	appliedState = appliedStateJSON{}
+	if err := loadAppliedState(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(appliedState, want) {
+		t.Errorf("loaded applied state got: %+v, want: %+v", appliedState, want)
+	}
+}
+
+func TestReconcileAppliedState(t *testing.T) {
+	oldWrite, oldIfs, oldRemove := writeAppliedState, appliedInterfaces, removeStaleAddress
+	defer func() {
+		writeAppliedState, appliedInterfaces, removeStaleAddress = oldWrite, oldIfs, oldRemove
+		appliedState = appliedStateJSON{}
+	}()
+
+	known, _ := net.ParseMAC("42:01:0a:00:00:02")
+	stale, _ := net.ParseMAC("42:01:0a:00:00:03")
+	writeAppliedState = func([]string) error { return nil }
+	appliedInterfaces = func() ([]net.Interface, error) {
+		return []net.Interface{{Index: 2, HardwareAddr: known}, {Index: 3, HardwareAddr: stale}}, nil
+	}
+	var removed []string
+	removeStaleAddress = func(ip net.IP, index uint32) error {
+		if index != 3 {
+			t.Errorf("removed %s from interface %d, want 3", ip, index)
+		}
+		removed = append(removed, ip.String())
+		return nil
+	}
+
+	md := &metadataJSON{}
+	md.Instance.Attributes.WindowsKeys = `{"userName":"user"}`
+	md.Instance.NetworkInterfaces = []networkInterfacesJSON{{Mac: known.String()}}
+
+	var tests = []struct {
+		name        string
+		windowsKeys string
+		wantSeeded  bool
+	}{
+		{"keys unchanged", windowsKeysFingerprint(md), true},
+		{"keys changed", "abc", false},
+		{"first run", "", false},
+	}
+	for _, tt := range tests {
+		removed = nil
+		appliedState = appliedStateJSON{
+			ForwardedIPs: map[string][]string{known.String(): {"1.2.3.4"}, stale.String(): {"5.6.7.8"}},
+			WindowsKeys:  tt.windowsKeys,
+		}
+
+		var old metadataJSON
+		fp := reconcileAppliedState(ini.Empty(), md, &old)
+		if seeded := old.Instance.Attributes.WindowsKeys == md.Instance.Attributes.WindowsKeys; seeded != tt.wantSeeded {
+			t.Errorf("test case %q: old windows-keys seeded: %t, want: %t", tt.name, seeded, tt.wantSeeded)
+		}
+		if changed := pathsChanged([]string{"instance/attributes/windows-keys"}, changedKeys(fp, fingerprintMetadata(md))); changed == tt.wantSeeded {
+			t.Errorf("test case %q: windows-keys changed in hash mode: %t, want: %t", tt.name, changed, !tt.wantSeeded)
+		}
+		if want := []string{"5.6.7.8"}; !reflect.DeepEqual(removed, want) {
+			t.Errorf("test case %q: removed got: %q, want: %q", tt.name, removed, want)
+		}
+		if want := map[string][]string{known.String(): {"1.2.3.4"}}; !reflect.DeepEqual(appliedState.ForwardedIPs, want) {
+			t.Errorf("test case %q: forwarded IPs got: %v, want: %v", tt.name, appliedState.ForwardedIPs, want)
+		}
+	}
+}
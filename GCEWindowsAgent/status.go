@@ -0,0 +1,95 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// statusAddress is the local address of the status endpoint, per
+// [core] status_address. The endpoint is off when unset. It has no
+// authentication and reports manager state, so only loopback addresses are
+// accepted.
+func statusAddress(cfg *ini.File) (string, error) {
+	return loopbackAddress(cfg, "status_address")
+}
+
+type statusJSON struct {
+	Managers      map[string]string `json:"managers"`
+	Audit         *auditStatus      `json:"audit,omitempty"`
+	Verify        *verifyStatus     `json:"verify,omitempty"`
+	PendingReboot pendingRebootJSON `json:"pendingReboot"`
+}
+
+type managerConfigJSON struct {
+	Section string `json:"section"`
+	enablement
+}
+
+func newStatusMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", handleStatus)
+	mux.HandleFunc("/config", handleConfig)
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Errorln("Error writing status response:", err)
+	}
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	s := captureAgentState()
+	writeJSON(w, statusJSON{
+		Managers:      s.ManagerStates,
+		Audit:         getAuditStatus(),
+		Verify:        getVerifyStatus(),
+		PendingReboot: getPendingReboot(),
+	})
+}
+
+// handleConfig reports the effective manager set, evaluated against the
+// metadata of the last update cycle.
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	md := getAppliedMetadata()
+	if md == nil {
+		md = &metadataJSON{}
+	}
+	var resp []managerConfigJSON
+	for _, mgr := range newManagers(md, md, loadConfig()) {
+		resp = append(resp, managerConfigJSON{mgr.section, managerEnablement(mgr.manager)})
+	}
+	writeJSON(w, resp)
+}
+
+// serveStatus runs the status endpoint until ctx is done.
+func serveStatus(ctx context.Context, addr string) {
+	srv := &http.Server{Addr: addr, Handler: newStatusMux()}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	logger.Infof("Serving agent status on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Errorln("Error serving agent status:", err)
+	}
+}
@@ -0,0 +1,114 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+func TestIsEnabled(t *testing.T) {
+	md := &metadataJSON{}
+	md.Instance.Attributes.EnableDiagnostics = "true"
+	md.Project.Attributes.EnableDiagnostics = "false"
+	md.Project.Attributes.DisableAccountManager = "true"
+	md.Project.Attributes.EnableTimeSync = "bogus"
+
+	cfg, err := ini.InsensitiveLoad([]byte("[addressManager]\ndisable=true\n[printers]\nmanage=true"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name string
+		rule enableRule
+		def  bool
+		want enablement
+	}{
+		{"config", addressesEnable, true, enablement{false, sourceConfig, "addressManager.disable"}},
+		{"config only", enableRule{section: "printers", key: "manage"}, false, enablement{true, sourceConfig, "printers.manage"}},
+		{"instance metadata", diagnosticsEnable, false, enablement{true, sourceInstanceMetadata, "enable-diagnostics"}},
+		{"project metadata", accountsEnable, true, enablement{false, sourceProjectMetadata, "disable-account-manager"}},
+		{"invalid metadata uses default", timeSyncEnable, false, enablement{false, sourceDefault, ""}},
+		{"default", enableRule{section: "pagefile", key: "manage"}, false, enablement{false, sourceDefault, ""}},
+	}
+
+	for _, tt := range tests {
+		if got := isEnabled(cfg, md, tt.rule, tt.def); got != tt.want {
+			t.Errorf("test case %q: isEnabled() got: %+v, want: %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestStatusAddress(t *testing.T) {
+	var tests = []struct {
+		data    string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"[core]\nstatus_address=127.0.0.1:8080", "127.0.0.1:8080", false},
+		{"[core]\nstatus_address=localhost:8080", "localhost:8080", false},
+		{"[core]\nstatus_address=0.0.0.0:8080", "", true},
+		{"[core]\nstatus_address=:8080", "", true},
+		{"[core]\nstatus_address=10.0.0.2:8080", "", true},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := statusAddress(cfg)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("statusAddress(%q) error: %v, want error: %t", tt.data, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("statusAddress(%q) got: %q, want: %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestHandleConfig(t *testing.T) {
+	defer func() { appliedMetadata = nil }()
+	md := &metadataJSON{}
+	md.Instance.Attributes.EnableDiagnostics = "true"
+	appliedMetadata = md
+
+	rec := httptest.NewRecorder()
+	newStatusMux().ServeHTTP(rec, httptest.NewRequest("GET", "/config", nil))
+
+	var got []managerConfigJSON
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("error parsing /config response %q: %v", rec.Body, err)
+	}
+	want := map[string]enablement{
+		"diagnostics": {true, sourceInstanceMetadata, "enable-diagnostics"},
+		"printers":    {false, sourceDefault, ""},
+		"perfTune":    {true, sourceDefault, ""},
+	}
+	for _, m := range got {
+		if w, ok := want[m.Section]; ok && m.enablement != w {
+			t.Errorf("/config %s got: %+v, want: %+v", m.Section, m.enablement, w)
+		}
+		delete(want, m.Section)
+	}
+	if len(want) != 0 {
+		t.Errorf("/config is missing managers: %v", want)
+	}
+}
@@ -17,6 +17,7 @@ package main
 import (
 	"errors"
 	"net"
+	"time"
 )
 
 var errRegNotExist = errors.New("error")
@@ -25,10 +26,34 @@ func resetPwd(username, pwd string) error {
 	return nil
 }
 
-func createAdminUser(username, pwd string) error {
+func createUser(username, pwd, group string) error {
 	return nil
 }
 
+func addToGroup(username, group string) error {
+	return nil
+}
+
+func removeFromGroup(username, group string) error {
+	return nil
+}
+
+func deleteUser(username string) error {
+	return nil
+}
+
+func setUserDisabled(username string, disabled bool) error {
+	return nil
+}
+
+func localPasswordPolicy() (passwordPolicy, error) {
+	return passwordPolicy{}, nil
+}
+
+func domainUserExists(username string) (bool, error) {
+	return false, nil
+}
+
 func readRegMultiString(key, name string) ([]string, error) {
 	return nil, nil
 }
@@ -45,6 +70,64 @@ func removeAddress(ip net.IP, index uint32) error {
 	return nil
 }
 
+func addRoute(ipNet *net.IPNet, index uint32) error {
+	return nil
+}
+
+func removeRoute(ipNet *net.IPNet, index uint32) error {
+	return nil
+}
+
+func announceAddress(ip net.IP, index uint32) error {
+	return nil
+}
+
+func listAddresses(index uint32) ([]string, error) {
+	iface, err := net.InterfaceByIndex(int(index))
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP.String())
+		}
+	}
+	return ips, nil
+}
+
+func waitAddrChange() error {
+	return errors.New("network change notifications are not supported")
+}
+
+func readRegDword(key, name string) (uint32, error) {
+	return 0, errRegNotExist
+}
+
+func writeRegDword(key, name string, value uint32) error {
+	return nil
+}
+
 func deleteRegKey(key, name string) error {
 	return nil
 }
+
+func listenPipe(name string) (net.Listener, error) {
+	return net.Listen("unix", name)
+}
+
+func dialPipe(name string) (net.Conn, error) {
+	return net.Dial("unix", name)
+}
+
+func systemUptime() time.Duration {
+	return 0
+}
+
+func runService(name string, p *program) error {
+	return errors.New("running as a service is only supported on Windows")
+}
@@ -15,11 +15,19 @@
 package main
 
 import (
+	"time"
+
 	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/registry"
 )
 
-var errRegNotExist = registry.ErrNotExist
+var (
+	errRegNotExist = registry.ErrNotExist
+
+	kernel32           = windows.NewLazySystemDLL("kernel32.dll")
+	procGetTickCount64 = kernel32.NewProc("GetTickCount64")
+)
 
 func init() {
 	key, _, err := registry.CreateKey(registry.LOCAL_MACHINE, regKeyBase, registry.WRITE)
@@ -67,3 +75,30 @@ func deleteRegKey(key, name string) error {
 
 	return k.DeleteValue(name)
 }
+
+func readRegDword(key, name string) (uint32, error) {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, key, registry.QUERY_VALUE)
+	if err != nil {
+		return 0, err
+	}
+	defer k.Close()
+
+	v, _, err := k.GetIntegerValue(name)
+	return uint32(v), err
+}
+
+func writeRegDword(key, name string, value uint32) error {
+	k, _, err := registry.CreateKey(registry.LOCAL_MACHINE, key, registry.WRITE)
+	if err != nil {
+		return err
+	}
+	defer k.Close()
+
+	return k.SetDWordValue(name, value)
+}
+
+// systemUptime returns the time since Windows started.
+func systemUptime() time.Duration {
+	ms, _, _ := procGetTickCount64.Call()
+	return time.Duration(ms) * time.Millisecond
+}
@@ -0,0 +1,96 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// terminationNoticed is set once the termination notice was handled, so it
+// is handled once per notice.
+var terminationNoticed bool
+
+// terminationEnabled reports whether [termination] enable is set.
+func terminationEnabled(cfg *ini.File) bool {
+	return cfg.Section("termination").Key("enable").MustBool(false)
+}
+
+// terminationPaths returns the metadata paths of the termination notice, so
+// they are watched when no manager uses them.
+func terminationPaths(cfg *ini.File) []string {
+	if !terminationEnabled(cfg) {
+		return nil
+	}
+	return []string{"instance/preempted", "instance/maintenance-event"}
+}
+
+// terminationReason describes the termination notice of i.
+func terminationReason(i instanceJSON) string {
+	if i.Preempted == "TRUE" {
+		return "preemption"
+	}
+	return "host maintenance"
+}
+
+// handleTerminationNotice starts the termination handler the first time md
+// has a termination notice. Preemptible instances get about 30 seconds
+// before they stop, so it runs alongside the managers.
+func handleTerminationNotice(ctx context.Context, cfg *ini.File, md *metadataJSON, cl *cloudLogger) {
+	if !terminationEnabled(cfg) || !md.Instance.terminating() {
+		terminationNoticed = false
+		return
+	}
+	if terminationNoticed {
+		return
+	}
+	terminationNoticed = true
+	go onTermination(ctx, cfg, terminationReason(md.Instance), cl)
+}
+
+// onTermination runs [termination] script for at most script_timeout_sec and
+// flushes the logs. The wsfc manager drains the responder on the notice.
+func onTermination(ctx context.Context, cfg *ini.File, reason string, cl *cloudLogger) {
+	logger.Infof("Instance is stopping for %s.", reason)
+	sec := cfg.Section("termination")
+	if script := sec.Key("script").String(); script != "" {
+		if dryRun(cfg) {
+			logger.Infof("Dry run: would run termination script %s.", script)
+		} else if err := runTerminationScript(ctx, script, time.Duration(sec.Key("script_timeout_sec").MustInt(25))*time.Second); err != nil {
+			logger.Error(err)
+		}
+	}
+	fctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	cl.flushNow(fctx)
+}
+
+func runTerminationScript(ctx context.Context, script string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	logger.Infof("Running termination script %s.", script)
+	if err := runScriptCmd(scriptCommand(ctx, script), "termination script"); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("termination script %s did not finish within %s", script, timeout)
+		}
+		return fmt.Errorf("error running termination script %s: %v", script, err)
+	}
+	logger.Infof("Termination script %s finished.", script)
+	return nil
+}
@@ -0,0 +1,87 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+func TestHandleTerminationNotice(t *testing.T) {
+	oldRun := runScriptCmd
+	defer func() {
+		runScriptCmd = oldRun
+		terminationNoticed = false
+	}()
+	ran := make(chan string, 10)
+	runScriptCmd = func(c *exec.Cmd, name string) error {
+		ran <- c.Args[len(c.Args)-1]
+		return nil
+	}
+
+	cfg, err := ini.InsensitiveLoad([]byte("[termination]\nenable=true\nscript=C:\\stop.cmd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	preempted := &metadataJSON{Instance: instanceJSON{Preempted: "TRUE"}}
+	maintenance := &metadataJSON{Instance: instanceJSON{MaintenanceEvent: "TERMINATE_ON_HOST_MAINTENANCE"}}
+	var tests = []struct {
+		name    string
+		cfg     *ini.File
+		md      *metadataJSON
+		wantRun bool
+	}{
+		{"disabled", ini.Empty(), preempted, false},
+		{"no notice", cfg, &metadataJSON{}, false},
+		{"preempted", cfg, preempted, true},
+		{"same notice", cfg, preempted, false},
+		{"notice cleared", cfg, &metadataJSON{}, false},
+		{"host maintenance", cfg, maintenance, true},
+	}
+
+	for _, tt := range tests {
+		handleTerminationNotice(context.Background(), tt.cfg, tt.md, nil)
+		var got bool
+		select {
+		case script := <-ran:
+			got = true
+			if script != `C:\stop.cmd` {
+				t.Errorf("test case %q: ran %q, want C:\\stop.cmd", tt.name, script)
+			}
+		case <-time.After(100 * time.Millisecond):
+		}
+		if got != tt.wantRun {
+			t.Errorf("test case %q: script run: %t, want: %t", tt.name, got, tt.wantRun)
+		}
+	}
+}
+
+func TestWsfcDrainsOnTermination(t *testing.T) {
+	cfg, err := ini.InsensitiveLoad([]byte("[termination]\nenable=true"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := &metadataJSON{Instance: instanceJSON{Preempted: "TRUE"}}
+	if m := newWsfcManager(md, cfg); !m.agentNewDraining {
+		t.Error("wsfc manager not draining on a termination notice with the termination handler enabled")
+	}
+	if m := newWsfcManager(md, ini.Empty()); m.agentNewDraining {
+		t.Error("wsfc manager draining on a termination notice without drain_sec or the termination handler")
+	}
+}
@@ -0,0 +1,351 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math/bits"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+const (
+	defaultNTPServer = "metadata.google.internal"
+
+	w32timeConfig = `SYSTEM\CurrentControlSet\Services\W32Time\Config`
+)
+
+var (
+	timeSyncDisabled = true
+	ntpPeers         []string
+	ntpPollIntervals [2]uint32
+	peerCheckPeriod  = 5 * time.Minute
+
+	// timeSyncMigrating is set by set during a live migration,
+	// resyncPending once it completed until the clock was resynchronized.
+	// peersConfigured is set once set ran, the peers are only monitored
+	// after that.
+	timeSyncMu        sync.Mutex
+	timeSyncMigrating bool
+	resyncPending     bool
+	peersConfigured   bool
+
+	// driftThreshold is the clock offset from the active peer that is
+	// logged, zero to not check the offset. It is a time.Duration stored by
+	// set and loaded by monitorPeers.
+	driftThreshold int64
+
+	// w32tm and timeSyncReg are replaced in tests.
+	w32tm = func(args ...string) ([]byte, error) {
+		return exec.Command("w32tm", args...).CombinedOutput()
+	}
+	timeSyncReg dwordRegistry = systemDwordRegistry{}
+)
+
+type timeSync struct {
+	newMetadata *metadataJSON
+	config      *ini.File
+}
+
+// peers returns the ordered list of NTP servers from the config file, or
+// instance and then project metadata.
+func (t *timeSync) peers() []string {
+	servers := t.config.Section("timeSync").Key("ntp_servers").String()
+	if servers == "" {
+		servers = t.newMetadata.Instance.Attributes.NTPServers
+	}
+	if servers == "" {
+		servers = t.newMetadata.Project.Attributes.NTPServers
+	}
+
+	var peers []string
+	for _, s := range strings.Split(servers, ",") {
+		s = strings.TrimSpace(s)
+		if s != "" && !containsString(s, peers) {
+			peers = append(peers, s)
+		}
+	}
+	if len(peers) == 0 {
+		return []string{defaultNTPServer}
+	}
+	return peers
+}
+
+// pollIntervals returns the w32time MinPollInterval and MaxPollInterval, as
+// log2 seconds, from [timeSync] min_poll_interval_sec and
+// max_poll_interval_sec. The defaults poll every 64 to 1024 seconds.
+func (t *timeSync) pollIntervals() [2]uint32 {
+	sec := t.config.Section("timeSync")
+	log2 := func(key string, def int) uint32 {
+		v := sec.Key(key).MustInt(def)
+		if v < 1 {
+			v = def
+		}
+		return uint32(bits.Len(uint(v)) - 1)
+	}
+	min, max := log2("min_poll_interval_sec", 64), log2("max_poll_interval_sec", 1024)
+	if max < min {
+		max = min
+	}
+	return [2]uint32{min, max}
+}
+
+// migrationChanged reports whether set has a live migration to record or a
+// resync to run.
+func (t *timeSync) migrationChanged() bool {
+	timeSyncMu.Lock()
+	defer timeSyncMu.Unlock()
+	return t.newMetadata.Instance.migrating() != timeSyncMigrating || resyncPending
+}
+
+func (t *timeSync) diff() bool {
+	return !reflect.DeepEqual(t.peers(), ntpPeers) || t.pollIntervals() != ntpPollIntervals || t.migrationChanged()
+}
+
+func (t *timeSync) metadataPaths() []string {
+	return append([]string{"instance/maintenance-event"}, attributePaths...)
+}
+
+func (t *timeSync) disabled() (disabled bool) {
+	defer func() {
+		if disabled {
+			// The peers are monitored again once set configures them.
+			timeSyncMu.Lock()
+			peersConfigured = false
+			timeSyncMu.Unlock()
+		}
+		if disabled != timeSyncDisabled {
+			timeSyncDisabled = disabled
+			logStatus("time sync", disabled)
+		}
+	}()
+
+	return !t.enablement().Enabled
+}
+
+var timeSyncEnable = enableRule{
+	section:   "timeSync",
+	key:       "enable",
+	attribute: "enable-time-sync",
+	value:     func(a attributesJSON) string { return a.EnableTimeSync },
+}
+
+// Time sync is opt-in and disabled by default.
+func (t *timeSync) enablement() enablement {
+	return isEnabled(t.config, t.newMetadata, timeSyncEnable, !timeSyncDisabled)
+}
+
+// manualPeerList formats peers for w32tm /manualpeerlist. The first peer is
+// the primary source, the rest are only used as fallbacks in order.
+func manualPeerList(peers []string) string {
+	var list []string
+	for i, p := range peers {
+		// 0x8: client mode, 0x2: use as fallback only.
+		flags := "0x8"
+		if i > 0 {
+			flags = "0xa"
+		}
+		list = append(list, fmt.Sprintf("%s,%s", p, flags))
+	}
+	return strings.Join(list, " ")
+}
+
+// plan returns the w32time changes set would make.
+func (t *timeSync) plan() ([]string, error) {
+	var changes []string
+	peers, intervals := t.peers(), t.pollIntervals()
+	if !reflect.DeepEqual(peers, ntpPeers) || intervals != ntpPollIntervals {
+		changes = append(changes, fmt.Sprintf("configure NTP peers %q, polling every %d to %d seconds", peers, 1<<intervals[0], 1<<intervals[1]))
+	}
+	timeSyncMu.Lock()
+	defer timeSyncMu.Unlock()
+	if !t.newMetadata.Instance.migrating() && (timeSyncMigrating || resyncPending) {
+		changes = append(changes, "resynchronize the clock after the live migration")
+	}
+	return changes, nil
+}
+
+func (t *timeSync) set(ctx context.Context) error {
+	threshold := time.Duration(t.config.Section("timeSync").Key("drift_threshold_ms").MustInt(100)) * time.Millisecond
+	atomic.StoreInt64(&driftThreshold, int64(threshold))
+
+	peers, intervals := t.peers(), t.pollIntervals()
+	if !reflect.DeepEqual(peers, ntpPeers) || intervals != ntpPollIntervals {
+		logger.Infof("Configuring NTP peers %q, polling every %d to %d seconds", peers, 1<<intervals[0], 1<<intervals[1])
+		if err := timeSyncReg.set(w32timeConfig, "MinPollInterval", intervals[0]); err != nil {
+			return fmt.Errorf("error setting w32time MinPollInterval: %v", err)
+		}
+		if err := timeSyncReg.set(w32timeConfig, "MaxPollInterval", intervals[1]); err != nil {
+			return fmt.Errorf("error setting w32time MaxPollInterval: %v", err)
+		}
+		args := []string{"/config", "/manualpeerlist:" + manualPeerList(peers), "/syncfromflags:manual", "/update"}
+		if out, err := w32tm(args...); err != nil {
+			return fmt.Errorf("error configuring w32time: %v, output: %s", err, out)
+		}
+		ntpPeers, ntpPollIntervals = peers, intervals
+	}
+
+	// The clock may jump during live migration, resync once it completes.
+	timeSyncMu.Lock()
+	defer timeSyncMu.Unlock()
+	if t.newMetadata.Instance.migrating() {
+		timeSyncMigrating = true
+	} else if timeSyncMigrating {
+		timeSyncMigrating, resyncPending = false, true
+	}
+	if resyncPending {
+		logger.Info("Live migration complete, resynchronizing the clock.")
+		if out, err := w32tm("/resync", "/force"); err != nil {
+			return fmt.Errorf("error resynchronizing the clock: %v, output: %s", err, out)
+		}
+		resyncPending = false
+	}
+	peersConfigured = true
+	return nil
+}
+
+type peerStatus struct {
+	name  string
+	state string
+}
+
+// parsePeers parses the output of w32tm /query /peers.
+func parsePeers(out []byte) []peerStatus {
+	var peers []peerStatus
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		i := strings.Index(line, ":")
+		if i == -1 {
+			continue
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch key {
+		case "Peer":
+			// Strip the flags, e.g. "time.google.com,0x8".
+			peers = append(peers, peerStatus{name: strings.Split(value, ",")[0]})
+		case "State":
+			if len(peers) != 0 {
+				peers[len(peers)-1].state = value
+			}
+		}
+	}
+	return peers
+}
+
+// activePeer returns the first peer in the Active state.
+func activePeer(peers []peerStatus) (string, bool) {
+	for _, p := range peers {
+		if p.state == "Active" {
+			return p.name, true
+		}
+	}
+	return "", false
+}
+
+// parseStripchart parses the offset from the output of w32tm /stripchart
+// /dataonly, such as "10:15:04, +00.0003487s".
+func parseStripchart(out []byte) (time.Duration, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ",")
+		if len(fields) != 2 {
+			continue
+		}
+		v := strings.TrimSuffix(strings.TrimSpace(fields[1]), "s")
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			continue
+		}
+		return time.Duration(f * float64(time.Second)), nil
+	}
+	return 0, fmt.Errorf("no offset in w32tm output: %s", out)
+}
+
+// checkDrift logs when the clock is more than driftThreshold away from peer.
+func checkDrift(peer string) {
+	threshold := time.Duration(atomic.LoadInt64(&driftThreshold))
+	if threshold <= 0 {
+		return
+	}
+	out, err := w32tm("/stripchart", "/computer:"+peer, "/samples:1", "/dataonly")
+	if err != nil {
+		logger.Errorf("Error measuring clock offset from %s: %v, output: %s", peer, err, out)
+		return
+	}
+	offset, err := parseStripchart(out)
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	if absDuration(offset) > threshold {
+		logger.Warnf("Clock is %s off from NTP peer %s, more than the %s threshold", offset, peer, threshold)
+	}
+}
+
+var lastActivePeer string
+
+// checkPeers logs when w32time fails over to another peer or loses all of
+// them, and when the clock drifted from the active peer.
+func checkPeers() {
+	out, err := w32tm("/query", "/peers")
+	if err != nil {
+		logger.Errorf("Error querying NTP peers: %v, output: %s", err, out)
+		return
+	}
+	peers := parsePeers(out)
+	active, ok := activePeer(peers)
+	switch {
+	case !ok && lastActivePeer != "":
+		logger.Errorf("No NTP peer is active, last active peer was %s: %+v", lastActivePeer, peers)
+	case ok && lastActivePeer != "" && active != lastActivePeer:
+		logger.Infof("NTP failed over from %s to %s", lastActivePeer, active)
+	case ok && active != lastActivePeer:
+		logger.Infof("Active NTP peer is %s", active)
+	}
+	lastActivePeer = active
+	if ok {
+		checkDrift(active)
+	}
+}
+
+// peerMonitorLoop checks the NTP peers until ctx is done, once time sync
+// was set up.
+func peerMonitorLoop(ctx context.Context) {
+	periodicLoop(ctx, periodicTask{
+		name:     "NTP peer monitor",
+		interval: every(peerCheckPeriod),
+		due: func(*ini.File, time.Time) bool {
+			timeSyncMu.Lock()
+			defer timeSyncMu.Unlock()
+			return peersConfigured
+		},
+		run: func(context.Context, *ini.File) error {
+			checkPeers()
+			return nil
+		},
+	})
+}
@@ -0,0 +1,227 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+func TestTimeSyncPeers(t *testing.T) {
+	var tests = []struct {
+		name string
+		data []byte
+		md   *metadataJSON
+		want []string
+	}{
+		{"default", []byte(""), &metadataJSON{}, []string{defaultNTPServer}},
+		{"cfg", []byte("[timeSync]\nntp_servers=a.example.com, b.example.com"), &metadataJSON{Instance: instanceJSON{Attributes: attributesJSON{NTPServers: "c"}}}, []string{"a.example.com", "b.example.com"}},
+		{"instance metadata", []byte(""), &metadataJSON{Instance: instanceJSON{Attributes: attributesJSON{NTPServers: "c,d"}}, Project: projectJSON{Attributes: attributesJSON{NTPServers: "e"}}}, []string{"c", "d"}},
+		{"project metadata", []byte(""), &metadataJSON{Project: projectJSON{Attributes: attributesJSON{NTPServers: "e,,e,f"}}}, []string{"e", "f"}},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad(tt.data)
+		if err != nil {
+			t.Errorf("test case %q: error parsing config: %v", tt.name, err)
+			continue
+		}
+		if got := (&timeSync{newMetadata: tt.md, config: cfg}).peers(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("test case %q, timeSync.peers() got: %q, want: %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestManualPeerList(t *testing.T) {
+	var tests = []struct {
+		peers []string
+		want  string
+	}{
+		{[]string{"a"}, "a,0x8"},
+		{[]string{"a", "b", "c"}, "a,0x8 b,0xa c,0xa"},
+	}
+	for _, tt := range tests {
+		if got := manualPeerList(tt.peers); got != tt.want {
+			t.Errorf("manualPeerList(%q) got: %q, want: %q", tt.peers, got, tt.want)
+		}
+	}
+}
+
+func TestTimeSyncSet(t *testing.T) {
+	var gotArgs []string
+	oldW32tm, oldReg := w32tm, timeSyncReg
+	defer func() { w32tm, timeSyncReg = oldW32tm, oldReg }()
+	w32tm = func(args ...string) ([]byte, error) {
+		if args[0] == "/config" {
+			gotArgs = args
+		}
+		return nil, nil
+	}
+	reg := fakeDwordRegistry{}
+	timeSyncReg = reg
+
+	cfg, err := ini.InsensitiveLoad([]byte("[timeSync]\nntp_servers=a,b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &timeSync{newMetadata: &metadataJSON{}, config: cfg}
+	ntpPeers, peersConfigured = nil, false
+	if !ts.diff() {
+		t.Error("timeSync.diff() got: false, want: true")
+	}
+	if err := ts.set(context.Background()); err != nil {
+		t.Fatalf("timeSync.set(context.Background()) returned error: %v", err)
+	}
+	want := []string{"/config", "/manualpeerlist:a,0x8 b,0xa", "/syncfromflags:manual", "/update"}
+	if !reflect.DeepEqual(gotArgs, want) {
+		t.Errorf("w32tm args got: %q, want: %q", gotArgs, want)
+	}
+	if ts.diff() {
+		t.Error("timeSync.diff() after set got: true, want: false")
+	}
+	if !peersConfigured {
+		t.Error("peers aren't monitored after set")
+	}
+	off, err := ini.InsensitiveLoad([]byte("[timeSync]\nenable=false"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !(&timeSync{newMetadata: &metadataJSON{}, config: off}).disabled() {
+		t.Error("timeSync.disabled() with enable=false got: false, want: true")
+	}
+	if peersConfigured {
+		t.Error("peers are still monitored after time sync was disabled")
+	}
+	wantReg := fakeDwordRegistry{w32timeConfig + `\MinPollInterval`: 6, w32timeConfig + `\MaxPollInterval`: 10}
+	if !reflect.DeepEqual(reg, wantReg) {
+		t.Errorf("registry got: %v, want: %v", reg, wantReg)
+	}
+}
+
+func TestTimeSyncPollIntervals(t *testing.T) {
+	var tests = []struct {
+		data string
+		want [2]uint32
+	}{
+		{"", [2]uint32{6, 10}},
+		{"[timeSync]\nmin_poll_interval_sec=16\nmax_poll_interval_sec=300", [2]uint32{4, 8}},
+		{"[timeSync]\nmin_poll_interval_sec=2048", [2]uint32{11, 11}},
+		{"[timeSync]\nmin_poll_interval_sec=0\nmax_poll_interval_sec=bad", [2]uint32{6, 10}},
+	}
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := (&timeSync{newMetadata: &metadataJSON{}, config: cfg}).pollIntervals(); got != tt.want {
+			t.Errorf("pollIntervals(%q) got: %v, want: %v", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestTimeSyncResyncAfterMigration(t *testing.T) {
+	var resyncs int
+	oldW32tm, oldReg := w32tm, timeSyncReg
+	defer func() { w32tm, timeSyncReg = oldW32tm, oldReg }()
+	w32tm = func(args ...string) ([]byte, error) {
+		if args[0] == "/resync" {
+			resyncs++
+		}
+		return nil, nil
+	}
+	timeSyncReg = fakeDwordRegistry{}
+
+	cfg := ini.Empty()
+	migrating := &metadataJSON{Instance: instanceJSON{MaintenanceEvent: "MIGRATE_ON_HOST_MAINTENANCE"}}
+	ts := &timeSync{newMetadata: &metadataJSON{}, config: cfg}
+	if err := ts.set(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	during := &timeSync{newMetadata: migrating, config: cfg}
+	if !during.diff() {
+		t.Error("diff() as live migration starts got: false, want: true")
+	}
+	if err := during.set(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if during.diff() {
+		t.Error("diff() during live migration got: true, want: false")
+	}
+	if resyncs != 0 {
+		t.Errorf("clock resynchronized %d times during live migration, want 0", resyncs)
+	}
+	if !ts.diff() {
+		t.Error("diff() after live migration got: false, want: true")
+	}
+	if err := ts.set(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if resyncs != 1 {
+		t.Errorf("clock resynchronized %d times, want 1", resyncs)
+	}
+	if ts.diff() {
+		t.Error("diff() after resync got: true, want: false")
+	}
+}
+
+func TestParseStripchart(t *testing.T) {
+	var tests = []struct {
+		out     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"Tracking metadata.google.internal [169.254.169.254:123].\nCollecting 1 samples.\nThe current time is 5/1/2018 10:15:04 AM.\n10:15:04, +00.0003487s\n", 348700 * time.Nanosecond, false},
+		{"10:15:04, -01.5000000s\n", -1500 * time.Millisecond, false},
+		{"10:15:04, error: 0x800705B4\n", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseStripchart([]byte(tt.out))
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseStripchart(%q) got: %s, %v, want: %s, error: %t", tt.out, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParsePeers(t *testing.T) {
+	out := []byte(`#Peers: 2
+
+Peer: a.example.com,0x8
+State: Pending
+Time Remaining: 31.1234567s
+Mode: 3 (Client)
+Stratum: 0 (unspecified)
+
+Peer: b.example.com,0xa
+State: Active
+Time Remaining: 900.0000000s
+Mode: 3 (Client)
+Stratum: 1 (primary reference - syncd by radio clock)
+`)
+	want := []peerStatus{{"a.example.com", "Pending"}, {"b.example.com", "Active"}}
+	got := parsePeers(out)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsePeers() got: %+v, want: %+v", got, want)
+	}
+	if active, ok := activePeer(got); !ok || active != "b.example.com" {
+		t.Errorf("activePeer() got: %q, %t, want: %q, true", active, ok, "b.example.com")
+	}
+	if _, ok := activePeer(parsePeers([]byte("#Peers: 0\n"))); ok {
+		t.Error("activePeer() with no peers returned ok")
+	}
+}
@@ -0,0 +1,224 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// span is a single timed operation in an update cycle trace. All methods are
+// no-ops on a nil span so callers need not check whether tracing is enabled.
+type span struct {
+	tracer   *tracer
+	traceID  string
+	spanID   string
+	parentID string
+	name     string
+	start    time.Time
+	end      time.Time
+	err      error
+}
+
+// spanExporter sends the spans of a finished trace somewhere.
+type spanExporter interface {
+	export([]*span) error
+}
+
+type tracer struct {
+	exporter spanExporter
+	mu       sync.Mutex
+	ended    []*span
+}
+
+// newTracer returns a tracer exporting to [telemetry] otlp_endpoint, or nil if
+// tracing is not configured.
+func newTracer(cfg *ini.File) *tracer {
+	endpoint := cfg.Section("telemetry").Key("otlp_endpoint").String()
+	if endpoint == "" {
+		return nil
+	}
+	return &tracer{exporter: otlpExporter{endpoint: endpoint}}
+}
+
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// startSpan starts a span, a nil parent starts a new trace.
+func (t *tracer) startSpan(name string, parent *span) *span {
+	if t == nil {
+		return nil
+	}
+	s := &span{tracer: t, spanID: randomID(8), name: name, start: time.Now()}
+	if parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		s.traceID = randomID(16)
+	}
+	return s
+}
+
+// finish ends the span, finishing a root span exports the whole trace.
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end, s.err = time.Now(), err
+
+	t := s.tracer
+	t.mu.Lock()
+	t.ended = append(t.ended, s)
+	var spans []*span
+	if s.parentID == "" {
+		spans, t.ended = t.ended, nil
+	}
+	t.mu.Unlock()
+
+	if spans != nil {
+		if err := t.exporter.export(spans); err != nil {
+			logger.Errorln("Error exporting trace:", err)
+		}
+	}
+}
+
+// tracedManager records spans for the diff and set calls of a manager.
+type tracedManager struct {
+	manager
+	name   string
+	parent *span
+}
+
+func (t tracedManager) diff() bool {
+	s := t.parent.tracer.startSpan(t.name+".diff", t.parent)
+	defer s.finish(nil)
+	return t.manager.diff()
+}
+
+func (t tracedManager) set(ctx context.Context) error {
+	s := t.parent.tracer.startSpan(t.name+".set", t.parent)
+	err := t.manager.set(ctx)
+	s.finish(err)
+	return err
+}
+
+var traceTimeout = 5 * time.Second
+
+// otlpExporter posts spans as OTLP/HTTP JSON, endpoint is the full URL, e.g.
+// http://collector:4318/v1/traces.
+type otlpExporter struct {
+	endpoint string
+}
+
+type otlpAttributeJSON struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpStatusJSON struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpanJSON struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Status            otlpStatusJSON `json:"status"`
+}
+
+type otlpScopeSpansJSON struct {
+	Scope struct {
+		Name    string `json:"name"`
+		Version string `json:"version,omitempty"`
+	} `json:"scope"`
+	Spans []otlpSpanJSON `json:"spans"`
+}
+
+type otlpResourceSpansJSON struct {
+	Resource struct {
+		Attributes []otlpAttributeJSON `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpansJSON `json:"scopeSpans"`
+}
+
+type otlpTracesJSON struct {
+	ResourceSpans []otlpResourceSpansJSON `json:"resourceSpans"`
+}
+
+func otlpTraces(spans []*span) otlpTracesJSON {
+	var ss otlpScopeSpansJSON
+	ss.Scope.Name = "GCEWindowsAgent"
+	ss.Scope.Version = version
+	for _, s := range spans {
+		js := otlpSpanJSON{
+			TraceID:           s.traceID,
+			SpanID:            s.spanID,
+			ParentSpanID:      s.parentID,
+			Name:              s.name,
+			Kind:              1, // SPAN_KIND_INTERNAL
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.err != nil {
+			js.Status = otlpStatusJSON{Code: 2, Message: s.err.Error()} // STATUS_CODE_ERROR
+		}
+		ss.Spans = append(ss.Spans, js)
+	}
+
+	var attr otlpAttributeJSON
+	attr.Key = "service.name"
+	attr.Value.StringValue = "GCEWindowsAgent"
+	var rs otlpResourceSpansJSON
+	rs.Resource.Attributes = []otlpAttributeJSON{attr}
+	rs.ScopeSpans = []otlpScopeSpansJSON{ss}
+	return otlpTracesJSON{ResourceSpans: []otlpResourceSpansJSON{rs}}
+}
+
+func (e otlpExporter) export(spans []*span) error {
+	data, err := json.Marshal(otlpTraces(spans))
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: traceTimeout}
+	resp, err := client.Post(e.endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP endpoint returned %s", resp.Status)
+	}
+	return nil
+}
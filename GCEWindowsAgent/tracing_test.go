@@ -0,0 +1,136 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+type memoryExporter struct {
+	exports [][]*span
+}
+
+func (m *memoryExporter) export(spans []*span) error {
+	m.exports = append(m.exports, spans)
+	return nil
+}
+
+func TestNewTracer(t *testing.T) {
+	if tr := newTracer(ini.Empty()); tr != nil {
+		t.Errorf("newTracer() with no endpoint got: %+v, want nil", tr)
+	}
+	// A nil tracer and its spans must be usable.
+	var tr *tracer
+	s := tr.startSpan("runUpdate", nil)
+	s.finish(nil)
+	if s != nil {
+		t.Errorf("startSpan() on nil tracer got: %+v, want nil", s)
+	}
+
+	cfg, err := ini.InsensitiveLoad([]byte("[Telemetry]\notlp_endpoint=http://localhost:4318/v1/traces"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr := newTracer(cfg); tr == nil {
+		t.Error("newTracer() with endpoint got nil")
+	}
+}
+
+func TestTracedManagers(t *testing.T) {
+	exp := &memoryExporter{}
+	tr := &tracer{exporter: exp}
+	root := tr.startSpan("runUpdate", nil)
+	runManagers(context.Background(), ini.Empty(), []namedManager{
+		{"a", tracedManager{&fakeManager{isDiff: true}, "a", root}},
+		{"b", tracedManager{&fakeManager{isDiff: true, err: errors.New("fail")}, "b", root}},
+		{"c", tracedManager{&fakeManager{}, "c", root}},
+	})
+	if len(exp.exports) != 0 {
+		t.Fatalf("trace exported before the root span finished")
+	}
+	root.finish(nil)
+
+	if len(exp.exports) != 1 {
+		t.Fatalf("got %d exports, want 1", len(exp.exports))
+	}
+	var names []string
+	for _, s := range exp.exports[0] {
+		names = append(names, s.name)
+		if s.traceID != root.traceID {
+			t.Errorf("span %q trace ID got: %s, want: %s", s.name, s.traceID, root.traceID)
+		}
+		if s == root {
+			if s.parentID != "" {
+				t.Errorf("root span has parent %s", s.parentID)
+			}
+			continue
+		}
+		if s.parentID != root.spanID {
+			t.Errorf("span %q parent got: %s, want: %s", s.name, s.parentID, root.spanID)
+		}
+		if (s.err != nil) != (s.name == "b.set") {
+			t.Errorf("span %q error got: %v", s.name, s.err)
+		}
+	}
+	sort.Strings(names)
+	want := []string{"a.diff", "a.set", "b.diff", "b.set", "c.diff", "runUpdate"}
+	if len(names) != len(want) {
+		t.Fatalf("span names got: %q, want: %q", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("span names got: %q, want: %q", names, want)
+			break
+		}
+	}
+	neededPaths = nil
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var got otlpTracesJSON
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer ts.Close()
+
+	tr := &tracer{exporter: otlpExporter{endpoint: ts.URL}}
+	root := tr.startSpan("runUpdate", nil)
+	tr.startSpan("a.set", root).finish(errors.New("fail"))
+	root.finish(nil)
+
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("unexpected OTLP payload: %+v", got)
+	}
+	spans := got.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	if spans[0].Name != "a.set" || spans[0].ParentSpanID != spans[1].SpanID || spans[0].Status.Code != 2 {
+		t.Errorf("unexpected child span: %+v", spans[0])
+	}
+	if len(spans[1].TraceID) != 32 || len(spans[1].SpanID) != 16 {
+		t.Errorf("unexpected root span IDs: %+v", spans[1])
+	}
+}
@@ -0,0 +1,392 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+var (
+	// updateRecheck is how often the update settings are checked, so
+	// changes apply without a restart.
+	updateRecheck = time.Minute
+
+	// gcsDownloadURL, agentExecutable and restartAgent are replaced in
+	// tests.
+	gcsDownloadURL  = "https://storage.googleapis.com/storage/v1"
+	agentExecutable = os.Executable
+	// restartAgent restarts the service from a separate process, which
+	// outlives the agent being stopped.
+	restartAgent = func(exe string) error {
+		return exec.Command("powershell.exe", "-NoProfile", "-NonInteractive", "-Command", restartScript(exe)).Start()
+	}
+)
+
+// updateHealthTimeout is how long an updated agent has to report healthy,
+// by removing the previous binary, before it is rolled back.
+const updateHealthTimeout = 10 * time.Minute
+
+// restartScript restarts the service and restores exe.old if the new agent
+// has not removed it within updateHealthTimeout.
+func restartScript(exe string) string {
+	quote := func(s string) string { return "'" + strings.Replace(s, "'", "''", -1) + "'" }
+	return fmt.Sprintf(`$exe = %s; $old = $exe + '.old'
+Start-Sleep 5; Restart-Service GCEAgent -Force
+$deadline = (Get-Date).AddSeconds(%d)
+while ((Test-Path $old) -and (Get-Date) -lt $deadline) { Start-Sleep 5 }
+if (Test-Path $old) { Stop-Service GCEAgent -Force; Move-Item -Force $old $exe; Start-Service GCEAgent }`, quote(exe), int(updateHealthTimeout/time.Second))
+}
+
+// releaseJSON is the latest.json manifest of a release channel. Signature is
+// the base64 RSA PKCS #1 v1.5 signature of the SHA-256 of signedData, so the
+// version and object can't be swapped for those of another release.
+type releaseJSON struct {
+	Version   string `json:"version"`
+	Object    string `json:"object"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+// signedData returns the manifest fields covered by the signature, one per
+// line.
+func (r *releaseJSON) signedData() []byte {
+	return []byte(r.Version + "\n" + r.Object + "\n" + strings.ToLower(r.SHA256))
+}
+
+// verify checks the signature of the manifest.
+func (r *releaseJSON) verify(key *rsa.PublicKey) error {
+	sig, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil {
+		return fmt.Errorf("error decoding signature of release %s: %v", r.Version, err)
+	}
+	sum := sha256.Sum256(r.signedData())
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return fmt.Errorf("invalid signature on release %s manifest: %v", r.Version, err)
+	}
+	return nil
+}
+
+// updateChannel returns the [updates] channel, stable or beta.
+func updateChannel(config *ini.File) (string, error) {
+	switch c := config.Section("updates").Key("channel").MustString("stable"); c {
+	case "stable", "beta":
+		return c, nil
+	default:
+		return "", fmt.Errorf("invalid update channel %q, want stable or beta", c)
+	}
+}
+
+// parseVersion splits a version such as 4.6.0@1 into its numbers.
+func parseVersion(v string) []int {
+	var nums []int
+	for _, f := range strings.FieldsFunc(v, func(r rune) bool { return r < '0' || r > '9' }) {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return nil
+		}
+		nums = append(nums, n)
+	}
+	return nums
+}
+
+// compareVersions returns -1, 0 or 1 as version a is older than, the same as
+// or newer than b.
+func compareVersions(a, b string) int {
+	x, y := parseVersion(a), parseVersion(b)
+	for i := 0; i < len(x) || i < len(y); i++ {
+		var m, n int
+		if i < len(x) {
+			m = x[i]
+		}
+		if i < len(y) {
+			n = y[i]
+		}
+		switch {
+		case m < n:
+			return -1
+		case m > n:
+			return 1
+		}
+	}
+	return 0
+}
+
+// parseClock parses a local time of day such as 02:30.
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, want HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// inMaintenanceWindow reports whether now falls in window, such as
+// 02:00-04:00 in local time. A window can span midnight, an empty one is
+// always open.
+func inMaintenanceWindow(now time.Time, window string) (bool, error) {
+	if window == "" {
+		return true, nil
+	}
+	parts := strings.SplitN(window, "-", 2)
+	if len(parts) != 2 {
+		return false, fmt.Errorf("invalid maintenance window %q, want HH:MM-HH:MM", window)
+	}
+	start, err := parseClock(parts[0])
+	if err != nil {
+		return false, err
+	}
+	end, err := parseClock(parts[1])
+	if err != nil {
+		return false, err
+	}
+	t := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	if start <= end {
+		return t >= start && t < end, nil
+	}
+	return t >= start || t < end, nil
+}
+
+// readReleaseKey reads the PEM encoded RSA public key releases are signed
+// with.
+func readReleaseKey(file string) (*rsa.PublicKey, error) {
+	if file == "" {
+		return nil, errors.New("no public_key_file set to verify releases with")
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", file)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an RSA public key", file)
+	}
+	return rsaKey, nil
+}
+
+// downloadFromGCS writes object in bucket to w.
+func downloadFromGCS(ctx context.Context, config *ini.File, bucket, object string, w io.Writer) error {
+	token, err := serviceAccountToken(ctx, config)
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/b/%s/o/%s?alt=media", gcsDownloadURL, url.PathEscape(bucket), url.PathEscape(object))
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("error downloading gs://%s/%s: %s, %s", bucket, object, resp.Status, body)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// latestRelease fetches the manifest of the configured channel.
+func latestRelease(ctx context.Context, config *ini.File) (string, *releaseJSON, error) {
+	b := config.Section("updates").Key("bucket").String()
+	if b == "" {
+		return "", nil, errors.New("no updates bucket set")
+	}
+	bucket, prefix, err := parseGCSBucket(b)
+	if err != nil {
+		return "", nil, err
+	}
+	channel, err := updateChannel(config)
+	if err != nil {
+		return "", nil, err
+	}
+	var buf strings.Builder
+	if err := downloadFromGCS(ctx, config, bucket, path.Join(prefix, channel, "latest.json"), &buf); err != nil {
+		return "", nil, err
+	}
+	var release releaseJSON
+	if err := json.Unmarshal([]byte(buf.String()), &release); err != nil {
+		return "", nil, fmt.Errorf("error parsing %s release manifest: %v", channel, err)
+	}
+	if release.Version == "" || release.Object == "" {
+		return "", nil, fmt.Errorf("%s release manifest has no version or object", channel)
+	}
+	return bucket, &release, nil
+}
+
+// downloadRelease downloads the release binary to dst and verifies its hash
+// against the verified manifest, removing dst if it doesn't match.
+func downloadRelease(ctx context.Context, config *ini.File, bucket string, release *releaseJSON, dst string) (err error) {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dst)
+		}
+	}()
+
+	h := sha256.New()
+	if err := downloadFromGCS(ctx, config, bucket, release.Object, io.MultiWriter(f, h)); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, release.SHA256) {
+		return fmt.Errorf("SHA-256 of release %s is %s, want %s", release.Version, got, release.SHA256)
+	}
+	return nil
+}
+
+// replaceBinary swaps the running binary exe for src, keeping the old one as
+// exe.old as a running binary can be renamed but not overwritten. exe.old is
+// kept until the new agent is healthy.
+func replaceBinary(exe, src string) error {
+	old := exe + ".old"
+	if err := os.Remove(old); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Rename(exe, old); err != nil {
+		return err
+	}
+	if err := os.Rename(src, exe); err != nil {
+		if rerr := os.Rename(old, exe); rerr != nil {
+			logger.Errorf("Error restoring %s: %v", exe, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// markAgentHealthy removes the binary left by the last update, once the
+// agent completed an update cycle. Until then the restart script can roll
+// back to it.
+func markAgentHealthy() {
+	exe, err := agentExecutable()
+	if err != nil {
+		return
+	}
+	if err := os.Remove(exe + ".old"); err != nil && !os.IsNotExist(err) {
+		logger.Errorf("Error removing the previous agent binary: %v", err)
+	}
+}
+
+// checkForUpdate installs the latest release of the configured channel if its
+// manifest is signed and it is newer than the running agent, and restarts the
+// service. Older releases are refused, so a replayed manifest can't downgrade
+// the agent.
+func checkForUpdate(ctx context.Context, config *ini.File) error {
+	if version == "" {
+		logger.Debugf("Skipping update check, the agent version is unknown")
+		return nil
+	}
+	bucket, release, err := latestRelease(ctx, config)
+	if err != nil {
+		return err
+	}
+	key, err := readReleaseKey(config.Section("updates").Key("public_key_file").String())
+	if err != nil {
+		return err
+	}
+	if err := release.verify(key); err != nil {
+		return err
+	}
+	if compareVersions(release.Version, version) <= 0 {
+		logger.Debugf("Agent version %s is up to date, latest release is %s", version, release.Version)
+		return nil
+	}
+	if dryRun(config) {
+		logger.Infof("Dry run: would update the agent from %s to %s.", version, release.Version)
+		return nil
+	}
+	exe, err := agentExecutable()
+	if err != nil {
+		return err
+	}
+	logger.Infof("Updating the agent from %s to %s.", version, release.Version)
+	if err := downloadRelease(ctx, config, bucket, release, exe+".new"); err != nil {
+		return err
+	}
+	if err := replaceBinary(exe, exe+".new"); err != nil {
+		return err
+	}
+	logger.Infof("Installed agent %s, restarting.", release.Version)
+	return restartAgent(exe)
+}
+
+// updateLoop checks for agent updates every [updates] check_interval_sec
+// during the maintenance window, if updates are enabled.
+func updateLoop(ctx context.Context) {
+	var last time.Time
+	periodicLoop(ctx, periodicTask{
+		name:     "agent update",
+		interval: every(updateRecheck),
+		due: func(cfg *ini.File, now time.Time) bool {
+			sec := cfg.Section("updates")
+			if !sec.Key("enable").MustBool(false) {
+				return false
+			}
+			interval := time.Duration(sec.Key("check_interval_sec").MustInt(86400)) * time.Second
+			if now.Sub(last) < interval {
+				return false
+			}
+			open, err := inMaintenanceWindow(now, sec.Key("maintenance_window").String())
+			if err != nil {
+				logger.Error(err)
+				return false
+			}
+			return open
+		},
+		run: func(ctx context.Context, cfg *ini.File) error {
+			last = time.Now()
+			return checkForUpdate(ctx, cfg)
+		},
+	})
+}
@@ -0,0 +1,216 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+func TestCompareVersions(t *testing.T) {
+	var tests = []struct {
+		a, b string
+		want int
+	}{
+		{"4.6.0", "4.6.0", 0},
+		{"4.6.1", "4.6.0", 1},
+		{"4.6.0", "4.10.0", -1},
+		{"4.6", "4.6.0", 0},
+		{"4.6.0@2", "4.6.0@1", 1},
+		{"4.6.0.1", "4.6.0", 1},
+	}
+
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) got: %d, want: %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestInMaintenanceWindow(t *testing.T) {
+	at := func(h, m int) time.Time { return time.Date(2018, 1, 1, h, m, 0, 0, time.Local) }
+	var tests = []struct {
+		window  string
+		now     time.Time
+		want    bool
+		wantErr bool
+	}{
+		{"", at(12, 0), true, false},
+		{"02:00-04:00", at(3, 0), true, false},
+		{"02:00-04:00", at(4, 0), false, false},
+		{"02:00-04:00", at(1, 59), false, false},
+		{"23:00-01:00", at(23, 30), true, false},
+		{"23:00-01:00", at(0, 30), true, false},
+		{"23:00-01:00", at(12, 0), false, false},
+		{"2am-4am", at(3, 0), false, true},
+		{"02:00", at(3, 0), false, true},
+	}
+
+	for _, tt := range tests {
+		got, err := inMaintenanceWindow(tt.now, tt.window)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("inMaintenanceWindow(%s, %q) error: %v, want error: %t", tt.now.Format("15:04"), tt.window, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("inMaintenanceWindow(%s, %q) got: %t, want: %t", tt.now.Format("15:04"), tt.window, got, tt.want)
+		}
+	}
+}
+
+func TestCheckForUpdate(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "updates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmp)
+
+	prv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&prv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(tmp, "release.pem")
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(r releaseJSON) releaseJSON {
+		sum := sha256.Sum256(r.signedData())
+		sig, err := rsa.SignPKCS1v15(rand.Reader, prv, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Signature = base64.StdEncoding.EncodeToString(sig)
+		return r
+	}
+
+	binary := []byte("new agent")
+	sum := sha256.Sum256(binary)
+	good := sign(releaseJSON{"4.7.0", "beta/GCEWindowsAgent.exe", hex.EncodeToString(sum[:]), ""})
+	badSig := good
+	badSig.Signature = base64.StdEncoding.EncodeToString([]byte("forged"))
+	// A signed manifest with its version swapped.
+	badVersion := good
+	badVersion.Version = "4.8.0"
+	badHash := sign(releaseJSON{"4.7.0", "beta/GCEWindowsAgent.exe", hex.EncodeToString(make([]byte, sha256.Size)), ""})
+	old := sign(releaseJSON{"4.6.0", "beta/GCEWindowsAgent.exe", hex.EncodeToString(sum[:]), ""})
+	downgrade := sign(releaseJSON{"4.5.0", "beta/GCEWindowsAgent.exe", hex.EncodeToString(sum[:]), ""})
+
+	var tests = []struct {
+		name        string
+		config      string
+		release     releaseJSON
+		wantErr     bool
+		wantUpdated bool
+	}{
+		{"update", "[updates]\nchannel=beta", good, false, true},
+		{"up to date", "[updates]\nchannel=beta", old, false, false},
+		{"downgrade", "[updates]\nchannel=beta", downgrade, false, false},
+		{"bad signature", "[updates]\nchannel=beta", badSig, true, false},
+		{"unsigned version", "[updates]\nchannel=beta", badVersion, true, false},
+		{"bad hash", "[updates]\nchannel=beta", badHash, true, false},
+		{"wrong channel", "[updates]\nchannel=alpha", good, true, false},
+		{"dry run", "[updates]\nchannel=beta\n[core]\ndry_run=true", good, false, false},
+	}
+
+	oldServer, oldGCS, oldExe, oldRestart, oldVersion := metadataServer, gcsDownloadURL, agentExecutable, restartAgent, version
+	defer func() {
+		metadataServer, gcsDownloadURL, agentExecutable, restartAgent, version = oldServer, oldGCS, oldExe, oldRestart, oldVersion
+	}()
+	version = "4.6.0"
+	md := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"token"}`))
+	}))
+	defer md.Close()
+	metadataServer = md.URL
+	exe := filepath.Join(tmp, "GCEWindowsAgent.exe")
+	agentExecutable = func() (string, error) { return exe, nil }
+	var restarts int
+	restartAgent = func(string) error {
+		restarts++
+		return nil
+	}
+
+	for _, tt := range tests {
+		if err := ioutil.WriteFile(exe, []byte("old agent"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(exe + ".old")
+		restarts = 0
+		release := tt.release
+		gcs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.EscapedPath() {
+			case "/b/releases/o/agent%2Fbeta%2Flatest.json":
+				json.NewEncoder(w).Encode(release)
+			case "/b/releases/o/beta%2FGCEWindowsAgent.exe":
+				w.Write(binary)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		gcsDownloadURL = gcs.URL
+
+		cfg, err := ini.InsensitiveLoad([]byte("[updates]\nbucket=gs://releases/agent\npublic_key_file=" + keyFile + "\n" + tt.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkForUpdate(context.Background(), cfg)
+		gcs.Close()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("test case %q: checkForUpdate() error: %v, want error: %t", tt.name, err, tt.wantErr)
+		}
+		got, err := ioutil.ReadFile(exe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated := string(got) == string(binary); updated != tt.wantUpdated {
+			t.Errorf("test case %q: binary updated: %t, want: %t", tt.name, updated, tt.wantUpdated)
+		}
+		if updated := restarts == 1; updated != tt.wantUpdated {
+			t.Errorf("test case %q: restarted %d times", tt.name, restarts)
+		}
+		if _, err := os.Stat(exe + ".new"); !os.IsNotExist(err) {
+			t.Errorf("test case %q: %s.new left behind", tt.name, exe)
+		}
+		// The previous binary is kept until the new agent is healthy.
+		if _, err := os.Stat(exe + ".old"); (err == nil) != tt.wantUpdated {
+			t.Errorf("test case %q: %s.old kept: %t, want: %t", tt.name, exe, err == nil, tt.wantUpdated)
+		}
+		markAgentHealthy()
+		if _, err := os.Stat(exe + ".old"); !os.IsNotExist(err) {
+			t.Errorf("test case %q: %s.old not removed once healthy", tt.name, exe)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+// keyType is the type a config value must parse as.
+type keyType int
+
+const (
+	typeString keyType = iota
+	typeBool
+	typeInt
+	typeFloat
+)
+
+func (t keyType) String() string {
+	switch t {
+	case typeBool:
+		return "a bool"
+	case typeInt:
+		return "an integer"
+	case typeFloat:
+		return "a number"
+	}
+	return "a string"
+}
+
+// configSchema is every config key the agent reads, by section. A key read
+// anywhere in the agent must be listed here or validate-config reports it.
+var configSchema = map[string]map[string]keyType{
+	"core": {
+		"audit_interval_sec":        typeInt,
+		"boot_settle_sec":           typeInt,
+		"console_logging":           typeBool,
+		"control_pipe":              typeBool,
+		"dry_run":                   typeBool,
+		"guest_attributes":          typeBool,
+		"log_file":                  typeString,
+		"log_file_max_files":        typeInt,
+		"log_file_max_mb":           typeInt,
+		"log_format":                typeString,
+		"log_level":                 typeString,
+		"log_repeat_window_sec":     typeInt,
+		"manager_timeout_sec":       typeInt,
+		"metrics_address":           typeString,
+		"post_converge_script":      typeString,
+		"post_converge_timeout_sec": typeInt,
+		"serial_max_write":          typeInt,
+		"serial_port":               typeString,
+		"status_address":            typeString,
+		"treat_missing_as":          typeString,
+	},
+	"metadata": {
+		"accept_gzip":           typeBool,
+		"backoff_jitter":        typeFloat,
+		"config_format":         typeString,
+		"diff_mode":             typeString,
+		"error_after_failures":  typeInt,
+		"expected_instance":     typeString,
+		"expected_project":      typeString,
+		"file":                  typeString,
+		"hang_timeout_sec":      typeInt,
+		"idle_conn_timeout_sec": typeInt,
+		"max_backoff_sec":       typeInt,
+		"max_idle_conns":        typeInt,
+		"mode":                  typeString,
+		"poll_interval_sec":     typeInt,
+		"retry_interval_sec":    typeInt,
+		"server_ip":             typeString,
+		"subtree_fetch":         typeBool,
+		"watch_network_changes": typeBool,
+	},
+	"managers": {
+		"independent_watch": typeString,
+	},
+	"cloudLogging": {
+		"batch_size": typeInt,
+		"enable":     typeBool,
+		"flush_sec":  typeInt,
+		"log_name":   typeString,
+	},
+	"events": {
+		"webhook": typeString,
+	},
+	"inventory": {
+		"enable":       typeBool,
+		"interval_sec": typeInt,
+	},
+	"maintenance": {
+		"enable":           typeBool,
+		"hook":             typeString,
+		"hook_timeout_sec": typeInt,
+	},
+	"plugins": {
+		"dir": typeString,
+	},
+	"scripts": {
+		"enable":               typeBool,
+		"shutdown_timeout_sec": typeInt,
+		"timeout_sec":          typeInt,
+	},
+	"snapshots": {
+		"channel":            typeString,
+		"enable":             typeBool,
+		"freeze_timeout_sec": typeInt,
+		"post_script":        typeString,
+		"pre_script":         typeString,
+		"script_timeout_sec": typeInt,
+		"vss":                typeBool,
+		"vss_requester":      typeString,
+	},
+	"telemetry": {
+		"otlp_endpoint": typeString,
+	},
+	"termination": {
+		"enable":             typeBool,
+		"script":             typeString,
+		"script_timeout_sec": typeInt,
+	},
+	"updates": {
+		"bucket":             typeString,
+		"channel":            typeString,
+		"check_interval_sec": typeInt,
+		"enable":             typeBool,
+		"maintenance_window": typeString,
+		"public_key_file":    typeString,
+	},
+	"activation": {
+		"attempts": typeInt,
+		"enable":   typeBool,
+		"kms_host": typeString,
+	},
+	"addressManager": {
+		"disable":                typeBool,
+		"duplicate_ip_priority":  typeString,
+		"gratuitous_arp":         typeBool,
+		"ip_aliases":             typeBool,
+		"ipv6":                   typeBool,
+		"pause_during_migration": typeBool,
+		"removal_grace_sec":      typeInt,
+		"route_ranges":           typeString,
+		"use_netsh":              typeBool,
+	},
+	"accountManager": {
+		"admin_allowlist":     typeString,
+		"admin_denylist":      typeString,
+		"default_group":       typeString,
+		"disable":             typeBool,
+		"expired_accounts":    typeString,
+		"groups":              typeString,
+		"max_accounts":        typeInt,
+		"name_normalization":  typeString,
+		"reset_serial_port":   typeString,
+		"skip_if_domain_user": typeBool,
+	},
+	"wsfc": {
+		"addresses":          typeString,
+		"drain_sec":          typeInt,
+		"enable":             typeBool,
+		"enabled":            typeBool,
+		"ip_version":         typeString,
+		"port":               typeString,
+		"tls_cert_file":      typeString,
+		"tls_client_ca_file": typeString,
+		"tls_key_file":       typeString,
+	},
+	"diagnostics": {
+		"bucket":        typeString,
+		"drivers":       typeBool,
+		"enable":        typeBool,
+		"event_logs":    typeBool,
+		"hours":         typeInt,
+		"keep_archives": typeInt,
+		"minidumps":     typeBool,
+		"redact":        typeBool,
+		"schedule":      typeString,
+		"unattend":      typeBool,
+	},
+	"printers": {
+		"manage": typeBool,
+		"ports":  typeString,
+	},
+	"timeSync": {
+		"drift_threshold_ms":    typeInt,
+		"enable":                typeBool,
+		"max_poll_interval_sec": typeInt,
+		"min_poll_interval_sec": typeInt,
+		"ntp_servers":           typeString,
+	},
+	"pagefile": {
+		"files":  typeString,
+		"manage": typeBool,
+	},
+	"perfTune": {
+		"profile": typeString,
+	},
+	"osLogin": {
+		"default_group":        typeString,
+		"enable":               typeBool,
+		"refresh_interval_sec": typeInt,
+	},
+	"sshKeys": {
+		"enable": typeBool,
+	},
+	"rdpCert": {
+		"enable":            typeBool,
+		"renew_before_days": typeInt,
+		"validity_days":     typeInt,
+	},
+	"winrm": {
+		"enable":            typeBool,
+		"open_firewall":     typeBool,
+		"renew_before_days": typeInt,
+		"validity_days":     typeInt,
+	},
+	"mtu": {
+		"disable":                typeBool,
+		"interface_mac":          typeString,
+		"pause_during_migration": typeBool,
+	},
+	"hostname": {
+		"auto_rename":    typeBool,
+		"enable":         typeBool,
+		"set_dns_suffix": typeBool,
+	},
+	"instanceSetup": {
+		"disable_administrator": typeBool,
+		"enable":                typeBool,
+		"extend_boot_partition": typeBool,
+		"pagefile":              typeString,
+		"rdp":                   typeBool,
+		"winrm":                 typeBool,
+	},
+	"dns": {
+		"disable":                typeBool,
+		"interface_mac":          typeString,
+		"pause_during_migration": typeBool,
+		"search_domains":         typeString,
+		"servers":                typeString,
+	},
+	"disks": {
+		"enable":              typeBool,
+		"extend_drives":       typeString,
+		"extend_interval_sec": typeInt,
+		"policy":              typeString,
+	},
+	"domainJoin": {
+		"enable":   typeBool,
+		"settings": typeString,
+	},
+}
+
+// managerKeys are read from the section of every manager.
+var managerKeys = map[string]keyType{
+	"failure_is_fatal":  typeBool,
+	"first_boot_only":   typeBool,
+	"poll_interval_sec": typeInt,
+	"timeout_sec":       typeInt,
+}
+
+// schemaSection returns the name of section as written in configSchema,
+// config files are loaded case insensitively.
+func schemaSection(section string) (string, bool) {
+	for name := range configSchema {
+		if strings.EqualFold(name, section) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// schemaKey returns the type of key in section.
+func schemaKey(section, key string) (keyType, bool) {
+	if t, ok := configSchema[section][key]; ok {
+		return t, true
+	}
+	for _, mgr := range newManagers(&metadataJSON{}, &metadataJSON{}, ini.Empty()) {
+		if mgr.section == section {
+			t, ok := managerKeys[key]
+			return t, ok
+		}
+	}
+	return 0, false
+}
+
+// checkValue returns an error if the value of k doesn't parse as t. An empty
+// value is the same as an unset one.
+func checkValue(k *ini.Key, t keyType) error {
+	if k.Value() == "" {
+		return nil
+	}
+	var err error
+	switch t {
+	case typeBool:
+		_, err = k.Bool()
+	case typeInt:
+		_, err = k.Int()
+	case typeFloat:
+		_, err = k.Float64()
+	}
+	if err != nil {
+		return fmt.Errorf("%q is not %s", k.Value(), t)
+	}
+	return nil
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := []int{i}
+		for j := 1; j <= len(b); j++ {
+			d := prev[j-1]
+			if a[i-1] != b[j-1] {
+				d++
+			}
+			if prev[j]+1 < d {
+				d = prev[j] + 1
+			}
+			if cur[j-1]+1 < d {
+				d = cur[j-1] + 1
+			}
+			cur = append(cur, d)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// suggest returns the candidate closest to name if it's a likely typo.
+func suggest(name string, candidates []string) string {
+	best, bestDist := "", 3
+	for _, c := range candidates {
+		if d := editDistance(strings.ToLower(name), strings.ToLower(c)); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// checkConfig returns the problems in cfg: unknown sections and keys and
+// values of the wrong type.
+func checkConfig(cfg *ini.File) []string {
+	var sections []string
+	for name := range configSchema {
+		sections = append(sections, name)
+	}
+	sort.Strings(sections)
+	var problems []string
+	for _, sec := range cfg.Sections() {
+		if strings.EqualFold(sec.Name(), ini.DEFAULT_SECTION) {
+			for _, k := range sec.Keys() {
+				problems = append(problems, fmt.Sprintf("%s is not in a section", k.Name()))
+			}
+			continue
+		}
+		name, ok := schemaSection(sec.Name())
+		if !ok && isPluginSection(cfg, sec.Name()) {
+			continue
+		}
+		if !ok {
+			p := fmt.Sprintf("unknown section [%s]", sec.Name())
+			if s := suggest(sec.Name(), sections); s != "" {
+				p += fmt.Sprintf(", did you mean [%s]?", s)
+			}
+			problems = append(problems, p)
+			continue
+		}
+		var keys []string
+		for k := range configSchema[name] {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range sec.Keys() {
+			t, ok := schemaKey(name, k.Name())
+			if !ok {
+				p := fmt.Sprintf("[%s] unknown key %s", name, k.Name())
+				if s := suggest(k.Name(), keys); s != "" {
+					p += fmt.Sprintf(", did you mean %s?", s)
+				}
+				problems = append(problems, p)
+				continue
+			}
+			if err := checkValue(k, t); err != nil {
+				problems = append(problems, fmt.Sprintf("[%s] %s: %v", name, k.Name(), err))
+			}
+		}
+	}
+	return problems
+}
+
+// validateConfig checks the local config, the registry config and the
+// metadata config overlay, then writes the problems found and the effective
+// settings of each manager to w. It returns false if there were problems.
+func validateConfig(ctx context.Context, w io.Writer) bool {
+	var problems []string
+	cfg, err := parseConfig(configPath)
+	if err != nil && !os.IsNotExist(err) {
+		problems = append(problems, fmt.Sprintf("error parsing %s: %v", configPath, err))
+	}
+	if cfg == nil {
+		cfg, _ = ini.InsensitiveLoad([]byte{})
+	}
+	mergeRegistryConfig(cfg)
+
+	// Off GCE, such as in an image build, only the local config is checked.
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	md, err := getMetadata(ctx, cfg)
+	if err != nil {
+		fmt.Fprintf(w, "Skipping metadata config, error fetching metadata: %v\n", err)
+		md = &metadataJSON{}
+	} else if settings, err := metadataConfigSettings(md, cfg); err != nil {
+		problems = append(problems, fmt.Sprintf("error parsing google-compute-agent-config metadata: %v", err))
+	} else {
+		settings.merge(cfg)
+	}
+
+	problems = append(problems, checkConfig(cfg)...)
+	if len(problems) != 0 {
+		fmt.Fprintln(w, "Problems:")
+		for _, p := range problems {
+			fmt.Fprintf(w, "  %s\n", p)
+		}
+	}
+
+	// Reading a key adds it to cfg, so the settings are copied before the
+	// managers read them.
+	settings := make(map[string][]string)
+	for _, sec := range cfg.Sections() {
+		for _, k := range sec.Keys() {
+			if k.Value() != "" {
+				settings[sec.Name()] = append(settings[sec.Name()], fmt.Sprintf("%s = %s", k.Name(), k.Value()))
+			}
+		}
+	}
+
+	for _, mgr := range newManagers(md, md, cfg) {
+		e := managerEnablement(mgr.manager)
+		state := "disabled"
+		if e.Enabled {
+			state = "enabled"
+		}
+		if e.Setting != "" {
+			state += fmt.Sprintf(" by %s %s", e.Source, e.Setting)
+		} else {
+			state += " by " + e.Source
+		}
+		fmt.Fprintf(w, "\n[%s] %s, timeout %s\n", mgr.section, state, managerTimeout(cfg, mgr.section))
+		lines := settings[strings.ToLower(mgr.section)]
+		sort.Strings(lines)
+		for _, l := range lines {
+			fmt.Fprintf(w, "  %s\n", l)
+		}
+	}
+	return len(problems) == 0
+}
@@ -0,0 +1,121 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-ini/ini"
+)
+
+func TestCheckConfig(t *testing.T) {
+	var tests = []struct {
+		name string
+		data string
+		want []string
+	}{
+		{"empty", "", nil},
+		{"valid", "[core]\nmanager_timeout_sec=60\n[accountManager]\ndisable=false\ntimeout_sec=30\n[metadata]\nbackoff_jitter=0.5", nil},
+		{"case insensitive", "[AccountManager]\nMax_Accounts=3", nil},
+		{"typo in section", "[accountsManager]\ndisable=true", []string{"unknown section [accountsmanager], did you mean [accountManager]?"}},
+		{"unknown section", "[frobnicator]\nx=1", []string{"unknown section [frobnicator]"}},
+		{"typo in key", "[addressManager]\nremoval_grace_secs=5", []string{"[addressManager] unknown key removal_grace_secs, did you mean removal_grace_sec?"}},
+		{"empty value", "[dns]\ndisable=", nil},
+		{"manager key outside a manager", "[core]\ntimeout_sec=5", []string{"[core] unknown key timeout_sec"}},
+		{"type errors", "[core]\nmanager_timeout_sec=ten\n[dns]\ndisable=maybe", []string{
+			`[core] manager_timeout_sec: "ten" is not an integer`,
+			`[dns] disable: "maybe" is not a bool`,
+		}},
+		{"outside a section", "disable=true", []string{"disable is not in a section"}},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := checkConfig(cfg); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("test case %q: checkConfig() got: %q, want: %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	var tests = []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"abc", "", 3},
+		{"accountManager", "accountsManager", 1},
+		{"kitten", "sitting", 3},
+	}
+
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b); got != tt.want {
+			t.Errorf("editDistance(%q, %q) got: %d, want: %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	var tests = []struct {
+		name     string
+		registry []string
+		overlay  string
+		want     bool
+		wantOut  []string
+	}{
+		{"valid", []string{"accountManager.max_accounts=3"}, "[dns]\ndisable=true", true, []string{
+			"[accountManager] enabled by default, timeout 10m0s\n  max_accounts = 3\n",
+			"[dns] disabled by config dns.disable, timeout 10m0s\n  disable = true\n",
+		}},
+		{"registry typo", []string{"accountsManager.disable=true"}, "", false, []string{"Problems:\n  unknown section [accountsmanager], did you mean [accountManager]?\n"}},
+		{"overlay type error", nil, "[core]\nmanager_timeout_sec=ten", false, []string{`[core] manager_timeout_sec: "ten" is not an integer`}},
+		{"overlay parse error", nil, "{", false, []string{"error parsing google-compute-agent-config metadata"}},
+	}
+
+	oldServer, oldReadRegConfig := metadataServer, readRegConfig
+	defer func() { metadataServer, readRegConfig = oldServer, oldReadRegConfig }()
+	for _, tt := range tests {
+		md := &metadataJSON{}
+		md.Instance.Attributes.AgentConfig = tt.overlay
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(md)
+		}))
+		metadataServer = ts.URL
+		registry := tt.registry
+		readRegConfig = func() ([]string, error) { return registry, nil }
+
+		var out bytes.Buffer
+		got := validateConfig(context.Background(), &out)
+		ts.Close()
+		if got != tt.want {
+			t.Errorf("test case %q: validateConfig() got: %t, want: %t, output:\n%s", tt.name, got, tt.want, out.String())
+		}
+		for _, want := range tt.wantOut {
+			if !strings.Contains(out.String(), want) {
+				t.Errorf("test case %q: validateConfig() output missing %q, got:\n%s", tt.name, want, out.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+// independentSections are the managers run from their own metadata watch
+// rather than the shared update loop, set once at startup.
+var independentSections []string
+
+// parseIndependentWatch returns the manager sections listed in [managers]
+// independent_watch, "all" or "true" selects every manager.
+func parseIndependentWatch(cfg *ini.File, sections []string) []string {
+	value := strings.TrimSpace(cfg.Section("managers").Key("independent_watch").String())
+	switch strings.ToLower(value) {
+	case "", "false":
+		return nil
+	case "all", "true":
+		return sections
+	}
+
+	var selected []string
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		var found bool
+		for _, section := range sections {
+			if strings.EqualFold(s, section) {
+				found = true
+				if !containsString(section, selected) {
+					selected = append(selected, section)
+				}
+			}
+		}
+		if !found && s != "" {
+			logger.Errorf("Unknown manager %q in independent_watch", s)
+		}
+	}
+	return selected
+}
+
+// managerBuilder returns the manager for one update of an independent watch.
+type managerBuilder func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager
+
+// buildSection returns a managerBuilder for the manager with the given
+// section from newManagers.
+func buildSection(section string) managerBuilder {
+	return func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+		for _, mgr := range newManagers(newMetadata, oldMetadata, cfg) {
+			if mgr.section == section {
+				return mgr.manager
+			}
+		}
+		return nil
+	}
+}
+
+// watchPollInterval returns [section] poll_interval_sec when set, so a manager
+// can poll at its own cadence, or the shared metadata mode otherwise.
+func watchPollInterval(cfg *ini.File, section string) time.Duration {
+	if sec := cfg.Section(section).Key("poll_interval_sec").MustInt(0); sec > 0 {
+		return time.Duration(sec) * time.Second
+	}
+	return pollInterval(cfg)
+}
+
+// independentWatch watches only the metadata paths of one manager and runs it
+// whenever they change, until ctx is done. Like runUpdate it verifies the
+// metadata, traces the manager and runs the post convergence script.
+func independentWatch(ctx context.Context, section string, build managerBuilder) {
+	etags := map[string]string{}
+	content := map[string]json.RawMessage{}
+	var oldMetadata metadataJSON
+	for {
+		cfg := loadConfig()
+		paths := build(&metadataJSON{}, &metadataJSON{}, cfg).metadataPaths()
+		if paths == nil {
+			// The whole tree.
+			paths = []string{"instance", "project"}
+		} else {
+			paths = append(paths, verifyPaths(cfg)...)
+		}
+
+		newMetadata, err := watchMetadataPaths(ctx, getMetadataClient(cfg), paths, watchPollInterval(cfg, section), etags, content)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logger.Errorf("Error watching metadata for %s: %v", section, err)
+			if !sleepCtx(ctx, 5*time.Second) {
+				return
+			}
+			continue
+		}
+		if err := verifyMetadata(newMetadata, cfg); err != nil {
+			logger.Errorf("Not running %s: %v", section, err)
+			continue
+		}
+
+		mgr := namedManager{section, build(newMetadata, &oldMetadata, cfg)}
+		updateMu.Lock()
+		if mgr.disabled() {
+			recordState(cfg, section, stateDisabled)
+		} else if firstBootOnly(cfg, section) && !firstBoot() {
+			// Ran on first boot already.
+		} else {
+			convergeManager(ctx, cfg, mgr, false)
+		}
+		updateMu.Unlock()
+		oldMetadata = *newMetadata
+	}
+}
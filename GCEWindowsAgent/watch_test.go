@@ -0,0 +1,165 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+func TestParseIndependentWatch(t *testing.T) {
+	sections := []string{"addressManager", "accountManager", "diagnostics"}
+	var tests = []struct {
+		value string
+		want  []string
+	}{
+		{"", nil},
+		{"false", nil},
+		{"true", sections},
+		{"all", sections},
+		{"diagnostics, AddressManager, bogus", []string{"diagnostics", "addressManager"}},
+	}
+
+	for _, tt := range tests {
+		cfg := ini.Empty()
+		cfg.Section("managers").Key("independent_watch").SetValue(tt.value)
+		if got := parseIndependentWatch(cfg, sections); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseIndependentWatch(%q) got: %q, want: %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+// signalManager reports each set call on fired.
+type signalManager struct {
+	fakeManager
+	name  string
+	fired chan<- string
+}
+
+func (s *signalManager) set(ctx context.Context) error {
+	s.fired <- s.name
+	return nil
+}
+
+// hangingServer serves a metadata subtree per path, holding requests for the
+// current etag until the path changes.
+type hangingServer struct {
+	mu       sync.Mutex
+	versions map[string]int
+	changed  chan struct{}
+}
+
+func (h *hangingServer) bump(path string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.versions[path]++
+	close(h.changed)
+	h.changed = make(chan struct{})
+}
+
+func (h *hangingServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	for {
+		h.mu.Lock()
+		version, changed := strconv.Itoa(h.versions[path]), h.changed
+		h.mu.Unlock()
+		if r.URL.Query().Get("last_etag") != version {
+			w.Header().Set("etag", version)
+			if strings.HasSuffix(path, "network-interfaces") {
+				w.Write([]byte("[]"))
+			} else {
+				w.Write([]byte("{}"))
+			}
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func TestIndependentWatch(t *testing.T) {
+	h := &hangingServer{versions: map[string]int{"instance/attributes": 1, "instance/network-interfaces": 1}, changed: make(chan struct{})}
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+	oldServer := metadataServer
+	defer func() { metadataServer = oldServer }()
+	metadataServer = ts.URL
+
+	fired := make(chan string, 10)
+	build := func(name, path string) managerBuilder {
+		return func(newMetadata, oldMetadata *metadataJSON, cfg *ini.File) manager {
+			return &signalManager{fakeManager{isDiff: true, paths: []string{path}}, name, fired}
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go independentWatch(ctx, "attrs", build("attrs", "instance/attributes"))
+	go independentWatch(ctx, "nics", build("nics", "instance/network-interfaces"))
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-fired:
+			if got != want {
+				t.Errorf("manager %q fired, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("manager %q did not fire", want)
+		}
+	}
+	expectNone := func() {
+		t.Helper()
+		select {
+		case got := <-fired:
+			t.Errorf("manager %q fired unexpectedly", got)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+
+	// Both run once on their initial fetch.
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case name := <-fired:
+			got[name] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("managers did not run on the initial fetch")
+		}
+	}
+	if !got["attrs"] || !got["nics"] {
+		t.Fatalf("initial run got: %v, want both managers", got)
+	}
+
+	h.bump("instance/network-interfaces")
+	expect("nics")
+	expectNone()
+
+	h.bump("instance/attributes")
+	expect("attrs")
+	expectNone()
+}
@@ -0,0 +1,203 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
+	"github.com/go-ini/ini"
+)
+
+const winrmCertFriendlyName = "Google Compute Engine WinRM"
+
+var (
+	winrmDisabled     = true
+	winrmCertSchedule certSchedule
+)
+
+// winrmListener is the interface to the WinRM HTTPS listener.
+type winrmListener interface {
+	// thumbprint returns the certificate of the HTTPS listener, empty if
+	// there is none.
+	thumbprint() (string, error)
+	// configure creates or updates the HTTPS listener.
+	configure(thumbprint, hostname string, openFirewall bool) error
+}
+
+// psWinRMListener manages the listener with the WSMan PowerShell provider.
+type psWinRMListener struct{}
+
+const psWinRMHTTPS = `Get-ChildItem WSMan:\localhost\Listener | Where-Object { $_.Keys -contains 'Transport=HTTPS' } | Select-Object -First 1`
+
+func (psWinRMListener) thumbprint() (string, error) {
+	out, err := runPowershell(fmt.Sprintf(`$l = %s; if ($l) { (Get-Item (Join-Path $l.PSPath 'CertificateThumbprint')).Value }`, psWinRMHTTPS))
+	if err != nil {
+		return "", fmt.Errorf("error reading WinRM HTTPS listener: %v, output: %s", err, out)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func (psWinRMListener) configure(thumbprint, hostname string, openFirewall bool) error {
+	script := fmt.Sprintf(`Set-Service WinRM -StartupType Automatic
+Start-Service WinRM
+$s = @{Address='*';Transport='HTTPS'}
+$v = @{Hostname=%s;CertificateThumbprint=%s}
+if (%s) {
+  Set-WSManInstance -ResourceURI winrm/config/Listener -SelectorSet $s -ValueSet $v | Out-Null
+} else {
+  New-WSManInstance -ResourceURI winrm/config/Listener -SelectorSet $s -ValueSet $v | Out-Null
+}`, psQuote(hostname), psQuote(thumbprint), psWinRMHTTPS)
+	if openFirewall {
+		script += `
+if (-not (Get-NetFirewallRule -Name 'GCE-WinRM-HTTPS' -ErrorAction SilentlyContinue)) {
+  New-NetFirewallRule -Name 'GCE-WinRM-HTTPS' -DisplayName 'Windows Remote Management (HTTPS-In)' -Direction Inbound -Protocol TCP -LocalPort 5986 -Action Allow | Out-Null
+}`
+	}
+	if out, err := runPowershell(script); err != nil {
+		return fmt.Errorf("error configuring WinRM HTTPS listener: %v, output: %s", err, out)
+	}
+	return nil
+}
+
+// winrmListenerMgr is replaced in tests.
+var winrmListenerMgr winrmListener = psWinRMListener{}
+
+type winrm struct {
+	newMetadata, oldMetadata *metadataJSON
+	config                   *ini.File
+}
+
+func (w *winrm) diff() bool {
+	return w.newMetadata.Instance.Attributes.WinRMCertificate != w.oldMetadata.Instance.Attributes.WinRMCertificate ||
+		w.newMetadata.Project.Attributes.WinRMCertificate != w.oldMetadata.Project.Attributes.WinRMCertificate ||
+		winrmCertSchedule.due(time.Now())
+}
+
+func (w *winrm) metadataPaths() []string {
+	return attributePaths
+}
+
+func (w *winrm) disabled() (disabled bool) {
+	defer func() {
+		if disabled != winrmDisabled {
+			winrmDisabled = disabled
+			logStatus("WinRM", disabled)
+		}
+	}()
+
+	return !w.enablement().Enabled
+}
+
+var winrmEnable = enableRule{
+	section:   "winrm",
+	key:       "enable",
+	attribute: "enable-winrm-https",
+	value:     func(a attributesJSON) string { return a.EnableWinRMHTTPS },
+}
+
+// The WinRM HTTPS listener is opt-in and disabled by default.
+func (w *winrm) enablement() enablement {
+	return isEnabled(w.config, w.newMetadata, winrmEnable, !winrmDisabled)
+}
+
+// providedCert returns the winrm-certificate attribute, instance before
+// project.
+func (w *winrm) providedCert() string {
+	if c := w.newMetadata.Instance.Attributes.WinRMCertificate; c != "" {
+		return c
+	}
+	return w.newMetadata.Project.Attributes.WinRMCertificate
+}
+
+// plan returns the certificate changes set would make. A certificate from
+// metadata can't be told apart from the bound one before it is imported.
+func (w *winrm) plan() ([]string, error) {
+	_, renew, err := certValidity(w.config.Section("winrm"))
+	if err != nil {
+		return nil, err
+	}
+	if w.providedCert() != "" {
+		return []string{"import the winrm-certificate certificate and bind it to the WinRM HTTPS listener unless it is bound"}, nil
+	}
+	bound, err := winrmListenerMgr.thumbprint()
+	if err != nil {
+		return nil, err
+	}
+	return planCert(winrmCertFriendlyName, bound, renew)
+}
+
+// set configures the WinRM HTTPS listener with the certificate from the
+// winrm-certificate attribute, a base64 encoded PKCS #12 file without
+// password, or else with a self-signed certificate that is renewed
+// [winrm] renew_before_days before it expires. A failure is retried after a
+// backoff.
+func (w *winrm) set(ctx context.Context) (err error) {
+	defer func() {
+		if err != nil {
+			winrmCertSchedule.failed(time.Now())
+		}
+	}()
+	sec := w.config.Section("winrm")
+	validity, renew, err := certValidity(sec)
+	if err != nil {
+		return err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	// Off by default, so the listener isn't opened to every network the
+	// instance is on.
+	openFirewall, _ := sec.Key("open_firewall").Bool()
+	bind := func(thumbprint string) error {
+		return winrmListenerMgr.configure(thumbprint, hostname, openFirewall)
+	}
+	bound, err := winrmListenerMgr.thumbprint()
+	if err != nil {
+		return err
+	}
+
+	provided := w.providedCert()
+	if provided == "" {
+		_, err := ensureCert(winrmCertFriendlyName, bound, validity, renew, bind, &winrmCertSchedule)
+		return err
+	}
+
+	cert, err := certStoreMgr.importPFX(winrmCertFriendlyName, provided)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(cert.Thumbprint, bound) {
+		logger.Infof("Binding WinRM certificate %s from metadata", cert.Thumbprint)
+		if err := bind(cert.Thumbprint); err != nil {
+			return err
+		}
+	}
+	certs, err := certStoreMgr.list(winrmCertFriendlyName)
+	if err != nil {
+		return err
+	}
+	removeCertsExcept(certs, cert.Thumbprint)
+	if time.Now().After(cert.NotAfter.Add(-renew)) {
+		logger.Errorf("WinRM certificate %s from metadata expires at %s, replace winrm-certificate", cert.Thumbprint, cert.NotAfter.Format(time.RFC3339))
+	}
+	winrmCertSchedule.set(time.Now().Add(certRecheck))
+	return nil
+}
@@ -0,0 +1,118 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+type fakeWinRMListener struct {
+	bound        string
+	openFirewall bool
+}
+
+func (f *fakeWinRMListener) thumbprint() (string, error) {
+	return f.bound, nil
+}
+
+func (f *fakeWinRMListener) configure(thumbprint, hostname string, openFirewall bool) error {
+	f.bound, f.openFirewall = thumbprint, openFirewall
+	return nil
+}
+
+func TestWinRMSet(t *testing.T) {
+	oldStore, oldListener := certStoreMgr, winrmListenerMgr
+	defer func() {
+		certStoreMgr, winrmListenerMgr = oldStore, oldListener
+		winrmCertSchedule.set(time.Time{})
+	}()
+
+	valid := certJSON{Thumbprint: "OLD", NotAfter: time.Now().Add(100 * 24 * time.Hour)}
+	var tests = []struct {
+		name         string
+		data         string
+		certs        []certJSON
+		bound        string
+		provided     string
+		wantBound    string
+		wantFirewall bool
+		wantRemoved  []string
+	}{
+		{"self-signed", "", nil, "", "", "NEW0", false, nil},
+		{"self-signed bound", "", []certJSON{valid}, "OLD", "", "OLD", false, nil},
+		{"firewall rule", "[winrm]\nopen_firewall=true", nil, "", "", "NEW0", true, nil},
+		{"from metadata", "", []certJSON{valid}, "OLD", "cGZ4", "IMPORTED", false, []string{"OLD"}},
+	}
+
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		store := &fakeCertStore{certs: tt.certs}
+		listener := &fakeWinRMListener{bound: tt.bound}
+		certStoreMgr, winrmListenerMgr = store, listener
+
+		md := &metadataJSON{Project: projectJSON{Attributes: attributesJSON{WinRMCertificate: tt.provided}}}
+		if err := (&winrm{newMetadata: md, oldMetadata: &metadataJSON{}, config: cfg}).set(context.Background()); err != nil {
+			t.Fatalf("test case %q: set() returned error: %v", tt.name, err)
+		}
+		if listener.bound != tt.wantBound {
+			t.Errorf("test case %q: bound certificate got: %q, want: %q", tt.name, listener.bound, tt.wantBound)
+		}
+		if listener.openFirewall != tt.wantFirewall {
+			t.Errorf("test case %q: firewall opened: %t, want: %t", tt.name, listener.openFirewall, tt.wantFirewall)
+		}
+		if !reflect.DeepEqual(store.removed, tt.wantRemoved) {
+			t.Errorf("test case %q: removed got: %q, want: %q", tt.name, store.removed, tt.wantRemoved)
+		}
+		if winrmCertSchedule.due(time.Now()) {
+			t.Errorf("test case %q: next certificate check not scheduled", tt.name)
+		}
+	}
+}
+
+func TestWinRMDiff(t *testing.T) {
+	defer winrmCertSchedule.set(time.Time{})
+	winrmCertSchedule.set(time.Now().Add(time.Hour))
+
+	var tests = []struct {
+		name     string
+		old, new string
+		want     bool
+	}{
+		{"unchanged", "a", "a", false},
+		{"certificate changed", "a", "b", true},
+	}
+	for _, tt := range tests {
+		w := &winrm{
+			newMetadata: &metadataJSON{Instance: instanceJSON{Attributes: attributesJSON{WinRMCertificate: tt.new}}},
+			oldMetadata: &metadataJSON{Instance: instanceJSON{Attributes: attributesJSON{WinRMCertificate: tt.old}}},
+		}
+		if got := w.diff(); got != tt.want {
+			t.Errorf("test case %q: diff() got: %t, want: %t", tt.name, got, tt.want)
+		}
+	}
+
+	winrmCertSchedule.set(time.Now().Add(-time.Minute))
+	if !(&winrm{newMetadata: &metadataJSON{}, oldMetadata: &metadataJSON{}}).diff() {
+		t.Error("diff() with a certificate check due got: false, want: true")
+	}
+}
@@ -15,10 +15,16 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/GoogleCloudPlatform/compute-image-windows/logger"
@@ -38,12 +44,78 @@ const (
 var (
 	once          sync.Once
 	agentInstance *wsfcAgent
+
+	// wsfcDrainSleep is replaced in tests.
+	wsfcDrainSleep = sleepCtx
 )
 
 type wsfcManager struct {
 	agentNewState agentState
 	agentNewPort  string
-	agent         healthAgent
+	agentNewTLS   wsfcTLS
+	// agentNewNetwork is "tcp" for dual-stack, "tcp4" or "tcp6".
+	agentNewNetwork string
+	// agentNewDraining is set once the instance got a termination notice.
+	agentNewDraining bool
+	// drainPeriod is how long teardown drains a running agent.
+	drainPeriod time.Duration
+	agent       healthAgent
+}
+
+// wsfcNetwork returns the network the agent listens on from [wsfc]
+// ip_version: any, the default, listens dual-stack, ipv4 or ipv6 on one
+// family only.
+func wsfcNetwork(config *ini.File) string {
+	switch v := config.Section("wsfc").Key("ip_version").String(); v {
+	case "", "any":
+		return "tcp"
+	case "ipv4":
+		return "tcp4"
+	case "ipv6":
+		return "tcp6"
+	default:
+		logger.Errorf("Invalid wsfc ip_version %q, using any", v)
+		return "tcp"
+	}
+}
+
+// wsfcDrainPeriod is how long the agent answers health checks as unhealthy
+// before it stops, zero if draining is off.
+func wsfcDrainPeriod(config *ini.File) time.Duration {
+	return time.Duration(config.Section("wsfc").Key("drain_sec").MustInt(0)) * time.Second
+}
+
+// wsfcTLS are the PEM files the agent serves health checks over TLS with.
+// TLS is off without a certificate, clients must present a certificate
+// signed by clientCAFile if set.
+type wsfcTLS struct {
+	certFile, keyFile, clientCAFile string
+}
+
+func (t wsfcTLS) enabled() bool {
+	return t.certFile != ""
+}
+
+// config loads the files into a TLS server config.
+func (t wsfcTLS) config() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading wsfc agent certificate: %v", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if t.clientCAFile != "" {
+		data, err := ioutil.ReadFile(t.clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading wsfc agent client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", t.clientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
 }
 
 // Create new wsfcManager based on metadata agent request state will be set to
@@ -68,6 +140,7 @@ func newWsfcManager(newMetadata *metadataJSON, config *ini.File) *wsfcManager {
 		}
 	}
 
+	// The port is a comma separated list of "address:port" or "port" bindings.
 	newPort := wsfcDefaultAgentPort
 	port := config.Section("wsfc").Key("port").String()
 	if len(port) > 0 {
@@ -75,15 +148,35 @@ func newWsfcManager(newMetadata *metadataJSON, config *ini.File) *wsfcManager {
 	} else if len(newMetadata.Instance.Attributes.WSFCAgentPort) > 0 {
 		newPort = newMetadata.Instance.Attributes.WSFCAgentPort
 	} else if len(newMetadata.Project.Attributes.WSFCAgentPort) > 0 {
-		newPort = newMetadata.Instance.Attributes.WSFCAgentPort
+		newPort = newMetadata.Project.Attributes.WSFCAgentPort
+	}
+
+	// Certificates are local files, so TLS is only configurable locally.
+	newTLS := wsfcTLS{
+		certFile:     config.Section("wsfc").Key("tls_cert_file").String(),
+		keyFile:      config.Section("wsfc").Key("tls_key_file").String(),
+		clientCAFile: config.Section("wsfc").Key("tls_client_ca_file").String(),
 	}
 
-	return &wsfcManager{agentNewState: newState, agentNewPort: newPort, agent: getWsfcAgentInstance()}
+	// The termination handler always drains the responder on the notice.
+	drain := wsfcDrainPeriod(config)
+	newDraining := (drain > 0 || terminationEnabled(config)) && newMetadata.Instance.terminating()
+
+	return &wsfcManager{agentNewState: newState, agentNewPort: newPort, agentNewTLS: newTLS, agentNewNetwork: wsfcNetwork(config), agentNewDraining: newDraining, drainPeriod: drain, agent: getWsfcAgentInstance()}
 }
 
-// Implement manager.diff()
+// Implement manager.diff(). Bindings that failed to listen are retried until
+// they succeed.
 func (m *wsfcManager) diff() bool {
-	return m.agentNewState != m.agent.getState() || m.agentNewPort != m.agent.getPort()
+	return m.agentNewState != m.agent.getState() || m.agentNewPort != m.agent.getPort() || m.agentNewTLS != m.agent.getTLS() ||
+		m.agentNewNetwork != m.agent.getNetwork() ||
+		m.agentNewDraining != m.agent.isDraining() ||
+		(m.agentNewState == running && m.agent.hasUnbound())
+}
+
+// Implement manager.metadataPaths().
+func (m *wsfcManager) metadataPaths() []string {
+	return append([]string{"instance/preempted", "instance/maintenance-event"}, attributePaths...)
 }
 
 // Implement manager.disabled().
@@ -93,11 +186,21 @@ func (m *wsfcManager) disabled() bool {
 	return false
 }
 
+func (m *wsfcManager) enablement() enablement {
+	return enablement{Enabled: true, Source: sourceDefault}
+}
+
 // Diff will always be called before set. So in set, only two cases are possible:
 // - state changed: start or stop the wsfc agent accordingly
-// - port changed: restart the agent if it is running
-func (m *wsfcManager) set() error {
+// - port changed: update the listeners if the agent is running
+// - TLS or network changed: restart the agent if it is running
+// - a binding has no listener: retry it if the agent is running
+func (m *wsfcManager) set(ctx context.Context) error {
+	restart := m.agentNewTLS != m.agent.getTLS() || m.agentNewNetwork != m.agent.getNetwork()
 	m.agent.setPort(m.agentNewPort)
+	m.agent.setTLS(m.agentNewTLS)
+	m.agent.setNetwork(m.agentNewNetwork)
+	m.agent.setDraining(m.agentNewDraining)
 
 	// if state changes
 	if m.agentNewState != m.agent.getState() {
@@ -108,16 +211,58 @@ func (m *wsfcManager) set() error {
 		return m.agent.stop()
 	}
 
-	// If port changed
-	if m.agent.getState() == running {
+	if m.agent.getState() != running {
+		return nil
+	}
+
+	// If TLS or the network changed every listener restarts
+	if restart {
 		if err := m.agent.stop(); err != nil {
 			return err
 		}
-
 		return m.agent.run()
 	}
 
-	return nil
+	// If port changed only the listeners of changed or failed bindings start
+	return m.agent.run()
+}
+
+// plan returns the changes set would make to the agent.
+func (m *wsfcManager) plan() ([]string, error) {
+	var changes []string
+	state := m.agent.getState()
+	switch {
+	case m.agentNewState == stopped && state == running:
+		changes = append(changes, "stop the wsfc agent")
+	case m.agentNewState == running && state == stopped:
+		changes = append(changes, fmt.Sprintf("start the wsfc agent on %s", m.agentNewPort))
+	case m.agentNewState == running && (m.agentNewTLS != m.agent.getTLS() || m.agentNewNetwork != m.agent.getNetwork()):
+		changes = append(changes, fmt.Sprintf("restart the wsfc agent on %s", m.agentNewPort))
+	case m.agentNewState == running && m.agentNewPort != m.agent.getPort():
+		changes = append(changes, fmt.Sprintf("move the wsfc agent from %s to %s", m.agent.getPort(), m.agentNewPort))
+	case m.agentNewState == running && m.agent.hasUnbound():
+		changes = append(changes, fmt.Sprintf("retry the wsfc agent bindings of %s that failed to listen", m.agentNewPort))
+	}
+	if m.agentNewDraining && !m.agent.isDraining() {
+		changes = append(changes, "answer wsfc health checks as unhealthy")
+	}
+	return changes, nil
+}
+
+// teardown stops the agent when the service stops. A running agent first
+// answers health checks as unhealthy for the drain period, so load balancers
+// steer traffic away before the listeners close. An agent already draining
+// on a termination notice stops right away.
+func (m *wsfcManager) teardown(ctx context.Context) error {
+	if m.agent.getState() != running {
+		return nil
+	}
+	if m.drainPeriod > 0 && !m.agent.isDraining() {
+		m.agent.setDraining(true)
+		logger.Infof("Draining wsfc agent for %s before stopping.", m.drainPeriod)
+		wsfcDrainSleep(ctx, m.drainPeriod)
+	}
+	return m.agent.stop()
 }
 
 // interface for agent answering health check ping
@@ -125,43 +270,139 @@ type healthAgent interface {
 	getState() agentState
 	getPort() string
 	setPort(string)
+	getTLS() wsfcTLS
+	setTLS(wsfcTLS)
+	getNetwork() string
+	setNetwork(string)
+	isDraining() bool
+	setDraining(bool)
+	// hasUnbound reports whether a binding of the port has no listener.
+	hasUnbound() bool
 	run() error
 	stop() error
 }
 
 // Windows failover cluster agent, implements healthAgent interface
 type wsfcAgent struct {
-	port      string
+	// port is the comma separated list of bindings, see parseWSFCBindings.
+	port    string
+	tls     wsfcTLS
+	network string
+	// draining is nonzero while health checks are answered as unhealthy.
+	draining  int32
 	waitGroup *sync.WaitGroup
-	listener  *net.TCPListener
+	// listeners are the open listeners by binding.
+	listeners map[string]*net.TCPListener
 }
 
-// Start agent and taking tcp request
-func (a *wsfcAgent) run() error {
-	if a.getState() == running {
-		logger.Infoln("wsfc agent is already running")
-		return nil
+// parseWSFCBindings parses a comma separated list of "address:port" or "port"
+// bindings, a port alone listens on all addresses.
+func parseWSFCBindings(s string) ([]string, error) {
+	var bindings []string
+	for _, b := range strings.Split(s, ",") {
+		b = strings.TrimSpace(b)
+		if b == "" {
+			continue
+		}
+		if !strings.Contains(b, ":") {
+			b = ":" + b
+		}
+		host, port, err := net.SplitHostPort(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid wsfc agent binding %q: %v", b, err)
+		}
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("invalid wsfc agent port %q", port)
+		}
+		if host != "" && net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("invalid wsfc agent address %q", host)
+		}
+		if b = net.JoinHostPort(host, port); !containsString(b, bindings) {
+			bindings = append(bindings, b)
+		}
 	}
+	if len(bindings) == 0 {
+		return nil, fmt.Errorf("no wsfc agent bindings in %q", s)
+	}
+	return bindings, nil
+}
 
-	logger.Info("Starting wsfc agent...")
-	listenerAddr, err := net.ResolveTCPAddr("tcp", ":"+a.port)
+// Start a listener for every binding that has none and close the listeners of
+// bindings that are no longer configured. Other listeners keep running.
+func (a *wsfcAgent) run() error {
+	bindings, err := parseWSFCBindings(a.port)
 	if err != nil {
 		return err
 	}
 
-	listener, err := net.ListenTCP("tcp", listenerAddr)
+	var tlsConfig *tls.Config
+	if a.tls.enabled() {
+		if tlsConfig, err = a.tls.config(); err != nil {
+			return err
+		}
+	}
+
+	if a.listeners == nil {
+		a.listeners = make(map[string]*net.TCPListener)
+	}
+	for b, listener := range a.listeners {
+		if !containsString(b, bindings) {
+			logger.Infoln("wsfc agent - closing listener on", b)
+			if err := listener.Close(); err != nil {
+				logger.Errorln("wsfc agent - error closing listener:", err)
+			}
+			delete(a.listeners, b)
+		}
+	}
+
+	var firstErr error
+	for _, b := range bindings {
+		if _, ok := a.listeners[b]; ok {
+			continue
+		}
+		listener, err := a.listen(b, tlsConfig)
+		if err != nil {
+			logger.Errorf("wsfc agent - error listening on %s: %v", b, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		a.listeners[b] = listener
+	}
+	return firstErr
+}
+
+// listen starts taking tcp requests on binding.
+func (a *wsfcAgent) listen(binding string, tlsConfig *tls.Config) (*net.TCPListener, error) {
+	network := a.network
+	if network == "" {
+		network = "tcp"
+	}
+	listenerAddr, err := net.ResolveTCPAddr(network, binding)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	listener, err := net.ListenTCP(network, listenerAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Closing listener also closes the TLS listener wrapping it.
+	var l net.Listener = listener
+	if tlsConfig != nil {
+		l = tls.NewListener(listener, tlsConfig)
 	}
 
 	// goroutine for handling request
 	go func() {
 		for {
-			conn, err := listener.Accept()
+			conn, err := l.Accept()
 			if err != nil {
 				// if err is not due to listener closed, return
 				if opErr, ok := err.(*net.OpError); ok && strings.Contains(opErr.Error(), "closed") {
-					logger.Info("wsfc agent - tcp listener closed.")
+					logger.Infoln("wsfc agent - tcp listener closed on", binding)
 					return
 				}
 
@@ -173,10 +414,12 @@ func (a *wsfcAgent) run() error {
 		}
 	}()
 
-	logger.Infoln("wsfc agent stared. Listening on port:", a.port)
-	a.listener = listener
-
-	return nil
+	if tlsConfig != nil {
+		logger.Infoln("wsfc agent stared. Listening with TLS on:", binding)
+	} else {
+		logger.Infoln("wsfc agent stared. Listening on:", binding)
+	}
+	return listener, nil
 }
 
 // Handle health check request.
@@ -200,7 +443,12 @@ func (a *wsfcAgent) handleHealthCheckRequest(conn net.Conn) {
 	if err != nil {
 		logger.Errorln("wsfc - error on checking local ip:", err)
 	}
-	conn.Write([]byte(reply))
+	if a.isDraining() {
+		reply = "0"
+	}
+	if _, err := conn.Write([]byte(reply)); err == nil {
+		wsfcProbes.inc(reply)
+	}
 }
 
 // Stop agent. Will wait for all existing request to be completed.
@@ -211,25 +459,45 @@ func (a *wsfcAgent) stop() error {
 	}
 
 	logger.Info("Stopping wsfc agent...")
-	// close listener first to avoid taking additional request
-	err := a.listener.Close()
+	// close listeners first to avoid taking additional request
+	var err error
+	for b, listener := range a.listeners {
+		if closeErr := listener.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+		delete(a.listeners, b)
+	}
 	// wait for exiting request to finish
 	a.waitGroup.Wait()
-	a.listener = nil
 	logger.Info("wsfc agent stopped.")
 	return err
 }
 
 // Get the current state of the agent. If there is a valid listener,
-// return state running and if listener is nil, return stopped
+// return state running and if there are none, return stopped
 func (a *wsfcAgent) getState() agentState {
-	if a.listener != nil {
+	if len(a.listeners) != 0 {
 		return running
 	}
 
 	return stopped
 }
 
+// hasUnbound reports whether a valid binding of the port failed to listen, an
+// invalid port can't be retried.
+func (a *wsfcAgent) hasUnbound() bool {
+	bindings, err := parseWSFCBindings(a.port)
+	if err != nil {
+		return false
+	}
+	for _, b := range bindings {
+		if _, ok := a.listeners[b]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (a *wsfcAgent) getPort() string {
 	return a.port
 }
@@ -241,21 +509,66 @@ func (a *wsfcAgent) setPort(newPort string) {
 	}
 }
 
+func (a *wsfcAgent) getTLS() wsfcTLS {
+	return a.tls
+}
+
+func (a *wsfcAgent) setTLS(newTLS wsfcTLS) {
+	if newTLS != a.tls {
+		logger.Infof("update wsfc agent TLS certificate from %q to %q", a.tls.certFile, newTLS.certFile)
+		a.tls = newTLS
+	}
+}
+
+func (a *wsfcAgent) getNetwork() string {
+	return a.network
+}
+
+func (a *wsfcAgent) setNetwork(newNetwork string) {
+	if newNetwork != a.network {
+		logger.Infof("update wsfc agent network from %q to %q", a.network, newNetwork)
+		a.network = newNetwork
+	}
+}
+
+func (a *wsfcAgent) isDraining() bool {
+	return atomic.LoadInt32(&a.draining) != 0
+}
+
+func (a *wsfcAgent) setDraining(draining bool) {
+	if draining == a.isDraining() {
+		return
+	}
+	var v int32
+	if draining {
+		logger.Info("wsfc agent draining, answering health checks as unhealthy.")
+		v = 1
+	}
+	atomic.StoreInt32(&a.draining, v)
+}
+
 // Create wsfc agent only once
 func getWsfcAgentInstance() *wsfcAgent {
 	once.Do(func() {
 		agentInstance = &wsfcAgent{
 			port:      wsfcDefaultAgentPort,
+			network:   "tcp",
 			waitGroup: &sync.WaitGroup{},
-			listener:  nil,
+			listeners: make(map[string]*net.TCPListener),
 		}
 	})
 
 	return agentInstance
 }
 
-// help func to check whether the ip exists on local host.
+// help func to check whether the ip exists on local host. IPv4 and IPv6
+// addresses are compared in any form.
 func checkIPExist(ip string) (string, error) {
+	want := net.ParseIP(ip)
+	if want == nil {
+		return "0", nil
+	}
+
 	addrs, err := net.InterfaceAddrs()
 	if err != nil {
 		return "0", err
@@ -263,8 +576,7 @@ func checkIPExist(ip string) (string, error) {
 
 	for _, address := range addrs {
 		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			ipString := ipnet.IP.To4().String()
-			if ip == ipString {
+			if ipnet.IP.Equal(want) {
 				return "1", nil
 			}
 		}
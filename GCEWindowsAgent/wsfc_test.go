@@ -16,11 +16,26 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/go-ini/ini"
 )
@@ -55,10 +70,10 @@ func TestNewWsfcManager(t *testing.T) {
 		args args
 		want *wsfcManager
 	}{
-		{"empty meta config", args{&testMetadata}, &wsfcManager{agentNewState: stopped, agentNewPort: wsfcDefaultAgentPort, agent: testAgent}},
-		{"wsfc enabled", args{setEnableWSFC(testMetadata, "true")}, &wsfcManager{agentNewState: running, agentNewPort: wsfcDefaultAgentPort, agent: testAgent}},
-		{"wsfc addrs is set", args{setWSFCAddresses(testMetadata, "0.0.0.0")}, &wsfcManager{agentNewState: running, agentNewPort: wsfcDefaultAgentPort, agent: testAgent}},
-		{"wsfc port is set", args{setWSFCAgentPort(testMetadata, "1818")}, &wsfcManager{agentNewState: stopped, agentNewPort: "1818", agent: testAgent}},
+		{"empty meta config", args{&testMetadata}, &wsfcManager{agentNewState: stopped, agentNewPort: wsfcDefaultAgentPort, agentNewNetwork: "tcp", agent: testAgent}},
+		{"wsfc enabled", args{setEnableWSFC(testMetadata, "true")}, &wsfcManager{agentNewState: running, agentNewPort: wsfcDefaultAgentPort, agentNewNetwork: "tcp", agent: testAgent}},
+		{"wsfc addrs is set", args{setWSFCAddresses(testMetadata, "0.0.0.0")}, &wsfcManager{agentNewState: running, agentNewPort: wsfcDefaultAgentPort, agentNewNetwork: "tcp", agent: testAgent}},
+		{"wsfc port is set", args{setWSFCAgentPort(testMetadata, "1818")}, &wsfcManager{agentNewState: stopped, agentNewPort: "1818", agentNewNetwork: "tcp", agent: testAgent}},
 	}
 	for _, tt := range tests {
 		if got := newWsfcManager(tt.args.newMetadata, ini.Empty()); !reflect.DeepEqual(got, tt.want) {
@@ -73,11 +88,15 @@ func TestWsfcManagerDiff(t *testing.T) {
 		m    *wsfcManager
 		want bool
 	}{
-		{"state change from stop to running", &wsfcManager{agentNewState: running, agent: &wsfcAgent{listener: nil}}, true},
-		{"state change from running to stop", &wsfcManager{agentNewState: stopped, agent: &wsfcAgent{listener: testListener}}, true},
+		{"state change from stop to running", &wsfcManager{agentNewState: running, agent: &wsfcAgent{}}, true},
+		{"state change from running to stop", &wsfcManager{agentNewState: stopped, agent: &wsfcAgent{listeners: map[string]*net.TCPListener{":" + wsfcDefaultAgentPort: testListener}}}, true},
 		{"port changed", &wsfcManager{agentNewPort: "1818", agent: &wsfcAgent{port: wsfcDefaultAgentPort}}, true},
-		{"state does not change both running", &wsfcManager{agentNewState: running, agent: &wsfcAgent{listener: testListener}}, false},
-		{"state does not change both stopped", &wsfcManager{agentNewState: stopped, agent: &wsfcAgent{listener: nil}}, false},
+		{"TLS changed", &wsfcManager{agentNewTLS: wsfcTLS{certFile: "cert", keyFile: "key"}, agent: &wsfcAgent{}}, true},
+		{"state does not change both running", &wsfcManager{agentNewState: running, agent: &wsfcAgent{listeners: map[string]*net.TCPListener{":" + wsfcDefaultAgentPort: testListener}}}, false},
+		{"state does not change both stopped", &wsfcManager{agentNewState: stopped, agent: &wsfcAgent{}}, false},
+		{"draining", &wsfcManager{agentNewDraining: true, agent: &wsfcAgent{}}, true},
+		{"binding failed", &wsfcManager{agentNewState: running, agentNewPort: "1,2", agent: &wsfcAgent{port: "1,2", listeners: map[string]*net.TCPListener{":1": testListener}}}, true},
+		{"all bindings listening", &wsfcManager{agentNewState: running, agentNewPort: "1,2", agent: &wsfcAgent{port: "1,2", listeners: map[string]*net.TCPListener{":1": testListener, ":2": testListener}}}, false},
 	}
 	for _, tt := range tests {
 		if got := tt.m.diff(); got != tt.want {
@@ -100,6 +119,10 @@ func TestWsfcManagerDisabled(t *testing.T) {
 type mockAgent struct {
 	state       agentState
 	port        string
+	tls         wsfcTLS
+	network     string
+	draining    bool
+	unbound     bool
 	runError    bool
 	stopError   bool
 	runInvoked  bool
@@ -118,6 +141,34 @@ func (a *mockAgent) setPort(newPort string) {
 	a.port = newPort
 }
 
+func (a *mockAgent) getTLS() wsfcTLS {
+	return a.tls
+}
+
+func (a *mockAgent) setTLS(newTLS wsfcTLS) {
+	a.tls = newTLS
+}
+
+func (a *mockAgent) getNetwork() string {
+	return a.network
+}
+
+func (a *mockAgent) setNetwork(network string) {
+	a.network = network
+}
+
+func (a *mockAgent) isDraining() bool {
+	return a.draining
+}
+
+func (a *mockAgent) setDraining(draining bool) {
+	a.draining = draining
+}
+
+func (a *mockAgent) hasUnbound() bool {
+	return a.unbound
+}
+
 func (a *mockAgent) run() error {
 	a.runInvoked = true
 	if a.runError {
@@ -150,27 +201,58 @@ func TestWsfcManagerSet(t *testing.T) {
 		{"set start agent error", &wsfcManager{agentNewState: running, agent: &mockAgent{state: stopped, runError: true}}, true, true, false},
 		{"set stop agent", &wsfcManager{agentNewState: stopped, agent: &mockAgent{state: running}}, false, false, true},
 		{"set stop agent error", &wsfcManager{agentNewState: stopped, agent: &mockAgent{state: running, stopError: true}}, true, false, true},
-		{"set restart agent", &wsfcManager{agentNewState: running, agentNewPort: "1", agent: &mockAgent{state: running, port: "0"}}, false, true, true},
-		{"set restart agent stop error", &wsfcManager{agentNewState: running, agentNewPort: "1", agent: &mockAgent{state: running, port: "0", stopError: true}}, true, false, true},
-		{"set restart agent start error", &wsfcManager{agentNewState: running, agentNewPort: "1", agent: &mockAgent{state: running, port: "0", runError: true}}, true, true, true},
+		{"set rebind agent", &wsfcManager{agentNewState: running, agentNewPort: "1", agent: &mockAgent{state: running, port: "0"}}, false, true, false},
+		{"set rebind agent error", &wsfcManager{agentNewState: running, agentNewPort: "1", agent: &mockAgent{state: running, port: "0", runError: true}}, true, true, false},
+		{"set restart agent stop error", &wsfcManager{agentNewState: running, agentNewTLS: wsfcTLS{certFile: "cert"}, agent: &mockAgent{state: running, stopError: true}}, true, false, true},
+		{"set restart agent start error", &wsfcManager{agentNewState: running, agentNewTLS: wsfcTLS{certFile: "cert"}, agent: &mockAgent{state: running, runError: true}}, true, true, true},
+		{"set restart agent on TLS change", &wsfcManager{agentNewState: running, agentNewTLS: wsfcTLS{certFile: "cert"}, agent: &mockAgent{state: running}}, false, true, true},
+		{"set retry failed binding", &wsfcManager{agentNewState: running, agentNewPort: "1,2", agent: &mockAgent{state: running, port: "1,2", unbound: true}}, false, true, false},
 		{"set do nothing", &wsfcManager{agentNewState: stopped, agentNewPort: "1", agent: &mockAgent{state: stopped, port: "0"}}, false, false, false},
 	}
 	for _, tt := range tests {
-		if err := tt.m.set(); (err != nil) != tt.wantErr {
-			t.Errorf("wsfcManager.set() error = %v, wantErr %v", err, tt.wantErr)
+		if err := tt.m.set(context.Background()); (err != nil) != tt.wantErr {
+			t.Errorf("wsfcManager.set(context.Background()) error = %v, wantErr %v", err, tt.wantErr)
 		}
 
 		mAgent := tt.m.agent.(*mockAgent)
 		if gotRunInvoked := mAgent.runInvoked; gotRunInvoked != tt.runInvoked {
-			t.Errorf("wsfcManager.set() runInvoked = %v, want %v", gotRunInvoked, tt.runInvoked)
+			t.Errorf("wsfcManager.set(context.Background()) runInvoked = %v, want %v", gotRunInvoked, tt.runInvoked)
 		}
 
 		if gotStopInvoked := mAgent.stopInvoked; gotStopInvoked != tt.stopInvoked {
-			t.Errorf("wsfcManager.set() stopInvoked = %v, want %v", gotStopInvoked, tt.stopInvoked)
+			t.Errorf("wsfcManager.set(context.Background()) stopInvoked = %v, want %v", gotStopInvoked, tt.stopInvoked)
 		}
 
 		if tt.m.agentNewPort != mAgent.port {
-			t.Errorf("wsfcManager.set() does not set prot, agent port = %v, want %v", mAgent.port, tt.m.agentNewPort)
+			t.Errorf("wsfcManager.set(context.Background()) does not set prot, agent port = %v, want %v", mAgent.port, tt.m.agentNewPort)
+		}
+	}
+}
+
+func TestWsfcManagerPlan(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *wsfcManager
+		want []string
+	}{
+		{"start", &wsfcManager{agentNewState: running, agentNewPort: "1", agent: &mockAgent{state: stopped}}, []string{"start the wsfc agent on 1"}},
+		{"stop", &wsfcManager{agentNewState: stopped, agent: &mockAgent{state: running}}, []string{"stop the wsfc agent"}},
+		{"restart on TLS change", &wsfcManager{agentNewState: running, agentNewPort: "1", agentNewTLS: wsfcTLS{certFile: "cert"}, agent: &mockAgent{state: running, port: "1"}}, []string{"restart the wsfc agent on 1"}},
+		{"port change", &wsfcManager{agentNewState: running, agentNewPort: "2", agent: &mockAgent{state: running, port: "1"}}, []string{"move the wsfc agent from 1 to 2"}},
+		{"failed binding", &wsfcManager{agentNewState: running, agentNewPort: "1,2", agent: &mockAgent{state: running, port: "1,2", unbound: true}}, []string{"retry the wsfc agent bindings of 1,2 that failed to listen"}},
+		{"draining", &wsfcManager{agentNewState: running, agentNewPort: "1", agentNewDraining: true, agent: &mockAgent{state: running, port: "1"}}, []string{"answer wsfc health checks as unhealthy"}},
+		{"no changes", &wsfcManager{agentNewState: running, agentNewPort: "1", agent: &mockAgent{state: running, port: "1"}}, nil},
+	}
+	for _, tt := range tests {
+		got, err := tt.m.plan()
+		if err != nil {
+			t.Fatalf("test case %q: plan() returned error: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("test case %q: plan() got: %q, want: %q", tt.name, got, tt.want)
+		}
+		if mAgent := tt.m.agent.(*mockAgent); mAgent.runInvoked || mAgent.stopInvoked {
+			t.Errorf("test case %q: plan() changed the agent", tt.name)
 		}
 	}
 }
@@ -190,7 +272,7 @@ func getHealthCheckResponce(request string, agent healthAgent) (string, error) {
 func TestWsfcRunAgentE2E(t *testing.T) {
 
 	wsfcMgr := &wsfcManager{agentNewState: running, agentNewPort: wsfcDefaultAgentPort, agent: getWsfcAgentInstance()}
-	wsfcMgr.set()
+	wsfcMgr.set(context.Background())
 
 	// make sure the agent is cleaned up.
 	defer wsfcMgr.agent.stop()
@@ -228,14 +310,14 @@ func TestWsfcRunAgentE2E(t *testing.T) {
 
 	// test stop agent
 	wsfcMgrStop := &wsfcManager{agentNewState: stopped, agent: getWsfcAgentInstance()}
-	wsfcMgrStop.set()
+	wsfcMgrStop.set(context.Background())
 	if _, err := getHealthCheckResponce(existIP, wsfcMgr.agent); err == nil {
 		t.Errorf("health check still running after calling stop")
 	}
 }
 
 func TestInvokeRunOnRunningWsfcAgent(t *testing.T) {
-	agent := &wsfcAgent{listener: testListener}
+	agent := &wsfcAgent{port: wsfcDefaultAgentPort, listeners: map[string]*net.TCPListener{":" + wsfcDefaultAgentPort: testListener}}
 
 	if err := agent.run(); err != nil {
 		t.Errorf("Invoke run on running agent, error = %v, want = %v", err, nil)
@@ -243,7 +325,7 @@ func TestInvokeRunOnRunningWsfcAgent(t *testing.T) {
 }
 
 func TestInvokeStopOnStoppedWsfcAgent(t *testing.T) {
-	agent := &wsfcAgent{listener: nil}
+	agent := &wsfcAgent{}
 
 	if err := agent.stop(); err != nil {
 		t.Errorf("Invoke stop on stopped agent, error = %v, want = %v", err, nil)
@@ -260,6 +342,218 @@ func TestWsfcAgentSetPort(t *testing.T) {
 	}
 }
 
+func TestParseWSFCBindings(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"59998", []string{":59998"}, false},
+		{"59998, 10.0.0.5:59999,59998", []string{":59998", "10.0.0.5:59999"}, false},
+		{"[fd00::5]:59998", []string{"[fd00::5]:59998"}, false},
+		{"", nil, true},
+		{"0", nil, true},
+		{"port", nil, true},
+		{"host:59998", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseWSFCBindings(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseWSFCBindings(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseWSFCBindings(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestWsfcAgentMultipleBindings(t *testing.T) {
+	agent := &wsfcAgent{port: "59995,127.0.0.1:59996", waitGroup: &sync.WaitGroup{}, listeners: map[string]*net.TCPListener{}}
+	if err := agent.run(); err != nil {
+		t.Fatal(err)
+	}
+	defer agent.stop()
+
+	for _, port := range []string{"59995", "59996"} {
+		if got, err := getHealthCheckResponce("255.255.255.256", &wsfcAgent{port: port}); got != "0" {
+			t.Errorf("health check on port %s got = %v, want %v, error: %v", port, got, "0", err)
+		}
+	}
+
+	// Dropping a binding only closes its listener.
+	kept := agent.listeners[":59995"]
+	agent.setPort("59995")
+	if err := agent.run(); err != nil {
+		t.Fatal(err)
+	}
+	if agent.listeners[":59995"] != kept {
+		t.Error("listener of an unchanged binding was restarted")
+	}
+	if _, err := getHealthCheckResponce("255.255.255.256", &wsfcAgent{port: "59996"}); err == nil {
+		t.Error("health check still answered on a removed binding")
+	}
+}
+
+func TestWsfcAgentRetryBinding(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:59994")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agent := &wsfcAgent{port: "127.0.0.1:59993,127.0.0.1:59994", network: "tcp", waitGroup: &sync.WaitGroup{}, listeners: map[string]*net.TCPListener{}}
+	defer agent.stop()
+	m := &wsfcManager{agentNewState: running, agentNewPort: agent.port, agentNewNetwork: "tcp", agent: agent}
+
+	if err := m.set(context.Background()); err == nil {
+		t.Error("set() with a port in use returned no error")
+	}
+	if !m.diff() {
+		t.Error("diff() is false with a binding that failed to listen")
+	}
+
+	busy.Close()
+	if err := m.set(context.Background()); err != nil {
+		t.Fatalf("set() returned error: %v", err)
+	}
+	if m.diff() {
+		t.Error("diff() is true with every binding listening")
+	}
+}
+
+func TestNewWsfcManagerDraining(t *testing.T) {
+	cfg, err := ini.InsensitiveLoad([]byte("[wsfc]\ndrain_sec=10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		cfg  *ini.File
+		md   metadataJSON
+		want bool
+	}{
+		{"running", cfg, metadataJSON{}, false},
+		{"preempted", cfg, metadataJSON{Instance: instanceJSON{Preempted: "TRUE"}}, true},
+		{"host maintenance", cfg, metadataJSON{Instance: instanceJSON{MaintenanceEvent: "TERMINATE_ON_HOST_MAINTENANCE"}}, true},
+		{"live migration", cfg, metadataJSON{Instance: instanceJSON{MaintenanceEvent: "MIGRATE_ON_HOST_MAINTENANCE"}}, false},
+		{"drain off", ini.Empty(), metadataJSON{Instance: instanceJSON{Preempted: "TRUE"}}, false},
+	}
+	for _, tt := range tests {
+		if got := newWsfcManager(&tt.md, tt.cfg).agentNewDraining; got != tt.want {
+			t.Errorf("test case %q: agentNewDraining = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWsfcManagerTeardown(t *testing.T) {
+	oldSleep := wsfcDrainSleep
+	defer func() { wsfcDrainSleep = oldSleep }()
+
+	var existIP string
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() && ipnet.IP.To4() != nil {
+			existIP = ipnet.IP.String()
+			break
+		}
+	}
+
+	var tests = []struct {
+		name      string
+		data      string
+		wantSlept time.Duration
+	}{
+		{"drain", "[wsfc]\ndrain_sec=10", 10 * time.Second},
+		{"no drain", "", 0},
+	}
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		agent := getWsfcAgentInstance()
+		agent.setPort("59994")
+		if err := agent.run(); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := getHealthCheckResponce(existIP, agent); existIP != "" && got != "1" {
+			t.Errorf("test case %q: health check before teardown got = %v, want %v", tt.name, got, "1")
+		}
+
+		var slept time.Duration
+		wsfcDrainSleep = func(ctx context.Context, d time.Duration) bool {
+			slept = d
+			// Health checks fail while draining.
+			if got, err := getHealthCheckResponce(existIP, agent); got != "0" {
+				t.Errorf("test case %q: health check while draining got = %v, want %v, error: %v", tt.name, got, "0", err)
+			}
+			return true
+		}
+		if err := newWsfcManager(&metadataJSON{}, cfg).teardown(context.Background()); err != nil {
+			t.Errorf("test case %q: teardown() error: %v", tt.name, err)
+		}
+		if slept != tt.wantSlept {
+			t.Errorf("test case %q: teardown() slept %s, want %s", tt.name, slept, tt.wantSlept)
+		}
+		if agent.getState() != stopped {
+			t.Errorf("test case %q: teardown() did not stop the agent", tt.name)
+		}
+		agent.stop()
+		agent.setDraining(false)
+		agent.setPort(wsfcDefaultAgentPort)
+	}
+}
+
+func TestWsfcNetwork(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"", "tcp"},
+		{"[wsfc]\nip_version=any", "tcp"},
+		{"[wsfc]\nip_version=ipv4", "tcp4"},
+		{"[wsfc]\nip_version=ipv6", "tcp6"},
+		{"[wsfc]\nip_version=bogus", "tcp"},
+	}
+	for _, tt := range tests {
+		cfg, err := ini.InsensitiveLoad([]byte(tt.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := wsfcNetwork(cfg); got != tt.want {
+			t.Errorf("wsfcNetwork(%q) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestCheckIPExist(t *testing.T) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() {
+			continue
+		}
+		// IPv6 addresses match in expanded form too.
+		ip := ipnet.IP.String()
+		if ipnet.IP.To4() == nil && !strings.HasPrefix(ip, "::") {
+			ip = strings.Replace(ip, "::", ":0::", 1)
+		}
+		if got, err := checkIPExist(ip); got != "1" {
+			t.Errorf("checkIPExist(%q) = %v, want %v, error: %v", ip, got, "1", err)
+		}
+	}
+	for _, ip := range []string{"", "255.255.255.256", "127.0.0.1", "::1"} {
+		if got, _ := checkIPExist(ip); got != "0" {
+			t.Errorf("checkIPExist(%q) = %v, want %v", ip, got, "0")
+		}
+	}
+}
+
 func TestGetWsfcAgentInstance(t *testing.T) {
 	agentFirst := getWsfcAgentInstance()
 	agentSecond := getWsfcAgentInstance()
@@ -268,3 +562,99 @@ func TestGetWsfcAgentInstance(t *testing.T) {
 		t.Errorf("getWsfcAgentInstance is not returning same instance")
 	}
 }
+
+// writeTestCert writes a self-signed certificate and its key as PEM files to
+// dir.
+func writeTestCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "wsfc-test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestWsfcTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wsfc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+
+	tests := []struct {
+		name           string
+		tls            wsfcTLS
+		wantErr        bool
+		wantClientAuth tls.ClientAuthType
+	}{
+		{"server only", wsfcTLS{certFile: certFile, keyFile: keyFile}, false, tls.NoClientCert},
+		{"client CA", wsfcTLS{certFile: certFile, keyFile: keyFile, clientCAFile: certFile}, false, tls.RequireAndVerifyClientCert},
+		{"missing key", wsfcTLS{certFile: certFile, keyFile: filepath.Join(dir, "missing")}, true, tls.NoClientCert},
+		{"bad client CA", wsfcTLS{certFile: certFile, keyFile: keyFile, clientCAFile: keyFile}, true, tls.NoClientCert},
+	}
+	for _, tt := range tests {
+		cfg, err := tt.tls.config()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("test case %q: config() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if err == nil && cfg.ClientAuth != tt.wantClientAuth {
+			t.Errorf("test case %q: config() ClientAuth = %v, want %v", tt.name, cfg.ClientAuth, tt.wantClientAuth)
+		}
+	}
+}
+
+func TestWsfcRunAgentTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wsfc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir)
+
+	agent := &wsfcAgent{port: "59997", tls: wsfcTLS{certFile: certFile, keyFile: keyFile}, waitGroup: &sync.WaitGroup{}, listeners: map[string]*net.TCPListener{}}
+	if err := agent.run(); err != nil {
+		t.Fatal(err)
+	}
+	defer agent.stop()
+
+	conn, err := tls.Dial("tcp", "localhost:"+agent.getPort(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("TLS health check failed: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "255.255.255.256")
+	if got, _ := bufio.NewReader(conn).ReadString('\n'); got != "0" {
+		t.Errorf("TLS health check got = %v, want %v", got, "0")
+	}
+
+	// Plaintext requests are not answered.
+	if got, _ := getHealthCheckResponce("255.255.255.256", agent); got == "0" {
+		t.Error("plaintext health check answered by TLS agent")
+	}
+}
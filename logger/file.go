@@ -0,0 +1,138 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package logger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// rotateRetry is how long after a failed rotation the file is rotated, or
+// reopened, again. The file may be held open by another process, such as a
+// log shipper or a virus scanner.
+var rotateRetry = time.Minute
+
+// FileBackend is a Backend that writes entries to a file, in the format set
+// with SetFormat, and rotates it by size.
+type FileBackend struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+	// retryAt is when to retry a failed rotation.
+	retryAt time.Time
+	closed  bool
+}
+
+// NewFileBackend opens path for appending. Once the file would grow past
+// maxSize bytes it is renamed to path.1, path.1 to path.2 and so on, keeping
+// at most maxFiles old files.
+func NewFileBackend(path string, maxSize int64, maxFiles int) (*FileBackend, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	b := &FileBackend{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := b.open(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (b *FileBackend) open() error {
+	f, err := os.OpenFile(b.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	b.f, b.size = f, fi.Size()
+	return nil
+}
+
+// Log writes e to the file. Errors are dropped as there is nowhere to log
+// them.
+func (b *FileBackend) Log(e Entry) {
+	line := e.Time.Local().Format("2006/01/02 15:04:05 ") + e.text()
+	if jsonFormat {
+		line = jsonEntry(e)
+	}
+	line += "\r\n"
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	if b.f == nil {
+		// Reopen the file a failed rotation couldn't.
+		if time.Now().Before(b.retryAt) {
+			return
+		}
+		if err := b.open(); err != nil {
+			b.retryAt = time.Now().Add(rotateRetry)
+			return
+		}
+	}
+	if b.size > 0 && b.size+int64(len(line)) > b.maxSize && !time.Now().Before(b.retryAt) {
+		// A file that couldn't be moved is reopened with its old size.
+		if err := b.rotate(); err != nil || b.size > 0 {
+			b.retryAt = time.Now().Add(rotateRetry)
+		}
+		if b.f == nil {
+			return
+		}
+	}
+	n, _ := b.f.WriteString(line)
+	b.size += int64(n)
+}
+
+// rotate shifts the old files up by one, dropping the oldest, and starts a
+// new file.
+func (b *FileBackend) rotate() error {
+	b.f.Close()
+	b.f = nil
+	for i := b.maxFiles - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", b.path, i), fmt.Sprintf("%s.%d", b.path, i+1))
+	}
+	if b.maxFiles > 0 {
+		os.Rename(b.path, b.path+".1")
+	} else {
+		os.Remove(b.path)
+	}
+	// If the file couldn't be moved, keep appending to it rather than lose
+	// entries.
+	return b.open()
+}
+
+// Close closes the file. Entries logged after Close are dropped.
+func (b *FileBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	if b.f == nil {
+		return nil
+	}
+	err := b.f.Close()
+	b.f = nil
+	return err
+}
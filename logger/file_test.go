@@ -0,0 +1,114 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package logger
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileBackendRotate(t *testing.T) {
+	var tests = []struct {
+		name      string
+		maxFiles  int
+		entries   int
+		wantFiles []string
+	}{
+		{"no rotation", 2, 1, []string{"agent.log"}},
+		{"rotated once", 2, 2, []string{"agent.log", "agent.log.1"}},
+		{"oldest dropped", 2, 4, []string{"agent.log", "agent.log.1", "agent.log.2"}},
+		{"no old files", 0, 3, []string{"agent.log"}},
+	}
+
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "logger")
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, "agent.log")
+		// Every entry fills a file.
+		b, err := NewFileBackend(path, 10, tt.maxFiles)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < tt.entries; i++ {
+			b.Log(Entry{Time: time.Now(), Severity: "INFO", Component: "test", Message: fmt.Sprint("entry ", i)})
+		}
+		b.Close()
+
+		var got []string
+		files, _ := ioutil.ReadDir(dir)
+		for _, f := range files {
+			got = append(got, f.Name())
+		}
+		if strings.Join(got, ",") != strings.Join(tt.wantFiles, ",") {
+			t.Errorf("test case %q: files got: %q, want: %q", tt.name, got, tt.wantFiles)
+		}
+		data, _ := ioutil.ReadFile(path)
+		if want := fmt.Sprint("entry ", tt.entries-1); !strings.Contains(string(data), want) {
+			t.Errorf("test case %q: %s got: %q, want the last entry %q", tt.name, path, data, want)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFileBackendRotateRetry(t *testing.T) {
+	oldRetry := rotateRetry
+	defer func() { rotateRetry = oldRetry }()
+	rotateRetry = time.Hour
+
+	dir, err := ioutil.TempDir("", "logger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "agent.log")
+	b, err := NewFileBackend(path, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	// A directory in the way of agent.log.1 fails the rotation.
+	if err := os.MkdirAll(filepath.Join(path+".1", "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		b.Log(Entry{Time: time.Now(), Severity: "INFO", Component: "test", Message: fmt.Sprint("entry ", i)})
+	}
+	if b.retryAt.IsZero() {
+		t.Error("failed rotation set no retry time")
+	}
+	data, _ := ioutil.ReadFile(path)
+	if got := strings.Count(string(data), "entry"); got != 3 {
+		t.Errorf("%s has %d entries, want all 3 appended while rotation backs off: %q", path, got, data)
+	}
+
+	os.RemoveAll(path + ".1")
+	b.Log(Entry{Time: time.Now(), Severity: "INFO", Component: "test", Message: "backing off"})
+	if _, err := os.Stat(path + ".1"); err == nil {
+		t.Error("rotated before the retry time")
+	}
+	b.retryAt = time.Now()
+	b.Log(Entry{Time: time.Now(), Severity: "INFO", Component: "test", Message: "retried"})
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("not rotated after the retry time: %v", err)
+	}
+}
@@ -17,12 +17,17 @@
 package logger
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/tarm/serial"
 )
@@ -31,10 +36,13 @@ var (
 	// Log is a log.Logger that writes to a serial console and stdout.
 	Log         *log.Logger
 	slInfo      *log.Logger
+	slWarning   *log.Logger
 	slError     *log.Logger
 	slFatal     *log.Logger
 	initialized bool
 	logger      string
+	jsonFormat  bool
+	level       severity = sInfo
 )
 
 // Init sets up logging and should be called before log functions, usually in
@@ -42,40 +50,201 @@ var (
 // output will go to COM1.
 func Init(name, port string) {
 	logger = name
-	out := io.MultiWriter(&serialPort{port}, os.Stdout)
 	// Split logging to the serial port and stdout from the event log so
 	// processes like the metadata script runner can log to serial output
 	// but not the system log.
-	Log = log.New(out, "", log.Ldate|log.Ltime)
+	Log = log.New(serialOutput(port), "", logFlags())
 	if err := slSetup(name); err != nil {
 		Log.Fatal(err)
 	}
 	initialized = true
 }
 
+// SetFormat selects the format of the serial console and stdout output,
+// "text" (the default) or "json". JSON output is one object per line with
+// the timestamp, severity, component, message and any fields, for log
+// pipelines to parse. The event log is always written as text.
+func SetFormat(format string) error {
+	switch strings.ToLower(format) {
+	case "", "text":
+		jsonFormat = false
+	case "json":
+		jsonFormat = true
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	if Log != nil {
+		Log.SetFlags(logFlags())
+	}
+	return nil
+}
+
+// SetLevel sets the minimum severity logged, "debug", "info" (the default),
+// "warning" or "error". Debug messages only go to the serial console and
+// stdout, never the event log.
+func SetLevel(l string) error {
+	switch strings.ToLower(l) {
+	case "debug":
+		level = sDebug
+	case "", "info":
+		level = sInfo
+	case "warning", "warn":
+		level = sWarning
+	case "error":
+		level = sError
+	default:
+		return fmt.Errorf("unknown log level %q", l)
+	}
+	return nil
+}
+
+func logFlags() int {
+	if jsonFormat {
+		return 0
+	}
+	return log.Ldate | log.Ltime
+}
+
+// Entry is a logged message as passed to backends.
+type Entry struct {
+	Time      time.Time              `json:"timestamp"`
+	Severity  string                 `json:"severity"`
+	Component string                 `json:"component"`
+	Caller    string                 `json:"caller,omitempty"`
+	Message   string                 `json:"message"`
+	Fields    map[string]interface{} `json:"fields,omitempty"`
+}
+
+// text formats e as written to the event log and, by default, the serial
+// console.
+func (e Entry) text() string {
+	msg := fmt.Sprintf("%s: %s", e.Component, e.Message)
+	switch {
+	case e.Caller != "":
+		msg = fmt.Sprintf("%s: %s %s: %s", e.Component, e.Severity, e.Caller, e.Message)
+	case e.Severity == "WARNING":
+		msg = fmt.Sprintf("%s: %s %s", e.Component, e.Severity, e.Message)
+	}
+	var keys []string
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		msg += fmt.Sprintf(" %s=%v", k, e.Fields[k])
+	}
+	return msg
+}
+
+// Backend receives every logged entry in addition to the serial console,
+// stdout and event log. Log is called synchronously and must not block.
+type Backend interface {
+	Log(e Entry)
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   []Backend
+)
+
+// AddBackend sends log entries to b.
+func AddBackend(b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends = append(backends[:len(backends):len(backends)], b)
+}
+
+// RemoveBackend stops sending log entries to b.
+func RemoveBackend(b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	var bs []Backend
+	for _, o := range backends {
+		if o != b {
+			bs = append(bs, o)
+		}
+	}
+	backends = bs
+}
+
 type severity int
 
 const (
-	sInfo = iota
+	sDebug severity = iota
+	sInfo
+	sWarning
 	sError
 	sFatal
 )
 
+// SetSerialPort changes the serial port written to after Init, "none" to
+// only write to stdout.
+func SetSerialPort(port string) {
+	Log.SetOutput(serialOutput(port))
+}
+
+func serialOutput(port string) io.Writer {
+	if port == "" || strings.EqualFold(port, "none") {
+		return os.Stdout
+	}
+	return io.MultiWriter(&serialPort{Port: port}, os.Stdout)
+}
+
+// Backoff between attempts to open a serial port that failed to open.
+const (
+	serialRetryMin = 10 * time.Second
+	serialRetryMax = 10 * time.Minute
+)
+
+// serialPort is only written through log.Logger, which serializes writes.
 type serialPort struct {
 	Port string
+	// retryAt is when to try opening the port again after backoff.
+	retryAt time.Time
+	backoff time.Duration
 }
 
+// Write writes b to the serial port. If the port can't be opened, such as
+// when another process holds it, writes are dropped until it is tried again
+// with exponential backoff, and stdout still gets the output.
 func (s *serialPort) Write(b []byte) (int, error) {
+	now := time.Now()
+	if now.Before(s.retryAt) {
+		return len(b), nil
+	}
 	c := &serial.Config{Name: s.Port, Baud: 115200}
 	p, err := serial.OpenPort(c)
 	if err != nil {
-		return 0, err
+		if s.backoff == 0 && slError != nil {
+			slError.Printf("%s: ERROR pausing serial logging, cannot open %s: %v", logger, s.Port, err)
+		}
+		s.backoff = nextSerialBackoff(s.backoff)
+		s.retryAt = now.Add(s.backoff)
+		return len(b), nil
 	}
 	defer p.Close()
+	if s.backoff != 0 {
+		s.backoff, s.retryAt = 0, time.Time{}
+		if slInfo != nil {
+			slInfo.Printf("%s: INFO resumed serial logging to %s", logger, s.Port)
+		}
+	}
 
 	return p.Write(b)
 }
 
+// nextSerialBackoff doubles d between serialRetryMin and serialRetryMax.
+func nextSerialBackoff(d time.Duration) time.Duration {
+	d *= 2
+	if d < serialRetryMin {
+		return serialRetryMin
+	}
+	if d > serialRetryMax {
+		return serialRetryMax
+	}
+	return d
+}
+
 func caller() string {
 	_, file, line, ok := runtime.Caller(3)
 	if !ok {
@@ -85,79 +254,209 @@ func caller() string {
 	return fmt.Sprintf("%s:%d", filepath.Base(file), line)
 }
 
-func output(s severity, txt string) {
+func output(s severity, txt string, kv []interface{}) {
+	if s < level {
+		return
+	}
 	if !initialized {
 		Init("logger", "COM1")
 	}
 
+	var sev, c string
+	var sl *log.Logger
 	switch s {
+	case sDebug:
+		sev, c = "DEBUG", caller()
 	case sInfo:
-		msg := fmt.Sprintf("%s: %s", logger, txt)
-		Log.Output(3, msg)
-		slInfo.Output(3, msg)
+		sev, sl = "INFO", slInfo
+	case sWarning:
+		sev, sl = "WARNING", slWarning
 	case sError:
-		msg := fmt.Sprintf("%s: ERROR %s: %s", logger, caller(), txt)
-		Log.Output(3, msg)
-		slError.Output(3, msg)
+		sev, c, sl = "ERROR", caller(), slError
 	case sFatal:
-		msg := fmt.Sprintf("%s: FATAL %s: %s", logger, caller(), txt)
-		Log.Output(3, msg)
-		slFatal.Output(3, msg)
+		sev, c, sl = "FATAL", caller(), slFatal
 	default:
 		panic(fmt.Sprintln("unrecognized severity:", s))
 	}
+
+	e := newEntry(sev, c, txt, kv)
+	if s != sFatal && repeated(e, sl) {
+		return
+	}
+	emit(e, sl)
+}
+
+// outputEvent is output for an info message logged to the event log with
+// event ID id. Events are never suppressed as repeated.
+func outputEvent(id uint32, txt string) {
+	if sInfo < level {
+		return
+	}
+	if !initialized {
+		Init("logger", "COM1")
+	}
+	emit(newEntry("INFO", "", txt, nil), slEvent(id))
+}
+
+// emit writes e to every output, and to sl in the event log if not nil.
+func emit(e Entry, sl *log.Logger) {
+	msg := e.text()
+	if jsonFormat {
+		Log.Output(4, jsonEntry(e))
+	} else {
+		Log.Output(4, msg)
+	}
+	if sl != nil {
+		sl.Output(4, msg)
+	}
+	backendsMu.RLock()
+	bs := backends
+	backendsMu.RUnlock()
+	for _, b := range bs {
+		b.Log(e)
+	}
+}
+
+// fieldValue returns the value at i of a key/value list, which is missing
+// if the list has an odd length.
+func fieldValue(kv []interface{}, i int) interface{} {
+	if i >= len(kv) {
+		return "MISSING"
+	}
+	switch v := kv[i].(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return kv[i]
+}
+
+func newEntry(sev, c, txt string, kv []interface{}) Entry {
+	e := Entry{
+		Time:      time.Now().UTC(),
+		Severity:  sev,
+		Component: logger,
+		Caller:    c,
+		Message:   strings.TrimSuffix(txt, "\n"),
+	}
+	if len(kv) > 0 {
+		e.Fields = make(map[string]interface{})
+		for i := 0; i < len(kv); i += 2 {
+			e.Fields[fmt.Sprint(kv[i])] = fieldValue(kv, i+1)
+		}
+	}
+	return e
+}
+
+// jsonEntry formats e as JSON, falling back to quoting the field values if
+// they can't be marshalled.
+func jsonEntry(e Entry) string {
+	b, err := json.Marshal(e)
+	if err != nil {
+		fields := make(map[string]interface{})
+		for k, v := range e.Fields {
+			fields[k] = fmt.Sprint(v)
+		}
+		e.Fields = fields
+		b, _ = json.Marshal(e)
+	}
+	return string(b)
+}
+
+// Debug logs with the DEBUG severity.
+// Arguments are handled in the manner of fmt.Print.
+func Debug(v ...interface{}) {
+	output(sDebug, fmt.Sprint(v...), nil)
+}
+
+// Debugf logs with the DEBUG severity.
+// Arguments are handled in the manner of fmt.Printf.
+func Debugf(format string, v ...interface{}) {
+	output(sDebug, fmt.Sprintf(format, v...), nil)
 }
 
 // Info logs with the INFO severity.
 // Arguments are handled in the manner of fmt.Print.
 func Info(v ...interface{}) {
-	output(sInfo, fmt.Sprint(v...))
+	output(sInfo, fmt.Sprint(v...), nil)
 }
 
 // Infoln logs with the INFO severity.
 // Arguments are handled in the manner of fmt.Println.
 func Infoln(v ...interface{}) {
-	output(sInfo, fmt.Sprintln(v...))
+	output(sInfo, fmt.Sprintln(v...), nil)
 }
 
 // Infof logs with the INFO severity.
 // Arguments are handled in the manner of fmt.Printf.
 func Infof(format string, v ...interface{}) {
-	output(sInfo, fmt.Sprintf(format, v...))
+	output(sInfo, fmt.Sprintf(format, v...), nil)
+}
+
+// InfoEventf logs with the INFO severity, using id as the event ID in the
+// event log so the event can be filtered on.
+// Arguments are handled in the manner of fmt.Printf.
+func InfoEventf(id uint32, format string, v ...interface{}) {
+	outputEvent(id, fmt.Sprintf(format, v...))
+}
+
+// Infow logs msg with the INFO severity and the given key/value pairs as
+// fields, such as Infow("Added address", "ip", ip, "mac", mac).
+func Infow(msg string, keysAndValues ...interface{}) {
+	output(sInfo, msg, keysAndValues)
+}
+
+// Warn logs with the WARNING severity.
+// Arguments are handled in the manner of fmt.Print.
+func Warn(v ...interface{}) {
+	output(sWarning, fmt.Sprint(v...), nil)
+}
+
+// Warnf logs with the WARNING severity.
+// Arguments are handled in the manner of fmt.Printf.
+func Warnf(format string, v ...interface{}) {
+	output(sWarning, fmt.Sprintf(format, v...), nil)
 }
 
 // Error logs with the ERROR severity.
 // Arguments are handled in the manner of fmt.Print.
 func Error(v ...interface{}) {
-	output(sError, fmt.Sprint(v...))
+	output(sError, fmt.Sprint(v...), nil)
 }
 
 // Errorln logs with the ERROR severity.
 // Arguments are handled in the manner of fmt.Println.
 func Errorln(v ...interface{}) {
-	output(sError, fmt.Sprintln(v...))
+	output(sError, fmt.Sprintln(v...), nil)
 }
 
 // Errorf logs with the Error severity.
 // Arguments are handled in the manner of fmt.Printf.
 func Errorf(format string, v ...interface{}) {
-	output(sError, fmt.Sprintf(format, v...))
+	output(sError, fmt.Sprintf(format, v...), nil)
+}
+
+// Errorw logs msg with the ERROR severity and the given key/value pairs as
+// fields.
+func Errorw(msg string, keysAndValues ...interface{}) {
+	output(sError, msg, keysAndValues)
 }
 
 // Fatal logs with the Fatal severity, and ends with os.Exit(1).
 // Arguments are handled in the manner of fmt.Print.
 func Fatal(v ...interface{}) {
-	output(sFatal, fmt.Sprint(v...))
+	output(sFatal, fmt.Sprint(v...), nil)
 }
 
 // Fatalln logs with the Fatal severity, and ends with os.Exit(1).
 // Arguments are handled in the manner of fmt.Println.
 func Fatalln(v ...interface{}) {
-	output(sFatal, fmt.Sprintln(v...))
+	output(sFatal, fmt.Sprintln(v...), nil)
 }
 
 // Fatalf logs with the Fatal severity, and ends with os.Exit(1).
 // Arguments are handled in the manner of fmt.Printf.
 func Fatalf(format string, v ...interface{}) {
-	output(sFatal, fmt.Sprintf(format, v...))
+	output(sFatal, fmt.Sprintf(format, v...), nil)
 }
@@ -22,7 +22,12 @@ import (
 func slSetup(src string) error {
 	// Linux stub for running tests.
 	slInfo = log.New(ioutil.Discard, "", 0)
+	slWarning = slInfo
 	slError = slInfo
 	slFatal = slInfo
 	return nil
 }
+
+func slEvent(id uint32) *log.Logger {
+	return slInfo
+}
@@ -0,0 +1,84 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONFormat(t *testing.T) {
+	Init("test", "none")
+	defer SetFormat("text")
+
+	var tests = []struct {
+		name string
+		log  func()
+		want map[string]interface{}
+	}{
+		{
+			"info",
+			func() { Info("hello") },
+			map[string]interface{}{"severity": "INFO", "component": "test", "message": "hello"},
+		},
+		{
+			"fields",
+			func() { Infow("Added address", "ip", "10.0.0.1", "count", 2) },
+			map[string]interface{}{"severity": "INFO", "component": "test", "message": "Added address", "fields": map[string]interface{}{"ip": "10.0.0.1", "count": 2.0}},
+		},
+		{
+			"unmarshallable field",
+			func() { Infow("nan", "value", math.NaN()) },
+			map[string]interface{}{"severity": "INFO", "component": "test", "message": "nan", "fields": map[string]interface{}{"value": "NaN"}},
+		},
+		{
+			"warning",
+			func() { Warnf("%s", "careful") },
+			map[string]interface{}{"severity": "WARNING", "component": "test", "message": "careful"},
+		},
+	}
+
+	if err := SetFormat("json"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		Log.SetOutput(&buf)
+		tt.log()
+		line := strings.TrimSpace(buf.String())
+		var got map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Errorf("test case %q: output %q is not JSON: %v", tt.name, line, err)
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, got["timestamp"].(string)); err != nil {
+			t.Errorf("test case %q: timestamp %v: %v", tt.name, got["timestamp"], err)
+		}
+		delete(got, "timestamp")
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(tt.want)
+		if !bytes.Equal(gotJSON, wantJSON) {
+			t.Errorf("test case %q: got %s, want %s", tt.name, gotJSON, wantJSON)
+		}
+	}
+
+	if err := SetFormat("xml"); err == nil {
+		t.Error("SetFormat(xml) returned no error")
+	}
+}
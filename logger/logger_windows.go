@@ -24,17 +24,27 @@ import (
 	"golang.org/x/sys/windows/svc/eventlog"
 )
 
+// elInfo is the event log writer of info messages, used by slEvent.
+var elInfo *writer
+
 type writer struct {
 	pri severity
 	src string
 	el  *eventlog.Log
+	// id is the event ID, zero for the default of the severity.
+	id uint32
 }
 
 // Write sends a log message to the Event Log.
 func (w *writer) Write(b []byte) (int, error) {
 	switch w.pri {
 	case sInfo:
+		if w.id != 0 {
+			return len(b), w.el.Info(w.id, string(b))
+		}
 		return len(b), w.el.Info(1, string(b))
+	case sWarning:
+		return len(b), w.el.Warning(3, string(b))
 	case sError:
 		return len(b), w.el.Error(2, string(b))
 	}
@@ -42,7 +52,7 @@ func (w *writer) Write(b []byte) (int, error) {
 }
 
 func newW(pri severity, src string) (*writer, error) {
-	if err := eventlog.InstallAsEventCreate(src, eventlog.Info|eventlog.Error); err != nil {
+	if err := eventlog.InstallAsEventCreate(src, eventlog.Info|eventlog.Warning|eventlog.Error); err != nil {
 		if !strings.Contains(err.Error(), "registry key already exists") {
 			return nil, err
 		}
@@ -65,6 +75,12 @@ func slSetup(src string) error {
 		return err
 	}
 	slInfo = log.New(infoL, "INFO: ", flags)
+	elInfo = infoL
+	warnL, err := newW(sWarning, src)
+	if err != nil {
+		return err
+	}
+	slWarning = log.New(warnL, "WARNING: ", flags)
 	errL, err := newW(sError, src)
 	if err != nil {
 		return err
@@ -73,3 +89,14 @@ func slSetup(src string) error {
 	slFatal = log.New(errL, "FATAL: ", flags)
 	return nil
 }
+
+// slEvent returns a logger writing info messages to the event log with event
+// ID id.
+func slEvent(id uint32) *log.Logger {
+	if elInfo == nil {
+		return nil
+	}
+	w := *elInfo
+	w.id = id
+	return log.New(&w, "INFO: ", slInfo.Flags())
+}
@@ -0,0 +1,78 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package logger
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// repeat tracks a message logged within the repeat window.
+type repeat struct {
+	entry Entry
+	sl    *log.Logger
+	count int
+}
+
+var (
+	repeatMu     sync.Mutex
+	repeatWindow time.Duration
+	repeats      = make(map[string]*repeat)
+)
+
+// SetRepeatWindow suppresses messages identical to one logged less than d
+// ago. When the window ends a single "last message repeated N times" line is
+// logged in their place. Zero, the default, logs every message.
+func SetRepeatWindow(d time.Duration) {
+	repeatMu.Lock()
+	defer repeatMu.Unlock()
+	repeatWindow = d
+}
+
+// repeated reports whether e repeats a message in the current window, and
+// otherwise starts a window for it.
+func repeated(e Entry, sl *log.Logger) bool {
+	repeatMu.Lock()
+	defer repeatMu.Unlock()
+	if repeatWindow <= 0 {
+		return false
+	}
+	key := e.Severity + " " + e.text()
+	if r, ok := repeats[key]; ok {
+		r.count++
+		return true
+	}
+	repeats[key] = &repeat{entry: e, sl: sl}
+	time.AfterFunc(repeatWindow, func() { endRepeat(key) })
+	return false
+}
+
+// endRepeat ends the window for key, logging how often its message was
+// suppressed.
+func endRepeat(key string) {
+	repeatMu.Lock()
+	r := repeats[key]
+	delete(repeats, key)
+	repeatMu.Unlock()
+	if r == nil || r.count == 0 {
+		return
+	}
+	e := r.entry
+	e.Time = time.Now().UTC()
+	e.Message = fmt.Sprintf("last message repeated %d times: %s", r.count, e.Message)
+	emit(e, r.sl)
+}
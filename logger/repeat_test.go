@@ -0,0 +1,91 @@
+//  Copyright 2018 Google Inc. All Rights Reserved.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the License.
+//  You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//  Unless required by applicable law or agreed to in writing, software
+//  distributed under the License is distributed on an "AS IS" BASIS,
+//  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//  See the License for the specific language governing permissions and
+//  limitations under the License.
+
+package logger
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureBackend records the messages logged.
+type captureBackend struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (c *captureBackend) Log(e Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, e.Message)
+}
+
+func (c *captureBackend) logged() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.messages...)
+}
+
+// setupCapture initializes the logger without a serial port and captures
+// what it logs.
+func setupCapture(t *testing.T) (*captureBackend, func()) {
+	Init("test", "none")
+	Log.SetOutput(ioutil.Discard)
+	c := &captureBackend{}
+	AddBackend(c)
+	return c, func() { RemoveBackend(c) }
+}
+
+func TestRepeatSuppression(t *testing.T) {
+	c, cleanup := setupCapture(t)
+	defer cleanup()
+	defer SetRepeatWindow(0)
+
+	var tests = []struct {
+		name   string
+		window time.Duration
+		log    []string
+		want   []string
+	}{
+		{"off", 0, []string{"a", "a"}, []string{"a", "a"}},
+		{"repeated", 50 * time.Millisecond, []string{"a", "a", "a"}, []string{"a", "last message repeated 2 times: a"}},
+		{"distinct", 50 * time.Millisecond, []string{"a", "b"}, []string{"a", "b"}},
+		{"interleaved", 50 * time.Millisecond, []string{"a", "b", "a"}, []string{"a", "b", "last message repeated 1 times: a"}},
+	}
+
+	for _, tt := range tests {
+		c.mu.Lock()
+		c.messages = nil
+		c.mu.Unlock()
+		SetRepeatWindow(tt.window)
+		for _, m := range tt.log {
+			Info(m)
+		}
+		// Let the windows end.
+		time.Sleep(2*tt.window + 20*time.Millisecond)
+		got := c.logged()
+		if len(got) != len(tt.want) {
+			t.Errorf("test case %q: logged %q, want %q", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("test case %q: logged %q, want %q", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}